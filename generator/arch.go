@@ -0,0 +1,84 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// archInfo is an architecture booster generates images for
+type archInfo struct {
+	kernelDir string // the kernel arch directory, the arch-specific modules are at kernel/arch/$DIR
+	machine   elf.Machine
+	class     elf.Class
+	byteOrder binary.ByteOrder
+}
+
+// archInfos are the supported architectures keyed by their GOARCH names, the same names init uses to pick
+// the Discoverable Partitions Specification types
+var archInfos = map[string]archInfo{
+	"386":     {"x86", elf.EM_386, elf.ELFCLASS32, binary.LittleEndian},
+	"amd64":   {"x86", elf.EM_X86_64, elf.ELFCLASS64, binary.LittleEndian},
+	"arm":     {"arm", elf.EM_ARM, elf.ELFCLASS32, binary.LittleEndian},
+	"arm64":   {"arm64", elf.EM_AARCH64, elf.ELFCLASS64, binary.LittleEndian},
+	"loong64": {"loongarch", elf.Machine(258), elf.ELFCLASS64, binary.LittleEndian}, // EM_LOONGARCH
+	"ppc64":   {"powerpc", elf.EM_PPC64, elf.ELFCLASS64, binary.BigEndian},
+	"ppc64le": {"powerpc", elf.EM_PPC64, elf.ELFCLASS64, binary.LittleEndian},
+	"riscv64": {"riscv", elf.EM_RISCV, elf.ELFCLASS64, binary.LittleEndian},
+	"s390x":   {"s390", elf.EM_S390, elf.ELFCLASS64, binary.BigEndian},
+}
+
+func checkTargetArch(arch string) error {
+	if _, ok := archInfos[arch]; ok {
+		return nil
+	}
+	var supported []string
+	for a := range archInfos {
+		supported = append(supported, a)
+	}
+	sort.Strings(supported)
+	return fmt.Errorf("unsupported architecture %s, expected one of: %s", arch, strings.Join(supported, ", "))
+}
+
+// elfArch returns the architecture the ELF file is built for, or an empty string if it is not a supported one
+func elfArch(ef *elf.File) string {
+	for name, a := range archInfos {
+		if ef.Machine == a.machine && ef.Class == a.class && ef.ByteOrder == a.byteOrder {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkElfArch checks that the binary added to the image is built for the target architecture
+func checkElfArch(name string, ef *elf.File, arch string) error {
+	if arch == "" {
+		return nil
+	}
+	if got := elfArch(ef); got != arch {
+		if got == "" {
+			got = ef.Machine.String()
+		}
+		return fmt.Errorf("%s is built for %s but the image is generated for %s", name, got, arch)
+	}
+	return nil
+}
+
+// archModules returns the modules list for the target architecture, the x86 arch-specific modules dirs are replaced
+// with the target ones
+func archModules(modules []string, arch string) []string {
+	a, ok := archInfos[arch]
+	if !ok || a.kernelDir == "x86" {
+		return modules
+	}
+	result := make([]string, len(modules))
+	for i, m := range modules {
+		if strings.HasPrefix(m, "kernel/arch/x86/") {
+			m = "kernel/arch/" + a.kernelDir + "/" + strings.TrimPrefix(m, "kernel/arch/x86/")
+		}
+		result[i] = m
+	}
+	return result
+}
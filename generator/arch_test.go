@@ -0,0 +1,49 @@
+package main
+
+import (
+	"debug/elf"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestCheckTargetArch(t *testing.T) {
+	if err := checkTargetArch("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "unsupported architecture x86_64, expected one of: 386, amd64, arm, arm64, loong64, ppc64, ppc64le, riscv64, s390x"
+	if err := checkTargetArch("x86_64"); err == nil || err.Error() != expected {
+		t.Fatalf("expected error '%s', got '%v'", expected, err)
+	}
+}
+
+func TestElfArch(t *testing.T) {
+	ef, err := elf.Open("/usr/bin/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ef.Close()
+	if arch := elfArch(ef); arch != runtime.GOARCH {
+		t.Fatalf("expected /usr/bin/true to be built for %s, got '%s'", runtime.GOARCH, arch)
+	}
+	if err := checkElfArch("/usr/bin/true", ef, runtime.GOARCH); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkElfArch("/usr/bin/true", ef, "s390x"); err == nil {
+		t.Fatal("expected an architecture mismatch")
+	}
+}
+
+func TestArchModules(t *testing.T) {
+	modules := []string{"kernel/arch/x86/crypto/", "kernel/crypto/", "sd_mod"}
+	if got := archModules(modules, "amd64"); !reflect.DeepEqual(got, modules) {
+		t.Fatalf("unexpected amd64 modules %q", got)
+	}
+	expected := []string{"kernel/arch/arm64/crypto/", "kernel/crypto/", "sd_mod"}
+	if got := archModules(modules, "arm64"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected arm64 modules %q, got %q", expected, got)
+	}
+	if modules[0] != "kernel/arch/x86/crypto/" {
+		t.Fatal("the original list is expected to be kept")
+	}
+}
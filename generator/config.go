@@ -6,6 +6,9 @@ import (
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,15 +26,131 @@ type UserConfig struct {
 		Ip         string `yaml:",omitempty"`            // e.g. 10.0.2.15/24
 		Gateway    string `yaml:",omitempty"`            // e.g. 10.0.2.255
 		DNSServers string `yaml:"dns_servers,omitempty"` // comma-separated list of ips, e.g. 10.0.1.1,8.8.8.8
+
+		KeyServerCA       string `yaml:"key_server_ca,omitempty"`       // CA bundle to verify the rd.luks.keyfile HTTPS server
+		KeyServerInsecure bool   `yaml:"key_server_insecure,omitempty"` // do not verify the rd.luks.keyfile server certificate
+		Wireguard         string `yaml:",omitempty"`                    // WireGuard tunnel config in the wg-quick format
+	}
+	Universal            bool                 `yaml:",omitempty"`
+	UniversalModules     string               `yaml:"universal_modules,omitempty"`   // module set of the universal image: storage, net or all
+	HostOnlyDevices      bool                 `yaml:"host_only_devices,omitempty"`   // add only the drivers of the present devices to a host-specific image
+	Modules              string               `yaml:",omitempty"`                    // comma separated list of extra modules to add to initramfs
+	ModulesForceLoad     string               `yaml:"modules_force_load,omitempty"`  // comma separated list of extra modules to load at the boot time
+	ModulesBlocklist     string               `yaml:"modules_blocklist,omitempty"`   // comma separated list of modules that must not be added to the image
+	Compression          string               `yaml:",omitempty"`                    // output file compression
+	CompressionLevel     int                  `yaml:"compression_level,omitempty"`   // output file compression level, the compressor default if not set
+	ModulesCompression   string               `yaml:"modules_compression,omitempty"` // compression of the kernel modules inside the image
+	MountTimeout         string               `yaml:"mount_timeout,omitempty"`       // timeout for waiting for the rootfs mounted
+	ExtraFiles           ExtraFilesConfig     `yaml:"extra_files,omitempty"`         // files to add to image, either a comma-separated list or a list of files and mappings
+	FirmwareFiles        string               `yaml:"firmware_files,omitempty"`      // comma-separated list of firmware globs relative to /usr/lib/firmware
+	Microcode            string               `yaml:",omitempty"`                    // add early CPU microcode, either true or a path to a prebuilt microcode archive
+	VerityPublicKey      string               `yaml:"verity_public_key,omitempty"`   // PEM public key verifying the signature of the dm-verity root hash
+	Crypttab             string               `yaml:",omitempty"`                    // crypttab file that lists the LUKS devices to unlock at boot
+	Fsck                 string               `yaml:",omitempty"`                    // comma-separated list of filesystem types whose checkers are added, e.g. ext4,vfat
+	MeasureRootPcr       *int                 `yaml:"measure_root_pcr,omitempty"`    // TPM2 PCR to extend with the identity of the mounted root filesystem
+	RandomSeed           bool                 `yaml:"random_seed,omitempty"`         // embed a random seed generated for each image, init mixes it into the kernel RNG
+	VirtioRng            bool                 `yaml:"virtio_rng,omitempty"`          // add virtio-rng driver, init seeds the kernel RNG from the host
+	Plymouth             bool                 `yaml:",omitempty"`                    // add plymouth to show the boot splash and ask the passphrases
+	StripBinaries        bool                 `yaml:"strip,omitempty"`               // if strip symbols from the binaries, shared libraries and kernel modules
+	StaticInit           bool                 `yaml:"static_init,omitempty"`         // require a statically linked init binary so the image does not need its libc
+	EnableVirtualConsole VirtualConsoleConfig `yaml:"vconsole,omitempty"`            // configure virtual console at boot time using config from https://www.freedesktop.org/software/systemd/man/vconsole.conf.html
+	Mounts               []InitMount          `yaml:",omitempty"`                    // extra filesystems to mount under the root before switching to it, e.g. /var
+	FactoryReset         *InitFactoryReset    `yaml:"factory_reset,omitempty"`       // root partition that is recreated on request, e.g. at the first boot
+	Credentials          []CredentialConfig   `yaml:",omitempty"`                    // secrets passed to the booted system as systemd credentials
+	Hooks                []HookConfig         `yaml:",omitempty"`                    // executables run in order right before switching to the root
+	UdevRules            string               `yaml:"udev_rules,omitempty"`          // comma-separated list of udev rules files that name the devices at boot
+}
+
+// HookConfig is a script or a binary that init runs before switching to the root
+type HookConfig struct {
+	File  string
+	Fatal bool `yaml:",omitempty"` // a failed hook stops the boot
+}
+
+// CredentialConfig is a systemd credential that init delivers to the booted system, its value is either embedded
+// to the image from a file or fetched from the key server at boot
+type CredentialConfig struct {
+	Name string
+	File string `yaml:",omitempty"`
+	Url  string `yaml:",omitempty"`
+}
+
+// ExtraFile is an item of extra_files. Source is added at Dest if it is set, Mode overrides the source permissions.
+type ExtraFile struct {
+	Source string
+	Dest   string `yaml:",omitempty"`
+	Mode   string `yaml:",omitempty"` // octal permissions, e.g. 0755
+}
+
+// ExtraFilesConfig is either a comma-separated list of files, e.g. 'extra_files: vim,fsck', or a list whose items are
+// files or mappings, e.g. '{source: /usr/local/bin/helper, dest: /usr/bin/helper, mode: 0700}'
+type ExtraFilesConfig []ExtraFile
+
+func (c *ExtraFilesConfig) UnmarshalYAML(value *yaml.Node) error {
+	*c = nil
+	if value.Kind == yaml.ScalarNode {
+		var list string
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		for _, f := range strings.Split(list, ",") {
+			*c = append(*c, ExtraFile{Source: f})
+		}
+		return nil
+	}
+	var items []yaml.Node
+	if err := value.Decode(&items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		var f ExtraFile
+		if item.Kind == yaml.ScalarNode {
+			if err := item.Decode(&f.Source); err != nil {
+				return err
+			}
+		} else if err := item.Decode(&f); err != nil {
+			return err
+		}
+		*c = append(*c, f)
 	}
-	Universal            bool   `yaml:",omitempty"`
-	Modules              string `yaml:",omitempty"`                   // comma separated list of extra modules to add to initramfs
-	ModulesForceLoad     string `yaml:"modules_force_load,omitempty"` // comma separated list of extra modules to load at the boot time
-	Compression          string `yaml:",omitempty"`                   // output file compression
-	MountTimeout         string `yaml:"mount_timeout,omitempty"`      // timeout for waiting for the rootfs mounted
-	ExtraFiles           string `yaml:"extra_files,omitempty"`        // comma-separated list of files to add to image
-	StripBinaries        bool   `yaml:"strip,omitempty"`              // if strip symbols from the binaries, shared libraries and kernel modules
-	EnableVirtualConsole bool   `yaml:"vconsole,omitempty"`           // configure virtual console at boot time using config from https://www.freedesktop.org/software/systemd/man/vconsole.conf.html
+	return nil
+}
+
+// VirtualConsoleConfig is either a flag that enables the console configuration from /etc/vconsole.conf or
+// the configuration itself, e.g. 'vconsole: {keymap: de-latin1}'
+type VirtualConsoleConfig struct {
+	Enabled      bool   `yaml:"-"`
+	Keymap       string `yaml:",omitempty"`
+	KeymapToggle string `yaml:"keymap_toggle,omitempty"`
+	Font         string `yaml:",omitempty"`
+	FontMap      string `yaml:"font_map,omitempty"`
+	FontUnimap   string `yaml:"font_unimap,omitempty"`
+	properties   map[string]string
+}
+
+func (c *VirtualConsoleConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&c.Enabled)
+	}
+	type plain VirtualConsoleConfig
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.Enabled = true
+	// the same names as in vconsole.conf
+	c.properties = make(map[string]string)
+	for k, v := range map[string]string{
+		"KEYMAP":        c.Keymap,
+		"KEYMAP_TOGGLE": c.KeymapToggle,
+		"FONT":          c.Font,
+		"FONT_MAP":      c.FontMap,
+		"FONT_UNIMAP":   c.FontUnimap,
+	} {
+		if v != "" {
+			c.properties[k] = v
+		}
+	}
+	return nil
 }
 
 // read user config from the specified file. If file parameter is empty string then "empty" configuration is considered
@@ -68,6 +187,9 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 				n.Ip, n.Gateway, n.DNSServers,
 			}
 		}
+		conf.keyServerCA = n.KeyServerCA
+		conf.keyServerInsecure = n.KeyServerInsecure
+		conf.wireguardConfig = n.Wireguard
 
 		if u.Network.Interfaces != "" {
 			// get MAC addresses for the specified interface names
@@ -90,15 +212,169 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 		}
 	}
 	conf.universal = u.Universal || *universal
+	conf.overlay = *overlay
+	if *universalModules != "" {
+		u.UniversalModules = *universalModules
+	}
+	switch u.UniversalModules {
+	case "", "all":
+		conf.universalModules = "all"
+	case "storage", "net":
+		conf.universalModules = u.UniversalModules
+	default:
+		return nil, fmt.Errorf("config: unknown universal_modules %s, expected one of storage, net, all", u.UniversalModules)
+	}
+	conf.hostOnlyDevices = u.HostOnlyDevices
 	if u.Modules != "" {
 		conf.modules = strings.Split(u.Modules, ",")
 	}
 	if u.ModulesForceLoad != "" {
 		conf.modulesForceLoad = strings.Split(u.ModulesForceLoad, ",")
 	}
+	if u.ModulesBlocklist != "" {
+		conf.modulesBlocklist = strings.Split(u.ModulesBlocklist, ",")
+		for _, b := range conf.modulesBlocklist {
+			for _, f := range conf.modulesForceLoad {
+				if normalizeModuleName(b) == normalizeModuleName(f) {
+					return nil, fmt.Errorf("config: module %s is specified both in modules_force_load and modules_blocklist", f)
+				}
+			}
+		}
+	}
 	conf.compression = u.Compression
-	if u.ExtraFiles != "" {
-		conf.extraFiles = strings.Split(u.ExtraFiles, ",")
+	switch u.ModulesCompression {
+	case "", "none":
+		conf.modulesCompression = "none"
+	case "zstd", "xz", "gzip":
+		conf.modulesCompression = u.ModulesCompression
+	default:
+		return nil, fmt.Errorf("config: unknown modules_compression %s, expected one of none, zstd, xz, gzip", u.ModulesCompression)
+	}
+	conf.verityPublicKey = u.VerityPublicKey
+	conf.crypttab = u.Crypttab
+	if u.Fsck != "" {
+		conf.fsck = strings.Split(u.Fsck, ",")
+	}
+	if p := u.MeasureRootPcr; p != nil && (*p < 0 || *p > 23) {
+		return nil, fmt.Errorf("config: invalid measure_root_pcr %d, expected a PCR index 0-23", *p)
+	}
+	conf.measureRootPcr = u.MeasureRootPcr
+	conf.randomSeed = u.RandomSeed
+	conf.staticInit = u.StaticInit
+	conf.virtioRng = u.VirtioRng
+	for _, f := range u.ExtraFiles {
+		if f.Source == "" {
+			return nil, fmt.Errorf("config: extra_files item does not specify the source")
+		}
+		if f.Dest == "" && f.Mode == "" {
+			conf.extraFiles = append(conf.extraFiles, f.Source)
+			continue
+		}
+		m := extraFileMapping{source: f.Source, dest: f.Dest}
+		if !strings.HasPrefix(m.source, "/") {
+			m.source = "/usr/bin/" + m.source
+		}
+		if m.dest == "" {
+			m.dest = m.source
+		}
+		if !filepath.IsAbs(m.dest) {
+			return nil, fmt.Errorf("config: extra file %s destination '%s' is expected to be an absolute path", f.Source, f.Dest)
+		}
+		if f.Mode != "" {
+			mode, err := strconv.ParseUint(f.Mode, 8, 32)
+			if err != nil || mode > 0777 {
+				return nil, fmt.Errorf("config: invalid mode '%s' of extra file %s, expected octal permissions, e.g. 0755", f.Mode, f.Source)
+			}
+			m.mode = os.FileMode(mode)
+			m.hasMode = true
+		}
+		conf.extraFileMappings = append(conf.extraFileMappings, m)
+	}
+	if u.FirmwareFiles != "" {
+		conf.firmwareFiles = strings.Split(u.FirmwareFiles, ",")
+	}
+	switch m := u.Microcode; {
+	case m == "" || m == "false" || m == "no" || m == "off":
+	case m == "true" || m == "yes" || m == "on":
+		conf.microcode = true
+	case filepath.IsAbs(m):
+		conf.microcodeImage = m
+	default:
+		return nil, fmt.Errorf("config: invalid microcode value %s, expected a boolean or an absolute path to the microcode archive", m)
+	}
+	if conf.overlay && (conf.microcode || conf.microcodeImage != "") {
+		// the kernel looks for the microcode in the first archive only
+		return nil, fmt.Errorf("config: microcode cannot be added to an overlay image, add it to the base image instead")
+	}
+	targets := make(set)
+	for _, m := range u.Mounts {
+		if m.Device == "" {
+			return nil, fmt.Errorf("config: mount %s does not specify the device", m.Target)
+		}
+		target := filepath.Clean(m.Target)
+		if !filepath.IsAbs(target) || target == "/" {
+			return nil, fmt.Errorf("config: invalid mount target '%s' of %s, expected an absolute path other than /", m.Target, m.Device)
+		}
+		if targets[target] {
+			return nil, fmt.Errorf("config: mount target %s is specified more than once", target)
+		}
+		targets[target] = true
+		for _, o := range strings.Split(m.Options, ",") {
+			if (o == "bind" || o == "rbind") && (!filepath.IsAbs(m.Device) || m.Fstype != "") {
+				return nil, fmt.Errorf("config: bind mount %s expects an absolute path inside the root filesystem as the device and no fstype", target)
+			}
+		}
+		m.Target = target
+		conf.mounts = append(conf.mounts, m)
+	}
+	names := make(set)
+	for _, c := range u.Credentials {
+		if c.Name == "" || c.Name == "." || c.Name == ".." || strings.ContainsRune(c.Name, '/') || len(c.Name) > 255 {
+			return nil, fmt.Errorf("config: invalid credential name '%s'", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("config: credential %s is specified more than once", c.Name)
+		}
+		names[c.Name] = true
+		if (c.File == "") == (c.Url == "") {
+			return nil, fmt.Errorf("config: credential %s is expected to specify either file or url", c.Name)
+		}
+		if c.Url != "" && !strings.HasPrefix(c.Url, "https://") && !strings.HasPrefix(c.Url, "http://") {
+			return nil, fmt.Errorf("config: credential %s url %s is expected to be http(s)", c.Name, c.Url)
+		}
+		if c.Url != "" && conf.networkConfigType == netOff {
+			return nil, fmt.Errorf("config: credential %s is fetched from %s but the network is not configured", c.Name, c.Url)
+		}
+		conf.credentials = append(conf.credentials, c)
+	}
+	if u.UdevRules != "" {
+		names := make(set)
+		for _, f := range strings.Split(u.UdevRules, ",") {
+			name := filepath.Base(f)
+			if !strings.HasSuffix(name, ".rules") {
+				return nil, fmt.Errorf("config: udev rules file '%s' is expected to have .rules extension", f)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("config: udev rules file name %s is used more than once", name)
+			}
+			names[name] = true
+			conf.udevRules = append(conf.udevRules, f)
+		}
+	}
+	for _, h := range u.Hooks {
+		if !filepath.IsAbs(h.File) {
+			return nil, fmt.Errorf("config: hook file '%s' is expected to be an absolute path", h.File)
+		}
+		conf.hooks = append(conf.hooks, h)
+	}
+	if r := u.FactoryReset; r != nil {
+		if !strings.HasPrefix(r.Device, "PARTUUID=") && !strings.HasPrefix(r.Device, "PARTLABEL=") {
+			return nil, fmt.Errorf("config: invalid factory_reset device '%s', expected a partition specified with PARTUUID= or PARTLABEL=", r.Device)
+		}
+		if r.Fstype == "" {
+			return nil, fmt.Errorf("config: factory_reset does not specify the fstype")
+		}
+		conf.factoryReset = r
 	}
 	if u.MountTimeout != "" {
 		timeout, err := time.ParseDuration(u.MountTimeout)
@@ -108,6 +384,15 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 		conf.timeout = timeout
 	}
 
+	// https://reproducible-builds.org/specs/source-date-epoch/
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH value %s, expected a non-negative number of seconds since the Unix epoch", epoch)
+		}
+		conf.modTime = time.Unix(sec, 0)
+	}
+
 	// now check command line flags
 	conf.output = *outputFile
 	conf.forceOverwrite = *forceOverwriteFile
@@ -115,26 +400,81 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 	if *compression != "" {
 		conf.compression = *compression
 	}
+	if *noCompression {
+		if *compression != "" && *compression != "none" {
+			return nil, fmt.Errorf("-noCompression cannot be used together with -compression=%s", *compression)
+		}
+		// the kernel unpacks an uncompressed cpio archive as well, the config compression level is not used then
+		conf.compression = "none"
+		u.CompressionLevel = 0
+	}
 	if conf.compression == "" {
 		conf.compression = "zstd"
 	}
-	if *kernelVersion != "" {
+	if u.CompressionLevel != 0 {
+		levels, ok := compressionLevels[conf.compression]
+		if !ok {
+			return nil, fmt.Errorf("config: compression_level is not supported for %s compression", conf.compression)
+		}
+		if u.CompressionLevel < levels[0] || u.CompressionLevel > levels[1] {
+			return nil, fmt.Errorf("config: %s compression_level %d is out of range %d-%d", conf.compression, u.CompressionLevel, levels[0], levels[1])
+		}
+		conf.compressionLevel = u.CompressionLevel
+	}
+	switch {
+	case *sysroot != "":
+		dir, ver, err := sysrootKernel(*sysroot, *kernelVersion)
+		if err != nil {
+			return nil, err
+		}
+		conf.kernelVersion, conf.modulesDir = ver, dir
+	case *kernelVersion != "":
 		conf.kernelVersion = *kernelVersion
-	} else {
+		conf.modulesDir = path.Join("/usr/lib/modules", conf.kernelVersion)
+	default:
 		ver, err := readKernelVersion()
 		if err != nil {
 			return nil, err
 		}
 		conf.kernelVersion = ver
+		conf.modulesDir = path.Join("/usr/lib/modules", conf.kernelVersion)
+	}
+	if *kernelModulesDir != "" {
+		conf.modulesDir = *kernelModulesDir
 	}
-	conf.modulesDir = path.Join("/usr/lib/modules", conf.kernelVersion)
 	conf.debug = *debugEnabled
 	conf.readDeviceAliases = readDeviceAliases
 	conf.readHostModules = readHostModules
+	conf.readHostDevices = readHostDevices
 	conf.readModprobeOptions = readModprobeOptions
+	root, modulesDir := *sysroot, conf.modulesDir
+	conf.readKernelConfig = func(kernelVersion string) ([]byte, error) {
+		return readKernelConfig(root, modulesDir, kernelVersion)
+	}
+	conf.readCPUVendor = readCPUVendor
 	conf.stripBinaries = u.StripBinaries || *strip
-	conf.enableVirtualConsole = u.EnableVirtualConsole
+	if err := checkTargetArch(*targetArch); err != nil {
+		return nil, err
+	}
+	conf.arch = *targetArch
+	if conf.microcode && conf.arch != "amd64" && conf.arch != "386" {
+		return nil, fmt.Errorf("config: microcode is supported for x86 images only, the image is generated for %s", conf.arch)
+	}
+	if conf.arch != runtime.GOARCH {
+		// the host devices, modules and tools do not describe the target system
+		switch {
+		case *kernelVersion == "" && *sysroot == "":
+			return nil, fmt.Errorf("-kernelVersion or -sysroot is required to generate an image for architecture %s", conf.arch)
+		case !conf.universal || conf.overlay:
+			return nil, fmt.Errorf("a host-specific image cannot be generated for architecture %s, use -universal", conf.arch)
+		case conf.stripBinaries:
+			return nil, fmt.Errorf("config: strip is not supported for an image of architecture %s", conf.arch)
+		}
+	}
+	conf.plymouth = u.Plymouth
+	conf.enableVirtualConsole = u.EnableVirtualConsole.Enabled
 	if conf.enableVirtualConsole {
+		conf.vconsoleProperties = u.EnableVirtualConsole.properties
 		conf.vconsolePath = "/etc/vconsole.conf"
 		conf.localePath = "/etc/locale.conf"
 	}
@@ -142,6 +482,46 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 	return &conf, nil
 }
 
+// sysrootKernel returns the modules dir and the version of the kernel installed at the sysroot. If the version is not
+// specified then the sysroot has to contain a single kernel.
+func sysrootKernel(root, kernelVersion string) (string, string, error) {
+	for _, d := range []string{"usr/lib/modules", "lib/modules"} {
+		base := filepath.Join(root, d)
+		if kernelVersion != "" {
+			dir := filepath.Join(base, kernelVersion)
+			if _, err := os.Stat(dir); err == nil {
+				return dir, kernelVersion, nil
+			}
+			continue
+		}
+		entries, err := os.ReadDir(base)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		var versions []string
+		for _, e := range entries {
+			if e.IsDir() {
+				versions = append(versions, e.Name())
+			}
+		}
+		switch len(versions) {
+		case 0:
+			continue
+		case 1:
+			return filepath.Join(base, versions[0]), versions[0], nil
+		default:
+			return "", "", fmt.Errorf("sysroot %s contains multiple kernels (%s), specify one with -kernelVersion", root, strings.Join(versions, ", "))
+		}
+	}
+	if kernelVersion != "" {
+		return "", "", fmt.Errorf("modules of kernel %s are not found at sysroot %s", kernelVersion, root)
+	}
+	return "", "", fmt.Errorf("no kernel modules are found at sysroot %s", root)
+}
+
 func readKernelVersion() (string, error) {
 	// read kernel binary version as
 	//     if (argc > 1){
@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
 
 func TestReadEmptyConfig(t *testing.T) {
 	t.Parallel()
@@ -13,3 +18,478 @@ func TestReadEmptyConfig(t *testing.T) {
 		t.Fatalf("expected default compression zstd, got %s", c.compression)
 	}
 }
+
+func TestReadUniversalModulesConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config, expected, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.universalModules != expected {
+			t.Fatalf("expected universal modules %s, got %s", expected, c.universalModules)
+		}
+	}
+
+	check("universal: true\n", "all", "")
+	check("universal: true\nuniversal_modules: storage\n", "storage", "")
+	check("universal: true\nuniversal_modules: net\n", "net", "")
+	check("universal: true\nuniversal_modules: gpu\n", "", "config: unknown universal_modules gpu, expected one of storage, net, all")
+}
+
+func TestReadCompressionLevelConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, expected int, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.compressionLevel != expected {
+			t.Fatalf("expected compression level %d, got %d", expected, c.compressionLevel)
+		}
+	}
+
+	check("compression: zstd\n", 0, "")
+	check("compression_level: 19\n", 19, "")
+	check("compression: gzip\ncompression_level: 9\n", 9, "")
+	check("compression: zstd\ncompression_level: 23\n", 0, "config: zstd compression_level 23 is out of range 1-22")
+	check("compression: xz\ncompression_level: 6\n", 0, "config: compression_level is not supported for xz compression")
+}
+
+func TestNoCompressionFlag(t *testing.T) {
+	// not parallel as it changes the flags
+	defer func(noComp bool, comp string) { *noCompression, *compression = noComp, comp }(*noCompression, *compression)
+
+	file := t.TempDir() + "/booster.yaml"
+	if err := os.WriteFile(file, []byte("compression: zstd\ncompression_level: 19\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	*noCompression = true
+	c, err := readGeneratorConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.compression != "none" || c.compressionLevel != 0 {
+		t.Fatalf("expected uncompressed image, got compression %s level %d", c.compression, c.compressionLevel)
+	}
+
+	*compression = "gzip"
+	if _, err := readGeneratorConfig(file); err == nil || err.Error() != "-noCompression cannot be used together with -compression=gzip" {
+		t.Fatalf("expected conflicting flags error, got %v", err)
+	}
+}
+
+func TestOverlayFlag(t *testing.T) {
+	// not parallel as it changes the flags
+	defer func(o bool) { *overlay = o }(*overlay)
+
+	file := t.TempDir() + "/booster.yaml"
+	if err := os.WriteFile(file, []byte("microcode: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	*overlay = true
+	if _, err := readGeneratorConfig(file); err == nil || err.Error() != "config: microcode cannot be added to an overlay image, add it to the base image instead" {
+		t.Fatalf("expected microcode error, got %v", err)
+	}
+
+	if err := os.WriteFile(file, []byte("compression: gzip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := readGeneratorConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.overlay {
+		t.Fatal("expected overlay mode")
+	}
+}
+
+func TestArchFlag(t *testing.T) {
+	// not parallel as it changes the flags
+	defer func(a, k, m string, u bool) {
+		*targetArch, *kernelVersion, *kernelModulesDir, *universal = a, k, m, u
+	}(*targetArch, *kernelVersion, *kernelModulesDir, *universal)
+
+	cross := "arm64"
+	if runtime.GOARCH == cross {
+		cross = "amd64"
+	}
+	file := t.TempDir() + "/booster.yaml"
+	if err := os.WriteFile(file, []byte("compression: zstd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check := func(expectedErr string) *generatorConfig {
+		t.Helper()
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	*targetArch = "sparc64"
+	check("unsupported architecture sparc64, expected one of: 386, amd64, arm, arm64, loong64, ppc64, ppc64le, riscv64, s390x")
+
+	*targetArch = cross
+	check("-kernelVersion or -sysroot is required to generate an image for architecture " + cross)
+	*kernelVersion = "6.1.0-target"
+	check("a host-specific image cannot be generated for architecture " + cross + ", use -universal")
+
+	*universal = true
+	*kernelModulesDir = "/srv/target/usr/lib/modules/6.1.0-target"
+	c := check("")
+	if c.arch != cross || c.kernelVersion != "6.1.0-target" || c.modulesDir != *kernelModulesDir {
+		t.Fatalf("unexpected target arch %s kernel %s modules %s", c.arch, c.kernelVersion, c.modulesDir)
+	}
+
+	if err := os.WriteFile(file, []byte("microcode: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cross != "amd64" {
+		check("config: microcode is supported for x86 images only, the image is generated for " + cross)
+	}
+}
+
+func TestSysrootFlag(t *testing.T) {
+	// not parallel as it changes the flags
+	defer func(s, k, m string) { *sysroot, *kernelVersion, *kernelModulesDir = s, k, m }(*sysroot, *kernelVersion, *kernelModulesDir)
+
+	root := t.TempDir()
+	file := root + "/booster.yaml"
+	if err := os.WriteFile(file, []byte("compression: zstd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check := func(expectedVersion, expectedDir, expectedErr string) {
+		t.Helper()
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.kernelVersion != expectedVersion || c.modulesDir != expectedDir {
+			t.Fatalf("expected kernel %s at %s, got %s at %s", expectedVersion, expectedDir, c.kernelVersion, c.modulesDir)
+		}
+	}
+
+	*sysroot = root
+	check("", "", "no kernel modules are found at sysroot "+root)
+
+	if err := os.MkdirAll(root+"/lib/modules/5.10.0-old", 0755); err != nil {
+		t.Fatal(err)
+	}
+	check("5.10.0-old", root+"/lib/modules/5.10.0-old", "")
+
+	if err := os.MkdirAll(root+"/usr/lib/modules/6.1.0-new", 0755); err != nil {
+		t.Fatal(err)
+	}
+	check("6.1.0-new", root+"/usr/lib/modules/6.1.0-new", "")
+	if err := os.MkdirAll(root+"/usr/lib/modules/6.2.0-newer", 0755); err != nil {
+		t.Fatal(err)
+	}
+	check("", "", "sysroot "+root+" contains multiple kernels (6.1.0-new, 6.2.0-newer), specify one with -kernelVersion")
+
+	*kernelVersion = "5.10.0-old"
+	check("5.10.0-old", root+"/lib/modules/5.10.0-old", "")
+	*kernelVersion = "4.19.0-missing"
+	check("", "", "modules of kernel 4.19.0-missing are not found at sysroot "+root)
+
+	*kernelVersion = "6.2.0-newer"
+	*kernelModulesDir = root + "/modules"
+	check("6.2.0-newer", root+"/modules", "")
+}
+
+func TestReadMicrocodeConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, microcode bool, image, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.microcode != microcode || c.microcodeImage != image {
+			t.Fatalf("expected microcode %v image '%s', got %v '%s'", microcode, image, c.microcode, c.microcodeImage)
+		}
+	}
+
+	check("", false, "", "")
+	check("microcode: true\n", true, "", "")
+	check("microcode: false\n", false, "", "")
+	check("microcode: /boot/intel-ucode.img\n", false, "/boot/intel-ucode.img", "")
+	check("microcode: intel-ucode.img\n", false, "", "config: invalid microcode value intel-ucode.img, expected a boolean or an absolute path to the microcode archive")
+}
+
+func TestReadVirtualConsoleConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, enabled bool, properties map[string]string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.enableVirtualConsole != enabled || !reflect.DeepEqual(c.vconsoleProperties, properties) {
+			t.Fatalf("%s: expected vconsole %v %v, got %v %v", config, enabled, properties, c.enableVirtualConsole, c.vconsoleProperties)
+		}
+	}
+
+	check("", false, nil)
+	check("vconsole: false\n", false, nil)
+	check("vconsole: true\n", true, nil)
+	check("vconsole: {keymap: de-latin1}\n", true, map[string]string{"KEYMAP": "de-latin1"})
+	check("vconsole:\n  keymap: us\n  keymap_toggle: ru\n  font: lat1-16\n", true, map[string]string{"KEYMAP": "us", "KEYMAP_TOGGLE": "ru", "FONT": "lat1-16"})
+}
+
+func TestReadMountsConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, expected []InitMount, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.mounts, expected) {
+			t.Fatalf("%s: expected mounts %+v, got %+v", config, expected, c.mounts)
+		}
+	}
+
+	check("", nil, "")
+	check("mounts:\n  - device: PARTLABEL=var\n    target: /var/\n    fstype: ext4\n    options: noatime\n  - {device: LABEL=data, target: /srv, nofail: true}\n",
+		[]InitMount{
+			{Device: "PARTLABEL=var", Target: "/var", Fstype: "ext4", Options: "noatime"},
+			{Device: "LABEL=data", Target: "/srv", NoFail: true},
+		}, "")
+	check("mounts:\n  - target: /var\n", nil, "config: mount /var does not specify the device")
+	check("mounts:\n  - {device: LABEL=var, target: var}\n", nil, "config: invalid mount target 'var' of LABEL=var, expected an absolute path other than /")
+	check("mounts:\n  - {device: LABEL=root, target: /}\n", nil, "config: invalid mount target '/' of LABEL=root, expected an absolute path other than /")
+	check("mounts:\n  - {device: LABEL=var, target: /var}\n  - {device: LABEL=var2, target: /var/}\n", nil, "config: mount target /var is specified more than once")
+	check("mounts:\n  - {device: /srv/data/home, target: /home, options: \"rbind,nodev\"}\n", []InitMount{{Device: "/srv/data/home", Target: "/home", Options: "rbind,nodev"}}, "")
+	check("mounts:\n  - {device: LABEL=home, target: /home, options: bind}\n", nil, "config: bind mount /home expects an absolute path inside the root filesystem as the device and no fstype")
+}
+
+func TestReadMeasureRootConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, expected int, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == -1 {
+			if c.measureRootPcr != nil {
+				t.Fatalf("expected root measurement disabled, got PCR %d", *c.measureRootPcr)
+			}
+			return
+		}
+		if c.measureRootPcr == nil || *c.measureRootPcr != expected {
+			t.Fatalf("expected root measurement to PCR %d, got %v", expected, c.measureRootPcr)
+		}
+	}
+
+	check("", -1, "")
+	check("measure_root_pcr: 15\n", 15, "")
+	check("measure_root_pcr: 0\n", 0, "")
+	check("measure_root_pcr: 24\n", 0, "config: invalid measure_root_pcr 24, expected a PCR index 0-23")
+}
+
+func TestReadFactoryResetConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, expected *InitFactoryReset, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.factoryReset, expected) {
+			t.Fatalf("expected factory reset %+v, got %+v", expected, c.factoryReset)
+		}
+	}
+
+	check("", nil, "")
+	check("factory_reset: {device: PARTLABEL=root, fstype: ext4, options: -L root}\n", &InitFactoryReset{Device: "PARTLABEL=root", Fstype: "ext4", Options: "-L root"}, "")
+	check("factory_reset: {device: PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4, fstype: btrfs}\n", &InitFactoryReset{Device: "PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4", Fstype: "btrfs"}, "")
+	check("factory_reset: {device: /dev/sda2, fstype: ext4}\n", nil, "config: invalid factory_reset device '/dev/sda2', expected a partition specified with PARTUUID= or PARTLABEL=")
+	check("factory_reset: {device: PARTLABEL=root}\n", nil, "config: factory_reset does not specify the fstype")
+}
+
+func TestReadCredentialsConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, expected []CredentialConfig, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.credentials, expected) {
+			t.Fatalf("expected credentials %+v, got %+v", expected, c.credentials)
+		}
+	}
+
+	check("", nil, "")
+	check("credentials:\n  - {name: wifi.psk, file: /etc/booster/wifi.psk}\n", []CredentialConfig{{Name: "wifi.psk", File: "/etc/booster/wifi.psk"}}, "")
+	check("network: {dhcp: on}\ncredentials:\n  - {name: token, url: https://keys.example.com/<MAC>}\n", []CredentialConfig{{Name: "token", Url: "https://keys.example.com/<MAC>"}}, "")
+	check("credentials:\n  - {name: token, url: https://keys.example.com/token}\n", nil, "config: credential token is fetched from https://keys.example.com/token but the network is not configured")
+	check("credentials:\n  - {name: ../passwd, file: /etc/passwd}\n", nil, "config: invalid credential name '../passwd'")
+	check("credentials:\n  - {name: token}\n", nil, "config: credential token is expected to specify either file or url")
+	check("credentials:\n  - {name: a, file: /a}\n  - {name: a, file: /b}\n", nil, "config: credential a is specified more than once")
+}
+
+func TestReadUdevRulesConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, expected []string, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.udevRules, expected) {
+			t.Fatalf("expected udev rules %+v, got %+v", expected, c.udevRules)
+		}
+	}
+
+	check("", nil, "")
+	check("udev_rules: /etc/udev/rules.d/70-net.rules,/etc/udev/rules.d/60-disk.rules\n", []string{"/etc/udev/rules.d/70-net.rules", "/etc/udev/rules.d/60-disk.rules"}, "")
+	check("udev_rules: /etc/udev/rules.d/70-net\n", nil, "config: udev rules file '/etc/udev/rules.d/70-net' is expected to have .rules extension")
+	check("udev_rules: /etc/udev/rules.d/70-net.rules,/usr/lib/udev/rules.d/70-net.rules\n", nil, "config: udev rules file name 70-net.rules is used more than once")
+}
+
+func TestReadExtraFilesConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(config string, expectedFiles []string, expectedMappings []extraFileMapping, expectedErr string) {
+		file := t.TempDir() + "/booster.yaml"
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readGeneratorConfig(file)
+		if expectedErr != "" {
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.extraFiles, expectedFiles) {
+			t.Fatalf("expected extra files %+v, got %+v", expectedFiles, c.extraFiles)
+		}
+		if !reflect.DeepEqual(c.extraFileMappings, expectedMappings) {
+			t.Fatalf("expected extra file mappings %+v, got %+v", expectedMappings, c.extraFileMappings)
+		}
+	}
+
+	check("", nil, nil, "")
+	check("extra_files: vim,/usr/share/vim/vim82/,fsck\n", []string{"vim", "/usr/share/vim/vim82/", "fsck"}, nil, "")
+	check(`extra_files:
+  - busybox
+  - {source: /usr/local/bin/helper, dest: /usr/bin/helper, mode: 0700}
+  - {source: /etc/helper.conf, mode: "0600"}
+  - {source: strace, dest: /usr/sbin/strace}
+`, []string{"busybox"}, []extraFileMapping{
+		{source: "/usr/local/bin/helper", dest: "/usr/bin/helper", mode: 0700, hasMode: true},
+		{source: "/etc/helper.conf", dest: "/etc/helper.conf", mode: 0600, hasMode: true},
+		{source: "/usr/bin/strace", dest: "/usr/sbin/strace"},
+	}, "")
+	check("extra_files:\n  - {source: /etc/helper.conf, mode: 0999}\n", nil, nil, "config: invalid mode '0999' of extra file /etc/helper.conf, expected octal permissions, e.g. 0755")
+	check("extra_files:\n  - {source: /etc/helper.conf, mode: 04755}\n", nil, nil, "config: invalid mode '04755' of extra file /etc/helper.conf, expected octal permissions, e.g. 0755")
+	check("extra_files:\n  - {source: /etc/helper.conf, dest: helper.conf}\n", nil, nil, "config: extra file /etc/helper.conf destination 'helper.conf' is expected to be an absolute path")
+	check("extra_files:\n  - {dest: /etc/helper.conf}\n", nil, nil, "config: extra_files item does not specify the source")
+}
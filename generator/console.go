@@ -7,19 +7,26 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
-func (img *Image) enableVirtualConsole(vConsolePath, localePath string) (*VirtualConsole, error) {
+// enableVirtualConsole adds the console keymap and fonts to the image. The settings are read from vConsolePath
+// unless they are specified in booster.yaml.
+func (img *Image) enableVirtualConsole(vConsolePath, localePath string, vprop map[string]string) (*VirtualConsole, error) {
 	debug("enabling virtual console")
 
 	var conf VirtualConsole
 
-	vconf, err := os.ReadFile(vConsolePath)
-	if err != nil {
-		return nil, err
+	if vprop == nil {
+		vconf, err := os.ReadFile(vConsolePath)
+		if err != nil {
+			return nil, err
+		}
+		vprop = parseProperties(string(vconf))
+	} else {
+		vConsolePath = "booster.yaml"
 	}
-	vprop := parseProperties(string(vconf))
 
 	// adding keymap
 	if keymap, ok := vprop["KEYMAP"]; ok {
@@ -41,19 +48,30 @@ func (img *Image) enableVirtualConsole(vConsolePath, localePath string) (*Virtua
 		if err := img.AppendContent(blob, 0644, conf.KeymapFile); err != nil {
 			return nil, err
 		}
+
+		// the binary keymap contains the key tables only, the dead keys and the compose key need the accent table
+		diacritics, err := readDiacritics(conf.Utf, keymap, vprop["KEYMAP_TOGGLE"])
+		if err != nil {
+			warning("%v, the dead keys and the compose key will use the kernel default accent table", err)
+		} else if len(diacritics) != 0 {
+			conf.DiacriticsFile = "/console/diacritics"
+			if err := img.AppendContent(formatDiacritics(diacritics), 0644, conf.DiacriticsFile); err != nil {
+				return nil, err
+			}
+		}
 	} else {
 		warning("vconsole is enabled but %s does not contain KEYMAP property", vConsolePath)
 	}
 
 	// adding fonts
 	if font, ok := vprop["FONT"]; ok {
-		if err := img.appendExtraFiles([]string{"setfont"}); err != nil {
-			return nil, err
-		}
-
 		if blob, err := readFontFile(font); err != nil {
 			return nil, err
 		} else {
+			// init loads the font itself, check that it is able to parse it
+			if _, err := parseFont(blob); err != nil {
+				return nil, fmt.Errorf("font %s: %v", font, err)
+			}
 			conf.FontFile = "/console/font"
 			if err := img.AppendContent(blob, 0644, conf.FontFile); err != nil {
 				return nil, err
@@ -64,8 +82,8 @@ func (img *Image) enableVirtualConsole(vConsolePath, localePath string) (*Virtua
 			if blob, err := readFontFile(m); err != nil {
 				return nil, err
 			} else {
-				conf.FontFile = "/console/font.map"
-				if err := img.AppendContent(blob, 0644, conf.FontFile); err != nil {
+				conf.FontMapFile = "/console/font.map"
+				if err := img.AppendContent(blob, 0644, conf.FontMapFile); err != nil {
 					return nil, err
 				}
 			}
@@ -75,12 +93,19 @@ func (img *Image) enableVirtualConsole(vConsolePath, localePath string) (*Virtua
 			if blob, err := readFontFile(u); err != nil {
 				return nil, err
 			} else {
-				conf.FontFile = "/console/font.unimap"
-				if err := img.AppendContent(blob, 0644, conf.FontFile); err != nil {
+				conf.FontUnicodeFile = "/console/font.unimap"
+				if err := img.AppendContent(blob, 0644, conf.FontUnicodeFile); err != nil {
 					return nil, err
 				}
 			}
 		}
+
+		// the console maps are loaded with setfont
+		if conf.FontMapFile != "" || conf.FontUnicodeFile != "" {
+			if err := img.appendExtraFiles([]string{"setfont"}); err != nil {
+				return nil, err
+			}
+		}
 	} else {
 		debug("%s does not provide FONT settings, skip vconsole font configuration", vConsolePath)
 	}
@@ -103,7 +128,16 @@ func loadKeymap(keymap, keymapToggle string, isUtf bool) ([]byte, error) {
 	return exec.Command("loadkeys", args...).Output()
 }
 
+// readFontFile reads the font specified either by its name in /usr/share/kbd/consolefonts/ or by its absolute path
 func readFontFile(font string) (blob []byte, err error) {
+	if filepath.IsAbs(font) {
+		blob, err := os.ReadFile(font)
+		if err != nil {
+			return nil, err
+		}
+		return gunzipFont(font, blob)
+	}
+
 	entries, err := os.ReadDir("/usr/share/kbd/consolefonts/")
 	if err != nil {
 		return nil, err
@@ -117,24 +151,22 @@ func readFontFile(font string) (blob []byte, err error) {
 			if err != nil {
 				return nil, err
 			}
-
-			if strings.HasSuffix(name, ".gz") {
-				// unpack the archive
-				gz, err := gzip.NewReader(bytes.NewReader(blob))
-				if err != nil {
-					return nil, err
-				}
-				defer gz.Close()
-
-				blob, err = io.ReadAll(gz)
-				if err != nil {
-					return nil, err
-				}
-				name = name[:len(name)-3] // remove .gz suffix from the name
-			}
-
-			return blob, nil
+			return gunzipFont(name, blob)
 		}
 	}
 	return nil, fmt.Errorf("unable to find file for specified font '%s'", font)
 }
+
+func gunzipFont(name string, blob []byte) ([]byte, error) {
+	if !strings.HasSuffix(name, ".gz") {
+		return blob, nil
+	}
+	// unpack the archive
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return io.ReadAll(gz)
+}
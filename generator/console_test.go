@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
 
 func TestReadFontFile(t *testing.T) {
 	check := func(font string) {
@@ -43,3 +50,62 @@ func TestLoadKeymap(t *testing.T) {
 	check("us", "de", true)
 	check("us", "", false)
 }
+
+func TestReadDiacritics(t *testing.T) {
+	dir := t.TempDir()
+	write := func(file string, content []byte) {
+		file = filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write([]byte("include \"compose.latin1\"\nkeycode 1 = Escape\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	write("i386/qwertz/de-latin1.map.gz", gz.Bytes())
+	// latin1 encoded file as shipped by kbd
+	write("i386/include/compose.latin1.inc", []byte("charset \"iso-8859-1\"\n"+
+		"compose '`' 'a' to '\xe0' # a grave\n"+
+		"compose '\\'' 'e' to U+00e9\n"+
+		"compose 'C' '=' to '\u20ac'\n"+
+		"compose as usual for \"iso-8859-1\"\n"+
+		"compose 'o' 'e' to oe\n"))
+	write("i386/qwerty/us.map", []byte("keycode 1 = Escape\n"))
+
+	defer func(dirs []string) { keymapDirs = dirs }(keymapDirs)
+	keymapDirs = []string{filepath.Join(dir, "missing"), dir}
+
+	diacritics, err := readDiacritics(true, "de-latin1", "us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []diacritic{{'`', 'a', 'à'}, {'\'', 'e', 'é'}, {'C', '=', '€'}}
+	if !reflect.DeepEqual(diacritics, expected) {
+		t.Fatalf("expected %v, got %v", expected, diacritics)
+	}
+
+	// the 8-bit console cannot produce the euro sign
+	diacritics, err = readDiacritics(false, "de-latin1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diacritics, expected[:2]) {
+		t.Fatalf("expected %v, got %v", expected[:2], diacritics)
+	}
+	if content := string(formatDiacritics(diacritics)); content != "96 97 224\n39 101 233\n" {
+		t.Fatalf("unexpected accent table '%s'", content)
+	}
+
+	if _, err := readDiacritics(true, "fr"); err == nil || err.Error() != "keymap: unable to find the source of keymap fr" {
+		t.Fatalf("expected missing keymap error, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// appendCrypttab adds the crypttab that init uses to unlock the LUKS devices. The keyfiles and the detached headers
+// specified as plain paths are expected in the image, they are added from the host.
+func (img *Image) appendCrypttab(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("crypttab: %v", err)
+	}
+
+	var files []string
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 4 {
+			return fmt.Errorf("crypttab: %s:%d: expected 'name device [keyfile [options]]'", file, n)
+		}
+		if len(fields) > 2 && strings.HasPrefix(fields[2], "/") && !strings.ContainsRune(fields[2], ':') {
+			files = append(files, fields[2])
+		}
+		if len(fields) > 3 {
+			for _, o := range strings.Split(fields[3], ",") {
+				if h := strings.TrimPrefix(o, "header="); h != o && strings.HasPrefix(h, "/") && !strings.ContainsRune(h, ':') {
+					files = append(files, h)
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("crypttab: %v", err)
+	}
+
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("crypttab: %v", err)
+		}
+		debug("crypttab: adding %s, it is readable by anyone who can read the image", f)
+		if err := img.AppendFile(f); err != nil {
+			return err
+		}
+	}
+	return img.AppendContent(content, 0600, crypttabPath)
+}
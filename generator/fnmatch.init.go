@@ -0,0 +1 @@
+../init/fnmatch.go
\ No newline at end of file
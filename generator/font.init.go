@@ -0,0 +1 @@
+../init/font.go
\ No newline at end of file
@@ -2,12 +2,20 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/x509"
+	"debug/elf"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,26 +25,59 @@ type generatorConfig struct {
 	networkConfigType       netConfigType
 	networkStaticConfig     *networkStaticConfig
 	networkActiveInterfaces []net.HardwareAddr
+	keyServerCA             string // CA bundle file embedded to the image
+	keyServerInsecure       bool
+	wireguardConfig         string // WireGuard tunnel config file embedded to the image
+	verityPublicKey         string // key verifying the dm-verity root hash signature, embedded to the image
+	crypttab                string // crypttab file embedded to the image, init unlocks the LUKS devices listed there
+	measureRootPcr          *int   // TPM2 PCR extended with the root identity at boot
+	randomSeed              bool   // embed a random seed generated for this image
+	virtioRng               bool   // add virtio-rng driver to seed the kernel RNG from the host
 	universal               bool
+	hostOnlyDevices         bool     // add only the drivers of the present storage, network, input and TPM devices
+	overlay                 bool     // generate the host-specific overlay for a base image
+	universalModules        string   // module set of the universal image: storage, net or all
 	modules                 []string // extra modules to add
 	modulesForceLoad        []string // extra modules to load at the boot time
+	modulesBlocklist        []string // modules that must not be added to the image
 	compression             string
+	compressionLevel        int    // 0 means the compressor default level
+	modulesCompression      string // compression of the modules inside the image
 	timeout                 time.Duration
+	modTime                 time.Time // modification time of the image files, set with SOURCE_DATE_EPOCH
 	extraFiles              []string
+	firmwareFiles           []string // firmware globs relative to hostFirmwareDir
+	fsck                    []string // filesystem types whose checkers are added for the boot time fsck
+	microcode               bool     // build the early microcode archive from hostFirmwareDir
+	microcodeImage          string   // prebuilt early microcode archive
+	plymouth                bool     // add plymouth and its theme
+	hostFirmwareDir         string   // firmwareDir if not set
 	output                  string
 	forceOverwrite          bool // overwrite output file
 	initBinary              string
 	kernelVersion           string
+	arch                    string // GOARCH name of the target architecture
 	modulesDir              string
 	debug                   bool
 	readDeviceAliases       func() (set, error)
 	readHostModules         func() (set, error)
+	readHostDevices         func() ([]hostDevice, error)
 	readModprobeOptions     func() (map[string]string, error)
+	readKernelConfig        func(kernelVersion string) ([]byte, error)
+	readCPUVendor           func() (string, error)
 	stripBinaries           bool
+	staticInit              bool        // fail if the init binary is dynamically linked
+	mounts                  []InitMount // extra filesystems mounted before switching to the root
+	factoryReset            *InitFactoryReset
+	credentials             []CredentialConfig // delivered to the booted system
+	hooks                   []HookConfig       // run before switching to the root
+	udevRules               []string           // udev rules files, init applies their naming rules
+	extraFileMappings       []extraFileMapping // extra files added at another location or with other permissions
 
 	// virtual console configs
 	enableVirtualConsole     bool
 	vconsolePath, localePath string
+	vconsoleProperties       map[string]string // vconsole.conf properties specified in booster.yaml, used instead of vconsolePath
 }
 
 type networkStaticConfig struct {
@@ -61,8 +102,8 @@ const (
 // This is default modules list checked by booster. It either specifies a name of the module
 // or whole directory that added recursively. Dependencies of these scanned modules are added as well.
 //
-// In case of 'universal' build all specified modules are added to the image.
 // In case of 'host' build only modules for active devices are added.
+// In case of 'universal' build the universal modules lists below are used instead.
 var defaultModulesList = []string{
 	"kernel/fs/",
 	"kernel/arch/x86/crypto/",
@@ -74,42 +115,184 @@ var defaultModulesList = []string{
 	"kernel/drivers/char/tpm/",
 	"kernel/drivers/usb/host/",
 	"kernel/drivers/hid/usbhid/",
-	"hid_generic", "sd_mod", "ahci",
+	"hid_generic", "sd_mod", "ahci", "loop",
 	"virtio_pci", "virtio_blk", "virtio_scsi", "virtio_crypto",
 }
 
+// Modules added to the universal image instead of defaultModulesList. The image is expected to boot at unknown
+// hardware so it includes all drivers of the given kind, init loads the ones needed for the devices via modalias.
+var (
+	// needed regardless of the universal module set
+	universalBaseModulesList = []string{
+		"kernel/arch/x86/crypto/",
+		"kernel/crypto/",
+		"kernel/drivers/input/serio/",
+		"kernel/drivers/input/keyboard/",
+		"kernel/drivers/char/tpm/",
+		"kernel/drivers/usb/host/",
+		"kernel/drivers/hid/usbhid/",
+		"hid_generic", "loop", "virtio_pci", "virtio_crypto",
+	}
+	universalStorageModulesList = []string{
+		"kernel/fs/",
+		"kernel/drivers/md/",
+		"kernel/drivers/ata/",
+		"kernel/drivers/scsi/",
+		"kernel/drivers/nvme/",
+		"kernel/drivers/block/",
+		"kernel/drivers/mmc/",
+		"kernel/drivers/usb/storage/",
+		"sd_mod", "ahci", "virtio_blk", "virtio_scsi",
+	}
+	universalNetModulesList = []string{
+		"kernel/drivers/net/ethernet/",
+		"kernel/drivers/net/phy/",
+		"kernel/drivers/net/mdio/",
+		"virtio_net", "bonding", "8021q",
+	}
+)
+
+// universalModulesList returns the modules of the universal image for the given module set, all modules by default
+func universalModulesList(modules string) []string {
+	result := append([]string{}, universalBaseModulesList...)
+	if modules != "net" {
+		result = append(result, universalStorageModulesList...)
+	}
+	if modules != "storage" {
+		result = append(result, universalNetModulesList...)
+	}
+	return result
+}
+
 func generateInitRamfs(conf *generatorConfig) error {
 	if _, err := os.Stat(conf.output); (err == nil || !os.IsNotExist(err)) && !conf.forceOverwrite {
 		return fmt.Errorf("File %v exists, please specify -force if you want to overwrite it", conf.output)
 	}
 
-	img, err := NewImage(conf.output, conf.compression, conf.stripBinaries)
+	if conf.readKernelConfig != nil {
+		kernelConfig, err := conf.readKernelConfig(conf.kernelVersion)
+		if err != nil {
+			return err
+		}
+		if err := checkKernelDecompressor(kernelConfig, conf.compression); err != nil {
+			return err
+		}
+	}
+
+	earlyArchive, err := earlyMicrocode(conf)
 	if err != nil {
 		return err
 	}
-	defer img.Cleanup()
 
-	if err := img.appendInitBinary(conf.initBinary); err != nil {
+	img, err := NewImage(conf.output, conf.compression, conf.compressionLevel, conf.stripBinaries, conf.modTime, earlyArchive)
+	if err != nil {
 		return err
 	}
+	defer img.Cleanup()
+	img.arch = conf.arch
+
+	// an overlay image contains the host-specific files only, the init binary and the modules come with the base image
+	if !conf.overlay {
+		if err := img.appendInitBinary(conf.initBinary, conf.arch, conf.staticInit); err != nil {
+			return err
+		}
+	}
 
 	if err := img.appendExtraFiles(conf.extraFiles); err != nil {
 		return err
 	}
+	if err := img.appendExtraFileMappings(conf.extraFileMappings); err != nil {
+		return err
+	}
 
-	kmod, err := img.appendModules(conf)
-	if err != nil {
+	if conf.keyServerCA != "" {
+		if err := img.appendKeyServerCA(conf.keyServerCA); err != nil {
+			return err
+		}
+	}
+
+	if conf.wireguardConfig != "" {
+		if err := img.appendWireguardConfig(conf.wireguardConfig); err != nil {
+			return err
+		}
+	}
+
+	if conf.verityPublicKey != "" {
+		if err := img.appendVerityPublicKey(conf.verityPublicKey); err != nil {
+			return err
+		}
+	}
+
+	if conf.crypttab != "" {
+		if err := img.appendCrypttab(conf.crypttab); err != nil {
+			return err
+		}
+	}
+
+	if conf.randomSeed {
+		if err := img.appendRandomSeed(); err != nil {
+			return err
+		}
+	}
+
+	if err := img.appendCredentials(conf.credentials); err != nil {
 		return err
 	}
 
+	if err := img.appendHooks(conf.hooks); err != nil {
+		return err
+	}
+
+	if err := img.appendUdevRules(conf.udevRules); err != nil {
+		return err
+	}
+
+	var kmod *Kmod
+	if !conf.overlay {
+		kmod, err = img.appendModules(conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	// added after the modules so the files required by the modules are not reported as duplicates
+	if err := img.appendFirmwareGlobs(conf.hostFirmwareDir, conf.firmwareFiles); err != nil {
+		return err
+	}
+
+	if conf.factoryReset != nil {
+		if err := img.appendMkfs(conf.factoryReset.Fstype); err != nil {
+			return err
+		}
+	}
+
+	for _, fstype := range conf.fsck {
+		if err := img.appendFsck(fstype); err != nil {
+			return err
+		}
+	}
+
+	if conf.plymouth {
+		if err := img.appendPlymouth(); err != nil {
+			return err
+		}
+	}
+
 	var vconsole *VirtualConsole
 	if conf.enableVirtualConsole {
-		vconsole, err = img.enableVirtualConsole(conf.vconsolePath, conf.localePath)
+		vconsole, err = img.enableVirtualConsole(conf.vconsolePath, conf.localePath, conf.vconsoleProperties)
 		if err != nil {
 			return err
 		}
 	}
 
+	if conf.overlay {
+		if err := img.appendOverlayConfig(conf, vconsole); err != nil {
+			return err
+		}
+		return img.Close()
+	}
+
 	kmod.filterModprobeForRequiredModules()
 
 	if err := img.appendInitConfig(conf, kmod, vconsole); err != nil {
@@ -121,14 +304,100 @@ func generateInitRamfs(conf *generatorConfig) error {
 		return err
 	}
 
-	return img.Close()
+	if err := img.Close(); err != nil {
+		return err
+	}
+	if conf.universal {
+		// universal images are considerably larger, show the price of the portability
+		info, err := os.Stat(conf.output)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("universal image %s: %d kernel modules, %.1f MiB\n", conf.output, len(kmod.requiredModules), float64(info.Size())/(1<<20))
+	}
+	return nil
+}
+
+// kernelDecompressors are the kernel config options that enable decompression of the initramfs
+var kernelDecompressors = map[string]string{
+	"zstd": "CONFIG_RD_ZSTD",
+	"gzip": "CONFIG_RD_GZIP",
+	"xz":   "CONFIG_RD_XZ",
+	"lz4":  "CONFIG_RD_LZ4",
+}
+
+// readKernelConfig reads the build config of the given kernel from its modules dir or from /boot of the sysroot, the host
+// if sysroot is empty. It returns nil if the config is not available, e.g. the kernel headers are not installed.
+func readKernelConfig(sysroot, modulesDir, kernelVersion string) ([]byte, error) {
+	for _, f := range []string{modulesDir + "/build/.config", filepath.Join(sysroot, "/boot/config-"+kernelVersion)} {
+		content, err := os.ReadFile(f)
+		if err == nil {
+			return content, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if sysroot != "" {
+		return nil, nil // the running kernel is not the one of the sysroot
+	}
+	// the config of the running kernel
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil || string(bytes.TrimRight(uts.Release[:], "\x00")) != kernelVersion {
+		return nil, nil
+	}
+	f, err := os.Open("/proc/config.gz")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("/proc/config.gz: %v", err)
+	}
+	return io.ReadAll(r)
+}
+
+// checkKernelDecompressor checks that the kernel is able to decompress the image. The check is skipped
+// if the kernel config is not available.
+func checkKernelDecompressor(kernelConfig []byte, compression string) error {
+	option, ok := kernelDecompressors[compression]
+	if !ok || kernelConfig == nil {
+		return nil
+	}
+	if !regexp.MustCompile(`(?m)^` + option + `=y$`).Match(kernelConfig) {
+		return fmt.Errorf("the kernel is built without %s, it is unable to decompress %s compressed image, use another compression algorithm", option, compression)
+	}
+	return nil
 }
 
-func (img *Image) appendInitBinary(initBinary string) error {
+// appendInitBinary adds init built for the target arch. A dynamically linked init gets its dynamic loader and shared
+// libraries added, unless static is set then such init is rejected.
+func (img *Image) appendInitBinary(initBinary, arch string, static bool) error {
 	content, err := os.ReadFile(initBinary)
 	if err != nil {
 		return fmt.Errorf("%s: %v", initBinary, err)
 	}
+	ef, err := elf.NewFile(bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("init binary %s: %v", initBinary, err)
+	}
+	defer ef.Close()
+	if err := checkElfArch("init binary "+initBinary, ef, arch); err != nil {
+		return fmt.Errorf("%v, build init with GOARCH=%s", err, arch)
+	}
+	switch {
+	case isStaticElf(ef):
+		debug("init binary %s is statically linked", initBinary)
+	case static:
+		return fmt.Errorf("init binary %s is dynamically linked but static_init is set, build init with CGO_ENABLED=0", initBinary)
+	default:
+		debug("init binary %s is dynamically linked, adding its dynamic loader and shared libraries", initBinary)
+	}
 	return img.AppendContent(content, 0755, "/init")
 }
 
@@ -146,6 +415,155 @@ func (img *Image) appendExtraFiles(binaries []string) error {
 	return nil
 }
 
+// extraFileMapping is an extra file added at dest, with mode if hasMode is set
+type extraFileMapping struct {
+	source, dest string
+	mode         os.FileMode
+	hasMode      bool
+}
+
+// appendExtraFileMappings adds the extra files at their destinations. A symlink is added as a symlink and its target
+// is added at its own location. The ELF dependencies are added the same way as for the other extra files.
+func (img *Image) appendExtraFileMappings(mappings []extraFileMapping) error {
+	for _, m := range mappings {
+		fi, err := os.Lstat(m.source)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(m.source)
+			if err != nil {
+				return err
+			}
+			resolved := target
+			if !filepath.IsAbs(target) {
+				resolved = filepath.Join(filepath.Dir(m.source), target)
+				if filepath.Dir(m.source) != filepath.Dir(m.dest) {
+					target = resolved // the relative target would point elsewhere from the new location
+				}
+			}
+			if err := img.AppendSymlink(target, m.dest); err != nil {
+				return err
+			}
+			if err := img.AppendFile(resolved); err != nil {
+				return err
+			}
+		case fi.IsDir():
+			return fmt.Errorf("extra_files: %s is a directory, only files can be added at another location or with other permissions", m.source)
+		default:
+			content, err := os.ReadFile(m.source)
+			if err != nil {
+				return err
+			}
+			mode := fi.Mode().Perm()
+			if m.hasMode {
+				mode = m.mode
+			}
+			if err := img.AppendContent(content, mode, m.dest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// appendKeyServerCA adds the CA bundle used by init to verify the server that serves the LUKS keyfile
+func (img *Image) appendKeyServerCA(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("network.key_server_ca: %v", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(content) {
+		return fmt.Errorf("network.key_server_ca: %s does not contain any PEM encoded certificates", file)
+	}
+	return img.AppendContent(content, 0644, keyServerCAPath)
+}
+
+// randomSeedSize matches the size of the buffer init reads the seed into
+const randomSeedSize = 512
+
+// appendRandomSeed adds a seed for the kernel RNG, a new one is generated each time the image is generated. The seed
+// is readable by root only and init deletes it once the seed is used.
+func (img *Image) appendRandomSeed() error {
+	seed := make([]byte, randomSeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return fmt.Errorf("random_seed: %v", err)
+	}
+	return img.AppendContent(seed, 0600, randomSeedPath)
+}
+
+// appendCredentials adds the values of the credentials specified with a file, they are readable by root only
+func (img *Image) appendCredentials(credentials []CredentialConfig) error {
+	for _, c := range credentials {
+		if c.File == "" {
+			continue
+		}
+		content, err := os.ReadFile(c.File)
+		if err != nil {
+			return fmt.Errorf("credentials: %v", err)
+		}
+		if err := img.AppendContent(content, 0600, filepath.Join(credentialsDir, c.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initCredentials returns the credentials list for init, the embedded values are found by the credential name
+func initCredentials(credentials []CredentialConfig) []InitCredential {
+	var result []InitCredential
+	for _, c := range credentials {
+		result = append(result, InitCredential{Name: c.Name, Url: c.Url})
+	}
+	return result
+}
+
+// appendUdevRules adds the udev rules files, init evaluates them in the order of their names the same way as udev
+func (img *Image) appendUdevRules(files []string) error {
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("udev_rules: %v", err)
+		}
+		if err := img.AppendContent(content, 0644, filepath.Join(udevRulesDir, filepath.Base(f))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendMkfs adds the tool that init runs to recreate the root filesystem at the factory reset
+func (img *Image) appendMkfs(fstype string) error {
+	file, err := findBinary("mkfs."+fstype, "/usr/bin", "/usr/sbin", "/sbin")
+	if err != nil {
+		return fmt.Errorf("factory_reset: %v", err)
+	}
+	return img.appendExtraFiles([]string{file})
+}
+
+// appendFsck adds the filesystem checker that init runs before mounting the root filesystem
+func (img *Image) appendFsck(fstype string) error {
+	file, err := findBinary("fsck."+fstype, "/usr/bin", "/usr/sbin", "/sbin")
+	if err != nil {
+		return fmt.Errorf("fsck: %v", err)
+	}
+	return img.appendExtraFiles([]string{file})
+}
+
+// appendWireguardConfig adds the tunnel config that init brings up once the network is configured. The config usually
+// contains the private key thus it is readable by root only.
+func (img *Image) appendWireguardConfig(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("network.wireguard: %v", err)
+	}
+	if !bytes.Contains(content, []byte("[Peer]")) {
+		return fmt.Errorf("network.wireguard: %s does not contain any [Peer] sections", file)
+	}
+	return img.AppendContent(content, 0600, wireguardConfigPath)
+}
+
 func (img *Image) appendFirmwareFiles(modName string, fws []string) error {
 	for _, fw := range fws {
 		fwPath := firmwareDir + fw
@@ -160,6 +578,52 @@ func (img *Image) appendFirmwareFiles(modName string, fws []string) error {
 	return nil
 }
 
+// appendFirmwareGlobs adds the firmware files that match the globs. Some drivers request the firmware at probe time
+// and it is not listed in their modinfo, e.g. NIC blobs needed for the network boot. A glob that matches nothing
+// is reported but does not fail the generation as the firmware might be unused at the target hardware.
+func (img *Image) appendFirmwareGlobs(dir string, globs []string) error {
+	if dir == "" {
+		dir = firmwareDir
+	}
+	for _, g := range globs {
+		if g == "" || filepath.IsAbs(g) || strings.HasPrefix(filepath.Clean(g), "..") {
+			return fmt.Errorf("firmware_files: invalid pattern '%s', expected a path relative to %s", g, firmwareDir)
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, g))
+		if err != nil {
+			return fmt.Errorf("firmware_files: %s: %v", g, err)
+		}
+		if len(matches) == 0 {
+			warning("firmware_files: no firmware files in %s match %s", dir, g)
+			continue
+		}
+		for _, m := range matches {
+			err := filepath.Walk(m, func(file string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(dir, file)
+				if err != nil {
+					return err
+				}
+				dest := firmwareDir + rel
+				if img.hasFile(dest) {
+					return nil // required by one of the modules
+				}
+				content, err := os.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				return img.AppendContent(content, 0644, dest)
+			})
+			if err != nil {
+				return fmt.Errorf("firmware_files: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
 func (img *Image) appendInitConfig(conf *generatorConfig, kmod *Kmod, vconsole *VirtualConsole) error {
 	var initConfig InitConfig // config for init stored to /etc/booster.init.yaml
 
@@ -167,29 +631,72 @@ func (img *Image) appendInitConfig(conf *generatorConfig, kmod *Kmod, vconsole *
 	initConfig.Kernel = conf.kernelVersion
 	initConfig.ModuleDependencies = kmod.dependencies
 	initConfig.ModulePostDependencies = kmod.postDependencies
+	initConfig.ModuleSoftDependencies = kmod.softDependencies
 	initConfig.ModulesForceLoad = kmod.selectNonBuiltinModules(conf.modulesForceLoad)
 	initConfig.ModprobeOptions = kmod.modprobeOptions
 	initConfig.VirtualConsole = vconsole
+	initConfig.Network = initNetworkConfig(conf)
+	initConfig.Mounts = conf.mounts
+	initConfig.MeasureRootPcr = conf.measureRootPcr
+	initConfig.FactoryReset = conf.factoryReset
+	initConfig.Credentials = initCredentials(conf.credentials)
+	initConfig.Hooks = initHooks(conf.hooks)
 
-	if conf.networkConfigType == netDhcp {
-		initConfig.Network = &InitNetworkConfig{}
-		initConfig.Network.Dhcp = true
-	} else if conf.networkConfigType == netStatic {
-		initConfig.Network = &InitNetworkConfig{}
-		initConfig.Network.Ip = conf.networkStaticConfig.ip
-		initConfig.Network.Gateway = conf.networkStaticConfig.gateway
-		initConfig.Network.DNSServers = conf.networkStaticConfig.dnsServers
+	content, err := yaml.Marshal(initConfig)
+	if err != nil {
+		return err
 	}
-	if conf.networkActiveInterfaces != nil {
-		initConfig.Network.Interfaces = conf.networkActiveInterfaces
+
+	return img.AppendContent(content, 0644, initConfigPath)
+}
+
+// appendOverlayConfig adds the host-specific part of the init config, init merges it with the config of the base image.
+// The modules are not known at this point thus all the modprobe options of the host are added.
+func (img *Image) appendOverlayConfig(conf *generatorConfig, vconsole *VirtualConsole) error {
+	var initConfig InitConfig
+
+	initConfig.MountTimeout = int(conf.timeout.Seconds())
+	initConfig.Kernel = conf.kernelVersion
+	initConfig.ModulesForceLoad = conf.modulesForceLoad
+	modprobeOptions, err := conf.readModprobeOptions()
+	if err != nil {
+		return err
 	}
+	initConfig.ModprobeOptions = modprobeOptions
+	initConfig.VirtualConsole = vconsole
+	initConfig.Network = initNetworkConfig(conf)
+	initConfig.Mounts = conf.mounts
+	initConfig.MeasureRootPcr = conf.measureRootPcr
+	initConfig.FactoryReset = conf.factoryReset
+	initConfig.Credentials = initCredentials(conf.credentials)
+	initConfig.Hooks = initHooks(conf.hooks)
 
 	content, err := yaml.Marshal(initConfig)
 	if err != nil {
 		return err
 	}
 
-	return img.AppendContent(content, 0644, initConfigPath)
+	return img.AppendContent(content, 0644, overlayInitConfigPath)
+}
+
+func initNetworkConfig(conf *generatorConfig) *InitNetworkConfig {
+	var network *InitNetworkConfig
+	if conf.networkConfigType == netDhcp {
+		network = &InitNetworkConfig{}
+		network.Dhcp = true
+	} else if conf.networkConfigType == netStatic {
+		network = &InitNetworkConfig{}
+		network.Ip = conf.networkStaticConfig.ip
+		network.Gateway = conf.networkStaticConfig.gateway
+		network.DNSServers = conf.networkStaticConfig.dnsServers
+	}
+	if network != nil {
+		network.KeyServerInsecure = conf.keyServerInsecure
+	}
+	if conf.networkActiveInterfaces != nil {
+		network.Interfaces = conf.networkActiveInterfaces
+	}
+	return network
 }
 
 func (img *Image) appendModules(conf *generatorConfig) (*Kmod, error) {
@@ -198,17 +705,62 @@ func (img *Image) appendModules(conf *generatorConfig) (*Kmod, error) {
 		return nil, err
 	}
 
+	predefinedModules := defaultModulesList
+	if conf.universal {
+		predefinedModules = universalModulesList(conf.universalModules)
+	}
+	predefinedModules = archModules(predefinedModules, conf.arch)
 	// some kernels might be compiled without some of the modules (e.g. virtio) from the predefined list
 	// generator should not fail if a module is not detected
-	if err := kmod.activateModules(true, false, defaultModulesList...); err != nil {
+	if err := kmod.activateModules(true, false, predefinedModules...); err != nil {
 		return nil, err
 	}
+	predefined := make(set, len(kmod.requiredModules))
+	for m := range kmod.requiredModules {
+		predefined[m] = true
+	}
 	if err := kmod.activateModules(false, true, conf.modules...); err != nil {
 		return nil, err
 	}
+	if kmod.deviceModules != nil {
+		// 'modules' is the escape hatch for the drivers of the devices absent at the host now
+		kmod.forcedModules = make(set)
+		for m := range kmod.requiredModules {
+			if !predefined[m] {
+				kmod.forcedModules[m] = true
+			}
+		}
+	}
 	if err := kmod.activateModules(false, true, conf.modulesForceLoad...); err != nil {
 		return nil, err
 	}
+	for _, m := range conf.mounts {
+		// the filesystem type can be detected at boot only, the module is missing if the filesystem is built-in
+		if m.Fstype != "" {
+			if err := kmod.activateModules(false, false, m.Fstype); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if conf.factoryReset != nil {
+		// the filesystem of the recreated root is known in advance
+		if err := kmod.activateModules(false, false, conf.factoryReset.Fstype); err != nil {
+			return nil, err
+		}
+	}
+	if conf.virtioRng {
+		// the driver is missing if it is built into the kernel, the kernel feeds the RNG from it itself then
+		if err := kmod.activateModules(false, false, "virtio_rng", "virtio_pci"); err != nil {
+			return nil, err
+		}
+	}
+	if conf.wireguardConfig != "" {
+		// the module is missing if wireguard is built into the kernel
+		if err := kmod.activateModules(false, false, "wireguard"); err != nil {
+			return nil, err
+		}
+	}
+	kmod.blockModules(conf.modulesBlocklist...)
 
 	// cbc module is a hard requirement for "encrypted_keys"
 	// https://github.com/torvalds/linux/blob/master/security/keys/encrypted-keys/encrypted.c#L42
@@ -220,6 +772,9 @@ func (img *Image) appendModules(conf *generatorConfig) (*Kmod, error) {
 	if err := kmod.addModulesToImage(img); err != nil {
 		return nil, err
 	}
+	if kmod.deviceModules != nil {
+		kmod.reportHostDeviceModules()
+	}
 
 	// collect aliases for required modules only
 	aliases, err := kmod.filterAliasesForRequiredModules(conf)
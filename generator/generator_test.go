@@ -2,17 +2,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cavaliercoder/go-cpio"
 	"gopkg.in/yaml.v3"
 )
 
@@ -54,21 +59,43 @@ func prepareAssets(t *testing.T) {
 type options struct {
 	workDir                      string
 	compression                  string
+	compressionLevel             int
+	kernelConfig                 string // content of the kernel build config, unknown config if empty
+	modulesCompression           string
 	universal                    bool
+	universalModules             string
+	hostOnlyDevices              bool
 	extraModules                 []string // modules to add to the image
+	modulesBlocklist             []string
+	modulesForceLoad             []string
 	prepareModulesAt             []string // copy a test module to these locations
 	unpackImage                  bool
 	hostModules                  []string // modules as found under /proc/modules
 	hostAliases                  []string // list of all aliases for the host devices
 	kernelAliases                []alias  // aliases as found under kernel/modules.alias (pattern + corresponding module)
 	softDeps                     []string
+	hostDevices                  []hostDevice
+	crypttab                     string
+	fsck                         []string
 	builtin                      []string
 	extraFiles                   []string
+	firmwareFiles                []string
+	prepareFirmwareAt            []string // create firmware files at these locations
 	modprobeOptions              map[string]string
 	expectError                  string
 	stripBinaries                bool
 	enableVirtualConsole         bool
 	vConsoleConfig, localeConfig string
+	modTime                      time.Time
+	microcode                    bool
+	cpuVendor                    string
+	overlay                      bool
+	randomSeed                   bool
+	hooks                        []HookConfig
+	udevRules                    []string
+	extraFileMappings            []extraFileMapping
+	staticInit                   bool
+	arch                         string
 }
 
 func generateAliasesFile(aliases []alias) []byte {
@@ -165,6 +192,17 @@ func createTestInitRamfs(t *testing.T, opts *options) {
 		t.Fatal(err)
 	}
 
+	firmwareDir := path.Join(wd, "firmware")
+	for _, f := range opts.prepareFirmwareAt {
+		loc := firmwareDir + "/" + f
+		if err := os.MkdirAll(filepath.Dir(loc), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(loc, []byte("firmware "+f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
 	listAsFunc := func(in []string) func() (set, error) {
 		out := make(set)
 		for _, a := range in {
@@ -178,20 +216,49 @@ func createTestInitRamfs(t *testing.T, opts *options) {
 		compression = "none"
 	}
 
+	readKernelConfig := func(string) ([]byte, error) {
+		if opts.kernelConfig == "" {
+			return nil, nil
+		}
+		return []byte(opts.kernelConfig), nil
+	}
+
 	conf := generatorConfig{
 		initBinary:           "/usr/bin/false",
 		compression:          compression,
+		compressionLevel:     opts.compressionLevel,
+		modulesCompression:   opts.modulesCompression,
 		universal:            opts.universal,
+		universalModules:     opts.universalModules,
 		kernelVersion:        "matestkernel",
 		modulesDir:           modulesDir,
 		output:               wd + "/booster.img",
 		readDeviceAliases:    listAsFunc(opts.hostAliases),
 		readHostModules:      listAsFunc(opts.hostModules),
+		readHostDevices:      func() ([]hostDevice, error) { return opts.hostDevices, nil },
+		hostOnlyDevices:      opts.hostOnlyDevices,
+		crypttab:             opts.crypttab,
+		fsck:                 opts.fsck,
 		readModprobeOptions:  func() (map[string]string, error) { return opts.modprobeOptions, nil },
+		readKernelConfig:     readKernelConfig,
 		extraFiles:           opts.extraFiles,
+		firmwareFiles:        opts.firmwareFiles,
+		hostFirmwareDir:      firmwareDir,
 		modules:              opts.extraModules,
+		modulesBlocklist:     opts.modulesBlocklist,
+		modulesForceLoad:     opts.modulesForceLoad,
 		stripBinaries:        opts.stripBinaries,
 		enableVirtualConsole: opts.enableVirtualConsole,
+		modTime:              opts.modTime,
+		microcode:            opts.microcode,
+		readCPUVendor:        func() (string, error) { return opts.cpuVendor, nil },
+		overlay:              opts.overlay,
+		randomSeed:           opts.randomSeed,
+		hooks:                opts.hooks,
+		udevRules:            opts.udevRules,
+		extraFileMappings:    opts.extraFileMappings,
+		staticInit:           opts.staticInit,
+		arch:                 opts.arch,
 	}
 	if opts.enableVirtualConsole {
 		conf.vconsolePath = wd + "/vconsole.conf"
@@ -217,7 +284,19 @@ func createTestInitRamfs(t *testing.T, opts *options) {
 		return
 	}
 
-	if err := verifyCompressedFile(compression, wd+"/booster.img"); err != nil {
+	image := wd + "/booster.img"
+	if opts.microcode {
+		// the compressed archive follows the uncompressed early one
+		content, err := os.ReadFile(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		image = wd + "/booster.main.img"
+		if err := os.WriteFile(image, content[earlyArchiveSize(t, content):], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := verifyCompressedFile(compression, image); err != nil {
 		t.Fatal(err)
 	}
 
@@ -234,6 +313,23 @@ func createTestInitRamfs(t *testing.T, opts *options) {
 	}
 }
 
+// earlyArchiveSize returns the size of the uncompressed cpio archive at the beginning of the image
+func earlyArchiveSize(t *testing.T, image []byte) int {
+	r := bytes.NewReader(image)
+	archive := cpio.NewReader(r)
+	for {
+		_, err := archive.Next()
+		if err == io.EOF {
+			break // the trailer entry
+		}
+		if err != nil {
+			t.Fatalf("reading early archive: %v", err)
+		}
+	}
+	// the trailer name is padded to 4 bytes
+	return (len(image) - r.Len() + 3) &^ 3
+}
+
 func verifyCompressedFile(compression string, file string) error {
 	var verifyCmd *exec.Cmd
 	switch compression {
@@ -326,6 +422,23 @@ func testGzipImageCompression(t *testing.T) {
 	createTestInitRamfs(t, &options{compression: "gzip"})
 }
 
+func testImageCompressionLevel(t *testing.T) {
+	t.Run("Zstd", func(t *testing.T) {
+		createTestInitRamfs(t, &options{compression: "zstd", compressionLevel: 19, kernelConfig: "CONFIG_RD_GZIP=y\nCONFIG_RD_ZSTD=y\n"})
+	})
+	t.Run("Gzip", func(t *testing.T) {
+		createTestInitRamfs(t, &options{compression: "gzip", compressionLevel: 1})
+	})
+}
+
+func testUnsupportedKernelDecompressor(t *testing.T) {
+	createTestInitRamfs(t, &options{
+		compression:  "zstd",
+		kernelConfig: "CONFIG_RD_GZIP=y\n# CONFIG_RD_ZSTD is not set\n",
+		expectError:  "the kernel is built without CONFIG_RD_ZSTD, it is unable to decompress zstd compressed image, use another compression algorithm",
+	})
+}
+
 func testXzImageCompression(t *testing.T) {
 	createTestInitRamfs(t, &options{compression: "xz"})
 }
@@ -390,6 +503,19 @@ func testSoftDependencies(t *testing.T) {
 
 	// all except kernel/testfoo.ko need to be in the image
 	checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/modules/", "foo.ko", "a.ko", "b.ko", "c.ko", "d.ko", "booster.alias")
+
+	// init skips a soft dependency blocklisted at boot, it needs to know which of the dependencies are soft
+	c, err := os.ReadFile(opts.workDir + "/image.unpacked/etc/booster.init.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg InitConfig
+	if err := yaml.Unmarshal(c, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string][]string{"foo": {"abuiltinfoo", "a", "b"}}; !reflect.DeepEqual(cfg.ModuleSoftDependencies, expected) {
+		t.Fatalf("soft dependencies expected %v, got %v", expected, cfg.ModuleSoftDependencies)
+	}
 }
 
 func testComplexPatterns(t *testing.T) {
@@ -407,6 +533,63 @@ func testComplexPatterns(t *testing.T) {
 	checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/modules/", "booster.alias", "k4.ko", "k5.ko", "k7_1.ko")
 }
 
+func testUniversalModuleSets(t *testing.T) {
+	modules := []string{"kernel/fs/foo.ko", "kernel/crypto/cbc.ko", "kernel/drivers/nvme/host/nvme.ko", "kernel/drivers/net/ethernet/intel/e1000e.ko", "kernel/sound/snd.ko"}
+
+	t.Run("Storage", func(t *testing.T) {
+		opts := options{
+			universal:        true,
+			universalModules: "storage",
+			prepareModulesAt: modules,
+			unpackImage:      true,
+		}
+		createTestInitRamfs(t, &opts)
+		checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/modules/", "foo.ko", "cbc.ko", "nvme.ko", "booster.alias")
+	})
+	t.Run("Net", func(t *testing.T) {
+		opts := options{
+			universal:        true,
+			universalModules: "net",
+			prepareModulesAt: modules,
+			unpackImage:      true,
+		}
+		createTestInitRamfs(t, &opts)
+		checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/modules/", "cbc.ko", "e1000e.ko", "booster.alias")
+	})
+	t.Run("All", func(t *testing.T) {
+		opts := options{
+			universal:        true,
+			universalModules: "all",
+			prepareModulesAt: modules,
+			unpackImage:      true,
+		}
+		createTestInitRamfs(t, &opts)
+		checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/modules/", "foo.ko", "cbc.ko", "nvme.ko", "e1000e.ko", "booster.alias")
+	})
+}
+
+func testModulesBlocklist(t *testing.T) {
+	opts := options{
+		universal:        true,
+		prepareModulesAt: []string{"kernel/fs/foo.ko", "kernel/fs/bar.ko", "kernel/fs/baz.ko", "kernel/crypto/cbc.ko"},
+		softDeps:         []string{"foo pre: bar post: baz"},
+		modulesBlocklist: []string{"bar", "missing"},
+		unpackImage:      true,
+	}
+	createTestInitRamfs(t, &opts)
+
+	checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/modules/", "foo.ko", "baz.ko", "cbc.ko", "booster.alias")
+}
+
+func testBlocklistedDependency(t *testing.T) {
+	createTestInitRamfs(t, &options{
+		universal:        true,
+		prepareModulesAt: []string{"kernel/crypto/encrypted_keys.ko", "kernel/crypto/cbc.ko"},
+		modulesBlocklist: []string{"cbc"},
+		expectError:      "module encrypted_keys depends on module cbc that is in modules_blocklist, remove the module from the image with 'modules: -encrypted_keys' in booster.yaml",
+	})
+}
+
 func testHostMode(t *testing.T) {
 	opts := options{
 		universal:        false,
@@ -455,6 +638,127 @@ pci:v*d*sv*sd*bc0Csc03i30* cbc`
 	checkFileExistence(t, opts.workDir+"/image.unpacked/usr/lib/firmware/rtw88/rtw8723d_fw.bin")
 }
 
+func testHostOnlyDevices(t *testing.T) {
+	opts := options{
+		universal:       false,
+		hostOnlyDevices: true,
+		prepareModulesAt: []string{
+			"kernel/fs/ext4.ko",
+			"kernel/drivers/md/dm_crypt.ko",
+			"kernel/drivers/ata/ahci.ko",
+			"kernel/drivers/usb/host/xhci_pci.ko",
+			"kernel/drivers/net/ethernet/intel/e1000e.ko",
+			"kernel/drivers/net/ethernet/realtek/r8169.ko",
+			"kernel/drivers/scsi/mydisk.ko",
+		},
+		// r8169 and xhci_pci are loaded but their devices are unplugged
+		hostModules: []string{"ext4", "dm_crypt", "ahci", "xhci_pci", "e1000e", "r8169"},
+		hostDevices: []hostDevice{
+			{syspath: "/sys/devices/pci0000:00/0000:00:1f.2", modalias: "pci:v00008086d00002822sv00001028sd000007A1bc01sc06i01", driverModule: "ahci"},
+			{syspath: "/sys/devices/pci0000:00/0000:00:19.0", modalias: "pci:v00008086d000015B8sv00001028sd000007A1bc02sc00i00"},
+		},
+		hostAliases: []string{
+			"pci:v00008086d00002822sv00001028sd000007A1bc01sc06i01",
+			"pci:v00008086d000015B8sv00001028sd000007A1bc02sc00i00",
+		},
+		kernelAliases: []alias{
+			{"pci:v*d*sv*sd*bc01sc06i01*", "ahci"},
+			{"pci:v*d*sv*sd*bc0Csc03i30*", "xhci_pci"},
+			{"pci:v00008086d000015B8sv*sd*bc*sc*i*", "e1000e"},
+			{"pci:v000010ECd00008168sv*sd*bc*sc*i*", "r8169"},
+			{"scsi:t-0x00*", "mydisk"},
+			{"devname:mapper/control", "dm_crypt"},
+		},
+		extraModules: []string{"mydisk"}, // the drive is powered down
+		unpackImage:  true,
+	}
+	createTestInitRamfs(t, &opts)
+
+	checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/modules/", "ahci.ko", "booster.alias", "dm_crypt.ko", "e1000e.ko", "ext4.ko", "mydisk.ko")
+
+	aliasesFile, err := os.ReadFile(opts.workDir + "/image.unpacked/usr/lib/modules/booster.alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arr := strings.Split(strings.TrimRight(string(aliasesFile), "\n"), "\n")
+	sort.Strings(arr)
+	expectedAliases := []string{
+		"pci:v*d*sv*sd*bc01sc06i01* ahci",
+		"pci:v00008086d000015B8sv*sd*bc*sc*i* e1000e",
+		"scsi:t-0x00* mydisk",
+	}
+	if !reflect.DeepEqual(arr, expectedAliases) {
+		t.Fatalf("Generated aliases %q do not match the expected %q", arr, expectedAliases)
+	}
+}
+
+func testCrypttab(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := dir + "/root.key"
+	if err := os.WriteFile(keyfile, []byte("secret"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	content := "# encrypted devices\n" +
+		"root UUID=ac8299a8-91ce-4bf6-a524-55a62844b787 " + keyfile + " discard\n" +
+		"home PARTLABEL=crypthome /home.key:LABEL=keystick header=/headers/home.luks:LABEL=esp\n"
+	crypttab := dir + "/crypttab"
+	if err := os.WriteFile(crypttab, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{
+		crypttab:    crypttab,
+		unpackImage: true,
+	}
+	createTestInitRamfs(t, &opts)
+
+	got, err := os.ReadFile(opts.workDir + "/image.unpacked" + crypttabPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Fatalf("expected crypttab %q, got %q", content, got)
+	}
+	checkFileExistence(t, opts.workDir+"/image.unpacked"+keyfile)
+	// the keyfile at another device is not added to the image
+	if _, err := os.Stat(opts.workDir + "/image.unpacked/home.key"); !os.IsNotExist(err) {
+		t.Fatalf("expected /home.key to be missing in the image, got %v", err)
+	}
+}
+
+func testInvalidCrypttab(t *testing.T) {
+	crypttab := t.TempDir() + "/crypttab"
+	if err := os.WriteFile(crypttab, []byte("root\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{
+		crypttab:    crypttab,
+		expectError: "crypttab: " + crypttab + ":1: expected 'name device [keyfile [options]]'",
+	}
+	createTestInitRamfs(t, &opts)
+}
+
+func testFsck(t *testing.T) {
+	checker, err := findBinary("fsck.ext4", "/usr/bin", "/usr/sbin", "/sbin")
+	if err != nil {
+		t.Skip(err)
+	}
+	opts := options{
+		fsck:        []string{"ext4"},
+		unpackImage: true,
+	}
+	createTestInitRamfs(t, &opts)
+	checkFileExistence(t, opts.workDir+"/image.unpacked"+checker)
+}
+
+func testFsckMissing(t *testing.T) {
+	opts := options{
+		fsck:        []string{"nosuchfs"},
+		expectError: "fsck: binary fsck.nosuchfs is not found",
+	}
+	createTestInitRamfs(t, &opts)
+}
+
 func testExtraFiles(t *testing.T) {
 	files := []string{"e", "q", "z"}
 	d := t.TempDir()
@@ -488,6 +792,137 @@ func testInvalidExtraFiles(t *testing.T) {
 	})
 }
 
+func testExtraFileMappings(t *testing.T) {
+	d := t.TempDir()
+	content, err := os.ReadFile("/usr/bin/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(d+"/helper", content, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("helper", d+"/helper-link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(d+"/helper.conf", []byte("verbose=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{
+		extraFileMappings: []extraFileMapping{
+			{source: d + "/helper", dest: "/usr/bin/helper", mode: 0700, hasMode: true},
+			{source: d + "/helper-link", dest: "/usr/bin/helper-link"},
+			{source: d + "/helper.conf", dest: "/etc/helper.conf", mode: 0600, hasMode: true},
+		},
+	}
+	createTestInitRamfs(t, &opts)
+
+	entries, err := readImage(opts.workDir + "/booster.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]imageEntry)
+	var libcFound bool
+	for _, e := range entries {
+		found["/"+e.name] = e
+		if strings.Contains(path.Base(e.name), "libc.so") {
+			libcFound = true
+		}
+	}
+	if e, ok := found["/usr/bin/helper"]; !ok || e.mode.Perm() != 0700 || e.size != int64(len(content)) {
+		t.Fatalf("unexpected helper entry %+v", e)
+	}
+	if !libcFound {
+		t.Fatal("the shared libraries of the helper are not found in the image")
+	}
+	if e, ok := found["/usr/bin/helper-link"]; !ok || e.mode&os.ModeSymlink == 0 || e.link != d+"/helper" {
+		t.Fatalf("unexpected helper symlink entry %+v", e)
+	}
+	if _, ok := found[d+"/helper"]; !ok {
+		t.Fatal("the symlink target is not found in the image")
+	}
+	if e, ok := found["/etc/helper.conf"]; !ok || e.mode.Perm() != 0600 {
+		t.Fatalf("unexpected helper config entry %+v", e)
+	}
+}
+
+func testMissingExtraFileMapping(t *testing.T) {
+	createTestInitRamfs(t, &options{
+		extraFileMappings: []extraFileMapping{{source: "/foo/nonexistent", dest: "/usr/bin/nonexistent"}},
+		expectError:       "lstat /foo/nonexistent: no such file or directory",
+	})
+}
+
+func testDynamicInitRejected(t *testing.T) {
+	createTestInitRamfs(t, &options{
+		staticInit:  true,
+		expectError: "init binary /usr/bin/false is dynamically linked but static_init is set, build init with CGO_ENABLED=0",
+	})
+}
+
+func testInitArchMismatch(t *testing.T) {
+	arch := "arm64"
+	if runtime.GOARCH == arch {
+		arch = "amd64"
+	}
+	createTestInitRamfs(t, &options{
+		arch:        arch,
+		expectError: "init binary /usr/bin/false is built for " + runtime.GOARCH + " but the image is generated for " + arch + ", build init with GOARCH=" + arch,
+	})
+}
+
+func testRecompressedModules(t *testing.T) {
+	opts := options{
+		universal:          true,
+		modulesCompression: "zstd",
+		prepareModulesAt:   []string{"kernel/fs/plain.ko", "kernel/fs/xz.ko.xz", "kernel/fs/gz.ko.gz"},
+		unpackImage:        true,
+	}
+	createTestInitRamfs(t, &opts)
+
+	checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/modules/", "plain.ko.zst", "xz.ko.zst", "gz.ko.zst", "booster.alias")
+	f, err := os.Open(opts.workDir + "/image.unpacked/usr/lib/modules/xz.ko.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := moduleReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile("assets/test_module.ko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatal("recompressed module does not match the original one")
+	}
+}
+
+func testFirmwareFiles(t *testing.T) {
+	opts := options{
+		prepareFirmwareAt: []string{"rtl_nic/rtl8168h-2.fw", "rtl_nic/rtl8125a-3.fw", "intel/ibt-17-16-1.sfi", "intel/ibt-17-16-1.ddc"},
+		firmwareFiles:     []string{"rtl_nic/rtl8168*.fw", "intel/", "missing-*.bin"},
+		unpackImage:       true,
+	}
+	createTestInitRamfs(t, &opts)
+
+	checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/firmware/rtl_nic", "rtl8168h-2.fw")
+	checkDirListing(t, opts.workDir+"/image.unpacked/usr/lib/firmware/intel", "ibt-17-16-1.sfi", "ibt-17-16-1.ddc")
+	checkFilesEqual(t, opts.workDir+"/firmware/rtl_nic/rtl8168h-2.fw", opts.workDir+"/image.unpacked/usr/lib/firmware/rtl_nic/rtl8168h-2.fw")
+}
+
+func testInvalidFirmwareFiles(t *testing.T) {
+	createTestInitRamfs(t, &options{
+		firmwareFiles: []string{"../modules/*"},
+		expectError:   "firmware_files: invalid pattern '../modules/*', expected a path relative to /usr/lib/firmware/",
+	})
+}
+
 func testCompressedModules(t *testing.T) {
 	opts := options{
 		universal:        true,
@@ -511,6 +946,277 @@ func testCompressedModules(t *testing.T) {
 	checkFileExistence(t, opts.workDir+"/image.unpacked/usr/lib/firmware/rtw88/rtw8723d_fw.bin")
 }
 
+func testReproducibleImage(t *testing.T) {
+	modTime := time.Unix(1620000000, 0)
+	// the work dirs are removed once the subtests finish, so the checksums are computed right after the builds
+	build := func(checksum *[sha256.Size]byte) func(t *testing.T) {
+		return func(t *testing.T) {
+			opts := options{
+				universal:        true,
+				compression:      "zstd",
+				modTime:          modTime,
+				prepareModulesAt: []string{"kernel/fs/plain.ko", "kernel/fs/zst.ko.zst", "kernel/fs/xz.ko.xz", "kernel/crypto/cbc.ko", "kernel/drivers/md/dm_crypt.ko"},
+				extraFiles:       []string{"true"},
+			}
+			createTestInitRamfs(t, &opts)
+			content, err := os.ReadFile(opts.workDir + "/booster.img")
+			if err != nil {
+				t.Fatal(err)
+			}
+			*checksum = sha256.Sum256(content)
+			checkImageEntriesCanonical(t, bytes.NewReader(content), modTime)
+		}
+	}
+	var first, second [sha256.Size]byte
+	t.Run("Build", func(t *testing.T) {
+		t.Run("First", build(&first))
+		t.Run("Second", build(&second))
+	})
+	if first != second {
+		t.Fatalf("images built from the same input differ, sha256 %x and %x", first, second)
+	}
+}
+
+// checkImageEntriesCanonical checks that the entries of the zstd compressed image are sorted and have the same
+// modification time and owner
+func checkImageEntriesCanonical(t *testing.T, image io.Reader, modTime time.Time) {
+	r, err := moduleReader(image) // the image is zstd compressed the same way as the modules
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := cpio.NewReader(r)
+	var names []string
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.ModTime.Equal(modTime) || hdr.UID != 0 || hdr.GID != 0 {
+			t.Fatalf("%s: expected mtime %v and root owner, got mtime %v uid %d gid %d", hdr.Name, modTime, hdr.ModTime, hdr.UID, hdr.GID)
+		}
+		names = append(names, hdr.Name)
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Fatalf("image entries are not sorted: %v", names)
+	}
+}
+
+func testEarlyMicrocode(t *testing.T) {
+	opts := options{
+		compression:       "zstd",
+		microcode:         true,
+		cpuVendor:         "GenuineIntel",
+		prepareFirmwareAt: []string{"intel-ucode/06-8e-09", "intel-ucode/06-9e-0a", "amd-ucode/microcode_amd_fam17h.bin"},
+	}
+	createTestInitRamfs(t, &opts)
+
+	image, err := os.ReadFile(opts.workDir + "/booster.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(image, []byte("070701")) {
+		t.Fatal("the image does not start with an uncompressed cpio archive")
+	}
+	archive := cpio.NewReader(bytes.NewReader(image))
+	var names []string
+	var microcode []byte
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "kernel/x86/microcode/GenuineIntel.bin" {
+			if microcode, err = io.ReadAll(archive); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectedNames := []string{"kernel", "kernel/x86", "kernel/x86/microcode", "kernel/x86/microcode/GenuineIntel.bin"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("expected early archive entries %v, got %v", expectedNames, names)
+	}
+	if expected := "firmware intel-ucode/06-8e-09firmware intel-ucode/06-9e-0a"; string(microcode) != expected {
+		t.Fatalf("expected microcode '%s', got '%s'", expected, microcode)
+	}
+	if main := image[earlyArchiveSize(t, image):]; !bytes.HasPrefix(main, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		t.Fatal("the main archive is expected to be zstd compressed")
+	}
+}
+
+func testInspectImage(t *testing.T) {
+	for _, compression := range []string{"zstd", "none"} {
+		compression := compression
+		t.Run(compression, func(t *testing.T) {
+			opts := options{
+				compression:       compression,
+				universal:         true,
+				microcode:         true,
+				prepareFirmwareAt: []string{"intel-ucode/06-8e-09"},
+				prepareModulesAt:  []string{"kernel/fs/foo.ko", "kernel/crypto/cbc.ko"},
+				softDeps:          []string{"foo post: cbc"},
+				kernelAliases:     []alias{{"fs-foo", "foo"}},
+			}
+			createTestInitRamfs(t, &opts)
+
+			entries, err := readImage(opts.workDir + "/booster.img")
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := make(map[string]imageEntry)
+			for _, e := range entries {
+				found[e.name] = e
+			}
+			if e, ok := found["kernel/x86/microcode/GenuineIntel.bin"]; !ok || !e.early {
+				t.Fatalf("early microcode is not found: %+v", e)
+			}
+			if e, ok := found["init"]; !ok || e.early || e.mode != 0755 {
+				t.Fatalf("init binary is not found: %+v", e)
+			}
+			if e, ok := found["usr/lib/modules/foo.ko"]; !ok || e.mode != 0644 || e.size == 0 {
+				t.Fatalf("module foo is not found: %+v", e)
+			}
+			if e, ok := found["usr/lib/modules"]; !ok || !e.mode.IsDir() {
+				t.Fatalf("modules dir is not found: %+v", e)
+			}
+
+			problems, err := verifyImage(entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != 0 {
+				t.Fatalf("unexpected problems %v", problems)
+			}
+		})
+	}
+}
+
+func testOverlayImage(t *testing.T) {
+	opts := options{
+		overlay:          true,
+		prepareModulesAt: []string{"kernel/fs/foo.ko"},
+		modulesForceLoad: []string{"foo"},
+		extraFiles:       []string{"/usr/bin/true"},
+		modprobeOptions:  map[string]string{"foo": "bar=1"},
+	}
+	createTestInitRamfs(t, &opts)
+
+	entries, err := readImage(opts.workDir + "/booster.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overlayConfig []byte
+	for _, e := range entries {
+		switch name := "/" + e.name; {
+		case name == "/init" || name == initConfigPath || strings.HasPrefix(name, imageModulesDir):
+			t.Fatalf("overlay image should not contain %s", name)
+		case name == overlayInitConfigPath:
+			overlayConfig = e.content
+		}
+	}
+	if overlayConfig == nil {
+		t.Fatalf("overlay image does not contain %s", overlayInitConfigPath)
+	}
+
+	var config InitConfig
+	if err := yaml.Unmarshal(overlayConfig, &config); err != nil {
+		t.Fatal(err)
+	}
+	expected := InitConfig{
+		Kernel:           "matestkernel",
+		ModulesForceLoad: []string{"foo"},
+		ModprobeOptions:  map[string]string{"foo": "bar=1"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected overlay config %+v, got %+v", expected, config)
+	}
+}
+
+func testRandomSeed(t *testing.T) {
+	opts := options{randomSeed: true}
+	createTestInitRamfs(t, &opts)
+
+	entries, err := readImage(opts.workDir + "/booster.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if "/"+e.name != randomSeedPath {
+			continue
+		}
+		if e.mode.Perm() != 0600 || e.size != randomSeedSize {
+			t.Fatalf("expected random seed of %d bytes readable by root only, got %s %d", randomSeedSize, e.mode, e.size)
+		}
+		return
+	}
+	t.Fatalf("image does not contain %s", randomSeedPath)
+}
+
+func testHooks(t *testing.T) {
+	hook := t.TempDir() + "/unlock-data"
+	if err := os.WriteFile(hook, []byte("#!/bin/sh -e\necho $BOOSTER_ROOT_DEVICE\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{hooks: []HookConfig{{File: hook, Fatal: true}}}
+	createTestInitRamfs(t, &opts)
+
+	entries, err := readImage(opts.workDir + "/booster.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hookFound, interpreterFound bool
+	var initConfig InitConfig
+	for _, e := range entries {
+		switch "/" + e.name {
+		case hooksDir + "/00-unlock-data":
+			hookFound = e.mode.Perm() == 0755
+		case "/bin/sh":
+			interpreterFound = true
+		case initConfigPath:
+			if err := yaml.Unmarshal(e.content, &initConfig); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !hookFound || !interpreterFound {
+		t.Fatalf("expected the executable hook and its interpreter in the image, found hook %v interpreter %v", hookFound, interpreterFound)
+	}
+	expected := []InitHook{{Path: hooksDir + "/00-unlock-data", Fatal: true}}
+	if !reflect.DeepEqual(initConfig.Hooks, expected) {
+		t.Fatalf("expected hooks %+v in the init config, got %+v", expected, initConfig.Hooks)
+	}
+}
+
+func testUdevRules(t *testing.T) {
+	rules := t.TempDir() + "/70-net.rules"
+	content := `SUBSYSTEM=="net", ATTR{address}=="52:54:00:12:34:56", NAME="lan0"` + "\n"
+	if err := os.WriteFile(rules, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{udevRules: []string{rules}}
+	createTestInitRamfs(t, &opts)
+
+	entries, err := readImage(opts.workDir + "/booster.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if "/"+e.name == udevRulesDir+"/70-net.rules" {
+			if e.size != int64(len(content)) || e.mode.Perm() != 0644 {
+				t.Fatalf("unexpected rules file %+v", e)
+			}
+			return
+		}
+	}
+	t.Fatal("the udev rules file is not found in the image")
+}
+
 func testModuleNameAliases(t *testing.T) {
 	opts := options{
 		prepareModulesAt: []string{"kernel/fs/plain.ko", "kernel/fs/zst.ko.zst", "kernel/fs/xz.ko.xz", "kernel/fs/lz4.ko.lz4", "kernel/fs/gz.ko.gz"},
@@ -542,6 +1248,47 @@ func testStripBinaries(t *testing.T) {
 	checkFileExistence(t, opts.workDir+"/image.unpacked/usr/lib/firmware/rtw88/rtw8723d_fw.bin")
 }
 
+func testStrippedBinaryRuns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chroot requires root")
+	}
+	if _, err := exec.LookPath("objcopy"); err != nil {
+		t.Skip("objcopy is not installed")
+	}
+	// a binary with a large debug section the strip removes
+	d := t.TempDir()
+	if err := os.WriteFile(d+"/debuginfo", make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("objcopy", "--add-section", ".debug_booster="+d+"/debuginfo", "/usr/bin/true", d+"/true").CombinedOutput(); err != nil {
+		t.Fatalf("objcopy: %v: %s", err, out)
+	}
+	fi, err := os.Stat(d + "/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{
+		stripBinaries:     true,
+		extraFileMappings: []extraFileMapping{{source: d + "/true", dest: "/usr/bin/true-debug"}},
+		unpackImage:       true,
+	}
+	createTestInitRamfs(t, &opts)
+
+	root := opts.workDir + "/image.unpacked"
+	stripped, err := os.Stat(root + "/usr/bin/true-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stripped.Size() >= fi.Size()-1<<20 {
+		t.Fatalf("expected the debug section to be stripped, the binary size is %d, the original size is %d", stripped.Size(), fi.Size())
+	}
+	// the stripped binary and its stripped shared libraries still work
+	if out, err := exec.Command("chroot", root, "/usr/bin/true-debug").CombinedOutput(); err != nil {
+		t.Fatalf("stripped binary does not run: %v: %s", err, out)
+	}
+}
+
 func testEnableVirtualConsole(t *testing.T) {
 	opts := options{
 		universal:            true,
@@ -558,6 +1305,55 @@ func testEnableVirtualConsole(t *testing.T) {
 	checkFileExistence(t, opts.workDir+"/image.unpacked/console/font.unimap")
 }
 
+func testConsoleFont(t *testing.T) {
+	// a raw 8x16 font
+	font := t.TempDir() + "/ter-116n.fnt"
+	if err := os.WriteFile(font, make([]byte, 256*16), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{
+		enableVirtualConsole: true,
+		vConsoleConfig:       "FONT=" + font + "\n",
+	}
+	createTestInitRamfs(t, &opts)
+
+	entries, err := readImage(opts.workDir + "/booster.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var initConfig InitConfig
+	for _, e := range entries {
+		switch e.name {
+		case "usr/bin/setfont":
+			t.Fatal("setfont is not needed to load the font")
+		case "console/font":
+			if e.size != 256*16 {
+				t.Fatalf("unexpected font size %d", e.size)
+			}
+		case "etc/booster.init.yaml":
+			if err := yaml.Unmarshal(e.content, &initConfig); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if c := initConfig.VirtualConsole; c == nil || c.FontFile != "/console/font" {
+		t.Fatalf("unexpected virtual console config %+v", c)
+	}
+}
+
+func testInvalidConsoleFont(t *testing.T) {
+	font := t.TempDir() + "/broken.psf"
+	if err := os.WriteFile(font, []byte("\x36\x04\x00\x10"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{
+		enableVirtualConsole: true,
+		vConsoleConfig:       "FONT=" + font + "\n",
+		expectError:          "font " + font + ": PSF1 font glyphs are truncated",
+	}
+	createTestInitRamfs(t, &opts)
+}
+
 func testModprobeOptions(t *testing.T) {
 	opts := options{
 		prepareModulesAt: []string{"kernel/fs/test1.ko", "test2.ko", "test3.ko", "test4.ko"},
@@ -607,16 +1403,43 @@ func TestGenerator(t *testing.T) {
 	t.Run("ZstdImageCompression", testZstdImageCompression)
 	t.Run("GzipImageCompression", testGzipImageCompression)
 	t.Run("XzImageCompression", testXzImageCompression)
+	t.Run("ImageCompressionLevel", testImageCompressionLevel)
+	t.Run("UnsupportedKernelDecompressor", testUnsupportedKernelDecompressor)
 	t.Run("Lz4ImageCompression", testLz4ImageCompression)
 	t.Run("UniversalMode", testUniversalMode)
+	t.Run("UniversalModuleSets", testUniversalModuleSets)
 	t.Run("HostMode", testHostMode)
+	t.Run("HostOnlyDevices", testHostOnlyDevices)
+	t.Run("Crypttab", testCrypttab)
+	t.Run("InvalidCrypttab", testInvalidCrypttab)
+	t.Run("Fsck", testFsck)
+	t.Run("FsckMissing", testFsckMissing)
+	t.Run("ModulesBlocklist", testModulesBlocklist)
+	t.Run("BlocklistedDependency", testBlocklistedDependency)
 	t.Run("ComplexPatterns", testComplexPatterns)
 	t.Run("SoftDepenencies", testSoftDependencies)
 	t.Run("ExtraFiles", testExtraFiles)
 	t.Run("InvalidExtraFiles", testInvalidExtraFiles)
+	t.Run("ExtraFileMappings", testExtraFileMappings)
+	t.Run("MissingExtraFileMapping", testMissingExtraFileMapping)
+	t.Run("DynamicInitRejected", testDynamicInitRejected)
+	t.Run("InitArchMismatch", testInitArchMismatch)
+	t.Run("FirmwareFiles", testFirmwareFiles)
+	t.Run("InvalidFirmwareFiles", testInvalidFirmwareFiles)
 	t.Run("CompressedModules", testCompressedModules)
+	t.Run("RecompressedModules", testRecompressedModules)
+	t.Run("ReproducibleImage", testReproducibleImage)
+	t.Run("EarlyMicrocode", testEarlyMicrocode)
+	t.Run("InspectImage", testInspectImage)
+	t.Run("OverlayImage", testOverlayImage)
+	t.Run("RandomSeed", testRandomSeed)
+	t.Run("Hooks", testHooks)
+	t.Run("UdevRules", testUdevRules)
 	t.Run("ModuleNameAliases", testModuleNameAliases)
 	t.Run("StripBinaries", testStripBinaries)
+	t.Run("StrippedBinaryRuns", testStrippedBinaryRuns)
 	t.Run("EnableVirtualConsole", testEnableVirtualConsole)
+	t.Run("ConsoleFont", testConsoleFont)
+	t.Run("InvalidConsoleFont", testInvalidConsoleFont)
 	t.Run("ModprobeOptions", testModprobeOptions)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// hookPath is the location of the hook in the image, the index keeps the configured order
+func hookPath(i int, file string) string {
+	return path.Join(hooksDir, fmt.Sprintf("%02d-%s", i, filepath.Base(file)))
+}
+
+// appendHooks adds the pre-pivot hooks. The dependencies of the binaries are added the same way as for extra_files,
+// for a script its interpreter is added.
+func (img *Image) appendHooks(hooks []HookConfig) error {
+	for i, h := range hooks {
+		content, err := os.ReadFile(h.File)
+		if err != nil {
+			return fmt.Errorf("hooks: %v", err)
+		}
+		for _, interpreter := range scriptInterpreters(content) {
+			debug("hooks: adding interpreter %s of %s", interpreter, h.File)
+			if err := img.AppendFile(interpreter); err != nil {
+				return fmt.Errorf("hooks: interpreter of %s: %v", h.File, err)
+			}
+		}
+		if err := img.AppendContent(content, 0755, hookPath(i, h.File)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scriptInterpreters returns the interpreter from the script shebang, e.g. "#!/bin/sh -e". For "#!/usr/bin/env bash"
+// it returns both env and the binary env runs, the latter is looked up at PATH=/usr/bin at boot.
+func scriptInterpreters(content []byte) []string {
+	if !bytes.HasPrefix(content, []byte("#!")) {
+		return nil
+	}
+	line := content[2:]
+	if idx := bytes.IndexByte(line, '\n'); idx != -1 {
+		line = line[:idx]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return nil
+	}
+	if path.Base(fields[0]) == "env" && len(fields) > 1 && !strings.HasPrefix(fields[1], "-") {
+		return []string{fields[0], "/usr/bin/" + fields[1]}
+	}
+	return fields[:1]
+}
+
+// initHooks returns the hooks list for init
+func initHooks(hooks []HookConfig) []InitHook {
+	var result []InitHook
+	for i, h := range hooks {
+		result = append(result, InitHook{Path: hookPath(i, h.File), Fatal: h.Fatal})
+	}
+	return result
+}
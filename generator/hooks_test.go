@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScriptInterpreters(t *testing.T) {
+	check := func(content string, expected ...string) {
+		t.Helper()
+		if got := scriptInterpreters([]byte(content)); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%q: expected interpreters %q, got %q", content, expected, got)
+		}
+	}
+
+	check("#!/bin/sh\necho hello\n", "/bin/sh")
+	check("#! /usr/bin/bash -e\n", "/usr/bin/bash")
+	check("#!/usr/bin/env python3\n", "/usr/bin/env", "/usr/bin/python3")
+	check("#!/usr/bin/env -S bash -e\n", "/usr/bin/env")
+	check("\x7fELF\x02\x01\x01")
+	check("#!\n")
+}
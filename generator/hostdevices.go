@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hostDeviceClasses are the sysfs classes of the devices kept by host_only_devices: the storage and network devices
+// needed to reach the root, the input devices used at the passphrase prompts and the TPMs that unlock the disks
+var hostDeviceClasses = []string{"block", "net", "input", "tpm", "tpmrm"}
+
+// hostDevice is a sysfs device present at the host, either a device of hostDeviceClasses or one of its parents
+type hostDevice struct {
+	syspath      string
+	modalias     string
+	driverModule string // module of the driver bound to the device, empty if no driver is bound or it is built-in
+}
+
+func readHostDevices() ([]hostDevice, error) {
+	return readSysfsDevices("/sys", hostDeviceClasses)
+}
+
+// readSysfsDevices returns the devices of the classes together with their parents up to the sysfs root, e.g. for
+// a NVMe disk it is the disk, the NVMe controller, the PCI bridges and the PCI root
+func readSysfsDevices(sysDir string, classes []string) ([]hostDevice, error) {
+	devicesDir := filepath.Join(sysDir, "devices") + "/"
+	visited := make(set)
+	var devices []hostDevice
+	for _, c := range classes {
+		entries, err := os.ReadDir(filepath.Join(sysDir, "class", c))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			dir, err := filepath.EvalSymlinks(filepath.Join(sysDir, "class", c, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			// the parents of a visited device are visited already
+			for ; strings.HasPrefix(dir, devicesDir) && !visited[dir]; dir = filepath.Dir(dir) {
+				visited[dir] = true
+				d := hostDevice{syspath: dir}
+				if content, err := os.ReadFile(filepath.Join(dir, "modalias")); err == nil {
+					d.modalias = strings.TrimSpace(string(content))
+				}
+				if target, err := os.Readlink(filepath.Join(dir, "driver", "module")); err == nil {
+					d.driverModule = filepath.Base(target)
+				}
+				if d.modalias != "" || d.driverModule != "" {
+					devices = append(devices, d)
+				}
+			}
+		}
+	}
+	return devices, nil
+}
+
+// isHardwareAlias reports if the alias matches modaliases of the devices (e.g. pci:v*d*, usb:v*, acpi*:PNP0303:*)
+// rather than the device nodes, symbols or names requested by the kernel (e.g. devname:, fs-ext4, block-major-7-*)
+func isHardwareAlias(pattern string) bool {
+	return strings.ContainsRune(pattern, ':') && !strings.HasPrefix(pattern, "devname:") && !strings.HasPrefix(pattern, "symbol:")
+}
+
+// findHostDeviceModules computes the modules the present devices need: the modules of their bound drivers and the
+// modules with the aliases matching their modaliases. The modules are mapped to the reason they are needed.
+// The hardware drivers the devices do not need are filtered out from the predefined modules lists.
+func (k *Kmod) findHostDeviceModules(devices []hostDevice) {
+	k.deviceModules = make(map[string]string)
+	k.hardwareDrivers = make(set)
+	for _, a := range k.aliases {
+		if isHardwareAlias(a.pattern) {
+			if p := k.nameToPathMapping.forward[a.module]; strings.HasPrefix(p, "kernel/drivers/") {
+				k.hardwareDrivers[a.module] = true
+			}
+		}
+	}
+
+	for _, d := range devices {
+		if m := normalizeModuleName(d.driverModule); m != "" {
+			if _, ok := k.deviceModules[m]; !ok {
+				k.deviceModules[m] = "driver of " + d.syspath
+			}
+		}
+		if d.modalias == "" {
+			continue
+		}
+		for _, a := range matchAlias(d.modalias, k.aliases) {
+			if _, ok := k.deviceModules[a.module]; !ok {
+				k.deviceModules[a.module] = "alias " + a.pattern + " matches " + d.syspath
+			}
+		}
+	}
+}
+
+// hostNeeds reports if the module is needed at the host. By default it is any module used at the host. With
+// host_only_devices a hardware driver is needed only if a present storage, network, input or TPM device uses it.
+func (k *Kmod) hostNeeds(mod string) bool {
+	if k.deviceModules == nil || !k.hardwareDrivers[mod] {
+		return k.hostModules[mod]
+	}
+	_, ok := k.deviceModules[mod]
+	return ok
+}
+
+// reportHostDeviceModules prints the hardware drivers selected by host_only_devices and why they are added
+func (k *Kmod) reportHostDeviceModules() {
+	var added, skipped []string
+	for m := range k.hardwareDrivers {
+		switch {
+		case k.requiredModules[m]:
+			added = append(added, m)
+		case k.hostModules[m]:
+			skipped = append(skipped, m)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(skipped)
+
+	for _, m := range added {
+		if reason, ok := k.deviceModules[m]; ok {
+			debug("host_only_devices: adding module %s, %s", m, reason)
+		} else if k.forcedModules[m] {
+			debug("host_only_devices: adding module %s, it is specified with modules", m)
+		} else {
+			debug("host_only_devices: adding module %s, it is a dependency of another module", m)
+		}
+	}
+	for _, m := range skipped {
+		debug("host_only_devices: skipping module %s, it is used at the host but no present storage, network, input or TPM device needs it", m)
+	}
+	debug("host_only_devices: %d hardware drivers are added, %d used at the host are skipped", len(added), len(skipped))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadSysfsDevices(t *testing.T) {
+	sys := t.TempDir()
+	mkdir := func(dir string) {
+		if err := os.MkdirAll(filepath.Join(sys, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(file, content string) {
+		if err := os.WriteFile(filepath.Join(sys, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target, link string) {
+		if err := os.Symlink(target, filepath.Join(sys, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pci := "devices/pci0000:00"
+	nvme := pci + "/0000:00:1d.0"
+	mkdir(nvme + "/nvme/nvme0/nvme0n1")
+	mkdir(pci + "/0000:00:19.0/net/eth0")
+	mkdir("devices/virtual/block/loop0")
+	mkdir("devices/platform/i8042/serio0/input/input3")
+	mkdir("bus/pci/drivers/nvme")
+	mkdir("module/nvme")
+	mkdir("module/e1000e")
+	mkdir("class/block")
+	mkdir("class/net")
+	mkdir("class/input")
+	mkdir("class/sound/card0") // not a class of the host devices
+	write(nvme+"/modalias", "pci:v0000144Dd0000A808sv0000144Dsd0000A801bc01sc08i02\n")
+	symlink("../../../bus/pci/drivers/nvme", nvme+"/driver")
+	symlink("../../../../module/nvme", "bus/pci/drivers/nvme/module")
+	write(pci+"/0000:00:19.0/modalias", "pci:v00008086d000015B8sv00001028sd000007A1bc02sc00i00\n")
+	write("devices/platform/i8042/serio0/modalias", "serio:ty06pr00id00ex00\n")
+	symlink("../../"+nvme+"/nvme/nvme0/nvme0n1", "class/block/nvme0n1")
+	symlink("../../devices/virtual/block/loop0", "class/block/loop0")
+	symlink("../../"+pci+"/0000:00:19.0/net/eth0", "class/net/eth0")
+	symlink("../../devices/platform/i8042/serio0/input/input3", "class/input/input3")
+
+	devices, err := readSysfsDevices(sys, []string{"block", "net", "input", "tpm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := filepath.EvalSymlinks(sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []hostDevice{
+		{syspath: filepath.Join(root, nvme), modalias: "pci:v0000144Dd0000A808sv0000144Dsd0000A801bc01sc08i02", driverModule: "nvme"},
+		{syspath: filepath.Join(root, pci, "0000:00:19.0"), modalias: "pci:v00008086d000015B8sv00001028sd000007A1bc02sc00i00"},
+		{syspath: filepath.Join(root, "devices/platform/i8042/serio0"), modalias: "serio:ty06pr00id00ex00"},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("expected devices %+v, got %+v", expected, devices)
+	}
+}
+
+func TestIsHardwareAlias(t *testing.T) {
+	check := func(pattern string, expected bool) {
+		if isHardwareAlias(pattern) != expected {
+			t.Fatalf("isHardwareAlias(%s): expected %v", pattern, expected)
+		}
+	}
+	check("pci:v00008086d000015B8sv*sd*bc*sc*i*", true)
+	check("acpi*:PNP0303:*", true)
+	check("usb:v*p*d*dc*dsc*dp*ic03isc01ip01in*", true)
+	check("devname:mapper/control", false)
+	check("symbol:nvme_init_ctrl", false)
+	check("block-major-7-*", false)
+	check("fs-ext4", false)
+	check("crypto-aes", false)
+}
@@ -10,8 +10,10 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cavaliercoder/go-cpio"
 	"github.com/google/renameio"
@@ -28,9 +30,28 @@ type Image struct {
 	out           *cpio.Writer
 	contains      set // whether image contains the file
 	stripBinaries bool
+	entries       []cpioEntry // written to the archive sorted by name when the image is closed
+	modTime       time.Time   // modification time of all entries, zero time is written as 0
+	arch          string      // the target architecture the binaries are checked for, any if empty
+	strippedBytes int64       // the size the ELF files are reduced by with stripBinaries
 }
 
-func NewImage(path string, compression string, stripBinaries bool) (*Image, error) {
+// cpioEntry is a file added to the image. Files are added concurrently (e.g. the kernel modules) thus the entries
+// are collected and then written in the canonical order, so the same input always produces the same image.
+type cpioEntry struct {
+	hdr     *cpio.Header
+	content []byte
+}
+
+// compressionLevels are the ranges of the compression levels supported for the image compression
+var compressionLevels = map[string][2]int{
+	"zstd": {1, 22},
+	"gzip": {gzip.BestSpeed, gzip.BestCompression},
+}
+
+// NewImage creates the image file. The compression level is the compressor default if it is 0.
+// The early archive (e.g. CPU microcode) is written uncompressed ahead of the main archive, it can be nil.
+func NewImage(path string, compression string, compressionLevel int, stripBinaries bool, modTime time.Time, earlyArchive []byte) (*Image, error) {
 	file, err := renameio.TempFile("", path)
 	if err != nil {
 		return nil, err
@@ -38,13 +59,23 @@ func NewImage(path string, compression string, stripBinaries bool) (*Image, erro
 	if err := file.Chmod(0644); err != nil {
 		return nil, err
 	}
+	if _, err := file.Write(earlyArchive); err != nil {
+		return nil, err
+	}
 
 	var compressor io.WriteCloser
 	switch compression {
 	case "zstd":
-		compressor, err = zstd.NewWriter(file)
+		var opts []zstd.EOption
+		if compressionLevel != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel)))
+		}
+		compressor, err = zstd.NewWriter(file, opts...)
 	case "gzip":
-		compressor = gzip.NewWriter(file)
+		if compressionLevel == 0 {
+			compressionLevel = gzip.DefaultCompression
+		}
+		compressor, err = gzip.NewWriterLevel(file, compressionLevel)
 	case "xz":
 		conf := xz.WriterConfig{CheckSum: xz.CRC32}
 		if err := conf.Verify(); err != nil {
@@ -69,6 +100,7 @@ func NewImage(path string, compression string, stripBinaries bool) (*Image, erro
 		out:           out,
 		contains:      make(set),
 		stripBinaries: stripBinaries,
+		modTime:       modTime,
 	}, nil
 }
 
@@ -81,6 +113,12 @@ func (img *Image) Cleanup() {
 }
 
 func (img *Image) Close() error {
+	if img.stripBinaries {
+		debug("strip: the ELF files are %d bytes smaller", img.strippedBytes)
+	}
+	if err := img.writeEntries(); err != nil {
+		return err
+	}
 	if err := img.out.Close(); err != nil {
 		return err
 	}
@@ -92,6 +130,34 @@ func (img *Image) Close() error {
 	return img.file.CloseAtomicallyReplace()
 }
 
+// appendEntry adds the entry to the image, the entries are written once all of them are collected.
+// It has to be called with img.m locked.
+func (img *Image) appendEntry(hdr *cpio.Header, content []byte) {
+	// the owner is always root, the host owner of the files must not leak to the image
+	hdr.UID, hdr.GID = 0, 0
+	hdr.ModTime = img.modTime
+	img.entries = append(img.entries, cpioEntry{hdr, content})
+}
+
+// writeEntries writes the collected entries to the archive sorted by name. A parent directory always precedes
+// its content as its name is a prefix of the content names.
+func (img *Image) writeEntries() error {
+	img.m.Lock()
+	defer img.m.Unlock()
+
+	sort.Slice(img.entries, func(i, j int) bool { return img.entries[i].hdr.Name < img.entries[j].hdr.Name })
+	for _, e := range img.entries {
+		if err := img.out.WriteHeader(e.hdr); err != nil {
+			return err
+		}
+		if _, err := img.out.Write(e.content); err != nil {
+			return err
+		}
+	}
+	img.entries = nil
+	return nil
+}
+
 // AppendDirEntry appends directory entry to the image (and its parent if it is needed).
 // It does not add the directory content
 func (img *Image) AppendDirEntry(dir string) error {
@@ -117,13 +183,31 @@ func (img *Image) AppendDirEntry(dir string) error {
 		Mode: cpio.FileMode(0755) | cpio.ModeDir,
 	}
 	img.m.Lock()
-	err := img.out.WriteHeader(hdr)
+	img.appendEntry(hdr, nil)
 	img.m.Unlock()
 
-	return err
+	return nil
+}
+
+// strip strips the ELF file and accounts the size it gets reduced by
+func (img *Image) strip(name string, in []byte, stripAll bool) ([]byte, error) {
+	out, err := stripElf(name, in, stripAll)
+	if err != nil {
+		return nil, err
+	}
+	img.m.Lock()
+	img.strippedBytes += int64(len(in) - len(out))
+	img.m.Unlock()
+	return out, nil
 }
 
+// stripElf removes the symbols and sections not needed at runtime. The binaries are stripped completely while
+// the shared libraries and the modules keep the symbols needed for the relocations, so the dynamic linking and
+// the module loading keep working.
 func stripElf(name string, in []byte, stripAll bool) ([]byte, error) {
+	if _, err := exec.LookPath("strip"); err != nil {
+		return nil, fmt.Errorf("strip: %v, install binutils or disable the strip option", err)
+	}
 	t, err := os.CreateTemp("", "booster.strip")
 	if err != nil {
 		return nil, err
@@ -150,6 +234,57 @@ func stripElf(name string, in []byte, stripAll bool) ([]byte, error) {
 	return os.ReadFile(t.Name())
 }
 
+// hasFile checks whether the file has been added to the image already
+func (img *Image) hasFile(dest string) bool {
+	img.m.Lock()
+	defer img.m.Unlock()
+	return img.contains[dest]
+}
+
+// appendModule adds the module to the image either uncompressed or compressed with the given format. Init decompresses
+// the compressed modules in memory. The module is stripped before the compression.
+func (img *Image) appendModule(name string, content []byte, compression string) error {
+	dest := imageModulesDir + name + ".ko"
+	if compression == "" || compression == "none" {
+		return img.AppendContent(content, 0644, dest)
+	}
+
+	var err error
+	if img.stripBinaries {
+		if content, err = img.strip(dest, content, false); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	w, err := newModuleCompressor(&buf, compression)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return img.AppendContent(buf.Bytes(), 0644, dest+moduleCompressionExts[compression])
+}
+
+// moduleCompressionExts are the file extensions of the compressed modules, init looks the modules up by these
+var moduleCompressionExts = map[string]string{"zstd": ".zst", "xz": ".xz", "gzip": ".gz"}
+
+func newModuleCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "xz":
+		return xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(w)
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown modules compression format: %s", compression)
+	}
+}
+
 func (img *Image) AppendContent(content []byte, mode os.FileMode, dest string) error {
 	img.m.Lock()
 	if img.contains[dest] {
@@ -177,6 +312,12 @@ func (img *Image) AppendContent(content []byte, mode os.FileMode, dest string) e
 		} else {
 			defer ef.Close()
 
+			if (ef.Type == elf.ET_EXEC || ef.Type == elf.ET_DYN) && !strings.HasPrefix(dest, firmwareDir) {
+				if err := checkElfArch(dest, ef, img.arch); err != nil {
+					return err
+				}
+			}
+
 			doStrip := img.stripBinaries
 			if strings.HasPrefix(dest, firmwareDir) {
 				// some firmware files are actually ELF but we should not run strip on them
@@ -185,13 +326,13 @@ func (img *Image) AppendContent(content []byte, mode os.FileMode, dest string) e
 			if doStrip {
 				// do not use --strip-all for modules/shared libs as it fails to load
 				isBinary := ef.Type == elf.ET_EXEC
-				content, err = stripElf(dest, content, isBinary)
+				content, err = img.strip(dest, content, isBinary)
 				if err != nil {
 					return err
 				}
 			}
 
-			if err := img.AppendElfDependencies(ef); err != nil {
+			if err := img.AppendElfDependencies(dest, ef); err != nil {
 				return err
 			}
 		}
@@ -203,13 +344,9 @@ func (img *Image) AppendContent(content []byte, mode os.FileMode, dest string) e
 		Size: int64(len(content)),
 	}
 	img.m.Lock()
-	if err := img.out.WriteHeader(hdr); err != nil {
-		img.m.Unlock()
-		return err
-	}
-	_, err := img.out.Write(content)
+	img.appendEntry(hdr, content)
 	img.m.Unlock()
-	return err
+	return nil
 }
 
 // AppendFile appends the file + its dependencies to the ramfs file
@@ -247,23 +384,7 @@ func (img *Image) AppendFile(fn string) error {
 		if err != nil {
 			return err
 		}
-
-		hdr := &cpio.Header{
-			Name: strings.TrimPrefix(fn, "/"),
-			Mode: cpio.FileMode(fi.Mode().Perm()) | cpio.ModeSymlink,
-			Size: int64(len(linkTarget)),
-		}
-
-		img.m.Lock()
-		if err := img.out.WriteHeader(hdr); err != nil {
-			img.m.Unlock()
-			return err
-		}
-		if _, err := img.out.Write([]byte(linkTarget)); err != nil {
-			img.m.Unlock()
-			return err
-		}
-		img.m.Unlock()
+		img.appendSymlinkEntry(linkTarget, fi.Mode().Perm(), fn)
 
 		// now add the link target as well
 		if !filepath.IsAbs(linkTarget) {
@@ -301,6 +422,36 @@ func (img *Image) AppendFile(fn string) error {
 	return nil
 }
 
+// AppendSymlink adds symlink dest pointing to target, the target itself is not added
+func (img *Image) AppendSymlink(target, dest string) error {
+	img.m.Lock()
+	if img.contains[dest] {
+		img.m.Unlock()
+		warning("trying to add symlink %s to the image but it is already there", dest)
+		return nil
+	}
+	img.contains[dest] = true
+	img.m.Unlock()
+
+	if err := img.AppendDirEntry(path.Dir(dest)); err != nil {
+		return err
+	}
+	img.appendSymlinkEntry(target, 0777, dest)
+	return nil
+}
+
+func (img *Image) appendSymlinkEntry(target string, mode os.FileMode, dest string) {
+	hdr := &cpio.Header{
+		Name: strings.TrimPrefix(dest, "/"),
+		Mode: cpio.FileMode(mode) | cpio.ModeSymlink,
+		Size: int64(len(target)),
+	}
+
+	img.m.Lock()
+	img.appendEntry(hdr, []byte(target))
+	img.m.Unlock()
+}
+
 func elfSectionContent(s *elf.Section) (string, error) {
 	b, err := s.Data()
 	if err != nil {
@@ -309,10 +460,9 @@ func elfSectionContent(s *elf.Section) (string, error) {
 	return string(b[:bytes.IndexByte(b, '\x00')]), nil
 }
 
-func (img *Image) AppendElfDependencies(ef *elf.File) error {
-	// TODO: use ef.DynString(elf.DT_RPATH) to calculate path to the loaded library
-	// or maybe we can parse /etc/ld.so.cache to get location for all libs?
-
+// AppendElfDependencies adds the dynamic loader and the shared libraries of the binary located at dest in the image.
+// The libraries are resolved the same way as the dynamic loader does.
+func (img *Image) AppendElfDependencies(dest string, ef *elf.File) error {
 	libs, err := ef.ImportedLibraries()
 	if err != nil {
 		return err
@@ -326,13 +476,17 @@ func (img *Image) AppendElfDependencies(ef *elf.File) error {
 		}
 		libs = append(libs, interp)
 	}
+	if len(libs) == 0 {
+		return nil
+	}
 
-	for _, p := range libs {
-		if !filepath.IsAbs(p) {
-			p = filepath.Join("/usr/lib", p)
-		}
-		err := img.AppendFile(p)
+	dirs := elfLibraryDirs(dest, ef)
+	for _, l := range libs {
+		file, err := findLibrary(l, dirs, ef)
 		if err != nil {
+			return fmt.Errorf("%s: %v", dest, err)
+		}
+		if err := img.AppendFile(file); err != nil {
 			return err
 		}
 	}
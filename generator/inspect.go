@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cavaliercoder/go-cpio"
+	"gopkg.in/yaml.v3"
+)
+
+const cpioMagic = "070701"
+
+// imageEntry is a file stored in the image
+type imageEntry struct {
+	name    string
+	mode    os.FileMode
+	size    int64
+	link    string // symlink target
+	early   bool   // the file is in the uncompressed early archive, e.g. the CPU microcode
+	content []byte // kept only for the files needed to verify the image
+}
+
+// inspectImage lists the files of the image, e.g. 'booster inspect [-verify] booster.img'. With -verify it also checks
+// that the image contains the dependencies of its kernel modules. It returns the process exit code.
+func inspectImage(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	verify := flags.Bool("verify", false, "Check that all the modules referenced by the image are present")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: booster inspect [-verify] IMAGE")
+		return 2
+	}
+
+	entries, err := readImage(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, e := range entries {
+		name := e.name
+		if e.early {
+			name += " (early)"
+		}
+		if e.link != "" {
+			name += " -> " + e.link
+		}
+		fmt.Printf("%s %10d %s\n", e.mode, e.size, name)
+	}
+
+	if *verify {
+		problems, err := verifyImage(entries)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) != 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// readImage reads the entries of the image. The image might start with an uncompressed early archive followed by
+// the main archive that is either compressed or uncompressed.
+func readImage(file string) ([]imageEntry, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var early []imageEntry
+	if bytes.HasPrefix(content, []byte(cpioMagic)) {
+		r := bytes.NewReader(content)
+		entries, err := readArchive(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		// the archive is padded to 4 bytes, the kernel also skips zero padding between the archives
+		rest := content[(len(content)-r.Len()+3)&^3:]
+		rest = bytes.TrimLeft(rest, "\x00")
+		if len(rest) == 0 {
+			return entries, nil // uncompressed image
+		}
+		for i := range entries {
+			entries[i].early = true
+		}
+		early, content = entries, rest
+	}
+
+	var r io.Reader = bytes.NewReader(content)
+	if !bytes.HasPrefix(content, []byte(cpioMagic)) {
+		// the compression formats are the same as for the modules
+		if r, err = moduleReader(r); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	entries, err := readArchive(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return append(early, entries...), nil
+}
+
+func readArchive(r io.Reader) ([]imageEntry, error) {
+	var entries []imageEntry
+	archive := cpio.NewReader(r)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := imageEntry{
+			name: hdr.Name,
+			mode: hdr.FileInfo().Mode(),
+			size: hdr.Size,
+			link: hdr.Linkname,
+		}
+		if name := "/" + hdr.Name; name == initConfigPath || name == overlayInitConfigPath || name == imageModulesDir+"booster.alias" {
+			if e.content, err = io.ReadAll(archive); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+}
+
+// verifyImage checks that the modules referenced by the init config and by the aliases are in the image.
+// It returns the list of the problems found.
+func verifyImage(entries []imageEntry) ([]string, error) {
+	modules := make(set)
+	var initConfig InitConfig
+	var aliases []byte
+	for _, e := range entries {
+		name := "/" + e.name
+		switch {
+		case name == initConfigPath:
+			if err := yaml.Unmarshal(e.content, &initConfig); err != nil {
+				return nil, fmt.Errorf("%s: %v", initConfigPath, err)
+			}
+		case name == imageModulesDir+"booster.alias":
+			aliases = e.content
+		case strings.HasPrefix(name, imageModulesDir):
+			mod := path.Base(name)
+			for _, ext := range moduleCompressionExts {
+				mod = strings.TrimSuffix(mod, ext)
+			}
+			if strings.HasSuffix(mod, ".ko") {
+				modules[strings.TrimSuffix(mod, ".ko")] = true
+			}
+		}
+	}
+
+	var problems []string
+	checkDeps := func(kind string, deps map[string][]string) {
+		for mod, list := range deps {
+			if !modules[mod] {
+				continue // a dependency of a module that is not in the image does not matter
+			}
+			for _, d := range list {
+				if !modules[d] {
+					problems = append(problems, fmt.Sprintf("module %s: %s %s is missing", mod, kind, d))
+				}
+			}
+		}
+	}
+	checkDeps("dependency", initConfig.ModuleDependencies)
+	checkDeps("post dependency", initConfig.ModulePostDependencies)
+	for _, m := range initConfig.ModulesForceLoad {
+		if !modules[m] {
+			problems = append(problems, fmt.Sprintf("module %s: it is forcibly loaded but missing", m))
+		}
+	}
+	for _, line := range strings.Split(string(aliases), "\n") {
+		parts := strings.Split(line, " ")
+		if len(parts) == 2 && !modules[parts[1]] {
+			problems = append(problems, fmt.Sprintf("module %s: it is referenced by alias %s but missing", parts[1], parts[0]))
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
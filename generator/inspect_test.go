@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVerifyImage(t *testing.T) {
+	t.Parallel()
+
+	initConfig := `moduledependencies:
+  btrfs: [libcrc32c, xor]
+  nouveau: [drm]
+modulepostdependencies:
+  libcrc32c: [crc32c_intel]
+modulesforceload: [btrfs, dm_crypt]
+`
+	entries := []imageEntry{
+		{name: "etc/booster.init.yaml", content: []byte(initConfig)},
+		{name: "usr/lib/modules/booster.alias", content: []byte("fs-btrfs btrfs\npci:v000010DEd*sv*sd*bc03sc*i* nouveau\n")},
+		{name: "usr/lib/modules/btrfs.ko.zst"},
+		{name: "usr/lib/modules/libcrc32c.ko"},
+		{name: "kernel/x86/microcode/GenuineIntel.bin", early: true},
+	}
+	problems, err := verifyImage(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"module btrfs: dependency xor is missing",
+		"module dm_crypt: it is forcibly loaded but missing",
+		"module libcrc32c: post dependency crc32c_intel is missing",
+		"module nouveau: it is referenced by alias pci:v000010DEd*sv*sd*bc03sc*i* but missing",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("expected problems %q, got %q", expected, problems)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// keymapDirs are the locations of the kbd keymap sources on different distros
+var keymapDirs = []string{"/usr/share/kbd/keymaps", "/usr/lib/kbd/keymaps", "/usr/share/keymaps"}
+
+// maxDiacritics is the size of the kernel accent table, MAX_DIACR from linux/kd.h
+const maxDiacritics = 256
+
+// diacritic is an entry of the kernel accent table. A dead key or the compose key followed by base produces result.
+type diacritic struct {
+	diacr, base, result rune
+}
+
+// readDiacritics returns the compose definitions of the keymaps. `loadkeys -b` does not dump them thus they are
+// parsed from the keymap sources. Only the definitions that fit the keyboard mode are returned, i.e. the 8-bit
+// characters if the console is not in the UTF-8 mode.
+func readDiacritics(isUtf bool, keymaps ...string) ([]diacritic, error) {
+	var result []diacritic
+	for _, keymap := range keymaps {
+		if keymap == "" {
+			continue
+		}
+		file, err := findKeymap(keymapDirs, keymap)
+		if err != nil {
+			return nil, err
+		}
+		p := keymapParser{visited: make(set)}
+		if err := p.parse(file); err != nil {
+			return nil, err
+		}
+		for _, d := range p.diacritics {
+			if !isUtf && (d.diacr > 0xff || d.base > 0xff || d.result > 0xff) {
+				continue
+			}
+			result = append(result, d)
+		}
+	}
+	if len(result) > maxDiacritics {
+		warning("keymap: %d compose definitions found, only the first %d are used", len(result), maxDiacritics)
+		result = result[:maxDiacritics]
+	}
+	return result, nil
+}
+
+// formatDiacritics serializes the accent table as "diacr base result" lines that init parses at boot
+func formatDiacritics(diacritics []diacritic) []byte {
+	var buf bytes.Buffer
+	for _, d := range diacritics {
+		fmt.Fprintf(&buf, "%d %d %d\n", d.diacr, d.base, d.result)
+	}
+	return buf.Bytes()
+}
+
+var keymapExts = []string{".map", ".map.gz", ".kmap", ".kmap.gz"}
+
+var errKeymapFound = errors.New("keymap found") // stops the keymaps dir walk
+
+// findKeymap finds the source of the keymap specified either by its name (e.g. de-latin1) or by its path
+func findKeymap(dirs []string, keymap string) (string, error) {
+	if strings.ContainsRune(keymap, '/') {
+		return keymap, nil
+	}
+	for _, dir := range dirs {
+		var found string
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if d.Name() == "include" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			for _, ext := range keymapExts {
+				if d.Name() == keymap+ext {
+					found = p
+					return errKeymapFound
+				}
+			}
+			return nil
+		})
+		if err != nil && err != errKeymapFound && !os.IsNotExist(err) {
+			return "", err
+		}
+		if found != "" {
+			return found, nil
+		}
+	}
+	return "", fmt.Errorf("keymap: unable to find the source of keymap %s", keymap)
+}
+
+type keymapParser struct {
+	visited    set // the files parsed already, protects from include loops
+	charset    string
+	diacritics []diacritic
+}
+
+func (p *keymapParser) parse(file string) error {
+	if p.visited[file] {
+		return nil
+	}
+	p.visited[file] = true
+
+	content, err := readKeymapFile(file)
+	if err != nil {
+		return fmt.Errorf("keymap: %v", err)
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		tokens := tokenizeKeymapLine(s.Text())
+		if len(tokens) == 0 {
+			continue
+		}
+		switch tokens[0] {
+		case "include":
+			if len(tokens) != 2 {
+				continue
+			}
+			inc, err := findKeymapInclude(filepath.Dir(file), strings.Trim(tokens[1], `"`))
+			if err != nil {
+				return fmt.Errorf("keymap: %s: %v", file, err)
+			}
+			if err := p.parse(inc); err != nil {
+				return err
+			}
+		case "charset":
+			if len(tokens) == 2 {
+				p.charset = strings.ToLower(strings.Trim(tokens[1], `"`))
+			}
+		case "compose":
+			// compose 'A' 'E' to 'Æ'
+			if len(tokens) != 5 || tokens[3] != "to" {
+				debug("keymap: %s: unsupported compose definition '%s'", file, s.Text())
+				continue
+			}
+			var d diacritic
+			var ok [3]bool
+			d.diacr, ok[0] = p.parseChar(tokens[1])
+			d.base, ok[1] = p.parseChar(tokens[2])
+			d.result, ok[2] = p.parseChar(tokens[4])
+			if !ok[0] || !ok[1] || !ok[2] {
+				debug("keymap: %s: unsupported compose definition '%s'", file, s.Text())
+				continue
+			}
+			p.diacritics = append(p.diacritics, d)
+		}
+	}
+	return s.Err()
+}
+
+// parseChar parses a character of a compose definition, either quoted (e.g. 'a' or '\033') or a number (0x61, U+00e0)
+func (p *keymapParser) parseChar(token string) (rune, bool) {
+	if strings.HasPrefix(token, "U+") {
+		r, err := strconv.ParseUint(token[2:], 16, 32)
+		return rune(r), err == nil
+	}
+	if len(token) < 3 || token[0] != '\'' || token[len(token)-1] != '\'' {
+		r, err := strconv.ParseUint(token, 0, 32)
+		return rune(r), err == nil
+	}
+
+	c := token[1 : len(token)-1]
+	if c[0] == '\\' {
+		if len(c) == 2 {
+			return rune(c[1]), true
+		}
+		r, err := strconv.ParseUint(c[1:], 8, 8)
+		return rune(r), err == nil
+	}
+	if r, size := utf8.DecodeRuneInString(c); r != utf8.RuneError && size == len(c) {
+		return r, true
+	}
+	// a single 8-bit character in the keymap charset, only latin1 is supported as its bytes match the unicode code points
+	if len(c) == 1 && (p.charset == "" || p.charset == "iso-8859-1" || p.charset == "latin1") {
+		return rune(c[0]), true
+	}
+	return 0, false
+}
+
+// tokenizeKeymapLine splits the keymap line into tokens, the quoted characters and strings are kept as single tokens
+func tokenizeKeymapLine(line string) []string {
+	var tokens []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#' || c == '!':
+			return tokens // comment
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < len(line) && line[j] != c {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return append(tokens, line[i:])
+			}
+			tokens = append(tokens, line[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' && line[j] != '\r' {
+				j++
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// findKeymapInclude resolves the included file the same way as loadkeys: relative to the including file and
+// to the nearest include directories
+func findKeymapInclude(dir, name string) (string, error) {
+	dirs := []string{dir, filepath.Join(dir, "../include"), filepath.Join(dir, "../../include")}
+	if filepath.IsAbs(name) {
+		dirs = []string{""}
+	}
+	for _, d := range dirs {
+		for _, ext := range []string{"", ".inc", ".map"} {
+			for _, gz := range []string{"", ".gz"} {
+				f := filepath.Join(d, name+ext+gz)
+				if fi, err := os.Stat(f); err == nil && !fi.IsDir() {
+					return f, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("unable to find included file %s", name)
+}
+
+func readKeymapFile(file string) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(file, ".gz") {
+		return content, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	defer gz.Close()
+	return io.ReadAll(gz)
+}
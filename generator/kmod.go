@@ -34,13 +34,22 @@ type Kmod struct {
 	requiredModules   set                 // set of modules that we need to be added to the image
 	dependencies      map[string][]string // dependency list for modules
 	postDependencies  map[string][]string // post dependency list for modules
+	softDependencies  map[string][]string // soft pre-dependencies of the modules, they are in dependencies too
 	modprobeOptions   map[string]string   // module options parsed from modprobe.d
 	aliases           []alias
 	extraDep          map[string][]string // extra dependencies added by the generator
+	deviceModules     map[string]string   // host_only_devices: modules needed by the present devices mapped to the reason
+	hardwareDrivers   set                 // host_only_devices: drivers with modaliases, they are filtered by deviceModules
+	forcedModules     set                 // host_only_devices: modules added with 'modules' that keep all their aliases
 	hostModules       set
+	compression       string // compression of the modules in the image, "none" keeps them uncompressed
+	blocklist         set    // modules that must not be added to the image, see modules_blocklist
 }
 
 func NewKmod(conf *generatorConfig) (*Kmod, error) {
+	if _, err := os.Stat(conf.modulesDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("modules directory %s of kernel %s does not exist, specify the modules location with -modulesDir or -sysroot", conf.modulesDir, conf.kernelVersion)
+	}
 	kmod := &Kmod{
 		universal:         conf.universal,
 		kernelVersion:     conf.kernelVersion,
@@ -51,6 +60,8 @@ func NewKmod(conf *generatorConfig) (*Kmod, error) {
 		aliases:           nil,
 		extraDep:          make(map[string][]string),
 		hostModules:       make(set),
+		compression:       conf.modulesCompression,
+		blocklist:         make(set),
 	}
 
 	if err := kmod.scanModulesDir(); err != nil {
@@ -71,6 +82,13 @@ func NewKmod(conf *generatorConfig) (*Kmod, error) {
 	if err != nil {
 		return nil, err
 	}
+	if conf.hostOnlyDevices && !conf.universal {
+		devices, err := conf.readHostDevices()
+		if err != nil {
+			return nil, err
+		}
+		kmod.findHostDeviceModules(devices)
+	}
 
 	kmod.modprobeOptions, err = conf.readModprobeOptions()
 	if err != nil {
@@ -96,7 +114,7 @@ func (k *Kmod) activateModules(filter, failIfMissing bool, mods ...string) error
 		if pattern := m; pattern == "*" || strings.HasSuffix(pattern, "/") {
 			// trailing '/' means we match path recursively
 			for mod, modPath := range k.nameToPathMapping.forward {
-				if filter && !k.hostModules[mod] {
+				if filter && !k.hostNeeds(mod) {
 					continue
 				}
 				if pattern == "*" || strings.HasPrefix(modPath, pattern) {
@@ -114,7 +132,7 @@ func (k *Kmod) activateModules(filter, failIfMissing bool, mods ...string) error
 				}
 			}
 		} else {
-			if filter && !k.hostModules[m] {
+			if filter && !k.hostNeeds(m) {
 				continue
 			}
 
@@ -168,6 +186,7 @@ func (k *Kmod) resolveDependencies() error {
 
 	k.dependencies = make(map[string][]string)
 	k.postDependencies = make(map[string][]string)
+	k.softDependencies = make(map[string][]string)
 
 	depsVisited := make(set)
 	for e := depsToVisit.Front(); e != nil; e = e.Next() {
@@ -183,12 +202,21 @@ func (k *Kmod) resolveDependencies() error {
 		if d, exist := modulesDep[name]; exist {
 			deps = append(deps, d...)
 		}
-		if d, exist := softPreDeps[name]; exist {
-			deps = append(deps, d...)
-		}
 		if d, exist := k.extraDep[name]; exist {
 			deps = append(deps, d...)
 		}
+		for _, d := range deps {
+			if k.blocklist[d] {
+				return fmt.Errorf("module %s depends on module %s that is in modules_blocklist, remove the module from the image with 'modules: -%s' in booster.yaml", name, d, name)
+			}
+		}
+		if d, exist := softPreDeps[name]; exist {
+			// soft dependencies are optional
+			if soft := k.withoutBlocklisted(d); len(soft) > 0 {
+				deps = append(deps, soft...)
+				k.softDependencies[name] = soft
+			}
+		}
 
 		if len(deps) > 0 {
 			k.dependencies[name] = deps
@@ -197,7 +225,7 @@ func (k *Kmod) resolveDependencies() error {
 			}
 		}
 
-		if deps, exist := softPostDeps[name]; exist {
+		if deps := k.withoutBlocklisted(softPostDeps[name]); len(deps) > 0 {
 			k.postDependencies[name] = deps
 			for _, d := range deps {
 				depsToVisit.PushBack(d)
@@ -208,6 +236,34 @@ func (k *Kmod) resolveDependencies() error {
 	return nil
 }
 
+// blockModules removes the modules from the image and prevents adding them as dependencies of other modules
+func (k *Kmod) blockModules(mods ...string) {
+	for _, m := range mods {
+		mod := k.resolveModname(m)
+		if mod == "" {
+			debug("blocklisted module %s does not exist", m)
+			continue
+		}
+		k.blocklist[mod] = true
+		if k.requiredModules[mod] {
+			debug("deactivate blocklisted module %s", mod)
+			delete(k.requiredModules, mod)
+		}
+	}
+}
+
+func (k *Kmod) withoutBlocklisted(mods []string) []string {
+	var result []string
+	for _, m := range mods {
+		if k.blocklist[m] {
+			debug("skip blocklisted soft dependency %s", m)
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
 func (k *Kmod) readKernelAliases() error {
 	f, err := os.Open(path.Join(k.hostModulesDir, "modules.alias"))
 	if err != nil {
@@ -279,22 +335,7 @@ func (k *Kmod) addModulesToImage(img *Image) error {
 		}
 		defer f.Close()
 
-		var r io.Reader
-		ext := path.Ext(p)
-		switch ext {
-		case ".ko":
-			r = f
-		case ".xz":
-			r, err = xz.NewReader(f, 0)
-		case ".zst":
-			r, err = zstd.NewReader(f)
-		case ".lz4":
-			r = lz4.NewReader(f)
-		case ".gz":
-			r, err = gzip.NewReader(f)
-		default:
-			err = fmt.Errorf("unknown module compression format: %s", ext)
-		}
+		r, err := moduleReader(f)
 		if err != nil {
 			errCh <- fmt.Errorf("unpacking module %s: %v", modName, err)
 			return
@@ -306,13 +347,13 @@ func (k *Kmod) addModulesToImage(img *Image) error {
 			return
 		}
 
-		if err := img.AppendContent(content, 0644, imageModulesDir+modName+".ko"); err != nil {
-			errCh <- err
+		ef, err := elf.NewFile(bytes.NewReader(content))
+		if err != nil {
+			errCh <- fmt.Errorf("module %s: %v", modName, err)
 			return
 		}
 
-		ef, err := elf.NewFile(bytes.NewReader(content))
-		if err != nil {
+		if err := img.appendModule(modName, content, k.compression); err != nil {
 			errCh <- err
 			return
 		}
@@ -526,20 +567,16 @@ func (k *Kmod) readModulesSoftDep(dir string) (map[string][]string, map[string][
 //   modprobe -qaR 'serio:ty06pr00id00ex00'
 //     atkbd
 //     serio_raw
-func matchAlias(needle string, aliases []alias) ([]alias, error) {
-	// TODO: implement it according to https://github.com/vadmium/module-init-tools/blob/master/modprobe.c#L2000
+// the patterns are matched the same way as modprobe does
+func matchAlias(needle string, aliases []alias) []alias {
 	var result []alias
 
 	for _, a := range aliases {
-		match, err := path.Match(a.pattern, needle)
-		if err != nil {
-			return nil, err
-		}
-		if match {
+		if fnmatch(a.pattern, needle) {
 			result = append(result, a)
 		}
 	}
-	return result, nil
+	return result
 }
 
 // matches needed using simple string comparison instead of using path matching
@@ -592,16 +629,26 @@ func (k *Kmod) filterAliasesForRequiredModules(conf *generatorConfig) ([]alias,
 		// filter out only aliases known to kernel
 		var newFilteredAliases []alias // aliases for the given devices
 		for a := range devAliases {
-			matched, err := matchAlias(a, filteredAliases)
-			if err != nil {
-				return nil, err
-			}
+			matched := matchAlias(a, filteredAliases)
 			if len(matched) > 0 {
 				newFilteredAliases = append(newFilteredAliases, matched...)
 			} else {
 				debug("no matches found for a device alias '%s'", a)
 			}
 		}
+		// the modules added explicitly with host_only_devices are loaded once their devices appear, e.g. a drive
+		// that is powered down during the image generation
+		if k.forcedModules != nil {
+			added := make(set)
+			for _, a := range newFilteredAliases {
+				added[a.pattern+" "+a.module] = true
+			}
+			for _, a := range filteredAliases {
+				if k.forcedModules[a.module] && !added[a.pattern+" "+a.module] {
+					newFilteredAliases = append(newFilteredAliases, a)
+				}
+			}
+		}
 		filteredAliases = newFilteredAliases
 	}
 
@@ -669,6 +716,32 @@ func (k *Kmod) addExtraDep(mod string, deps ...string) {
 	k.extraDep[mod] = append(k.extraDep[mod], k.selectNonBuiltinModules(deps)...)
 }
 
+// moduleReader returns reader of the decompressed module. The compression is detected by the magic bytes
+// as the file extension does not always match the content.
+func moduleReader(f io.Reader) (io.Reader, error) {
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("\x7fELF")):
+		return r, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return zstd.NewReader(r)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(r, 0)
+	case bytes.HasPrefix(magic, []byte{0x04, 0x22, 0x4d, 0x18}):
+		return lz4.NewReader(r), nil
+	case bytes.HasPrefix(magic, []byte{0x02, 0x21, 0x4c, 0x18}):
+		return lz4.NewReaderLegacy(r), nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported compression format (magic bytes %x), expected ELF, zstd, xz, lz4 or gzip", magic)
+	}
+}
+
 // readModuleFirmwareRequirements parses given module file .modinfo section
 // and collects all firmware files dependencies for it.
 func readModuleFirmwareRequirements(ef *elf.File) ([]string, error) {
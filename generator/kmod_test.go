@@ -205,3 +205,84 @@ func TestReadModprobeOptions(t *testing.T) {
 		t.Fatal("expect non-nil options map")
 	}
 }
+
+func TestModuleReader(t *testing.T) {
+	module := []byte("\x7fELF module content")
+	check := func(name string, compressed []byte) {
+		r, err := moduleReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(content, module) {
+			t.Fatalf("%s: expected %q, got %q", name, module, content)
+		}
+	}
+
+	check("plain", module)
+	for _, compression := range []string{"zstd", "xz", "gzip"} {
+		var buf bytes.Buffer
+		w, err := newModuleCompressor(&buf, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(module); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		check(compression, buf.Bytes())
+	}
+
+	if _, err := moduleReader(bytes.NewReader([]byte("BZh91AY&SY"))); err == nil || !strings.Contains(err.Error(), "unsupported compression format") {
+		t.Fatalf("expected unsupported compression error, got %v", err)
+	}
+}
+
+func TestMatchAlias(t *testing.T) {
+	aliases := []alias{
+		{"pci:v00008086d000015B8sv*sd*bc*sc*i*", "e1000e"},
+		{"dmi:*:pn*ThinkPad*:*", "thinkpad_acpi"},
+		{"usb:v046DpC52Bd*dc*dsc*dp*ic03isc01ip0[12]in*", "usbhid"},
+		{"serio:ty06pr*id*ex*", "atkbd"},
+		{"serio:ty*pr*id*ex*", "serio_raw"},
+		{"acpi*:PNP0C0[!9]:*", "button"},
+		{"of:N*T*Cfoo[bar", "foo"},
+	}
+
+	check := func(needle string, expected ...string) {
+		var modules []string
+		for _, a := range matchAlias(needle, aliases) {
+			modules = append(modules, a.module)
+		}
+		if !reflect.DeepEqual(modules, expected) {
+			t.Fatalf("alias %s: expected %v, got %v", needle, expected, modules)
+		}
+	}
+
+	check("pci:v00008086d000015B8sv000017AAsd00002245bc02sc00i00", "e1000e")
+	check("pci:v00008086d000015B9sv000017AAsd00002245bc02sc00i00")
+	// '*' matches '/' the same way as it does for modprobe
+	check("dmi:bvnLENOVO:bvrN1CET:pnThinkPad/T460s:pvrThinkPadT460s:", "thinkpad_acpi")
+	check("usb:v046DpC52Bd1201dc00dsc00dp00ic03isc01ip02in01", "usbhid")
+	check("usb:v046DpC52Bd1201dc00dsc00dp00ic03isc01ip03in01")
+	check("serio:ty06pr00id00ex00", "atkbd", "serio_raw")
+	check("acpi:PNP0C0C:", "button")
+	check("acpi:PNP0C09:")
+	// a malformed bracket expression matches literally
+	check("of:NfooTbarCfoo[bar", "foo")
+	check("of:NfooTbarCfoob")
+}
+
+func TestMissingModulesDir(t *testing.T) {
+	dir := t.TempDir() + "/usr/lib/modules/6.1.0-missing"
+	_, err := NewKmod(&generatorConfig{kernelVersion: "6.1.0-missing", modulesDir: dir})
+	expected := "modules directory " + dir + " of kernel 6.1.0-missing does not exist, specify the modules location with -modulesDir or -sysroot"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error '%s', got '%v'", expected, err)
+	}
+}
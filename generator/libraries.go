@@ -0,0 +1,131 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// libraryDirs are the default locations of the shared libraries, the dynamic loader looks there after the dirs
+// from ld.so.conf
+var libraryDirs = []string{"/usr/lib", "/usr/lib64", "/lib", "/lib64"}
+
+const ldSoConfPath = "/etc/ld.so.conf"
+
+var (
+	ldSoConfOnce sync.Once
+	ldSoConfDirs []string
+)
+
+// systemLibraryDirs returns the dirs where the shared libraries are searched if the binary does not specify its own
+func systemLibraryDirs() []string {
+	ldSoConfOnce.Do(func() {
+		dirs, err := readLdSoConf(ldSoConfPath, make(set))
+		if err != nil {
+			debug("%v", err)
+		}
+		ldSoConfDirs = append(dirs, libraryDirs...)
+	})
+	return ldSoConfDirs
+}
+
+// readLdSoConf returns the library dirs listed in the ld.so.conf file and in the files it includes
+func readLdSoConf(file string, visited set) ([]string, error) {
+	if visited[file] {
+		return nil, nil
+	}
+	visited[file] = true
+
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if idx := strings.IndexByte(line, '#'); idx != -1 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "include" {
+			dirs = append(dirs, fields...)
+			continue
+		}
+		for _, pattern := range fields[1:] {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(file), pattern)
+			}
+			includes, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			for _, inc := range includes {
+				incDirs, err := readLdSoConf(inc, visited)
+				if err != nil {
+					return nil, err
+				}
+				dirs = append(dirs, incDirs...)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// elfLibraryDirs returns the dirs where the dynamic loader looks for the libraries of the binary: its DT_RUNPATH
+// and DT_RPATH followed by the system dirs. dest is the location of the binary, $ORIGIN is resolved relative to it.
+func elfLibraryDirs(dest string, ef *elf.File) []string {
+	var dirs []string
+	origin := filepath.Dir(dest)
+	for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+		paths, _ := ef.DynString(tag)
+		for _, p := range paths {
+			for _, d := range filepath.SplitList(p) {
+				d = strings.ReplaceAll(d, "${ORIGIN}", origin)
+				d = strings.ReplaceAll(d, "$ORIGIN", origin)
+				dirs = append(dirs, d)
+			}
+		}
+	}
+	return append(dirs, systemLibraryDirs()...)
+}
+
+// findLibrary returns the location of the shared library needed by the binary. The libraries of another ELF class
+// or architecture (e.g. 32-bit libraries of a multilib system) are skipped the same way as the dynamic loader does.
+func findLibrary(lib string, dirs []string, ef *elf.File) (string, error) {
+	if filepath.IsAbs(lib) {
+		return lib, nil
+	}
+	for _, d := range dirs {
+		file := filepath.Join(d, lib)
+		if isCompatibleLibrary(file, ef) {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find shared library %s, searched at %s", lib, strings.Join(dirs, ":"))
+}
+
+func isCompatibleLibrary(file string, ef *elf.File) bool {
+	lib, err := elf.Open(file)
+	if err != nil {
+		return false
+	}
+	defer lib.Close()
+	return lib.Class == ef.Class && lib.Machine == ef.Machine
+}
+
+// isStaticElf reports whether the binary runs without the dynamic loader and shared libraries
+func isStaticElf(ef *elf.File) bool {
+	if ef.Section(".interp") != nil {
+		return false
+	}
+	libs, err := ef.ImportedLibraries()
+	return err == nil && len(libs) == 0
+}
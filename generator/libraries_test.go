@@ -0,0 +1,87 @@
+package main
+
+import (
+	"debug/elf"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReadLdSoConf(t *testing.T) {
+	d := t.TempDir()
+	files := map[string]string{
+		"ld.so.conf":                  "# libraries\n/usr/local/lib\ninclude ld.so.conf.d/*.conf\ninclude " + d + "/ld.so.conf\n",
+		"ld.so.conf.d/10-a.conf":      "/opt/a/lib /opt/a/lib64 # two dirs\n",
+		"ld.so.conf.d/20-b.conf":      "\n/opt/b/lib\n",
+		"ld.so.conf.d/README":         "/not/included\n",
+		"ld.so.conf.d/30-empty.conf":  "",
+		"ld.so.conf.d/40-nested.conf": "include ../nonexistent.conf\n",
+	}
+	if err := os.Mkdir(d+"/ld.so.conf.d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for f, content := range files {
+		if err := os.WriteFile(d+"/"+f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs, err := readLdSoConf(d+"/ld.so.conf", make(set))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/usr/local/lib", "/opt/a/lib", "/opt/a/lib64", "/opt/b/lib"}
+	if !reflect.DeepEqual(dirs, expected) {
+		t.Fatalf("expected library dirs %q, got %q", expected, dirs)
+	}
+}
+
+func TestFindLibrary(t *testing.T) {
+	ef, err := elf.Open("/usr/bin/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ef.Close()
+
+	content, err := os.ReadFile("/usr/bin/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, d2 := t.TempDir(), t.TempDir()
+	// a non-ELF file with the library name is skipped as an incompatible library
+	if err := os.WriteFile(d1+"/libfoo.so.1", []byte("not a library"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(d2+"/libfoo.so.1", content, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := findLibrary("libfoo.so.1", []string{d1, d2}, ef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != d2+"/libfoo.so.1" {
+		t.Fatalf("expected the library at %s, got %s", d2, file)
+	}
+
+	if file, err := findLibrary("/lib64/ld-linux-x86-64.so.2", nil, ef); err != nil || file != "/lib64/ld-linux-x86-64.so.2" {
+		t.Fatalf("absolute library path is expected to be kept, got %s %v", file, err)
+	}
+
+	_, err = findLibrary("libbar.so.2", []string{d1, d2}, ef)
+	expectedErr := "unable to find shared library libbar.so.2, searched at " + d1 + ":" + d2
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected error '%s', got '%v'", expectedErr, err)
+	}
+}
+
+func TestIsStaticElf(t *testing.T) {
+	ef, err := elf.Open("/usr/bin/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ef.Close()
+	if isStaticElf(ef) {
+		t.Fatal("/usr/bin/true is expected to be dynamically linked")
+	}
+}
@@ -14,10 +14,16 @@ var (
 	forceOverwriteFile = flag.Bool("force", false, "Overwrite existing initrd file")
 	initBinary         = flag.String("initBinary", "/usr/lib/booster/init", "Booster 'init' binary location")
 	compression        = flag.String("compression", "", `Output file compression ("zstd", "gzip", "none")`)
+	noCompression      = flag.Bool("noCompression", false, "Do not compress the output file, a shortcut for -compression=none")
 	kernelVersion      = flag.String("kernelVersion", "", "Linux kernel version to generate initramfs for")
+	kernelModulesDir   = flag.String("modulesDir", "", "Kernel modules tree of the target system, /usr/lib/modules/$kernelVersion if not set")
+	sysroot            = flag.String("sysroot", "", "Root of the target system tree to read the kernel modules and config from")
+	targetArch         = flag.String("arch", runtime.GOARCH, `Target architecture of the image, a GOARCH name (e.g. "amd64", "arm64")`)
 	configFile         = flag.String("config", "/etc/booster.yaml", "Configuration file path")
 	debugEnabled       = flag.Bool("debug", false, "Enable debug output")
 	universal          = flag.Bool("universal", false, "Add wide range of modules/tools to allow this image boot at different machines")
+	overlay            = flag.Bool("overlay", false, "Generate a host-specific overlay image that the bootloader loads after a base image")
+	universalModules   = flag.String("universalModules", "", `Modules to add to the universal image ("storage", "net", "all")`)
 	strip              = flag.Bool("strip", false, "Strip ELF binaries before adding it to the image")
 	pprofcpu           = flag.String("pprof.cpu", "", "Write cpu profile to file")
 	pprofmem           = flag.String("pprof.mem", "", "Write memory profile to file")
@@ -82,6 +88,16 @@ func runGenerator() error {
 func main() {
 	flag.Parse()
 
+	if flag.Arg(0) == "validate-cmdline" {
+		os.Exit(validateCmdline(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "inspect" {
+		os.Exit(inspectImage(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "sign-verity" {
+		os.Exit(signVerity(flag.Args()[1:]))
+	}
+
 	if err := runGenerator(); err != nil {
 		log.Fatal(err)
 	}
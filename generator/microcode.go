@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cavaliercoder/go-cpio"
+)
+
+// The kernel loads the CPU microcode early at boot from an uncompressed cpio archive that precedes the main
+// initramfs archive, see https://www.kernel.org/doc/html/latest/x86/microcode.html
+const earlyMicrocodeDir = "kernel/x86/microcode/"
+
+// microcodeVendors maps the CPU vendor ids to the microcode blobs location relative to the firmware dir
+var microcodeVendors = map[string]string{
+	"GenuineIntel": "intel-ucode/*",
+	"AuthenticAMD": "amd-ucode/microcode_amd*.bin",
+}
+
+// earlyMicrocode returns the early microcode archive prepended to the image or nil if microcode is not enabled
+func earlyMicrocode(conf *generatorConfig) ([]byte, error) {
+	if conf.microcodeImage != "" {
+		return readEarlyMicrocodeImage(conf.microcodeImage)
+	}
+	if !conf.microcode {
+		return nil, nil
+	}
+	vendors, err := microcodeVendorsFor(conf)
+	if err != nil {
+		return nil, err
+	}
+	return buildEarlyMicrocode(conf.hostFirmwareDir, vendors, conf.modTime)
+}
+
+// buildEarlyMicrocode builds the early cpio archive with the microcode of the given CPU vendors. The microcode files
+// of a vendor are concatenated into a single blob, the kernel picks the update matching the CPU itself.
+func buildEarlyMicrocode(dir string, vendors []string, modTime time.Time) ([]byte, error) {
+	if dir == "" {
+		dir = firmwareDir
+	}
+	var buf bytes.Buffer
+	w := cpio.NewWriter(&buf)
+
+	dirsAdded := false
+	for _, vendor := range vendors {
+		files, err := filepath.Glob(filepath.Join(dir, microcodeVendors[vendor]))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			warning("microcode: no %s microcode found at %s, install the microcode package for the CPU", vendor, dir)
+			continue
+		}
+		sort.Strings(files)
+
+		var blob []byte
+		for _, f := range files {
+			content, err := os.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("microcode: %v", err)
+			}
+			blob = append(blob, content...)
+		}
+		debug("microcode: adding %d %s microcode files", len(files), vendor)
+
+		if !dirsAdded {
+			for _, dir := range []string{"kernel", "kernel/x86", "kernel/x86/microcode"} {
+				hdr := &cpio.Header{Name: dir, Mode: cpio.FileMode(0755) | cpio.ModeDir, ModTime: modTime}
+				if err := w.WriteHeader(hdr); err != nil {
+					return nil, err
+				}
+			}
+			dirsAdded = true
+		}
+		hdr := &cpio.Header{
+			Name:    earlyMicrocodeDir + vendor + ".bin",
+			Mode:    cpio.FileMode(0644) | cpio.ModeRegular,
+			Size:    int64(len(blob)),
+			ModTime: modTime,
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(blob); err != nil {
+			return nil, err
+		}
+	}
+	if !dirsAdded {
+		return nil, nil
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readEarlyMicrocodeImage reads a prebuilt early microcode archive, e.g. /boot/intel-ucode.img
+func readEarlyMicrocodeImage(file string) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("microcode: %v", err)
+	}
+	if !bytes.HasPrefix(content, []byte("070701")) {
+		return nil, fmt.Errorf("microcode: %s is not an uncompressed cpio archive", file)
+	}
+	return content, nil
+}
+
+// readCPUVendor returns the vendor id of the host CPU, e.g. GenuineIntel
+func readCPUVendor() (string, error) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "vendor_id" {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	return "", s.Err()
+}
+
+// microcodeVendorsFor returns the CPU vendors to add the microcode for. A universal image supports all the vendors.
+func microcodeVendorsFor(conf *generatorConfig) ([]string, error) {
+	if conf.universal {
+		return []string{"AuthenticAMD", "GenuineIntel"}, nil
+	}
+	vendor, err := conf.readCPUVendor()
+	if err != nil {
+		return nil, fmt.Errorf("microcode: unable to detect the CPU vendor: %v", err)
+	}
+	if _, ok := microcodeVendors[vendor]; !ok {
+		warning("microcode: no microcode is available for CPU vendor '%s'", vendor)
+		return nil, nil
+	}
+	return []string{vendor}, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	plymouthConfig   = "/etc/plymouth/plymouthd.conf"
+	plymouthDefaults = "/usr/share/plymouth/plymouthd.defaults"
+	plymouthThemes   = "/usr/share/plymouth/themes/"
+)
+
+// plymouthPluginDirs are the locations of the plymouth plugins on different distros
+var plymouthPluginDirs = []string{"/usr/lib/plymouth", "/usr/lib64/plymouth", "/usr/lib/*-linux-gnu*/plymouth"}
+
+// plymouthFonts are the fonts the label-freetype plugin loads. Like plymouth-populate-initrd booster adds the fonts
+// fontconfig matches for the patterns under these names.
+var plymouthFonts = []struct{ pattern, dest string }{
+	{"", "/usr/share/fonts/Plymouth.ttf"},
+	{"monospace", "/usr/share/fonts/Plymouth-monospace.ttf"},
+}
+
+// fontconfigDir is the fontconfig configuration that the label-pango plugin needs to find the fonts
+const fontconfigDir = "/etc/fonts"
+
+// appendPlymouth adds plymouth, its configured theme and the plugins needed to show the splash. The text themes
+// are added as well, plymouth falls back to them if the graphics cannot be initialized.
+func (img *Image) appendPlymouth() error {
+	var binaries []string
+	for _, b := range []string{"plymouthd", "plymouth"} {
+		file, err := findBinary(b, "/usr/bin", "/usr/sbin")
+		if err != nil {
+			return fmt.Errorf("plymouth: %v, install plymouth package", err)
+		}
+		binaries = append(binaries, file)
+	}
+	if err := img.appendExtraFiles(binaries); err != nil {
+		return err
+	}
+
+	pluginDir, err := findPlymouthPluginDir()
+	if err != nil {
+		return err
+	}
+
+	theme, err := readPlymouthTheme(plymouthConfig, plymouthDefaults)
+	if err != nil {
+		return err
+	}
+	debug("plymouth: adding theme %s", theme)
+
+	for _, f := range []string{plymouthConfig, plymouthDefaults} {
+		if _, err := os.Stat(f); err == nil {
+			if err := img.AppendFile(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the label plugins render the passphrase prompt and the messages of the graphical themes
+	plugins := []string{"renderers/drm.so", "renderers/frame-buffer.so", "label.so", "label-pango.so", "label-freetype.so"}
+	for _, t := range []string{theme, "text", "details"} {
+		themeFile := filepath.Join(plymouthThemes, t, t+".plymouth")
+		module, imageDir, err := readPlymouthThemeModule(themeFile)
+		if err != nil {
+			if t != theme && os.IsNotExist(err) {
+				continue // the fallback themes are optional
+			}
+			return fmt.Errorf("plymouth: %v", err)
+		}
+		if err := img.AppendFile(filepath.Dir(themeFile)); err != nil {
+			return err
+		}
+		if imageDir != "" {
+			// a theme might use the images of another one, e.g. bgrt uses the spinner images
+			if err := img.AppendFile(imageDir); err != nil {
+				return fmt.Errorf("plymouth: theme %s images: %v", t, err)
+			}
+		}
+		plugins = append(plugins, module+".so")
+	}
+
+	for _, p := range plugins {
+		file := filepath.Join(pluginDir, p)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			debug("plymouth: plugin %s does not exist", file)
+			continue
+		}
+		if err := img.AppendFile(file); err != nil {
+			return err
+		}
+	}
+	return img.appendPlymouthFonts(pluginDir)
+}
+
+// appendPlymouthFonts adds the fonts used by the label plugins. label-freetype loads the fonts from the fixed paths,
+// label (label-pango in newer plymouth versions) finds them with fontconfig.
+func (img *Image) appendPlymouthFonts(pluginDir string) error {
+	if _, err := os.Stat(filepath.Join(pluginDir, "label-freetype.so")); err == nil {
+		for _, f := range plymouthFonts {
+			file, err := fcMatch(f.pattern)
+			if err != nil {
+				warning("plymouth: %v", err)
+				continue
+			}
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if err := img.AppendContent(content, 0644, f.dest); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, p := range []string{"label.so", "label-pango.so"} {
+		if _, err := os.Stat(filepath.Join(pluginDir, p)); err != nil {
+			continue
+		}
+		if err := img.AppendFile(fontconfigDir); err != nil {
+			return fmt.Errorf("plymouth: fontconfig: %v", err)
+		}
+		for _, f := range plymouthFonts {
+			file, err := fcMatch(f.pattern)
+			if err != nil {
+				warning("plymouth: %v", err)
+				continue
+			}
+			if err := img.AppendFile(file); err != nil {
+				return err
+			}
+		}
+		break
+	}
+	return nil
+}
+
+// fcMatch returns the font file fontconfig matches for the pattern, an empty pattern matches the default font
+var fcMatch = func(pattern string) (string, error) {
+	args := []string{"--format=%{file}"}
+	if pattern != "" {
+		args = append(args, pattern)
+	}
+	out, err := exec.Command("fc-match", args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to find font '%s' with fc-match: %v", pattern, err)
+	}
+	file := strings.TrimSpace(string(out))
+	if file == "" {
+		return "", fmt.Errorf("fc-match did not find font '%s'", pattern)
+	}
+	return file, nil
+}
+
+func findBinary(name string, dirs ...string) (string, error) {
+	for _, d := range dirs {
+		file := filepath.Join(d, name)
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("binary %s is not found", name)
+}
+
+func findPlymouthPluginDir() (string, error) {
+	for _, pattern := range plymouthPluginDirs {
+		dirs, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		for _, d := range dirs {
+			if _, err := os.Stat(filepath.Join(d, "renderers")); err == nil {
+				return d, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("plymouth: unable to find the plugins directory")
+}
+
+// readPlymouthTheme returns the theme configured with "Theme=" property of the [Daemon] section. The config takes
+// precedence over the distro defaults.
+func readPlymouthTheme(files ...string) (string, error) {
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("plymouth: %v", err)
+		}
+		if theme := readIniProperty(content, "Daemon", "Theme"); theme != "" {
+			return theme, nil
+		}
+	}
+	return "", fmt.Errorf("plymouth: theme is not configured, set it with 'plymouth-set-default-theme'")
+}
+
+// readPlymouthThemeModule returns the name of the plugin that displays the theme and the directory with the theme
+// images specified with ImageDir property of the plugin section, it is empty for the themes without images
+func readPlymouthThemeModule(themeFile string) (string, string, error) {
+	content, err := os.ReadFile(themeFile)
+	if err != nil {
+		return "", "", err
+	}
+	module := readIniProperty(content, "Plymouth Theme", "ModuleName")
+	if module == "" {
+		return "", "", fmt.Errorf("%s does not specify ModuleName", themeFile)
+	}
+	return module, readIniProperty(content, module, "ImageDir"), nil
+}
+
+// readIniProperty returns the value of the property in the section of an ini-style file, e.g. [Daemon] Theme=spinner
+func readIniProperty(content []byte, section, key string) string {
+	var current string
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = line[1 : len(line)-1]
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if current == section && len(parts) == 2 && strings.TrimSpace(parts[0]) == key {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
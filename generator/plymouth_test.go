@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReadPlymouthTheme(t *testing.T) {
+	dir := t.TempDir()
+	config, defaults := dir+"/plymouthd.conf", dir+"/plymouthd.defaults"
+	if err := os.WriteFile(defaults, []byte("[Daemon]\nTheme=spinner\nShowDelay=5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config does not exist
+	theme, err := readPlymouthTheme(config, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme != "spinner" {
+		t.Fatalf("expected theme spinner, got %s", theme)
+	}
+
+	if err := os.WriteFile(config, []byte("# set with plymouth-set-default-theme\n[Daemon]\nTheme = bgrt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	theme, err = readPlymouthTheme(config, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme != "bgrt" {
+		t.Fatalf("expected theme bgrt, got %s", theme)
+	}
+
+	if _, err := readPlymouthTheme(dir + "/missing"); err == nil {
+		t.Fatal("expected an error for the missing theme")
+	}
+}
+
+func TestReadPlymouthThemeModule(t *testing.T) {
+	file := t.TempDir() + "/bgrt.plymouth"
+	content := "[Plymouth Theme]\nName=BGRT\nModuleName=two-step\n\n[two-step]\nImageDir=/usr/share/plymouth/themes/spinner\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	module, imageDir, err := readPlymouthThemeModule(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if module != "two-step" {
+		t.Fatalf("expected module two-step, got %s", module)
+	}
+	if imageDir != "/usr/share/plymouth/themes/spinner" {
+		t.Fatalf("expected images at the spinner theme, got '%s'", imageDir)
+	}
+}
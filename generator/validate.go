@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// validateCmdline checks device references of a kernel command line, e.g. 'booster validate-cmdline root=UUID=...'.
+// The check is done by the init binary in its dry-run mode, this way the generator uses exactly the same parser
+// as the boot process. It returns the process exit code.
+func validateCmdline(args []string) int {
+	cmd := exec.Command(*initBinary, append([]string{"validate-cmdline"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintf(os.Stderr, "unable to run init binary %s: %v\n", *initBinary, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// appendVerityPublicKey adds the key that init uses to verify the signature of the dm-verity root hash
+func (img *Image) appendVerityPublicKey(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("verity_public_key: %v", err)
+	}
+	if _, err := parseVerityPublicKey(content); err != nil {
+		return fmt.Errorf("verity_public_key: %s: %v", file, err)
+	}
+	return img.AppendContent(content, 0644, verityPublicKeyPath)
+}
+
+// signVerity stores the signature of the root hash at the verity hash device, e.g.
+// 'booster sign-verity -key verity.key -roothash $HASH /dev/sda3'. It returns the process exit code.
+func signVerity(args []string) int {
+	flags := flag.NewFlagSet("sign-verity", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "PEM encoded private key (Ed25519, ECDSA or RSA)")
+	rootHashParam := flags.String("roothash", "", "Root hash of the verity device as printed by 'veritysetup format'")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *keyFile == "" || *rootHashParam == "" {
+		fmt.Fprintln(os.Stderr, "usage: booster sign-verity -key KEY -roothash HASH HASH_DEVICE")
+		return 2
+	}
+
+	if err := signVerityHashDevice(flags.Arg(0), *keyFile, *rootHashParam); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func signVerityHashDevice(device, keyFile, rootHashParam string) error {
+	rootHash, err := hex.DecodeString(rootHashParam)
+	if err != nil || len(rootHash) == 0 {
+		return fmt.Errorf("invalid root hash %s", rootHashParam)
+	}
+	keyData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := parseVerityPrivateKey(keyData)
+	if err != nil {
+		return fmt.Errorf("%s: %v", keyFile, err)
+	}
+	sig, err := signRootHash(key, rootHash)
+	if err != nil {
+		return err
+	}
+	record := encodeVeritySignature(sig)
+
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// struct verity_sb at lib/verity/verity.c of cryptsetup
+	sb := make([]byte, veritySignatureOffset)
+	if _, err := f.ReadAt(sb, 0); err != nil {
+		return fmt.Errorf("%s: %v", device, err)
+	}
+	if !bytes.HasPrefix(sb, []byte("verity\x00\x00")) {
+		return fmt.Errorf("%s does not have a verity superblock, the hash device has to be formatted with 'veritysetup format'", device)
+	}
+	hashBlockSize := int(binary.LittleEndian.Uint32(sb[0x44:]))
+	if veritySignatureOffset+len(record) > hashBlockSize {
+		return fmt.Errorf("%s: the signature does not fit the %d bytes hash block, format the device with a larger --hash-block-size", device, hashBlockSize)
+	}
+
+	// make sure the rest of the superblock block is either empty or signed already
+	current := make([]byte, hashBlockSize-veritySignatureOffset)
+	if _, err := f.ReadAt(current, veritySignatureOffset); err != nil {
+		return fmt.Errorf("%s: %v", device, err)
+	}
+	if !bytes.HasPrefix(current, []byte(veritySignatureMagic)) && len(bytes.Trim(current, "\x00")) != 0 {
+		return fmt.Errorf("%s: the space after the verity superblock is not empty", device)
+	}
+
+	padded := make([]byte, len(current)) // clears the previous signature
+	copy(padded, record)
+	if _, err := f.WriteAt(padded, veritySignatureOffset); err != nil {
+		return fmt.Errorf("%s: %v", device, err)
+	}
+	return f.Sync()
+}
+
+// parseVerityPrivateKey parses a PEM encoded private key either in PKCS #8 format or an EC/RSA specific one
+func parseVerityPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("PEM encoded private key is expected")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case *rsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// signRootHash signs the root hash the way verifyRootHashSignature expects
+func signRootHash(key crypto.Signer, rootHash []byte) ([]byte, error) {
+	msg := verityRootHashMessage(rootHash)
+	digest := sha256.Sum256(msg)
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, msg), nil
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, k, digest[:])
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"testing"
+)
+
+func TestSignVerityHashDevice(t *testing.T) {
+	t.Parallel()
+
+	const rootHash = "fd6e2d3d2f3b2ac1b9b3bbc165d5a6e87b8c0df064e1bc5ed44a5b3d68fcb9a2"
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{edKey, ecKey, rsaKey} {
+		dir := t.TempDir()
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyFile := dir + "/verity.key"
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		pubDer, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := parseVerityPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		device := dir + "/hash.img"
+		sb := make([]byte, 8192)
+		copy(sb, "verity\x00\x00")
+		binary.LittleEndian.PutUint32(sb[0x44:], 4096)
+		if err := os.WriteFile(device, sb, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// signing twice replaces the signature
+		for i := 0; i < 2; i++ {
+			if err := signVerityHashDevice(device, keyFile, rootHash); err != nil {
+				t.Fatalf("%T: %v", key, err)
+			}
+		}
+
+		content, err := os.ReadFile(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := decodeVeritySignature(content[veritySignatureOffset:4096])
+		if err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		hash := []byte{0xfd, 0x6e, 0x2d, 0x3d, 0x2f, 0x3b, 0x2a, 0xc1, 0xb9, 0xb3, 0xbb, 0xc1, 0x65, 0xd5, 0xa6, 0xe8,
+			0x7b, 0x8c, 0x0d, 0xf0, 0x64, 0xe1, 0xbc, 0x5e, 0xd4, 0x4a, 0x5b, 0x3d, 0x68, 0xfc, 0xb9, 0xa2}
+		if err := verifyRootHashSignature(pub, hash, sig); err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		hash[0] ^= 1
+		if err := verifyRootHashSignature(pub, hash, sig); err != errVeritySignature {
+			t.Fatalf("%T: expected signature mismatch for a different root hash, got %v", key, err)
+		}
+	}
+}
+
+func TestSignVerityNonEmptyBlock(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := dir + "/verity.key"
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	device := dir + "/hash.img"
+	sb := make([]byte, 4096)
+	copy(sb, "verity\x00\x00")
+	binary.LittleEndian.PutUint32(sb[0x44:], 4096)
+	sb[1000] = 0x42
+	if err := os.WriteFile(device, sb, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := signVerityHashDevice(device, keyFile, "00ff"); err == nil {
+		t.Fatal("signing is expected to fail if the space after the superblock is used")
+	}
+	binary.LittleEndian.PutUint32(sb[0x44:], 512)
+	sb[1000] = 0
+	if err := os.WriteFile(device, sb, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := signVerityHashDevice(device, keyFile, "00ff"); err == nil {
+		t.Fatal("signing is expected to fail if the hash block does not have space for the signature")
+	}
+}
@@ -0,0 +1 @@
+../init/veritysig.go
\ No newline at end of file
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// assemblyLayer is a kind of stacked block device. A device of a layer might host any of the upper layers,
+// e.g. an md array contains a LUKS device that contains an LVM physical volume.
+type assemblyLayer int
+
+const (
+	layerMd assemblyLayer = iota
+	layerLuks
+	layerLvm
+)
+
+var assemblyLayerNames = []string{
+	layerMd:   "md",
+	layerLuks: "luks",
+	layerLvm:  "lvm",
+}
+
+// assemblyNode is a superblock discovered at a block device that needs to be activated, e.g. a LUKS device to open
+type assemblyNode struct {
+	dev     string // kernel name of the device that carries the superblock, e.g. "md126"
+	layer   assemblyLayer
+	lower   []*assemblyNode // nodes of the devices this device is stacked on
+	settled bool            // the activation is finished, successfully or not
+}
+
+// assemblyGraph is a DAG of the discovered stacked devices. A node is activated only after the nodes it is stacked on
+// and all the nodes of the lower layers are settled as any of them might host a device needed by this node.
+// For example an LVM volume group is not scanned until the LUKS devices are opened.
+type assemblyGraph struct {
+	mutex        sync.Mutex
+	cond         *sync.Cond
+	nodes        map[string]*assemblyNode
+	order        []string                  // activated nodes as "layer:dev"
+	lowerDevices func(dev string) []string // devices the given device is stacked on
+}
+
+func newAssemblyGraph(lowerDevices func(dev string) []string) *assemblyGraph {
+	g := &assemblyGraph{
+		nodes:        make(map[string]*assemblyNode),
+		lowerDevices: lowerDevices,
+	}
+	g.cond = sync.NewCond(&g.mutex)
+	return g
+}
+
+var assembly = newAssemblyGraph(sysfsLowerDevices)
+
+// add registers a superblock discovered at the device. It needs to be called synchronously from the device
+// discovery so the nodes of the upper layers know about it before they are activated.
+func (g *assemblyGraph) add(dev string, layer assemblyLayer) *assemblyNode {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if n, ok := g.nodes[dev]; ok {
+		return n
+	}
+	n := &assemblyNode{dev: dev, layer: layer}
+	for _, l := range g.lowerDevices(dev) {
+		if ln, ok := g.nodes[l]; ok {
+			n.lower = append(n.lower, ln)
+		}
+	}
+	g.nodes[dev] = n
+	return n
+}
+
+// ready checks whether all the devices that might host the node are settled. g.mutex must be held.
+func (g *assemblyGraph) ready(n *assemblyNode) bool {
+	for _, l := range n.lower {
+		if !l.settled {
+			return false
+		}
+	}
+	for _, o := range g.nodes {
+		if !o.settled && o.layer < n.layer {
+			return false
+		}
+	}
+	return true
+}
+
+// activate waits until the lower layers are settled and then runs the activation. The node is settled once
+// the activation returns.
+func (g *assemblyGraph) activate(n *assemblyNode, activation func() error) error {
+	g.mutex.Lock()
+	for !g.ready(n) {
+		g.cond.Wait()
+	}
+	g.order = append(g.order, assemblyLayerNames[n.layer]+":"+n.dev)
+	g.mutex.Unlock()
+
+	debug("assembly: activating %s device %s", assemblyLayerNames[n.layer], n.dev)
+	err := activation()
+	g.settle(n)
+	return err
+}
+
+// settle marks the node as activated, it is used for nodes that are activated together with other nodes,
+// e.g. the member disks of an md array
+func (g *assemblyGraph) settle(n *assemblyNode) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	n.settled = true
+	g.cond.Broadcast()
+}
+
+// waitSettled waits until all the discovered nodes are activated
+func (g *assemblyGraph) waitSettled() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for g.pending() {
+		g.cond.Wait()
+	}
+}
+
+// pending checks whether any of the discovered nodes is not activated yet. g.mutex must be held.
+func (g *assemblyGraph) pending() bool {
+	for _, n := range g.nodes {
+		if !n.settled {
+			return true
+		}
+	}
+	return false
+}
+
+// assemblyDevName returns the kernel name of the block device (e.g. "dm-0" for /dev/mapper/luks-$UUID)
+func assemblyDevName(info *blkInfo) string {
+	sysPath := fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(info.devNo), unix.Minor(info.devNo))
+	if target, err := filepath.EvalSymlinks(sysPath); err == nil {
+		return filepath.Base(target)
+	}
+	return filepath.Base(info.path)
+}
+
+// sysfsLowerDevices returns the devices the given device-mapper or md device is stacked on
+func sysfsLowerDevices(dev string) []string {
+	slaves, err := os.ReadDir("/sys/class/block/" + dev + "/slaves")
+	if err != nil {
+		return nil
+	}
+	var devs []string
+	for _, s := range slaves {
+		devs = append(devs, s.Name())
+	}
+	return devs
+}
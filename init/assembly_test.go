@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAssemblyOrder(t *testing.T) {
+	// md RAID of sda and sdb -> LUKS at md126 -> LVM physical volume at dm-0, plus a plain physical volume at sdc
+	// of the same volume group
+	stack := map[string][]string{
+		"md126": {"sda", "sdb"},
+		"dm-0":  {"md126"},
+	}
+	g := newAssemblyGraph(func(dev string) []string { return stack[dev] })
+
+	sda := g.add("sda", layerMd)
+	sdb := g.add("sdb", layerMd)
+	luks := g.add("md126", layerLuks)
+	pv := g.add("dm-0", layerLvm)
+	plainPv := g.add("sdc", layerLvm)
+	if len(luks.lower) != 2 || len(pv.lower) != 1 || pv.lower[0] != luks {
+		t.Fatalf("unexpected dependencies: luks %v, lvm %v", luks.lower, pv.lower)
+	}
+
+	var wg sync.WaitGroup
+	activate := func(n *assemblyNode, activation func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = g.activate(n, func() error {
+				activation()
+				return nil
+			})
+		}()
+	}
+
+	// the upper layers are started first, they need to wait for the devices they might be stacked on
+	activate(plainPv, func() {})
+	activate(pv, func() {})
+	activate(luks, func() {})
+	time.Sleep(10 * time.Millisecond)
+	g.mutex.Lock()
+	if len(g.order) != 0 {
+		t.Fatalf("devices activated before the md array is assembled: %v", g.order)
+	}
+	g.mutex.Unlock()
+
+	// md array assembly settles all its members
+	activate(sda, func() { g.settle(sdb) })
+	wg.Wait()
+
+	if len(g.order) != 4 || g.order[0] != "md:sda" || g.order[1] != "luks:md126" {
+		t.Fatalf("unexpected activation order %v", g.order)
+	}
+	lvm := []string{g.order[2], g.order[3]}
+	sort.Strings(lvm)
+	if !reflect.DeepEqual(lvm, []string{"lvm:dm-0", "lvm:sdc"}) {
+		t.Fatalf("unexpected activation order %v", g.order)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		g.waitSettled()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("activated devices are not settled")
+	}
+}
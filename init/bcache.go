@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bcacheCacheTimeout is the time a backing device waits for its caching device before it gets started degraded
+const bcacheCacheTimeout = 10 * time.Second
+
+var (
+	degradedBcache      = map[string]bool{} // backing devices (e.g. "sdb") that were started without their caching device
+	degradedBcacheMutex sync.Mutex
+)
+
+// handleBcacheBlockDevice registers a bcache member device with the kernel. Once both the backing and caching
+// devices are registered the kernel assembles a /dev/bcacheN device that is processed as any other block device.
+func handleBcacheBlockDevice(info *blkInfo) error {
+	loadModules("bcache").Wait()
+
+	debug("registering bcache device %s", info.path)
+	if err := os.WriteFile("/sys/fs/bcache/register", []byte(info.path), 0200); err != nil {
+		return fmt.Errorf("bcache: unable to register %s: %v", info.path, err)
+	}
+
+	data := info.data.(bcacheData)
+	if data.backing && !isZeroUuid(data.setUuid) {
+		// a backing device attached to a cache set does not start until the caching device is registered
+		go waitForBcacheCache(filepath.Base(info.path))
+	}
+	return nil
+}
+
+// waitForBcacheCache waits for the caching device of the backing device devName. If it does not appear
+// then the backing device is started without the cache.
+func waitForBcacheCache(devName string) {
+	running := "/sys/class/block/" + devName + "/bcache/running"
+
+	timeout := time.After(bcacheCacheTimeout)
+	for {
+		if b, err := os.ReadFile(running); err == nil && strings.TrimSpace(string(b)) == "1" {
+			return
+		}
+		select {
+		case <-timeout:
+			warning("bcache: caching device for %s did not appear, starting it degraded", devName)
+			// the flag needs to be set before the bcache device appears
+			degradedBcacheMutex.Lock()
+			degradedBcache[devName] = true
+			degradedBcacheMutex.Unlock()
+			if err := os.WriteFile(running, []byte("1"), 0200); err != nil {
+				warning("bcache: unable to start %s: %v", devName, err)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// isDegradedBcache checks whether dev is a bcache device started without its caching device.
+// The cache might contain dirty data thus such device should be used read-only.
+func isDegradedBcache(dev string) bool {
+	name := filepath.Base(dev)
+	if !strings.HasPrefix(name, "bcache") {
+		return false
+	}
+	slaves, err := os.ReadDir("/sys/class/block/" + name + "/slaves")
+	if err != nil {
+		return false
+	}
+
+	degradedBcacheMutex.Lock()
+	defer degradedBcacheMutex.Unlock()
+	for _, s := range slaves {
+		if degradedBcache[s.Name()] {
+			return true
+		}
+	}
+	return false
+}
+
+func isZeroUuid(uuid UUID) bool {
+	for _, b := range uuid {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
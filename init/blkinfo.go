@@ -3,19 +3,98 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"unicode/utf16"
+
+	"golang.org/x/sys/unix"
 )
 
 type blkInfo struct {
+	path   string // path to the block device, e.g. /dev/sda1
+	devNo  uint64 // major/minor device number
 	format string // gpt, dos, ext4, btrfs, ...
 	isFs   bool   // specifies if the format a mountable filesystem
 	uuid   UUID
 	label  string
+	data   interface{} // format specific data, e.g. list of partitions for gpt
+}
+
+// gptPart describes a single entry of a GPT partition table
+type gptPart struct {
+	num        int // partition index in the table, starts from 0
+	typeGuid   UUID
+	uuid       UUID
+	attributes uint64
+	name       string
+}
+
+// GPT partition attribute flags as defined by the Discoverable Partitions Specification
+const (
+	gptAttrReadOnly = 1 << 60
+	gptAttrNoAuto   = 1 << 63
+)
+
+// btrfsData describes a member device of a btrfs filesystem
+type btrfsData struct {
+	numDevices uint64 // number of devices in the filesystem
+	devId      uint64 // id of this device within the filesystem
+}
+
+// bcacheData describes a bcache member device
+type bcacheData struct {
+	backing bool // backing device, otherwise it is a caching device
+	setUuid UUID // uuid of the cache set the device is attached to
+}
+
+// integrityData describes a standalone dm-integrity device
+type integrityData struct {
+	tagSize             uint16 // size of the integrity tag per sector
+	providedDataSectors uint64 // size of the mapped device in 512-byte sectors
+	flags               uint32
+	sectorsPerBlockLog2 uint8
+}
+
+// verityData describes a dm-verity hash device formatted with a superblock
+type verityData struct {
+	hashType      uint32
+	algorithm     string
+	dataBlockSize uint32
+	hashBlockSize uint32
+	dataBlocks    uint64
+	salt          []byte
+}
+
+// lvmData describes an LVM physical volume
+type lvmData struct {
+	pvUuid string // LVM uuid of the physical volume, 32 characters without dashes
+}
+
+// imsmData describes a member disk of an Intel Matrix Storage Manager (IMSM, Intel RST) fake-RAID container
+type imsmData struct {
+	familyNum  uint32     // identifies the container, all its member disks share the same value
+	numVolumes int        // number of RAID volumes in the container, 0 for a spare disk
+	disks      []imsmDisk // disk table of the container
 }
 
+// imsmDisk is an entry of the IMSM disk table
+type imsmDisk struct {
+	serial string
+	status uint32
+}
+
+// IMSM disk status flags
+const (
+	imsmDiskSpare      = 0x1
+	imsmDiskConfigured = 0x2
+	imsmDiskFailed     = 0x4
+)
+
 var errUnknownBlockType = fmt.Errorf("cannot detect block device type")
 
 // readBlkInfo block device information. Returns nil if the format was not detected.
@@ -26,11 +105,27 @@ func readBlkInfo(path string) (*blkInfo, error) {
 	}
 	defer r.Close()
 
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(r.Fd()), &stat); err != nil {
+		return nil, err
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
 	type probeFn func(r io.ReaderAt) *blkInfo
-	probes := []probeFn{probeGpt, probeMbr, probeLuks, probeExt4, probeBtrfs, probeXfs, probeF2fs}
+	// IMSM metadata is stored at the end of the disk and a RAID1 member disk also carries the volume GPT at its beginning,
+	// ntfs and exfat boot sectors carry the MBR boot signature so they need to be probed before mbr,
+	// hybrid ISO images have a partition table as well and they are referenced by the filesystem label
+	probeImsmMember := func(r io.ReaderAt) *blkInfo { return probeImsm(r, size) }
+	probes := []probeFn{probeImsmMember, probeIso9660, probeGpt, probeNtfs, probeExfat, probeMbr, probeLuks, probeIntegrity, probeVerity, probeBcache, probeLvm, probeExt4, probeBtrfs, probeXfs, probeF2fs, probeSquashfs}
 	for _, fn := range probes {
 		info := fn(r)
 		if info != nil {
+			info.path = path
+			info.devNo = stat.Rdev
 			debug("blkinfo for %s: type=%s UUID=%s LABEL=%s", path, info.format, info.uuid.toString(), info.label)
 			return info, nil
 		}
@@ -39,12 +134,25 @@ func readBlkInfo(path string) (*blkInfo, error) {
 	return nil, errUnknownBlockType
 }
 
+// gptGuid converts GUID from its on-disk mixed-endian form to the byte order used by UUID
+func gptGuid(d []byte) UUID {
+	return []byte{d[3], d[2], d[1], d[0],
+		d[5], d[4],
+		d[7], d[6],
+		d[8], d[9],
+		d[10], d[11], d[12], d[13], d[14], d[15]}
+}
+
 func probeGpt(r io.ReaderAt) *blkInfo {
 	const (
 		// https://wiki.osdev.org/GPT
-		tableHeaderOffset = 0x200
-		signatureOffset   = 0x0
-		guidOffset        = 0x38
+		sectorSize          = 0x200
+		tableHeaderOffset   = 0x200
+		signatureOffset     = 0x0
+		guidOffset          = 0x38
+		partitionsLbaOffset = 0x48
+		partitionsNumOffset = 0x50
+		partitionSizeOffset = 0x54
 	)
 	signature := make([]byte, 8)
 	if _, err := r.ReadAt(signature, tableHeaderOffset+signatureOffset); err != nil {
@@ -58,12 +166,162 @@ func probeGpt(r io.ReaderAt) *blkInfo {
 	if _, err := r.ReadAt(d, tableHeaderOffset+guidOffset); err != nil {
 		return nil
 	}
-	uuid := []byte{d[3], d[2], d[1], d[0],
-		d[5], d[4],
-		d[7], d[6],
-		d[8], d[9],
-		d[10], d[11], d[12], d[13], d[14], d[15]}
-	return &blkInfo{"gpt", false, uuid, ""}
+	uuid := gptGuid(d)
+
+	buff := make([]byte, 16)
+	if _, err := r.ReadAt(buff, tableHeaderOffset+partitionsLbaOffset); err != nil {
+		return nil
+	}
+	partitionsLba := binary.LittleEndian.Uint64(buff[0:8])
+	partitionsNum := binary.LittleEndian.Uint32(buff[8:12])
+	partitionSize := binary.LittleEndian.Uint32(buff[12:16])
+
+	partitions, err := readGptPartitions(r, int64(partitionsLba*sectorSize), int(partitionsNum), int(partitionSize))
+	if err != nil {
+		warning("unable to read gpt partitions: %v", err)
+		return nil
+	}
+
+	return &blkInfo{format: "gpt", uuid: uuid, data: partitions}
+}
+
+func readGptPartitions(r io.ReaderAt, offset int64, num, size int) ([]gptPart, error) {
+	const (
+		typeGuidOffset = 0x0
+		uuidOffset     = 0x10
+		attrOffset     = 0x30
+		nameOffset     = 0x38
+		nameLength     = 72
+		minEntrySize   = nameOffset + nameLength
+	)
+	if size < minEntrySize {
+		return nil, fmt.Errorf("invalid partition entry size %d", size)
+	}
+
+	var partitions []gptPart
+	entry := make([]byte, size)
+	for i := 0; i < num; i++ {
+		if _, err := r.ReadAt(entry, offset+int64(i*size)); err != nil {
+			return nil, err
+		}
+
+		typeGuid := gptGuid(entry[typeGuidOffset : typeGuidOffset+16])
+		if bytes.Equal(typeGuid, make([]byte, 16)) {
+			continue // unused entry
+		}
+
+		runes := make([]uint16, nameLength/2)
+		if err := binary.Read(bytes.NewReader(entry[nameOffset:nameOffset+nameLength]), binary.LittleEndian, &runes); err != nil {
+			return nil, err
+		}
+		for j, r := range runes {
+			if r == 0 {
+				runes = runes[:j]
+				break
+			}
+		}
+
+		partitions = append(partitions, gptPart{
+			num:        i,
+			typeGuid:   typeGuid,
+			uuid:       gptGuid(entry[uuidOffset : uuidOffset+16]),
+			attributes: binary.LittleEndian.Uint64(entry[attrOffset : attrOffset+8]),
+			name:       string(utf16.Decode(runes)),
+		})
+	}
+
+	return partitions, nil
+}
+
+// readParentGpt returns the name of the disk the partition belongs to and the disk partition table
+func readParentGpt(partition string) (string, []gptPart, error) {
+	name := filepath.Base(partition)
+	if !isPartition(name) {
+		return "", nil, fmt.Errorf("%s is not a partition", partition)
+	}
+	sysPath, err := filepath.EvalSymlinks("/sys/class/block/" + name)
+	if err != nil {
+		return "", nil, err
+	}
+	disk := filepath.Base(filepath.Dir(sysPath))
+	info, err := readBlkInfo("/dev/" + disk)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.format != "gpt" {
+		return "", nil, fmt.Errorf("disk %s does not have a gpt partition table", disk)
+	}
+	return disk, info.data.([]gptPart), nil
+}
+
+// updateGptAttributes changes the attributes of the partition entry in both the primary and the backup partition tables
+// and updates their checksums
+func updateGptAttributes(disk string, entry int, update func(attrs uint64) uint64) error {
+	const (
+		sectorSize          = 0x200
+		headerSizeOffset    = 0xc
+		headerCrcOffset     = 0x10
+		backupLbaOffset     = 0x20
+		partitionsLbaOffset = 0x48
+		partitionsNumOffset = 0x50
+		partitionSizeOffset = 0x54
+		partitionsCrcOffset = 0x58
+		attrOffset          = 0x30
+		minHeaderSize       = 0x5c
+	)
+
+	f, err := os.OpenFile(disk, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	updateTable := func(headerLba uint64) (uint64, error) {
+		header := make([]byte, sectorSize)
+		if _, err := f.ReadAt(header, int64(headerLba*sectorSize)); err != nil {
+			return 0, err
+		}
+		if string(header[:8]) != "EFI PART" {
+			return 0, fmt.Errorf("no gpt header at LBA %d", headerLba)
+		}
+		headerSize := binary.LittleEndian.Uint32(header[headerSizeOffset:])
+		if headerSize < minHeaderSize || headerSize > sectorSize {
+			return 0, fmt.Errorf("invalid gpt header size %d", headerSize)
+		}
+		num := int(binary.LittleEndian.Uint32(header[partitionsNumOffset:]))
+		size := int(binary.LittleEndian.Uint32(header[partitionSizeOffset:]))
+		if entry >= num || size < attrOffset+8 {
+			return 0, fmt.Errorf("invalid partition entry %d", entry)
+		}
+		entriesOffset := int64(binary.LittleEndian.Uint64(header[partitionsLbaOffset:]) * sectorSize)
+		entries := make([]byte, num*size)
+		if _, err := f.ReadAt(entries, entriesOffset); err != nil {
+			return 0, err
+		}
+
+		attrs := entries[entry*size+attrOffset:]
+		binary.LittleEndian.PutUint64(attrs, update(binary.LittleEndian.Uint64(attrs)))
+		binary.LittleEndian.PutUint32(header[partitionsCrcOffset:], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(header[headerCrcOffset:], 0)
+		binary.LittleEndian.PutUint32(header[headerCrcOffset:], crc32.ChecksumIEEE(header[:headerSize]))
+
+		if _, err := f.WriteAt(entries, entriesOffset); err != nil {
+			return 0, err
+		}
+		if _, err := f.WriteAt(header, int64(headerLba*sectorSize)); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(header[backupLbaOffset:]), nil
+	}
+
+	backupLba, err := updateTable(1)
+	if err != nil {
+		return fmt.Errorf("primary gpt: %v", err)
+	}
+	if _, err := updateTable(backupLba); err != nil {
+		return fmt.Errorf("backup gpt at LBA %d: %v", backupLba, err)
+	}
+	return f.Sync()
 }
 
 func probeMbr(r io.ReaderAt) *blkInfo {
@@ -94,7 +352,7 @@ func probeMbr(r io.ReaderAt) *blkInfo {
 		return nil
 	}
 	id := []byte{b[3], b[2], b[1], b[0]} // little endian
-	return &blkInfo{"mbr", false, id, ""}
+	return &blkInfo{format: "mbr", uuid: id}
 }
 
 func probeLuks(r io.ReaderAt) *blkInfo {
@@ -139,7 +397,227 @@ func probeLuks(r io.ReaderAt) *blkInfo {
 		label = fixedArrayToString(buff)
 	}
 
-	return &blkInfo{"luks", false, uuid, label}
+	return &blkInfo{format: "luks", uuid: uuid, label: label}
+}
+
+func probeIntegrity(r io.ReaderAt) *blkInfo {
+	// https://www.kernel.org/doc/html/latest/admin-guide/device-mapper/dm-integrity.html
+	// struct superblock at drivers/md/dm-integrity.c
+	const (
+		integrityMagic                     = "integrt\x00"
+		integrityTagSizeOffset             = 0xa
+		integrityProvidedDataSectorsOffset = 0x10
+		integrityFlagsOffset               = 0x18
+		integritySectorsPerBlockOffset     = 0x1c
+	)
+
+	sb := make([]byte, 0x20)
+	if _, err := r.ReadAt(sb, 0); err != nil {
+		return nil
+	}
+	if string(sb[:len(integrityMagic)]) != integrityMagic {
+		return nil
+	}
+	data := integrityData{
+		tagSize:             binary.LittleEndian.Uint16(sb[integrityTagSizeOffset:]),
+		providedDataSectors: binary.LittleEndian.Uint64(sb[integrityProvidedDataSectorsOffset:]),
+		flags:               binary.LittleEndian.Uint32(sb[integrityFlagsOffset:]),
+		sectorsPerBlockLog2: sb[integritySectorsPerBlockOffset],
+	}
+	// dm-integrity does not have any uuid or label
+	return &blkInfo{format: "integrity", data: data}
+}
+
+func probeImsm(r io.ReaderAt, size int64) *blkInfo {
+	// struct imsm_super at super-intel.c of mdadm
+	const (
+		imsmSignature         = "Intel Raid ISM Cfg Sig. "
+		imsmSectorSize        = 512
+		imsmChecksumOffset    = 0x20
+		imsmMpbSizeOffset     = 0x24
+		imsmFamilyNumOffset   = 0x28
+		imsmNumDisksOffset    = 0x38
+		imsmNumRaidDevsOffset = 0x39
+		imsmDiskTableOffset   = 0xd8
+		imsmDiskEntrySize     = 0x30
+		imsmDiskStatusOffset  = 0x18
+		imsmDiskSerialLen     = 16
+		imsmMaxMpbSize        = 128 * 1024
+	)
+
+	// the anchor sector is the second to last sector of the disk
+	anchorOffset := size - 2*imsmSectorSize
+	if anchorOffset < 0 {
+		return nil
+	}
+	mpb := make([]byte, imsmSectorSize)
+	if _, err := r.ReadAt(mpb, anchorOffset); err != nil {
+		return nil
+	}
+	if string(mpb[:len(imsmSignature)]) != imsmSignature {
+		return nil
+	}
+
+	mpbSize := int64(binary.LittleEndian.Uint32(mpb[imsmMpbSizeOffset:]))
+	if mpbSize < imsmDiskTableOffset || mpbSize > imsmMaxMpbSize || mpbSize > anchorOffset {
+		return nil
+	}
+	if mpbSize > imsmSectorSize {
+		// the rest of a large metadata block is stored in the sectors preceding the anchor
+		extraSectors := (mpbSize+imsmSectorSize-1)/imsmSectorSize - 1
+		extra := make([]byte, extraSectors*imsmSectorSize)
+		if _, err := r.ReadAt(extra, anchorOffset-int64(len(extra))); err != nil {
+			return nil
+		}
+		mpb = append(mpb, extra...)
+	}
+	mpb = mpb[:mpbSize]
+
+	var sum uint32
+	for i := 0; i+4 <= len(mpb); i += 4 {
+		sum += binary.LittleEndian.Uint32(mpb[i:])
+	}
+	checksum := binary.LittleEndian.Uint32(mpb[imsmChecksumOffset:])
+	if sum-checksum != checksum {
+		debug("imsm: invalid metadata checksum")
+		return nil
+	}
+
+	data := imsmData{
+		familyNum:  binary.LittleEndian.Uint32(mpb[imsmFamilyNumOffset:]),
+		numVolumes: int(mpb[imsmNumRaidDevsOffset]),
+	}
+	numDisks := int(mpb[imsmNumDisksOffset])
+	if imsmDiskTableOffset+numDisks*imsmDiskEntrySize > len(mpb) {
+		return nil
+	}
+	for i := 0; i < numDisks; i++ {
+		entry := mpb[imsmDiskTableOffset+i*imsmDiskEntrySize:]
+		data.disks = append(data.disks, imsmDisk{
+			serial: string(bytes.TrimRight(entry[:imsmDiskSerialLen], "\x00 ")),
+			status: binary.LittleEndian.Uint32(entry[imsmDiskStatusOffset:]),
+		})
+	}
+
+	// the container does not have a uuid, the family number identifies its members
+	return &blkInfo{format: "imsm", data: data}
+}
+
+func probeVerity(r io.ReaderAt) *blkInfo {
+	// struct verity_sb at lib/verity/verity.c of cryptsetup
+	const (
+		verityMagic               = "verity\x00\x00"
+		verityVersionOffset       = 0x8
+		verityHashTypeOffset      = 0xc
+		verityUuidOffset          = 0x10
+		verityAlgorithmOffset     = 0x20
+		verityAlgorithmLen        = 32
+		verityDataBlockSizeOffset = 0x40
+		verityHashBlockSizeOffset = 0x44
+		verityDataBlocksOffset    = 0x48
+		veritySaltSizeOffset      = 0x50
+		veritySaltOffset          = 0x58
+		verityMaxSaltSize         = 256
+	)
+
+	sb := make([]byte, veritySaltOffset+verityMaxSaltSize)
+	if _, err := r.ReadAt(sb, 0); err != nil {
+		return nil
+	}
+	if string(sb[:len(verityMagic)]) != verityMagic {
+		return nil
+	}
+	if version := binary.LittleEndian.Uint32(sb[verityVersionOffset:]); version != 1 {
+		debug("verity: unsupported superblock version %d", version)
+		return nil
+	}
+	saltSize := int(binary.LittleEndian.Uint16(sb[veritySaltSizeOffset:]))
+	if saltSize > verityMaxSaltSize {
+		return nil
+	}
+	data := verityData{
+		hashType:      binary.LittleEndian.Uint32(sb[verityHashTypeOffset:]),
+		algorithm:     string(bytes.TrimRight(sb[verityAlgorithmOffset:verityAlgorithmOffset+verityAlgorithmLen], "\x00")),
+		dataBlockSize: binary.LittleEndian.Uint32(sb[verityDataBlockSizeOffset:]),
+		hashBlockSize: binary.LittleEndian.Uint32(sb[verityHashBlockSizeOffset:]),
+		dataBlocks:    binary.LittleEndian.Uint64(sb[verityDataBlocksOffset:]),
+		salt:          append([]byte{}, sb[veritySaltOffset:veritySaltOffset+saltSize]...),
+	}
+	uuid := make(UUID, 16)
+	copy(uuid, sb[verityUuidOffset:])
+	return &blkInfo{format: "verity", uuid: uuid, data: data}
+}
+
+func probeLvm(r io.ReaderAt) *blkInfo {
+	// struct label_header and struct pv_header at lib/format_text/layout.h of LVM2
+	const (
+		lvmSectorSize       = 512
+		lvmLabelScanSectors = 4
+		lvmLabelId          = "LABELONE"
+		lvmLabelType        = "LVM2 001"
+		lvmLabelTypeOffset  = 0x18
+		lvmContentOffset    = 0x14 // offset of pv_header from the label start
+		lvmPvUuidLen        = 32
+	)
+
+	sector := make([]byte, lvmSectorSize)
+	for i := int64(0); i < lvmLabelScanSectors; i++ {
+		if _, err := r.ReadAt(sector, i*lvmSectorSize); err != nil {
+			return nil
+		}
+		if string(sector[:8]) != lvmLabelId || string(sector[lvmLabelTypeOffset:lvmLabelTypeOffset+8]) != lvmLabelType {
+			continue
+		}
+		contentOffset := binary.LittleEndian.Uint32(sector[lvmContentOffset:])
+		if contentOffset+lvmPvUuidLen > lvmSectorSize {
+			return nil
+		}
+		pvUuid := string(sector[contentOffset : contentOffset+lvmPvUuidLen])
+		return &blkInfo{format: "lvm", data: lvmData{pvUuid: pvUuid}}
+	}
+	return nil
+}
+
+func probeBcache(r io.ReaderAt) *blkInfo {
+	// https://github.com/torvalds/linux/blob/master/include/uapi/linux/bcache.h
+	const (
+		bcacheSuperblockOffset = 0x1000
+		bcacheVersionOffset    = 0x10
+		bcacheMagicOffset      = 0x18
+		bcacheUUIDOffset       = 0x28
+		bcacheSetUUIDOffset    = 0x38
+		bcacheLabelOffset      = 0x48
+		bcacheMagic            = "\xc6\x85\x73\xf6\x4e\x1a\x45\xca\x82\x65\xf5\x7f\x48\xba\x6d\x81"
+	)
+
+	magic := make([]byte, 16)
+	if _, err := r.ReadAt(magic, bcacheSuperblockOffset+bcacheMagicOffset); err != nil {
+		return nil
+	}
+	if !bytes.Equal(magic, []byte(bcacheMagic)) {
+		return nil
+	}
+	buff := make([]byte, 8)
+	if _, err := r.ReadAt(buff, bcacheSuperblockOffset+bcacheVersionOffset); err != nil {
+		return nil
+	}
+	version := binary.LittleEndian.Uint64(buff)
+	// BCACHE_SB_VERSION_BDEV, BCACHE_SB_VERSION_BDEV_WITH_OFFSET and BCACHE_SB_VERSION_BDEV_WITH_FEATURES
+	backing := version == 1 || version == 4 || version == 6
+
+	uuid := make([]byte, 16)
+	if _, err := r.ReadAt(uuid, bcacheSuperblockOffset+bcacheUUIDOffset); err != nil {
+		return nil
+	}
+	setUuid := make([]byte, 16)
+	if _, err := r.ReadAt(setUuid, bcacheSuperblockOffset+bcacheSetUUIDOffset); err != nil {
+		return nil
+	}
+	label := make([]byte, 32)
+	if _, err := r.ReadAt(label, bcacheSuperblockOffset+bcacheLabelOffset); err != nil {
+		return nil
+	}
+	return &blkInfo{format: "bcache", uuid: uuid, label: fixedArrayToString(label), data: bcacheData{backing: backing, setUuid: setUuid}}
 }
 
 func probeExt4(r io.ReaderAt) *blkInfo {
@@ -167,7 +645,7 @@ func probeExt4(r io.ReaderAt) *blkInfo {
 	if _, err := r.ReadAt(label, extSuperblockOffset+extLabelOffset); err != nil {
 		return nil
 	}
-	return &blkInfo{"ext4", true, uuid, fixedArrayToString(label)}
+	return &blkInfo{format: "ext4", isFs: true, uuid: uuid, label: fixedArrayToString(label)}
 }
 
 func probeBtrfs(r io.ReaderAt) *blkInfo {
@@ -175,6 +653,8 @@ func probeBtrfs(r io.ReaderAt) *blkInfo {
 	const (
 		btrfsSuperblockOffset = 0x10000
 		btrfsMagicOffset      = 0x40
+		btrfsNumDevicesOffset = 0x88
+		btrfsDevIdOffset      = 0xc9 // dev_item.devid
 		btrfsUUIDOffset       = 0x11b
 		btrfsLabelOffset      = 0x12b
 		btrfsMagic            = "_BHRfS_M"
@@ -195,7 +675,17 @@ func probeBtrfs(r io.ReaderAt) *blkInfo {
 	if _, err := r.ReadAt(label, btrfsSuperblockOffset+btrfsLabelOffset); err != nil {
 		return nil
 	}
-	return &blkInfo{"btrfs", true, uuid, fixedArrayToString(label)}
+	buff := make([]byte, 8)
+	if _, err := r.ReadAt(buff, btrfsSuperblockOffset+btrfsNumDevicesOffset); err != nil {
+		return nil
+	}
+	numDevices := binary.LittleEndian.Uint64(buff)
+	if _, err := r.ReadAt(buff, btrfsSuperblockOffset+btrfsDevIdOffset); err != nil {
+		return nil
+	}
+	devId := binary.LittleEndian.Uint64(buff)
+	data := btrfsData{numDevices: numDevices, devId: devId}
+	return &blkInfo{format: "btrfs", isFs: true, uuid: uuid, label: fixedArrayToString(label), data: data}
 }
 
 func probeXfs(r io.ReaderAt) *blkInfo {
@@ -223,7 +713,7 @@ func probeXfs(r io.ReaderAt) *blkInfo {
 	if _, err := r.ReadAt(label, xfsSuperblockOffset+xfsLabelOffset); err != nil {
 		return nil
 	}
-	return &blkInfo{"xfs", true, id, fixedArrayToString(label)}
+	return &blkInfo{format: "xfs", isFs: true, uuid: id, label: fixedArrayToString(label)}
 }
 
 func probeF2fs(r io.ReaderAt) *blkInfo {
@@ -264,5 +754,293 @@ func probeF2fs(r io.ReaderAt) *blkInfo {
 		}
 	}
 	label := string(utf16.Decode(runes))
-	return &blkInfo{"f2fs", true, uuid, label}
+	return &blkInfo{format: "f2fs", isFs: true, uuid: uuid, label: label}
+}
+
+// probeNtfs detects NTFS filesystem. The 64-bit volume serial number is used as the uuid, its bytes are stored
+// in big-endian order so uuid.toString() matches the serial printed by blkid (e.g. 0123456789abcdef).
+func probeNtfs(r io.ReaderAt) *blkInfo {
+	// https://flatcap.github.io/linux-ntfs/ntfs/files/boot.html
+	const (
+		ntfsMagicOffset             = 0x3
+		ntfsBytesPerSectorOffset    = 0xb
+		ntfsSectorsPerClusterOffset = 0xd
+		ntfsMftClusterOffset        = 0x30
+		ntfsMftRecordSizeOffset     = 0x40
+		ntfsSerialOffset            = 0x48
+		ntfsMagic                   = "NTFS    "
+		ntfsVolumeRecord            = 3 // $Volume is the 4th record in MFT
+	)
+
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil
+	}
+	if string(boot[ntfsMagicOffset:ntfsMagicOffset+len(ntfsMagic)]) != ntfsMagic {
+		return nil
+	}
+
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, binary.LittleEndian.Uint64(boot[ntfsSerialOffset:]))
+	info := &blkInfo{format: "ntfs", isFs: true, uuid: id}
+
+	bytesPerSector := int64(binary.LittleEndian.Uint16(boot[ntfsBytesPerSectorOffset:]))
+	if bytesPerSector < 256 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0 {
+		return info
+	}
+	sectorsPerCluster := int64(boot[ntfsSectorsPerClusterOffset])
+	if sectorsPerCluster > 0x80 {
+		// large clusters are encoded as a negative power of two
+		shift := 256 - sectorsPerCluster
+		if shift > 12 {
+			return info
+		}
+		sectorsPerCluster = 1 << shift
+	}
+	clusterSize := bytesPerSector * sectorsPerCluster
+	var recordSize int64
+	if v := int8(boot[ntfsMftRecordSizeOffset]); v > 0 {
+		recordSize = int64(v) * clusterSize
+	} else if v >= -16 {
+		recordSize = 1 << -v
+	}
+	if clusterSize == 0 || recordSize < 512 || recordSize > 65536 {
+		return info
+	}
+
+	mftOffset := int64(binary.LittleEndian.Uint64(boot[ntfsMftClusterOffset:])) * clusterSize
+	record := make([]byte, recordSize)
+	if _, err := r.ReadAt(record, mftOffset+ntfsVolumeRecord*recordSize); err != nil {
+		return info
+	}
+	info.label = ntfsVolumeName(record)
+	return info
+}
+
+// ntfsVolumeName extracts the volume name from the $Volume MFT record
+func ntfsVolumeName(record []byte) string {
+	const (
+		recordMagic        = "FILE"
+		attrVolumeName     = 0x60
+		attrEnd            = 0xffffffff
+		fixupStride        = 512
+		attrHeaderSize     = 0x18
+		residentValueLen   = 0x10
+		residentValueStart = 0x14
+	)
+
+	if string(record[:4]) != recordMagic {
+		return ""
+	}
+
+	// apply the update sequence array, the last two bytes of each 512-byte block are stored there
+	usaOffset := int(binary.LittleEndian.Uint16(record[0x4:]))
+	usaCount := int(binary.LittleEndian.Uint16(record[0x6:]))
+	if usaOffset+2*usaCount > len(record) || (usaCount-1)*fixupStride > len(record) {
+		return ""
+	}
+	for i := 1; i < usaCount; i++ {
+		copy(record[i*fixupStride-2:i*fixupStride], record[usaOffset+2*i:usaOffset+2*i+2])
+	}
+
+	offset := int(binary.LittleEndian.Uint16(record[0x14:]))
+	for offset+attrHeaderSize <= len(record) {
+		attrType := binary.LittleEndian.Uint32(record[offset:])
+		attrLen := int(binary.LittleEndian.Uint32(record[offset+4:]))
+		if attrType == attrEnd || attrLen == 0 || offset+attrLen > len(record) {
+			break
+		}
+		if attrType == attrVolumeName && record[offset+8] == 0 { // the name is always a resident attribute
+			valueLen := int(binary.LittleEndian.Uint32(record[offset+residentValueLen:]))
+			valueStart := offset + int(binary.LittleEndian.Uint16(record[offset+residentValueStart:]))
+			if valueStart+valueLen > offset+attrLen {
+				break
+			}
+			return decodeUtf16(record[valueStart : valueStart+valueLen])
+		}
+		offset += attrLen
+	}
+	return ""
+}
+
+// probeExfat detects exFAT filesystem. The 32-bit volume serial number is used as the uuid, its bytes are stored
+// in big-endian order so uuid.toString() matches the serial printed by blkid without the dash (e.g. 1234abcd for 1234-ABCD).
+func probeExfat(r io.ReaderAt) *blkInfo {
+	// https://docs.microsoft.com/en-us/windows/win32/fileio/exfat-specification
+	const (
+		exfatMagicOffset          = 0x3
+		exfatFatOffset            = 0x50
+		exfatClusterHeapOffset    = 0x58
+		exfatClusterCountOffset   = 0x5c
+		exfatRootDirClusterOffset = 0x60
+		exfatSerialOffset         = 0x64
+		exfatSectorShiftOffset    = 0x6c
+		exfatClusterShiftOffset   = 0x6d
+		exfatMagic                = "EXFAT   "
+		exfatEntrySize            = 32
+		exfatEntryEnd             = 0x00
+		exfatEntryLabel           = 0x83
+		exfatMaxRootClusters      = 256 // protects from loops in a corrupted FAT
+	)
+
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil
+	}
+	if string(boot[exfatMagicOffset:exfatMagicOffset+len(exfatMagic)]) != exfatMagic {
+		return nil
+	}
+
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, binary.LittleEndian.Uint32(boot[exfatSerialOffset:]))
+	info := &blkInfo{format: "exfat", isFs: true, uuid: id}
+
+	sectorShift, clusterShift := boot[exfatSectorShiftOffset], boot[exfatClusterShiftOffset]
+	if sectorShift < 9 || sectorShift > 12 || sectorShift+clusterShift > 25 {
+		return info
+	}
+	sectorSize := int64(1) << sectorShift
+	clusterSize := sectorSize << clusterShift
+	fatOffset := int64(binary.LittleEndian.Uint32(boot[exfatFatOffset:])) * sectorSize
+	heapOffset := int64(binary.LittleEndian.Uint32(boot[exfatClusterHeapOffset:])) * sectorSize
+	clusterCount := binary.LittleEndian.Uint32(boot[exfatClusterCountOffset:])
+
+	// the label is stored as an entry of the root directory, walk the directory cluster chain to find it
+	cluster := binary.LittleEndian.Uint32(boot[exfatRootDirClusterOffset:])
+	buf := make([]byte, clusterSize)
+	for i := 0; i < exfatMaxRootClusters && cluster >= 2 && cluster-2 < clusterCount; i++ {
+		if _, err := r.ReadAt(buf, heapOffset+int64(cluster-2)*clusterSize); err != nil {
+			return info
+		}
+		for e := 0; e+exfatEntrySize <= len(buf); e += exfatEntrySize {
+			switch buf[e] {
+			case exfatEntryEnd:
+				return info
+			case exfatEntryLabel:
+				length := int(buf[e+1])
+				if length > 11 {
+					length = 11
+				}
+				info.label = decodeUtf16(buf[e+2 : e+2+2*length])
+				return info
+			}
+		}
+
+		next := make([]byte, 4)
+		if _, err := r.ReadAt(next, fatOffset+4*int64(cluster)); err != nil {
+			return info
+		}
+		cluster = binary.LittleEndian.Uint32(next)
+	}
+	return info
+}
+
+// decodeUtf16 converts a little-endian UTF-16 buffer to a string
+func decodeUtf16(b []byte) string {
+	runes := make([]uint16, len(b)/2)
+	for i := range runes {
+		runes[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(runes))
+}
+
+func probeSquashfs(r io.ReaderAt) *blkInfo {
+	// struct squashfs_super_block at fs/squashfs/squashfs_fs.h
+	const (
+		squashfsMagic              = "hsqs"
+		squashfsVersionMajorOffset = 0x1c
+	)
+
+	buff := make([]byte, 4)
+	if _, err := r.ReadAt(buff, 0); err != nil {
+		return nil
+	}
+	if string(buff) != squashfsMagic {
+		return nil
+	}
+	if _, err := r.ReadAt(buff[:2], squashfsVersionMajorOffset); err != nil {
+		return nil
+	}
+	if version := binary.LittleEndian.Uint16(buff); version != 4 {
+		debug("squashfs version %d is not supported", version)
+		return nil
+	}
+	// squashfs has neither UUID nor label
+	return &blkInfo{format: "squashfs", isFs: true}
+}
+
+// probeIso9660 detects ISO 9660 filesystem of live media. The volume has no UUID, blkid uses the modification date
+// (or the creation date if the former is not set) instead, e.g. 2024-01-01-12-00-00-00. The digits of the date are stored
+// as the uuid so uuid.toString() prints them without dashes. The Joliet volume identifier takes precedence over
+// the primary one as it is not limited to upper-case characters.
+func probeIso9660(r io.ReaderAt) *blkInfo {
+	const (
+		isoDescriptorsOffset  = 0x8000 // the descriptors start at sector 16
+		isoSectorSize         = 2048
+		isoMaxDescriptors     = 32
+		isoMagic              = "CD001"
+		isoTypePrimary        = 1
+		isoTypeSupplementary  = 2
+		isoTypeTerminator     = 255
+		isoVolumeIdOffset     = 40
+		isoVolumeIdLength     = 32
+		isoEscapesOffset      = 88
+		isoCreationDateOffset = 813
+		isoModifiedDateOffset = 830
+		isoDateDigits         = 16
+	)
+
+	var info *blkInfo
+	var jolietLabel string
+	desc := make([]byte, isoSectorSize)
+	for i := 0; i < isoMaxDescriptors; i++ {
+		if _, err := r.ReadAt(desc, isoDescriptorsOffset+int64(i)*isoSectorSize); err != nil {
+			break
+		}
+		if string(desc[1:1+len(isoMagic)]) != isoMagic {
+			break
+		}
+		volumeId := desc[isoVolumeIdOffset : isoVolumeIdOffset+isoVolumeIdLength]
+		switch desc[0] {
+		case isoTypePrimary:
+			info = &blkInfo{format: "iso9660", isFs: true, label: string(bytes.TrimRight(volumeId, " \x00"))}
+			for _, offset := range []int{isoModifiedDateOffset, isoCreationDateOffset} {
+				if id := isoDateId(desc[offset : offset+isoDateDigits]); id != nil {
+					info.uuid = id
+					break
+				}
+			}
+		case isoTypeSupplementary:
+			// Joliet escape sequences for UCS-2 levels 1-3
+			escapes := string(desc[isoEscapesOffset : isoEscapesOffset+3])
+			if escapes == "%/@" || escapes == "%/C" || escapes == "%/E" {
+				name := make([]uint16, len(volumeId)/2)
+				for j := range name {
+					name[j] = binary.BigEndian.Uint16(volumeId[2*j:])
+				}
+				jolietLabel = strings.TrimRight(string(utf16.Decode(name)), " \x00")
+			}
+		}
+		if desc[0] == isoTypeTerminator {
+			break
+		}
+	}
+	if info != nil && jolietLabel != "" {
+		info.label = jolietLabel
+	}
+	return info
+}
+
+// isoDateId converts the digits of an ISO 9660 date (YYYYMMDDHHMMSScc) to an id, an unset date returns nil
+func isoDateId(date []byte) UUID {
+	if len(bytes.Trim(date, "0\x00")) == 0 {
+		return nil
+	}
+	for _, c := range date {
+		if c < '0' || c > '9' {
+			return nil
+		}
+	}
+	id, _ := hex.DecodeString(string(date))
+	return id
 }
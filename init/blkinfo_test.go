@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"hash/crc32"
 	"os"
 	"os/exec"
+	"reflect"
 	"strings"
 	"testing"
+	"unicode/utf16"
 )
 
 func check(t *testing.T, name, fstype, uuidStr, label string, size int64, script string) {
@@ -47,6 +52,8 @@ func check(t *testing.T, name, fstype, uuidStr, label string, size int64, script
 	var uuid []byte
 	if fstype == "mbr" {
 		uuid, err = hex.DecodeString(uuidStr)
+	} else if fstype == "exfat" || fstype == "ntfs" || fstype == "iso9660" {
+		uuid, err = parseFsSerial(uuidStr)
 	} else {
 		uuid, err = parseUUID(uuidStr)
 	}
@@ -86,4 +93,344 @@ func TestBlkInfo(t *testing.T) {
 	check(t, "luks2", "luks", "51df71ed-8e4a-4a7a-956d-b782706a52d1", "bazz", 10, "cryptsetup luksFormat -q --type=luks2 --iter-time=1 --uuid=$UUID --label=$LABEL $OUTPUT <<< 'tetspassphrase'")
 	check(t, "gpt", "gpt", "c26fcabe-8010-4bff-a066-8c73e76dbb32", "", 1, "fdisk $OUTPUT <<< 'g\nx\ni\n$UUID\nr\nw\n'")
 	check(t, "mbr", "mbr", "2beab180", "", 1, "fdisk $OUTPUT <<< 'o\nx\ni\n0x$UUID\nr\nw\n'")
+	check(t, "exfat", "exfat", "5D2A-1C3B", "DataVol", 10, "serial=$UUID; mkfs.exfat -L $LABEL --volume-serial=0x${serial/-/} $OUTPUT")
+	check(t, "exfat_unicode", "exfat", "5D2A-1C3C", "Données", 10, "serial=$UUID; mkfs.exfat -L $LABEL --volume-serial=0x${serial/-/} $OUTPUT")
+	check(t, "ntfs", "ntfs", "2C6E1D5A7F3B9E41", "WindowsData", 10, "mkntfs -F -Q -L $LABEL $OUTPUT && ntfslabel --new-serial=$UUID $OUTPUT")
+	check(t, "iso9660", "iso9660", "2024-01-01-12-00-00-00", "ARCH_202401", 1, "uuid=$UUID; mkdir -p assets/iso_root; xorriso -as mkisofs --modification-date=${uuid//-/} -V $LABEL -o $OUTPUT assets/iso_root")
+	check(t, "iso9660_joliet", "iso9660", "2024-01-02-12-00-00-00", "Live Medium", 1, "uuid=$UUID; mkdir -p assets/iso_root; xorriso -as mkisofs -J --modification-date=${uuid//-/} -V '$LABEL' -o $OUTPUT assets/iso_root")
+	check(t, "ntfs_unicode", "ntfs", "2C6E1D5A7F3B9E42", "Système", 10, "mkntfs -F -Q -L $LABEL $OUTPUT && ntfslabel --new-serial=$UUID $OUTPUT")
+}
+
+// craftGptImage creates an in-memory disk image with a GPT table that contains the given partitions.
+// Note that gptGuid() mixed-endian conversion is symmetric and used here to encode GUIDs.
+func craftGptImage(diskUuid UUID, partitions []gptPart) []byte {
+	const (
+		entrySize   = 128
+		entriesNum  = 128
+		entriesLba  = 2
+		imageLength = (entriesLba + entriesNum*entrySize/512) * 512
+	)
+
+	img := make([]byte, imageLength)
+	copy(img[0x200:], "EFI PART")
+	copy(img[0x200+0x38:], gptGuid(diskUuid))
+	binary.LittleEndian.PutUint64(img[0x200+0x48:], entriesLba)
+	binary.LittleEndian.PutUint32(img[0x200+0x50:], entriesNum)
+	binary.LittleEndian.PutUint32(img[0x200+0x54:], entrySize)
+
+	for _, p := range partitions {
+		entry := img[entriesLba*512+p.num*entrySize:]
+		copy(entry[0x0:], gptGuid(p.typeGuid))
+		copy(entry[0x10:], gptGuid(p.uuid))
+		binary.LittleEndian.PutUint64(entry[0x30:], p.attributes)
+		for i, r := range utf16.Encode([]rune(p.name)) {
+			binary.LittleEndian.PutUint16(entry[0x38+2*i:], r)
+		}
+	}
+
+	return img
+}
+
+func TestGptPartitions(t *testing.T) {
+	diskUuid, _ := parseUUID("c26fcabe-8010-4bff-a066-8c73e76dbb32")
+	linuxFs, _ := parseUUID("0fc63daf-8483-4772-8e79-3d69d8477de4")
+	esp, _ := parseUUID("c12a7328-f81f-11d2-ba4b-00a0c93ec93b")
+	uuid1, _ := parseUUID("9e5bdbd0-3a2c-4f77-8c1b-b58e4c1f0a6d")
+	uuid2, _ := parseUUID("1705d91e-bf54-4a1a-878d-721d7233eba4")
+
+	partitions := []gptPart{
+		{num: 0, typeGuid: esp, uuid: uuid1, name: "EFI system partition"},
+		{num: 2, typeGuid: linuxFs, uuid: uuid2, attributes: gptAttrReadOnly, name: "root-b"},
+	}
+	img := craftGptImage(diskUuid, partitions)
+
+	info := probeGpt(bytes.NewReader(img))
+	if info == nil {
+		t.Fatal("unable to detect gpt")
+	}
+	if !bytes.Equal(info.uuid, diskUuid) {
+		t.Fatalf("gpt uuid = %v, want %v", info.uuid.toString(), diskUuid.toString())
+	}
+	if !reflect.DeepEqual(info.data.([]gptPart), partitions) {
+		t.Fatalf("gpt partitions = %+v, want %+v", info.data, partitions)
+	}
+}
+
+func TestBcache(t *testing.T) {
+	check := func(version uint64, backing bool) {
+		uuid, _ := parseUUID("9e5bdbd0-3a2c-4f77-8c1b-b58e4c1f0a6d")
+		setUuid, _ := parseUUID("1705d91e-bf54-4a1a-878d-721d7233eba4")
+
+		img := make([]byte, 0x2000)
+		sb := img[0x1000:]
+		binary.LittleEndian.PutUint64(sb[0x10:], version)
+		copy(sb[0x18:], "\xc6\x85\x73\xf6\x4e\x1a\x45\xca\x82\x65\xf5\x7f\x48\xba\x6d\x81")
+		copy(sb[0x28:], uuid)
+		copy(sb[0x38:], setUuid)
+		copy(sb[0x48:], "bcachelabel")
+
+		info := probeBcache(bytes.NewReader(img))
+		if info == nil {
+			t.Fatalf("version %d: unable to detect bcache", version)
+		}
+		if info.format != "bcache" || info.isFs {
+			t.Fatalf("version %d: unexpected format %s", version, info.format)
+		}
+		if !bytes.Equal(info.uuid, uuid) {
+			t.Fatalf("bcache uuid = %v, want %v", info.uuid.toString(), uuid.toString())
+		}
+		if info.label != "bcachelabel" {
+			t.Fatalf("bcache label = %s, want bcachelabel", info.label)
+		}
+		data := info.data.(bcacheData)
+		if data.backing != backing {
+			t.Fatalf("version %d: backing = %v, want %v", version, data.backing, backing)
+		}
+		if !bytes.Equal(data.setUuid, setUuid) {
+			t.Fatalf("bcache set uuid = %v, want %v", data.setUuid.toString(), setUuid.toString())
+		}
+	}
+
+	check(0, false)
+	check(1, true)
+	check(3, false)
+	check(4, true)
+
+	if probeBcache(bytes.NewReader(make([]byte, 0x2000))) != nil {
+		t.Fatal("bcache detected at an empty image")
+	}
+}
+
+func TestLvm(t *testing.T) {
+	const pvUuid = "ufn3G8dI4dZ3LYbdTX6AcWo1sZ0aZgjU"
+
+	img := make([]byte, 0x1000)
+	label := img[0x200:] // pvcreate puts the label to the second sector
+	copy(label, "LABELONE")
+	binary.LittleEndian.PutUint64(label[0x8:], 1)
+	binary.LittleEndian.PutUint32(label[0x14:], 0x20)
+	copy(label[0x18:], "LVM2 001")
+	copy(label[0x20:], pvUuid)
+
+	info := probeLvm(bytes.NewReader(img))
+	if info == nil {
+		t.Fatal("unable to detect LVM physical volume")
+	}
+	if info.format != "lvm" || info.isFs {
+		t.Fatalf("unexpected format %s", info.format)
+	}
+	if data := info.data.(lvmData); data.pvUuid != pvUuid {
+		t.Fatalf("pv uuid = %s, want %s", data.pvUuid, pvUuid)
+	}
+
+	if probeLvm(bytes.NewReader(make([]byte, 0x1000))) != nil {
+		t.Fatal("empty image detected as LVM physical volume")
+	}
+}
+
+func TestSquashfs(t *testing.T) {
+	img := make([]byte, 0x1000)
+	copy(img, "hsqs")
+	binary.LittleEndian.PutUint16(img[0x1c:], 4)
+
+	info := probeSquashfs(bytes.NewReader(img))
+	if info == nil {
+		t.Fatal("unable to detect squashfs")
+	}
+	if info.format != "squashfs" || !info.isFs {
+		t.Fatalf("unexpected format %s", info.format)
+	}
+
+	binary.LittleEndian.PutUint16(img[0x1c:], 3)
+	if probeSquashfs(bytes.NewReader(img)) != nil {
+		t.Fatal("squashfs version 3 is not expected to be detected")
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	sb := make([]byte, 4096)
+	copy(sb, "integrt\x00")
+	sb[0x8] = 5 // version
+	binary.LittleEndian.PutUint16(sb[0xa:], 4)
+	binary.LittleEndian.PutUint32(sb[0xc:], 8)
+	binary.LittleEndian.PutUint64(sb[0x10:], 200000)
+	binary.LittleEndian.PutUint32(sb[0x18:], 0x8)
+	sb[0x1c] = 3
+
+	info := probeIntegrity(bytes.NewReader(sb))
+	if info == nil {
+		t.Fatal("unable to detect dm-integrity")
+	}
+	if info.format != "integrity" || info.isFs {
+		t.Fatalf("unexpected format %s", info.format)
+	}
+	expected := integrityData{tagSize: 4, providedDataSectors: 200000, flags: 0x8, sectorsPerBlockLog2: 3}
+	if info.data.(integrityData) != expected {
+		t.Fatalf("dm-integrity data = %+v, want %+v", info.data, expected)
+	}
+
+	if probeIntegrity(bytes.NewReader(make([]byte, 4096))) != nil {
+		t.Fatal("dm-integrity detected at an empty image")
+	}
+}
+
+func TestVerity(t *testing.T) {
+	sb := make([]byte, 4096)
+	copy(sb, "verity\x00\x00")
+	binary.LittleEndian.PutUint32(sb[0x8:], 1) // version
+	binary.LittleEndian.PutUint32(sb[0xc:], 1) // hash type
+	copy(sb[0x10:], []byte{0x8a, 0x3f, 0x5c, 0x12, 0x6b, 0x4e, 0x4d, 0x0a, 0x9c, 0x1f, 0x2e, 0x3d, 0x4c, 0x5b, 0x6a, 0x79})
+	copy(sb[0x20:], "sha256")
+	binary.LittleEndian.PutUint32(sb[0x40:], 4096)
+	binary.LittleEndian.PutUint32(sb[0x44:], 4096)
+	binary.LittleEndian.PutUint64(sb[0x48:], 25600)
+	binary.LittleEndian.PutUint16(sb[0x50:], 4)
+	copy(sb[0x58:], []byte{1, 2, 3, 4})
+
+	info := probeVerity(bytes.NewReader(sb))
+	if info == nil {
+		t.Fatal("unable to detect dm-verity hash device")
+	}
+	if info.format != "verity" || info.isFs {
+		t.Fatalf("unexpected format %s", info.format)
+	}
+	if info.uuid.toString() != "8a3f5c12-6b4e-4d0a-9c1f-2e3d4c5b6a79" {
+		t.Fatalf("unexpected uuid %s", info.uuid.toString())
+	}
+	expected := verityData{hashType: 1, algorithm: "sha256", dataBlockSize: 4096, hashBlockSize: 4096, dataBlocks: 25600, salt: []byte{1, 2, 3, 4}}
+	if !reflect.DeepEqual(info.data.(verityData), expected) {
+		t.Fatalf("dm-verity data = %+v, want %+v", info.data, expected)
+	}
+
+	binary.LittleEndian.PutUint32(sb[0x8:], 2)
+	if probeVerity(bytes.NewReader(sb)) != nil {
+		t.Fatal("dm-verity superblock of unknown version detected")
+	}
+	if probeVerity(bytes.NewReader(make([]byte, 4096))) != nil {
+		t.Fatal("dm-verity detected at an empty image")
+	}
+}
+
+func TestBtrfsMultiDevice(t *testing.T) {
+	uuid, _ := parseUUID("1884e1eb-186f-4b1b-af11-45ea80da8e3c")
+
+	member := func(devId uint64) []byte {
+		img := make([]byte, 0x11000)
+		sb := img[0x10000:]
+		copy(sb[0x40:], "_BHRfS_M")
+		binary.LittleEndian.PutUint64(sb[0x88:], 3)
+		binary.LittleEndian.PutUint64(sb[0xc9:], devId)
+		copy(sb[0x11b:], uuid)
+		copy(sb[0x12b:], "raid")
+		return img
+	}
+
+	info := probeBtrfs(bytes.NewReader(member(2)))
+	if info == nil {
+		t.Fatal("unable to detect btrfs")
+	}
+	if !bytes.Equal(info.uuid, uuid) || info.label != "raid" {
+		t.Fatalf("unexpected btrfs uuid %s or label %s", info.uuid.toString(), info.label)
+	}
+	data := info.data.(btrfsData)
+	if data.numDevices != 3 || data.devId != 2 {
+		t.Fatalf("btrfs data = %+v, want 3 devices and devid 2", data)
+	}
+
+	defer func() { btrfsMembers = map[string]map[uint64]string{} }()
+	btrfsMembers[uuid.toString()] = map[uint64]string{2: "/dev/sdb1"}
+	if missing := btrfsMissingMembers(info); !reflect.DeepEqual(missing, []uint64{1, 3}) {
+		t.Fatalf("missing members = %v, want [1 3]", missing)
+	}
+	btrfsMembers[uuid.toString()][1] = "/dev/sda1"
+	btrfsMembers[uuid.toString()][3] = "/dev/sdc1"
+	if missing := btrfsMissingMembers(info); missing != nil {
+		t.Fatalf("missing members = %v, want none", missing)
+	}
+	if present := btrfsPresentMembers(info); !reflect.DeepEqual(present, []string{"/dev/sda1", "/dev/sdb1", "/dev/sdc1"}) {
+		t.Fatalf("present members = %v", present)
+	}
+
+	// a member counts once the kernel has registered it
+	defer func() { btrfsScanDevice = scanBtrfsDevice }()
+	btrfsMembers = map[string]map[uint64]string{}
+	info.path = "/dev/sdb1"
+	btrfsScanDevice = func(path string) error {
+		if missing := btrfsMissingMembers(info); !reflect.DeepEqual(missing, []uint64{1, 2, 3}) {
+			t.Fatalf("%s counts as registered before the scan is done, missing members = %v", path, missing)
+		}
+		return errors.New("btrfs: unable to scan device " + path)
+	}
+	if err := registerBtrfsDevice(info); err == nil {
+		t.Fatal("expected the scan error")
+	}
+	if missing := btrfsMissingMembers(info); !reflect.DeepEqual(missing, []uint64{1, 2, 3}) {
+		t.Fatalf("a device that failed to register counts as a member, missing members = %v", missing)
+	}
+	btrfsScanDevice = func(string) error { return nil }
+	if err := registerBtrfsDevice(info); err != nil {
+		t.Fatal(err)
+	}
+	if missing := btrfsMissingMembers(info); !reflect.DeepEqual(missing, []uint64{1, 3}) {
+		t.Fatalf("missing members = %v, want [1 3]", missing)
+	}
+}
+
+func TestUpdateGptAttributes(t *testing.T) {
+	linuxFs, _ := parseUUID("0fc63daf-8483-4772-8e79-3d69d8477de4")
+	uuid1, _ := parseUUID("9e5bdbd0-3a2c-4f77-8c1b-b58e4c1f0a6d")
+	uuid2, _ := parseUUID("1705d91e-bf54-4a1a-878d-721d7233eba4")
+	partitions := []gptPart{
+		{num: 0, typeGuid: linuxFs, uuid: uuid1, attributes: gptAttrFactoryReset, name: "data"},
+		{num: 1, typeGuid: linuxFs, uuid: uuid2, attributes: gptAttrFactoryReset | gptAttrReadOnly, name: "root"},
+	}
+	primary := craftGptImage(uuid1, partitions)
+
+	// the backup table is a copy of the primary one at the end of the disk: the entries followed by the header
+	backupLba := uint64(len(primary)/512 + 32)
+	binary.LittleEndian.PutUint32(primary[0x200+0xc:], 0x5c)
+	binary.LittleEndian.PutUint64(primary[0x200+0x20:], backupLba)
+	img := append(primary, primary[2*512:]...)
+	img = append(img, primary[0x200:0x400]...)
+	binary.LittleEndian.PutUint64(img[backupLba*512+0x48:], uint64(len(primary)/512))
+
+	disk := t.TempDir() + "/disk.img"
+	if err := os.WriteFile(disk, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	clear := func(attrs uint64) uint64 { return attrs &^ gptAttrFactoryReset }
+	if err := updateGptAttributes(disk, 1, clear); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := os.ReadFile(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := probeGpt(bytes.NewReader(img))
+	if info == nil {
+		t.Fatal("unable to detect gpt")
+	}
+	parts := info.data.([]gptPart)
+	if parts[0].attributes != gptAttrFactoryReset || parts[1].attributes != gptAttrReadOnly {
+		t.Fatalf("unexpected attributes 0x%x 0x%x", parts[0].attributes, parts[1].attributes)
+	}
+
+	for _, lba := range []uint64{1, backupLba} {
+		header := append([]byte(nil), img[lba*512:lba*512+0x5c]...)
+		entriesOffset := binary.LittleEndian.Uint64(header[0x48:]) * 512
+		entries := img[entriesOffset : entriesOffset+128*128]
+		if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[0x58:]) {
+			t.Fatalf("invalid partition entries checksum of the table at LBA %d", lba)
+		}
+		if attr := binary.LittleEndian.Uint64(entries[128+0x30:]); attr != gptAttrReadOnly {
+			t.Fatalf("attribute is not cleared in the table at LBA %d: 0x%x", lba, attr)
+		}
+
+		crc := binary.LittleEndian.Uint32(header[0x10:])
+		binary.LittleEndian.PutUint32(header[0x10:], 0)
+		if crc32.ChecksumIEEE(header) != crc {
+			t.Fatalf("invalid header checksum of the table at LBA %d", lba)
+		}
+	}
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// bondMemberTimeout is the time to wait for the member interfaces once the first of them appears.
+// The bond is started degraded if some of the members are still missing.
+const bondMemberTimeout = 10 * time.Second
+
+var bondModes = []string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}
+
+// bondConfig is a bonded interface specified with bond= boot param
+type bondConfig struct {
+	name    string
+	members []string
+	mode    string
+	options []string // bonding driver options other than mode, e.g. miimon=100
+	mtu     int
+	once    sync.Once
+}
+
+var bondConfigs []*bondConfig // specified with bond= boot params
+
+// parseBondParam parses bond=<bondname>[:<members>[:<options>[:<mtu>]]] boot param in the dracut format,
+// e.g. bond=bond0:eth0,eth1:mode=active-backup,miimon=100. Members are comma-separated interface names
+// and the options are the bonding driver options.
+func parseBondParam(param string) (*bondConfig, error) {
+	fields := strings.Split(param, ":")
+	if len(fields) > 4 {
+		return nil, fmt.Errorf("expected format is bond=<bondname>[:<members>[:<options>[:<mtu>]]]")
+	}
+	b := &bondConfig{name: fields[0], mode: "balance-rr"}
+	if b.name == "" {
+		return nil, fmt.Errorf("bond name is not specified")
+	}
+
+	if len(fields) > 1 && fields[1] != "" {
+		b.members = strings.Split(fields[1], ",")
+	} else {
+		// the same default as dracut uses
+		b.members = []string{"eth0", "eth1"}
+	}
+	for _, m := range b.members {
+		if m == "" || m == b.name {
+			return nil, fmt.Errorf("invalid member interface '%s'", m)
+		}
+	}
+
+	if len(fields) > 2 && fields[2] != "" {
+		for _, o := range strings.Split(fields[2], ",") {
+			idx := strings.IndexByte(o, '=')
+			if idx < 1 {
+				return nil, fmt.Errorf("invalid bonding option '%s', expected <name>=<value>", o)
+			}
+			if o[:idx] == "mode" {
+				mode, err := parseBondMode(o[idx+1:])
+				if err != nil {
+					return nil, err
+				}
+				b.mode = mode
+				continue
+			}
+			b.options = append(b.options, o)
+		}
+	}
+
+	if len(fields) > 3 {
+		mtu, err := parseMtu(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		b.mtu = mtu
+	}
+	return b, nil
+}
+
+// parseBondMode parses bonding mode specified either by name or by its number
+func parseBondMode(mode string) (string, error) {
+	if n, err := strconv.Atoi(mode); err == nil && n >= 0 && n < len(bondModes) {
+		return bondModes[n], nil
+	}
+	for _, m := range bondModes {
+		if m == mode {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown bonding mode %s, expected one of %s", mode, strings.Join(bondModes, ", "))
+}
+
+// bondFor returns the bond the interface is a member of, or nil
+func bondFor(ifname string) *bondConfig {
+	for _, b := range bondConfigs {
+		for _, m := range b.members {
+			if m == ifname {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+func isBondName(ifname string) bool {
+	for _, b := range bondConfigs {
+		if b.name == ifname {
+			return true
+		}
+	}
+	return false
+}
+
+// startBond creates the bond once the first of its members appears. The bond is configured with the ip= params
+// of the bond interface.
+func startBond(b *bondConfig) {
+	b.once.Do(func() {
+		go func() {
+			if err := setupBond(b); err != nil {
+				warning("%s: %v", b.name, err)
+				return
+			}
+			if startVlans(b.name) {
+				return
+			}
+			if err := initializeNetworkInterface(b.name); err != nil {
+				warning("unable to initialize network interface %s: %v\n", b.name, err)
+			}
+		}()
+	})
+}
+
+// setupBond creates the bond interface and enslaves the member interfaces that are present
+func setupBond(b *bondConfig) error {
+	if hasModule("bonding") {
+		loadModules("bonding").Wait()
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = b.name
+	if b.mtu != 0 {
+		attrs.MTU = b.mtu
+	}
+	bond := netlink.NewLinkBond(attrs)
+	bond.Mode = netlink.StringToBondMode(b.mode)
+	if err := netlink.LinkAdd(bond); err != nil {
+		return fmt.Errorf("unable to create bond: %v, the image might need the 'bonding' module, add it with 'modules: bonding' in booster.yaml", err)
+	}
+	link, err := netlink.LinkByName(b.name)
+	if err != nil {
+		return err
+	}
+	for _, o := range b.options {
+		idx := strings.IndexByte(o, '=')
+		file := "/sys/class/net/" + b.name + "/bonding/" + o[:idx]
+		if err := os.WriteFile(file, []byte(o[idx+1:]), 0644); err != nil {
+			warning("%s: unable to set bonding option %s: %v", b.name, o, err)
+		}
+	}
+
+	members := waitForBondMembers(b, bondMemberTimeout)
+	if len(members) == 0 {
+		return fmt.Errorf("none of the member interfaces %s appeared within %v", strings.Join(b.members, ", "), bondMemberTimeout)
+	}
+	if len(members) != len(b.members) {
+		warning("%s: starting degraded bond with members %s out of %s", b.name, strings.Join(members, ", "), strings.Join(b.members, ", "))
+	}
+	for _, m := range members {
+		member, err := netlink.LinkByName(m)
+		if err != nil {
+			return err
+		}
+		// an interface has to be down to be enslaved
+		if err := netlink.LinkSetDown(member); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMasterByIndex(member, link.Attrs().Index); err != nil {
+			return fmt.Errorf("unable to add %s to the bond: %v", m, err)
+		}
+		if err := netlink.LinkSetUp(member); err != nil {
+			return err
+		}
+		initializedIfnames = append(initializedIfnames, m)
+		debug("%s: added member interface %s", b.name, m)
+	}
+	return nil
+}
+
+// waitForBondMembers waits for the member interfaces to appear and returns the ones that are present
+func waitForBondMembers(b *bondConfig, timeout time.Duration) []string {
+	start := time.Now()
+	for {
+		var present []string
+		for _, m := range b.members {
+			if _, err := net.InterfaceByName(m); err == nil {
+				present = append(present, m)
+			}
+		}
+		if len(present) == len(b.members) || time.Since(start) > timeout {
+			return present
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBondParam(t *testing.T) {
+	check := func(param string, expected *bondConfig) {
+		b, err := parseBondParam(param)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if b.name != expected.name || b.mode != expected.mode || b.mtu != expected.mtu ||
+			!reflect.DeepEqual(b.members, expected.members) || !reflect.DeepEqual(b.options, expected.options) {
+			t.Fatalf("%s: expected %+v, got %+v", param, expected, b)
+		}
+	}
+
+	check("bond0", &bondConfig{name: "bond0", members: []string{"eth0", "eth1"}, mode: "balance-rr"})
+	check("bond0:eth0,eth1:mode=active-backup", &bondConfig{name: "bond0", members: []string{"eth0", "eth1"}, mode: "active-backup"})
+	check("bond1:enp1s0,enp2s0,enp3s0:mode=4,miimon=100,lacp_rate=fast:9000", &bondConfig{name: "bond1", members: []string{"enp1s0", "enp2s0", "enp3s0"}, mode: "802.3ad", options: []string{"miimon=100", "lacp_rate=fast"}, mtu: 9000})
+
+	for _, param := range []string{":eth0,eth1", "bond0:eth0,,eth1", "bond0:bond0", "bond0:eth0:mode=fastest", "bond0:eth0:miimon", "bond0:eth0::jumbo", "bond0:eth0:mode=1:1500:extra"} {
+		if _, err := parseBondParam(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+func TestBondFor(t *testing.T) {
+	defer func() { bondConfigs = nil }()
+
+	bondConfigs = []*bondConfig{{name: "bond0", members: []string{"eth0", "eth1"}}}
+	if b := bondFor("eth1"); b == nil || b.name != "bond0" {
+		t.Fatalf("eth1 is expected to be a member of bond0, got %v", b)
+	}
+	if b := bondFor("eth2"); b != nil {
+		t.Fatalf("eth2 is not expected to be a bond member, got %v", b)
+	}
+	if !isBondName("bond0") || isBondName("eth0") {
+		t.Fatal("unexpected bond interface check result")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+)
+
+// boot stages where rd.break boot param can stop the boot and start a debug shell
+const (
+	breakDeviceRef = "deviceref" // the device references from the command line are parsed
+	breakPreMount  = "pre-mount" // the root device is found but not mounted yet
+	breakPrePivot  = "pre-pivot" // the root filesystem is mounted, right before switching to it
+)
+
+var breakStageNames = []string{breakDeviceRef, breakPreMount, breakPrePivot}
+
+// breakStages are the stages specified with rd.break boot param
+var breakStages = map[string]bool{}
+
+// debugShells is the number of open breakpoint shells, the root timeout does not run while a shell is open
+var debugShells int32
+
+// preMountBreaks passes the rd.break=pre-mount requests of the root mount to waitForRoot. The shell runs at the main
+// goroutine and it closes the channel from the request once the shell exits.
+var preMountBreaks = make(chan chan struct{})
+
+// waitPreMountBreak asks waitForRoot to start the pre-mount debug shell and waits until the shell exits
+func waitPreMountBreak() {
+	done := make(chan struct{})
+	preMountBreaks <- done
+	<-done
+}
+
+// parseBreakStages parses a comma-separated list of rd.break stages. An empty value stops before switching to the
+// root filesystem as dracut does.
+func parseBreakStages(param string) (map[string]bool, error) {
+	stages := map[string]bool{}
+	if param == "" {
+		stages[breakPrePivot] = true
+		return stages, nil
+	}
+	for _, s := range strings.Split(param, ",") {
+		known := false
+		for _, n := range breakStageNames {
+			if s == n {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown stage %s, expected one of %s", s, strings.Join(breakStageNames, ", "))
+		}
+		stages[s] = true
+	}
+	return stages, nil
+}
+
+// breakpoint starts an interactive shell if the boot is requested to stop at the given stage.
+// The boot continues once the user exits the shell.
+func breakpoint(stage string) {
+	if !breakStages[stage] {
+		return
+	}
+	quitPlymouth() // the splash hides the shell
+
+	inform("rd.break: reached stage %s, starting a debug shell. Exit the shell to continue the boot", stage)
+	switch stage {
+	case breakDeviceRef:
+		for _, r := range cmdRoots {
+			describeDeviceRef(os.Stdout, "root", r)
+		}
+	case breakPreMount:
+		for _, l := range describeDiscoveredDevices() {
+			fmt.Println(l)
+		}
+	}
+
+	if _, err := os.Stat("/usr/bin/busybox"); os.IsNotExist(err) {
+		warning("rd.break: busybox is not available in the image, add it to 'extra_files' in booster.yaml to get the debug shell")
+		return
+	}
+	cmd := exec.Command("/usr/bin/busybox", "sh", "-I")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "PS1=booster ("+stage+")# ")
+	atomic.AddInt32(&debugShells, 1)
+	defer atomic.AddInt32(&debugShells, -1)
+	if err := cmd.Run(); err != nil {
+		warning("rd.break: debug shell: %v", err)
+	}
+}
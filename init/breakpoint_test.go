@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseBreakStages(t *testing.T) {
+	check := func(param string, expected ...string) {
+		stages, err := parseBreakStages(param)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if len(stages) != len(expected) {
+			t.Fatalf("%s: expected stages %v, got %v", param, expected, stages)
+		}
+		for _, s := range expected {
+			if !stages[s] {
+				t.Fatalf("%s: expected stage %s to be enabled", param, s)
+			}
+		}
+	}
+
+	check("", breakPrePivot)
+	check("deviceref", breakDeviceRef)
+	check("deviceref,pre-mount", breakDeviceRef, breakPreMount)
+
+	for _, param := range []string{"initqueue", "deviceref,", "pre-mount,foo"} {
+		if _, err := parseBreakStages(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
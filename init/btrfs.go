@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// btrfsMembersTimeout is the time to wait for all devices of a multi-device btrfs filesystem
+const btrfsMembersTimeout = 30 * time.Second
+
+// from include/uapi/linux/btrfs.h
+const (
+	btrfsPathNameMax = 4087
+	btrfsIocScanDev  = 0x50009404 // _IOW(BTRFS_IOCTL_MAGIC, 4, struct btrfs_ioctl_vol_args)
+)
+
+type btrfsIoctlVolArgs struct {
+	fd   int64
+	name [btrfsPathNameMax + 1]byte
+}
+
+var (
+	btrfsMembers      = map[string]map[uint64]string{} // filesystem UUID -> device id -> path of the registered device
+	btrfsMembersMutex sync.Mutex
+
+	btrfsScanDevice = scanBtrfsDevice // tests replace it
+)
+
+// registerBtrfsDevice registers a member of a multi-device btrfs filesystem with the kernel.
+// It is an equivalent of 'btrfs device scan $DEVICE'. The member counts as discovered only once the kernel knows it,
+// otherwise the root could be mounted before the last device is registered.
+func registerBtrfsDevice(info *blkInfo) error {
+	data := info.data.(btrfsData)
+	fsid := info.uuid.toString()
+
+	if err := btrfsScanDevice(info.path); err != nil {
+		return err
+	}
+
+	btrfsMembersMutex.Lock()
+	if btrfsMembers[fsid] == nil {
+		btrfsMembers[fsid] = map[uint64]string{}
+	}
+	btrfsMembers[fsid][data.devId] = info.path
+	btrfsMembersMutex.Unlock()
+
+	debug("registered device %s (devid %d) of btrfs filesystem %s", info.path, data.devId, fsid)
+	return nil
+}
+
+// scanBtrfsDevice passes the device to the kernel btrfs module with BTRFS_IOC_SCAN_DEV ioctl
+func scanBtrfsDevice(path string) error {
+	loadModules("btrfs").Wait()
+
+	ctl, err := os.OpenFile("/dev/btrfs-control", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+
+	var args btrfsIoctlVolArgs
+	copy(args.name[:btrfsPathNameMax], path)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, ctl.Fd(), btrfsIocScanDev, uintptr(unsafe.Pointer(&args))); errno != 0 {
+		return fmt.Errorf("btrfs: unable to scan device %s: %v", path, errno)
+	}
+	return nil
+}
+
+// btrfsMissingMembers returns ids of the devices of the filesystem described by info that have not been discovered yet
+func btrfsMissingMembers(info *blkInfo) []uint64 {
+	data := info.data.(btrfsData)
+
+	btrfsMembersMutex.Lock()
+	defer btrfsMembersMutex.Unlock()
+
+	members := btrfsMembers[info.uuid.toString()]
+	// device ids are not necessarily contiguous (e.g. after a device replacement), so only the number of discovered devices
+	// is reliable. The missing ids are reported as a hint.
+	if uint64(len(members)) >= data.numDevices {
+		return nil
+	}
+	var missing []uint64
+	for id := uint64(1); uint64(len(missing))+uint64(len(members)) < data.numDevices; id++ {
+		if _, ok := members[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// btrfsPresentMembers returns sorted list of discovered devices of the filesystem described by info
+func btrfsPresentMembers(info *blkInfo) []string {
+	btrfsMembersMutex.Lock()
+	defer btrfsMembersMutex.Unlock()
+
+	var paths []string
+	for _, p := range btrfsMembers[info.uuid.toString()] {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// waitForBtrfsMembers waits until all devices of a multi-device btrfs filesystem are discovered and registered
+func waitForBtrfsMembers(info *blkInfo) error {
+	timeout := time.After(btrfsMembersTimeout)
+	for {
+		missing := btrfsMissingMembers(info)
+		if len(missing) == 0 {
+			return nil
+		}
+		select {
+		case <-timeout:
+			ids := make([]string, len(missing))
+			for i, id := range missing {
+				ids[i] = fmt.Sprint(id)
+			}
+			return fmt.Errorf("btrfs filesystem %s consists of %d devices but devices with id %s did not appear, found devices: %s",
+				info.uuid.toString(), info.data.(btrfsData).numDevices, strings.Join(ids, ", "), strings.Join(btrfsPresentMembers(info), ", "))
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// btrfsSubvolOptions processes subvol= and subvolid= options of a btrfs mount options string. If both are specified then
+// subvolid wins as it is unambiguous. It returns the updated options and the selected subvolume for error reporting.
+func btrfsSubvolOptions(options string) (string, string, error) {
+	var subvol, subvolId string
+	var outOptions []string
+	for _, o := range strings.Split(options, ",") {
+		switch {
+		case strings.HasPrefix(o, "subvol="):
+			subvol = o
+		case strings.HasPrefix(o, "subvolid="):
+			subvolId = o
+			if _, err := strconv.ParseUint(strings.TrimPrefix(o, "subvolid="), 10, 64); err != nil {
+				return "", "", fmt.Errorf("invalid btrfs subvolume id %s", o)
+			}
+		case o != "":
+			outOptions = append(outOptions, o)
+		}
+	}
+
+	selected := subvol
+	if subvolId != "" {
+		if subvol != "" {
+			warning("both %s and %s are specified, using %s", subvol, subvolId, subvolId)
+		}
+		selected = subvolId
+	}
+	if selected != "" {
+		outOptions = append(outOptions, selected)
+	}
+	return strings.Join(outOptions, ","), selected, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBtrfsSubvolOptions(t *testing.T) {
+	check := func(input, options, subvol string) {
+		o, s, err := btrfsSubvolOptions(input)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if o != options {
+			t.Fatalf("%s: options expected %s, got %s", input, options, o)
+		}
+		if s != subvol {
+			t.Fatalf("%s: subvolume expected %s, got %s", input, subvol, s)
+		}
+	}
+
+	check("", "", "")
+	check("compress=zstd", "compress=zstd", "")
+	check("subvol=@", "subvol=@", "subvol=@")
+	check("subvol=@,compress=zstd:2", "compress=zstd:2,subvol=@", "subvol=@")
+	check("subvolid=256", "subvolid=256", "subvolid=256")
+	check("subvol=@,space_cache,subvolid=257", "space_cache,subvolid=257", "subvolid=257")
+
+	if _, _, err := btrfsSubvolOptions("subvolid=root"); err == nil {
+		t.Fatal("expected to fail for a non-numeric subvolid")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// cmdlineFileTimeout is the time to wait for the device with the boot params file
+	cmdlineFileTimeout  = 10 * time.Second
+	cmdlineFileMountDir = "/run/booster/cmdline"
+)
+
+// cmdlineFile is a file with extra boot params, specified with booster.cmdline_file=$DEVICE:$PATH boot param
+type cmdlineFile struct {
+	device *deviceRef
+	path   string // path of the file at the device filesystem
+}
+
+func (f *cmdlineFile) String() string {
+	return f.device.String() + ":" + f.path
+}
+
+// parseCmdlineFile parses booster.cmdline_file=$DEVICE:$PATH boot param, e.g. booster.cmdline_file=PARTLABEL=esp:/booster/cmdline.
+// The device part uses the same format as root=.
+func parseCmdlineFile(param string) (*cmdlineFile, error) {
+	ref, path, err := parseDeviceFile("booster.cmdline_file", param)
+	if err != nil {
+		return nil, err
+	}
+	return &cmdlineFile{device: ref, path: path}, nil
+}
+
+// loadCmdlineFile reads the boot params file and merges its params into cmdline. It runs before the rest of the boot
+// params are parsed thus the device is looked up by scanning the block devices directly.
+func loadCmdlineFile(param string) error {
+	f, err := parseCmdlineFile(param)
+	if err != nil {
+		return err
+	}
+
+	// load the storage drivers needed to access the device
+	if err := filepath.Walk("/sys/devices", scanSysModaliases); err != nil {
+		return err
+	}
+	info, err := findCmdlineFileDevice(f, cmdlineFileTimeout)
+	if err != nil {
+		return err
+	}
+	content, err := readDeviceFile(info, cmdlineFileMountDir, f.path)
+	if err != nil {
+		return fmt.Errorf("booster.cmdline_file %s: %v", f, err)
+	}
+	debug("read boot params from %s", f)
+	mergeCmdlineParams(string(content))
+	return nil
+}
+
+// findCmdlineFileDevice waits for a filesystem that matches the file device reference. GPT references are resolved
+// using the partition tables of the scanned disks.
+func findCmdlineFileDevice(f *cmdlineFile, timeout time.Duration) (*blkInfo, error) {
+	start := time.Now()
+	for {
+		ref := f.device
+		var devices []*blkInfo
+		entries, _ := os.ReadDir("/sys/class/block")
+		for _, e := range entries {
+			info, err := cachedProbeBlockDevice("/dev/" + e.Name())
+			if err != nil {
+				continue
+			}
+			if partitions, ok := info.data.([]gptPart); ok && info.format == "gpt" {
+				if r := ref.resolveFromGptTable(e.Name(), partitions); r != nil {
+					ref = r
+				}
+			}
+			devices = append(devices, info)
+		}
+		for _, info := range devices {
+			if info.isFs && ref.matchesBlkInfo(info) {
+				return info, nil
+			}
+		}
+
+		if time.Since(start) > timeout {
+			return nil, fmt.Errorf("booster.cmdline_file: device %s did not appear within %v", f.device, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// mergeCmdlineParams adds the params from the boot params file content to cmdline. The params specified at the kernel
+// command line take precedence. Lines starting with '#' are comments.
+func mergeCmdlineParams(content string) {
+	specified := make(map[string]bool)
+	for key := range cmdline {
+		specified[key] = true
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, part := range strings.Fields(line) {
+			key := part
+			if idx := strings.IndexByte(part, '='); idx > -1 {
+				key = part[:idx]
+			}
+			if specified[key] {
+				debug("booster.cmdline_file: %s is overridden by the kernel command line", part)
+				continue
+			}
+			addCmdlineParam(part)
+		}
+	}
+}
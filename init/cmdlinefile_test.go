@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCmdlineFile(t *testing.T) {
+	f, err := parseCmdlineFile("PARTLABEL=esp:/booster/cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.device.String() != "PARTLABEL=esp" || f.path != "/booster/cmdline" {
+		t.Fatalf("unexpected boot params file %s", f)
+	}
+
+	for _, param := range []string{"PARTLABEL=esp", "PARTLABEL=esp:/", "zfs=tank/root:/cmdline"} {
+		if _, err := parseCmdlineFile(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+func TestMergeCmdlineParams(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		moduleParams = make(map[string][]string)
+	}()
+
+	cmdline = make(map[string]string)
+	cmdlineValues = make(map[string][]string)
+	moduleParams = make(map[string][]string)
+	parseCmdlineParams("root=LABEL=rescue booster.cmdline_file=PARTLABEL=esp:/booster/cmdline quiet")
+	mergeCmdlineParams("# generated by the image builder\nroot=UUID=2a3b4c5d rootflags=subvol=@\n\nrd.luks.name=1234=root rd.luks.name=5678=home  nvme.poll_queues=2\n")
+
+	expected := map[string]string{
+		"root":                 "LABEL=rescue",
+		"booster.cmdline_file": "PARTLABEL=esp:/booster/cmdline",
+		"quiet":                "",
+		"rootflags":            "subvol=@",
+		"rd.luks.name":         "5678=home",
+		"nvme.poll_queues":     "2",
+	}
+	if !reflect.DeepEqual(cmdline, expected) {
+		t.Fatalf("expected %v, got %v", expected, cmdline)
+	}
+	if values := cmdlineParams("rd.luks.name"); !reflect.DeepEqual(values, []string{"1234=root", "5678=home"}) {
+		t.Fatalf("unexpected rd.luks.name values %v", values)
+	}
+	if values := cmdlineParams("root"); !reflect.DeepEqual(values, []string{"LABEL=rescue"}) {
+		t.Fatalf("unexpected root values %v", values)
+	}
+	if params := moduleParams["nvme"]; !reflect.DeepEqual(params, []string{"poll_queues=2"}) {
+		t.Fatalf("unexpected nvme module params %v", params)
+	}
+}
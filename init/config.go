@@ -10,25 +10,82 @@ type InitNetworkConfig struct {
 	Ip         string `yaml:",omitempty"`            // e.g. 10.0.2.15/24
 	Gateway    string `yaml:",omitempty"`            // e.g. 10.0.2.255
 	DNSServers string `yaml:"dns_servers,omitempty"` // comma-separated list of ips, e.g. 10.0.1.1,8.8.8.8
+
+	KeyServerInsecure bool `yaml:",omitempty"` // skip TLS verification of the server that serves rd.luks.keyfile
 }
 
 type VirtualConsole struct {
 	KeymapFile      string `yaml:",omitempty"`
+	DiacriticsFile  string `yaml:",omitempty"` // accent table used by the dead keys and the compose key
 	Utf             bool   `yaml:",omitempty"`
 	FontFile        string `yaml:",omitempty"`
 	FontMapFile     string `yaml:",omitempty"`
 	FontUnicodeFile string `yaml:",omitempty"`
 }
 
+// InitMount is a filesystem mounted under the new root before switching to it, e.g. a separate /var partition
+type InitMount struct {
+	Device  string // device reference in the format of the root= boot param
+	Target  string // mount point relative to the new root
+	Fstype  string `yaml:",omitempty"`       // filesystem type, detected from the device if not set
+	Options string `yaml:",omitempty"`       // comma-separated mount options, e.g. noatime,nodev
+	NoFail  bool   `yaml:"nofail,omitempty"` // a failed mount is reported but does not stop the boot
+}
+
+// InitFactoryReset is the root partition that is recreated on request, e.g. at the first boot of an appliance
+type InitFactoryReset struct {
+	Device  string // the partition specified with PARTUUID= or PARTLABEL=
+	Fstype  string // mkfs.$FSTYPE creates the filesystem
+	Options string `yaml:",omitempty"` // space-separated mkfs arguments
+}
+
+// InitCredential is a secret that init passes to the booted system as a systemd credential
+type InitCredential struct {
+	Name string
+	Url  string `yaml:",omitempty"` // fetched from the key server at boot, otherwise the credential is embedded to the image
+}
+
+// InitHook is an executable that init runs right before switching to the root
+type InitHook struct {
+	Path  string // location of the hook inside the image
+	Fatal bool   `yaml:",omitempty"` // a failed hook stops the boot, otherwise the failure is reported and the boot continues
+}
+
 type InitConfig struct {
 	Network                *InitNetworkConfig  `yaml:",omitempty"`
 	ModuleDependencies     map[string][]string `yaml:",omitempty"`
 	ModulePostDependencies map[string][]string `yaml:",omitempty"`
+	ModuleSoftDependencies map[string][]string `yaml:",omitempty"` // the soft pre-dependencies, they are listed at ModuleDependencies as well
 	ModulesForceLoad       []string            `yaml:",omitempty"`
 	ModprobeOptions        map[string]string   `yaml:",omitempty"`
 	Kernel                 string              `yaml:",omitempty"` // kernel version this image was built for
 	MountTimeout           int                 `yaml:",omitempty"` // mount timeout in seconds
 	VirtualConsole         *VirtualConsole     `yaml:",omitempty"`
+	Mounts                 []InitMount         `yaml:",omitempty"` // mounted in order after the root and /usr filesystems
+	MeasureRootPcr         *int                `yaml:",omitempty"` // TPM2 PCR extended with the identity of the mounted root
+	FactoryReset           *InitFactoryReset   `yaml:",omitempty"`
+	Credentials            []InitCredential    `yaml:",omitempty"`
+	Hooks                  []InitHook          `yaml:",omitempty"` // run in order before switching to the root
 }
 
-const initConfigPath = "/etc/booster.init.yaml"
+const (
+	initConfigPath = "/etc/booster.init.yaml"
+	// overlayInitConfigPath is the host-specific part of the config that comes with an overlay image
+	overlayInitConfigPath = "/etc/booster.overlay.yaml"
+	// keyServerCAPath is the CA bundle used to verify the server that serves rd.luks.keyfile
+	keyServerCAPath = "/etc/booster/key_server_ca.pem"
+	// wireguardConfigPath is the WireGuard tunnel config in the wg-quick format
+	wireguardConfigPath = "/etc/booster/wireguard.conf"
+	// verityPublicKeyPath is the key that verifies the signature of the roothash= boot param
+	verityPublicKeyPath = "/etc/booster/verity_key.pem"
+	// randomSeedPath is the seed generated for each image, init mixes it into the kernel RNG
+	randomSeedPath = "/etc/booster/random-seed"
+	// credentialsDir contains the credentials embedded to the image, one file per credential
+	credentialsDir = "/etc/booster/credentials"
+	// hooksDir contains the pre-pivot hooks, the file names are prefixed with the hook order
+	hooksDir = "/usr/lib/booster/hooks"
+	// udevRulesDir contains the udev rules files embedded to the image
+	udevRulesDir = "/usr/lib/booster/udev"
+	// crypttabPath is the crypttab embedded to the image, init unlocks the LUKS devices listed there
+	crypttabPath = "/etc/booster/crypttab"
+)
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeInitConfig(t *testing.T) {
+	base := InitConfig{
+		Network:                &InitNetworkConfig{Dhcp: true},
+		ModuleDependencies:     map[string][]string{"btrfs": {"libcrc32c"}},
+		ModulePostDependencies: nil,
+		ModulesForceLoad:       []string{"btrfs", "dm_crypt"},
+		ModprobeOptions:        map[string]string{"nvme": "poll_queues=2", "e1000e": "InterruptThrottleRate=1"},
+		Kernel:                 "5.12.0",
+		MountTimeout:           30,
+	}
+	overlay := InitConfig{
+		Network:          &InitNetworkConfig{Ip: "10.0.2.15/24", Gateway: "10.0.2.2"},
+		ModulesForceLoad: []string{"dm_crypt", "tpm_crb"},
+		ModprobeOptions:  map[string]string{"e1000e": "InterruptThrottleRate=3"},
+		Kernel:           "5.12.0",
+		VirtualConsole:   &VirtualConsole{KeymapFile: "/console/keymap"},
+		Mounts:           []InitMount{{Device: "LABEL=var", Target: "/var"}},
+	}
+	mergeInitConfig(&base, &overlay)
+
+	expected := InitConfig{
+		Network:            &InitNetworkConfig{Ip: "10.0.2.15/24", Gateway: "10.0.2.2"},
+		ModuleDependencies: map[string][]string{"btrfs": {"libcrc32c"}},
+		ModulesForceLoad:   []string{"btrfs", "dm_crypt", "tpm_crb"},
+		ModprobeOptions:    map[string]string{"nvme": "poll_queues=2", "e1000e": "InterruptThrottleRate=3"},
+		Kernel:             "5.12.0",
+		MountTimeout:       30,
+		VirtualConsole:     &VirtualConsole{KeymapFile: "/console/keymap"},
+		Mounts:             []InitMount{{Device: "LABEL=var", Target: "/var"}},
+	}
+	if !reflect.DeepEqual(base, expected) {
+		t.Fatalf("expected merged config %+v, got %+v", expected, base)
+	}
+}
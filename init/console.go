@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -16,8 +17,12 @@ func consoleSetFont(c *VirtualConsole) error {
 		debug("setfont parameters are not specified")
 		return nil
 	}
+	if c.FontMapFile == "" && c.FontUnicodeFile == "" {
+		return loadFont(c.FontFile)
+	}
 
-	debug("loading font file %s", c.FontFile)
+	// the console maps are loaded with setfont
+	debug("loading font file %s with setfont", c.FontFile)
 	args := []string{c.FontFile}
 	if c.FontMapFile != "" {
 		args = append(args, "-m", c.FontMapFile)
@@ -33,40 +38,119 @@ func consoleSetFont(c *VirtualConsole) error {
 	return cmd.Run()
 }
 
-func loadKmap(fd uintptr, file string) error {
-	blob, err := os.ReadFile(file)
+// loadFont sets the console font and its unicode table
+func loadFont(file string) error {
+	debug("loading font file %s", file)
+	data, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
-
-	curr := 0 // position of characters read from blob
-	if !bytes.HasPrefix(blob, []byte("bkeymap")) {
-		return fmt.Errorf("%s: is not a valid binary keymap", file)
+	font, err := parseFont(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
 	}
-	curr = 7
 
 	const (
 		// from linux/kd.h
-		KDGKBENT = 0x4B46 /* gets one entry in translation table */
-		KDSKBENT = 0x4B47 /* sets one entry in translation table */
-
-		NR_KEYS        = 128
-		MAX_NR_KEYMAPS = 256
+		KDFONTOP            = 0x4B72
+		PIO_UNIMAP          = 0x4B67
+		PIO_UNIMAPCLR       = 0x4B68
+		KD_FONT_OP_SET      = 0
+		KD_FONT_OP_SET_TALL = 4 // since Linux 6.2
+		// the kernel expects glyphs of 32 rows unless the font is set with KD_FONT_OP_SET_TALL
+		vpitch = 32
 	)
 
-	// load kmap
+	cons, err := os.OpenFile("/dev/tty0", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer cons.Close()
+
+	op := uint32(KD_FONT_OP_SET)
+	rows := vpitch
+	if font.height > vpitch {
+		op, rows = KD_FONT_OP_SET_TALL, font.height
+	}
+	pitch := (font.width + 7) / 8
+	glyphs := make([]byte, font.charCount*rows*pitch)
+	for i := 0; i < font.charCount; i++ {
+		copy(glyphs[i*rows*pitch:], font.glyphs[i*font.charSize:(i+1)*font.charSize])
+	}
+
+	fontOp := struct {
+		op, flags     uint32
+		width, height uint32
+		charcount     uint32
+		data          *byte
+	}{op: op, width: uint32(font.width), height: uint32(font.height), charcount: uint32(font.charCount), data: &glyphs[0]}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, cons.Fd(), KDFONTOP, uintptr(unsafe.Pointer(&fontOp))); errno != 0 {
+		return os.NewSyscallError(fmt.Sprintf("ioctl (cmd=0x%x)", KDFONTOP), errno)
+	}
+
+	if len(font.unicode) == 0 {
+		debug("font %s does not have a unicode table, keeping the current one", file)
+		return nil
+	}
+	var unimapInit struct{ advisedHashSize, advisedHashStep, advisedHashLevel uint16 }
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, cons.Fd(), PIO_UNIMAPCLR, uintptr(unsafe.Pointer(&unimapInit))); errno != 0 {
+		return os.NewSyscallError(fmt.Sprintf("ioctl (cmd=0x%x)", PIO_UNIMAPCLR), errno)
+	}
+	unimap := struct {
+		entryCount uint16
+		entries    *unipair
+	}{entryCount: uint16(len(font.unicode)), entries: &font.unicode[0]}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, cons.Fd(), PIO_UNIMAP, uintptr(unsafe.Pointer(&unimap))); errno != 0 {
+		return os.NewSyscallError(fmt.Sprintf("ioctl (cmd=0x%x)", PIO_UNIMAP), errno)
+	}
+	return nil
+}
+
+const (
+	// from linux/kd.h
+	KDGKBENT     = 0x4B46 /* gets one entry in translation table */
+	KDSKBENT     = 0x4B47 /* sets one entry in translation table */
+	KDSKBDIACR   = 0x4B4B /* write kernel accent table */
+	KDSKBDIACRUC = 0x4BFB /* write kernel accent table - UCS */
+	KDGKBMODE    = 0x4B44 /* gets current keyboard mode */
+	KDSKBMODE    = 0x4B45 /* sets current keyboard mode */
+
+	K_RAW       = 0x00
+	K_XLATE     = 0x01
+	K_MEDIUMRAW = 0x02
+	K_UNICODE   = 0x03
+
+	NR_KEYS        = 128
+	MAX_NR_KEYMAPS = 256
+	MAX_DIACR      = 256
+)
+
+type kbentry struct {
+	kb_table uint8
+	kb_index uint8
+	kb_value uint16
+}
+
+// parseBkeymap parses the binary keymap generated by 'loadkeys -b': the "bkeymap" magic, MAX_NR_KEYMAPS flags of
+// the keymaps present followed by NR_KEYS entries of each present keymap
+func parseBkeymap(blob []byte) ([]kbentry, error) {
+	if !bytes.HasPrefix(blob, []byte("bkeymap")) {
+		return nil, fmt.Errorf("is not a valid binary keymap")
+	}
+	curr := 7 // position of characters read from blob
+	if len(blob) < curr+MAX_NR_KEYMAPS {
+		return nil, fmt.Errorf("binary keymap is truncated")
+	}
 	keymaps := blob[curr : curr+MAX_NR_KEYMAPS]
 	curr += MAX_NR_KEYMAPS
 
+	var entries []kbentry
 	for i, enabled := range keymaps {
 		if enabled != 1 {
 			continue
 		}
-
-		type kbentry struct {
-			kb_table uint8
-			kb_index uint8
-			kb_value uint16
+		if len(blob) < curr+2*NR_KEYS {
+			return nil, fmt.Errorf("binary keymap is truncated")
 		}
 		for j := 0; j < NR_KEYS; j++ {
 			var ke kbentry
@@ -76,12 +160,111 @@ func loadKmap(fd uintptr, file string) error {
 			ke.kb_value = *(*uint16)(unsafe.Pointer(&blob[curr]))
 			curr += 2
 
-			if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, KDSKBENT, uintptr(unsafe.Pointer(&ke))); errno != 0 {
-				return os.NewSyscallError(fmt.Sprintf("ioctl (cmd=0x%x)", KDSKBENT), errno)
+			entries = append(entries, ke)
+		}
+	}
+	return entries, nil
+}
+
+// loadKmap sets the key translation tables. If the keymap cannot be loaded completely then the entries already set
+// are restored, so the console keeps its previous (the kernel default US) layout rather than a mix of two.
+func loadKmap(fd uintptr, file string) error {
+	blob, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	entries, err := parseBkeymap(blob)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	ioctl := func(cmd uintptr, ke *kbentry) error {
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, cmd, uintptr(unsafe.Pointer(ke))); errno != 0 {
+			return os.NewSyscallError(fmt.Sprintf("ioctl (cmd=0x%x)", cmd), errno)
+		}
+		return nil
+	}
+
+	var previous []kbentry
+	for _, ke := range entries {
+		old := kbentry{kb_table: ke.kb_table, kb_index: ke.kb_index}
+		err := ioctl(KDGKBENT, &old)
+		if err == nil {
+			err = ioctl(KDSKBENT, &ke)
+		}
+		if err != nil {
+			for i := len(previous) - 1; i >= 0; i-- {
+				_ = ioctl(KDSKBENT, &previous[i])
 			}
+			return err
+		}
+		previous = append(previous, old)
+	}
+
+	return nil
+}
+
+type diacritic struct {
+	diacr, base, result uint32
+}
+
+// parseDiacritics parses the accent table generated by booster, "diacr base result" lines of the character codes
+func parseDiacritics(content []byte) ([]diacritic, error) {
+	var result []diacritic
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
 		}
+		var d diacritic
+		if _, err := fmt.Sscanf(line, "%d %d %d", &d.diacr, &d.base, &d.result); err != nil {
+			return nil, fmt.Errorf("invalid accent table entry '%s'", line)
+		}
+		result = append(result, d)
+	}
+	if len(result) > MAX_DIACR {
+		return nil, fmt.Errorf("accent table has %d entries, the maximum is %d", len(result), MAX_DIACR)
+	}
+	return result, nil
+}
+
+// loadDiacritics sets the accent table used by the dead keys and the compose key
+func loadDiacritics(fd uintptr, file string, isUtf bool) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	diacritics, err := parseDiacritics(content)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
 	}
 
+	var cmd uintptr
+	var arg unsafe.Pointer
+	if isUtf {
+		var table struct {
+			kb_cnt    uint32
+			kbdiacruc [MAX_DIACR]diacritic
+		}
+		table.kb_cnt = uint32(len(diacritics))
+		copy(table.kbdiacruc[:], diacritics)
+		cmd, arg = KDSKBDIACRUC, unsafe.Pointer(&table)
+	} else {
+		var table struct {
+			kb_cnt  uint32
+			kbdiacr [MAX_DIACR]struct{ diacr, base, result uint8 }
+		}
+		table.kb_cnt = uint32(len(diacritics))
+		for i, d := range diacritics {
+			if d.diacr > 0xff || d.base > 0xff || d.result > 0xff {
+				return fmt.Errorf("%s: accent table entry %d is not an 8-bit character", file, i)
+			}
+			table.kbdiacr[i].diacr, table.kbdiacr[i].base, table.kbdiacr[i].result = uint8(d.diacr), uint8(d.base), uint8(d.result)
+		}
+		cmd, arg = KDSKBDIACR, unsafe.Pointer(&table)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, cmd, uintptr(arg)); errno != 0 {
+		return os.NewSyscallError(fmt.Sprintf("ioctl (cmd=0x%x)", cmd), errno)
+	}
 	return nil
 }
 
@@ -100,17 +283,6 @@ func consoleLoadKeymap(c *VirtualConsole) error {
 	}
 	defer cons.Close()
 
-	const (
-		// from linux/kd.h
-		KDSETMODE = 0x4B3A
-		KDGETMODE = 0x4B3B
-
-		K_RAW       = 0x00
-		K_XLATE     = 0x01
-		K_MEDIUMRAW = 0x02
-		K_UNICODE   = 0x03
-	)
-
 	var mode int
 	var ctrl string // refer 'man console_codes' for the control codes explanation
 	if isUtf {
@@ -122,24 +294,40 @@ func consoleLoadKeymap(c *VirtualConsole) error {
 		ctrl = "\033%@"
 		// stty -F ${dev} -iutf8
 	}
+	prevMode, err := unix.IoctlGetInt(int(cons.Fd()), KDGKBMODE)
+	if err != nil {
+		return err
+	}
 	// kbd_mode
-	if err := unix.IoctlSetInt(int(cons.Fd()), KDSETMODE, mode); err != nil {
+	if err := unix.IoctlSetInt(int(cons.Fd()), KDSKBMODE, mode); err != nil {
+		return err
+	}
+
+	if err := loadKmap(cons.Fd(), c.KeymapFile); err != nil {
+		_ = unix.IoctlSetInt(int(cons.Fd()), KDSKBMODE, prevMode)
 		return err
 	}
 	if _, err := cons.WriteString(ctrl); err != nil {
 		return err
 	}
 
-	return loadKmap(cons.Fd(), c.KeymapFile)
+	if c.DiacriticsFile != "" {
+		// the keys are loaded already, the kernel default accent table is kept if the keymap one fails
+		if err := loadDiacritics(cons.Fd(), c.DiacriticsFile, isUtf); err != nil {
+			warning("unable to load accent table: %v, the dead keys and the compose key might produce wrong characters", err)
+		}
+	}
+	return nil
 }
 
 func configureVirtualConsole() error {
 	if c := config.VirtualConsole; c != nil {
 		if err := consoleSetFont(c); err != nil {
-			return err
+			warning("unable to load font: %v, keeping the default font", err)
 		}
+		// a broken keymap should not prevent typing the passphrase, the US layout is still usable
 		if err := consoleLoadKeymap(c); err != nil {
-			return err
+			warning("unable to load keymap: %v, falling back to the US layout", err)
 		}
 	}
 	return nil
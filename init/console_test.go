@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBkeymap(t *testing.T) {
+	blob := append([]byte("bkeymap"), make([]byte, MAX_NR_KEYMAPS)...)
+	blob[7+0], blob[7+2] = 1, 1 // plain and altgr keymaps
+	for i := 0; i < 2*NR_KEYS; i++ {
+		blob = append(blob, byte(i), 0xf0)
+	}
+
+	entries, err := parseBkeymap(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2*NR_KEYS {
+		t.Fatalf("expected %d entries, got %d", 2*NR_KEYS, len(entries))
+	}
+	if e := entries[1]; e != (kbentry{kb_table: 0, kb_index: 1, kb_value: 0xf001}) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if e := entries[NR_KEYS+3]; e != (kbentry{kb_table: 2, kb_index: 3, kb_value: 0xf083}) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	if _, err := parseBkeymap(blob[:len(blob)-1]); err == nil || err.Error() != "binary keymap is truncated" {
+		t.Fatalf("expected truncated keymap error, got %v", err)
+	}
+	if _, err := parseBkeymap([]byte("keymap")); err == nil || err.Error() != "is not a valid binary keymap" {
+		t.Fatalf("expected invalid keymap error, got %v", err)
+	}
+}
+
+func TestParseDiacritics(t *testing.T) {
+	diacritics, err := parseDiacritics([]byte("96 97 224\n39 101 233\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []diacritic{{'`', 'a', 'à'}, {'\'', 'e', 'é'}}
+	if !reflect.DeepEqual(diacritics, expected) {
+		t.Fatalf("expected %v, got %v", expected, diacritics)
+	}
+
+	if _, err := parseDiacritics([]byte("96 a 224\n")); err == nil || err.Error() != "invalid accent table entry '96 a 224'" {
+		t.Fatalf("expected invalid entry error, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCredentialsTarget is where systemd imports the credentials passed by the initramfs from, the directory
+	// survives switch_root as /run is moved to the new root
+	defaultCredentialsTarget = "/run/credentials/@initrd"
+	credentialFetchTimeout   = 30 * time.Second
+)
+
+// credentialsTarget returns the directory the credentials are delivered to, it can be changed with
+// booster.credentials_dir boot param. Only a directory at /run survives switch_root.
+func credentialsTarget() string {
+	dir, ok := cmdline["booster.credentials_dir"]
+	if !ok {
+		return defaultCredentialsTarget
+	}
+	dir = filepath.Clean(dir)
+	if !strings.HasPrefix(dir, "/run/") {
+		warning("booster.credentials_dir: %s is not at /run and does not survive switch_root, using %s", dir, defaultCredentialsTarget)
+		return defaultCredentialsTarget
+	}
+	return dir
+}
+
+// deliverCredentials writes the configured credentials to the booted system. The values are never logged and they are
+// zeroed once written, the embedded credentials are deleted from the initramfs. A credential that cannot be read is
+// reported and skipped, it does not fail the boot.
+func deliverCredentials() {
+	if len(config.Credentials) == 0 {
+		return
+	}
+	dir := credentialsTarget()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		warning("credentials: %v", err)
+		return
+	}
+	for _, c := range config.Credentials {
+		value, err := readCredential(c)
+		if err != nil {
+			warning("credential %s: %v", c.Name, err)
+			continue
+		}
+		err = writeCredential(filepath.Join(dir, c.Name), value)
+		MemZeroBytes(value)
+		if err != nil {
+			warning("credential %s: %v", c.Name, err)
+			continue
+		}
+		debug("credential %s is delivered to %s", c.Name, dir)
+	}
+}
+
+// readCredential returns the value of the credential, the caller needs to zero it once it is used
+func readCredential(c InitCredential) ([]byte, error) {
+	if c.Url != "" {
+		return fetchLuksKey(c.Url, credentialFetchTimeout)
+	}
+
+	file := filepath.Join(credentialsDir, c.Name)
+	value, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// the initramfs content is freed at switch_root, the copy is wiped right away so it is not around until then
+	if err := os.WriteFile(file, make([]byte, len(value)), 0600); err != nil {
+		warning("%v", err)
+	}
+	if err := os.Remove(file); err != nil {
+		warning("%v", err)
+	}
+	return value, nil
+}
+
+// writeCredential writes the credential readable by root only, the same way as systemd stores them
+func writeCredential(file string, value []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0400)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
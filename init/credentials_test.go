@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWriteCredential(t *testing.T) {
+	file := t.TempDir() + "/token"
+	if err := writeCredential(file, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0400 {
+		t.Fatalf("credential is expected to be readable by root only, got %s", fi.Mode())
+	}
+
+	cmdline = map[string]string{"booster.credentials_dir": "/run/credentials/custom/"}
+	if dir := credentialsTarget(); dir != "/run/credentials/custom" {
+		t.Fatalf("unexpected credentials dir %s", dir)
+	}
+	cmdline = map[string]string{"booster.credentials_dir": "/etc/credentials"}
+	if dir := credentialsTarget(); dir != defaultCredentialsTarget {
+		t.Fatalf("a dir outside of /run is expected to be ignored, got %s", dir)
+	}
+	cmdline = nil
+}
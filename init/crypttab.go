@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// crypttabFile is the location of the embedded crypttab, tests point it elsewhere
+var crypttabFile = crypttabPath
+
+// crypttabIgnoredOptions are the crypttab(5) options that do not affect unlocking in the initramfs
+var crypttabIgnoredOptions = []string{"luks", "nofail", "initramfs", "readonly", "read-only", "x-initrd.attach"}
+
+// readCrypttab returns the LUKS devices of the embedded crypttab. rd.luks.crypttab=0 disables it the same way
+// as for systemd. The lines that booster cannot handle are reported and skipped.
+func readCrypttab() ([]*luksMapping, error) {
+	if v, ok := cmdline["rd.luks.crypttab"]; ok && (v == "0" || v == "no") {
+		return nil, nil
+	}
+	content, err := os.ReadFile(crypttabFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseCrypttab(content), nil
+}
+
+// parseCrypttab parses the crypttab(5) format, each line is "name device [keyfile [options]]". The device uses
+// the same format as root= (e.g. UUID=, PARTLABEL=, /dev/disk/by-id/...), the keyfile is either a path in the image
+// or $PATH:$DEVICE for a keyfile at another device; "-" and "none" mean no keyfile.
+func parseCrypttab(content []byte) []*luksMapping {
+	var mappings []*luksMapping
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		m, err := parseCrypttabLine(strings.Fields(line))
+		if err != nil {
+			warning("crypttab:%d: %v, skipping the line", n, err)
+			continue
+		}
+		if m != nil {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings
+}
+
+// parseCrypttabLine returns the LUKS device of the crypttab line, or nil if the device is not unlocked at boot
+func parseCrypttabLine(fields []string) (*luksMapping, error) {
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, fmt.Errorf("expected 'name device [keyfile [options]]'")
+	}
+	ref, _, err := parseLuksRef("crypttab", fields[1])
+	if err != nil {
+		return nil, err
+	}
+	m := &luksMapping{ref: ref, name: fields[0], param: fields[1]}
+
+	if len(fields) > 2 && fields[2] != "-" && fields[2] != "none" {
+		if m.keyfile, err = parseCrypttabFile("keyfile", fields[2]); err != nil {
+			return nil, err
+		}
+	}
+
+	var options []string
+	if len(fields) > 3 && fields[3] != "-" {
+		for _, o := range strings.Split(fields[3], ",") {
+			switch {
+			case o == "noauto":
+				debug("crypttab: %s is not unlocked at boot, it is marked noauto", m.name)
+				return nil, nil
+			case o == "plain" || o == "tcrypt" || o == "bitlk" || o == "swap" || o == "tmp":
+				return nil, fmt.Errorf("%s: %s devices are not supported", m.name, o)
+			case strings.HasPrefix(o, "header="):
+				if m.header, err = parseCrypttabHeader(strings.TrimPrefix(o, "header=")); err != nil {
+					return nil, err
+				}
+			case strings.HasPrefix(o, "keyfile-timeout="):
+				options = append(options, o)
+			case rdLuksOptions[o] != "":
+				options = append(options, o)
+			case isCrypttabIgnoredOption(o):
+			default:
+				debug("crypttab: %s: option %s is not supported, ignoring it", m.name, o)
+			}
+		}
+	}
+	m.options = strings.Join(options, ",")
+	return m, nil
+}
+
+func isCrypttabIgnoredOption(o string) bool {
+	for _, i := range crypttabIgnoredOptions {
+		if o == i {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCrypttabFile parses either a path in the image or $PATH:$DEVICE, the order systemd uses for the keyfile
+// and header= at crypttab
+func parseCrypttabFile(kind, value string) (*luksKeyfile, error) {
+	if !strings.HasPrefix(value, "/") {
+		return nil, fmt.Errorf("%s %s is not an absolute path", kind, value)
+	}
+	idx := strings.IndexByte(value, ':')
+	if idx == -1 {
+		return &luksKeyfile{path: filepath.Clean(value)}, nil
+	}
+	ref, path, err := parseDeviceFile("crypttab "+kind, value[idx+1:]+":"+value[:idx])
+	if err != nil {
+		return nil, err
+	}
+	return &luksKeyfile{device: ref, path: path}, nil
+}
+
+func parseCrypttabHeader(value string) (*luksHeader, error) {
+	f, err := parseCrypttabFile("header", value)
+	if err != nil {
+		return nil, err
+	}
+	return &luksHeader{device: f.device, path: f.path}, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCrypttab(t *testing.T) {
+	mappings := parseCrypttab([]byte(`# comment
+root UUID=ac8299a8-91ce-4bf6-a524-55a62844b787 none discard,luks,tpm2-device=auto
+home PARTLABEL=crypthome /etc/keys/home.key:LABEL=keystick keyfile-timeout=5s,no-read-workqueue
+data PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4 /etc/keys/data.key header=/headers/data.luks:LABEL=esp
+backup /dev/sdb1 - noauto
+swap /dev/sdc1 /dev/urandom swap
+broken
+`))
+
+	type mapping struct{ ref, name, keyfile, header, options string }
+	var got []mapping
+	for _, m := range mappings {
+		var keyfile, header string
+		if m.keyfile != nil {
+			keyfile = m.keyfile.String()
+		}
+		if m.header != nil {
+			header = m.header.String()
+		}
+		got = append(got, mapping{m.ref.String(), m.name, keyfile, header, m.options})
+	}
+	expected := []mapping{
+		{"UUID=ac8299a8-91ce-4bf6-a524-55a62844b787", "root", "", "", "discard"},
+		{"PARTLABEL=crypthome", "home", "LABEL=keystick:/etc/keys/home.key", "", "keyfile-timeout=5s,no-read-workqueue"},
+		{"PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4", "data", "/etc/keys/data.key", "LABEL=esp:/headers/data.luks", ""},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected crypttab devices %+v, got %+v", expected, got)
+	}
+}
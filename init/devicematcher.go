@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DeviceMatcher matches block devices against a device reference. It allows adding device reference formats
+// without modifying the parser, see registerDeviceMatcher.
+type DeviceMatcher interface {
+	// Matches checks whether the block device matches the reference
+	Matches(blk *blkInfo) bool
+	// ResolveGpt tries to resolve the reference to a partition device path using the partition table of
+	// device devName (e.g. "sda"). It returns false if the reference cannot be resolved with this table.
+	ResolveGpt(devName string, partitions []gptPart) (string, bool)
+}
+
+// DeviceMatcherParser parses the value of a KEY=value device reference
+type DeviceMatcherParser func(value string) (DeviceMatcher, error)
+
+var (
+	deviceMatchers      = map[string]DeviceMatcherParser{}
+	deviceMatchersMutex sync.Mutex
+)
+
+// byPathAliases maps /dev/disk/by-* paths to the equivalent KEY= reference
+var byPathAliases = map[string]string{
+	"/dev/disk/by-uuid/":      "UUID",
+	"/dev/disk/by-label/":     "LABEL",
+	"/dev/disk/by-partuuid/":  "PARTUUID",
+	"/dev/disk/by-partlabel/": "PARTLABEL",
+}
+
+// registerDeviceMatcher registers a parser for KEY=value device references. parseDeviceRef uses it for
+// references with the given key. It should be called from an init() function.
+func registerDeviceMatcher(key string, parser DeviceMatcherParser) {
+	deviceMatchersMutex.Lock()
+	defer deviceMatchersMutex.Unlock()
+
+	if _, ok := deviceMatchers[key]; ok {
+		panic(fmt.Sprintf("device matcher for %s= references is registered already", key))
+	}
+	deviceMatchers[key] = parser
+}
+
+func lookupDeviceMatcher(key string) (DeviceMatcherParser, bool) {
+	deviceMatchersMutex.Lock()
+	defer deviceMatchersMutex.Unlock()
+
+	parser, ok := deviceMatchers[key]
+	return parser, ok
+}
+
+func init() {
+	registerDeviceMatcher("UUID", func(value string) (DeviceMatcher, error) {
+		if strings.HasSuffix(value, "*") {
+			prefix, err := parseUUIDPrefix(strings.TrimSuffix(value, "*"))
+			if err != nil {
+				return nil, err
+			}
+			return &deviceRef{format: refFsUuidPrefix, data: prefix}, nil
+		}
+		value = stripQuotes(value)
+		u, err := parseUUID(value)
+		if err != nil {
+			// exFAT and NTFS filesystems are identified by a volume serial number, ISO 9660 by a date
+			serial, serialErr := parseFsSerial(value)
+			if serialErr != nil {
+				return nil, err
+			}
+			u = serial
+		}
+		return &deviceRef{format: refFsUuid, data: u}, nil
+	})
+	registerDeviceMatcher("LABEL", func(value string) (DeviceMatcher, error) {
+		return &deviceRef{format: refFsLabel, data: stripQuotes(value)}, nil
+	})
+	registerDeviceMatcher("PARTUUID", func(value string) (DeviceMatcher, error) {
+		value, offset, hasOffset, err := parsePartnroff(value)
+		if err != nil {
+			return nil, err
+		}
+		u, err := parseUUID(stripQuotes(value))
+		if err != nil {
+			return nil, err
+		}
+		if hasOffset {
+			return &deviceRef{format: refGptUuidPartoff, data: gptUuidPartoffData{u, offset}}, nil
+		}
+		return &deviceRef{format: refGptUuid, data: u}, nil
+	})
+	registerDeviceMatcher("PARTLABEL", func(value string) (DeviceMatcher, error) {
+		label, offset, hasOffset, err := parsePartnroff(value)
+		if err != nil {
+			return nil, err
+		}
+		value = label
+		// the label might be a shell-style glob, check that the pattern is well-formed
+		if _, err := filepath.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", value, err)
+		}
+		if hasOffset {
+			return &deviceRef{format: refGptLabelPartoff, data: gptLabelPartoffData{value, offset}}, nil
+		}
+		return &deviceRef{format: refGptLabel, data: value}, nil
+	})
+	registerDeviceMatcher("PARTTYPE", func(value string) (DeviceMatcher, error) {
+		u, err := parseGptType(value)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceRef{format: refGptType, data: gptTypeData{[]UUID{u}, false}}, nil
+	})
+	registerDeviceMatcher("PARTN", func(value string) (DeviceMatcher, error) {
+		num, err := parsePartNum(value)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceRef{format: refPartNum, data: partNumData{"", num}}, nil
+	})
+	registerDeviceMatcher("nbd", func(value string) (DeviceMatcher, error) {
+		data, err := parseNbdRef(value)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceRef{format: refNbd, data: *data}, nil
+	})
+	registerDeviceMatcher("ZFS", func(value string) (DeviceMatcher, error) {
+		data, err := parseZfsRef(value)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceRef{format: refZfsDataset, data: *data}, nil
+	})
+	registerDeviceMatcher("iscsi", func(value string) (DeviceMatcher, error) {
+		data, err := parseIscsiRef(value)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceRef{format: refIscsi, data: *data}, nil
+	})
+	registerDeviceMatcher("nfs", func(value string) (DeviceMatcher, error) {
+		data, err := parseNfsRef(value)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceRef{format: refNfs, data: *data}, nil
+	})
+}
+
+// Matches implements DeviceMatcher interface
+func (d *deviceRef) Matches(blk *blkInfo) bool {
+	return d.matchesBlkInfo(blk)
+}
+
+// ResolveGpt implements DeviceMatcher interface
+func (d *deviceRef) ResolveGpt(devName string, partitions []gptPart) (string, bool) {
+	ref := d.resolveFromGptTable(devName, partitions)
+	if ref == nil {
+		return "", false
+	}
+	return ref.data.(string), true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// serialMatcher is an example of an out-of-tree matcher that selects a partition by the disk serial number
+type serialMatcher struct {
+	serial string
+	part   int
+}
+
+func (m serialMatcher) Matches(blk *blkInfo) bool {
+	return blk.label == m.serial
+}
+
+func (m serialMatcher) ResolveGpt(devName string, partitions []gptPart) (string, bool) {
+	if devName != m.serial {
+		return "", false
+	}
+	for _, p := range partitions {
+		if p.num == m.part-1 {
+			return "/dev/" + calculateDevName(devName, p.num), true
+		}
+	}
+	return "", false
+}
+
+func TestDeviceMatcherRegistry(t *testing.T) {
+	registerDeviceMatcher("SERIAL", func(value string) (DeviceMatcher, error) {
+		fields := strings.Split(value, "#")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected format is SERIAL=$SERIAL#$PARTNUM")
+		}
+		num, err := parsePartNum(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return serialMatcher{fields[0], num}, nil
+	})
+	defer delete(deviceMatchers, "SERIAL")
+
+	ref, err := parseDeviceRef("root", "SERIAL=vda#2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.format != refCustom {
+		t.Fatalf("expected a custom reference, got format %d", ref.format)
+	}
+	if !ref.matchesBlkInfo(&blkInfo{label: "vda"}) || ref.matchesBlkInfo(&blkInfo{label: "vdb"}) {
+		t.Fatal("custom matcher is not used for block device matching")
+	}
+
+	partitions := []gptPart{{num: 0, name: "esp"}, {num: 1, name: "root"}}
+	resolved := ref.resolveFromGptTable("vda", partitions)
+	if resolved == nil || resolved.format != refPath || resolved.data.(string) != "/dev/vda2" {
+		t.Fatalf("expected to be resolved to /dev/vda2, got %v", resolved)
+	}
+	if ref.resolveFromGptTable("vdb", partitions) != nil {
+		t.Fatal("expected to be unresolved for vdb")
+	}
+
+	if _, err := parseDeviceRef("root", "SERIAL=vda", false); err == nil {
+		t.Fatal("expected the custom parser error to be propagated")
+	}
+	if _, err := parseDeviceRef("root", "UNKNOWN=foo", false); err == nil {
+		t.Fatal("expected to fail for an unregistered reference type")
+	}
+}
+
+func TestBuiltinDeviceMatchers(t *testing.T) {
+	var matcher DeviceMatcher
+	ref, err := parseDeviceRef("root", "PARTLABEL=root", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher = ref
+
+	path, ok := matcher.ResolveGpt("nvme0n1", []gptPart{{num: 0, name: "esp"}, {num: 1, name: "root"}})
+	if !ok || path != "/dev/nvme0n1p2" {
+		t.Fatalf("expected to be resolved to /dev/nvme0n1p2, got %s", path)
+	}
+	if matcher.Matches(&blkInfo{path: "/dev/nvme0n1p2"}) {
+		t.Fatal("gpt reference is not expected to match block devices directly")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a duplicated matcher is expected to panic")
+		}
+	}()
+	registerDeviceMatcher("UUID", nil)
+}
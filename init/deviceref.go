@@ -0,0 +1,951 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type refFormat uint8
+
+const (
+	refPath refFormat = iota
+	refFsUuid
+	refFsLabel
+	refGptUuid
+	refGptLabel
+	refPartNum
+	refDevNum
+	refFsUuidPrefix    // a short UUID prefix as printed by some tools, e.g. UUID=1705d91e*
+	refNbd             // network block device, the device appears only after connecting to the server
+	refIscsi           // iSCSI LUN, the device appears only after logging in to the target
+	refCustom          // reference handled by a matcher registered with registerDeviceMatcher
+	refGptType         // GPT partition type GUID, specified with PARTTYPE= or used for the partitions autodiscovery
+	refZfsDataset      // ZFS dataset, the pool is imported with zpool and the dataset is mounted directly without matching block devices
+	refGptLabelPartoff // GPT partition at an offset from the partition with the given label, e.g. PARTLABEL=esp/PARTNROFF=1
+	refNfs             // NFS export, it is mounted directly once the network is configured
+	refGptSlot         // A/B slot selected by the GPT attributes among the partitions matching the PARTLABEL= or PARTTYPE= reference
+	refById            // /dev/disk/by-id/ link name matched against the ids computed from sysfs, see diskIds()
+	refByPath          // /dev/disk/by-path/ link name of a disk matched against the path ids computed from sysfs, see pathIds()
+	refFsLabelGlob     // shell-style glob matched against filesystem labels, used only for booster.overlay layers
+	refGptUuidPartoff  // GPT partition at an offset from the partition with the given UUID, e.g. PARTUUID=$UUID/PARTNROFF=1
+)
+
+var refFormatNames = map[refFormat]string{
+	refPath:            "refPath",
+	refFsUuid:          "refFsUuid",
+	refFsLabel:         "refFsLabel",
+	refGptUuid:         "refGptUuid",
+	refGptLabel:        "refGptLabel",
+	refPartNum:         "refPartNum",
+	refDevNum:          "refDevNum",
+	refFsUuidPrefix:    "refFsUuidPrefix",
+	refNbd:             "refNbd",
+	refIscsi:           "refIscsi",
+	refCustom:          "refCustom",
+	refGptType:         "refGptType",
+	refZfsDataset:      "refZfsDataset",
+	refGptLabelPartoff: "refGptLabelPartoff",
+	refNfs:             "refNfs",
+	refGptSlot:         "refGptSlot",
+	refById:            "refById",
+	refByPath:          "refByPath",
+	refFsLabelGlob:     "refFsLabelGlob",
+	refGptUuidPartoff:  "refGptUuidPartoff",
+}
+
+func (f refFormat) String() string {
+	if name, ok := refFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("refFormat(%d)", uint8(f))
+}
+
+// deviceRef is a reference to a block device as specified by a user, e.g. with root= boot param
+type deviceRef struct {
+	format   refFormat
+	data     interface{} // this field depends on format
+	readOnly bool        // the reference is resolved from an autodiscovered GPT partition with the read-only attribute set
+}
+
+// partNumData is data for refPartNum reference
+type partNumData struct {
+	parent string // hint for the parent disk, either its path id (e.g. pci-0000:00:04.0) or empty string to match any disk
+	num    int    // partition number, starts from 1
+}
+
+// gptLabelPartoffData is data for refGptLabelPartoff reference
+type gptLabelPartoffData struct {
+	label  string // PARTLABEL of the base partition, might be a glob
+	offset int    // offset from the base partition number, might be negative
+}
+
+// gptUuidPartoffData is data for refGptUuidPartoff reference
+type gptUuidPartoffData struct {
+	uuid   UUID // PARTUUID of the base partition
+	offset int  // offset from the base partition number, might be negative
+}
+
+// devNumData is data for refDevNum reference
+type devNumData struct {
+	major, minor int
+}
+
+var devNumRe = regexp.MustCompile(`^(\d+):(\d+)$`)
+
+// gptTypeData is data for refGptType reference
+type gptTypeData struct {
+	types      []UUID // any of these partition types matches
+	autodetect bool   // the reference is used for autodiscovery, the Discoverable Partitions Specification attributes are honored
+}
+
+// nbdData is data for refNbd reference
+type nbdData struct {
+	host   string
+	port   int // 0 means the default NBD port
+	export string
+	hwaddr string // MAC address of the interface the host is reached through, empty means any interface
+}
+
+// iscsiData is data for refIscsi reference
+type iscsiData struct {
+	host   string
+	port   int // 0 means the default iSCSI port
+	lun    int
+	target string
+	hwaddr string // MAC address of the interface the host is reached through, empty means any interface
+}
+
+// nfsData is data for refNfs reference
+type nfsData struct {
+	host    string
+	path    string // exported directory
+	options string // NFS mount options, e.g. vers=4.2
+}
+
+// zfsData is a ZFS dataset specified with root=zfs:$POOL/$DATASET. Both fields are empty for zfs:AUTO.
+type zfsData struct {
+	pool    string
+	dataset string // full dataset name including the pool, e.g. rpool/ROOT/default
+}
+
+var zfsDatasetRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.:-]*(/[a-zA-Z0-9_.: -]+)*$`)
+
+// parseZfsRef parses the value of zfs:$DATASET reference. AUTO selects the dataset from the bootfs property of the imported pools.
+func parseZfsRef(value string) (*zfsData, error) {
+	if value == "AUTO" {
+		return &zfsData{}, nil
+	}
+	if !zfsDatasetRe.MatchString(value) {
+		return nil, fmt.Errorf("invalid ZFS dataset name %s", value)
+	}
+	pool := value
+	if idx := strings.IndexByte(value, '/'); idx != -1 {
+		pool = value[:idx]
+	}
+	return &zfsData{pool: pool, dataset: value}, nil
+}
+
+// parseNfsRef parses NFS reference in format <host>:<path>[:<options>], the options are comma-separated NFS mount options
+func parseNfsRef(param string) (*nfsData, error) {
+	host, rest, err := splitHost(param)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(rest, "/") {
+		return nil, fmt.Errorf("exported directory is not specified or is not absolute")
+	}
+	path, options := rest, ""
+	if idx := strings.IndexByte(rest, ':'); idx != -1 {
+		path, options = rest[:idx], rest[idx+1:]
+	}
+	return &nfsData{host, path, options}, nil
+}
+
+const (
+	nbdDefaultPort   = 10809
+	iscsiDefaultPort = 3260
+)
+
+var hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// hwaddrPrefixRe matches the interface selector of a network reference, e.g. 52:54:00:12:34:56@
+var hwaddrPrefixRe = regexp.MustCompile(`^((?:[[:xdigit:]]{2}:){5}[[:xdigit:]]{2})@`)
+
+// splitHwaddr splits the optional MAC address of the interface the network device is reached through
+// from a network reference, e.g. 52:54:00:12:34:56@10.0.2.2:rootfs
+func splitHwaddr(param string) (string, string) {
+	m := hwaddrPrefixRe.FindStringSubmatch(param)
+	if m == nil {
+		return "", param
+	}
+	hwaddr, _ := net.ParseMAC(m[1]) // the regexp allows only valid 6-byte addresses
+	return hwaddr.String(), param[len(m[0]):]
+}
+
+// splitHost splits a network reference into the host part and the rest of the string.
+// IPv6 addresses need to be enclosed into square brackets, e.g. [fd00::1]:export
+func splitHost(param string) (string, string, error) {
+	var host, rest string
+	if strings.HasPrefix(param, "[") {
+		end := strings.Index(param, "]")
+		if end == -1 {
+			return "", "", fmt.Errorf("missing closing bracket in %s", param)
+		}
+		host, rest = param[1:end], param[end+1:]
+		if net.ParseIP(host) == nil {
+			return "", "", fmt.Errorf("invalid IP address %s", host)
+		}
+		if rest != "" && rest[0] != ':' {
+			return "", "", fmt.Errorf("unexpected characters after IP address %s", host)
+		}
+		return host, strings.TrimPrefix(rest, ":"), nil
+	}
+
+	if idx := strings.IndexByte(param, ':'); idx != -1 {
+		host, rest = param[:idx], param[idx+1:]
+	} else {
+		host = param
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("host is not specified")
+	}
+	if net.ParseIP(host) == nil && (len(host) > 253 || !hostnameRe.MatchString(host)) {
+		return "", "", fmt.Errorf("%s is neither a valid hostname nor an IP address", host)
+	}
+	return host, rest, nil
+}
+
+// parsePort parses optional port number, empty string means the default port
+func parsePort(port string) (int, error) {
+	if port == "" {
+		return 0, nil
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port number %s", port)
+	}
+	return p, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNbdRef parses NBD reference in format [<mac>@]<host>[:<port>]:<export>
+func parseNbdRef(param string) (*nbdData, error) {
+	hwaddr, param := splitHwaddr(param)
+	host, rest, err := splitHost(param)
+	if err != nil {
+		return nil, err
+	}
+	var port int
+	export := rest
+	// the port is optional, a numeric field followed by a colon is considered as one
+	if idx := strings.IndexByte(rest, ':'); idx != -1 && isDigits(rest[:idx]) {
+		if port, err = parsePort(rest[:idx]); err != nil {
+			return nil, err
+		}
+		export = rest[idx+1:]
+	}
+	if export == "" {
+		return nil, fmt.Errorf("export name is not specified")
+	}
+	return &nbdData{host, port, export, hwaddr}, nil
+}
+
+// parseIscsiRef parses iSCSI reference in the RFC 4173 format <host>:[<protocol>]:[<port>]:[<lun>]:<targetname>,
+// optionally prefixed with <mac>@. The target name is the last field as it usually contains colons itself.
+func parseIscsiRef(param string) (*iscsiData, error) {
+	hwaddr, param := splitHwaddr(param)
+	host, rest, err := splitHost(param)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(rest, ":", 4)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("expected format is <host>:<protocol>:<port>:<lun>:<targetname>")
+	}
+	if fields[0] != "" && fields[0] != "6" {
+		return nil, fmt.Errorf("unsupported protocol %s, only TCP (6) is supported", fields[0])
+	}
+	port, err := parsePort(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	var lun int
+	if fields[2] != "" {
+		lun, err = strconv.Atoi(fields[2])
+		if err != nil || lun < 0 {
+			return nil, fmt.Errorf("invalid LUN %s", fields[2])
+		}
+	}
+	if fields[3] == "" {
+		return nil, fmt.Errorf("target name is not specified")
+	}
+	return &iscsiData{host, port, lun, fields[3], hwaddr}, nil
+}
+
+// parsePartNum parses partition number as used by PARTN= and by-path -partN references
+func parsePartNum(num string) (int, error) {
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return 0, fmt.Errorf("partition number %s is not a number", num)
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("partition number %d is invalid, numbering starts from 1", n)
+	}
+	return n, nil
+}
+
+// parseDeviceRef parses a device reference (e.g. value of root= boot param).
+// name is the boot param name and it is used for error reporting only.
+// Supported formats are /dev/XXX path, UUID=, LABEL=, PARTUUID=, PARTLABEL=, PARTN=, their /dev/disk/by-* equivalents,
+// /dev/disk/by-id/ disk ids, MAJOR:MINOR device number and nbd=/iscsi= network device references.
+// If enableAutodetect is true and param is empty then the reference points to a partition found with
+// the Discoverable Partitions Specification rules.
+func parseDeviceRef(name, param string, enableAutodetect bool) (*deviceRef, error) {
+	param, err := unquoteParam(param)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if param == "" {
+		if enableAutodetect {
+			return autodiscoveryRootRef(runtime.GOARCH), nil
+		}
+		return nil, fmt.Errorf("%s boot option is not specified", name)
+	}
+	for prefix, key := range byPathAliases {
+		if strings.HasPrefix(param, prefix) {
+			param = key + "=" + strings.TrimPrefix(param, prefix)
+			break
+		}
+	}
+	if strings.HasPrefix(param, "/dev/disk/by-path/") {
+		id := strings.TrimPrefix(param, "/dev/disk/by-path/")
+		if idx := strings.LastIndex(id, "-part"); idx != -1 {
+			num, err := parsePartNum(id[idx+5:])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid partition suffix in %s: %v", name, param, err)
+			}
+			return &deviceRef{format: refPartNum, data: partNumData{id[:idx], num}}, nil
+		}
+		if id == "" || strings.ContainsRune(id, '/') {
+			return nil, fmt.Errorf("%s: invalid disk path %s", name, param)
+		}
+		return &deviceRef{format: refByPath, data: id}, nil
+	}
+	if strings.HasPrefix(param, "/dev/disk/by-id/") {
+		ref, ok, err := parseByIdRef(strings.TrimPrefix(param, "/dev/disk/by-id/"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if ok {
+			return ref, nil
+		}
+	}
+	// nfs://$HOST/$PATH is the URL form used by DHCP root-path
+	if strings.HasPrefix(param, "nfs://") {
+		rest := strings.TrimPrefix(param, "nfs://")
+		idx := strings.IndexByte(rest, '/')
+		if idx == -1 {
+			return nil, fmt.Errorf("%s: exported directory is not specified in %s", name, param)
+		}
+		param = "nfs=" + rest[:idx] + ":" + rest[idx:]
+	}
+	// dracut-style network references use a colon as the separator
+	if strings.HasPrefix(param, "nbd:") || strings.HasPrefix(param, "iscsi:") || strings.HasPrefix(param, "nfs:") {
+		param = strings.Replace(param, ":", "=", 1)
+	}
+	// zfs:rpool/ROOT/default is the form used by the ZFS on Linux initramfs scripts
+	if strings.HasPrefix(param, "zfs:") {
+		param = "ZFS=" + strings.TrimPrefix(param, "zfs:")
+	}
+	if idx := strings.IndexByte(param, '='); idx > 0 && !strings.Contains(param[:idx], "/") {
+		key, value := param[:idx], param[idx+1:]
+		parser, ok := lookupDeviceMatcher(key)
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown device reference type %s in %s", name, key, param)
+		}
+		matcher, err := parser(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s reference %s: %v", name, key, param, err)
+		}
+		if ref, ok := matcher.(*deviceRef); ok {
+			return ref, nil
+		}
+		return &deviceRef{format: refCustom, data: matcher}, nil
+	}
+	if m := devNumRe.FindStringSubmatch(param); m != nil {
+		// the classic numeric form of the kernel root= parameter
+		major, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid major device number %s: %v", name, param, err)
+		}
+		minor, err := strconv.Atoi(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid minor device number %s: %v", name, param, err)
+		}
+		return &deviceRef{format: refDevNum, data: devNumData{major, minor}}, nil
+	}
+	if strings.HasPrefix(param, "/dev/") {
+		return &deviceRef{format: refPath, data: param}, nil
+	}
+
+	return nil, fmt.Errorf("%s: unknown device reference format %s", name, param)
+}
+
+// autodiscoveryGptTypes is a map of root partition type GUIDs from the Discoverable Partitions Specification
+// https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+// The map is keyed by runtime.GOARCH.
+var autodiscoveryGptTypes = map[string]string{
+	"386":     "44479540-f297-41b2-9af7-d131d5f0458a",
+	"amd64":   "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+	"arm":     "69dad710-2ce4-4e3c-b16c-21a1d49abed3",
+	"arm64":   "b921b045-1df0-41c3-af44-4c6f280d3fae",
+	"loong64": "77055800-792c-4f94-b39a-98c91b762bb6", // loongarch64
+	"ppc64":   "912ade1d-a839-4913-8964-a10eee08fbd2",
+	"ppc64le": "c31c45e6-3f39-412e-80fb-4809c4980599",
+	"riscv64": "72ec70a6-cf74-40e6-bd49-4bda08e8f224",
+	"s390x":   "5eead9a9-fe09-4a1e-a1d7-520d00531306",
+}
+
+// autodiscoveryUsrGptTypes is a map of /usr partition type GUIDs from the Discoverable Partitions Specification
+var autodiscoveryUsrGptTypes = map[string]string{
+	"386":     "75250d76-8cc6-458e-bd66-bd47cc81a812",
+	"amd64":   "8484680c-9521-48c6-9c11-b0720656f69e",
+	"arm":     "7d0359a3-02b3-4f0a-865c-654403e70625",
+	"arm64":   "b0e01050-ee5f-4390-949a-9101b17104e9",
+	"loong64": "e611c702-575c-4cbe-9a46-434fa0bf7e3f", // loongarch64
+	"ppc64":   "15bb03af-77e7-4d4a-b12b-c0d084f7491c",
+	"ppc64le": "ee2b9983-21e8-4153-86d9-b6901a5a1d29",
+	"riscv64": "beaec34b-8442-439b-a40b-984381ed097d",
+	"s390x":   "8a4f5770-50aa-4ed3-874a-99b710db6fea",
+}
+
+// autodiscoveryUsrRef returns a reference to the /usr partition found by its GPT type GUID.
+// It returns nil if the architecture is not known.
+func autodiscoveryUsrRef(arch string) *deviceRef {
+	guid, ok := autodiscoveryUsrGptTypes[arch]
+	if !ok {
+		debug("GPT partition autodiscovery does not know the /usr partition type for architecture %s", arch)
+		return nil
+	}
+	u, _ := parseUUID(guid)
+	return &deviceRef{format: refGptType, data: gptTypeData{[]UUID{u}, true}}
+}
+
+// autodiscoverySwapRef returns a reference to the swap partition used for resuming from hibernation when
+// booster.resume_auto boot param is specified
+func autodiscoverySwapRef() *deviceRef {
+	u, _ := parseUUID(gptTypeAliases["swap"])
+	return &deviceRef{format: refGptType, data: gptTypeData{[]UUID{u}, true}}
+}
+
+// gptTypeAliases maps human-friendly partition type names accepted by PARTTYPE= to the type GUIDs.
+// Architecture-specific types are taken from the autodiscovery tables.
+var gptTypeAliases = map[string]string{
+	"esp":        "c12a7328-f81f-11d2-ba4b-00a0c93ec93b",
+	"xbootldr":   "bc13c2ff-59e6-4262-a352-b275fd6f7172",
+	"swap":       "0657fd6d-a4ab-43c4-84e5-0933c84b4f4f",
+	"linux":      "0fc63daf-8483-4772-8e79-3d69d8477de4",
+	"linux-home": "933ac7e1-2eb4-4f13-b844-0e14e2aef915",
+	"linux-srv":  "3b8f8425-20e0-4f3b-907f-1a25a76f98e8",
+	"linux-var":  "4d21b016-b534-45c2-a9fb-5c16e091fd2d",
+	"linux-root": autodiscoveryGptTypes[runtime.GOARCH],
+	"linux-usr":  autodiscoveryUsrGptTypes[runtime.GOARCH],
+}
+
+// parseGptType parses PARTTYPE= value that is either a type GUID or one of gptTypeAliases
+func parseGptType(value string) (UUID, error) {
+	value = stripQuotes(value)
+	if guid, ok := gptTypeAliases[value]; ok {
+		if guid == "" {
+			return nil, fmt.Errorf("partition type %s is not defined for architecture %s", value, runtime.GOARCH)
+		}
+		return parseUUID(guid)
+	}
+	if u, err := parseUUID(value); err == nil {
+		return u, nil
+	}
+
+	aliases := make([]string, 0, len(gptTypeAliases))
+	for a := range gptTypeAliases {
+		aliases = append(aliases, a)
+	}
+	sort.Strings(aliases)
+	return nil, fmt.Errorf("unknown partition type %s, expected a type GUID or one of: %s", value, strings.Join(aliases, ", "))
+}
+
+// autodiscoveryRootRef returns a reference to the root partition found by its GPT type GUID.
+// If the architecture is not known then any of the known root partition types is accepted.
+func autodiscoveryRootRef(arch string) *deviceRef {
+	if guid, ok := autodiscoveryGptTypes[arch]; ok {
+		u, _ := parseUUID(guid)
+		return &deviceRef{format: refGptType, data: gptTypeData{[]UUID{u}, true}}
+	}
+
+	warning("root= boot param is not specified and GPT partition autodiscovery does not know the root partition type for architecture %s, "+
+		"using the first partition with any known root partition type", arch)
+	var types []UUID
+	for _, guid := range autodiscoveryGptTypes {
+		u, _ := parseUUID(guid)
+		types = append(types, u)
+	}
+	return &deviceRef{format: refGptType, data: gptTypeData{types, true}}
+}
+
+// unquoteParam removes quotes that wrap the whole boot param value, e.g. root='UUID=...' emitted by some GRUB configs.
+// Quotes around the reference value (e.g. LABEL="My Root") are preserved and handled by the reference parsers.
+func unquoteParam(param string) (string, error) {
+	if param == "" {
+		return param, nil
+	}
+	isQuote := func(c byte) bool { return c == '"' || c == '\'' }
+	first, last := param[0], param[len(param)-1]
+	if isQuote(first) {
+		if len(param) < 2 || last != first {
+			return "", fmt.Errorf("unbalanced quotes in %s", param)
+		}
+		return param[1 : len(param)-1], nil
+	}
+	if isQuote(last) && strings.Count(param, string(last))%2 != 0 {
+		return "", fmt.Errorf("unbalanced quotes in %s", param)
+	}
+	return param, nil
+}
+
+// parsePartnroff splits the kernel-style /PARTNROFF=$OFFSET suffix off a partition reference value,
+// e.g. esp/PARTNROFF=1. The offset is an integer and might be negative.
+func parsePartnroff(value string) (string, int, bool, error) {
+	const suffix = "/PARTNROFF="
+	idx := strings.LastIndex(value, suffix)
+	if idx == -1 {
+		return value, 0, false, nil
+	}
+	offset, err := strconv.Atoi(value[idx+len(suffix):])
+	if err != nil {
+		return "", 0, false, fmt.Errorf("invalid partition offset %s", value[idx+len(suffix):])
+	}
+	return value[:idx], offset, true, nil
+}
+
+// parseUUIDPrefix parses beginning of a UUID. Dashes are optional. It returns the prefix as a lowercase hex string.
+func parseUUIDPrefix(prefix string) (string, error) {
+	prefix = strings.ToLower(strings.ReplaceAll(prefix, "-", ""))
+	if prefix == "" {
+		return "", fmt.Errorf("prefix is empty")
+	}
+	if len(prefix) > 32 {
+		return "", fmt.Errorf("prefix is longer than UUID")
+	}
+	for _, c := range prefix {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return "", fmt.Errorf("invalid hexadecimal symbol %c", c)
+		}
+	}
+	return prefix, nil
+}
+
+// parseDeviceRefs parses a comma-separated list of device references, e.g. root=UUID=$UUID,PARTLABEL=root.
+// Each of the references is parsed independently.
+func parseDeviceRefs(name, param string, enableAutodetect bool) ([]*deviceRef, error) {
+	if param == "" {
+		ref, err := parseDeviceRef(name, param, enableAutodetect)
+		if err != nil {
+			return nil, err
+		}
+		return []*deviceRef{ref}, nil
+	}
+	var refs []*deviceRef
+	for _, p := range strings.Split(param, ",") {
+		ref, err := parseDeviceRef(name, p, false)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func (d *deviceRef) String() string {
+	switch d.format {
+	case refPath:
+		return d.data.(string)
+	case refFsUuid:
+		return "UUID=" + d.data.(UUID).toString()
+	case refFsLabel, refFsLabelGlob:
+		return "LABEL=" + d.data.(string)
+	case refFsUuidPrefix:
+		return "UUID=" + d.data.(string) + "*"
+	case refGptUuid:
+		return "PARTUUID=" + d.data.(UUID).toString()
+	case refGptLabel:
+		return "PARTLABEL=" + d.data.(string)
+	case refGptLabelPartoff:
+		data := d.data.(gptLabelPartoffData)
+		return fmt.Sprintf("PARTLABEL=%s/PARTNROFF=%d", data.label, data.offset)
+	case refGptUuidPartoff:
+		data := d.data.(gptUuidPartoffData)
+		return fmt.Sprintf("PARTUUID=%s/PARTNROFF=%d", data.uuid.toString(), data.offset)
+	case refPartNum:
+		data := d.data.(partNumData)
+		if data.parent == "" {
+			return fmt.Sprintf("PARTN=%d", data.num)
+		}
+		return fmt.Sprintf("/dev/disk/by-path/%s-part%d", data.parent, data.num)
+	case refDevNum:
+		data := d.data.(devNumData)
+		return fmt.Sprintf("%d:%d", data.major, data.minor)
+	case refNbd:
+		data := d.data.(nbdData)
+		if data.port == 0 {
+			return fmt.Sprintf("nbd=%s%s:%s", hwaddrPrefix(data.hwaddr), joinHost(data.host), data.export)
+		}
+		return fmt.Sprintf("nbd=%s%s:%d:%s", hwaddrPrefix(data.hwaddr), joinHost(data.host), data.port, data.export)
+	case refIscsi:
+		data := d.data.(iscsiData)
+		port := ""
+		if data.port != 0 {
+			port = strconv.Itoa(data.port)
+		}
+		return fmt.Sprintf("iscsi=%s%s::%s:%d:%s", hwaddrPrefix(data.hwaddr), joinHost(data.host), port, data.lun, data.target)
+	case refNfs:
+		data := d.data.(nfsData)
+		if data.options == "" {
+			return fmt.Sprintf("nfs=%s:%s", joinHost(data.host), data.path)
+		}
+		return fmt.Sprintf("nfs=%s:%s:%s", joinHost(data.host), data.path, data.options)
+	case refCustom:
+		return fmt.Sprint(d.data)
+	case refGptType:
+		data := d.data.(gptTypeData)
+		var types []string
+		for _, t := range data.types {
+			types = append(types, t.toString())
+		}
+		if data.autodetect {
+			return "autodiscovered partition (GPT type " + strings.Join(types, "|") + ")"
+		}
+		return "PARTTYPE=" + strings.Join(types, "|")
+	case refGptSlot:
+		return "A/B slot of " + d.data.(*deviceRef).String()
+	case refById:
+		return "/dev/disk/by-id/" + d.data.(string)
+	case refByPath:
+		return "/dev/disk/by-path/" + d.data.(string)
+	case refZfsDataset:
+		data := d.data.(zfsData)
+		if data.dataset == "" {
+			return "zfs:AUTO"
+		}
+		return "zfs:" + data.dataset
+	default:
+		return fmt.Sprintf("unknown device reference format %d", d.format)
+	}
+}
+
+// dependsOnGpt returns true if the reference can be resolved only with a help of a GPT partition table
+func (d *deviceRef) dependsOnGpt() bool {
+	return d.format == refGptUuid || d.format == refGptLabel || d.format == refPartNum || d.format == refGptType ||
+		d.format == refGptLabelPartoff || d.format == refGptUuidPartoff || d.format == refGptSlot
+}
+
+// isAmbiguous returns true if the reference might match several devices. Such a reference is used only if it matches
+// exactly one device. Disk ids built from serial numbers are not guaranteed to be unique, e.g. cheap USB enclosures
+// report the same serial number.
+func (d *deviceRef) isAmbiguous() bool {
+	return d.format == refFsUuidPrefix || d.format == refById && isSerialId(d.data.(string))
+}
+
+// isNetwork returns true if the referenced device is available only after a network transport is set up.
+// Such references never match local block devices and need to be attached with attachNetworkDevice,
+// NFS exports are mounted directly.
+func (d *deviceRef) isNetwork() bool {
+	return d.format == refNbd || d.format == refIscsi || d.format == refNfs
+}
+
+// isZfs returns true if the reference is a ZFS dataset that gets mounted with mountZfsRoot
+func (d *deviceRef) isZfs() bool {
+	return d.format == refZfsDataset
+}
+
+// hwaddrPrefix formats the interface selector of a network reference
+func hwaddrPrefix(hwaddr string) string {
+	if hwaddr == "" {
+		return ""
+	}
+	return hwaddr + "@"
+}
+
+// networkHwaddr returns the MAC address of the interface the network device of the reference is reached through.
+// It returns an empty string if any interface can be used.
+func (d *deviceRef) networkHwaddr() string {
+	switch d.format {
+	case refNbd:
+		return d.data.(nbdData).hwaddr
+	case refIscsi:
+		return d.data.(iscsiData).hwaddr
+	default:
+		return ""
+	}
+}
+
+// joinHost encloses IPv6 addresses into square brackets
+func joinHost(host string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// calculateDevName returns a device name for the partition of the given parent device.
+// partition is an index in the partition table that starts from 0.
+func calculateDevName(parent string, partition int) string {
+	// some drivers use 'p' prefix for the partition number, i.e. the one ending with a digit
+	last := parent[len(parent)-1]
+	if last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", parent, partition+1)
+	}
+	return fmt.Sprintf("%s%d", parent, partition+1)
+}
+
+// labelCaseInsensitive enables case-insensitive comparison of filesystem and GPT partition labels.
+// It is set with booster.label_ci boot param.
+var labelCaseInsensitive bool
+
+// labelsEqual compares two labels taking labelCaseInsensitive into account
+func labelsEqual(a, b string) bool {
+	if labelCaseInsensitive {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// labelMatches compares a label with a pattern that might be a shell-style glob
+func labelMatches(pattern, label string) bool {
+	if !hasGlobMeta(pattern) {
+		return labelsEqual(pattern, label)
+	}
+	if labelCaseInsensitive {
+		pattern, label = strings.ToLower(pattern), strings.ToLower(label)
+	}
+	match, _ := filepath.Match(pattern, label)
+	return match
+}
+
+// hasGlobMeta returns true if the pattern contains any of shell-style glob metacharacters
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// resolveFromGptTable checks if the reference is gpt-specific and if yes then tries to resolve it to
+// a device path using partition table t of device devName (e.g. "sda").
+// It returns nil if the reference cannot be resolved with this table.
+func (d *deviceRef) resolveFromGptTable(devName string, t []gptPart) *deviceRef {
+	if d.format == refCustom {
+		if path, ok := d.data.(DeviceMatcher).ResolveGpt(devName, t); ok {
+			return &deviceRef{format: refPath, data: path}
+		}
+		return nil
+	}
+
+	p := d.findGptPartition(devName, t)
+	if p == nil {
+		return nil
+	}
+	base := d
+	if d.format == refGptSlot {
+		base = d.data.(*deviceRef)
+	}
+	// per the Discoverable Partitions Specification the partition attributes apply to autodiscovered partitions
+	readOnly := base.format == refGptType && base.data.(gptTypeData).autodetect && p.attributes&gptAttrReadOnly != 0
+	return &deviceRef{format: refPath, data: "/dev/" + calculateDevName(devName, p.num), readOnly: readOnly}
+}
+
+// tableLevel is a partition table of a chain of nested tables, e.g. a disk image installed to a partition
+type tableLevel struct {
+	devName    string // the device exposing the partitions of the table, e.g. "sda" or "loop0"
+	partitions []gptPart
+}
+
+// resolveFromGptTableChain tries to resolve the gpt-specific reference with a chain of nested partition tables.
+// levels[0] is the table of the disk and every next level is the table found inside a partition of the previous one.
+// The levels are walked from the outermost one and the partition device name is calculated with the device name of
+// the level where the reference matches. A disk hint of the reference (e.g. the disk of a by-path -partN reference)
+// identifies the disk of levels[0].
+// It returns nil if the reference cannot be resolved with any of the tables.
+func (d *deviceRef) resolveFromGptTableChain(levels []tableLevel) *deviceRef {
+	ref, _ := d.resolveGptTableLevel(levels)
+	return ref
+}
+
+// resolveGptTableLevel is resolveFromGptTableChain that also returns the level the reference is resolved at
+func (d *deviceRef) resolveGptTableLevel(levels []tableLevel) (*deviceRef, *tableLevel) {
+	r := d
+	for i := range levels {
+		l := &levels[i]
+		if ref := r.resolveFromGptTable(l.devName, l.partitions); ref != nil {
+			return ref, l
+		}
+		if i == 0 && r.format == refPartNum && r.data.(partNumData).parent != "" {
+			data := r.data.(partNumData)
+			if !matchesPathId(l.devName, data.parent) {
+				return nil, nil
+			}
+			// nested tables are not disks with a hardware path, the partition is selected by its number only
+			r = &deviceRef{format: refPartNum, data: partNumData{"", data.num}}
+		}
+	}
+	return nil, nil
+}
+
+// findGptPartition returns the entry of the partition table t of device devName that matches the gpt-specific reference.
+// It returns nil if there is no such partition.
+func (d *deviceRef) findGptPartition(devName string, t []gptPart) *gptPart {
+	if !d.dependsOnGpt() {
+		return nil
+	}
+
+	if d.format == refPartNum {
+		data := d.data.(partNumData)
+		if data.parent != "" && !matchesPathId(devName, data.parent) {
+			return nil
+		}
+		for i, p := range t {
+			if p.num == data.num-1 {
+				return &t[i]
+			}
+		}
+		return nil
+	}
+
+	if d.format == refGptLabelPartoff {
+		data := d.data.(gptLabelPartoffData)
+		return findGptPartitionAtOffset(devName, t, &deviceRef{format: refGptLabel, data: data.label}, data.offset)
+	}
+
+	if d.format == refGptUuidPartoff {
+		data := d.data.(gptUuidPartoffData)
+		return findGptPartitionAtOffset(devName, t, &deviceRef{format: refGptUuid, data: data.uuid}, data.offset)
+	}
+
+	if d.format == refGptSlot {
+		p, _ := selectGptSlot(devName, t, d.data.(*deviceRef))
+		return p
+	}
+
+	// partitions are stored in the partition-number order so the first matched one wins
+	for i := range t {
+		if d.matchesGptPart(devName, &t[i]) {
+			return &t[i]
+		}
+	}
+
+	return nil
+}
+
+// findGptPartitionAtOffset returns the entry of the partition table t that is at the given offset from the partition
+// matching the base reference. It returns nil if either of the partitions does not exist.
+func findGptPartitionAtOffset(devName string, t []gptPart, base *deviceRef, offset int) *gptPart {
+	p := base.findGptPartition(devName, t)
+	if p == nil {
+		return nil
+	}
+	num := p.num + offset
+	for i := range t {
+		if t[i].num == num {
+			return &t[i]
+		}
+	}
+	debug("partition with offset %d from #%d of %s does not exist", offset, p.num+1, devName)
+	return nil
+}
+
+// matchesGptPart checks whether the partition p of device devName matches the PARTUUID=, PARTTYPE= or PARTLABEL= reference
+func (d *deviceRef) matchesGptPart(devName string, p *gptPart) bool {
+	switch d.format {
+	case refGptUuid:
+		return bytes.Equal(p.uuid, d.data.(UUID))
+	case refGptType:
+		data := d.data.(gptTypeData)
+		if data.autodetect && p.attributes&gptAttrNoAuto != 0 {
+			debug("partition #%d of %s has no-auto flag set, skipping it for autodiscovery", p.num+1, devName)
+			return false
+		}
+		for _, typ := range data.types {
+			if bytes.Equal(p.typeGuid, typ) {
+				return true
+			}
+		}
+	case refGptLabel:
+		pattern := d.data.(string)
+		if hasGlobMeta(pattern) {
+			debug("matching partition #%d '%s' of %s against PARTLABEL pattern '%s'", p.num+1, p.name, devName, pattern)
+		}
+		return labelMatches(pattern, p.name)
+	}
+	return false
+}
+
+// matchesBlkInfo checks whether the block device matches the reference
+func (d *deviceRef) matchesBlkInfo(blk *blkInfo) bool {
+	switch d.format {
+	case refPath:
+		return d.data.(string) == blk.path || udevLinkTarget(d.data.(string)) == blk.path
+	case refFsUuid:
+		return bytes.Equal(d.data.(UUID), blk.uuid)
+	case refFsLabel:
+		return labelsEqual(d.data.(string), blk.label)
+	case refFsLabelGlob:
+		return labelMatches(d.data.(string), blk.label)
+	case refFsUuidPrefix:
+		return len(blk.uuid) != 0 && strings.HasPrefix(hex.EncodeToString(blk.uuid), d.data.(string))
+	case refDevNum:
+		data := d.data.(devNumData)
+		return blk.devNo != 0 && data.major == int(unix.Major(blk.devNo)) && data.minor == int(unix.Minor(blk.devNo))
+	case refByPath:
+		id := d.data.(string)
+		// the link created by the udev rules covers the topologies pathIds() does not support
+		return matchesPathId(filepath.Base(blk.path), id) || udevLinkTarget("/dev/disk/by-path/"+id) == blk.path
+	case refPartNum:
+		// a partition of a disk selected by its path, the partition table is not needed
+		data := d.data.(partNumData)
+		return data.parent != "" && matchesPathPartition(blk.path, data.parent, data.num)
+	case refById:
+		id := d.data.(string)
+		for _, i := range blockDeviceIds(filepath.Base(blk.path)) {
+			if i == id {
+				return true
+			}
+		}
+		return false
+	case refCustom:
+		return d.data.(DeviceMatcher).Matches(blk)
+	case refNbd, refIscsi, refNfs:
+		// the device node name is known only after the transport is attached, see mountNetworkRoot()
+		return false
+	case refZfsDataset:
+		// datasets are mounted after importing the pool, see mountZfsRoot()
+		return false
+	default:
+		return false
+	}
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseDeviceRef(t *testing.T) {
+	check := func(param string, format refFormat, data interface{}) {
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if ref.format != format {
+			t.Fatalf("%s: expected format %d, got %d", param, format, ref.format)
+		}
+		switch v := data.(type) {
+		case UUID:
+			if !bytes.Equal(ref.data.(UUID), v) {
+				t.Fatalf("%s: expected data %v, got %v", param, v, ref.data)
+			}
+		case partNumData, devNumData, nbdData, iscsiData, zfsData, gptLabelPartoffData:
+			if ref.data != v {
+				t.Fatalf("%s: expected data %+v, got %+v", param, v, ref.data)
+			}
+		case gptUuidPartoffData:
+			data := ref.data.(gptUuidPartoffData)
+			if !bytes.Equal(data.uuid, v.uuid) || data.offset != v.offset {
+				t.Fatalf("%s: expected data %+v, got %+v", param, v, ref.data)
+			}
+		default:
+			if ref.data != data {
+				t.Fatalf("%s: expected data %v, got %v", param, data, ref.data)
+			}
+		}
+	}
+
+	uuid := UUID{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4}
+
+	check("/dev/sda1", refPath, "/dev/sda1")
+	check("UUID=1705d91e-bf54-4a1a-878d-721d7233eba4", refFsUuid, uuid)
+	check(`UUID="1705d91e-bf54-4a1a-878d-721d7233eba4"`, refFsUuid, uuid)
+	check("UUID=1705d91ebf544a1a878d721d7233eba4", refFsUuid, uuid)
+	check("UUID=5D2A-1C3B", refFsUuid, UUID{0x5d, 0x2a, 0x1c, 0x3b})
+	check("UUID=2C6E1D5A7F3B9E41", refFsUuid, UUID{0x2c, 0x6e, 0x1d, 0x5a, 0x7f, 0x3b, 0x9e, 0x41})
+	check("/dev/disk/by-uuid/1705d91e-bf54-4a1a-878d-721d7233eba4", refFsUuid, uuid)
+	check("UUID=1705d91e*", refFsUuidPrefix, "1705d91e")
+	check("UUID=1705D91E-BF*", refFsUuidPrefix, "1705d91ebf")
+	check("LABEL=rootfs", refFsLabel, "rootfs")
+	check("LABEL=layer-*", refFsLabel, "layer-*")
+	check("/dev/disk/by-label/rootfs", refFsLabel, "rootfs")
+	check("PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4", refGptUuid, uuid)
+	check("/dev/disk/by-partuuid/1705d91e-bf54-4a1a-878d-721d7233eba4", refGptUuid, uuid)
+	check("PARTLABEL=root", refGptLabel, "root")
+	check("PARTLABEL=root-*", refGptLabel, "root-*")
+	check("/dev/disk/by-partlabel/root-[ab]", refGptLabel, "root-[ab]")
+	check("PARTLABEL=esp/PARTNROFF=1", refGptLabelPartoff, gptLabelPartoffData{"esp", 1})
+	check("PARTLABEL=root-*/PARTNROFF=-2", refGptLabelPartoff, gptLabelPartoffData{"root-*", -2})
+	check("PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4/PARTNROFF=1", refGptUuidPartoff, gptUuidPartoffData{uuid, 1})
+	check("/dev/disk/by-partuuid/1705d91e-bf54-4a1a-878d-721d7233eba4/PARTNROFF=-1", refGptUuidPartoff, gptUuidPartoffData{uuid, -1})
+	check("PARTN=2", refPartNum, partNumData{"", 2})
+	check("/dev/disk/by-path/pci-0000:00:04.0-part12", refPartNum, partNumData{"pci-0000:00:04.0", 12})
+	check("/dev/disk/by-path/pci-0000:00:04.0", refByPath, "pci-0000:00:04.0")
+	check("/dev/disk/by-path/pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0", refByPath, "pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0")
+	check("/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", refById, "wwn-0x5000c500a1b2c3d4")
+	check("/dev/disk/by-id/nvme-eui.0025388b71b2c3d4-part2", refById, "nvme-eui.0025388b71b2c3d4-part2")
+	check("/dev/disk/by-id/usb-SanDisk_Cruzer_4C530001-0:0", refById, "usb-SanDisk_Cruzer_4C530001-0:0")
+	check("/dev/disk/by-id/dm-uuid-LVM-abc", refPath, "/dev/disk/by-id/dm-uuid-LVM-abc")
+	check("8:2", refDevNum, devNumData{8, 2})
+	check("259:0", refDevNum, devNumData{259, 0})
+	check("nbd=10.0.2.2:rootfs", refNbd, nbdData{"10.0.2.2", 0, "rootfs", ""})
+	check("nbd=nbd.example.com:10810:rootfs", refNbd, nbdData{"nbd.example.com", 10810, "rootfs", ""})
+	check("nbd:[fd00::1]:root:fs", refNbd, nbdData{"fd00::1", 0, "root:fs", ""})
+	check("nbd=52:54:00:AB:34:56@10.0.2.2:rootfs", refNbd, nbdData{"10.0.2.2", 0, "rootfs", "52:54:00:ab:34:56"})
+	check("nbd=52:54:00:12:34:56@[fd00::1]:10810:root@host", refNbd, nbdData{"fd00::1", 10810, "root@host", "52:54:00:12:34:56"})
+	check("iscsi=10.0.2.2::::iqn.2021-04.com.example:disk1", refIscsi, iscsiData{"10.0.2.2", 0, 0, "iqn.2021-04.com.example:disk1", ""})
+	check("iscsi:storage:6:3261:2:iqn.2021-04.com.example:disk1", refIscsi, iscsiData{"storage", 3261, 2, "iqn.2021-04.com.example:disk1", ""})
+	check("iscsi=52:54:00:12:34:56@storage::::iqn.2021-04.com.example:disk1", refIscsi, iscsiData{"storage", 0, 0, "iqn.2021-04.com.example:disk1", "52:54:00:12:34:56"})
+	check("nfs=10.0.2.2:/srv/root", refNfs, nfsData{"10.0.2.2", "/srv/root", ""})
+	check("nfs:[fd00::1]:/srv/root:vers=4.2,ro", refNfs, nfsData{"fd00::1", "/srv/root", "vers=4.2,ro"})
+	check("nfs://nfs.example.com/exports/node1", refNfs, nfsData{"nfs.example.com", "/exports/node1", ""})
+	check("zfs:rpool/ROOT/default", refZfsDataset, zfsData{"rpool", "rpool/ROOT/default"})
+	check("ZFS=rpool/ROOT/default", refZfsDataset, zfsData{"rpool", "rpool/ROOT/default"})
+	check("zfs:tank", refZfsDataset, zfsData{"tank", "tank"})
+	check("zfs:AUTO", refZfsDataset, zfsData{})
+
+	invalid := func(param string) {
+		if _, err := parseDeviceRef("root", param, false); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+
+	invalid("")
+	invalid("foobar")
+	invalid("UUID=1705d91e")
+	invalid("UUID=*")
+	invalid("UUID=1705x*")
+	invalid("UUID=1705d91e-bf54-4a1a-878d-721d7233eba4a*")
+	invalid("PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba")
+	invalid("PARTLABEL=root-[ab")
+	invalid("PARTLABEL=esp/PARTNROFF=")
+	invalid("PARTLABEL=esp/PARTNROFF=one")
+	invalid("PARTLABEL=esp[/PARTNROFF=1")
+	invalid("PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4/PARTNROFF=one")
+	invalid("PARTUUID=1705d91e/PARTNROFF=1")
+	invalid("PARTN=0")
+	invalid("PARTN=-1")
+	invalid("PARTN=two")
+	invalid("/dev/disk/by-path/pci-0000:00:04.0-part0")
+	invalid("zfs:")
+	invalid("zfs:/rpool")
+	invalid("zfs:rpool/ROOT/")
+	invalid("zfs:rpool@snapshot")
+	invalid("/dev/disk/by-path/pci-0000:00:04.0-partx")
+	invalid("/dev/disk/by-path/")
+	invalid("/dev/disk/by-id/ata-")
+	invalid("/dev/disk/by-id/nvme-eui.0025388b71b2c3d4/part1")
+	invalid("8:")
+	invalid("8:-1")
+	invalid("0x8:1")
+	invalid("nbd=10.0.2.2")
+	invalid("nbd=:rootfs")
+	invalid("nbd=host_name:rootfs")
+	invalid("nbd=-host:rootfs")
+	invalid("nbd=10.0.2.2:70000:rootfs")
+	invalid("nbd=[fd00::1:rootfs")
+	invalid("nbd=[not-ip]:rootfs")
+	invalid("iscsi=10.0.2.2:iqn.2021-04.com.example")
+	invalid("iscsi=10.0.2.2:17:::iqn.2021-04.com.example:disk1")
+	invalid("iscsi=10.0.2.2:::x:iqn.2021-04.com.example:disk1")
+	invalid("iscsi=10.0.2.2::::")
+	invalid("nbd=52:54:00:12:34:56@:rootfs")
+	invalid("iscsi=52-54-00-12-34-56@10.0.2.2::::iqn.2021-04.com.example:disk1")
+	invalid("nfs=10.0.2.2")
+	invalid("nfs=10.0.2.2:srv/root")
+	invalid("nfs://nfs.example.com")
+}
+
+func TestParseDeviceRefQuotes(t *testing.T) {
+	uuid := UUID{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4}
+
+	check := func(param string, format refFormat, data interface{}) {
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if ref.format != format {
+			t.Fatalf("%s: expected format %s, got %s", param, format, ref.format)
+		}
+		if u, ok := data.(UUID); ok {
+			if !bytes.Equal(ref.data.(UUID), u) {
+				t.Fatalf("%s: expected data %v, got %v", param, u, ref.data)
+			}
+		} else if ref.data != data {
+			t.Fatalf("%s: expected data %v, got %v", param, data, ref.data)
+		}
+	}
+
+	check(`'UUID=1705d91e-bf54-4a1a-878d-721d7233eba4'`, refFsUuid, uuid)
+	check(`"UUID=1705d91e-bf54-4a1a-878d-721d7233eba4"`, refFsUuid, uuid)
+	check(`UUID='1705d91e-bf54-4a1a-878d-721d7233eba4'`, refFsUuid, uuid)
+	check(`'/dev/sda1'`, refPath, "/dev/sda1")
+	check(`"PARTLABEL=root"`, refGptLabel, "root")
+	check(`LABEL="My Root"`, refFsLabel, "My Root")
+	check(`'LABEL="My Root"'`, refFsLabel, "My Root")
+
+	unbalanced := func(param string) {
+		_, err := parseDeviceRef("root", param, false)
+		if err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+		if !strings.Contains(err.Error(), "unbalanced quotes") {
+			t.Fatalf("%s: expected an unbalanced quotes error, got: %v", param, err)
+		}
+	}
+
+	unbalanced(`'UUID=1705d91e-bf54-4a1a-878d-721d7233eba4"`)
+	unbalanced(`"UUID=1705d91e-bf54-4a1a-878d-721d7233eba4'`)
+	unbalanced(`'UUID=1705d91e-bf54-4a1a-878d-721d7233eba4`)
+	unbalanced(`UUID=1705d91e-bf54-4a1a-878d-721d7233eba4"`)
+	unbalanced(`'`)
+}
+
+func TestCalculateDevName(t *testing.T) {
+	check := func(parent string, partition int, expected string) {
+		if name := calculateDevName(parent, partition); name != expected {
+			t.Fatalf("%s#%d: expected %s, got %s", parent, partition, expected, name)
+		}
+	}
+
+	check("sda", 0, "sda1")
+	check("vdb", 11, "vdb12")
+	check("nvme0n1", 1, "nvme0n1p2")
+	check("mmcblk0", 0, "mmcblk0p1")
+	check("loop3", 4, "loop3p5")
+}
+
+func TestResolveFromGptTable(t *testing.T) {
+	partitions := []gptPart{
+		{num: 0, uuid: UUID{0x01, 15: 0}, name: "esp"},
+		{num: 1, uuid: UUID{0x02, 15: 0}, name: "root-a"},
+		{num: 2, uuid: UUID{0x03, 15: 0}, name: "root-b"},
+		{num: 4, uuid: UUID{0x05, 15: 0}, name: "root-*"},
+	}
+
+	check := func(param string, expected string) {
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved := ref.resolveFromGptTable("sda", partitions)
+		if expected == "" {
+			if resolved != nil {
+				t.Fatalf("%s: expected to be unresolved, got %s", param, resolved)
+			}
+			return
+		}
+		if resolved == nil {
+			t.Fatalf("%s: expected to be resolved to %s", param, expected)
+		}
+		if resolved.format != refPath || resolved.data.(string) != expected {
+			t.Fatalf("%s: expected to be resolved to %s, got %s", param, expected, resolved)
+		}
+	}
+
+	check("PARTLABEL=esp", "/dev/sda1")
+	check("PARTLABEL=root", "")
+	check("PARTLABEL=root-b", "/dev/sda3")
+	check("PARTLABEL=root-*", "/dev/sda2") // the first partition wins
+	check(`PARTLABEL=root-\*`, "/dev/sda5")
+	check("PARTLABEL=root-[b-z]", "/dev/sda3")
+	check("PARTLABEL=?sp", "/dev/sda1")
+	check("PARTLABEL=home-*", "")
+	check("PARTLABEL=esp/PARTNROFF=1", "/dev/sda2")
+	check("PARTLABEL=esp/PARTNROFF=0", "/dev/sda1")
+	check("PARTLABEL=root-b/PARTNROFF=-1", "/dev/sda2")
+	check("PARTLABEL=root-b/PARTNROFF=2", "/dev/sda5")
+	check("PARTLABEL=esp/PARTNROFF=3", "") // unused partition entry
+	check("PARTLABEL=esp/PARTNROFF=-1", "")
+	check("PARTLABEL=home/PARTNROFF=1", "")
+	check("PARTUUID=01000000-0000-0000-0000-000000000000/PARTNROFF=2", "/dev/sda3")
+	check("PARTUUID=03000000-0000-0000-0000-000000000000/PARTNROFF=-2", "/dev/sda1")
+	check("PARTUUID=03000000-0000-0000-0000-000000000000/PARTNROFF=1", "") // unused partition entry
+	check("PARTUUID=00000000-0000-0000-0000-000000000000/PARTNROFF=1", "")
+	check("PARTN=3", "/dev/sda3")
+	check("PARTN=4", "") // unused partition entry
+	check("PARTN=5", "/dev/sda5")
+	check("PARTN=6", "")
+	check("PARTUUID=00000000-0000-0000-0000-000000000000", "")
+	check("UUID=01000000-0000-0000-0000-000000000000", "")
+}
+
+func TestLabelCaseInsensitive(t *testing.T) {
+	partitions := []gptPart{
+		{num: 0, uuid: UUID{0x01}, name: "ESP"},
+		{num: 1, uuid: UUID{0x02}, name: "Root-A"},
+	}
+	uuid := UUID{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4}
+	blk := &blkInfo{path: "/dev/sda1", format: "vfat", isFs: true, uuid: uuid, label: "BOOT"}
+
+	check := func(ci bool, param string, expected bool) {
+		labelCaseInsensitive = ci
+		defer func() { labelCaseInsensitive = false }()
+
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var matches bool
+		if ref.dependsOnGpt() {
+			matches = ref.resolveFromGptTable("sda", partitions) != nil
+		} else {
+			matches = ref.matchesBlkInfo(blk)
+		}
+		if matches != expected {
+			t.Fatalf("%s (case-insensitive=%v): expected match %v, got %v", param, ci, expected, matches)
+		}
+	}
+
+	// default is case-sensitive
+	check(false, "LABEL=BOOT", true)
+	check(false, "LABEL=boot", false)
+	check(false, "PARTLABEL=esp", false)
+	check(false, "PARTLABEL=root-*", false)
+	check(false, "LABEL=BO*", false) // globs are matched only for booster.overlay
+
+	check(true, "LABEL=boot", true)
+	check(true, "LABEL=Boot", true)
+	check(true, "LABEL=boot2", false)
+	check(true, "PARTLABEL=esp", true)
+	check(true, "PARTLABEL=root-*", true)
+	check(true, "PARTLABEL=ROOT-[a]", true)
+
+	// UUID comparison is not affected by the flag
+	check(true, "UUID=1705D91E-BF54-4A1A-878D-721D7233EBA4", true)
+	check(true, "UUID=1705d91e-bf54-4a1a-878d-721d7233eba5", false)
+}
+
+func TestMatchesDevNum(t *testing.T) {
+	blk := &blkInfo{path: "/dev/nvme0n1p2", devNo: unix.Mkdev(259, 2)}
+
+	check := func(param string, expected bool) {
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches := ref.matchesBlkInfo(blk); matches != expected {
+			t.Fatalf("%s: expected match %v, got %v", param, expected, matches)
+		}
+	}
+
+	check("259:2", true)
+	check("259:1", false)
+	check("8:2", false)
+	check("0:0", false)
+}
+
+func TestParseDeviceRefs(t *testing.T) {
+	refs, err := parseDeviceRefs("root", "UUID=1705d91e-bf54-4a1a-878d-721d7233eba4,PARTLABEL=root-*,/dev/sda2,ZFS=rpool/ROOT/default,zfs:AUTO,PARTLABEL=esp/PARTNROFF=1,PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4/PARTNROFF=-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"UUID=1705d91e-bf54-4a1a-878d-721d7233eba4", "PARTLABEL=root-*", "/dev/sda2", "zfs:rpool/ROOT/default", "zfs:AUTO", "PARTLABEL=esp/PARTNROFF=1", "PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4/PARTNROFF=-1"}
+	if len(refs) != len(expected) {
+		t.Fatalf("expected %d references, got %d", len(expected), len(refs))
+	}
+	for i, r := range refs {
+		if r.String() != expected[i] {
+			t.Fatalf("reference #%d: expected %s, got %s", i, expected[i], r)
+		}
+	}
+
+	refs, err = parseDeviceRefs("root", "LABEL=root", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].format != refFsLabel {
+		t.Fatalf("expected a single LABEL reference, got %v", refs)
+	}
+
+	for _, param := range []string{"", "UUID=1705d91e-bf54-4a1a-878d-721d7233eba4,", "LABEL=root,foobar"} {
+		if _, err := parseDeviceRefs("root", param, false); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+func TestMatchesUuidPrefix(t *testing.T) {
+	uuid := UUID{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4}
+	blk := &blkInfo{path: "/dev/sda1", format: "ext4", isFs: true, uuid: uuid}
+
+	check := func(param string, expected bool) {
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ref.isAmbiguous() {
+			t.Fatalf("%s: expected to be ambiguous", param)
+		}
+		if matches := ref.matchesBlkInfo(blk); matches != expected {
+			t.Fatalf("%s: expected match %v, got %v", param, expected, matches)
+		}
+	}
+
+	check("UUID=1705d91e*", true)
+	check("UUID=1705D91E*", true)
+	check("UUID=1705d91e-bf5*", true)
+	check("UUID=1705d91ebf544a1a878d721d7233eba4*", true)
+	check("UUID=1705d91f*", false)
+	check("UUID=05d91e*", false)
+
+	ref, err := parseDeviceRef("root", "UUID=1705d91e-bf54-4a1a-878d-721d7233eba4", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.isAmbiguous() {
+		t.Fatal("a full UUID reference is not expected to be ambiguous")
+	}
+}
+
+func TestByIdAmbiguous(t *testing.T) {
+	check := func(param string, expected bool) {
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.isAmbiguous() != expected {
+			t.Fatalf("%s: expected ambiguous %v", param, expected)
+		}
+	}
+
+	check("/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", false)
+	check("/dev/disk/by-id/nvme-eui.0025388b71b2c3d4-part2", false)
+	check("/dev/disk/by-id/scsi-35000c500a1b2c3d4", false)
+	check("/dev/disk/by-id/usb-SanDisk_Cruzer_4C530001-0:0", true)
+	check("/dev/disk/by-id/ata-Samsung_SSD_860_S3Z9NB0K123456A-part1", true)
+	check("/dev/disk/by-id/scsi-SATA_Samsung_SSD_860_S3Z9NB0K123456A", true)
+}
+
+func TestRootAutodiscovery(t *testing.T) {
+	amd64Root, _ := parseUUID("4f68bce3-e8cd-4db1-96e7-fbcaf984b709")
+	riscv64Root, _ := parseUUID("72ec70a6-cf74-40e6-bd49-4bda08e8f224")
+	linuxFs, _ := parseUUID("0fc63daf-8483-4772-8e79-3d69d8477de4")
+
+	check := func(arch string, partitions []gptPart, expected string) {
+		ref := autodiscoveryRootRef(arch)
+		resolved := ref.resolveFromGptTable("vda", partitions)
+		if expected == "" {
+			if resolved != nil {
+				t.Fatalf("%s: expected to be unresolved, got %s", arch, resolved)
+			}
+			return
+		}
+		if resolved == nil || resolved.data.(string) != expected {
+			t.Fatalf("%s: expected to be resolved to %s, got %v", arch, expected, resolved)
+		}
+	}
+
+	partitions := []gptPart{{num: 0, typeGuid: linuxFs}, {num: 1, typeGuid: riscv64Root}, {num: 2, typeGuid: amd64Root}}
+	check("amd64", partitions, "/dev/vda3")
+	check("riscv64", partitions, "/dev/vda2")
+	check("loong64", partitions, "")
+	check("mips64", partitions, "/dev/vda2") // unknown arch accepts any known root type
+	check("mips64", partitions[:1], "")
+
+	ref, err := parseDeviceRef("root", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.format != refGptType {
+		t.Fatalf("expected autodiscovery reference, got %s", ref)
+	}
+	if _, err := parseDeviceRef("resume", "", false); err == nil {
+		t.Fatal("expected to fail for an empty param with autodetect disabled")
+	}
+}
+
+func TestUsrAutodiscovery(t *testing.T) {
+	amd64Root, _ := parseUUID("4f68bce3-e8cd-4db1-96e7-fbcaf984b709")
+	amd64Usr, _ := parseUUID("8484680c-9521-48c6-9c11-b0720656f69e")
+	arm64Usr, _ := parseUUID("b0e01050-ee5f-4390-949a-9101b17104e9")
+
+	partitions := []gptPart{
+		{num: 0, typeGuid: amd64Root},
+		{num: 1, typeGuid: amd64Usr, attributes: gptAttrNoAuto},
+		{num: 2, typeGuid: amd64Usr, attributes: gptAttrReadOnly},
+		{num: 3, typeGuid: arm64Usr},
+	}
+
+	ref := autodiscoveryUsrRef("amd64")
+	p := ref.findGptPartition("sda", partitions)
+	if p == nil || p.num != 2 {
+		t.Fatalf("expected /usr partition #3 to be found (#2 has no-auto flag), got %+v", p)
+	}
+	if p.attributes&gptAttrReadOnly == 0 {
+		t.Fatal("expected /usr partition to be read-only")
+	}
+	if resolved := ref.resolveFromGptTable("sda", partitions); resolved == nil || resolved.data.(string) != "/dev/sda3" {
+		t.Fatalf("expected to be resolved to /dev/sda3, got %v", resolved)
+	}
+
+	if resolved := autodiscoveryUsrRef("arm64").resolveFromGptTable("sda", partitions); resolved == nil || resolved.data.(string) != "/dev/sda4" {
+		t.Fatalf("expected to be resolved to /dev/sda4, got %v", resolved)
+	}
+	if autodiscoveryUsrRef("mips64") != nil {
+		t.Fatal("expected no /usr autodiscovery for an unknown architecture")
+	}
+	if autodiscoveryRootRef("amd64").findGptPartition("sda", partitions[1:]) != nil {
+		t.Fatal("/usr partition is not expected to be autodiscovered as root")
+	}
+}
+
+func TestResolveFromGptTableChain(t *testing.T) {
+	levels := []tableLevel{
+		{"vdq", []gptPart{{num: 0, name: "esp"}, {num: 1, name: "image"}}},
+		{"loop0", []gptPart{{num: 0, name: "boot"}, {num: 1, name: "data"}, {num: 2, name: "nestedroot"}}},
+	}
+
+	check := func(param string, expected string) {
+		t.Helper()
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved := ref.resolveFromGptTableChain(levels)
+		if expected == "" {
+			if resolved != nil {
+				t.Fatalf("%s: expected not to be resolved, got %s", param, resolved)
+			}
+			return
+		}
+		if resolved == nil || resolved.format != refPath || resolved.data.(string) != expected {
+			t.Fatalf("%s: expected to be resolved to %s, got %v", param, expected, resolved)
+		}
+	}
+
+	check("PARTLABEL=nestedroot", "/dev/loop0p3")
+	check("PARTLABEL=esp", "/dev/vdq1")
+	check("PARTLABEL=missing", "")
+	// the table of the disk is searched first
+	check("PARTN=2", "/dev/vdq2")
+	check("PARTN=3", "/dev/loop0p3")
+	check("PARTN=4", "")
+	check("PARTLABEL=boot/PARTNROFF=2", "/dev/loop0p3")
+	// the disk hint is checked against the disk with the outermost table, there is no such disk here
+	check("/dev/disk/by-path/pci-0000:00:04.0-part3", "")
+
+	if (&deviceRef{format: refPath, data: "/dev/vdq1"}).resolveFromGptTableChain(levels) != nil {
+		t.Fatal("a device path is not expected to be resolved with partition tables")
+	}
+	if (&deviceRef{format: refGptLabel, data: "esp"}).resolveFromGptTableChain(nil) != nil {
+		t.Fatal("a reference is not expected to be resolved with an empty chain")
+	}
+}
+
+func TestSwapAutodiscovery(t *testing.T) {
+	amd64Root, _ := parseUUID("4f68bce3-e8cd-4db1-96e7-fbcaf984b709")
+	swap, _ := parseUUID("0657fd6d-a4ab-43c4-84e5-0933c84b4f4f")
+
+	partitions := []gptPart{
+		{num: 0, typeGuid: amd64Root},
+		{num: 1, typeGuid: swap, attributes: gptAttrNoAuto},
+		{num: 2, typeGuid: swap},
+	}
+
+	ref := autodiscoverySwapRef()
+	if resolved := ref.resolveFromGptTable("vda", partitions); resolved == nil || resolved.data.(string) != "/dev/vda3" {
+		t.Fatalf("expected to be resolved to /dev/vda3, got %v", resolved)
+	}
+	if ref.resolveFromGptTable("vda", partitions[:2]) != nil {
+		t.Fatal("swap partition with no-auto flag is not expected to be autodiscovered")
+	}
+}
+
+func TestGptReadOnlyAttribute(t *testing.T) {
+	diskUuid, _ := parseUUID("c26fcabe-8010-4bff-a066-8c73e76dbb32")
+	amd64Root, _ := parseUUID("4f68bce3-e8cd-4db1-96e7-fbcaf984b709")
+	uuid, _ := parseUUID("1705d91e-bf54-4a1a-878d-721d7233eba4")
+
+	check := func(attributes uint64, bootParams map[string]string, expectReadOnly bool) {
+		img := craftGptImage(diskUuid, []gptPart{{num: 1, typeGuid: amd64Root, uuid: uuid, attributes: attributes, name: "root"}})
+		info := probeGpt(bytes.NewReader(img))
+		if info == nil {
+			t.Fatal("unable to detect gpt")
+		}
+
+		ref := autodiscoveryRootRef("amd64").resolveFromGptTable("sda", info.data.([]gptPart))
+		if ref == nil || ref.data.(string) != "/dev/sda2" {
+			t.Fatalf("expected to be resolved to /dev/sda2, got %v", ref)
+		}
+		if ref.readOnly != (attributes&gptAttrReadOnly != 0) {
+			t.Fatalf("attributes 0x%x: unexpected read-only flag %v", attributes, ref.readOnly)
+		}
+
+		saved := cmdline
+		cmdline = bootParams
+		defer func() { cmdline = saved }()
+		flags, _, err := rootMountFlags(ref, "ext4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readOnly := flags&unix.MS_RDONLY != 0; readOnly != expectReadOnly {
+			t.Fatalf("attributes 0x%x, params %v: expected read-only mount %v, got %v", attributes, bootParams, expectReadOnly, readOnly)
+		}
+	}
+
+	check(0, map[string]string{}, true)
+	check(0, map[string]string{"rw": ""}, false)
+	check(0, map[string]string{"ro": ""}, true)
+	check(0, map[string]string{"rootflags": "rw"}, false)
+	check(0, map[string]string{"rootflags": "rw", "ro": ""}, true)
+	check(0, map[string]string{"rootflags": "ro", "rw": ""}, false)
+	check(0, map[string]string{"rootflags": "noatime"}, true)
+	check(gptAttrReadOnly, map[string]string{}, true)
+	check(gptAttrReadOnly, map[string]string{"rw": ""}, true)
+	check(1<<59, map[string]string{"rw": ""}, false)
+
+	// the attribute is honored for autodiscovered partitions only
+	img := craftGptImage(diskUuid, []gptPart{{num: 1, typeGuid: amd64Root, uuid: uuid, attributes: gptAttrReadOnly, name: "root"}})
+	ref, err := parseDeviceRef("root", "PARTLABEL=root", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved := ref.resolveFromGptTable("sda", probeGpt(bytes.NewReader(img)).data.([]gptPart)); resolved == nil || resolved.readOnly {
+		t.Fatalf("PARTLABEL reference is not expected to be read-only, got %+v", resolved)
+	}
+}
+
+func TestParseGptType(t *testing.T) {
+	linuxHome, _ := parseUUID("933ac7e1-2eb4-4f13-b844-0e14e2aef915")
+	esp, _ := parseUUID("c12a7328-f81f-11d2-ba4b-00a0c93ec93b")
+
+	check := func(param string, expected UUID) {
+		ref, err := parseDeviceRef("root", param, false)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if ref.format != refGptType {
+			t.Fatalf("%s: expected format %d, got %d", param, refGptType, ref.format)
+		}
+		data := ref.data.(gptTypeData)
+		if data.autodetect || len(data.types) != 1 || !bytes.Equal(data.types[0], expected) {
+			t.Fatalf("%s: unexpected data %+v", param, data)
+		}
+	}
+
+	check("PARTTYPE=933ac7e1-2eb4-4f13-b844-0e14e2aef915", linuxHome)
+	check("PARTTYPE=933AC7E1-2EB4-4F13-B844-0E14E2AEF915", linuxHome)
+	check("PARTTYPE=linux-home", linuxHome)
+	check("PARTTYPE=esp", esp)
+	check(`PARTTYPE="esp"`, esp)
+	if root, ok := autodiscoveryGptTypes[runtime.GOARCH]; ok {
+		u, _ := parseUUID(root)
+		check("PARTTYPE=linux-root", u)
+	}
+
+	_, err := parseDeviceRef("root", "PARTTYPE=linux-foo", false)
+	if err == nil {
+		t.Fatal("expected to fail for an unknown partition type alias")
+	}
+	if !strings.Contains(err.Error(), "linux-home") {
+		t.Fatalf("expected the error to list valid aliases, got: %v", err)
+	}
+
+	// explicitly specified type does not use the autodiscovery attributes
+	ref, _ := parseDeviceRef("root", "PARTTYPE=linux-home", false)
+	partitions := []gptPart{{num: 0, typeGuid: linuxHome, attributes: gptAttrNoAuto | gptAttrReadOnly}}
+	resolved := ref.resolveFromGptTable("sda", partitions)
+	if resolved == nil || resolved.data.(string) != "/dev/sda1" || resolved.readOnly {
+		t.Fatalf("expected to be resolved to a read-write /dev/sda1, got %+v", resolved)
+	}
+}
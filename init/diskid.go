@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// byIdPrefixes are the /dev/disk/by-id/ link prefixes booster computes from sysfs attributes of the disks.
+// Links with other prefixes (e.g. dm-uuid-) are matched as plain paths.
+var byIdPrefixes = []string{"ata-", "wwn-", "nvme-", "scsi-", "usb-"}
+
+// serialIdPrefixes are the by-id prefixes of the ids built from vendor serial numbers. Unlike the WWN and
+// the NVMe namespace ids they might be shared by several disks.
+var serialIdPrefixes = []string{"ata-", "scsi-S", "usb-"}
+
+// parseByIdRef parses the name of a /dev/disk/by-id/ link, the -partN suffix of partition links is kept in the name
+func parseByIdRef(id string) (*deviceRef, bool, error) {
+	for _, prefix := range byIdPrefixes {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		if id == prefix || strings.ContainsRune(id, '/') {
+			return nil, true, fmt.Errorf("invalid disk id %s", id)
+		}
+		return &deviceRef{format: refById, data: id}, true, nil
+	}
+	return nil, false, nil
+}
+
+// isSerialId returns true if the by-id name is built from the disk serial number
+func isSerialId(id string) bool {
+	for _, prefix := range serialIdPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockDeviceIds returns the /dev/disk/by-id/ names of the block device devName (e.g. "sda1")
+// the same way udev persistent storage rules create them
+func blockDeviceIds(devName string) []string {
+	sysPath, err := filepath.EvalSymlinks("/sys/class/block/" + devName)
+	if err != nil {
+		return nil
+	}
+	suffix := ""
+	if part := readSysAttr(sysPath, "partition"); part != "" {
+		suffix = "-part" + part
+		sysPath = filepath.Dir(sysPath)
+	}
+	ids := diskIds(sysPath)
+	for i := range ids {
+		ids[i] += suffix
+	}
+	return ids
+}
+
+// diskIds returns the by-id names of the disk at sysfs directory sysPath:
+//   - nvme-<wwid> from the namespace wwid, e.g. nvme-eui.0025388b71b2c3d4
+//   - nvme-<model>_<serial> and nvme-<model>_<serial>_<nsid> from the controller model and serial
+//   - wwn-0x<id> from the NAA device/wwid of SCSI and ATA disks
+//   - scsi-3<id> from the NAA device/wwid, scsi-1<id> from the T10 device/wwid
+//   - scsi-S<vendor>_<model>_<serial> from device/vendor, device/model and the device/vpd_pg80 serial number
+//   - ata-<model>_<serial> from the IDENTIFY data at device/vpd_pg89 of libata disks
+//   - usb-<vendor>_<model>_<serial>-<target>:<lun> from the SCSI vendor and model and the USB device serial
+func diskIds(sysPath string) []string {
+	var ids []string
+	if nsid := readSysAttr(sysPath, "nsid"); nsid != "" {
+		if wwid := readSysAttr(sysPath, "wwid"); wwid != "" {
+			ids = append(ids, "nvme-"+udevIdString(wwid))
+		}
+		model, serial := readSysAttr(sysPath, "device/model"), readSysAttr(sysPath, "device/serial")
+		if model != "" && serial != "" {
+			id := "nvme-" + udevIdString(model) + "_" + udevIdString(serial)
+			ids = append(ids, id, id+"_"+nsid)
+		}
+		return ids
+	}
+
+	dev := filepath.Join(sysPath, "device")
+	vendor, model := readSysAttr(dev, "vendor"), readSysAttr(dev, "model")
+	if vendor == "" && model == "" {
+		return nil
+	}
+	wwid := readSysAttr(dev, "wwid")
+	if strings.HasPrefix(wwid, "naa.") {
+		ids = append(ids, "wwn-0x"+strings.ToLower(wwid[4:]))
+	}
+
+	if usbSerial, ok := usbDeviceSerial(dev); ok {
+		// e.g. /sys/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0
+		var host, bus, target, lun int
+		if _, err := fmt.Sscanf(readSysLink(sysPath, "device"), "%d:%d:%d:%d", &host, &bus, &target, &lun); err == nil && usbSerial != "" {
+			ids = append(ids, fmt.Sprintf("usb-%s_%s_%s-%d:%d", udevIdString(vendor), udevIdString(model), udevIdString(usbSerial), target, lun))
+		}
+		return ids
+	}
+
+	serial, _ := parseVpdSerial(dev)
+	if strings.HasPrefix(wwid, "naa.") {
+		ids = append(ids, "scsi-3"+strings.ToLower(wwid[4:]))
+	} else if strings.HasPrefix(wwid, "t10.") {
+		ids = append(ids, "scsi-1"+udevIdString(wwid[4:]))
+	}
+	if serial != "" {
+		ids = append(ids, "scsi-S"+udevIdString(vendor)+"_"+udevIdString(model)+"_"+udevIdString(serial))
+	}
+	if vendor == "ATA" {
+		if ataModel, ataSerial, err := parseAtaIdentify(dev); err == nil {
+			ids = append(ids, "ata-"+udevIdString(ataModel)+"_"+udevIdString(ataSerial))
+		} else {
+			debug("%s: %v", sysPath, err)
+		}
+	}
+	return ids
+}
+
+// usbDeviceSerial looks for the USB device the SCSI device dev belongs to and returns its serial number
+func usbDeviceSerial(dev string) (string, bool) {
+	dir, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return "", false
+	}
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			return readSysAttr(dir, "serial"), true
+		}
+	}
+	return "", false
+}
+
+// parseVpdSerial returns the unit serial number from the SCSI VPD page 0x80
+func parseVpdSerial(dev string) (string, error) {
+	page, err := os.ReadFile(filepath.Join(dev, "vpd_pg80"))
+	if err != nil {
+		return "", err
+	}
+	if len(page) < 4 || page[1] != 0x80 || len(page) < 4+int(page[3]) {
+		return "", fmt.Errorf("invalid VPD page 0x80")
+	}
+	return strings.TrimSpace(string(page[4 : 4+int(page[3])])), nil
+}
+
+// parseAtaIdentify returns the model and the serial number from the IDENTIFY DEVICE data that libata reports
+// with the ATA Information VPD page 0x89. The device/model attribute cannot be used as SCSI truncates it to 16 characters.
+func parseAtaIdentify(dev string) (string, string, error) {
+	const identifyOffset = 60 // IDENTIFY DEVICE data is 512 bytes long
+	page, err := os.ReadFile(filepath.Join(dev, "vpd_pg89"))
+	if err != nil {
+		return "", "", err
+	}
+	if len(page) < identifyOffset+512 || page[1] != 0x89 {
+		return "", "", fmt.Errorf("invalid VPD page 0x89")
+	}
+	identify := page[identifyOffset : identifyOffset+512]
+	serial := ataString(identify[2*10 : 2*20]) // words 10-19
+	model := ataString(identify[2*27 : 2*47])  // words 27-46
+	if serial == "" || model == "" {
+		return "", "", fmt.Errorf("empty ATA model or serial number")
+	}
+	return model, serial, nil
+}
+
+// ataString decodes an IDENTIFY DEVICE string, the characters of every word are swapped
+func ataString(data []byte) string {
+	s := make([]byte, len(data))
+	for i := 0; i+1 < len(data); i += 2 {
+		s[i], s[i+1] = data[i+1], data[i]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(s), "\x00"))
+}
+
+// udevIdString converts a sysfs attribute to the form udev uses for the links: the leading and trailing whitespace
+// is removed, the runs of whitespace are replaced with '_' and so are the characters not allowed in the names
+func udevIdString(s string) string {
+	var b strings.Builder
+	space := false
+	for _, c := range strings.TrimSpace(s) {
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			space = true
+			continue
+		case space:
+			b.WriteByte('_')
+			space = false
+		}
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune("#+-.:=@_", c) {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiskIds(t *testing.T) {
+	sys := t.TempDir()
+	write := func(file string, content []byte) {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(target, name string) {
+		if err := os.Symlink(target, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encodeAtaString := func(s string, size int) []byte {
+		b := []byte(s + strings.Repeat(" ", size-len(s)))
+		for i := 0; i < len(b); i += 2 {
+			b[i], b[i+1] = b[i+1], b[i]
+		}
+		return b
+	}
+	vpd80 := func(serial string) []byte {
+		return append([]byte{0, 0x80, 0, byte(len(serial))}, serial...)
+	}
+
+	// an ATA disk behind libata
+	ata := sys + "/devices/pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0"
+	write(ata+"/vendor", []byte("ATA     \n"))
+	write(ata+"/model", []byte("Samsung SSD 860 \n"))
+	write(ata+"/wwid", []byte("naa.5002538E40A1B2C3\n"))
+	write(ata+"/vpd_pg80", vpd80("S3Z9NB0K123456A"))
+	identify := make([]byte, 60+512)
+	identify[1] = 0x89
+	copy(identify[60+20:], encodeAtaString("     S3Z9NB0K123456A", 20))
+	copy(identify[60+54:], encodeAtaString("Samsung SSD 860 EVO 500GB", 40))
+	write(ata+"/vpd_pg89", identify)
+	write(ata+"/block/sda/sda2/partition", []byte("2\n"))
+	link(ata, ata+"/block/sda/device")
+
+	check := func(sysPath string, expected []string) {
+		t.Helper()
+		ids := diskIds(sysPath)
+		if !reflect.DeepEqual(ids, expected) {
+			t.Fatalf("%s: expected ids %q, got %q", sysPath, expected, ids)
+		}
+	}
+	check(ata+"/block/sda", []string{
+		"wwn-0x5002538e40a1b2c3",
+		"scsi-35002538e40a1b2c3",
+		"scsi-SATA_Samsung_SSD_860_S3Z9NB0K123456A",
+		"ata-Samsung_SSD_860_EVO_500GB_S3Z9NB0K123456A",
+	})
+
+	// a QEMU SCSI disk with a T10 vendor id
+	qemu := sys + "/devices/pci0000:00/0000:00:05.0/virtio2/host2/target2:0:0/2:0:0:0"
+	write(qemu+"/vendor", []byte("QEMU    \n"))
+	write(qemu+"/model", []byte("QEMU HARDDISK   \n"))
+	write(qemu+"/wwid", []byte("t10.QEMU    QEMU HARDDISK   drive-scsi0\n"))
+	write(qemu+"/vpd_pg80", vpd80("drive-scsi0"))
+	write(qemu+"/block/sdb/size", []byte("2048\n"))
+	link(qemu, qemu+"/block/sdb/device")
+	check(qemu+"/block/sdb", []string{
+		"scsi-1QEMU_QEMU_HARDDISK_drive-scsi0",
+		"scsi-SQEMU_QEMU_HARDDISK_drive-scsi0",
+	})
+
+	// a USB flash drive
+	usb := sys + "/devices/pci0000:00/0000:00:14.0/usb2/2-1"
+	write(usb+"/idVendor", []byte("0781\n"))
+	write(usb+"/serial", []byte("4C530001\n"))
+	usbScsi := usb + "/2-1:1.0/host6/target6:0:0/6:0:0:1"
+	write(usbScsi+"/vendor", []byte("SanDisk \n"))
+	write(usbScsi+"/model", []byte("Cruzer Blade    \n"))
+	write(usbScsi+"/block/sdc/size", []byte("2048\n"))
+	link(usbScsi, usbScsi+"/block/sdc/device")
+	check(usbScsi+"/block/sdc", []string{"usb-SanDisk_Cruzer_Blade_4C530001-0:1"})
+
+	// an NVMe namespace
+	nvme := sys + "/devices/pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0"
+	write(nvme+"/model", []byte("Samsung SSD 970 EVO Plus 1TB            \n"))
+	write(nvme+"/serial", []byte("S4EWNX0R123456      \n"))
+	write(nvme+"/nvme0n1/nsid", []byte("1\n"))
+	write(nvme+"/nvme0n1/wwid", []byte("eui.0025388b71b2c3d4\n"))
+	link(nvme, nvme+"/nvme0n1/device")
+	check(nvme+"/nvme0n1", []string{
+		"nvme-eui.0025388b71b2c3d4",
+		"nvme-Samsung_SSD_970_EVO_Plus_1TB_S4EWNX0R123456",
+		"nvme-Samsung_SSD_970_EVO_Plus_1TB_S4EWNX0R123456_1",
+	})
+
+	// a virtual device without the SCSI attributes
+	write(sys+"/devices/virtual/block/loop0/size", []byte("0\n"))
+	check(sys+"/devices/virtual/block/loop0", nil)
+}
+
+func TestUdevIdString(t *testing.T) {
+	check := func(s, expected string) {
+		if id := udevIdString(s); id != expected {
+			t.Fatalf("%q: expected %s, got %s", s, expected, id)
+		}
+	}
+	check("  Samsung SSD  860\t EVO ", "Samsung_SSD_860_EVO")
+	check("WDC WD40EFRX-68N32N0", "WDC_WD40EFRX-68N32N0")
+	check("Ext/Disk(1)", "Ext_Disk_1_")
+	check("", "")
+}
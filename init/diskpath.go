@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	pciAddressRe   = regexp.MustCompile(`^[[:xdigit:]]{4}:[[:xdigit:]]{2}:[[:xdigit:]]{2}\.[[:xdigit:]]$`)
+	ataPortRe      = regexp.MustCompile(`^ata(\d+)$`)
+	scsiHostRe     = regexp.MustCompile(`^host(\d+)$`)
+	scsiDeviceRe   = regexp.MustCompile(`^(\d+):(\d+):(\d+):(\d+)$`)
+	usbInterfaceRe = regexp.MustCompile(`^\d+-([\d.]+:\d+\.\d+)$`)
+	// pathSkippedRe matches the sysfs topology elements that are not a part of the path identifier
+	pathSkippedRe = regexp.MustCompile(`^(block|nvme|nvme\d+|virtio\d+|target\d+:\d+:\d+|usb\d+|\d+-[\d.]+)$`)
+)
+
+// pathIds returns persistent hardware path identifiers of the disk devName (e.g. "vda") in the format used by udev
+// for /dev/disk/by-path/ links, e.g. "pci-0000:00:04.0". The first identifier is the one current udev versions use,
+// the others are the compatibility links.
+func pathIds(devName string) ([]string, error) {
+	// e.g. /sys/devices/pci0000:00/0000:00:04.0/virtio1/block/vda
+	target, err := filepath.EvalSymlinks("/sys/block/" + devName)
+	if err != nil {
+		return nil, err
+	}
+	return parsePathIds(target)
+}
+
+// parsePathIds builds the path identifiers from the sysfs topology of the disk at sysPath. Supported are
+// the devices attached to a PCI function directly (e.g. virtio), ATA and SCSI disks, USB storage and NVMe namespaces:
+//   - pci-0000:00:04.0 for a virtio disk
+//   - pci-0000:00:17.0-ata-1.0 (and pci-0000:00:17.0-ata-1 compatibility link) for an ATA disk
+//   - pci-0000:00:05.0-scsi-0:0:1:0 for a SCSI disk
+//   - pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0 for a USB disk
+//   - pci-0000:3d:00.0-nvme-1 for an NVMe namespace
+func parsePathIds(sysPath string) ([]string, error) {
+	elems := strings.Split(sysPath, "/")
+	devName := elems[len(elems)-1]
+
+	pci := -1
+	for i, elem := range elems {
+		if pciAddressRe.MatchString(elem) {
+			pci = i // the last PCI address in the chain is the device itself, others are bridges
+		}
+	}
+	if pci == -1 {
+		return nil, fmt.Errorf("%s: unable to find PCI address of the device", devName)
+	}
+
+	path := "pci-" + elems[pci]
+	var compat, ataPort string
+	var host, hostBase int
+	for i := pci + 1; i < len(elems)-1; i++ {
+		elem, dir := elems[i], strings.Join(elems[:i+1], "/")
+		if m := ataPortRe.FindStringSubmatch(elem); m != nil {
+			ataPort = readSysAttr(dir, "ata_port/"+elem+"/port_no")
+			if ataPort == "" {
+				ataPort = m[1]
+			}
+		} else if m := scsiHostRe.FindStringSubmatch(elem); m != nil {
+			host, _ = strconv.Atoi(m[1])
+			hostBase = lowestScsiHost(filepath.Dir(dir), host)
+		} else if m := scsiDeviceRe.FindStringSubmatch(elem); m != nil {
+			bus, _ := strconv.Atoi(m[2])
+			target, _ := strconv.Atoi(m[3])
+			lun, _ := strconv.Atoi(m[4])
+			switch {
+			case ataPort == "":
+				// SCSI host numbers depend on the probing order, udev counts them from the first host of the controller
+				path += fmt.Sprintf("-scsi-%d:%d:%d:%d", host-hostBase, bus, target, lun)
+			case bus != 0:
+				// a device behind a port multiplier
+				compat = path + "-ata-" + ataPort
+				path += fmt.Sprintf("-ata-%s.%d.0", ataPort, bus)
+			default:
+				compat = path + "-ata-" + ataPort
+				path += fmt.Sprintf("-ata-%s.%d", ataPort, target)
+			}
+		} else if m := usbInterfaceRe.FindStringSubmatch(elem); m != nil {
+			path += "-usb-0:" + m[1]
+		} else if !pathSkippedRe.MatchString(elem) {
+			return nil, fmt.Errorf("%s: unsupported device topology element %s in %s", devName, elem, sysPath)
+		}
+	}
+	if strings.HasPrefix(devName, "nvme") {
+		nsid := readSysAttr(sysPath, "nsid")
+		if nsid == "" {
+			return nil, fmt.Errorf("%s: unable to read the NVMe namespace id", devName)
+		}
+		path += "-nvme-" + nsid
+	}
+
+	ids := []string{path}
+	if compat != "" {
+		ids = append(ids, compat)
+	}
+	return ids, nil
+}
+
+// lowestScsiHost returns the lowest number of the SCSI hosts of the controller at dir
+func lowestScsiHost(dir string, host int) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return host
+	}
+	for _, e := range entries {
+		if m := scsiHostRe.FindStringSubmatch(e.Name()); m != nil {
+			if n, _ := strconv.Atoi(m[1]); n < host {
+				host = n
+			}
+		}
+	}
+	return host
+}
+
+// matchesPathId checks whether the disk devName (e.g. "sda") has the given path identifier
+func matchesPathId(devName, id string) bool {
+	ids, err := pathIds(devName)
+	if err != nil {
+		debug("%v", err)
+		return false
+	}
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPathPartition checks whether the block device at path is partition num of the disk with the path id.
+// It does not need the partition table thus it works for MBR disks as well.
+func matchesPathPartition(path, id string, num int) bool {
+	name := filepath.Base(path)
+	if !isPartition(name) {
+		return false
+	}
+	sysPath, err := filepath.EvalSymlinks("/sys/class/block/" + name)
+	if err != nil {
+		return false
+	}
+	disk := filepath.Base(filepath.Dir(sysPath))
+	return name == calculateDevName(disk, num-1) && matchesPathId(disk, id)
+}
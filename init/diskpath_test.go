@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParsePathIds(t *testing.T) {
+	sys := t.TempDir()
+	mkdir := func(dir string) string {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	write := func(file, content string) {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(sysPath string, expected ...string) {
+		t.Helper()
+		ids, err := parsePathIds(sysPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Fatalf("%s: expected path ids %q, got %q", sysPath, expected, ids)
+		}
+	}
+
+	check(sys+"/devices/pci0000:00/0000:00:04.0/virtio1/block/vda", "pci-0000:00:04.0")
+	// a disk behind a PCI bridge
+	check(sys+"/devices/pci0000:00/0000:00:1c.0/0000:01:00.0/virtio3/block/vdb", "pci-0000:01:00.0")
+
+	ata := mkdir(sys + "/devices/pci0000:00/0000:00:17.0/ata3")
+	write(mkdir(ata+"/ata_port/ata3")+"/port_no", "2\n")
+	check(ata+"/host2/target2:0:0/2:0:0:0/block/sda", "pci-0000:00:17.0-ata-2.0", "pci-0000:00:17.0-ata-2")
+	check(ata+"/host2/target2:1:0/2:1:0:0/block/sdb", "pci-0000:00:17.0-ata-2.1.0", "pci-0000:00:17.0-ata-2")
+
+	// the second SCSI host of a controller
+	scsi := sys + "/devices/pci0000:00/0000:00:05.0/virtio2"
+	mkdir(scsi + "/host4")
+	mkdir(scsi + "/host5")
+	check(scsi+"/host5/target5:0:1/5:0:1:3/block/sdc", "pci-0000:00:05.0-scsi-1:0:1:3")
+
+	usb := sys + "/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1.4/2-1.4:1.0"
+	mkdir(usb + "/host6")
+	check(usb+"/host6/target6:0:0/6:0:0:0/block/sdd", "pci-0000:00:14.0-usb-0:1.4:1.0-scsi-0:0:0:0")
+
+	nvme := mkdir(sys + "/devices/pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0/nvme0n2")
+	write(nvme+"/nsid", "2\n")
+	check(nvme, "pci-0000:3d:00.0-nvme-2")
+
+	for _, p := range []string{
+		sys + "/devices/virtual/block/loop0",
+		sys + "/devices/pci0000:00/0000:00:1f.0/0000:02:00.0/host0/port-0:0/end_device-0:0/target0:0:0/0:0:0:0/block/sde",
+	} {
+		if _, err := parsePathIds(p); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", p)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// gptAttrFactoryReset is the GPT partition attribute that requests the factory reset of the root partition at the next
+// boot, booster clears it once the filesystem is recreated. It is one of the type-specific attribute bits (48-63)
+// that neither the Discoverable Partitions Specification nor the A/B slot attributes use.
+const gptAttrFactoryReset = 1 << 57
+
+var (
+	factoryResetRef       *deviceRef // partition to reset, specified with factory_reset config option
+	factoryResetRequested bool       // set with booster.factory_reset boot param
+)
+
+// parseFactoryResetParams parses the partition reference of the factory reset config. The reset is possible only
+// if the image is generated with the factory_reset option, the boot param alone is ignored.
+func parseFactoryResetParams() error {
+	_, factoryResetRequested = cmdline["booster.factory_reset"]
+	if config.FactoryReset == nil {
+		factoryResetRef = nil
+		if factoryResetRequested {
+			warning("booster.factory_reset is ignored as the image is generated without factory_reset option")
+		}
+		return nil
+	}
+	ref, err := parseDeviceRef("factory_reset", config.FactoryReset.Device, false)
+	if err != nil {
+		return err
+	}
+	if ref.format != refGptUuid && ref.format != refGptLabel {
+		return fmt.Errorf("factory_reset: the partition is expected to be specified with PARTUUID= or PARTLABEL=, got %s", config.FactoryReset.Device)
+	}
+	factoryResetRef = ref
+	return nil
+}
+
+// factoryReset recreates the root filesystem if the root device is the factory reset partition and the reset is
+// requested either with booster.factory_reset boot param or with the GPT partition attribute. It returns the
+// information about the new filesystem.
+func factoryReset(info *blkInfo) (*blkInfo, error) {
+	if factoryResetRef == nil {
+		return info, nil
+	}
+	disk, partitions, err := readParentGpt(info.path)
+	if err != nil {
+		debug("factory reset: %v", err)
+		return info, nil
+	}
+	p := factoryResetRef.findGptPartition(disk, partitions)
+	if p == nil || "/dev/"+calculateDevName(disk, p.num) != info.path {
+		debug("factory reset: root device %s is not the factory reset partition %s", info.path, factoryResetRef)
+		return info, nil
+	}
+	byAttribute := p.attributes&gptAttrFactoryReset != 0
+	if !factoryResetRequested && !byAttribute {
+		return info, nil
+	}
+
+	fstype := config.FactoryReset.Fstype
+	trigger := "booster.factory_reset boot param"
+	if byAttribute {
+		trigger = "the partition attribute"
+	}
+	warning("FACTORY RESET requested with %s: recreating %s filesystem at %s (%s), ALL DATA AT THE PARTITION IS DESTROYED", trigger, fstype, info.path, factoryResetRef)
+	showMessage("Factory reset: recreating the root filesystem")
+
+	args := append(strings.Fields(config.FactoryReset.Options), info.path)
+	cmd := exec.Command("mkfs."+fstype, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("factory reset: mkfs.%s %s: %v", fstype, strings.Join(args, " "), err)
+	}
+	warning("FACTORY RESET: %s filesystem is created at %s", fstype, info.path)
+
+	if byAttribute {
+		// otherwise the partition is reset at every boot
+		clear := func(attrs uint64) uint64 { return attrs &^ gptAttrFactoryReset }
+		if err := updateGptAttributes("/dev/"+disk, p.num, clear); err != nil {
+			return nil, fmt.Errorf("factory reset: unable to clear the partition attribute: %v", err)
+		}
+	}
+	flushProbeCache() // the filesystem and the partition table are rewritten without uevents
+	return probeBlockDevice(info.path)
+}
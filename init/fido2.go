@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fido2TokenType is the LUKS2 token type created by systemd-cryptenroll --fido2-device
+const fido2TokenType = "systemd-fido2"
+
+const (
+	fido2DeviceTimeout = 10 * time.Second // time to wait for a FIDO2 key to be plugged in
+	fido2AssertTimeout = 30 * time.Second // time the user has to confirm the presence by touching the key
+)
+
+// fido2Token is the payload of a systemd-fido2 LUKS2 token
+type fido2Token struct {
+	Credential        string `json:"fido2-credential"` // base64 encoded
+	Salt              string `json:"fido2-salt"`       // base64 encoded
+	RelyingParty      string `json:"fido2-rp"`
+	ClientPinRequired bool   `json:"fido2-clientPin-required"`
+	UpRequired        *bool  `json:"fido2-up-required"` // missing in the tokens created by old systemd versions, the presence is required then
+	UvRequired        bool   `json:"fido2-uv-required"`
+}
+
+// parseFido2Token parses the token payload and sets the defaults systemd uses for missing fields
+func parseFido2Token(payload []byte) (*fido2Token, error) {
+	var t fido2Token
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return nil, err
+	}
+	if t.Credential == "" || t.Salt == "" {
+		return nil, fmt.Errorf("FIDO2 token does not have a credential or salt")
+	}
+	if t.RelyingParty == "" {
+		t.RelyingParty = "io.systemd.cryptsetup"
+	}
+	if t.UpRequired == nil {
+		up := true
+		t.UpRequired = &up
+	}
+	return &t, nil
+}
+
+// fido2TokenPassword obtains the hmac-secret from a FIDO2 key with the fido2-assert tool. systemd uses
+// the base64 encoded secret as the LUKS passphrase.
+func fido2TokenPassword(payload []byte) ([]byte, error) {
+	token, err := parseFido2Token(payload)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath("fido2-assert"); err != nil {
+		return nil, fmt.Errorf("fido2-assert tool is not available in the image, add it to 'extra_files' in booster.yaml to unlock with a FIDO2 key")
+	}
+
+	device, err := waitForFido2Device(fido2DeviceTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := make([]byte, 32)
+	if _, err := rand.Read(clientDataHash); err != nil {
+		return nil, err
+	}
+	input := strings.Join([]string{
+		base64.StdEncoding.EncodeToString(clientDataHash),
+		token.RelyingParty,
+		token.Credential,
+		token.Salt,
+	}, "\n") + "\n"
+
+	args := []string{"-G", "-h", "-i", "-"}
+	args = append(args, "-t", fmt.Sprintf("up=%v", *token.UpRequired))
+	if token.UvRequired {
+		args = append(args, "-t", "uv=true")
+	}
+	if token.ClientPinRequired {
+		args = append(args, "-t", "pin=true")
+	}
+	args = append(args, device)
+
+	ctx, cancel := context.WithTimeout(context.Background(), fido2AssertTimeout)
+	defer cancel()
+	if *token.UpRequired {
+		fmt.Println("Please touch the FIDO2 security key to unlock")
+	}
+	cmd := exec.CommandContext(ctx, "fido2-assert", args...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("FIDO2 key presence has not been confirmed within %v", fido2AssertTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fido2-assert: %v", err)
+	}
+	defer MemZeroBytes(out)
+
+	secret, err := fido2AssertSecret(out)
+	if err != nil {
+		return nil, err
+	}
+	defer MemZeroBytes(secret)
+	password := make([]byte, base64.StdEncoding.EncodedLen(len(secret)))
+	base64.StdEncoding.Encode(password, secret)
+	return password, nil
+}
+
+// fido2AssertSecret extracts the hmac-secret from 'fido2-assert -G -h' output. The secret is the last line of the output.
+func fido2AssertSecret(out []byte) ([]byte, error) {
+	lines := bytes.Split(bytes.TrimSpace(out), []byte("\n"))
+	// client data hash, relying party, authenticator data, signature and the secret
+	if len(lines) < 5 {
+		return nil, fmt.Errorf("fido2-assert: unexpected output, the hmac-secret is missing")
+	}
+	encoded := bytes.TrimSpace(lines[len(lines)-1])
+	secret := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(secret, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("fido2-assert: invalid hmac-secret: %v", err)
+	}
+	return secret[:n], nil
+}
+
+// waitForFido2Device waits until a FIDO2 key is plugged in and returns its hidraw device path
+func waitForFido2Device(timeout time.Duration) (string, error) {
+	start := time.Now()
+	for {
+		if dev := findFido2Device(); dev != "" {
+			return dev, nil
+		}
+		if time.Since(start) > timeout {
+			return "", fmt.Errorf("no FIDO2 key found within %v", timeout)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func findFido2Device() string {
+	descriptors, _ := filepath.Glob("/sys/class/hidraw/*/device/report_descriptor")
+	for _, f := range descriptors {
+		desc, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		if isFido2ReportDescriptor(desc) {
+			return "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(f)))
+		}
+	}
+	return ""
+}
+
+// isFido2ReportDescriptor checks whether the HID report descriptor starts with the FIDO Alliance usage page (0xf1d0)
+func isFido2ReportDescriptor(desc []byte) bool {
+	return bytes.HasPrefix(desc, []byte{0x06, 0xd0, 0xf1})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFido2Token(t *testing.T) {
+	token, err := parseFido2Token([]byte(`{"type":"systemd-fido2","keyslots":["1"],"fido2-credential":"Y3JlZA==","fido2-salt":"c2FsdA==","fido2-rp":"io.systemd.cryptsetup","fido2-clientPin-required":true,"fido2-up-required":false,"fido2-uv-required":false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Credential != "Y3JlZA==" || token.Salt != "c2FsdA==" || !token.ClientPinRequired || *token.UpRequired || token.UvRequired {
+		t.Fatalf("unexpected token %+v", token)
+	}
+
+	// old systemd versions do not store the rp and the presence flags
+	token, err = parseFido2Token([]byte(`{"type":"systemd-fido2","keyslots":["1"],"fido2-credential":"Y3JlZA==","fido2-salt":"c2FsdA=="}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.RelyingParty != "io.systemd.cryptsetup" || !*token.UpRequired {
+		t.Fatalf("unexpected token defaults %+v", token)
+	}
+
+	if _, err := parseFido2Token([]byte(`{"type":"systemd-fido2","keyslots":["1"]}`)); err == nil {
+		t.Fatal("expected a token without credential to fail")
+	}
+
+	out := "Y2RoCg==\nio.systemd.cryptsetup\nYXV0aGRhdGE=\nc2lnbmF0dXJl\nc2VjcmV0\n"
+	secret, err := fido2AssertSecret([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret) != "secret" {
+		t.Fatalf("unexpected hmac-secret %q", secret)
+	}
+	if _, err := fido2AssertSecret([]byte("Y2RoCg==\nio.systemd.cryptsetup\n")); err == nil {
+		t.Fatal("expected output without hmac-secret to fail")
+	}
+
+	if !isFido2ReportDescriptor([]byte{0x06, 0xd0, 0xf1, 0x09, 0x01, 0xa1, 0x01}) {
+		t.Fatal("FIDO2 report descriptor is not detected")
+	}
+	if isFido2ReportDescriptor([]byte{0x05, 0x01, 0x09, 0x06, 0xa1, 0x01}) {
+		t.Fatal("keyboard report descriptor is detected as FIDO2")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anatol/uevent.go"
+)
+
+const (
+	firmwareDir = "/usr/lib/firmware/"
+	// firmwareClassPath is the custom firmware search path of the kernel loader, see firmware_class.path boot param
+	firmwareClassPath = "/sys/module/firmware_class/parameters/path"
+)
+
+// setFirmwarePath points the kernel firmware loader to the firmware directory of the image. The kernel looks up
+// /lib/firmware only and the image keeps the files at /usr/lib/firmware. A path specified with firmware_class.path
+// boot param is kept as is.
+func setFirmwarePath() {
+	if _, err := os.Stat(firmwareDir); os.IsNotExist(err) {
+		return
+	}
+	current, err := os.ReadFile(firmwareClassPath)
+	if err != nil {
+		debug("firmware: %v", err)
+		return
+	}
+	if p := strings.TrimSpace(string(current)); p != "" {
+		debug("firmware: kernel firmware search path is set to %s", p)
+		return
+	}
+	if err := os.WriteFile(firmwareClassPath, []byte(firmwareDir), 0644); err != nil {
+		warning("firmware: unable to set kernel firmware search path: %v", err)
+	}
+}
+
+// handleFirmwareUevent serves the firmware requests that fall back to the user-space loader. The kernel sends them
+// if the direct loading fails, e.g. for drivers that request the user-space helper explicitly.
+func handleFirmwareUevent(ev *uevent.Uevent) error {
+	if ev.Action != "add" {
+		return nil
+	}
+	name := ev.Vars["FIRMWARE"]
+	if name == "" {
+		return nil
+	}
+	return loadFirmware("/sys"+ev.Devpath, name)
+}
+
+// loadFirmware writes the firmware file to the loader sysfs interface at dir. A firmware missing in the image
+// is reported to the kernel right away so the driver does not wait for the loader timeout.
+func loadFirmware(dir, name string) error {
+	content, err := readFirmware(name)
+	if err != nil {
+		_ = os.WriteFile(dir+"/loading", []byte("-1"), 0644)
+		return err
+	}
+	if err := os.WriteFile(dir+"/loading", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("firmware %s: %v", name, err)
+	}
+	if err := os.WriteFile(dir+"/data", content, 0644); err != nil {
+		_ = os.WriteFile(dir+"/loading", []byte("-1"), 0644)
+		return fmt.Errorf("firmware %s: %v", name, err)
+	}
+	debug("firmware: loaded %s", name)
+	return os.WriteFile(dir+"/loading", []byte("0"), 0644)
+}
+
+// readFirmware reads the requested firmware from the image
+func readFirmware(name string) ([]byte, error) {
+	file := filepath.Join(firmwareDir, name)
+	if !strings.HasPrefix(file, firmwareDir) {
+		return nil, fmt.Errorf("firmware %s: invalid firmware name", name)
+	}
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("firmware %s is requested but it is not in the image, add it with 'firmware_files: %s' in booster.yaml", name, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firmware %s: %v", name, err)
+	}
+	return content, nil
+}
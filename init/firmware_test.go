@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadFirmware(t *testing.T) {
+	dir := t.TempDir()
+	if err := loadFirmware(dir, "../../etc/passwd"); err == nil {
+		t.Fatal("firmware outside of the firmware directory is expected to be rejected")
+	}
+	if loading, err := os.ReadFile(dir + "/loading"); err != nil || string(loading) != "-1" {
+		t.Fatalf("expected the request to be aborted, got '%s' (%v)", loading, err)
+	}
+
+	err := loadFirmware(dir, "booster-test/missing.bin")
+	if err == nil || !strings.Contains(err.Error(), "firmware_files: booster-test/missing.bin") {
+		t.Fatalf("expected a hint to add the missing firmware, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+// fnmatch reports whether name matches the shell wildcard pattern. It follows fnmatch(3) called without flags
+// that is what modprobe uses to match modaliases. Unlike path.Match the '*' wildcard matches '/' too and
+// a malformed bracket expression matches literally instead of failing the whole match.
+func fnmatch(pattern, name string) bool {
+	px, nx := 0, 0
+	// position to restart from if the current attempt fails, the last '*' consumes one more character then
+	starPx, starNx := -1, -1
+	for px < len(pattern) || nx < len(name) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				starPx, starNx = px, nx+1
+				px++
+				continue
+			case '?':
+				if nx < len(name) {
+					px++
+					nx++
+					continue
+				}
+			case '[':
+				if nx < len(name) {
+					matched, width := matchBracket(pattern[px:], name[nx])
+					if width == 0 {
+						// unterminated bracket expression, '[' is a regular character then
+						matched, width = name[nx] == '[', 1
+					}
+					if matched {
+						px += width
+						nx++
+						continue
+					}
+				}
+			default:
+				width := 1
+				if c == '\\' && px+1 < len(pattern) {
+					c = pattern[px+1]
+					width = 2
+				}
+				if nx < len(name) && name[nx] == c {
+					px += width
+					nx++
+					continue
+				}
+			}
+		}
+		if starPx != -1 && starNx <= len(name) {
+			px, nx = starPx, starNx
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// matchBracket matches the character against the bracket expression at the beginning of the pattern,
+// e.g. [0-9a-f] or [!0]. It returns the length of the expression or 0 if the expression is not terminated.
+func matchBracket(pattern string, ch byte) (bool, int) {
+	i := 1
+	negate := i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^')
+	if negate {
+		i++
+	}
+	matched := false
+	for first := true; i < len(pattern); first = false {
+		lo := pattern[i]
+		if lo == ']' && !first {
+			return matched != negate, i + 1
+		}
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			i += 2
+			hi = pattern[i]
+			if hi == '\\' && i+1 < len(pattern) {
+				i++
+				hi = pattern[i]
+			}
+		}
+		if lo <= ch && ch <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// PC Screen Font formats, see https://www.win.tue.nl/~aeb/linux/kbd/font-formats-1.html
+const (
+	psf1Magic        = "\x36\x04"
+	psf1Mode512      = 0x01
+	psf1ModeHasTab   = 0x02
+	psf1ModeHasSeq   = 0x04
+	psf1Separator    = 0xffff
+	psf1StartSeq     = 0xfffe
+	psf2Magic        = "\x72\xb5\x4a\x86"
+	psf2HasUnicode   = 0x01
+	psf2Separator    = 0xff
+	psf2StartSeq     = 0xfe
+	maxFontHeight    = 64
+	maxFontWidth     = 64
+	rawFontCharCount = 256
+)
+
+// unipair maps a unicode character to a glyph of the font, struct unipair from linux/kd.h
+type unipair struct {
+	unicode uint16
+	fontpos uint16
+}
+
+// consoleFont is a parsed console font
+type consoleFont struct {
+	width, height int
+	charCount     int
+	charSize      int       // bytes per glyph, height rows of (width+7)/8 bytes
+	glyphs        []byte    // charCount glyphs
+	unicode       []unipair // the unicode table of the font, empty if the font does not have one
+}
+
+// parseFont parses a console font either in PSF1 or PSF2 format or a raw font of 256 8-pixel wide glyphs
+func parseFont(data []byte) (*consoleFont, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte(psf2Magic)):
+		return parsePsf2Font(data)
+	case bytes.HasPrefix(data, []byte(psf1Magic)):
+		return parsePsf1Font(data)
+	case len(data) != 0 && len(data)%rawFontCharCount == 0 && len(data)/rawFontCharCount <= maxFontHeight:
+		height := len(data) / rawFontCharCount
+		return &consoleFont{width: 8, height: height, charCount: rawFontCharCount, charSize: height, glyphs: data}, nil
+	default:
+		return nil, fmt.Errorf("unknown font format")
+	}
+}
+
+func parsePsf1Font(data []byte) (*consoleFont, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("PSF1 font header is truncated")
+	}
+	mode, height := data[2], int(data[3])
+	f := &consoleFont{width: 8, height: height, charCount: 256, charSize: height}
+	if mode&psf1Mode512 != 0 {
+		f.charCount = 512
+	}
+	if height == 0 || height > maxFontHeight {
+		return nil, fmt.Errorf("invalid font height %d", height)
+	}
+	end := 4 + f.charCount*f.charSize
+	if len(data) < end {
+		return nil, fmt.Errorf("PSF1 font glyphs are truncated")
+	}
+	f.glyphs = data[4:end]
+
+	if mode&(psf1ModeHasTab|psf1ModeHasSeq) == 0 {
+		return f, nil
+	}
+	table := data[end:]
+	for pos := 0; pos < f.charCount; pos++ {
+		inSeq := false
+		for {
+			if len(table) < 2 {
+				return nil, fmt.Errorf("PSF1 font unicode table is truncated")
+			}
+			u := binary.LittleEndian.Uint16(table)
+			table = table[2:]
+			if u == psf1Separator {
+				break
+			}
+			if u == psf1StartSeq {
+				inSeq = true // the console cannot display the sequences
+			}
+			if !inSeq {
+				f.unicode = append(f.unicode, unipair{unicode: u, fontpos: uint16(pos)})
+			}
+		}
+	}
+	return f, nil
+}
+
+func parsePsf2Font(data []byte) (*consoleFont, error) {
+	if len(data) < 32 {
+		return nil, fmt.Errorf("PSF2 font header is truncated")
+	}
+	headerSize := binary.LittleEndian.Uint32(data[8:])
+	flags := binary.LittleEndian.Uint32(data[12:])
+	charCount := binary.LittleEndian.Uint32(data[16:])
+	charSize := binary.LittleEndian.Uint32(data[20:])
+	height := binary.LittleEndian.Uint32(data[24:])
+	width := binary.LittleEndian.Uint32(data[28:])
+	if width == 0 || width > maxFontWidth || height == 0 || height > maxFontHeight {
+		return nil, fmt.Errorf("invalid font size %dx%d", width, height)
+	}
+	if charCount == 0 || charCount > 512 {
+		return nil, fmt.Errorf("invalid font glyphs number %d, the console supports up to 512", charCount)
+	}
+	if charSize != height*((width+7)/8) {
+		return nil, fmt.Errorf("font glyph size %d does not match the font size %dx%d", charSize, width, height)
+	}
+	end := uint64(headerSize) + uint64(charCount)*uint64(charSize)
+	if headerSize < 32 || uint64(len(data)) < end {
+		return nil, fmt.Errorf("PSF2 font glyphs are truncated")
+	}
+	f := &consoleFont{
+		width:     int(width),
+		height:    int(height),
+		charCount: int(charCount),
+		charSize:  int(charSize),
+		glyphs:    data[headerSize:end],
+	}
+
+	if flags&psf2HasUnicode == 0 {
+		return f, nil
+	}
+	table := data[end:]
+	for pos := 0; pos < f.charCount; pos++ {
+		inSeq := false
+		for {
+			if len(table) == 0 {
+				return nil, fmt.Errorf("PSF2 font unicode table is truncated")
+			}
+			if table[0] == psf2Separator {
+				table = table[1:]
+				break
+			}
+			if table[0] == psf2StartSeq {
+				inSeq = true // the console cannot display the sequences
+				table = table[1:]
+				continue
+			}
+			r, size := utf8.DecodeRune(table)
+			if r == utf8.RuneError && size <= 1 {
+				return nil, fmt.Errorf("PSF2 font unicode table contains an invalid UTF-8 character")
+			}
+			table = table[size:]
+			if !inSeq && r <= 0xffff {
+				f.unicode = append(f.unicode, unipair{unicode: uint16(r), fontpos: uint16(pos)})
+			}
+		}
+	}
+	return f, nil
+}
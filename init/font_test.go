@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParseFont(t *testing.T) {
+	glyphs := func(count, size int) []byte {
+		b := make([]byte, count*size)
+		for i := range b {
+			b[i] = byte(i / size)
+		}
+		return b
+	}
+
+	t.Run("Psf1", func(t *testing.T) {
+		data := append([]byte{0x36, 0x04, psf1ModeHasTab, 16}, glyphs(256, 16)...)
+		for pos := 0; pos < 256; pos++ {
+			if pos == 'A' {
+				// two unicode characters and a sequence for glyph 'A'
+				data = append(data, 'A', 0, 0x10, 0x04, 0xfe, 0xff, 'A', 0, 0x0a, 0x03)
+			}
+			data = append(data, 0xff, 0xff)
+		}
+		font, err := parseFont(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if font.width != 8 || font.height != 16 || font.charCount != 256 || font.charSize != 16 || font.glyphs[16*'A'] != 'A' {
+			t.Fatalf("unexpected font %dx%d %d glyphs of %d bytes", font.width, font.height, font.charCount, font.charSize)
+		}
+		expected := []unipair{{'A', 'A'}, {0x0410, 'A'}}
+		if !reflect.DeepEqual(font.unicode, expected) {
+			t.Fatalf("expected unicode table %v, got %v", expected, font.unicode)
+		}
+
+		if _, err := parseFont(data[:4+255*16]); err == nil || err.Error() != "PSF1 font glyphs are truncated" {
+			t.Fatalf("expected truncated font error, got %v", err)
+		}
+		if _, err := parseFont(data[:len(data)-1]); err == nil || err.Error() != "PSF1 font unicode table is truncated" {
+			t.Fatalf("expected truncated table error, got %v", err)
+		}
+	})
+
+	t.Run("Psf2", func(t *testing.T) {
+		const width, height, count = 16, 32, 512
+		charSize := height * 2
+		header := make([]byte, 32)
+		copy(header, psf2Magic)
+		for i, v := range []uint32{0, 32, psf2HasUnicode, count, uint32(charSize), height, width} {
+			binary.LittleEndian.PutUint32(header[4+4*i:], v)
+		}
+		data := append(header, glyphs(count, charSize)...)
+		for pos := 0; pos < count; pos++ {
+			if pos == 0x100 {
+				data = append(data, "éé\xfeé"...)
+			}
+			data = append(data, 0xff)
+		}
+		font, err := parseFont(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if font.width != width || font.height != height || font.charCount != count || font.charSize != charSize {
+			t.Fatalf("unexpected font %dx%d %d glyphs of %d bytes", font.width, font.height, font.charCount, font.charSize)
+		}
+		expected := []unipair{{0xe9, 0x100}, {0xe9, 0x100}}
+		if !reflect.DeepEqual(font.unicode, expected) {
+			t.Fatalf("expected unicode table %v, got %v", expected, font.unicode)
+		}
+
+		binary.LittleEndian.PutUint32(data[12:], 0) // no unicode table
+		font, err = parseFont(data[:32+count*charSize])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(font.unicode) != 0 {
+			t.Fatalf("expected no unicode table, got %v", font.unicode)
+		}
+
+		binary.LittleEndian.PutUint32(data[20:], 60)
+		if _, err := parseFont(data); err == nil || err.Error() != "font glyph size 60 does not match the font size 16x32" {
+			t.Fatalf("expected glyph size error, got %v", err)
+		}
+	})
+
+	t.Run("Raw", func(t *testing.T) {
+		font, err := parseFont(glyphs(256, 14))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if font.width != 8 || font.height != 14 || font.charCount != 256 || len(font.unicode) != 0 {
+			t.Fatalf("unexpected font %dx%d %d glyphs", font.width, font.height, font.charCount)
+		}
+		if _, err := parseFont([]byte("not a font")); err == nil || err.Error() != "unknown font format" {
+			t.Fatalf("expected unknown format error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fsck exit code bits, see fsck(8)
+const (
+	fsckErrorsCorrected = 0x1
+	fsckRebootRequired  = 0x2
+	fsckErrorsLeft      = 0x4
+)
+
+var (
+	// fsckBinDirs are the directories the generator adds fsck binaries from
+	fsckBinDirs = []string{"/usr/bin", "/usr/sbin", "/sbin"}
+
+	// fsckMode and fsckRepair are set with fsck.mode= and fsck.repair= boot params, the same ones systemd-fsck uses.
+	// fsckRequested is set if any of them is specified.
+	fsckMode      string
+	fsckRepair    string
+	fsckRequested bool
+)
+
+// fsckRepairFlags are the fsck flags of fsck.repair modes
+var fsckRepairFlags = map[string]string{
+	"preen": "-a",
+	"yes":   "-y",
+	"no":    "-n",
+}
+
+// parseFsckParams parses fsck.mode=(auto|force|skip) and fsck.repair=(preen|yes|no) boot params. The root filesystem
+// is checked and repaired by default, as long as fsck is added to the image.
+func parseFsckParams() error {
+	fsckMode, fsckRepair, fsckRequested = "auto", "yes", false
+	if param, ok := cmdline["fsck.mode"]; ok {
+		if param != "auto" && param != "force" && param != "skip" {
+			return fmt.Errorf("fsck.mode: unknown mode '%s', expected one of auto, force, skip", param)
+		}
+		fsckMode = param
+		fsckRequested = param != "auto"
+	}
+	if param, ok := cmdline["fsck.repair"]; ok {
+		if _, ok := fsckRepairFlags[param]; !ok {
+			return fmt.Errorf("fsck.repair: unknown mode '%s', expected one of preen, yes, no", param)
+		}
+		fsckRepair = param
+		fsckRequested = true
+	}
+	return nil
+}
+
+// findFsck returns the filesystem specific checker if it is in the image, otherwise the generic fsck that
+// looks for the checker itself
+func findFsck(fstype string) string {
+	for _, name := range []string{"fsck." + fstype, "fsck"} {
+		for _, d := range fsckBinDirs {
+			file := filepath.Join(d, name)
+			if _, err := os.Stat(file); err == nil {
+				return file
+			}
+		}
+	}
+	return ""
+}
+
+// fsckArgs returns the arguments of the checker for the fsck.mode and fsck.repair modes
+func fsckArgs(dev string) []string {
+	args := []string{fsckRepairFlags[fsckRepair]}
+	if fsckMode == "force" {
+		args = append(args, "-f")
+	}
+	return append(args, dev)
+}
+
+// fsck checks the filesystem before it is mounted. The boot continues if the filesystem is clean or its errors are
+// corrected, it stops if errors are left uncorrected or fsck fails.
+func fsck(dev, fstype string) error {
+	if fsckMode == "skip" {
+		debug("fsck for %s is skipped with fsck.mode=skip", dev)
+		return nil
+	}
+	bin := findFsck(fstype)
+	if bin == "" {
+		if fsckRequested {
+			warning("fsck for %s is requested with a boot param but neither fsck.%s nor fsck is in the image, add them with 'fsck' or 'extra_files' config option; mounting the filesystem without the check", dev, fstype)
+		}
+		return nil
+	}
+
+	args := fsckArgs(dev)
+	debug("running %s %s", bin, strings.Join(args, " "))
+	cmd := exec.Command(bin, args...)
+	if verbosityLevel >= levelDebug || fsckRequested {
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+	}
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return fmt.Errorf("fsck for %s: unknown error %v", dev, err)
+	}
+
+	code := exitErr.ExitCode()
+	switch {
+	case code&^(fsckErrorsCorrected|fsckRebootRequired) == 0:
+		if code&fsckErrorsCorrected != 0 {
+			inform("fsck for %s: filesystem errors are corrected", dev)
+		}
+		// the filesystem is not mounted yet thus there is nothing to reboot for
+		return nil
+	case code&fsckErrorsLeft != 0 && fsckRepair == "no":
+		return fmt.Errorf("fsck for %s found errors that are left uncorrected with fsck.repair=no (code 0x%x), boot with fsck.repair=yes to correct them", dev, code)
+	case code&fsckErrorsLeft != 0:
+		return fmt.Errorf("fsck for %s: filesystem errors are left uncorrected (code 0x%x), repair the filesystem manually", dev, code)
+	default:
+		return fmt.Errorf("fsck for %s failed with code 0x%x", dev, code)
+	}
+}
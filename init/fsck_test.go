@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		fsckBinDirs = []string{"/usr/bin", "/usr/sbin", "/sbin"}
+		_ = parseFsckParams()
+	}()
+	dir := t.TempDir()
+	fsckBinDirs = []string{dir}
+	args := dir + "/args"
+
+	parse := func(params map[string]string) {
+		cmdline = params
+		if err := parseFsckParams(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func(code int) error {
+		script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$*\" > %s\nexit %d\n", args, code)
+		if err := os.WriteFile(dir+"/fsck.ext4", []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return fsck("/dev/sda1", "ext4")
+	}
+	checkArgs := func(expected string) {
+		got, err := os.ReadFile(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(got)) != expected {
+			t.Fatalf("expected fsck args '%s', got '%s'", expected, strings.TrimSpace(string(got)))
+		}
+	}
+
+	parse(map[string]string{})
+	if err := run(1); err != nil {
+		t.Fatal(err)
+	}
+	checkArgs("-y /dev/sda1")
+	if err := run(4); err == nil {
+		t.Fatal("expected uncorrected errors to fail")
+	}
+
+	parse(map[string]string{"fsck.mode": "force", "fsck.repair": "preen"})
+	if err := run(0); err != nil {
+		t.Fatal(err)
+	}
+	checkArgs("-a -f /dev/sda1")
+
+	parse(map[string]string{"fsck.repair": "no"})
+	if err := run(4); err == nil || !strings.Contains(err.Error(), "fsck.repair=no") {
+		t.Fatalf("expected uncorrected errors to fail, got %v", err)
+	}
+	checkArgs("-n /dev/sda1")
+
+	// fsck.xfs is not in the image
+	if err := fsck("/dev/sda2", "xfs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(args); err != nil {
+		t.Fatal(err)
+	}
+	parse(map[string]string{"fsck.mode": "skip"})
+	if err := run(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(args); !os.IsNotExist(err) {
+		t.Fatal("fsck is expected to be skipped")
+	}
+
+	for _, params := range []map[string]string{{"fsck.mode": "always"}, {"fsck.repair": "maybe"}} {
+		cmdline = params
+		if err := parseFsckParams(); err == nil {
+			t.Fatalf("%v: expected to fail but it did not", params)
+		}
+	}
+}
@@ -9,10 +9,12 @@ require (
 	github.com/anatol/uevent.go v1.0.1-0.20210327185707-f514f64e9887
 	github.com/goccy/go-json v0.4.13 // indirect
 	github.com/insomniacslk/dhcp v0.0.0-20210427180611-f2616923e229
+	github.com/klauspost/compress v1.12.2
 	github.com/vishvananda/netlink v1.1.0
 	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f // indirect
+	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8
 	github.com/yookoala/realpath v1.0.0
-	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	golang.org/x/net v0.0.0-20210423184538-5f58ad60dda6 // indirect
 	golang.org/x/sys v0.0.0-20210426230700-d19ff857e887
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
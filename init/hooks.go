@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runHooks runs the pre-pivot hooks in order. At this point the root filesystem is mounted at newRoot together with
+// /usr and the extra mounts. A failed fatal hook stops the boot, other failures are reported.
+func runHooks() error {
+	if len(config.Hooks) == 0 {
+		return nil
+	}
+	rootInfo, err := os.ReadFile(rootDeviceFile)
+	if err != nil && !os.IsNotExist(err) {
+		warning("%v", err)
+	}
+	env := hookEnv(rootInfo)
+	for _, h := range config.Hooks {
+		inform("running hook %s", h.Path)
+		cmd := exec.Command(h.Path)
+		cmd.Env = env
+		// a hook might need to interact with the user, e.g. to ask a passphrase
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			if h.Fatal {
+				return fmt.Errorf("hook %s: %v", h.Path, err)
+			}
+			warning("hook %s: %v", h.Path, err)
+		}
+	}
+	return nil
+}
+
+// hookEnv returns the environment of the hooks: the root mount point and the root device information saved to
+// rootDeviceFile, every KEY=value line is passed as BOOSTER_ROOT_KEY variable
+func hookEnv(rootInfo []byte) []string {
+	env := []string{"PATH=/usr/bin", "BOOSTER_ROOT=" + newRoot}
+	s := bufio.NewScanner(bytes.NewReader(rootInfo))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		env = append(env, "BOOSTER_ROOT_"+parts[0]+"="+parts[1])
+	}
+	return env
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHookEnv(t *testing.T) {
+	env := hookEnv([]byte("DEVICE=/dev/sda2\nDEVNO=8:2\nTYPE=ext4\nLABEL=my root\nREF=LABEL=my root\n"))
+	expected := []string{
+		"PATH=/usr/bin",
+		"BOOSTER_ROOT=" + newRoot,
+		"BOOSTER_ROOT_DEVICE=/dev/sda2",
+		"BOOSTER_ROOT_DEVNO=8:2",
+		"BOOSTER_ROOT_TYPE=ext4",
+		"BOOSTER_ROOT_LABEL=my root",
+		"BOOSTER_ROOT_REF=LABEL=my root",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("unexpected hook environment %q", env)
+	}
+	if env := hookEnv(nil); len(env) != 2 {
+		t.Fatalf("unexpected hook environment without the root information %q", env)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imsmMemberTimeout is the time to wait for all member disks of an IMSM container before it gets assembled degraded
+const imsmMemberTimeout = 10 * time.Second
+
+type imsmContainer struct {
+	members   []string        // paths of the discovered member disks
+	nodes     []*assemblyNode // assembly nodes of the member disks, settled once the container is assembled
+	assembled bool
+}
+
+var (
+	imsmContainers      = map[uint32]*imsmContainer{} // IMSM containers by their family number
+	imsmMemberDisks     = map[string]bool{}           // member disk names (e.g. "sda"), their partitions are not used directly
+	imsmContainersMutex sync.Mutex
+)
+
+// imsmExpectedMembers returns the number of active member disks recorded in the container disk table.
+// Spare and failed disks are not needed to assemble the volumes.
+func imsmExpectedMembers(data imsmData) int {
+	var num int
+	for _, d := range data.disks {
+		if d.status&imsmDiskConfigured != 0 && d.status&(imsmDiskFailed|imsmDiskSpare) == 0 {
+			num++
+		}
+	}
+	return num
+}
+
+// imsmDegraded returns true if the container disk table records a member disk that is failed or not configured.
+// Spare disks are not members of the volumes and do not make them degraded.
+func imsmDegraded(data imsmData) bool {
+	for _, d := range data.disks {
+		if d.status&imsmDiskSpare == 0 && (d.status&imsmDiskConfigured == 0 || d.status&imsmDiskFailed != 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleImsmBlockDevice records a member disk of an IMSM fake-RAID container. Once all the members are discovered
+// the container and its volumes are assembled with mdadm. The volumes (e.g. /dev/md126) are then processed as
+// any other block device, so their partition tables are scanned as usual.
+func handleImsmBlockDevice(info *blkInfo) error {
+	data := info.data.(imsmData)
+
+	imsmContainersMutex.Lock()
+	defer imsmContainersMutex.Unlock()
+
+	imsmMemberDisks[filepath.Base(info.path)] = true
+	if data.numVolumes == 0 {
+		debug("imsm: %s is a spare disk, skipping it", info.path)
+		return nil
+	}
+
+	c, ok := imsmContainers[data.familyNum]
+	if !ok {
+		c = &imsmContainer{}
+		imsmContainers[data.familyNum] = c
+		go waitForImsmMembers(data.familyNum)
+	}
+	if c.assembled {
+		warning("imsm: container %08x is assembled already, ignoring %s", data.familyNum, info.path)
+		return nil
+	}
+	c.members = append(c.members, info.path)
+	c.nodes = append(c.nodes, assembly.add(assemblyDevName(info), layerMd))
+
+	expected := imsmExpectedMembers(data)
+	if len(c.members) < expected {
+		debug("imsm: found %d of %d member disks of container %08x", len(c.members), expected, data.familyNum)
+		return nil
+	}
+	// a failed disk recorded in the metadata means the volumes are degraded even if all the active members are present
+	return assembleImsmContainer(data.familyNum, c, imsmDegraded(data))
+}
+
+// assembleImsmContainer assembles the container and settles its member disks so the devices stacked on
+// the volumes can be activated. imsmContainersMutex must be held.
+func assembleImsmContainer(familyNum uint32, c *imsmContainer, degraded bool) error {
+	c.assembled = true
+	err := assembleImsm(familyNum, c.members, degraded)
+	for _, n := range c.nodes {
+		assembly.settle(n)
+	}
+	return err
+}
+
+// waitForImsmMembers waits for the member disks of the container. If some of them do not appear then the container
+// is assembled with the available disks.
+func waitForImsmMembers(familyNum uint32) {
+	time.Sleep(imsmMemberTimeout)
+
+	imsmContainersMutex.Lock()
+	defer imsmContainersMutex.Unlock()
+
+	c := imsmContainers[familyNum]
+	if c.assembled {
+		return
+	}
+	warning("imsm: not all member disks of container %08x appeared, assembling it degraded", familyNum)
+	if err := assembleImsmContainer(familyNum, c, true); err != nil {
+		severe("%v", err)
+	}
+}
+
+// isImsmMemberPartition checks whether the block device is a partition of an IMSM member disk. The kernel scans
+// the partition table of RAID1 members as it is the same as the volume one, such partitions should not be used.
+func isImsmMemberPartition(devName string) bool {
+	if !isPartition(devName) {
+		return false
+	}
+	sysPath, err := filepath.EvalSymlinks("/sys/class/block/" + devName)
+	if err != nil {
+		return false
+	}
+	parent := filepath.Base(filepath.Dir(sysPath))
+
+	imsmContainersMutex.Lock()
+	defer imsmContainersMutex.Unlock()
+	return imsmMemberDisks[parent]
+}
+
+// assembleImsm assembles the container from its member disks and starts the volumes inside it.
+// Degraded volumes are started read-only.
+func assembleImsm(familyNum uint32, members []string, degraded bool) error {
+	if _, err := exec.LookPath("mdadm"); err != nil {
+		return fmt.Errorf("imsm: mdadm tool is not available in the image, add /usr/bin/mdadm to 'extra_files' in booster.yaml and regenerate the image")
+	}
+	for _, m := range []string{"md_mod", "raid0", "raid1", "raid10", "raid456"} {
+		if hasModule(m) {
+			loadModules(m).Wait()
+		}
+	}
+	if err := os.MkdirAll("/run/mdadm", 0755); err != nil {
+		return err
+	}
+
+	container := fmt.Sprintf("/dev/md/imsm%08x", familyNum)
+	inform("imsm: assembling container %s from %s", container, strings.Join(members, ", "))
+	args := append([]string{"--assemble", container}, members...)
+	if err := runMdadm(args...); err != nil {
+		return fmt.Errorf("imsm: unable to assemble container %s: %v", container, err)
+	}
+	args = []string{"--incremental", container}
+	if degraded {
+		args = append(args, "--run")
+	}
+	if err := runMdadm(args...); err != nil {
+		return fmt.Errorf("imsm: unable to start volumes of container %s: %v", container, err)
+	}
+
+	if degraded {
+		volumes, err := imsmVolumes(container)
+		if err != nil {
+			return err
+		}
+		for _, v := range volumes {
+			warning("imsm: volume %s is degraded, switching it to read-only mode", v)
+			if err := runMdadm("--readonly", v); err != nil {
+				return fmt.Errorf("imsm: %s: %v", v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// imsmVolumes returns paths of the started volumes of the container. A volume refers its container
+// with "external:/$CONTAINER/$INDEX" metadata version.
+func imsmVolumes(container string) ([]string, error) {
+	containerDev, err := filepath.EvalSymlinks(container)
+	if err != nil {
+		return nil, err
+	}
+	prefix := "external:/" + filepath.Base(containerDev) + "/"
+
+	versions, err := filepath.Glob("/sys/block/md*/md/metadata_version")
+	if err != nil {
+		return nil, err
+	}
+	var volumes []string
+	for _, f := range versions {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(string(b)), prefix) {
+			name := filepath.Base(filepath.Dir(filepath.Dir(f)))
+			volumes = append(volumes, "/dev/"+name)
+		}
+	}
+	return volumes, nil
+}
+
+func runMdadm(args ...string) error {
+	cmd := exec.Command("mdadm", args...)
+	if verbosityLevel >= levelDebug {
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+	}
+	return cmd.Run()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// imsmMetadata is the beginning of the IMSM metadata block of a RAID1 container with two disks
+// (family 5e2c1a07, volume "Volume0"), the rest of the 0x1d0-byte block is zeros
+const imsmMetadata = "496e74656c20526169642049534d20436667205369672e20312e312e30300000" +
+	"c019814ed0010000071a2c5e0300000000000000000000000201000000000000" +
+	"071a2c5e00000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"00000000000000000000000000000000000000000000000057442d574343344e" +
+	"31323334353637003060383a000000000a000000000000000000000000000000" +
+	"000000000000000057442d574343344e37363534333231003060383a01000000" +
+	"0a0000000000000000000000000000000000000000000000566f6c756d6530"
+
+// craftImsmImage places the metadata block at the end of a disk image the way mdadm does it
+func craftImsmImage(mpb []byte) []byte {
+	img := make([]byte, 1024*1024)
+	anchor := len(img) - 1024
+	copy(img[anchor:anchor+512], mpb)
+	if len(mpb) > 512 {
+		extra := mpb[512:]
+		sectors := (len(extra) + 511) / 512
+		copy(img[anchor-sectors*512:], extra)
+	}
+	return img
+}
+
+func imsmMpb(t *testing.T, size int) []byte {
+	b, err := hex.DecodeString(imsmMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb := make([]byte, size)
+	copy(mpb, b)
+	binary.LittleEndian.PutUint32(mpb[0x24:], uint32(size))
+	return mpb
+}
+
+func updateImsmChecksum(mpb []byte) {
+	binary.LittleEndian.PutUint32(mpb[0x20:], 0)
+	var sum uint32
+	for i := 0; i < len(mpb); i += 4 {
+		sum += binary.LittleEndian.Uint32(mpb[i:])
+	}
+	binary.LittleEndian.PutUint32(mpb[0x20:], sum)
+}
+
+func TestImsm(t *testing.T) {
+	probe := func(img []byte) *blkInfo {
+		return probeImsm(bytes.NewReader(img), int64(len(img)))
+	}
+
+	info := probe(craftImsmImage(imsmMpb(t, 0x1d0)))
+	if info == nil {
+		t.Fatal("unable to detect IMSM metadata")
+	}
+	if info.format != "imsm" || info.isFs {
+		t.Fatalf("unexpected format %s", info.format)
+	}
+	data := info.data.(imsmData)
+	if data.familyNum != 0x5e2c1a07 || data.numVolumes != 1 {
+		t.Fatalf("unexpected container family %08x with %d volumes", data.familyNum, data.numVolumes)
+	}
+	expectedDisks := []imsmDisk{{"WD-WCC4N1234567", 0xa}, {"WD-WCC4N7654321", 0xa}}
+	if !reflect.DeepEqual(data.disks, expectedDisks) {
+		t.Fatalf("disks = %+v, want %+v", data.disks, expectedDisks)
+	}
+	if n := imsmExpectedMembers(data); n != 2 {
+		t.Fatalf("expected 2 active members, got %d", n)
+	}
+	if imsmDegraded(data) {
+		t.Fatal("a healthy array is reported as degraded")
+	}
+	withSpare := data
+	withSpare.disks = append(append([]imsmDisk{}, data.disks...), imsmDisk{"WD-WCC4N1111111", imsmDiskSpare})
+	if imsmExpectedMembers(withSpare) != 2 || imsmDegraded(withSpare) {
+		t.Fatal("a spare disk is not expected to make the array degraded")
+	}
+
+	// degraded array, the second disk is marked as failed
+	mpb := imsmMpb(t, 0x1d0)
+	binary.LittleEndian.PutUint32(mpb[0xd8+0x30+0x18:], imsmDiskConfigured|imsmDiskFailed)
+	updateImsmChecksum(mpb)
+	info = probe(craftImsmImage(mpb))
+	if info == nil {
+		t.Fatal("unable to detect IMSM metadata of a degraded array")
+	}
+	if n := imsmExpectedMembers(info.data.(imsmData)); n != 1 {
+		t.Fatalf("expected 1 active member, got %d", n)
+	}
+	if !imsmDegraded(info.data.(imsmData)) {
+		t.Fatal("an array with a failed disk is expected to be degraded")
+	}
+
+	// a spare disk is not a member of any volume
+	mpb = imsmMpb(t, 0x1d0)
+	mpb[0x38], mpb[0x39] = 1, 0
+	binary.LittleEndian.PutUint32(mpb[0xd8+0x18:], imsmDiskSpare)
+	updateImsmChecksum(mpb)
+	info = probe(craftImsmImage(mpb))
+	if info == nil || info.data.(imsmData).numVolumes != 0 || imsmExpectedMembers(info.data.(imsmData)) != 0 {
+		t.Fatalf("unexpected spare disk info %+v", info)
+	}
+
+	// metadata larger than a sector continues at the sectors preceding the anchor
+	mpb = imsmMpb(t, 0x500)
+	mpb[0x4ff] = 0x42
+	updateImsmChecksum(mpb)
+	if probe(craftImsmImage(mpb)) == nil {
+		t.Fatal("unable to detect IMSM metadata spanning several sectors")
+	}
+
+	mpb = imsmMpb(t, 0x1d0)
+	mpb[0x100] ^= 0xff
+	if probe(craftImsmImage(mpb)) != nil {
+		t.Fatal("IMSM metadata with invalid checksum detected")
+	}
+	if probe(make([]byte, 1024*1024)) != nil {
+		t.Fatal("IMSM detected at an empty image")
+	}
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -23,3 +31,489 @@ func TestSunderMountFlags(t *testing.T) {
 	check("nodev", unix.MS_NODEV, "")
 	check("user_xattr,noatime,nobarrier,nodev,dirsync,lazytime,nolazytime,dev,rw,ro", unix.MS_NOATIME|unix.MS_DIRSYNC|unix.MS_RDONLY, "user_xattr,nobarrier")
 }
+
+func TestDescribeDiscoveredDevices(t *testing.T) {
+	discoveredDevices = map[string]*blkInfo{
+		"vdb":  {path: "/dev/vdb", format: "ext4", uuid: UUID{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4}, label: "root"},
+		"sda1": {path: "/dev/sda1", format: "vfat", uuid: UUID{0x2a, 0x3b, 0x4c, 0x5d}, label: "ESP"},
+		"sda":  {path: "/dev/sda", format: "gpt"},
+	}
+	defer func() { discoveredDevices = map[string]*blkInfo{} }()
+
+	expected := []string{
+		"sda: type=gpt UUID= LABEL=",
+		"sda1: type=vfat UUID=2a3b4c5d LABEL=ESP",
+		"vdb: type=ext4 UUID=1705d91e-bf54-4a1a-878d-721d7233eba4 LABEL=root",
+	}
+	lines := describeDiscoveredDevices()
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d: %v", len(expected), len(lines), lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Fatalf("line %d: expected '%s', got '%s'", i, expected[i], lines[i])
+		}
+	}
+}
+
+func TestWaitForDeviceSymlink(t *testing.T) {
+	dir := t.TempDir()
+	node := dir + "/dm-0"
+	if err := os.WriteFile(node, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a regular file has zero rdev
+	info := &blkInfo{path: dir + "/root", devNo: 0}
+
+	if err := waitForDeviceSymlink(info, 50*time.Millisecond); err == nil {
+		t.Fatal("expected to time out for a missing symlink")
+	}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		_ = os.Symlink(node, info.path)
+	}()
+	if err := waitForDeviceSymlink(info, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	info.devNo = unix.Mkdev(254, 0)
+	if err := waitForDeviceSymlink(info, 50*time.Millisecond); err == nil {
+		t.Fatal("expected to time out for a symlink that points to a different device")
+	}
+}
+
+func TestParseResumeParams(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdResume, resumeRequired = nil, false
+	}()
+
+	check := func(params map[string]string, ref string, required bool) {
+		cmdline = params
+		parseResumeParams()
+		if s := fmt.Sprint(cmdResume); cmdResume == nil && ref != "" || cmdResume != nil && s != ref {
+			t.Fatalf("%v: expected resume device %q, got %v", params, ref, cmdResume)
+		}
+		if resumeRequired != required {
+			t.Fatalf("%v: expected resumeRequired=%v, got %v", params, required, resumeRequired)
+		}
+	}
+	check(map[string]string{}, "", false)
+	check(map[string]string{"resume": "LABEL=swap"}, "LABEL=swap", true)
+	check(map[string]string{"resume": "UUID=foo"}, "", false)
+	// the root is not mounted before resuming from the autodiscovered swap partition either
+	check(map[string]string{"booster.resume_auto": ""}, autodiscoverySwapRef().String(), true)
+	check(map[string]string{"resume": "LABEL=swap", "booster.resume_auto": ""}, "LABEL=swap", true)
+}
+
+func TestWaitForResume(t *testing.T) {
+	defer func() {
+		resumeRequired = false
+		resumeHandled = make(chan struct{})
+	}()
+
+	resumeRequired = false
+	if resumePending() {
+		t.Fatal("resume is not expected to be pending if no resume device specified")
+	}
+
+	resumeRequired = true
+	resumeHandled = make(chan struct{})
+	if !resumePending() {
+		t.Fatal("expected resume to be pending")
+	}
+	start := time.Now()
+	waitForResume(20 * time.Millisecond)
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("expected to wait for the resume device until the timeout")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(resumeHandled)
+	}()
+	waitForResume(time.Minute)
+	if resumePending() {
+		t.Fatal("resume is not expected to be pending once the device is handled")
+	}
+}
+
+func TestProbeBlockDevices(t *testing.T) {
+	var disks []blockDisk
+	for i := 0; i < 24; i++ {
+		name := fmt.Sprintf("sd%c", 'a'+i)
+		disks = append(disks, blockDisk{name: name, partitions: []string{name + "1", name + "2", name + "3"}})
+	}
+
+	var mutex sync.Mutex
+	added := map[string]int{} // device name -> order of adding
+	add := func(devname string) error {
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		added[devname] = len(added)
+		mutex.Unlock()
+		return nil
+	}
+	if err := probeBlockDevices(disks, 8, add); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 24*4 {
+		t.Fatalf("expected %d devices to be added, got %d", 24*4, len(added))
+	}
+	for _, d := range disks {
+		prev := added[d.name]
+		for _, p := range d.partitions {
+			if added[p] < prev {
+				t.Fatalf("partition %s is added before the preceding device", p)
+			}
+			prev = added[p]
+		}
+	}
+
+	failing := func(devname string) error {
+		if devname == "sdc" {
+			return fmt.Errorf("unable to probe %s", devname)
+		}
+		return nil
+	}
+	if err := probeBlockDevices(disks, 8, failing); err == nil || err.Error() != "unable to probe sdc" {
+		t.Fatalf("expected the probing error to be returned, got %v", err)
+	}
+	if err := probeBlockDevices(nil, 8, failing); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkProbeBlockDevices simulates a system with 24 disks where probing each device takes 1ms
+func BenchmarkProbeBlockDevices(b *testing.B) {
+	var disks []blockDisk
+	for i := 0; i < 24; i++ {
+		name := fmt.Sprintf("sd%c", 'a'+i)
+		disks = append(disks, blockDisk{name: name, partitions: []string{name + "1", name + "2"}})
+	}
+	add := func(devname string) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+
+	for _, workers := range []int{1, 4, maxProbeWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := probeBlockDevices(disks, workers, add); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteRootDeviceInfo(t *testing.T) {
+	file := t.TempDir() + "/booster/root-device"
+	info := &blkInfo{
+		path:   "/dev/mapper/root",
+		devNo:  unix.Mkdev(254, 1),
+		format: "ext4",
+		uuid:   UUID{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4},
+		label:  "My Root",
+	}
+	ref := &deviceRef{format: refFsLabel, data: "My Root"}
+	writeRootDeviceInfo(file, info, ref)
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "DEVICE=/dev/mapper/root\nDEVNO=254:1\nTYPE=ext4\nUUID=1705d91e-bf54-4a1a-878d-721d7233eba4\nLABEL=My Root\nREF=LABEL=My Root\n"
+	if string(content) != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, content)
+	}
+
+	// a device without uuid and label
+	writeRootDeviceInfo(file, &blkInfo{path: "/dev/sda", format: "ext4"}, &deviceRef{format: refPath, data: "/dev/sda"})
+	content, err = os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "DEVICE=/dev/sda\nDEVNO=0:0\nTYPE=ext4\nREF=/dev/sda\n"
+	if string(content) != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, content)
+	}
+}
+
+func TestDeviceTimeout(t *testing.T) {
+	defer func() {
+		deviceTimeouts = nil
+		config.MountTimeout = 0
+	}()
+
+	config.MountTimeout = 180
+	if d := deviceTimeout(1); d != 3*time.Minute {
+		t.Fatalf("expected the mount timeout to be used by default, got %v", d)
+	}
+
+	deviceTimeouts = []time.Duration{5 * time.Second, time.Minute}
+	check := func(i int, expected time.Duration) {
+		if d := deviceTimeout(i); d != expected {
+			t.Fatalf("root #%d: expected timeout %v, got %v", i, expected, d)
+		}
+	}
+	check(0, 5*time.Second)
+	check(1, time.Minute)
+	check(2, time.Minute)
+}
+
+func TestWaitForRootTimeout(t *testing.T) {
+	defer func() {
+		deviceTimeouts = nil
+		cmdRoots, cmdRootNames, cmdRoot, activeRoot = nil, nil, nil, 0
+	}()
+
+	cmdRoots = []*deviceRef{{refPath, "/dev/nonexistent1", false}, {refPath, "/dev/nonexistent2", false}}
+	cmdRootNames = []string{"/dev/nonexistent1", "/dev/nonexistent2"}
+	cmdRoot, activeRoot = cmdRoots[0], 0
+	deviceTimeouts = []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}
+
+	rootMounted = make(chan struct{})
+	defer func() { rootMounted = make(chan struct{}) }()
+
+	err := waitForRoot()
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if activeRoot != 1 {
+		t.Fatalf("expected the fallback root to be tried, active root is #%d", activeRoot)
+	}
+	if !strings.Contains(err.Error(), "/dev/nonexistent2 within 20ms") {
+		t.Fatalf("expected the error to mention the root reference and its timeout, got: %v", err)
+	}
+}
+
+func TestWaitForRootMounted(t *testing.T) {
+	defer func() {
+		cmdRoots, cmdRootNames, cmdRoot, activeRoot = nil, nil, nil, 0
+		rootMounted = make(chan struct{})
+	}()
+	cmdRoots = []*deviceRef{{refPath, "/dev/nonexistent", false}}
+	cmdRootNames = []string{"/dev/nonexistent"}
+	cmdRoot, activeRoot = cmdRoots[0], 0
+	rootMounted = make(chan struct{})
+
+	goroutines := runtime.NumGoroutine()
+	// the root mounted by hand in rescue mode is marked the same way, marking it twice is fine
+	markRootMounted()
+	markRootMounted()
+	for i := 0; i < 10; i++ {
+		if err := waitForRoot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("waitForRoot leaks goroutines: %d before, %d after", goroutines, n)
+	}
+}
+
+func TestWaitForRootDebugShell(t *testing.T) {
+	defer func() {
+		deviceTimeouts = nil
+		cmdRoots, cmdRootNames, cmdRoot, activeRoot = nil, nil, nil, 0
+		atomic.StoreInt32(&debugShells, 0)
+	}()
+
+	cmdRoots = []*deviceRef{{refPath, "/dev/nonexistent", false}}
+	cmdRootNames = []string{"/dev/nonexistent"}
+	cmdRoot, activeRoot = cmdRoots[0], 0
+	deviceTimeouts = []time.Duration{10 * time.Millisecond}
+
+	rootMounted = make(chan struct{})
+	defer func() { rootMounted = make(chan struct{}) }()
+
+	atomic.StoreInt32(&debugShells, 1)
+	done := make(chan error)
+	go func() { done <- waitForRoot() }()
+	select {
+	case err := <-done:
+		t.Fatalf("the root timeout expired while the debug shell is open: %v", err)
+	case <-time.After(3 * debugShellPollInterval):
+	}
+
+	atomic.StoreInt32(&debugShells, 0)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected timeout error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the root timeout does not expire once the debug shell exits")
+	}
+}
+
+func TestWaitForRootPreMountBreak(t *testing.T) {
+	defer func() {
+		deviceTimeouts = nil
+		cmdRoots, cmdRootNames, cmdRoot, activeRoot = nil, nil, nil, 0
+		breakStages = map[string]bool{}
+	}()
+
+	cmdRoots = []*deviceRef{{refPath, "/dev/nonexistent", false}}
+	cmdRootNames = []string{"/dev/nonexistent"}
+	cmdRoot, activeRoot = cmdRoots[0], 0
+	deviceTimeouts = []time.Duration{time.Minute}
+	breakStages = map[string]bool{breakPreMount: true}
+
+	rootMounted = make(chan struct{})
+	defer func() { rootMounted = make(chan struct{}) }()
+
+	done := make(chan error)
+	go func() { done <- waitForRoot() }()
+
+	// the root mount goroutine waits until waitForRoot is done with the shell
+	broken := make(chan struct{})
+	go func() {
+		waitPreMountBreak()
+		close(broken)
+	}()
+	select {
+	case <-broken:
+	case <-time.After(time.Second):
+		t.Fatal("waitForRoot does not handle the pre-mount breakpoint")
+	}
+
+	markRootMounted()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitForRoot does not return once the root is mounted")
+	}
+}
+
+func TestResolveGptRefsUsrSameDisk(t *testing.T) {
+	rootRef := autodiscoveryRootRef(runtime.GOARCH)
+	usrRef := autodiscoveryUsrRef(runtime.GOARCH)
+	if rootRef == nil || usrRef == nil {
+		t.Skipf("no partitions autodiscovery for %s", runtime.GOARCH)
+	}
+	rootType, _ := parseUUID(autodiscoveryGptTypes[runtime.GOARCH])
+	usrType, _ := parseUUID(autodiscoveryUsrGptTypes[runtime.GOARCH])
+
+	cmdRoots = []*deviceRef{rootRef}
+	activeRoot = 0
+	cmdUsr, usrRequired = usrRef, false
+	defer func() {
+		cmdRoots, cmdRoot, cmdUsr = nil, nil, nil
+	}()
+
+	// a /usr partition of another disk is not used
+	resolveGptRefs("sda", []gptPart{{num: 0, typeGuid: usrType}})
+	if cmdUsr.format != refGptType {
+		t.Fatalf("/usr is not expected to be resolved without the root partition, got %s", cmdUsr)
+	}
+	resolveGptRefs("sdb", []gptPart{{num: 0, typeGuid: rootType}, {num: 1, typeGuid: usrType}})
+	if cmdRoot.String() != "/dev/sdb1" || cmdUsr.String() != "/dev/sdb2" {
+		t.Fatalf("expected root /dev/sdb1 and /usr /dev/sdb2, got %s and %s", cmdRoot, cmdUsr)
+	}
+}
+
+func TestCheckUnambiguous(t *testing.T) {
+	discoveredDevices = map[string]*blkInfo{
+		"sda1": {path: "/dev/sda1", format: "ext4", isFs: true, uuid: UUID{0x17, 0x05, 0xd9, 0x1e, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		"sdb1": {path: "/dev/sdb1", format: "ext4", isFs: true, uuid: UUID{0x17, 0x05, 0xd9, 0x1e, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+	settleTime := candidatesSettleTime
+	candidatesSettleTime = 0
+	defer func() {
+		discoveredDevices = map[string]*blkInfo{}
+		candidatesSettleTime = settleTime
+	}()
+
+	check := func(param string, expected string) {
+		ref, err := parseDeviceRef("resume", param, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkUnambiguous("resume", ref)
+		if expected == "" && err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if expected != "" && (err == nil || err.Error() != expected) {
+			t.Fatalf("%s: expected error '%s', got %v", param, expected, err)
+		}
+	}
+
+	check("UUID=1705d91e01*", "")
+	check("/dev/sdb1", "")
+	check("UUID=1705d91e*", "resume UUID=1705d91e* is ambiguous, it matches multiple devices: "+
+		"/dev/sda1 (UUID=1705d91e-0100-0000-0000-000000000000), /dev/sdb1 (UUID=1705d91e-0200-0000-0000-000000000000)")
+}
+
+func TestAmbiguousRootFailsWait(t *testing.T) {
+	ref, err := parseDeviceRef("root", "UUID=1705d91e*", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settleTime := candidatesSettleTime
+	candidatesSettleTime = 10 * time.Millisecond
+	cmdRoot, cmdRoots, rootCandidates, rootMountStarted = ref, []*deviceRef{ref}, nil, false
+	rootMounted = make(chan struct{})
+	defer func() {
+		candidatesSettleTime = settleTime
+		cmdRoot, cmdRoots, rootCandidates, rootMountStarted = nil, nil, nil, false
+		rootMounted = make(chan struct{})
+	}()
+
+	deviceRefsMutex.Lock()
+	addRootCandidate(&blkInfo{path: "/dev/sdb1", format: "ext4", isFs: true, uuid: UUID{0x17, 0x05, 0xd9, 0x1e, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}})
+	addRootCandidate(&blkInfo{path: "/dev/sda1", format: "ext4", isFs: true, uuid: UUID{0x17, 0x05, 0xd9, 0x1e, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}})
+	deviceRefsMutex.Unlock()
+
+	// the mount timeout is disabled here, the wait has to fail because of the ambiguity
+	done := make(chan error)
+	go func() { done <- waitForRoot() }()
+	select {
+	case err := <-done:
+		expected := "root UUID=1705d91e* is ambiguous, it matches multiple devices: " +
+			"/dev/sda1 (UUID=1705d91e-0100-0000-0000-000000000000), /dev/sdb1 (UUID=1705d91e-0200-0000-0000-000000000000)"
+		if err == nil || err.Error() != expected {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ambiguous root is not reported")
+	}
+}
+
+func TestPendingDeviceRefs(t *testing.T) {
+	oldRoot, oldUsr, oldUsrRequired := cmdRoot, cmdUsr, usrRequired
+	defer func() {
+		cmdRoot, cmdUsr, usrRequired = oldRoot, oldUsr, oldUsrRequired
+		rootMountStarted, usrMatched = false, false
+		luksMappings = nil
+	}()
+
+	ref := func(param string) *deviceRef {
+		r, err := parseDeviceRef("test", param, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	cmdRoot = ref("/dev/mapper/root")
+	cmdUsr, usrRequired = ref("PARTLABEL=usr"), true
+	luksMappings = []*luksMapping{
+		{ref: ref("UUID=639b8fdd-36ba-443e-be3e-e5b335935502"), name: "root"},
+		{ref: ref("PARTLABEL=home"), name: "home", found: true},
+	}
+
+	expected := []string{"root /dev/mapper/root", "luks UUID=639b8fdd-36ba-443e-be3e-e5b335935502", "/usr PARTLABEL=usr"}
+	if pending := pendingDeviceRefs(); !reflect.DeepEqual(pending, expected) {
+		t.Fatalf("expected pending references %v, got %v", expected, pending)
+	}
+
+	luksMappings[0].found = true
+	rootMountStarted, usrMatched = true, true
+	if pending := pendingDeviceRefs(); len(pending) != 0 {
+		t.Fatalf("all the references are resolved, got %v", pending)
+	}
+}
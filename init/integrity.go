@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/anatol/devmapper.go"
+)
+
+// dm-integrity superblock flags, see drivers/md/dm-integrity.c
+const (
+	integrityFlagJournalMac  = 0x1
+	integrityFlagDirtyBitmap = 0x4
+	integrityFlagFixedHmac   = 0x10
+)
+
+// integrityDefaultHashes maps the tag size to the internal hash that integritysetup uses for such tags
+var integrityDefaultHashes = map[uint16]string{
+	4:  "crc32c",
+	20: "sha1",
+	32: "sha256",
+}
+
+// handleIntegrityBlockDevice activates a standalone (non-LUKS) dm-integrity device. The mapped device appears
+// as /dev/mapper/integrity-$NAME and gets probed as any other block device.
+func handleIntegrityBlockDevice(info *blkInfo) error {
+	name := "integrity-" + filepath.Base(info.path)
+	table, err := integrityTable(info, cmdline["rd.integrity.mode"], cmdline["rd.integrity.hash"])
+	if err != nil {
+		return fmt.Errorf("dm-integrity %s: %v", info.path, err)
+	}
+
+	if hasModule("dm_integrity") {
+		loadModules("dm_integrity").Wait()
+	} else {
+		debug("dm_integrity module is not in the image, assuming it is built into the kernel")
+	}
+	// the kernel cannot request the hash implementation module itself as there is no modprobe in the image
+	_ = loadModalias("crypto-" + strings.TrimPrefix(table.Args[0], "internal_hash:"))
+
+	debug("activating dm-integrity device %s as %s, mode %s", info.path, name, table.Mode)
+	if err := devmapper.CreateAndLoad(name, "INTEGRITY-"+name, 0, table); err != nil {
+		return fmt.Errorf("dm-integrity: unable to activate %s, make sure the dm_integrity kernel module is available: %v", info.path, err)
+	}
+	return nil
+}
+
+// integrityTable builds the device mapper table for the dm-integrity device. mode and hash are the values of
+// rd.integrity.mode and rd.integrity.hash boot params, if they are empty then the values are detected from the superblock.
+func integrityTable(info *blkInfo, mode, hash string) (devmapper.IntegrityTable, error) {
+	data := info.data.(integrityData)
+
+	if data.flags&(integrityFlagJournalMac|integrityFlagFixedHmac) != 0 {
+		return devmapper.IntegrityTable{}, fmt.Errorf("keyed hashes are not supported")
+	}
+
+	switch mode {
+	case "":
+		// the activation mode is not stored in the superblock, only the bitmap mode leaves a trace there.
+		// integritysetup formats the journal even with --integrity-no-journal thus the direct mode has to be
+		// requested explicitly.
+		if data.flags&integrityFlagDirtyBitmap != 0 {
+			mode = "B" // bitmap mode
+		} else {
+			mode = "J" // journaled writes
+		}
+	case "J", "B", "D":
+	default:
+		return devmapper.IntegrityTable{}, fmt.Errorf("invalid mode %s, expected J, B or D", mode)
+	}
+
+	if hash == "" {
+		var ok bool
+		hash, ok = integrityDefaultHashes[data.tagSize]
+		if !ok {
+			return devmapper.IntegrityTable{}, fmt.Errorf("cannot detect the hash for tag size %d, specify it with rd.integrity.hash boot param", data.tagSize)
+		}
+	}
+
+	return devmapper.IntegrityTable{
+		Start:         0,
+		Length:        data.providedDataSectors,
+		BackendDevice: info.path,
+		BackendOffset: 0,
+		TagSize:       uint64(data.tagSize),
+		Mode:          mode,
+		Args:          []string{"internal_hash:" + hash, fmt.Sprintf("block_size:%d", 512<<data.sectorsPerBlockLog2)},
+	}, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIntegrityTable(t *testing.T) {
+	check := func(data integrityData, mode, hash, expectedMode string, expectedArgs ...string) {
+		table, err := integrityTable(&blkInfo{path: "/dev/sda2", data: data}, mode, hash)
+		if err != nil {
+			t.Fatalf("%+v: %v", data, err)
+		}
+		if table.Mode != expectedMode {
+			t.Fatalf("%+v: expected mode %s, got %s", data, expectedMode, table.Mode)
+		}
+		if table.Length != data.providedDataSectors || table.TagSize != uint64(data.tagSize) || table.BackendDevice != "/dev/sda2" {
+			t.Fatalf("%+v: unexpected table %+v", data, table)
+		}
+		if strings.Join(table.Args, " ") != strings.Join(expectedArgs, " ") {
+			t.Fatalf("%+v: expected args %v, got %v", data, expectedArgs, table.Args)
+		}
+	}
+
+	journaled := integrityData{tagSize: 4, providedDataSectors: 200000}
+	check(journaled, "", "", "J", "internal_hash:crc32c", "block_size:512")
+	check(integrityData{tagSize: 32, providedDataSectors: 1000, sectorsPerBlockLog2: 3}, "D", "", "D", "internal_hash:sha256", "block_size:4096")
+	check(integrityData{tagSize: 4, flags: integrityFlagDirtyBitmap}, "", "", "B", "internal_hash:crc32c", "block_size:512")
+	check(journaled, "D", "xxhash64", "D", "internal_hash:xxhash64", "block_size:512")
+
+	invalid := func(data integrityData, mode, hash string) {
+		if _, err := integrityTable(&blkInfo{path: "/dev/sda2", data: data}, mode, hash); err == nil {
+			t.Fatalf("%+v: expected to fail but it did not", data)
+		}
+	}
+	invalid(journaled, "X", "")
+	invalid(integrityData{tagSize: 8}, "", "")
+	invalid(integrityData{tagSize: 32, flags: integrityFlagFixedHmac}, "", "")
+	invalid(integrityData{tagSize: 4, flags: integrityFlagJournalMac}, "", "")
+}
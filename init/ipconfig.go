@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ipMethod is the way to configure an interface specified with ip= boot param
+type ipMethod int
+
+const (
+	ipStatic ipMethod = iota
+	ipDhcp            // DHCPv4
+	ipDhcp6           // DHCPv6, the default route comes from the router advertisements
+	ipAuto6           // IPv6 stateless address autoconfiguration (SLAAC)
+)
+
+var ipMethodNames = []string{
+	ipStatic: "static",
+	ipDhcp:   "dhcp",
+	ipDhcp6:  "dhcp6",
+	ipAuto6:  "auto6",
+}
+
+func (m ipMethod) String() string {
+	return ipMethodNames[m]
+}
+
+func (m ipMethod) isIpv6() bool {
+	return m == ipDhcp6 || m == ipAuto6
+}
+
+// ipConfig is network configuration specified with ip= boot param in the dracut format
+type ipConfig struct {
+	ifname   string // empty means all interfaces
+	method   ipMethod
+	addr     *net.IPNet // client address of the static configuration
+	gateway  net.IP
+	hostname string
+	mtu      int // 0 keeps the interface default
+}
+
+// ipv6AddressTimeout is the time to wait for the IPv6 duplicate address detection and router advertisements
+const ipv6AddressTimeout = 30 * time.Second
+
+var (
+	ipConfigs   []*ipConfig   // specified with ip= boot params
+	nameservers []net.IP      // specified with nameserver= boot params
+	linkWait    time.Duration // time to wait for carrier of every configured interface, set with booster.link_wait
+)
+
+// parseNetworkParams parses ip=, nameserver=, bond= and vlan= boot params. They take precedence over the network configuration
+// from booster.yaml.
+func parseNetworkParams() error {
+	ipConfigs, nameservers, bondConfigs, vlanConfigs, linkWait = nil, nil, nil, nil, 0
+	for _, param := range cmdlineParams("ip") {
+		c, err := parseIpParam(param)
+		if err != nil {
+			return fmt.Errorf("ip=%s: %v", param, err)
+		}
+		ipConfigs = append(ipConfigs, c)
+	}
+	for _, param := range cmdlineParams("nameserver") {
+		ip := net.ParseIP(strings.Trim(param, "[]"))
+		if ip == nil {
+			return fmt.Errorf("nameserver=%s: invalid IP address", param)
+		}
+		nameservers = append(nameservers, ip)
+	}
+	for _, param := range cmdlineParams("bond") {
+		b, err := parseBondParam(param)
+		if err != nil {
+			return fmt.Errorf("bond=%s: %v", param, err)
+		}
+		bondConfigs = append(bondConfigs, b)
+	}
+	for _, param := range cmdlineParams("vlan") {
+		v, err := parseVlanParam(param)
+		if err != nil {
+			return fmt.Errorf("vlan=%s: %v", param, err)
+		}
+		vlanConfigs = append(vlanConfigs, v)
+	}
+	if param, ok := cmdline["booster.link_wait"]; ok {
+		timeout, err := parseTimeout(param)
+		if err != nil {
+			return fmt.Errorf("booster.link_wait: %v", err)
+		}
+		linkWait = timeout
+	}
+	if len(ipConfigs) != 0 && config.Network == nil {
+		warning("ip= boot param is ignored as the image is built without network support, add 'network' to booster.yaml")
+	}
+	return nil
+}
+
+// parseIpMethod parses the autoconfiguration method field of ip= boot param
+func parseIpMethod(s string) (ipMethod, bool) {
+	switch s {
+	case "dhcp", "on", "any":
+		return ipDhcp, true
+	case "dhcp6":
+		return ipDhcp6, true
+	case "auto6":
+		return ipAuto6, true
+	default:
+		return 0, false
+	}
+}
+
+// parseIpParam parses one of the ip= boot param forms:
+//
+//	ip={dhcp|on|any|dhcp6|auto6}
+//	ip=<interface>:{dhcp|on|any|dhcp6|auto6}[:<mtu>]
+//	ip=<client-IP>:[<peer>]:<gateway-IP>:<netmask>:<hostname>:<interface>:{none|off|dhcp|on|any|dhcp6|auto6}[:<mtu>]
+//
+// IPv6 addresses are enclosed in brackets, e.g. ip=[2001:db8::10]::[2001:db8::1]:64::eth0:none.
+// The netmask is either a prefix length or an IPv4 netmask.
+func parseIpParam(param string) (*ipConfig, error) {
+	if m, ok := parseIpMethod(param); ok {
+		return &ipConfig{method: m}, nil
+	}
+
+	fields, err := splitIpFields(param)
+	if err != nil {
+		return nil, err
+	}
+	var mtu int
+	if len(fields) == 3 || len(fields) == 8 {
+		if mtu, err = parseMtu(fields[len(fields)-1]); err != nil {
+			return nil, err
+		}
+		fields = fields[:len(fields)-1]
+	}
+	switch len(fields) {
+	case 2:
+		m, ok := parseIpMethod(fields[1])
+		if !ok {
+			return nil, fmt.Errorf("unknown autoconfiguration method %s", fields[1])
+		}
+		if fields[0] == "" {
+			return nil, fmt.Errorf("interface is not specified")
+		}
+		return &ipConfig{ifname: fields[0], method: m, mtu: mtu}, nil
+	case 7:
+		c := &ipConfig{hostname: fields[4], ifname: fields[5], mtu: mtu}
+		switch fields[6] {
+		case "", "none", "off":
+			c.method = ipStatic
+		default:
+			m, ok := parseIpMethod(fields[6])
+			if !ok {
+				return nil, fmt.Errorf("unknown autoconfiguration method %s", fields[6])
+			}
+			c.method = m
+		}
+		if c.method != ipStatic {
+			return c, nil
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid client IP address '%s'", fields[0])
+		}
+		mask, err := parseIpNetmask(fields[3], ip)
+		if err != nil {
+			return nil, err
+		}
+		c.addr = &net.IPNet{IP: ip, Mask: mask}
+		if fields[2] != "" {
+			c.gateway = net.ParseIP(fields[2])
+			if c.gateway == nil {
+				return nil, fmt.Errorf("invalid gateway IP address %s", fields[2])
+			}
+			if (c.gateway.To4() == nil) != (ip.To4() == nil) {
+				return nil, fmt.Errorf("gateway %s and client address %s are of different IP versions", c.gateway, ip)
+			}
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unexpected number of fields, expected ip=<interface>:<method>[:<mtu>] or ip=<client-IP>:<peer>:<gateway-IP>:<netmask>:<hostname>:<interface>:<method>[:<mtu>]")
+	}
+}
+
+// splitIpFields splits ip= boot param by colons, the fields enclosed in brackets are IPv6 addresses and might contain
+// colons themselves
+func splitIpFields(param string) ([]string, error) {
+	var fields []string
+	for {
+		var field string
+		if strings.HasPrefix(param, "[") {
+			end := strings.IndexByte(param, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("missing closing bracket in %s", param)
+			}
+			field, param = param[1:end], param[end+1:]
+			if param != "" && param[0] != ':' {
+				return nil, fmt.Errorf("unexpected characters after IP address %s", field)
+			}
+		} else if idx := strings.IndexByte(param, ':'); idx != -1 {
+			field, param = param[:idx], param[idx:]
+		} else {
+			field, param = param, ""
+		}
+		fields = append(fields, field)
+		if param == "" {
+			return fields, nil
+		}
+		param = param[1:] // the colon
+	}
+}
+
+// parseIpNetmask parses the netmask field, an empty netmask means /64 for IPv6 addresses
+func parseIpNetmask(s string, ip net.IP) (net.IPMask, error) {
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	if s == "" {
+		if bits == 8*net.IPv4len {
+			return nil, fmt.Errorf("netmask is not specified for %s", ip)
+		}
+		return net.CIDRMask(64, bits), nil
+	}
+	if isDigits(s) {
+		prefix, err := strconv.Atoi(s)
+		if err != nil || prefix > bits {
+			return nil, fmt.Errorf("invalid prefix length %s", s)
+		}
+		return net.CIDRMask(prefix, bits), nil
+	}
+	mask := net.ParseIP(s).To4()
+	if mask == nil || bits != 8*net.IPv4len {
+		return nil, fmt.Errorf("invalid netmask %s", s)
+	}
+	if ones, _ := net.IPMask(mask).Size(); ones == 0 && !mask.Equal(net.IPv4zero) {
+		return nil, fmt.Errorf("netmask %s is not contiguous", s)
+	}
+	return net.IPMask(mask), nil
+}
+
+// parseMtu parses MTU of an interface, an empty value means the interface default
+func parseMtu(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mtu, err := strconv.Atoi(s)
+	if err != nil || mtu < 68 || mtu > 65535 {
+		return 0, fmt.Errorf("invalid MTU %s", s)
+	}
+	return mtu, nil
+}
+
+// ipConfigsMtu returns the MTU requested for the interface, the largest one wins if several ip= params specify it
+func ipConfigsMtu(configs []*ipConfig) int {
+	mtu := 0
+	for _, c := range configs {
+		if c.mtu > mtu {
+			mtu = c.mtu
+		}
+	}
+	return mtu
+}
+
+// waitForCarrier waits until the interface operational state is up, e.g. a switch port with spanning tree enabled
+// starts forwarding frames only several seconds after the link is up
+func waitForCarrier(ifname string, timeout time.Duration) error {
+	start := time.Now()
+	for {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return err
+		}
+		if link.Attrs().OperState == netlink.OperUp {
+			debug("%s: carrier is up after %v", ifname, time.Since(start))
+			return nil
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("%s: no carrier within %v", ifname, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// ipConfigsFor returns the ip= configurations that apply to the interface
+func ipConfigsFor(ifname string) []*ipConfig {
+	var result []*ipConfig
+	for _, c := range ipConfigs {
+		if c.ifname == "" || c.ifname == ifname {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// prepareIpv6 enables IPv6 router advertisements at the interface, it needs to be done before the link is up
+// so the router solicitation is sent right away
+func prepareIpv6(ifname string, configs []*ipConfig) {
+	autoconf := false
+	required := false
+	for _, c := range configs {
+		required = required || c.method.isIpv6() || (c.addr != nil && c.addr.IP.To4() == nil)
+		autoconf = autoconf || c.method == ipAuto6
+	}
+	if !required {
+		return
+	}
+	if hasModule("ipv6") {
+		loadModules("ipv6").Wait()
+	}
+
+	settings := map[string]string{"accept_ra": "1", "disable_ipv6": "0"}
+	if autoconf {
+		settings["autoconf"] = "1"
+	}
+	for name, value := range settings {
+		file := "/proc/sys/net/ipv6/conf/" + ifname + "/" + name
+		if err := os.WriteFile(file, []byte(value), 0644); err != nil {
+			warning("%s: %v", ifname, err)
+		}
+	}
+}
+
+// configureIp applies ip= configuration to the interface
+func configureIp(link netlink.Link, c *ipConfig) error {
+	ifname := link.Attrs().Name
+	debug("%s: configuring %s network", ifname, c.method)
+
+	switch c.method {
+	case ipDhcp:
+		return runDhcp(ifname)
+	case ipDhcp6:
+		return runDhcp6(link)
+	case ipAuto6:
+		addr, err := waitForIpv6Address(link, true, ipv6AddressTimeout)
+		if err != nil {
+			return err
+		}
+		inform("%s: autoconfigured address %s", ifname, addr)
+		return nil
+	}
+
+	addr := netlink.Addr{IPNet: c.addr}
+	if c.addr.IP.To4() == nil {
+		// the address is assigned by the administrator, do not wait for the duplicate address detection
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	if err := netlink.AddrAdd(link, &addr); err != nil {
+		return err
+	}
+	if c.gateway != nil {
+		defaultRoute := netlink.Route{LinkIndex: link.Attrs().Index, Gw: c.gateway}
+		if err := netlink.RouteAdd(&defaultRoute); err != nil {
+			return err
+		}
+	}
+	if c.hostname != "" {
+		if err := unix.Sethostname([]byte(c.hostname)); err != nil {
+			warning("unable to set hostname %s: %v", c.hostname, err)
+		}
+	}
+	return nil
+}
+
+// runDhcp6 requests an address with DHCPv6. The default route is configured by the kernel from the router advertisements.
+func runDhcp6(link netlink.Link) error {
+	ifname := link.Attrs().Name
+	// the solicit message is sent from the link-local address
+	if _, err := waitForIpv6Address(link, false, ipv6AddressTimeout); err != nil {
+		return err
+	}
+
+	client, err := nclient6.New(ifname)
+	if err != nil {
+		return fmt.Errorf("DHCPv6: %v", err)
+	}
+	defer client.Close()
+
+	var reply *dhcpv6.Message
+	for i := 0; i < 40; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		advertise, err := client.Solicit(ctx)
+		if err == nil {
+			reply, err = client.Request(ctx, advertise)
+		}
+		cancel()
+		if err == nil {
+			break
+		}
+		debug("DHCPv6: %v", err)
+		time.Sleep(time.Second)
+	}
+	if reply == nil {
+		return fmt.Errorf("DHCPv6: no reply received")
+	}
+
+	iana := reply.Options.OneIANA()
+	if iana == nil || iana.Options.OneAddress() == nil {
+		return fmt.Errorf("DHCPv6: no address assigned")
+	}
+	ip := iana.Options.OneAddress().IPv6Addr
+	addr := netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, Flags: unix.IFA_F_NODAD}
+	if err := netlink.AddrAdd(link, &addr); err != nil {
+		return err
+	}
+	inform("%s: DHCPv6 address %s", ifname, ip)
+
+	if dns := reply.Options.DNS(); len(dns) != 0 {
+		return addDNSServers(dns)
+	}
+	return nil
+}
+
+// waitForIpv6Address waits until the interface has a usable IPv6 address, either a global or a link-local one
+func waitForIpv6Address(link netlink.Link, global bool, timeout time.Duration) (net.IP, error) {
+	start := time.Now()
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if a.Flags&(unix.IFA_F_TENTATIVE|unix.IFA_F_DADFAILED) != 0 {
+				continue
+			}
+			if (global && a.IP.IsGlobalUnicast()) || (!global && a.IP.IsLinkLocalUnicast()) {
+				return a.IP, nil
+			}
+		}
+		if time.Since(start) > timeout {
+			kind := "link-local"
+			if global {
+				kind = "global"
+			}
+			return nil, fmt.Errorf("%s: no %s IPv6 address within %v", link.Attrs().Name, kind, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+var (
+	dnsServers      []net.IP
+	dnsServersMutex sync.Mutex
+)
+
+// addDNSServers adds the servers to /etc/resolv.conf. Servers of all the configured interfaces and address families
+// are used, the ones specified with nameserver= boot param go first.
+func addDNSServers(servers []net.IP) error {
+	dnsServersMutex.Lock()
+	defer dnsServersMutex.Unlock()
+
+	if dnsServers == nil {
+		dnsServers = append(dnsServers, nameservers...)
+	}
+	for _, s := range servers {
+		known := false
+		for _, d := range dnsServers {
+			if d.Equal(s) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			dnsServers = append(dnsServers, s)
+		}
+	}
+	return writeResolvConf(dnsServers)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseIpParam(t *testing.T) {
+	check := func(param string, expected ipConfig) {
+		c, err := parseIpParam(param)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if !reflect.DeepEqual(*c, expected) {
+			t.Fatalf("%s: expected %+v, got %+v", param, expected, *c)
+		}
+	}
+	ipNet := func(ip string, prefix int) *net.IPNet {
+		addr := net.ParseIP(ip)
+		bits := 128
+		if addr.To4() != nil {
+			bits = 32
+		}
+		return &net.IPNet{IP: addr, Mask: net.CIDRMask(prefix, bits)}
+	}
+
+	check("dhcp", ipConfig{method: ipDhcp})
+	check("auto6", ipConfig{method: ipAuto6})
+	check("eth0:dhcp6", ipConfig{ifname: "eth0", method: ipDhcp6})
+	check("enp1s0:on", ipConfig{ifname: "enp1s0", method: ipDhcp})
+	check("10.0.2.15::10.0.2.2:255.255.255.0:client:eth0:none", ipConfig{ifname: "eth0", method: ipStatic, addr: ipNet("10.0.2.15", 24), gateway: net.ParseIP("10.0.2.2"), hostname: "client"})
+	check("10.0.2.15:::16:::", ipConfig{method: ipStatic, addr: ipNet("10.0.2.15", 16)})
+	check("[2001:db8::10]::[2001:db8::1]:64::eth0:none", ipConfig{ifname: "eth0", method: ipStatic, addr: ipNet("2001:db8::10", 64), gateway: net.ParseIP("2001:db8::1")})
+	check("[fd00::5]::[fe80::1]:::eth1:off", ipConfig{ifname: "eth1", method: ipStatic, addr: ipNet("fd00::5", 64), gateway: net.ParseIP("fe80::1")})
+	check(":::::eth0:auto6", ipConfig{ifname: "eth0", method: ipAuto6})
+	check("eth0:dhcp:9000", ipConfig{ifname: "eth0", method: ipDhcp, mtu: 9000})
+	check("10.0.2.15::10.0.2.2:24::eth0:none:9000", ipConfig{ifname: "eth0", method: ipStatic, addr: ipNet("10.0.2.15", 24), gateway: net.ParseIP("10.0.2.2"), mtu: 9000})
+	check("eth0:dhcp:", ipConfig{ifname: "eth0", method: ipDhcp})
+
+	for _, param := range []string{
+		"static",
+		"eth0:none",
+		":dhcp",
+		"eth0:dhcp:jumbo",
+		"eth0:dhcp:40",
+		"eth0:dhcp:1500:52-54-00-12-34-56",
+		"[2001:db8::10::[2001:db8::1]:64::eth0:none",
+		"[2001:db8::10]x::[2001:db8::1]:64::eth0:none",
+		"10.0.2.15::10.0.2.2:::eth0:none",
+		"10.0.2.15::10.0.2.2:255.0.255.0::eth0:none",
+		"10.0.2.15::10.0.2.2:33::eth0:none",
+		"10.0.2.15::[2001:db8::1]:24::eth0:none",
+		"10.0.2.15::10.0.2.2:24::eth0:bootp",
+		"10.0.2::10.0.2.2:24::eth0:none",
+	} {
+		if _, err := parseIpParam(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+func TestIpConfigsFor(t *testing.T) {
+	defer func() { ipConfigs = nil }()
+
+	ipConfigs = []*ipConfig{{ifname: "eth0", method: ipDhcp}, {ifname: "eth0", method: ipAuto6}, {ifname: "eth1", method: ipDhcp6}}
+	if c := ipConfigsFor("eth0"); len(c) != 2 || c[0].method != ipDhcp || c[1].method != ipAuto6 {
+		t.Fatalf("unexpected dual-stack configuration of eth0: %v", c)
+	}
+	if c := ipConfigsFor("eth2"); len(c) != 0 {
+		t.Fatalf("eth2 is not expected to be configured: %v", c)
+	}
+	ipConfigs = append(ipConfigs, &ipConfig{method: ipDhcp})
+	if c := ipConfigsFor("eth2"); len(c) != 1 || c[0].method != ipDhcp {
+		t.Fatalf("unexpected configuration of eth2: %v", c)
+	}
+}
+
+func TestIpConfigsMtu(t *testing.T) {
+	if mtu := ipConfigsMtu([]*ipConfig{{method: ipDhcp}, {method: ipAuto6}}); mtu != 0 {
+		t.Fatalf("expected the default MTU, got %d", mtu)
+	}
+	if mtu := ipConfigsMtu([]*ipConfig{{method: ipDhcp, mtu: 1500}, {method: ipAuto6, mtu: 9000}}); mtu != 9000 {
+		t.Fatalf("expected MTU 9000, got %d", mtu)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// luksKeyfileDefaultTimeout is the time to wait for the keyfile device before falling back to other ways to unlock
+	luksKeyfileDefaultTimeout = 10 * time.Second
+	keyfileMountDir           = "/run/booster/keyfile"
+)
+
+// deviceFileMutex serializes readDeviceFile calls. Devices of several LUKS mappings are unlocked concurrently
+// and their keyfiles (or detached headers) share the mount directory.
+var deviceFileMutex sync.Mutex
+
+// luksKeyfile is a LUKS keyfile stored at a removable device, specified with rd.luks.keyfile=$DEVICE:$PATH boot param.
+// A keyfile of a crypttab line might be stored in the image, the device is nil then.
+type luksKeyfile struct {
+	device *deviceRef
+	path   string // path of the keyfile at the device filesystem
+}
+
+func (k *luksKeyfile) String() string {
+	if k.device == nil {
+		return k.path
+	}
+	return k.device.String() + ":" + k.path
+}
+
+// parseLuksKeyfile parses rd.luks.keyfile=$DEVICE:$PATH boot param, e.g. rd.luks.keyfile=LABEL=keystick:/secrets/root.key.
+// The device part uses the same format as root=.
+func parseLuksKeyfile(param string) (*luksKeyfile, error) {
+	ref, path, err := parseDeviceFile("rd.luks.keyfile", param)
+	if err != nil {
+		return nil, err
+	}
+	return &luksKeyfile{device: ref, path: path}, nil
+}
+
+// parseDeviceFile parses $DEVICE:$PATH value of the boot param key. The device part uses the same format as root=
+// and has to be a local filesystem.
+func parseDeviceFile(key, param string) (*deviceRef, string, error) {
+	idx := strings.Index(param, ":/")
+	if idx == -1 {
+		return nil, "", fmt.Errorf("invalid %s kernel parameter %s, expected format %s=<device>:<path>", key, param, key)
+	}
+	ref, err := parseDeviceRef(key, param[:idx], false)
+	if err != nil {
+		return nil, "", err
+	}
+	if ref.isNetwork() || ref.isZfs() {
+		return nil, "", fmt.Errorf("%s: %s is not a local filesystem", key, ref)
+	}
+	path := filepath.Clean(param[idx+1:])
+	if path == "/" {
+		return nil, "", fmt.Errorf("%s: file path is not specified in %s", key, param)
+	}
+	return ref, path, nil
+}
+
+// luksKeyfileTimeout returns the time to wait for the keyfile device, it is set with keyfile-timeout rd.luks.options
+// in the crypttab format, e.g. rd.luks.options=keyfile-timeout=30s
+func luksKeyfileTimeout(options string) time.Duration {
+	for _, o := range strings.Split(options, ",") {
+		if !strings.HasPrefix(o, "keyfile-timeout=") {
+			continue
+		}
+		timeout, err := parseTimeout(strings.TrimPrefix(o, "keyfile-timeout="))
+		if err != nil {
+			warning("rd.luks.options: %v", err)
+			break
+		}
+		return timeout
+	}
+	return luksKeyfileDefaultTimeout
+}
+
+// waitForKeyfileDevice waits for a filesystem that matches the keyfile device reference to be discovered
+func waitForKeyfileDevice(k *luksKeyfile, timeout time.Duration) (*blkInfo, error) {
+	info, err := waitForFileDevice(&k.device, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile %v", err)
+	}
+	return info, nil
+}
+
+// waitForFileDevice waits for a filesystem that matches the device reference to be discovered. The reference
+// is read under deviceRefsMutex as GPT references get resolved in place.
+func waitForFileDevice(device **deviceRef, timeout time.Duration) (*blkInfo, error) {
+	start := time.Now()
+	for {
+		deviceRefsMutex.Lock()
+		ref := *device
+		deviceRefsMutex.Unlock()
+
+		if devices := resolveAll(ref); len(devices) != 0 {
+			return devices[0], nil
+		}
+		if time.Since(start) > timeout {
+			return nil, fmt.Errorf("device %s did not appear within %v", ref, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// readLuksKeyfile mounts the keyfile device read-only and reads the keyfile. The device gets unmounted right away.
+// The caller needs to zero the returned key once it is used.
+func readLuksKeyfile(k *luksKeyfile, timeout time.Duration) ([]byte, error) {
+	var key []byte
+	var err error
+	if k.device == nil {
+		key, err = os.ReadFile(k.path)
+	} else {
+		var info *blkInfo
+		info, err = waitForKeyfileDevice(k, timeout)
+		if err != nil {
+			return nil, err
+		}
+		key, err = readDeviceFile(info, keyfileMountDir, k.path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keyfile %s: %v", k, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("keyfile %s is empty", k)
+	}
+	return key, nil
+}
+
+// readDeviceFile mounts the filesystem read-only at dir, reads the file and unmounts the filesystem right away
+func readDeviceFile(info *blkInfo, dir, path string) ([]byte, error) {
+	loadModules(info.format).Wait()
+
+	deviceFileMutex.Lock()
+	defer deviceFileMutex.Unlock()
+
+	if err := mount(info.path, dir, info.format, unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := unix.Unmount(dir, 0); err != nil {
+			warning("unmount(%s): %v", dir, err)
+			return
+		}
+		_ = os.Remove(dir)
+	}()
+
+	return os.ReadFile(filepath.Join(dir, path))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLuksKeyfile(t *testing.T) {
+	check := func(param, expectedRef, expectedPath string) {
+		k, err := parseLuksKeyfile(param)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if k.device.String() != expectedRef || k.path != expectedPath {
+			t.Fatalf("%s: expected keyfile %s at %s, got %s at %s", param, expectedPath, expectedRef, k.path, k.device)
+		}
+	}
+
+	check("LABEL=keystick:/secrets/root.key", "LABEL=keystick", "/secrets/root.key")
+	check("UUID=2a3b-4c5d:/root.key", "UUID=2a3b4c5d", "/root.key")
+	check("/dev/disk/by-path/pci-0000:00:14.0-part1:/keys/../root.key", "/dev/disk/by-path/pci-0000:00:14.0-part1", "/root.key")
+	check("8:17:/root.key", "8:17", "/root.key")
+
+	for _, param := range []string{"LABEL=keystick", "LABEL=keystick:/", "secrets/root.key", "nbd=10.0.2.2:keys:/root.key", "FOO=bar:/root.key"} {
+		if _, err := parseLuksKeyfile(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+func TestLuksKeyfileTimeout(t *testing.T) {
+	if d := luksKeyfileTimeout(""); d != luksKeyfileDefaultTimeout {
+		t.Fatalf("expected the default keyfile timeout, got %v", d)
+	}
+	if d := luksKeyfileTimeout("discard,keyfile-timeout=30s"); d != 30*time.Second {
+		t.Fatalf("expected keyfile timeout 30s, got %v", d)
+	}
+}
+
+func TestWaitForKeyfileDevice(t *testing.T) {
+	defer func() {
+		discoveredDevices = map[string]*blkInfo{}
+		discoveredOrder = nil
+	}()
+
+	k, err := parseLuksKeyfile("LABEL=keystick:/root.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waitForKeyfileDevice(k, 20*time.Millisecond); err == nil {
+		t.Fatal("expected absent keyfile device to time out")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		discoveredDevicesMutex.Lock()
+		discoveredDevices["sdb1"] = &blkInfo{path: "/dev/sdb1", format: "vfat", isFs: true, label: "keystick"}
+		discoveredOrder = append(discoveredOrder, "sdb1")
+		discoveredDevicesMutex.Unlock()
+	}()
+	info, err := waitForKeyfileDevice(k, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.path != "/dev/sdb1" {
+		t.Fatalf("unexpected keyfile device %s", info.path)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// liveDir is where the live image and its writable layer are mounted to. It is moved to the new root together with /run.
+	liveDir = "/run/booster/live"
+	// liveDefaultImage is the squashfs image path at the live medium, the same as dracut uses
+	liveDefaultImage = "/LiveOS/squashfs.img"
+)
+
+var (
+	liveMode  bool   // enabled with booster.live=1 boot param
+	liveImage string // squashfs image at the live medium, set with booster.live_image boot param
+)
+
+// parseLiveParams parses booster.live=1 and booster.live_image=$PATH boot params
+func parseLiveParams() error {
+	param, ok := cmdline["booster.live"]
+	if !ok {
+		return nil
+	}
+	switch param {
+	case "1":
+		liveMode = true
+	case "0":
+		liveMode = false
+	default:
+		return fmt.Errorf("invalid booster.live kernel parameter %s, expected booster.live=1", param)
+	}
+
+	liveImage = liveDefaultImage
+	if image, ok := cmdline["booster.live_image"]; ok {
+		if !strings.HasPrefix(image, "/") {
+			return fmt.Errorf("booster.live_image: path %s is not absolute", image)
+		}
+		liveImage = image
+	}
+	return nil
+}
+
+// mountLiveRoot mounts the squashfs root device read-only and assembles an overlay with a tmpfs writable layer as
+// the new root. If the root device is not a squashfs itself then it is a live medium with the squashfs image file.
+func mountLiveRoot(info *blkInfo) error {
+	if err := loadFilesystemModule("squashfs"); err != nil {
+		return err
+	}
+	if err := loadFilesystemModule("overlay"); err != nil {
+		return err
+	}
+
+	squashfsDev := info.path
+	if info.format != "squashfs" {
+		mediumDir := liveDir + "/medium"
+		if err := loadFilesystemModule(info.format); err != nil {
+			return err
+		}
+		if err := mount(info.path, mediumDir, info.format, unix.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("live medium %s: %v", info.path, err)
+		}
+		image := mediumDir + liveImage
+		if _, err := os.Stat(image); err != nil {
+			return fmt.Errorf("live image %s is not found at %s: %v", liveImage, info.path, err)
+		}
+		loadModules("loop").Wait()
+		loop, err := attachLoopDeviceMode(image, false, true)
+		if err != nil {
+			return err
+		}
+		squashfsDev = "/dev/" + loop
+	}
+
+	lowerDir := liveDir + "/squashfs"
+	if err := mount(squashfsDev, lowerDir, "squashfs", unix.MS_RDONLY, ""); err != nil {
+		return err
+	}
+	return mountTmpfsOverlay([]string{lowerDir}, liveDir+"/rw")
+}
+
+// filesystemModules maps the filesystems to the kernel modules providing them if the names differ
+var filesystemModules = map[string]string{
+	"iso9660": "isofs",
+}
+
+// loadFilesystemModule makes sure the filesystem is supported by the kernel, the module is loaded on demand
+// if it is not built into the kernel
+func loadFilesystemModule(fs string) error {
+	if filesystemSupported(fs) {
+		return nil
+	}
+	mod := fs
+	if m, ok := filesystemModules[fs]; ok {
+		mod = m
+	}
+	if !hasModule(mod) {
+		return fmt.Errorf("%s filesystem is not supported by the kernel and its module is not in the image, add it with 'modules: %s' in booster.yaml", fs, mod)
+	}
+	loadModules(mod).Wait()
+	if !filesystemSupported(fs) {
+		return fmt.Errorf("%s filesystem is not available after loading its module", fs)
+	}
+	return nil
+}
+
+func filesystemSupported(fs string) bool {
+	data, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	return procFilesystemsContains(data, fs)
+}
+
+// procFilesystemsContains checks whether /proc/filesystems content lists the filesystem, every line is
+// "[nodev]\t$FS"
+func procFilesystemsContains(data []byte, fs string) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 0 && fields[len(fields)-1] == fs {
+			return true
+		}
+	}
+	return false
+}
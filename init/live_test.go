@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLiveParams(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		liveMode, liveImage = false, ""
+	}()
+
+	check := func(params map[string]string, expectedMode bool, expectedImage string) {
+		cmdline = params
+		liveMode, liveImage = false, ""
+		if err := parseLiveParams(); err != nil {
+			t.Fatalf("%v: %v", params, err)
+		}
+		if liveMode != expectedMode || liveImage != expectedImage {
+			t.Fatalf("%v: expected live mode %v with image '%s', got %v with '%s'", params, expectedMode, expectedImage, liveMode, liveImage)
+		}
+	}
+
+	check(map[string]string{}, false, "")
+	check(map[string]string{"booster.live": "1"}, true, "/LiveOS/squashfs.img")
+	check(map[string]string{"booster.live": "1", "booster.live_image": "/images/root.sfs"}, true, "/images/root.sfs")
+
+	for _, params := range []map[string]string{{"booster.live": "yes"}, {"booster.live": "1", "booster.live_image": "root.sfs"}} {
+		cmdline = params
+		if err := parseLiveParams(); err == nil {
+			t.Fatalf("%v: expected to fail but it did not", params)
+		}
+	}
+}
+
+func TestProcFilesystemsContains(t *testing.T) {
+	data := []byte("nodev\tsysfs\nnodev\ttmpfs\n\text4\n\tsquashfs\nnodev\toverlay\n")
+	for _, fs := range []string{"squashfs", "overlay", "ext4"} {
+		if !procFilesystemsContains(data, fs) {
+			t.Fatalf("%s is expected to be supported", fs)
+		}
+	}
+	if procFilesystemsContains(data, "btrfs") || procFilesystemsContains(data, "nodev") {
+		t.Fatal("unexpected filesystem is reported as supported")
+	}
+}
@@ -3,43 +3,217 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
-	// TOTHINK rename to debug/info/warning
 	levelSevere = iota
 	levelWarning
+	levelInfo
 	levelDebug
 )
 
+// logLevelNames are the values accepted by booster.log_level boot param
+var logLevelNames = []string{
+	levelSevere:  "error",
+	levelWarning: "warn",
+	levelInfo:    "info",
+	levelDebug:   "debug",
+}
+
+// kernel log priorities the messages are written with to kmsg
+var kmsgLevels = []int{
+	levelSevere:  4,
+	levelWarning: 6,
+	levelInfo:    6,
+	levelDebug:   7,
+}
+
+const (
+	defaultLogBufferSize = 256
+	logFile              = "/run/booster/log"
+)
+
 var (
 	verbosityLevel = levelWarning // by default show warnings and errors
 
 	kmsg *os.File
+
+	logs = newLogBuffer(defaultLogBufferSize) // resized with booster.log_buffer boot param
 )
 
-func printMessage(format string, kLevel int, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	fmt.Println(msg)
-	_, _ = fmt.Fprint(kmsg, "<", kLevel, ">booster: ", msg)
+type logEntry struct {
+	msg   string
+	shown bool // printed to the console already
 }
 
-func debug(format string, v ...interface{}) {
-	if verbosityLevel >= levelDebug {
-		printMessage(format, 7, v...)
+// logBuffer keeps the last messages of all levels including the ones suppressed by the verbosity level,
+// so a quiet boot stays diagnosable if it fails
+type logBuffer struct {
+	mu      sync.Mutex
+	entries []logEntry // ring buffer, start is the oldest entry once the buffer is full
+	start   int
+	size    int
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{size: size}
+}
+
+func (b *logBuffer) enabled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size != 0
+}
+
+func (b *logBuffer) add(msg string, shown bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.size == 0 {
+		return
 	}
+	e := logEntry{msg: msg, shown: shown}
+	if len(b.entries) < b.size {
+		b.entries = append(b.entries, e)
+		return
+	}
+	b.entries[b.start] = e
+	b.start = (b.start + 1) % b.size
 }
 
-func warning(format string, v ...interface{}) {
-	if verbosityLevel >= levelWarning {
-		printMessage(format, 6, v...)
+// ordered returns the entries from the oldest to the newest, b.mu has to be held
+func (b *logBuffer) ordered() []logEntry {
+	return append(append([]logEntry{}, b.entries[b.start:]...), b.entries[:b.start]...)
+}
+
+// resize changes the buffer size keeping the newest messages
+func (b *logBuffer) resize(size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := b.ordered()
+	if len(entries) > size {
+		entries = entries[len(entries)-size:]
 	}
+	b.entries, b.start, b.size = entries, 0, size
 }
 
-func severe(format string, v ...interface{}) {
-	if verbosityLevel >= levelSevere {
-		printMessage(format, 4, v...)
+// suppressed returns the messages that have not been shown at the console and marks them as shown
+func (b *logBuffer) suppressed() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var result []string
+	for i := range b.entries {
+		e := &b.entries[(b.start+i)%len(b.entries)]
+		if !e.shown {
+			result = append(result, e.msg)
+			e.shown = true
+		}
+	}
+	return result
+}
+
+// messages returns all the buffered messages
+func (b *logBuffer) messages() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var result []string
+	for _, e := range b.ordered() {
+		result = append(result, e.msg)
+	}
+	return result
+}
+
+// parseLogBufferParam parses booster.log_buffer=N boot param, the number of the last messages to keep
+func parseLogBufferParam() {
+	param, ok := cmdline["booster.log_buffer"]
+	if !ok {
+		return
+	}
+	size, err := strconv.Atoi(param)
+	if err != nil || size < 0 {
+		warning("booster.log_buffer: invalid buffer size %s, expected a non-negative number of messages", param)
+		return
 	}
+	logs.resize(size)
+}
+
+// writeLogFile saves the buffered messages to /run/booster/log, the file is available after switching to the real root
+func writeLogFile() {
+	msgs := logs.messages()
+	if len(msgs) == 0 {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
+		return
+	}
+	// the messages might include secrets passed with the boot params, the file is readable by root only
+	_ = os.WriteFile(logFile, []byte(strings.Join(msgs, "\n")+"\n"), 0600)
+}
+
+// parseLogLevel converts a booster.log_level boot param value to a verbosity level
+func parseLogLevel(name string) (int, error) {
+	for level, n := range logLevelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s, expected one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// formatMessage prepends a message with the time elapsed since boot and the message level, e.g.
+// "[    1.234567] booster: warn: message"
+func formatMessage(level int, uptime uint64, msg string) string {
+	return fmt.Sprintf("[%5d.%06d] booster: %s: %s", uptime/1000000, uptime%1000000, logLevelNames[level], msg)
+}
+
+func logf(level int, format string, v ...interface{}) {
+	show := verbosityLevel >= level
+	if !show && !logs.enabled() {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	uptime, _ := readClock(unix.CLOCK_MONOTONIC)
+	line := formatMessage(level, uptime, msg)
+
+	if level == levelSevere {
+		// show what happened before the error
+		if suppressed := logs.suppressed(); len(suppressed) != 0 {
+			fmt.Println("booster: the last messages before the error:")
+			for _, s := range suppressed {
+				fmt.Println(s)
+			}
+		}
+	}
+	logs.add(line, show)
+	if show {
+		fmt.Println(line)
+		_, _ = fmt.Fprint(kmsg, "<", kmsgLevels[level], ">booster: ", msg)
+	}
+	if level == levelSevere {
+		writeLogFile()
+	}
+}
+
+// debug, inform, warning and severe are shortcuts for the messages of the corresponding level
+func debug(format string, v ...interface{}) {
+	logf(levelDebug, format, v...)
+}
+
+func inform(format string, v ...interface{}) {
+	logf(levelInfo, format, v...)
+}
+
+func warning(format string, v ...interface{}) {
+	logf(levelWarning, format, v...)
+}
+
+func severe(format string, v ...interface{}) {
+	logf(levelSevere, format, v...)
 }
 
 const sysKmsgFile = "/proc/sys/kernel/printk_devkmsg"
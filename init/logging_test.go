@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLogLevels(t *testing.T) {
+	for _, name := range []string{"error", "warn", "info", "debug"} {
+		level, err := parseLogLevel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if logLevelNames[level] != name {
+			t.Fatalf("%s: parsed as level %d", name, level)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Fatal("expected to fail for an unknown level")
+	}
+
+	check := func(level int, uptime uint64, msg, expected string) {
+		if out := formatMessage(level, uptime, msg); out != expected {
+			t.Fatalf("expected '%s', got '%s'", expected, out)
+		}
+	}
+	check(levelWarning, 1234567, "hello", "[    1.234567] booster: warn: hello")
+	check(levelDebug, 98765432100, "x", "[98765.432100] booster: debug: x")
+	check(levelSevere, 5, "", "[    0.000005] booster: error: ")
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(3)
+	for i := 1; i <= 5; i++ {
+		b.add(fmt.Sprintf("msg%d", i), i%2 == 0)
+	}
+	if msgs := b.messages(); !reflect.DeepEqual(msgs, []string{"msg3", "msg4", "msg5"}) {
+		t.Fatalf("unexpected messages %v", msgs)
+	}
+	if msgs := b.suppressed(); !reflect.DeepEqual(msgs, []string{"msg3", "msg5"}) {
+		t.Fatalf("unexpected suppressed messages %v", msgs)
+	}
+	if msgs := b.suppressed(); len(msgs) != 0 {
+		t.Fatalf("suppressed messages are expected to be shown once, got %v", msgs)
+	}
+
+	b.add("msg6", false)
+	b.resize(2)
+	if msgs := b.messages(); !reflect.DeepEqual(msgs, []string{"msg5", "msg6"}) {
+		t.Fatalf("unexpected messages after resize %v", msgs)
+	}
+	b.add("msg7", true)
+	if msgs := b.messages(); !reflect.DeepEqual(msgs, []string{"msg6", "msg7"}) {
+		t.Fatalf("unexpected messages %v", msgs)
+	}
+
+	b.resize(0)
+	b.add("msg8", false)
+	if b.enabled() || len(b.messages()) != 0 {
+		t.Fatalf("disabled buffer is expected to be empty, got %v", b.messages())
+	}
+}
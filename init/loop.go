@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// attachLoopDevice creates a new loop device backed by file and returns its name (e.g. "loop0").
+// If partscan is true then the kernel scans the partition table of the loop device and creates
+// partition devices for it.
+func attachLoopDevice(file string, partscan bool) (string, error) {
+	return attachLoopDeviceMode(file, partscan, false)
+}
+
+// attachLoopDeviceMode is attachLoopDevice that allows creating a read-only loop device, e.g. for a file stored
+// at a read-only filesystem
+func attachLoopDeviceMode(file string, partscan, readOnly bool) (string, error) {
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer ctl.Close()
+
+	num, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+	if err != nil {
+		return "", fmt.Errorf("loop: unable to get a free device: %v", err)
+	}
+	name := fmt.Sprintf("loop%d", num)
+
+	loop, err := os.OpenFile("/dev/"+name, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer loop.Close()
+
+	// the kernel makes the loop device read-only if the backing file is opened read-only
+	mode := os.O_RDWR
+	if readOnly {
+		mode = os.O_RDONLY
+	}
+	backing, err := os.OpenFile(file, mode, 0)
+	if err != nil {
+		return "", err
+	}
+	defer backing.Close()
+
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd())); err != nil {
+		return "", fmt.Errorf("loop: unable to attach %s to %s: %v", file, name, err)
+	}
+
+	// note that LO_FLAGS_AUTOCLEAR is not used as the device would be detached once we close it here
+	var info unix.LoopInfo64
+	if partscan {
+		info.Flags |= unix.LO_FLAGS_PARTSCAN
+	}
+
+	copy(info.File_name[:], file)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, loop.Fd(), unix.LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+		_ = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+		return "", os.NewSyscallError(fmt.Sprintf("ioctl (cmd=0x%x)", unix.LOOP_SET_STATUS64), errno)
+	}
+
+	debug("attached %s to loop device %s", file, name)
+	return name, nil
+}
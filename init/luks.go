@@ -1,14 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/anatol/clevis.go"
 	"github.com/anatol/luks.go"
+	"golang.org/x/sys/unix"
 )
 
 // rd luks options match systemd naming https://www.freedesktop.org/software/systemd/man/crypttab.html
@@ -20,13 +23,16 @@ var rdLuksOptions = map[string]string{
 	"no-write-workqueue":     luks.FlagNoWriteWorkqueue,
 }
 
-func luksApplyFlags(d luks.Device) error {
-	param, ok := cmdline["rd.luks.options"]
-	if !ok {
+func luksApplyFlags(d luksDevice, options string) error {
+	if options == "" {
 		return nil
 	}
 
-	for _, o := range strings.Split(param, ",") {
+	for _, o := range strings.Split(options, ",") {
+		if strings.HasPrefix(o, "keyfile-timeout=") {
+			// not a device flag, see luksKeyfileTimeout()
+			continue
+		}
 		flag, ok := rdLuksOptions[o]
 		if !ok {
 			return fmt.Errorf("Unknown value in rd.luks.options: %v", o)
@@ -38,134 +44,746 @@ func luksApplyFlags(d luks.Device) error {
 	return nil
 }
 
-func luksOpen(dev string, name string) error {
+// luksTokenHandlers obtain the passphrase from the payload of systemd-cryptenroll LUKS2 tokens
+var luksTokenHandlers = map[string]func(payload []byte) ([]byte, error){
+	fido2TokenType: fido2TokenPassword,
+	tpm2TokenType:  tpm2TokenPassword,
+}
+
+// luksUnlockSlots tries to unlock the device with the password using any of the slots.
+// It returns false if the password does not match any of them. The slots that need more memory than available
+// are skipped. The error tells about them only if all the slots are skipped, if any other slot does not match then
+// it is an incorrect password.
+func luksUnlockSlots(d luksDevice, slots []int, password []byte, name string) (bool, error) {
+	var memoryErr error
+	mismatched := false
+	for _, s := range slots {
+		err := d.Unlock(s, password, name)
+		if err == luks.ErrPassphraseDoesNotMatch {
+			mismatched = true
+			continue
+		}
+		if _, ok := err.(*argon2MemoryError); ok {
+			memoryErr = err
+			continue
+		}
+		if err == nil {
+			luksStashKey(name, password)
+		}
+		return true, err
+	}
+	if mismatched && memoryErr != nil {
+		warning("%v", memoryErr)
+		return false, nil
+	}
+	return false, memoryErr
+}
+
+// luksUnlockMethods are the ways to unlock a LUKS device, they are tried in the order set with rd.luks.unlock.
+// A method returns done once the device is unlocked or the unlocking failed for good. Otherwise it returns the reason
+// the method did not unlock the device, nil if the method is not configured, and the next method is tried.
+var luksUnlockMethods = map[string]func(d luksDevice, name string, m *luksMapping) (done bool, err error){
+	"keyfile":    luksUnlockKeyfile,
+	"keyserver":  luksUnlockKeyServer,
+	"fido2":      luksTokenUnlocker(fido2TokenType),
+	"tpm2":       luksTokenUnlocker(tpm2TokenType),
+	"clevis":     luksTokenUnlocker(luks.ClevisTokenType),
+	"passphrase": luksUnlockPassphrase,
+}
+
+// luksDefaultUnlockOrder is used for the devices without rd.luks.unlock
+var luksDefaultUnlockOrder = []string{"keyfile", "keyserver", "fido2", "tpm2", "clevis", "passphrase"}
+
+// parseLuksUnlockOrder parses the comma-separated list of the unlock methods, e.g. tpm2,keyfile,passphrase
+func parseLuksUnlockOrder(param string) ([]string, error) {
+	var order []string
+	seen := make(map[string]bool)
+	for _, m := range strings.Split(param, ",") {
+		if _, ok := luksUnlockMethods[m]; !ok {
+			return nil, fmt.Errorf("rd.luks.unlock: unknown unlock method '%s', expected one of %s", m, strings.Join(luksDefaultUnlockOrder, ", "))
+		}
+		if seen[m] {
+			return nil, fmt.Errorf("rd.luks.unlock: unlock method %s is specified twice in %s", m, param)
+		}
+		seen[m] = true
+		order = append(order, m)
+	}
+	return order, nil
+}
+
+func luksOpen(dev string, name string, m *luksMapping) error {
 	wg := loadModules("dm_crypt")
 	wg.Wait()
 
-	d, err := luks.Open(dev)
-	if err != nil {
-		return err
+	var d luksDevice
+	var err error
+	headerPath := dev
+	if m.header != nil {
+		headerFile, cleanup, err := readLuksHeader(m.header, dev)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		headerPath = headerFile
+		detached, err := openLuksDetached(dev, headerFile)
+		if err != nil {
+			return fmt.Errorf("%s: luks header %s: %v", dev, m.header, err)
+		}
+		if name == "" {
+			// the data device has no UUID, the name is derived from the UUID stored in the detached header
+			name = "luks-" + detached.uuid
+		}
+		d = detached
+	} else {
+		d, err = luks.Open(dev)
+		if err != nil {
+			return err
+		}
 	}
 	defer d.Close()
 
+	if memory, err := luks2Argon2Memory(headerPath); err != nil {
+		debug("%s: unable to read the keyslots memory cost: %v", dev, err)
+	} else if len(memory) != 0 {
+		d = &luksArgon2Device{luksDevice: d, memory: memory}
+	}
+
 	if len(d.Slots()) == 0 {
 		return fmt.Errorf("device %s has no slots to unlock", dev)
 	}
 
-	if err := luksApplyFlags(d); err != nil {
+	if err := luksApplyFlags(d, m.options); err != nil {
 		return err
 	}
 
-	// first try to unlock with token
-	tokens, err := d.Tokens()
-	if err != nil {
-		return err
+	return luksUnlock(d, name, m)
+}
+
+// luksUnlock tries the unlock methods of the mapping in order until one of them unlocks the device
+func luksUnlock(d luksDevice, name string, m *luksMapping) error {
+	unlockOrder := m.unlock
+	if unlockOrder == nil {
+		unlockOrder = luksDefaultUnlockOrder
 	}
-	for _, t := range tokens {
-		if t.Type != luks.ClevisTokenType {
-			continue
+	for _, method := range unlockOrder {
+		done, err := luksUnlockMethods[method](d, name, m)
+		if done {
+			return err
+		}
+		if err != nil {
+			debug("%s: unable to unlock with %s: %v", name, method, err)
 		}
+	}
+	return fmt.Errorf("%s: none of the unlock methods %s unlocked the device", name, strings.Join(unlockOrder, ","))
+}
 
-		var payload []byte
-		// Note that token metadata stored differently in LUKS v1 and v2
-		if d.Version() == 1 {
-			payload = t.Payload
-		} else {
-			var node struct {
-				Jwe json.RawMessage
-			}
-			if err := json.Unmarshal(t.Payload, &node); err != nil {
-				warning("%v", err)
+// luksUnlockKeyfile unlocks the device with the keyfile specified with rd.luks.keyfile=$DEVICE:$PATH or the one
+// of its crypttab line
+func luksUnlockKeyfile(d luksDevice, name string, m *luksMapping) (bool, error) {
+	keyfile := cmdLuksKeyfile
+	if keyfile == nil {
+		keyfile = m.keyfile
+	}
+	if keyfile == nil {
+		return false, nil
+	}
+	key, err := readLuksKeyfile(keyfile, luksKeyfileTimeout(m.options))
+	if err != nil {
+		return false, err
+	}
+	unlocked, err := luksUnlockSlots(d, d.Slots(), key, name)
+	MemZeroBytes(key)
+	if unlocked {
+		return true, err
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("keyfile %s does not match any of the slots", keyfile)
+}
+
+// luksUnlockKeyServer unlocks the device with the key fetched from the rd.luks.keyfile=https://... key server
+func luksUnlockKeyServer(d luksDevice, name string, _ *luksMapping) (bool, error) {
+	if cmdLuksKeyURL == "" {
+		return false, nil
+	}
+	// the key server is retried for as long as booster waits for the root device
+	key, err := fetchLuksKey(cmdLuksKeyURL, deviceTimeout(0))
+	if err != nil {
+		return false, err
+	}
+	unlocked, err := luksUnlockSlots(d, d.Slots(), key, name)
+	MemZeroBytes(key)
+	if unlocked {
+		return true, err
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("keyfile %s does not match any of the slots", cmdLuksKeyURL)
+}
+
+// luksTokenUnlocker returns the method that unlocks the device with its LUKS tokens of the given type
+func luksTokenUnlocker(tokenType string) func(d luksDevice, name string, m *luksMapping) (bool, error) {
+	return func(d luksDevice, name string, _ *luksMapping) (bool, error) {
+		tokens, err := d.Tokens()
+		if err != nil {
+			return true, err
+		}
+		var failure error
+		for _, t := range tokens {
+			if t.Type != tokenType {
 				continue
 			}
-			payload = node.Jwe
-		}
-
-		// in case of a (network) error retry it several times. or maybe retry logic needs to be inside the clevis itself?
-		var password []byte
-		for i := 0; i < 40; i++ {
-			password, err = clevis.Decrypt(payload)
-			if err == nil {
-				break
+			var password []byte
+			if tokenType == luks.ClevisTokenType {
+				password, err = clevisTokenPassword(d.Version(), t.Payload)
 			} else {
-				warning("%v", err)
-				time.Sleep(time.Second)
+				password, err = luksTokenHandlers[tokenType](t.Payload)
 			}
-		}
-
-		for _, s := range t.Slots {
-			err = d.Unlock(s, password, name)
-			if err == luks.ErrPassphraseDoesNotMatch {
+			if err != nil {
+				// e.g. the key is not plugged in or the PCR policy is not satisfied, fall back to other ways to unlock
+				failure = err
 				continue
 			}
+			unlocked, err := luksUnlockSlots(d, t.Slots, password, name)
 			MemZeroBytes(password)
-			return err
+			if unlocked {
+				return true, err
+			}
+			failure = err
+			if failure == nil {
+				failure = fmt.Errorf("%s token secret does not match any of the slots", t.Type)
+			}
 		}
-		MemZeroBytes(password)
+		return false, failure
+	}
+}
+
+// clevisTokenPassword decrypts the clevis token payload
+func clevisTokenPassword(luksVersion int, payload []byte) ([]byte, error) {
+	// Note that token metadata stored differently in LUKS v1 and v2
+	if luksVersion != 1 {
+		var node struct {
+			Jwe json.RawMessage
+		}
+		if err := json.Unmarshal(payload, &node); err != nil {
+			return nil, err
+		}
+		payload = node.Jwe
 	}
 
-	// tokens did not work, let's unlock with a password
+	// in case of a (network) error retry it several times. or maybe retry logic needs to be inside the clevis itself?
+	var err error
+	for i := 0; i < 40; i++ {
+		var password []byte
+		password, err = clevis.Decrypt(payload)
+		if err == nil {
+			return password, nil
+		}
+		debug("clevis: %v", err)
+		time.Sleep(time.Second)
+	}
+	return nil, err
+}
+
+// luksUnlockPassphrase asks for the passphrase. Devices are asked for the password one at a time so the passphrase
+// entered for one of them can be tried with the rest. The devices waiting for the prompt try every newly cached
+// passphrase in parallel, only the devices it does not unlock ask for another one.
+func luksUnlockPassphrase(d luksDevice, name string, _ *luksMapping) (bool, error) {
+	tried := -1 // generation of the last tried cached passphrase
+	luksPromptMutex.Lock()
 	for {
-		fmt.Print("Enter passphrase for ", name, ":")
-		password, err := readPassword()
+		for luksPrompting && luksPassphraseGen == tried {
+			luksPromptCond.Wait()
+		}
+		if luksPassphraseGen == tried {
+			break // no one asks for the password and the cached passphrase does not match
+		}
+		tried = luksPassphraseGen
+		luksPromptMutex.Unlock()
+		if unlocked, err := luksUnlockCached(d, name); unlocked {
+			return true, err
+		}
+		luksPromptMutex.Lock()
+	}
+	luksPrompting = true
+	luksPromptMutex.Unlock()
+
+	defer func() {
+		luksPromptMutex.Lock()
+		luksPrompting = false
+		luksPromptCond.Broadcast()
+		luksPromptMutex.Unlock()
+	}()
+	return luksPromptPassphrase(d, name)
+}
+
+// luksUnlockCached tries the cached passphrase. The key derivation is CPU-heavy thus at most one device per CPU
+// tries it at a time.
+func luksUnlockCached(d luksDevice, name string) (bool, error) {
+	cached := luksCachedPassphrase()
+	if cached == nil {
+		return false, nil
+	}
+	defer MemZeroBytes(cached)
+
+	luksKdfSlots <- struct{}{}
+	defer func() { <-luksKdfSlots }()
+	unlocked, err := luksUnlockSlots(d, d.Slots(), cached, name)
+	if !unlocked && err != nil {
+		debug("%s: unable to try the cached passphrase: %v", name, err)
+	} else if !unlocked {
+		debug("%s: cached passphrase does not match", name)
+	}
+	return unlocked, err
+}
+
+// luksPromptPassphrase asks for the passphrase until it unlocks the device or booster.luks.max_tries is reached
+func luksPromptPassphrase(d luksDevice, name string) (bool, error) {
+	// every entered passphrase that does not match any of the slots is one try, the empty ones are not tried
+	for tries := 1; ; {
+		password, err := luksAskPassword("Enter passphrase for " + name + ":")
 		if err != nil {
-			return err
+			return true, err
 		}
 		if len(password) == 0 {
 			fmt.Println("")
 			continue
 		}
 
-		fmt.Println("   Unlocking...")
-		for _, s := range d.Slots() {
-			err = d.Unlock(s, password, name)
-			if err == luks.ErrPassphraseDoesNotMatch {
-				continue
-			}
-			MemZeroBytes(password)
-			return err
+		showMessage("   Unlocking...")
+		unlocked, err := luksUnlockSlots(d, d.Slots(), password, name)
+		if unlocked && err == nil {
+			luksCachePassphrase(password)
 		}
-
 		// zeroify the password so we do not keep the sensitive data in the memory
 		MemZeroBytes(password)
+		if unlocked || err != nil {
+			return true, err
+		}
 
+		if luksMaxTries != 0 && tries >= luksMaxTries {
+			return true, luksLockoutDevice(name, tries)
+		}
+		tries++
 		// retry password
-		fmt.Println("   Incorrect passphrase, please try again")
+		showMessage("   Incorrect passphrase, please try again")
 	}
 }
 
-func handleLuksBlockDevice(info *blkInfo, devpath string) error {
-	var name string
-	var matches bool
+// luksLockoutDevice runs booster.luks.lockout action once too many incorrect passphrases are entered for the device.
+// If the emergency shell is not available then the machine is powered off.
+func luksLockoutDevice(name string, tries int) error {
+	severe("%s: %d incorrect passphrases entered, giving up", name, tries)
+	switch luksLockout {
+	case "shell":
+		emergencyShell()
+		fallthrough // the shell is not in the image
+	case "poweroff":
+		quitPlymouth()
+		unix.Sync()
+		if err := unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
+			return fmt.Errorf("%s: unable to power off: %v", name, err)
+		}
+	case "reboot":
+		quitPlymouth()
+		unix.Sync()
+		if err := unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART); err != nil {
+			return fmt.Errorf("%s: unable to reboot: %v", name, err)
+		}
+	}
+	return fmt.Errorf("%s: %d incorrect passphrases entered", name, tries)
+}
+
+// luksMapping is a LUKS device specified with rd.luks.uuid or rd.luks.name boot params or with a crypttab line.
+// header is the detached header specified with rd.luks.header, it is nil if the header is at the device. unlock is
+// the order of the unlock methods set with rd.luks.unlock, nil for the default order. keyfile is the keyfile of
+// the crypttab line, rd.luks.keyfile takes precedence over it.
+type luksMapping struct {
+	ref     *deviceRef
+	header  *luksHeader
+	keyfile *luksKeyfile
+	unlock  []string
+	name    string // name of the unlocked device, if empty then it is derived from the LUKS device UUID
+	param   string // the device as it is specified at the boot param
+	options string // rd.luks.options that apply to the device
+	found   bool   // a device matching the reference has been discovered
+}
+
+const (
+	// luksKeyringDescription is the name of the passphrase in the user kernel keyring, systemd-cryptsetup
+	// looks for the cached passphrases under the same name
+	luksKeyringDescription = "cryptsetup"
+	luksKeyringTimeout     = 150 // seconds
+
+	// luksStashPrefix is the prefix of the keys passed to the booted system with booster.luks.keyring, the key
+	// of a device is named after the unlocked device, e.g. booster:luks:root
+	luksStashPrefix         = "booster:luks:"
+	luksStashDefaultTimeout = 10 * time.Minute
+	// luksStashPerm lets the possessor do anything with the key and any root process read, search and revoke it
+	luksStashPerm = 0x3f000000 | 0x00010000 | 0x00020000 | 0x00080000 | 0x00200000
+)
+
+var (
+	luksMappings []*luksMapping // protected with deviceRefsMutex
+
+	// only one device asks for the password at a time, luksPromptMutex protects luksPrompting and luksPassphraseGen
+	luksPromptMutex   sync.Mutex
+	luksPromptCond    = sync.NewCond(&luksPromptMutex)
+	luksPrompting     bool
+	luksPassphraseGen int // incremented every time a passphrase is cached
+	// luksKdfSlots bounds the devices that derive the key from the cached passphrase in parallel
+	luksKdfSlots = make(chan struct{}, runtime.NumCPU())
+
+	cmdLuksKeyfile *luksKeyfile // specified with rd.luks.keyfile boot param
+	cmdLuksKeyURL  string       // rd.luks.keyfile boot param that points to a key server
+
+	luksMaxTries int    // incorrect passphrases allowed per device, set with booster.luks.max_tries; 0 means no limit
+	luksLockout  string // what to do once a device reaches luksMaxTries, set with booster.luks.lockout
+
+	// luksStashTimeout is the lifetime of the keys passed to the booted system, 0 if booster.luks.keyring is not set
+	luksStashTimeout time.Duration
+)
 
-	if param, ok := cmdline["rd.luks.name"]; ok {
-		parts := strings.Split(param, "=")
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid rd.luks.name kernel parameter %s, expected format rd.luks.name=<UUID>=<name>", cmdline["rd.luks.name"])
+// luksLockoutActions are the values of booster.luks.lockout, the first one is the default
+var luksLockoutActions = []string{"shell", "poweroff", "reboot"}
+
+// parseLuksRef parses the LUKS device reference. For compatibility with systemd a plain UUID is accepted,
+// otherwise it is a device reference in the same format as root=, e.g. PARTLABEL=cryptroot. It also returns
+// the device name that systemd uses for the plain UUID.
+func parseLuksRef(name, param string) (*deviceRef, string, error) {
+	stripped := stripQuotes(param)
+	if u, err := parseUUID(stripped); err == nil {
+		return &deviceRef{format: refFsUuid, data: u}, "luks-" + stripped, nil
+	}
+	ref, err := parseDeviceRef(name, param, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return ref, "", nil
+}
+
+// parseLuksParams parses rd.luks.name=$DEVICE=$NAME and rd.luks.uuid=$DEVICE boot params. Both of them can be specified
+// multiple times to unlock several devices. rd.luks.options=$DEVICE=$OPTIONS applies the options to one of the devices only.
+func parseLuksParams() error {
+	luksMappings = nil
+	for _, param := range cmdlineParams("rd.luks.name") {
+		idx := strings.LastIndexByte(param, '=')
+		if idx == -1 {
+			return fmt.Errorf("invalid rd.luks.name kernel parameter %s, expected format rd.luks.name=<UUID>=<name>", param)
+		}
+		name := param[idx+1:]
+		if err := validateDmName(name); err != nil {
+			return fmt.Errorf("rd.luks.name=%s: %v", param, err)
+		}
+		ref, _, err := parseLuksRef("rd.luks.name", param[:idx])
+		if err != nil {
+			return err
+		}
+		if m := lookupLuksMappingByRef(ref); m != nil {
+			if m.name == name {
+				continue // the same device is specified twice
+			}
+			return fmt.Errorf("rd.luks.name: device %s is given two names %s and %s", m.param, m.name, name)
+		}
+		luksMappings = append(luksMappings, &luksMapping{ref: ref, name: name, param: param[:idx]})
+	}
+	for _, param := range cmdlineParams("rd.luks.uuid") {
+		if lookupLuksMapping(param) != nil {
+			continue // rd.luks.name for this device specified already
+		}
+		ref, name, err := parseLuksRef("rd.luks.uuid", param)
+		if err != nil {
+			return err
+		}
+		luksMappings = append(luksMappings, &luksMapping{ref: ref, name: name, param: param})
+	}
+
+	crypttab, err := readCrypttab()
+	if err != nil {
+		return err
+	}
+	for _, c := range crypttab {
+		if err := validateDmName(c.name); err != nil {
+			warning("crypttab: %s: %v, skipping the line", c.name, err)
+			continue
+		}
+		m := lookupLuksMappingByRef(c.ref)
+		if m == nil {
+			luksMappings = append(luksMappings, c)
+			continue
+		}
+		// the boot params take precedence over the crypttab line, it fills in the rest only
+		if m.keyfile == nil {
+			m.keyfile = c.keyfile
+		}
+		if m.header == nil {
+			m.header = c.header
+		}
+		m.options = c.options
+	}
+
+	var globalOptions string
+	perDevice := make(map[*luksMapping]bool)
+	for _, param := range cmdlineParams("rd.luks.options") {
+		if m := luksMappingForOptions(param); m != nil {
+			m.options = param[len(m.param)+1:]
+			perDevice[m] = true
+		} else {
+			globalOptions = param
+		}
+	}
+	for _, m := range luksMappings {
+		// the crypttab options are overridden only if the boot param is specified
+		if !perDevice[m] && globalOptions != "" {
+			m.options = globalOptions
 		}
-		uuid, err := parseUUID(stripQuotes(parts[0]))
+	}
+
+	// rd.luks.unlock=$DEVICE=$METHODS sets the order for one of the devices the same way as rd.luks.options
+	var globalUnlock []string
+	for _, param := range cmdlineParams("rd.luks.unlock") {
+		m := luksMappingForOptions(param)
+		if m != nil {
+			param = param[len(m.param)+1:]
+		}
+		order, err := parseLuksUnlockOrder(param)
 		if err != nil {
-			return fmt.Errorf("invalid UUID %s %v", parts[0], err)
+			return err
 		}
-		if bytes.Equal(uuid, info.uuid) {
-			matches = true
-			name = parts[1]
+		if m != nil {
+			m.unlock = order
+		} else {
+			globalUnlock = order
+		}
+	}
+	for _, m := range luksMappings {
+		if m.unlock == nil {
+			m.unlock = globalUnlock
+		}
+	}
+
+	if param, ok := cmdline["rd.luks.keyfile"]; ok {
+		if strings.HasPrefix(param, "https://") || strings.HasPrefix(param, "http://") {
+			cmdLuksKeyURL, err = parseLuksKeyURL(param)
+		} else {
+			cmdLuksKeyfile, err = parseLuksKeyfile(param)
 		}
-	} else if uuid, ok := cmdline["rd.luks.uuid"]; ok {
-		stripped := stripQuotes(uuid)
-		u, err := parseUUID(stripped)
 		if err != nil {
-			return fmt.Errorf("invalid UUID %s in rd.luks.uuid boot param: %v", uuid, err)
+			return err
+		}
+	}
+	luksMaxTries = 0
+	if param, ok := cmdline["booster.luks.max_tries"]; ok {
+		luksMaxTries, err = strconv.Atoi(param)
+		if err != nil || luksMaxTries < 1 {
+			return fmt.Errorf("booster.luks.max_tries: invalid number of tries '%s', expected a positive number", param)
+		}
+	}
+	luksLockout = luksLockoutActions[0]
+	if param, ok := cmdline["booster.luks.lockout"]; ok {
+		valid := false
+		for _, a := range luksLockoutActions {
+			valid = valid || a == param
+		}
+		if !valid {
+			return fmt.Errorf("booster.luks.lockout: unknown action '%s', expected one of %s", param, strings.Join(luksLockoutActions, ", "))
+		}
+		luksLockout = param
+	}
+	luksMemoryCheck = luksMemoryCheckModes[0]
+	if param, ok := cmdline["booster.luks.memory_check"]; ok {
+		valid := false
+		for _, m := range luksMemoryCheckModes {
+			valid = valid || m == param
+		}
+		if !valid {
+			return fmt.Errorf("booster.luks.memory_check: unknown mode '%s', expected one of %s", param, strings.Join(luksMemoryCheckModes, ", "))
+		}
+		luksMemoryCheck = param
+	}
+	luksStashTimeout = 0
+	if param, ok := cmdline["booster.luks.keyring"]; ok {
+		luksStashTimeout = luksStashDefaultTimeout
+		if param != "" && param != "1" {
+			if luksStashTimeout, err = parseTimeout(param); err != nil {
+				return fmt.Errorf("booster.luks.keyring: %v", err)
+			}
+			if luksStashTimeout < time.Second {
+				return fmt.Errorf("booster.luks.keyring: the keys must expire, expected a timeout of 1 second or more, got %s", param)
+			}
+		}
+	}
+	names := make(map[string]string)
+	for _, m := range luksMappings {
+		if m.name == "" {
+			continue
+		}
+		if other, ok := names[m.name]; ok {
+			return fmt.Errorf("LUKS devices %s and %s are given the same name %s", other, m.param, m.name)
+		}
+		names[m.name] = m.param
+	}
+	return parseLuksHeaders()
+}
+
+// maxDmNameLen is the longest device-mapper device name, DM_NAME_LEN from linux/dm-ioctl.h minus the trailing zero
+const maxDmNameLen = 127
+
+// validateDmName checks that the name can be used for a device-mapper device and its /dev/mapper/ symlink
+func validateDmName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("device-mapper name is empty")
+	case len(name) > maxDmNameLen:
+		return fmt.Errorf("device-mapper name %s is longer than %d characters", name, maxDmNameLen)
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid device-mapper name %s", name)
+	}
+	for _, c := range name {
+		if c == '/' || c <= ' ' || c == 0x7f {
+			return fmt.Errorf("device-mapper name %q contains an invalid character %q", name, c)
+		}
+	}
+	return nil
+}
+
+// lookupLuksMapping returns the mapping for the device specified as param
+func lookupLuksMapping(param string) *luksMapping {
+	for _, m := range luksMappings {
+		if m.param == param {
+			return m
+		}
+	}
+	return nil
+}
+
+// lookupLuksMappingByRef returns the mapping of the device with the same reference
+func lookupLuksMappingByRef(ref *deviceRef) *luksMapping {
+	for _, m := range luksMappings {
+		if m.ref.String() == ref.String() {
+			return m
+		}
+	}
+	return nil
+}
+
+// luksMappingForOptions returns the mapping that rd.luks.options=$DEVICE=$OPTIONS param applies to
+func luksMappingForOptions(param string) *luksMapping {
+	for _, m := range luksMappings {
+		if strings.HasPrefix(param, m.param+"=") {
+			return m
 		}
-		if bytes.Equal(u, info.uuid) {
-			matches = true
-			name = "luks-" + stripped
+	}
+	return nil
+}
+
+// the passphrase prompt and the passphrase cache, tests replace them
+var (
+	luksAskPassword      = askPassword
+	luksCachedPassphrase = keyringCachedPassphrase
+	luksStorePassphrase  = keyringStorePassphrase
+)
+
+// keyringCachedPassphrase returns the passphrase that unlocked one of the devices, it is stored at the kernel keyring
+func keyringCachedPassphrase() []byte {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", luksKeyringDescription, 0)
+	if err != nil {
+		return nil
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil || size == 0 {
+		return nil
+	}
+	passphrase := make([]byte, size)
+	if _, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, passphrase, 0); err != nil {
+		MemZeroBytes(passphrase)
+		return nil
+	}
+	return passphrase
+}
+
+// keyringStorePassphrase stores the passphrase at the kernel keyring. It expires after a timeout the same way
+// systemd-cryptsetup caches passphrases.
+func keyringStorePassphrase(passphrase []byte) error {
+	id, err := unix.AddKey("user", luksKeyringDescription, passphrase, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, luksKeyringTimeout, 0, 0); err != nil {
+		debug("unable to set timeout for the cached passphrase: %v", err)
+	}
+	return nil
+}
+
+// luksCachePassphrase caches the passphrase, the devices waiting for the passphrase prompt are woken up to try it
+func luksCachePassphrase(passphrase []byte) {
+	if err := luksStorePassphrase(passphrase); err != nil {
+		debug("unable to cache the passphrase: %v", err)
+		return
+	}
+
+	luksPromptMutex.Lock()
+	luksPassphraseGen++
+	luksPromptCond.Broadcast()
+	luksPromptMutex.Unlock()
+}
+
+// luksStashKey passes the key that unlocked the device to the booted system if booster.luks.keyring is set. The key
+// is stored at the root user keyring that outlives the switch to the real root, it expires after the timeout.
+func luksStashKey(name string, key []byte) {
+	if luksStashTimeout == 0 {
+		return
+	}
+	id, err := unix.AddKey("user", luksStashPrefix+name, key, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		warning("%s: unable to store the key at the kernel keyring: %v", name, err)
+		return
+	}
+	if err := unix.KeyctlSetperm(id, luksStashPerm); err != nil {
+		debug("%s: unable to set the keyring key permissions: %v", name, err)
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, int(luksStashTimeout/time.Second), 0, 0); err != nil {
+		// a key that never expires is not left behind
+		warning("%s: unable to set timeout for the keyring key, revoking it: %v", name, err)
+		_, _ = unix.KeyctlInt(unix.KEYCTL_REVOKE, id, 0, 0, 0)
+		return
+	}
+	debug("%s: the key is stored at the user keyring as %s for %v", name, luksStashPrefix+name, luksStashTimeout)
+}
+
+func handleLuksBlockDevice(info *blkInfo, devpath string) error {
+	var mapping *luksMapping
+	deviceRefsMutex.Lock()
+	for _, m := range luksMappings {
+		if m.ref.matchesBlkInfo(info) {
+			mapping = m
+			m.found = true
+			break
 		}
 	}
-	if matches {
+	var snapshot luksMapping
+	if mapping != nil {
+		snapshot = *mapping
+	}
+	deviceRefsMutex.Unlock()
+
+	if mapping != nil {
+		name := snapshot.name
+		if name == "" && snapshot.header == nil {
+			name = "luks-" + info.uuid.toString()
+		}
+		node := assembly.add(assemblyDevName(info), layerLuks)
 		go func() {
 			// opening a luks device is a slow operation, run it in a separate goroutine
-			if err := luksOpen(devpath, name); err != nil {
+			err := assembly.activate(node, func() error {
+				if err := checkUnambiguous("LUKS device", snapshot.ref); err != nil {
+					return err
+				}
+				return luksOpen(devpath, name, &snapshot)
+			})
+			if err != nil {
 				severe("%v", err)
 			}
 		}()
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anatol/luks.go"
+)
+
+func TestParseLuksParams(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		luksMappings = nil
+	}()
+
+	check := func(params map[string]string, expectedRef, expectedName string) {
+		cmdline = params
+		if err := parseLuksParams(); err != nil {
+			t.Fatalf("%v: %v", params, err)
+		}
+		if len(luksMappings) != 1 {
+			t.Fatalf("%v: expected one LUKS device, got %d", params, len(luksMappings))
+		}
+		m := luksMappings[0]
+		if m.ref.String() != expectedRef || m.name != expectedName {
+			t.Fatalf("%v: expected %s named '%s', got %s named '%s'", params, expectedRef, expectedName, m.ref, m.name)
+		}
+	}
+
+	check(map[string]string{"rd.luks.uuid": "ac8299a8-91ce-4bf6-a524-55a62844b787"}, "UUID=ac8299a8-91ce-4bf6-a524-55a62844b787", "luks-ac8299a8-91ce-4bf6-a524-55a62844b787")
+	check(map[string]string{"rd.luks.uuid": "PARTLABEL=cryptroot"}, "PARTLABEL=cryptroot", "")
+	check(map[string]string{"rd.luks.name": "ac8299a8-91ce-4bf6-a524-55a62844b787=root"}, "UUID=ac8299a8-91ce-4bf6-a524-55a62844b787", "root")
+	check(map[string]string{"rd.luks.name": "PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4=root"}, "PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4", "root")
+
+	for _, params := range []map[string]string{{"rd.luks.name": "root"}, {"rd.luks.uuid": "ac8299a8"}} {
+		cmdline = params
+		if err := parseLuksParams(); err == nil {
+			t.Fatalf("%v: expected to fail but it did not", params)
+		}
+	}
+}
+
+func TestParseLuksParamsMultipleDevices(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		luksMappings = nil
+	}()
+
+	cmdline = make(map[string]string)
+	cmdlineValues = make(map[string][]string)
+	parseCmdlineParams("rd.luks.uuid=ac8299a8-91ce-4bf6-a524-55a62844b787 rd.luks.uuid=PARTLABEL=crypthome rd.luks.name=PARTLABEL=cryptswap=swap " +
+		"rd.luks.options=discard rd.luks.options=PARTLABEL=crypthome=no-read-workqueue,keyfile-timeout=5s")
+	if err := parseLuksParams(); err != nil {
+		t.Fatal(err)
+	}
+
+	type mapping struct{ ref, name, options string }
+	var got []mapping
+	for _, m := range luksMappings {
+		got = append(got, mapping{m.ref.String(), m.name, m.options})
+	}
+	expected := []mapping{
+		{"PARTLABEL=cryptswap", "swap", "discard"},
+		{"UUID=ac8299a8-91ce-4bf6-a524-55a62844b787", "luks-ac8299a8-91ce-4bf6-a524-55a62844b787", "discard"},
+		{"PARTLABEL=crypthome", "", "no-read-workqueue,keyfile-timeout=5s"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected LUKS devices %+v, got %+v", expected, got)
+	}
+
+	if d := luksKeyfileTimeout(luksMappings[2].options); d != 5*time.Second {
+		t.Fatalf("expected per-device keyfile timeout 5s, got %v", d)
+	}
+}
+
+func TestParseLuksHeaders(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		luksMappings = nil
+	}()
+
+	parse := func(params string) error {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		parseCmdlineParams(params)
+		return parseLuksParams()
+	}
+
+	if err := parse("rd.luks.name=PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4=root rd.luks.header=LABEL=esp:/headers/root.luks"); err != nil {
+		t.Fatal(err)
+	}
+	if h := luksMappings[0].header; h == nil || h.String() != "LABEL=esp:/headers/root.luks" {
+		t.Fatalf("expected header LABEL=esp:/headers/root.luks, got %v", h)
+	}
+
+	if err := parse("rd.luks.uuid=ac8299a8-91ce-4bf6-a524-55a62844b787 rd.luks.name=PARTLABEL=cryptdata=data " +
+		"rd.luks.header=PARTLABEL=cryptdata=UUID=41ea8e1a-3b68-4e3c-9c21-8e2b1d6a27e8:/data.luks"); err != nil {
+		t.Fatal(err)
+	}
+	if luksMappings[0].header == nil || luksMappings[0].header.String() != "UUID=41ea8e1a-3b68-4e3c-9c21-8e2b1d6a27e8:/data.luks" {
+		t.Fatalf("expected header of PARTLABEL=cryptdata, got %v", luksMappings[0].header)
+	}
+	if luksMappings[1].header != nil {
+		t.Fatalf("expected no detached header for %s, got %v", luksMappings[1].ref, luksMappings[1].header)
+	}
+
+	for _, params := range []string{
+		// the header is not at a device path
+		"rd.luks.name=PARTLABEL=cryptroot=root rd.luks.header=/headers/root.luks",
+		// the header of which device
+		"rd.luks.uuid=PARTLABEL=cryptroot rd.luks.uuid=PARTLABEL=crypthome rd.luks.header=LABEL=esp:/headers/root.luks",
+		// the data device does not have the UUID
+		"rd.luks.uuid=ac8299a8-91ce-4bf6-a524-55a62844b787 rd.luks.header=LABEL=esp:/headers/root.luks",
+	} {
+		if err := parse(params); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", params)
+		}
+	}
+}
+
+func TestParseLuksUnlockOrder(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		luksMappings = nil
+	}()
+
+	parse := func(params string) error {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		parseCmdlineParams(params)
+		return parseLuksParams()
+	}
+
+	if err := parse("rd.luks.uuid=PARTLABEL=cryptroot rd.luks.uuid=PARTLABEL=crypthome rd.luks.uuid=PARTLABEL=cryptswap " +
+		"rd.luks.unlock=tpm2,keyfile rd.luks.unlock=PARTLABEL=crypthome=keyfile,passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, m := range luksMappings {
+		got = append(got, m.unlock)
+	}
+	expected := [][]string{{"tpm2", "keyfile"}, {"keyfile", "passphrase"}, {"tpm2", "keyfile"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected unlock orders %v, got %v", expected, got)
+	}
+
+	if err := parse("rd.luks.uuid=PARTLABEL=cryptroot"); err != nil {
+		t.Fatal(err)
+	}
+	if luksMappings[0].unlock != nil {
+		t.Fatalf("expected the default unlock order, got %v", luksMappings[0].unlock)
+	}
+
+	for _, params := range []string{"rd.luks.uuid=PARTLABEL=cryptroot rd.luks.unlock=tpm2,password", "rd.luks.uuid=PARTLABEL=cryptroot rd.luks.unlock=tpm2,keyfile,tpm2"} {
+		if err := parse(params); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", params)
+		}
+	}
+}
+
+func TestParseLuksParamsCrypttab(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		luksMappings = nil
+		crypttabFile = crypttabPath
+	}()
+
+	crypttabFile = t.TempDir() + "/crypttab"
+	content := "root UUID=ac8299a8-91ce-4bf6-a524-55a62844b787 /etc/keys/root.key discard\n" +
+		"home PARTLABEL=crypthome - no-write-workqueue\n"
+	if err := os.WriteFile(crypttabFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	parse := func(params string) {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		parseCmdlineParams(params)
+		if err := parseLuksParams(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type mapping struct{ ref, name, options string }
+	check := func(expected []mapping) {
+		var got []mapping
+		for _, m := range luksMappings {
+			got = append(got, mapping{m.ref.String(), m.name, m.options})
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected LUKS devices %+v, got %+v", expected, got)
+		}
+	}
+
+	parse("")
+	check([]mapping{
+		{"UUID=ac8299a8-91ce-4bf6-a524-55a62844b787", "root", "discard"},
+		{"PARTLABEL=crypthome", "home", "no-write-workqueue"},
+	})
+	if luksMappings[0].keyfile == nil || luksMappings[0].keyfile.String() != "/etc/keys/root.key" {
+		t.Fatalf("expected the crypttab keyfile, got %v", luksMappings[0].keyfile)
+	}
+
+	// the boot params take precedence over the matching crypttab lines
+	parse("rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=cryptroot rd.luks.options=PARTLABEL=crypthome=discard")
+	check([]mapping{
+		{"UUID=ac8299a8-91ce-4bf6-a524-55a62844b787", "cryptroot", "discard"},
+		{"PARTLABEL=crypthome", "home", "discard"},
+	})
+	if luksMappings[0].keyfile == nil {
+		t.Fatal("expected the crypttab keyfile to be used for the device specified with the boot param")
+	}
+
+	parse("rd.luks.crypttab=0 rd.luks.uuid=PARTLABEL=cryptswap")
+	check([]mapping{{"PARTLABEL=cryptswap", "", ""}})
+}
+
+func TestParseLuksMaxTries(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		luksMappings = nil
+	}()
+
+	cmdline = map[string]string{"rd.luks.uuid": "PARTLABEL=cryptroot"}
+	if err := parseLuksParams(); err != nil {
+		t.Fatal(err)
+	}
+	if luksMaxTries != 0 || luksLockout != "shell" {
+		t.Fatalf("expected unlimited tries and the shell lockout by default, got %d tries and %s", luksMaxTries, luksLockout)
+	}
+
+	cmdline = map[string]string{"rd.luks.uuid": "PARTLABEL=cryptroot", "booster.luks.max_tries": "3", "booster.luks.lockout": "poweroff"}
+	if err := parseLuksParams(); err != nil {
+		t.Fatal(err)
+	}
+	if luksMaxTries != 3 || luksLockout != "poweroff" {
+		t.Fatalf("expected 3 tries and the poweroff lockout, got %d tries and %s", luksMaxTries, luksLockout)
+	}
+
+	for _, params := range []map[string]string{
+		{"booster.luks.max_tries": "0"},
+		{"booster.luks.max_tries": "three"},
+		{"booster.luks.lockout": "halt"},
+	} {
+		cmdline = params
+		if err := parseLuksParams(); err == nil {
+			t.Fatalf("%v: expected to fail but it did not", params)
+		}
+	}
+}
+
+func TestLuksUnlockOrder(t *testing.T) {
+	saved := make(map[string]func(d luksDevice, name string, m *luksMapping) (bool, error))
+	for k, v := range luksUnlockMethods {
+		saved[k] = v
+	}
+	defer func() {
+		luksUnlockMethods = saved
+	}()
+
+	var tried []string
+	method := func(name string, done bool, err error) {
+		luksUnlockMethods[name] = func(luksDevice, string, *luksMapping) (bool, error) {
+			tried = append(tried, name)
+			return done, err
+		}
+	}
+	method("tpm2", false, fmt.Errorf("PCR policy is not satisfied"))
+	method("keyfile", false, nil) // not configured
+	method("passphrase", true, nil)
+	method("clevis", true, nil)
+
+	if err := luksUnlock(nil, "root", &luksMapping{unlock: []string{"tpm2", "keyfile", "passphrase", "clevis"}}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"tpm2", "keyfile", "passphrase"}; !reflect.DeepEqual(tried, expected) {
+		t.Fatalf("expected methods %v to be tried, got %v", expected, tried)
+	}
+
+	tried = nil
+	if err := luksUnlock(nil, "root", &luksMapping{unlock: []string{"keyfile", "tpm2"}}); err == nil {
+		t.Fatal("expected the headless unlock to fail once all methods are tried")
+	}
+	if expected := []string{"keyfile", "tpm2"}; !reflect.DeepEqual(tried, expected) {
+		t.Fatalf("expected methods %v to be tried, got %v", expected, tried)
+	}
+}
+
+func TestParseLuksNames(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		luksMappings = nil
+		crypttabFile = crypttabPath
+	}()
+	crypttabFile = t.TempDir() + "/crypttab"
+
+	parse := func(params string) error {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		luksMappings = nil
+		parseCmdlineParams(params)
+		return parseLuksParams()
+	}
+
+	if err := parse("rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=cryptroot rd.luks.name=UUID=ac8299a8-91ce-4bf6-a524-55a62844b787=cryptroot rd.luks.name=PARTLABEL=crypthome=home"); err != nil {
+		t.Fatal(err)
+	}
+	if len(luksMappings) != 2 || luksMappings[0].name != "cryptroot" || luksMappings[1].name != "home" {
+		t.Fatalf("expected cryptroot and home LUKS devices, got %+v", luksMappings)
+	}
+
+	for _, params := range []string{
+		"rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=",
+		"rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=..",
+		"rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=crypt/root",
+		"rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=" + strings.Repeat("a", 128),
+		"rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=cryptroot rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=root",
+		"rd.luks.name=ac8299a8-91ce-4bf6-a524-55a62844b787=cryptroot rd.luks.name=PARTLABEL=crypthome=cryptroot",
+	} {
+		if err := parse(params); err == nil {
+			t.Fatalf("expected an error for %s", params)
+		}
+	}
+}
+
+func TestParseLuksKeyring(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		luksMappings = nil
+		luksStashTimeout = 0
+	}()
+
+	check := func(params map[string]string, expected time.Duration) {
+		cmdline = params
+		if err := parseLuksParams(); err != nil {
+			t.Fatal(err)
+		}
+		if luksStashTimeout != expected {
+			t.Fatalf("%v: expected the keyring timeout %v, got %v", params, expected, luksStashTimeout)
+		}
+	}
+	check(map[string]string{}, 0)
+	check(map[string]string{"booster.luks.keyring": ""}, 10*time.Minute)
+	check(map[string]string{"booster.luks.keyring": "90"}, 90*time.Second)
+	check(map[string]string{"booster.luks.keyring": "1h"}, time.Hour)
+
+	for _, param := range []string{"0", "forever", "500ms"} {
+		cmdline = map[string]string{"booster.luks.keyring": param}
+		if err := parseLuksParams(); err == nil {
+			t.Fatalf("booster.luks.keyring=%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+// fakeLuksDevice unlocks the keyslots with the passphrases
+type fakeLuksDevice struct {
+	mutex       sync.Mutex
+	passphrases map[int]string
+	unlocked    []string // names the device is unlocked with
+	tries       int
+}
+
+func (d *fakeLuksDevice) Close() error { return nil }
+
+func (d *fakeLuksDevice) FlagsAdd(flags ...string) error { return nil }
+
+func (d *fakeLuksDevice) Tokens() ([]luks.Token, error) { return nil, nil }
+
+func (d *fakeLuksDevice) Version() int { return 2 }
+
+func (d *fakeLuksDevice) Slots() []int {
+	var slots []int
+	for s := range d.passphrases {
+		slots = append(slots, s)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+func (d *fakeLuksDevice) Unlock(keyslot int, passphrase []byte, dmName string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.tries++
+	if d.passphrases[keyslot] != string(passphrase) {
+		return luks.ErrPassphraseDoesNotMatch
+	}
+	d.unlocked = append(d.unlocked, dmName)
+	return nil
+}
+
+func TestLuksPassphraseHandoff(t *testing.T) {
+	type answer struct {
+		passphrase string
+		err        error
+	}
+	prompts := make(chan string) // names of the devices that ask for the passphrase
+	answers := make(chan answer)
+	var cacheMutex sync.Mutex
+	var cache []byte
+	defer func() {
+		luksAskPassword = askPassword
+		luksCachedPassphrase = keyringCachedPassphrase
+		luksStorePassphrase = keyringStorePassphrase
+		luksPassphraseGen = 0
+	}()
+	luksAskPassword = func(prompt string) ([]byte, error) {
+		prompts <- strings.TrimSuffix(strings.TrimPrefix(prompt, "Enter passphrase for "), ":")
+		a := <-answers
+		return []byte(a.passphrase), a.err
+	}
+	luksCachedPassphrase = func() []byte {
+		cacheMutex.Lock()
+		defer cacheMutex.Unlock()
+		if cache == nil {
+			return nil
+		}
+		return append([]byte{}, cache...)
+	}
+	luksStorePassphrase = func(passphrase []byte) error {
+		cacheMutex.Lock()
+		defer cacheMutex.Unlock()
+		cache = append([]byte{}, passphrase...)
+		return nil
+	}
+
+	type result struct {
+		name     string
+		unlocked bool
+		err      error
+	}
+	results := make(chan result)
+	unlock := func(name string, d luksDevice) {
+		go func() {
+			unlocked, err := luksUnlockPassphrase(d, name, nil)
+			results <- result{name, unlocked, err}
+		}()
+	}
+	expectPrompt := func(name string) {
+		select {
+		case p := <-prompts:
+			if p != name {
+				t.Fatalf("expected %s to ask for the passphrase, got %s", name, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s does not ask for the passphrase", name)
+		}
+	}
+	expectNoPrompt := func() {
+		select {
+		case p := <-prompts:
+			t.Fatalf("unexpected passphrase prompt for %s", p)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	expectResult := func(name string, unlocked bool) result {
+		select {
+		case r := <-results:
+			if r.name != name || r.unlocked != unlocked {
+				t.Fatalf("expected %s unlocked=%v, got %s unlocked=%v err=%v", name, unlocked, r.name, r.unlocked, r.err)
+			}
+			return r
+		case <-time.After(time.Second):
+			t.Fatalf("%s is not done", name)
+		}
+		return result{}
+	}
+	reset := func() {
+		cache = nil
+		luksPassphraseGen = 0
+	}
+
+	// the devices waiting for the prompt unlock with the passphrase entered for the first one
+	reset()
+	devices := map[string]*fakeLuksDevice{}
+	for _, name := range []string{"root", "home", "data"} {
+		devices[name] = &fakeLuksDevice{passphrases: map[int]string{0: "secret"}}
+	}
+	unlock("root", devices["root"])
+	expectPrompt("root")
+	unlock("home", devices["home"])
+	unlock("data", devices["data"])
+	expectNoPrompt()
+	answers <- answer{passphrase: "secret"}
+	done := map[string]bool{}
+	for range devices {
+		r := <-results
+		if !r.unlocked || r.err != nil {
+			t.Fatalf("%s: expected to be unlocked, got unlocked=%v err=%v", r.name, r.unlocked, r.err)
+		}
+		done[r.name] = true
+	}
+	expectNoPrompt()
+	for name, d := range devices {
+		if !done[name] || !reflect.DeepEqual(d.unlocked, []string{name}) {
+			t.Fatalf("%s is not unlocked: %v", name, d.unlocked)
+		}
+	}
+
+	// a device the cached passphrase does not unlock asks for its own one
+	reset()
+	root := &fakeLuksDevice{passphrases: map[int]string{0: "secret"}}
+	home := &fakeLuksDevice{passphrases: map[int]string{0: "other"}}
+	unlock("root", root)
+	expectPrompt("root")
+	unlock("home", home)
+	expectNoPrompt()
+	answers <- answer{passphrase: "secret"}
+	expectResult("root", true)
+	expectPrompt("home")
+	if home.tries != 1 {
+		t.Fatalf("expected home to try the cached passphrase once before the prompt, got %d tries", home.tries)
+	}
+	answers <- answer{passphrase: "other"}
+	expectResult("home", true)
+
+	// a failed prompt wakes up the waiting device, it asks for the passphrase itself
+	reset()
+	root = &fakeLuksDevice{passphrases: map[int]string{0: "secret"}}
+	home = &fakeLuksDevice{passphrases: map[int]string{0: "secret"}}
+	unlock("root", root)
+	expectPrompt("root")
+	unlock("home", home)
+	expectNoPrompt()
+	answers <- answer{err: fmt.Errorf("prompt is cancelled")}
+	if r := expectResult("root", true); r.err == nil {
+		t.Fatal("expected the prompt error")
+	}
+	expectPrompt("home")
+	answers <- answer{passphrase: "secret"}
+	expectResult("home", true)
+	if len(root.unlocked) != 0 || len(home.unlocked) != 1 {
+		t.Fatalf("unexpected unlocks: root %v, home %v", root.unlocked, home.unlocked)
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anatol/devmapper.go"
+	"github.com/anatol/luks.go"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// luksDevice is the part of luks.Device the unlock code uses. It is implemented by the luks.go devices and by
+// the devices with a detached header that luks.go cannot open.
+type luksDevice interface {
+	Close() error
+	Slots() []int
+	FlagsAdd(flags ...string) error
+	Tokens() ([]luks.Token, error)
+	Version() int
+	Unlock(keyslot int, passphrase []byte, dmName string) error
+}
+
+const (
+	luks1HeaderSize   = 592
+	luks1KeyslotCount = 8
+	luks1KeyActive    = 0x00ac71f3
+	luks1DigestSize   = 20
+	luksSectorSize    = 512
+)
+
+// luksDetachedDevice is a LUKS1 or LUKS2 device with the header stored in a separate file. luks.go reads the header
+// from the device it unlocks, here the keyslots are read from the header file and the dm-crypt mapping is created
+// for the data device.
+type luksDetachedDevice struct {
+	dev     string // the data device
+	header  string // the header file
+	version int
+	uuid    string
+	slots   map[int]*luksKeyslot
+	digests []*luksDigest
+	segment luksSegment
+	tokens  []luks.Token
+	flags   []string // dm-crypt optional parameters
+}
+
+type luksKeyslot struct {
+	priority       int // 0 - ignored, 1 - normal, 2 - high
+	keySize        int // size of the volume key
+	areaOffset     int64
+	areaSize       int64
+	areaEncryption string
+	areaKeySize    int
+	kdf            luksKdf
+	stripes        int
+	afHash         string
+}
+
+type luksKdf struct {
+	kind       string // pbkdf2, argon2i or argon2id
+	hash       string // pbkdf2 only
+	iterations int    // pbkdf2 only
+	time       uint32 // argon2 only
+	memory     uint32 // argon2 only, in KiB
+	cpus       uint8  // argon2 only
+	salt       []byte
+}
+
+type luksDigest struct {
+	keyslots   []int
+	hash       string
+	iterations int
+	salt       []byte
+	digest     []byte
+}
+
+type luksSegment struct {
+	offset     uint64 // in bytes
+	size       uint64 // in bytes, 0 means the rest of the data device
+	ivTweak    uint64
+	encryption string
+	sectorSize uint64
+}
+
+// openLuksDetached reads the detached LUKS header from the header file. dev is the data device.
+func openLuksDetached(dev, header string) (*luksDetachedDevice, error) {
+	content, err := os.ReadFile(header)
+	if err != nil {
+		return nil, err
+	}
+	d := &luksDetachedDevice{dev: dev, header: header}
+	if len(content) < luks1HeaderSize || !bytes.Equal(content[:len(luks2Magic)], luks2Magic) {
+		return nil, fmt.Errorf("%s is not a LUKS header", header)
+	}
+	switch binary.BigEndian.Uint16(content[6:8]) {
+	case 1:
+		err = d.parseLuks1(content)
+	case 2:
+		err = d.parseLuks2(content)
+	default:
+		err = fmt.Errorf("unsupported LUKS version %d", binary.BigEndian.Uint16(content[6:8]))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", header, err)
+	}
+	return d, nil
+}
+
+func (d *luksDetachedDevice) parseLuks1(hdr []byte) error {
+	cstring := func(b []byte) string {
+		return string(bytes.TrimRight(b, "\x00"))
+	}
+	d.version = 1
+	d.uuid = cstring(hdr[168:208])
+	cipher := cstring(hdr[8:40]) + "-" + cstring(hdr[40:72])
+	hashSpec := cstring(hdr[72:104])
+	keyBytes := int(binary.BigEndian.Uint32(hdr[108:112]))
+	d.segment = luksSegment{
+		offset:     uint64(binary.BigEndian.Uint32(hdr[104:108])) * luksSectorSize,
+		encryption: cipher,
+		sectorSize: luksSectorSize,
+	}
+	d.slots = make(map[int]*luksKeyslot)
+	var ids []int
+	for i := 0; i < luks1KeyslotCount; i++ {
+		ks := hdr[208+48*i : 208+48*(i+1)]
+		if binary.BigEndian.Uint32(ks[0:4]) != luks1KeyActive {
+			continue
+		}
+		stripes := int(binary.BigEndian.Uint32(ks[44:48]))
+		d.slots[i] = &luksKeyslot{
+			priority:       1,
+			keySize:        keyBytes,
+			areaOffset:     int64(binary.BigEndian.Uint32(ks[40:44])) * luksSectorSize,
+			areaSize:       int64(keyBytes * stripes),
+			areaEncryption: cipher,
+			areaKeySize:    keyBytes,
+			kdf:            luksKdf{kind: "pbkdf2", hash: hashSpec, iterations: int(binary.BigEndian.Uint32(ks[4:8])), salt: ks[8:40]},
+			stripes:        stripes,
+			afHash:         hashSpec,
+		}
+		ids = append(ids, i)
+	}
+	d.digests = []*luksDigest{{
+		keyslots:   ids,
+		hash:       hashSpec,
+		iterations: int(binary.BigEndian.Uint32(hdr[164:168])),
+		salt:       hdr[132:164],
+		digest:     hdr[112 : 112+luks1DigestSize],
+	}}
+	return nil
+}
+
+// luks2Metadata is the JSON area of the LUKS2 header, see https://gitlab.com/cryptsetup/LUKS2-docs
+type luks2Metadata struct {
+	Keyslots map[string]struct {
+		Type     string `json:"type"`
+		KeySize  int    `json:"key_size"`
+		Priority *int   `json:"priority"`
+		Area     struct {
+			Type       string `json:"type"`
+			Offset     string `json:"offset"`
+			Size       string `json:"size"`
+			Encryption string `json:"encryption"`
+			KeySize    int    `json:"key_size"`
+		} `json:"area"`
+		Kdf struct {
+			Type       string `json:"type"`
+			Hash       string `json:"hash"`
+			Iterations int    `json:"iterations"`
+			Time       uint32 `json:"time"`
+			Memory     uint32 `json:"memory"`
+			Cpus       uint8  `json:"cpus"`
+			Salt       string `json:"salt"`
+		} `json:"kdf"`
+		Af struct {
+			Type    string `json:"type"`
+			Stripes int    `json:"stripes"`
+			Hash    string `json:"hash"`
+		} `json:"af"`
+	} `json:"keyslots"`
+	Segments map[string]struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Size       string `json:"size"`
+		IvTweak    string `json:"iv_tweak"`
+		Encryption string `json:"encryption"`
+		SectorSize uint64 `json:"sector_size"`
+	} `json:"segments"`
+	Digests map[string]struct {
+		Type       string   `json:"type"`
+		Keyslots   []string `json:"keyslots"`
+		Hash       string   `json:"hash"`
+		Iterations int      `json:"iterations"`
+		Salt       string   `json:"salt"`
+		Digest     string   `json:"digest"`
+	} `json:"digests"`
+	Tokens map[string]json.RawMessage `json:"tokens"`
+	Config struct {
+		Flags []string `json:"flags"`
+	} `json:"config"`
+}
+
+func (d *luksDetachedDevice) parseLuks2(hdr []byte) error {
+	size := binary.BigEndian.Uint64(hdr[8:16])
+	if size <= luks2HeaderSize || size > luks2MaxHeaderSize || uint64(len(hdr)) < size {
+		return fmt.Errorf("invalid LUKS2 header size %d", size)
+	}
+	if err := checkLuks2Checksum(hdr[:size]); err != nil {
+		return err
+	}
+	d.version = 2
+	d.uuid = string(bytes.TrimRight(hdr[168:208], "\x00"))
+
+	var meta luks2Metadata
+	if err := json.Unmarshal(bytes.TrimRight(hdr[luks2HeaderSize:size], "\x00"), &meta); err != nil {
+		return fmt.Errorf("LUKS2 metadata: %v", err)
+	}
+
+	d.slots = make(map[int]*luksKeyslot)
+	for id, ks := range meta.Keyslots {
+		slot, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid keyslot %s", id)
+		}
+		if ks.Type != "luks2" || ks.Area.Type != "raw" || ks.Af.Type != "luks1" {
+			debug("%s: keyslot %d of type %s is not supported", d.header, slot, ks.Type)
+			continue
+		}
+		offset, err1 := strconv.ParseInt(ks.Area.Offset, 10, 64)
+		areaSize, err2 := strconv.ParseInt(ks.Area.Size, 10, 64)
+		salt, err3 := base64.StdEncoding.DecodeString(ks.Kdf.Salt)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return fmt.Errorf("invalid keyslot %d", slot)
+		}
+		priority := 1
+		if ks.Priority != nil {
+			priority = *ks.Priority
+		}
+		d.slots[slot] = &luksKeyslot{
+			priority:       priority,
+			keySize:        ks.KeySize,
+			areaOffset:     offset,
+			areaSize:       areaSize,
+			areaEncryption: ks.Area.Encryption,
+			areaKeySize:    ks.Area.KeySize,
+			kdf: luksKdf{
+				kind:       ks.Kdf.Type,
+				hash:       ks.Kdf.Hash,
+				iterations: ks.Kdf.Iterations,
+				time:       ks.Kdf.Time,
+				memory:     ks.Kdf.Memory,
+				cpus:       ks.Kdf.Cpus,
+				salt:       salt,
+			},
+			stripes: ks.Af.Stripes,
+			afHash:  ks.Af.Hash,
+		}
+	}
+
+	for id, dg := range meta.Digests {
+		if dg.Type != "pbkdf2" {
+			return fmt.Errorf("digest %s of type %s is not supported", id, dg.Type)
+		}
+		salt, err1 := base64.StdEncoding.DecodeString(dg.Salt)
+		digest, err2 := base64.StdEncoding.DecodeString(dg.Digest)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid digest %s", id)
+		}
+		slots, err := parseLuks2Ids(dg.Keyslots)
+		if err != nil {
+			return fmt.Errorf("digest %s: %v", id, err)
+		}
+		d.digests = append(d.digests, &luksDigest{keyslots: slots, hash: dg.Hash, iterations: dg.Iterations, salt: salt, digest: digest})
+	}
+
+	seg, ok := meta.Segments["0"]
+	if !ok || seg.Type != "crypt" || len(meta.Segments) != 1 {
+		return fmt.Errorf("only a single crypt segment is supported")
+	}
+	var err error
+	if d.segment.offset, err = strconv.ParseUint(seg.Offset, 10, 64); err != nil {
+		return fmt.Errorf("invalid segment offset %s", seg.Offset)
+	}
+	if seg.Size != "dynamic" {
+		if d.segment.size, err = strconv.ParseUint(seg.Size, 10, 64); err != nil {
+			return fmt.Errorf("invalid segment size %s", seg.Size)
+		}
+	}
+	if d.segment.ivTweak, err = strconv.ParseUint(seg.IvTweak, 10, 64); err != nil {
+		return fmt.Errorf("invalid segment iv_tweak %s", seg.IvTweak)
+	}
+	d.segment.encryption = seg.Encryption
+	d.segment.sectorSize = seg.SectorSize
+
+	for _, f := range meta.Config.Flags {
+		// the persistent flags are named as the dm-crypt parameters with '-' instead of '_'
+		d.flags = append(d.flags, strings.ReplaceAll(f, "-", "_"))
+	}
+
+	for id, raw := range meta.Tokens {
+		var t struct {
+			Type     string   `json:"type"`
+			Keyslots []string `json:"keyslots"`
+		}
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return fmt.Errorf("token %s: %v", id, err)
+		}
+		tid, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid token %s", id)
+		}
+		slots, err := parseLuks2Ids(t.Keyslots)
+		if err != nil {
+			return fmt.Errorf("token %s: %v", id, err)
+		}
+		d.tokens = append(d.tokens, luks.Token{ID: tid, Slots: slots, Type: t.Type, Payload: raw})
+	}
+	sort.Slice(d.tokens, func(i, j int) bool { return d.tokens[i].ID < d.tokens[j].ID })
+	return nil
+}
+
+func parseLuks2Ids(ids []string) ([]int, error) {
+	var result []int
+	for _, id := range ids {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyslot %s", id)
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+// checkLuks2Checksum verifies the checksum of the binary header and the JSON area. The checksum field itself is
+// zeroed while computing it.
+func checkLuks2Checksum(hdr []byte) error {
+	const csumAlgOffset, csumOffset, csumSize = 72, 448, 64
+	alg := string(bytes.TrimRight(hdr[csumAlgOffset:csumAlgOffset+32], "\x00"))
+	h := luksHash(alg)
+	if h == nil {
+		return fmt.Errorf("unsupported header checksum algorithm %s", alg)
+	}
+	data := make([]byte, len(hdr))
+	copy(data, hdr)
+	expected := make([]byte, csumSize)
+	copy(expected, data[csumOffset:csumOffset+csumSize])
+	copy(data[csumOffset:csumOffset+csumSize], make([]byte, csumSize))
+	sum := h()
+	sum.Write(data)
+	if !bytes.Equal(sum.Sum(nil), expected[:sum.Size()]) {
+		return fmt.Errorf("header checksum does not match")
+	}
+	return nil
+}
+
+func luksHash(name string) func() hash.Hash {
+	switch name {
+	case "sha1":
+		return sha1.New
+	case "sha256":
+		return sha256.New
+	case "sha512":
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+func (d *luksDetachedDevice) Close() error {
+	return nil
+}
+
+func (d *luksDetachedDevice) Version() int {
+	return d.version
+}
+
+// Slots returns the keyslots in the order they are tried, the ones with a higher priority go first
+func (d *luksDetachedDevice) Slots() []int {
+	var slots []int
+	for id, ks := range d.slots {
+		if ks.priority > 0 {
+			slots = append(slots, id)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		pi, pj := d.slots[slots[i]].priority, d.slots[slots[j]].priority
+		if pi != pj {
+			return pi > pj
+		}
+		return slots[i] < slots[j]
+	})
+	return slots
+}
+
+func (d *luksDetachedDevice) Tokens() ([]luks.Token, error) {
+	return d.tokens, nil
+}
+
+func (d *luksDetachedDevice) FlagsAdd(flags ...string) error {
+	d.flags = append(d.flags, flags...)
+	return nil
+}
+
+func (d *luksDetachedDevice) Unlock(keyslot int, passphrase []byte, dmName string) error {
+	key, err := d.volumeKey(keyslot, passphrase)
+	if err != nil {
+		return err
+	}
+	table, err := d.cryptTable(key)
+	if err != nil {
+		return err
+	}
+	uuid := fmt.Sprintf("CRYPT-LUKS%d-%s-%s", d.version, strings.ReplaceAll(d.uuid, "-", ""), dmName)
+	return devmapper.CreateAndLoad(dmName, uuid, 0, table)
+}
+
+// volumeKey decrypts the volume key stored at the keyslot. It returns luks.ErrPassphraseDoesNotMatch if the key
+// does not match the digest.
+func (d *luksDetachedDevice) volumeKey(keyslot int, passphrase []byte) ([]byte, error) {
+	ks, ok := d.slots[keyslot]
+	if !ok {
+		return nil, fmt.Errorf("keyslot %d is not active", keyslot)
+	}
+	var digest *luksDigest
+	for _, dg := range d.digests {
+		for _, s := range dg.keyslots {
+			if s == keyslot {
+				digest = dg
+			}
+		}
+	}
+	if digest == nil {
+		return nil, fmt.Errorf("keyslot %d has no digest", keyslot)
+	}
+
+	areaKey, err := ks.kdf.derive(passphrase, ks.areaKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if ks.areaEncryption != "aes-xts-plain64" {
+		return nil, fmt.Errorf("keyslot %d: unsupported keyslot encryption %s", keyslot, ks.areaEncryption)
+	}
+	c, err := xts.NewCipher(aes.NewCipher, areaKey)
+	if err != nil {
+		return nil, fmt.Errorf("keyslot %d: %v", keyslot, err)
+	}
+	size := (ks.areaSize + luksSectorSize - 1) / luksSectorSize * luksSectorSize
+	area := make([]byte, size)
+	f, err := os.Open(d.header)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(area, ks.areaOffset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("keyslot %d: %v", keyslot, err)
+	}
+	for i := int64(0); i < size/luksSectorSize; i++ {
+		sector := area[i*luksSectorSize : (i+1)*luksSectorSize]
+		c.Decrypt(sector, sector, uint64(i))
+	}
+
+	h := luksHash(ks.afHash)
+	if h == nil {
+		return nil, fmt.Errorf("keyslot %d: unsupported AF hash %s", keyslot, ks.afHash)
+	}
+	if ks.stripes < 1 || int64(ks.keySize*ks.stripes) > size {
+		return nil, fmt.Errorf("keyslot %d: invalid AF stripes %d", keyslot, ks.stripes)
+	}
+	key := afMerge(area[:ks.keySize*ks.stripes], ks.keySize, ks.stripes, h)
+
+	dh := luksHash(digest.hash)
+	if dh == nil {
+		return nil, fmt.Errorf("unsupported digest hash %s", digest.hash)
+	}
+	computed := pbkdf2.Key(key, digest.salt, digest.iterations, len(digest.digest), dh)
+	if subtle.ConstantTimeCompare(computed, digest.digest) != 1 {
+		return nil, luks.ErrPassphraseDoesNotMatch
+	}
+	return key, nil
+}
+
+func (k *luksKdf) derive(passphrase []byte, size int) ([]byte, error) {
+	switch k.kind {
+	case "pbkdf2":
+		h := luksHash(k.hash)
+		if h == nil {
+			return nil, fmt.Errorf("unsupported pbkdf2 hash %s", k.hash)
+		}
+		return pbkdf2.Key(passphrase, k.salt, k.iterations, size, h), nil
+	case "argon2i":
+		return argon2.Key(passphrase, k.salt, k.time, k.memory, k.cpus, uint32(size)), nil
+	case "argon2id":
+		return argon2.IDKey(passphrase, k.salt, k.time, k.memory, k.cpus, uint32(size)), nil
+	default:
+		return nil, fmt.Errorf("unsupported kdf %s", k.kind)
+	}
+}
+
+// afMerge recovers the key from the anti-forensic stripes, see the LUKS1 on-disk format specification
+func afMerge(stripes []byte, keySize, count int, h func() hash.Hash) []byte {
+	d := make([]byte, keySize)
+	for i := 0; i < count-1; i++ {
+		for j := range d {
+			d[j] ^= stripes[i*keySize+j]
+		}
+		d = afDiffuse(d, h)
+	}
+	key := make([]byte, keySize)
+	last := stripes[(count-1)*keySize:]
+	for j := range key {
+		key[j] = d[j] ^ last[j]
+	}
+	return key
+}
+
+func afDiffuse(data []byte, h func() hash.Hash) []byte {
+	out := make([]byte, 0, len(data))
+	size := h().Size()
+	for i := 0; i*size < len(data); i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := h()
+		var iv [4]byte
+		binary.BigEndian.PutUint32(iv[:], uint32(i))
+		sum.Write(iv[:])
+		sum.Write(data[i*size : end])
+		out = append(out, sum.Sum(nil)[:end-i*size]...)
+	}
+	return out
+}
+
+// cryptTable builds the dm-crypt table of the data device for the unlocked volume key
+func (d *luksDetachedDevice) cryptTable(key []byte) (devmapper.CryptTable, error) {
+	size := d.segment.size
+	if size == 0 {
+		f, err := os.Open(d.dev)
+		if err != nil {
+			return devmapper.CryptTable{}, err
+		}
+		end, err := f.Seek(0, io.SeekEnd)
+		f.Close()
+		if err != nil {
+			return devmapper.CryptTable{}, err
+		}
+		if uint64(end) <= d.segment.offset {
+			return devmapper.CryptTable{}, fmt.Errorf("data device %s is smaller than the segment offset %d", d.dev, d.segment.offset)
+		}
+		size = uint64(end) - d.segment.offset
+	}
+	flags := append([]string{}, d.flags...)
+	if d.segment.sectorSize != 0 && d.segment.sectorSize != luksSectorSize {
+		flags = append(flags, fmt.Sprintf("sector_size:%d", d.segment.sectorSize))
+	}
+	return devmapper.CryptTable{
+		Start:         0,
+		Length:        size / luksSectorSize,
+		BackendDevice: d.dev,
+		BackendOffset: d.segment.offset / luksSectorSize,
+		Encryption:    d.segment.encryption,
+		Key:           key,
+		IVTweak:       d.segment.ivTweak,
+		Flags:         flags,
+	}, nil
+}
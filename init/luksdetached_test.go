@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anatol/devmapper.go"
+	"github.com/anatol/luks.go"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// makeLuks2Header writes a LUKS2 header with a pbkdf2 and an argon2id keyslot to file and returns the volume key
+func makeLuks2Header(t *testing.T, file string, passphrases [2]string, priorities [2]int) []byte {
+	const (
+		hdrSize    = 16384
+		keySize    = 64
+		stripes    = 4000
+		areaSize   = keySize * stripes
+		areaOffset = 32768
+	)
+	key := make([]byte, keySize)
+	rand.Read(key)
+
+	hdr := make([]byte, areaOffset+2*areaSize)
+	copy(hdr, luks2Magic)
+	binary.BigEndian.PutUint16(hdr[6:], 2)
+	binary.BigEndian.PutUint64(hdr[8:], hdrSize)
+	copy(hdr[72:], "sha256")
+	copy(hdr[168:], "0b0a2167-3a0c-4a04-910d-8b4e2e2d4b1e")
+
+	type kdf map[string]interface{}
+	kdfs := []kdf{
+		{"type": "pbkdf2", "hash": "sha256", "iterations": 1000},
+		{"type": "argon2id", "time": 4, "memory": 32, "cpus": 1},
+	}
+	keyslots := make(map[string]interface{})
+	for i, k := range kdfs {
+		salt := make([]byte, 32)
+		rand.Read(salt)
+		k["salt"] = base64.StdEncoding.EncodeToString(salt)
+
+		var areaKey []byte
+		if k["type"] == "pbkdf2" {
+			areaKey = pbkdf2.Key([]byte(passphrases[i]), salt, 1000, keySize, sha256.New)
+		} else {
+			areaKey = argon2.IDKey([]byte(passphrases[i]), salt, 4, 32, 1, keySize)
+		}
+
+		// anti-forensic split of the key, the last stripe is the diffused xor of the others and the key
+		area := hdr[areaOffset+i*areaSize : areaOffset+(i+1)*areaSize]
+		rand.Read(area[:keySize*(stripes-1)])
+		d := make([]byte, keySize)
+		for s := 0; s < stripes-1; s++ {
+			for j := range d {
+				d[j] ^= area[s*keySize+j]
+			}
+			d = afDiffuse(d, sha256.New)
+		}
+		for j := range d {
+			area[(stripes-1)*keySize+j] = d[j] ^ key[j]
+		}
+		c, err := xts.NewCipher(aes.NewCipher, areaKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for s := 0; s < areaSize/luksSectorSize; s++ {
+			sector := area[s*luksSectorSize : (s+1)*luksSectorSize]
+			c.Encrypt(sector, sector, uint64(s))
+		}
+
+		keyslots[fmt.Sprint(i)] = map[string]interface{}{
+			"type":     "luks2",
+			"key_size": keySize,
+			"priority": priorities[i],
+			"area":     map[string]interface{}{"type": "raw", "offset": fmt.Sprint(areaOffset + i*areaSize), "size": fmt.Sprint(areaSize), "encryption": "aes-xts-plain64", "key_size": keySize},
+			"kdf":      k,
+			"af":       map[string]interface{}{"type": "luks1", "stripes": stripes, "hash": "sha256"},
+		}
+	}
+
+	digestSalt := make([]byte, 32)
+	rand.Read(digestSalt)
+	meta := map[string]interface{}{
+		"keyslots": keyslots,
+		"segments": map[string]interface{}{
+			"0": map[string]interface{}{"type": "crypt", "offset": "4096", "size": "dynamic", "iv_tweak": "0", "encryption": "aes-xts-plain64", "sector_size": 4096},
+		},
+		"digests": map[string]interface{}{
+			"0": map[string]interface{}{
+				"type":       "pbkdf2",
+				"keyslots":   []string{"0", "1"},
+				"segments":   []string{"0"},
+				"hash":       "sha256",
+				"iterations": 1000,
+				"salt":       base64.StdEncoding.EncodeToString(digestSalt),
+				"digest":     base64.StdEncoding.EncodeToString(pbkdf2.Key(key, digestSalt, 1000, 32, sha256.New)),
+			},
+		},
+		"tokens": map[string]interface{}{
+			"0": map[string]interface{}{"type": "clevis", "keyslots": []string{"1"}, "jwe": map[string]interface{}{}},
+		},
+		"config": map[string]interface{}{"json_size": "12288", "keyslots_size": "16744448", "flags": []string{"allow-discards"}},
+	}
+	js, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(hdr[luks2HeaderSize:], js)
+	sum := sha256.Sum256(hdr[:hdrSize])
+	copy(hdr[448:], sum[:])
+
+	if err := os.WriteFile(file, hdr, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestLuksDetachedHeader(t *testing.T) {
+	dir := t.TempDir()
+	header, dev := filepath.Join(dir, "header"), filepath.Join(dir, "data")
+	key := makeLuks2Header(t, header, [2]string{"pbkdf2pass", "argon2pass"}, [2]int{1, 2})
+	if err := os.WriteFile(dev, make([]byte, 1024*1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := openLuksDetached(dev, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version() != 2 || d.uuid != "0b0a2167-3a0c-4a04-910d-8b4e2e2d4b1e" {
+		t.Fatalf("invalid header version %d or uuid %s", d.Version(), d.uuid)
+	}
+	// the high priority keyslot goes first
+	if slots := d.Slots(); !reflect.DeepEqual(slots, []int{1, 0}) {
+		t.Fatalf("invalid slots order %v", slots)
+	}
+	tokens, err := d.Tokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Type != luks.ClevisTokenType || !reflect.DeepEqual(tokens[0].Slots, []int{1}) {
+		t.Fatalf("invalid tokens %+v", tokens)
+	}
+
+	for slot, pass := range []string{"pbkdf2pass", "argon2pass"} {
+		k, err := d.volumeKey(slot, []byte(pass))
+		if err != nil {
+			t.Fatalf("keyslot %d: %v", slot, err)
+		}
+		if !bytes.Equal(k, key) {
+			t.Fatalf("keyslot %d: volume key does not match", slot)
+		}
+		if _, err := d.volumeKey(slot, []byte("wrongpass")); err != luks.ErrPassphraseDoesNotMatch {
+			t.Fatalf("keyslot %d: expected ErrPassphraseDoesNotMatch for a wrong passphrase, got %v", slot, err)
+		}
+	}
+
+	if err := d.FlagsAdd("no_read_workqueue"); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.cryptTable(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := devmapper.CryptTable{
+		Length:        (1024*1024 - 4096) / 512,
+		BackendDevice: dev,
+		BackendOffset: 8,
+		Encryption:    "aes-xts-plain64",
+		Key:           key,
+		Flags:         []string{"allow_discards", "no_read_workqueue", "sector_size:4096"},
+	}
+	if !reflect.DeepEqual(table, expected) {
+		t.Fatalf("invalid crypt table\nexpected %+v\ngot      %+v", expected, table)
+	}
+
+	// a corrupted header is rejected
+	hdr, err := os.ReadFile(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr[luks2HeaderSize+1] ^= 0xff
+	if err := os.WriteFile(header, hdr, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openLuksDetached(dev, header); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("expected a checksum error for a corrupted header, got %v", err)
+	}
+}
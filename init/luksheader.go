@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	luksHeaderMountDir = "/run/booster/header"
+	luksHeaderDir      = "/run/booster/luks-headers"
+	// luksHeaderPromptDelay is the time to wait for the header device before asking the user to plug it in
+	luksHeaderPromptDelay = 10 * time.Second
+)
+
+// luksHeader is a detached LUKS header stored as a file at another device (e.g. the ESP or a keystick), specified
+// with rd.luks.header=$DEVICE:$PATH boot param. The LUKS data device does not have a header then. A header of
+// a crypttab line might be stored in the image, the device is nil then.
+type luksHeader struct {
+	device *deviceRef
+	path   string // path of the header file at the device filesystem
+}
+
+func (h *luksHeader) String() string {
+	if h.device == nil {
+		return h.path
+	}
+	return h.device.String() + ":" + h.path
+}
+
+// parseLuksHeaders parses rd.luks.header=$DEVICE:$PATH boot params. rd.luks.header=$LUKS_DEVICE=$DEVICE:$PATH
+// specifies the header of one of the LUKS devices, a header without the LUKS device applies to the only LUKS device.
+func parseLuksHeaders() error {
+	var global *luksHeader
+	perDevice := make(map[*luksMapping]bool)
+	for _, param := range cmdlineParams("rd.luks.header") {
+		m := luksMappingForOptions(param)
+		if m != nil {
+			param = param[len(m.param)+1:]
+		}
+		ref, path, err := parseDeviceFile("rd.luks.header", param)
+		if err != nil {
+			return err
+		}
+		h := &luksHeader{device: ref, path: path}
+		if m != nil {
+			m.header = h
+			perDevice[m] = true
+		} else {
+			global = h
+		}
+	}
+
+	if global != nil {
+		if len(luksMappings) != 1 {
+			return fmt.Errorf("rd.luks.header=%s does not specify the LUKS device, use rd.luks.header=<device>=%s with several LUKS devices", global, global)
+		}
+		if !perDevice[luksMappings[0]] {
+			luksMappings[0].header = global
+		}
+	}
+
+	for _, m := range luksMappings {
+		if m.header == nil {
+			continue
+		}
+		// the filesystem UUID and label are stored in the LUKS header, the data device has none of them
+		if m.ref.format == refFsUuid || m.ref.format == refFsLabel || m.ref.format == refFsUuidPrefix {
+			return fmt.Errorf("rd.luks.header: LUKS device %s has a detached header, reference the data device with PARTUUID=, PARTLABEL= or a device path instead", m.param)
+		}
+	}
+	return nil
+}
+
+// matchesLuksHeaderMapping reports if the block device is the data device of a LUKS mapping with a detached header.
+// Such a device has no LUKS signature and it is detected by its reference only.
+func matchesLuksHeaderMapping(info *blkInfo) bool {
+	deviceRefsMutex.Lock()
+	defer deviceRefsMutex.Unlock()
+
+	for _, m := range luksMappings {
+		if m.header != nil && m.ref.matchesBlkInfo(info) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLuksHeader copies the detached header to the memory-backed /run, the header device is unmounted right away.
+// If the device does not show up shortly then the user is asked to plug it in. The returned cleanup function removes
+// the copy once the LUKS device is unlocked.
+func readLuksHeader(h *luksHeader, dev string) (string, func(), error) {
+	if h.device == nil {
+		return h.path, func() {}, nil // the header is in the image
+	}
+	info, err := waitForFileDevice(&h.device, luksHeaderPromptDelay)
+	if err != nil {
+		showMessage(fmt.Sprintf("Plug in device %s with the LUKS header of %s", h.device, dev))
+		timeout := deviceTimeout(0)
+		if timeout == 0 {
+			timeout = math.MaxInt64 // wait forever
+		}
+		if info, err = waitForFileDevice(&h.device, timeout); err != nil {
+			return "", nil, fmt.Errorf("luks header %v", err)
+		}
+	}
+
+	content, err := readDeviceFile(info, luksHeaderMountDir, h.path)
+	if err != nil {
+		return "", nil, fmt.Errorf("luks header %s: %v", h, err)
+	}
+	if err := os.MkdirAll(luksHeaderDir, 0700); err != nil {
+		return "", nil, err
+	}
+	file := filepath.Join(luksHeaderDir, filepath.Base(dev)+".luks")
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		return "", nil, err
+	}
+	return file, func() { _ = os.Remove(file) }, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	luks2HeaderSize = 4096 // binary part of the LUKS2 header, the JSON metadata area follows it
+	// luks2MaxHeaderSize is the largest LUKS2 header cryptsetup creates, the JSON area is at most 4MiB with the binary part
+	luks2MaxHeaderSize = 4 * 1024 * 1024
+	// argon2MemoryPercent is the part of the available memory a keyslot key derivation may use. The rest is left
+	// to the initramfs, the other devices being unlocked and the kernel.
+	argon2MemoryPercent = 75
+)
+
+var (
+	luks2Magic = []byte("LUKS\xba\xbe")
+
+	meminfoFile = "/proc/meminfo"
+
+	// luksMemoryCheck is set with booster.luks.memory_check. With "fail" the keyslots that need too much memory are
+	// not tried, with "warn" they are tried anyway.
+	luksMemoryCheck string
+	// luksMemoryCheckModes are the values of booster.luks.memory_check, the first one is the default
+	luksMemoryCheckModes = []string{"fail", "warn"}
+
+	// the devices derive the argon2 keys in parallel, argon2Mutex protects the memory they share
+	argon2Mutex     sync.Mutex
+	argon2Cond      = sync.NewCond(&argon2Mutex)
+	argon2Reserved  uint64 // KiB reserved by the running key derivations
+	argon2Available uint64 // MemAvailable in KiB, read once none of the derivations runs
+)
+
+// argon2MemoryError is returned for a keyslot that needs more memory than available
+type argon2MemoryError struct {
+	msg string
+}
+
+func (e *argon2MemoryError) Error() string {
+	return e.msg
+}
+
+// luks2Argon2Memory returns the argon2 memory cost in KiB of the keyslots read from the LUKS2 header. LUKS1 devices
+// and the pbkdf2 keyslots need little memory, they are not listed.
+func luks2Argon2Memory(path string) (map[int]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, luks2HeaderSize)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:len(luks2Magic)], luks2Magic) || binary.BigEndian.Uint16(hdr[6:8]) != 2 {
+		return nil, nil
+	}
+	size := binary.BigEndian.Uint64(hdr[8:16])
+	if size <= luks2HeaderSize || size > luks2MaxHeaderSize {
+		return nil, fmt.Errorf("invalid LUKS2 header size %d", size)
+	}
+	metadata := make([]byte, size-luks2HeaderSize)
+	if _, err := io.ReadFull(f, metadata); err != nil {
+		return nil, err
+	}
+	return parseLuks2Argon2Memory(bytes.TrimRight(metadata, "\x00"))
+}
+
+func parseLuks2Argon2Memory(metadata []byte) (map[int]uint64, error) {
+	var meta struct {
+		Keyslots map[string]struct {
+			Kdf struct {
+				Type   string `json:"type"`
+				Memory uint64 `json:"memory"` // KiB
+			} `json:"kdf"`
+		} `json:"keyslots"`
+	}
+	if err := json.Unmarshal(metadata, &meta); err != nil {
+		return nil, fmt.Errorf("LUKS2 metadata: %v", err)
+	}
+	memory := make(map[int]uint64)
+	for id, ks := range meta.Keyslots {
+		if !strings.HasPrefix(ks.Kdf.Type, "argon2") {
+			continue
+		}
+		slot, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("LUKS2 metadata: invalid keyslot %s", id)
+		}
+		memory[slot] = ks.Kdf.Memory
+	}
+	return memory, nil
+}
+
+// readMemAvailable returns the memory in KiB available for new allocations without swapping
+func readMemAvailable() (uint64, error) {
+	content, err := os.ReadFile(meminfoFile)
+	if err != nil {
+		return 0, err
+	}
+	return parseMemAvailable(content)
+}
+
+func parseMemAvailable(meminfo []byte) (uint64, error) {
+	s := bufio.NewScanner(bytes.NewReader(meminfo))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("MemAvailable is not found at meminfo")
+}
+
+// reserveArgon2Memory reserves the memory for the argon2 key derivation of the keyslot. All the derivations running
+// in parallel share argon2MemoryPercent of the available memory, the kernel would OOM-kill the init process otherwise.
+// It waits until the other derivations release enough memory and fails if the keyslot needs more than the whole budget.
+// The returned function releases the memory once the key is derived.
+func reserveArgon2Memory(name string, slot int, required uint64) (func(), error) {
+	if required == 0 {
+		return func() {}, nil
+	}
+	argon2Mutex.Lock()
+	defer argon2Mutex.Unlock()
+	if argon2Reserved == 0 {
+		available, err := readMemAvailable()
+		if err != nil {
+			debug("%s: unable to read the available memory: %v", name, err)
+			return func() {}, nil
+		}
+		argon2Available = available
+	}
+	budget := argon2Available / 100 * argon2MemoryPercent
+	if required > budget {
+		msg := fmt.Sprintf("%s: keyslot %d needs %d MiB of memory for argon2 but only %d MiB is available", name, slot, required/1024, argon2Available/1024)
+		if luksMemoryCheck != "warn" {
+			return nil, &argon2MemoryError{msg + ", reduce the keyslot memory cost with 'cryptsetup luksConvertKey --pbkdf-memory' or boot with booster.luks.memory_check=warn to try it anyway"}
+		}
+		// the keyslot does not fit the budget, at least it does not run along with the other derivations
+		warning("%s, trying it anyway as booster.luks.memory_check=warn is set", msg)
+	}
+	for argon2Reserved != 0 && argon2Reserved+required > budget {
+		argon2Cond.Wait()
+	}
+	argon2Reserved += required
+	return func() {
+		argon2Mutex.Lock()
+		argon2Reserved -= required
+		argon2Cond.Broadcast()
+		argon2Mutex.Unlock()
+	}, nil
+}
+
+// luksArgon2Device checks that there is enough memory for the argon2 keyslots before unlocking them
+type luksArgon2Device struct {
+	luksDevice
+	memory map[int]uint64 // argon2 memory cost of the keyslots in KiB
+}
+
+func (d *luksArgon2Device) Unlock(keyslot int, passphrase []byte, dmName string) error {
+	release, err := reserveArgon2Memory(dmName, keyslot, d.memory[keyslot])
+	if err != nil {
+		return err
+	}
+	defer release()
+	return d.luksDevice.Unlock(keyslot, passphrase, dmName)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLuks2Argon2Memory(t *testing.T) {
+	metadata := `{"keyslots":{"0":{"type":"luks2","kdf":{"type":"argon2id","time":4,"memory":1048576,"cpus":4}},` +
+		`"1":{"type":"luks2","kdf":{"type":"pbkdf2","hash":"sha256","iterations":1000}},` +
+		`"2":{"type":"luks2","kdf":{"type":"argon2i","time":4,"memory":65536,"cpus":1}}}}`
+	hdr := make([]byte, 16384)
+	copy(hdr, "LUKS\xba\xbe")
+	binary.BigEndian.PutUint16(hdr[6:], 2)
+	binary.BigEndian.PutUint64(hdr[8:], 16384)
+	copy(hdr[4096:], metadata)
+	file := t.TempDir() + "/luks.img"
+	if err := os.WriteFile(file, hdr, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	memory, err := luks2Argon2Memory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[int]uint64{0: 1048576, 2: 65536}; !reflect.DeepEqual(memory, expected) {
+		t.Fatalf("expected keyslots memory %v, got %v", expected, memory)
+	}
+}
+
+func TestReserveArgon2Memory(t *testing.T) {
+	defer func() {
+		meminfoFile = "/proc/meminfo"
+		luksMemoryCheck = ""
+	}()
+	meminfoFile = t.TempDir() + "/meminfo"
+	meminfo := "MemTotal:         504612 kB\nMemFree:          401220 kB\nMemAvailable:     409600 kB\n"
+	if err := os.WriteFile(meminfoFile, []byte(meminfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	luksMemoryCheck = "fail"
+	release, err := reserveArgon2Memory("root", 0, 262144)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	_, err = reserveArgon2Memory("root", 0, 1048576)
+	if _, ok := err.(*argon2MemoryError); !ok {
+		t.Fatalf("expected a memory error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "needs 1024 MiB of memory for argon2 but only 400 MiB is available") {
+		t.Fatalf("the error does not name the requested and available memory: %v", err)
+	}
+
+	// two keyslots fit the available memory one at a time but not together, the second one waits for the first
+	release, err = reserveArgon2Memory("root", 0, 262144)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved := make(chan func())
+	go func() {
+		r, err := reserveArgon2Memory("data", 0, 262144)
+		if err != nil {
+			t.Error(err)
+		}
+		reserved <- r
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("the memory is reserved for two keyslots at the same time")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case r := <-reserved:
+		r()
+	case <-time.After(time.Second):
+		t.Fatal("the memory is not reserved once the other keyslot released it")
+	}
+	if argon2Reserved != 0 {
+		t.Fatalf("%d KiB is left reserved", argon2Reserved)
+	}
+
+	luksMemoryCheck = "warn"
+	release, err = reserveArgon2Memory("root", 0, 1048576)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestLuksUnlockSlotsMemory(t *testing.T) {
+	defer func() {
+		meminfoFile = "/proc/meminfo"
+		luksMemoryCheck = ""
+	}()
+	meminfoFile = t.TempDir() + "/meminfo"
+	if err := os.WriteFile(meminfoFile, []byte("MemAvailable:     409600 kB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	luksMemoryCheck = "fail"
+
+	// keyslot 0 is argon2 that needs more memory than available, keyslot 1 is pbkdf2
+	fake := &fakeLuksDevice{passphrases: map[int]string{0: "argon2pass", 1: "pbkdf2pass"}}
+	d := &luksArgon2Device{luksDevice: fake, memory: map[int]uint64{0: 1048576}}
+
+	// a passphrase that does not match the other keyslot is an incorrect passphrase, not the memory error
+	unlocked, err := luksUnlockSlots(d, d.Slots(), []byte("mistyped"), "root")
+	if unlocked || err != nil {
+		t.Fatalf("expected an incorrect passphrase, got unlocked=%v err=%v", unlocked, err)
+	}
+	unlocked, err = luksUnlockSlots(d, d.Slots(), []byte("pbkdf2pass"), "root")
+	if !unlocked || err != nil {
+		t.Fatalf("expected the device to be unlocked with the other keyslot, got unlocked=%v err=%v", unlocked, err)
+	}
+
+	// no other keyslot could match
+	unlocked, err = luksUnlockSlots(d, []int{0}, []byte("argon2pass"), "root")
+	if _, ok := err.(*argon2MemoryError); unlocked || !ok {
+		t.Fatalf("expected the memory error, got unlocked=%v err=%v", unlocked, err)
+	}
+}
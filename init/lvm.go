@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// lvmVolume is a logical volume as reported by 'lvm lvs'
+type lvmVolume struct {
+	vg, name string
+	segtype  string // e.g. linear, thin-pool, thin
+	pool     string // thin pool of a thin volume
+	active   bool
+	partial  bool // some of the physical volumes are missing
+}
+
+func (v lvmVolume) String() string {
+	return v.vg + "/" + v.name
+}
+
+// lvmMutex serializes activation of the volumes, it runs every time a new physical volume appears
+var lvmMutex sync.Mutex
+
+func handleLvmBlockDevice(info *blkInfo) error {
+	if _, err := exec.LookPath("lvm"); err != nil {
+		return fmt.Errorf("lvm: lvm tool is not available in the image, add /usr/bin/lvm to 'extra_files' in booster.yaml and regenerate the image")
+	}
+	debug("lvm: found physical volume %s", info.path)
+
+	node := assembly.add(assemblyDevName(info), layerLvm)
+	go func() {
+		// a volume group might span several physical volumes, the volumes that are still missing some of them are
+		// activated once the rest of the physical volumes appear
+		if err := assembly.activate(node, activateLvm); err != nil {
+			severe("%v", err)
+		}
+	}()
+	return nil
+}
+
+// activateLvm activates all complete logical volumes that are not active yet. Thin pools are activated first
+// so their metadata is checked before any of the thin volumes is used.
+func activateLvm() error {
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	for _, m := range []string{"dm_mod", "dm_thin_pool"} {
+		if hasModule(m) {
+			loadModules(m).Wait()
+		}
+	}
+
+	out, err := runLvm("lvs", "--noheadings", "--separator", "|", "-o", "vg_name,lv_name,segtype,pool_lv,lv_attr")
+	if err != nil {
+		return fmt.Errorf("lvm: unable to list logical volumes: %v", err)
+	}
+	volumes, err := parseLvmVolumes(out)
+	if err != nil {
+		return fmt.Errorf("lvm: %v", err)
+	}
+
+	failedPools := make(map[string]bool)
+	for _, v := range volumes {
+		if v.segtype != "thin-pool" || v.active || v.partial {
+			continue
+		}
+		if err := activateThinPool(v); err != nil {
+			severe("%v", err)
+			failedPools[v.vg+"/"+v.name] = true
+		}
+	}
+
+	for _, v := range volumes {
+		if v.segtype == "thin-pool" || v.active || v.partial {
+			continue
+		}
+		if v.segtype == "thin" && failedPools[v.vg+"/"+v.pool] {
+			continue
+		}
+		debug("lvm: activating logical volume %s", v)
+		if _, err := runLvm("lvchange", "--activate", "y", v.String()); err != nil {
+			warning("lvm: unable to activate logical volume %s: %v", v, err)
+		}
+	}
+	return nil
+}
+
+// activateThinPool activates the thin pool. lvm checks the pool metadata with thin_check before the activation.
+func activateThinPool(v lvmVolume) error {
+	if _, err := exec.LookPath("thin_check"); err != nil {
+		return fmt.Errorf("lvm: thin pool %s needs thin_check tool to be activated, add /usr/bin/thin_check to 'extra_files' in booster.yaml and regenerate the image", v)
+	}
+	debug("lvm: activating thin pool %s", v)
+	if _, err := runLvm("lvchange", "--activate", "y", v.String()); err != nil {
+		if thinPoolNeedsRepair(err) {
+			return fmt.Errorf("lvm: metadata check of thin pool %s failed, the pool needs to be repaired with 'lvconvert --repair %s' from a rescue system", v, v)
+		}
+		return fmt.Errorf("lvm: unable to activate thin pool %s: %v", v, err)
+	}
+	return nil
+}
+
+// thinPoolNeedsRepair checks whether the activation failed because of a failed thin_check metadata check
+func thinPoolNeedsRepair(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Manual repair required") || (strings.Contains(msg, "thin_check") && strings.Contains(msg, "failed"))
+}
+
+// parseLvmVolumes parses 'lvm lvs --noheadings --separator | -o vg_name,lv_name,segtype,pool_lv,lv_attr' output
+func parseLvmVolumes(out []byte) ([]lvmVolume, error) {
+	var volumes []lvmVolume
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected lvs output line: %s", line)
+		}
+		attr := fields[4]
+		if len(attr) < 9 {
+			return nil, fmt.Errorf("unexpected attributes %s of logical volume %s/%s", attr, fields[0], fields[1])
+		}
+		volumes = append(volumes, lvmVolume{
+			vg:      fields[0],
+			name:    fields[1],
+			segtype: fields[2],
+			pool:    fields[3],
+			active:  attr[4] == 'a',
+			partial: attr[8] == 'p',
+		})
+	}
+	return volumes, nil
+}
+
+// lvmConfig makes lvm work without udev daemon, booster creates /dev/mapper symlinks itself once the devices appear
+func lvmConfig() string {
+	conf := "devices/obtain_device_list_from_udev=0 activation/udev_sync=0 activation/udev_rules=1"
+	if thinCheck, err := exec.LookPath("thin_check"); err == nil {
+		conf += fmt.Sprintf(" global/thin_check_executable=%q", thinCheck)
+	}
+	return conf
+}
+
+// runLvm runs the lvm command and returns its output. Error messages of the tool are included to the returned error.
+func runLvm(command string, args ...string) ([]byte, error) {
+	if err := os.MkdirAll("/run/lock/lvm", 0755); err != nil {
+		return nil, err
+	}
+
+	args = append([]string{command, "--config", lvmConfig()}, args...)
+	cmd := exec.Command("lvm", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if verbosityLevel >= levelDebug && stderr.Len() > 0 {
+		debug("lvm %s: %s", command, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseLvmVolumes(t *testing.T) {
+	out := []byte(`  vg0|pool|thin-pool||twi---tz--
+  vg0|root|thin|pool|Vwi---tz--
+  vg0|swap|linear||-wi-a-----
+  vg1|data|linear||-wi-----p-
+`)
+	volumes, err := parseLvmVolumes(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []lvmVolume{
+		{vg: "vg0", name: "pool", segtype: "thin-pool"},
+		{vg: "vg0", name: "root", segtype: "thin", pool: "pool"},
+		{vg: "vg0", name: "swap", segtype: "linear", active: true},
+		{vg: "vg1", name: "data", segtype: "linear", partial: true},
+	}
+	if !reflect.DeepEqual(volumes, expected) {
+		t.Fatalf("expected volumes %+v, got %+v", expected, volumes)
+	}
+
+	if _, err := parseLvmVolumes([]byte("vg0|root")); err == nil {
+		t.Fatal("expected malformed output to fail")
+	}
+}
+
+func TestThinPoolNeedsRepair(t *testing.T) {
+	check := func(msg string, expected bool) {
+		if got := thinPoolNeedsRepair(fmt.Errorf("%s", msg)); got != expected {
+			t.Fatalf("%s: expected needs repair %v, got %v", msg, expected, got)
+		}
+	}
+
+	check("exit status 5: Check of pool vg0/pool failed (status:1). Manual repair required!", true)
+	check(`exit status 5: /usr/bin/thin_check failed: bad checksum in superblock`, true)
+	check("exit status 5: Volume group \"vg0\" not found", false)
+}
@@ -1,17 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yookoala/realpath"
@@ -28,58 +29,225 @@ var (
 	cmdline = make(map[string]string)
 	// all boot params (from cmdline) that look like module.name=value considered as potential module parameters for 'module'
 	// it preserved to moduleParams for later use. cmdline is not modified.
-	moduleParams            = make(map[string][]string)
-	rootMounted             sync.WaitGroup // waits until the root partition is mounted
+	moduleParams = make(map[string][]string)
+	// all values of the boot params, some of them (e.g. rd.luks.uuid) can be specified multiple times
+	cmdlineValues           = make(map[string][]string)
+	rootMounted             = make(chan struct{}) // closed once the root filesystem is mounted, see markRootMounted()
+	mountedRootDevice       string                // device the root filesystem is mounted from, set before markRootMounted()
+	rootMountedMutex        sync.Mutex
 	concurrentModuleLoading = true
 )
 
+// parseCmdlineParams splits the kernel command line into cmdline and moduleParams maps
+func parseCmdlineParams(s string) {
+	parts := strings.Split(strings.TrimSpace(s), " ")
+	for _, part := range parts {
+		addCmdlineParam(part)
+	}
+}
+
+func addCmdlineParam(part string) {
+	// separate key/value based on the first = character;
+	// there may be multiple (e.g. in rd.luks.name)
+	if idx := strings.IndexByte(part, '='); idx > -1 {
+		key, val := part[:idx], part[idx+1:]
+		cmdline[key] = val
+		cmdlineValues[key] = append(cmdlineValues[key], val)
+
+		if dot := strings.IndexByte(key, '.'); dot != -1 {
+			// this param looks like a module options
+			mod, param := key[:dot], key[dot+1:]
+			mod = normalizeModuleName(mod)
+			moduleParams[mod] = append(moduleParams[mod], param+"="+val)
+		}
+	} else {
+		cmdline[part] = ""
+	}
+}
+
+// cmdlineParams returns all values of a boot param that can be specified multiple times
+func cmdlineParams(key string) []string {
+	if values, ok := cmdlineValues[key]; ok {
+		return values
+	}
+	if val, ok := cmdline[key]; ok {
+		return []string{val}
+	}
+	return nil
+}
+
 func parseCmdline() error {
 	b, err := os.ReadFile("/proc/cmdline")
 	if err != nil {
 		return err
 	}
-	parts := strings.Split(strings.TrimSpace(string(b)), " ")
-	for _, part := range parts {
-		// separate key/value based on the first = character;
-		// there may be multiple (e.g. in rd.luks.name)
-		if idx := strings.IndexByte(part, '='); idx > -1 {
-			key, val := part[:idx], part[idx+1:]
-			cmdline[key] = val
-
-			if dot := strings.IndexByte(key, '.'); dot != -1 {
-				// this param looks like a module options
-				mod, param := key[:dot], key[dot+1:]
-				mod = normalizeModuleName(mod)
-				moduleParams[mod] = append(moduleParams[mod], param+"="+val)
-			}
-		} else {
-			cmdline[part] = ""
+	parseCmdlineParams(string(b))
+	if param, ok := cmdline["booster.cmdline_file"]; ok {
+		// reading the file loads the storage drivers, the modules blocklisted at the kernel command line must not be
+		// loaded; the blocklist is parsed again below with the params from the file
+		parseBlocklistParam()
+		// the boot continues with the kernel command line params only
+		if err := loadCmdlineFile(param); err != nil {
+			warning("%v", err)
 		}
 	}
 
 	if _, ok := cmdline["booster.debug"]; ok {
 		verbosityLevel = levelDebug
-
+	} else if _, ok := cmdline["quiet"]; ok {
+		verbosityLevel = levelSevere
+	}
+	if param, ok := cmdline["booster.log_level"]; ok {
+		// an explicitly specified level takes precedence over booster.debug and quiet
+		if level, err := parseLogLevel(param); err != nil {
+			warning("%v", err)
+		} else {
+			verbosityLevel = level
+		}
+	}
+	parseLogBufferParam()
+	if verbosityLevel >= levelDebug {
 		// booster debug generates a lot of kmsg logs, to be able to preserve all these logs we disable kmsg throttling
 		if err := disableKmsgThrottling(); err != nil {
 			// user might set 'printk.devkmsg' param and it disables changing the throttling level
 			// in this case ignore the error
 			debug("%v", err)
 		}
-	} else if _, ok := cmdline["quiet"]; ok {
-		verbosityLevel = levelSevere
 	}
 
 	if _, ok := cmdline["booster.disable_concurrent_module_loading"]; ok {
 		concurrentModuleLoading = false
 	}
 
+	if _, ok := cmdline["booster.verbose"]; ok {
+		verboseDeviceReport = true
+	}
+
+	if v, ok := cmdline["booster.label_ci"]; ok && v != "0" {
+		labelCaseInsensitive = true
+	}
+
+	if param, ok := cmdline["booster.symlink_timeout"]; ok {
+		symlinkTimeout, err = parseTimeout(param)
+		if err != nil {
+			warning("booster.symlink_timeout: %v", err)
+		}
+	}
+
+	if param, ok := cmdline["rd.break"]; ok {
+		breakStages, err = parseBreakStages(param)
+		if err != nil {
+			warning("rd.break: %v", err)
+		}
+	}
+
+	if param, ok := cmdline["booster.device_timeout"]; ok {
+		deviceTimeouts, err = parseDeviceTimeouts(param)
+		if err != nil {
+			warning("booster.device_timeout: %v", err)
+		}
+	}
+
+	if err := parseLuksParams(); err != nil {
+		return err
+	}
+	if err := parseVerityParams(); err != nil {
+		return err
+	}
+	rootParam := cmdline["root"]
+	if rootParam == "" && verityRootHash != nil {
+		// the root filesystem is at the dm-verity device
+		rootParam = "/dev/mapper/" + verityRootName
+	}
+	if err := checkVerityRootParam(rootParam); err != nil {
+		return err
+	}
+	cmdRoots, err = parseDeviceRefs("root", rootParam, true)
+	if err != nil {
+		return err
+	}
+	if err := parseSlotParams(); err != nil {
+		return err
+	}
+	for _, r := range cmdRoots {
+		cmdRootNames = append(cmdRootNames, r.String())
+	}
+	cmdRoot = cmdRoots[0]
+	if param, ok := cmdline["mount.usr"]; ok {
+		cmdUsr, err = parseDeviceRef("mount.usr", param, false)
+		if err != nil {
+			return err
+		}
+		usrRequired = true
+	} else if cmdline["root"] == "" {
+		// /usr partition is autodiscovered together with the root partition
+		cmdUsr = autodiscoveryUsrRef(runtime.GOARCH)
+	}
+	if err := parseExtraMounts(); err != nil {
+		return err
+	}
+	if err := parseFactoryResetParams(); err != nil {
+		return err
+	}
+	parseVerifyRootParam()
+	if err := parseFsckParams(); err != nil {
+		return err
+	}
+	if err := parseTrimParam(); err != nil {
+		return err
+	}
+	parseResumeParams()
+	if err := parseOverlayParams(); err != nil {
+		return err
+	}
+	if err := parseLiveParams(); err != nil {
+		return err
+	}
+	if err := parseRescueParam(); err != nil {
+		return err
+	}
+	parsePlymouthParams()
+	if err := parseNetworkParams(); err != nil {
+		return err
+	}
+	if err := parseWireguardParams(); err != nil {
+		return err
+	}
+	parseBlocklistParam()
+	parseModulesParam()
+
 	return nil
 }
 
 var (
 	addedDevices      = map[string]bool{}
 	addedDevicesMutex sync.Mutex
+
+	cmdRoot, cmdResume *deviceRef   // devices specified with root= and resume= boot params, cmdRoot is the currently active root reference
+	cmdRoots           []*deviceRef // ordered list of root references, the next one is tried if the previous one did not appear within the mount timeout
+	cmdRootNames       []string     // root references as specified by the user, used for error reporting
+	activeRoot         int          // index of cmdRoot in cmdRoots
+	rootMountStarted   bool         // set once a device matching the root reference is found, it prevents mounting a fallback root device
+	rootCandidates     []*blkInfo   // devices matching an ambiguous root reference
+	deviceRefsMutex    sync.Mutex   // gpt references get resolved to a device path at the gpt table scan time
+
+	cmdUsr      *deviceRef               // /usr device specified with mount.usr= boot param or autodiscovered
+	usrRequired bool                     // /usr device is specified explicitly and has to be mounted
+	usrMatched  bool                     // a device matching cmdUsr has been found already
+	usrFound    = make(chan *blkInfo, 1) // receives the matched /usr device
+
+	symlinkTimeout      time.Duration   // time to wait for a device symlink to settle, set with booster.symlink_timeout boot param
+	deviceTimeouts      []time.Duration // time to wait for each of the root references to appear, set with booster.device_timeout boot param
+	symlinkPollInterval = 10 * time.Millisecond
+
+	resumeRequired bool                  // resume device is specified or autodiscovered, the root is mounted only after resuming from it is attempted
+	resumeHandled  = make(chan struct{}) // closed once resuming from the device matching cmdResume is attempted
+	resumeOnce     sync.Once
+
+	discoveredDevices      = map[string]*blkInfo{} // all probed block devices, used for reporting when the root is not found
+	discoveredOrder        []string                // names of discoveredDevices in the order they have been probed
+	discoveredDevicesMutex sync.Mutex
+	verboseDeviceReport    bool // set with booster.verbose boot param
 )
 
 // addBlockDevice is called upon receiving a uevent from the kernel with action “add”
@@ -97,66 +265,759 @@ func addBlockDevice(devname string) error {
 
 	debug("found a new device %s", devname)
 
-	cmdroot := cmdline["root"]
+	if isImsmMemberPartition(devname) {
+		debug("%s is a partition of an IMSM member disk, skipping it", devname)
+		return nil
+	}
+
+	applyBlockUdevRules(devname)
 
 	devpath := path.Join("/dev", devname)
+	info, err := cachedProbeBlockDevice(devpath)
+	if err != nil {
+		return err
+	}
+
+	discoveredDevicesMutex.Lock()
+	discoveredDevices[devname] = info
+	discoveredOrder = append(discoveredOrder, devname)
+	discoveredDevicesMutex.Unlock()
+
+	if data, ok := info.data.(btrfsData); ok && data.numDevices > 1 {
+		// all devices of a multi-device btrfs need to be known to the kernel before the filesystem can be mounted
+		if err := registerBtrfsDevice(info); err != nil {
+			warning("%v", err)
+		}
+	}
+
+	if info.format == "gpt" {
+		partitions := info.data.([]gptPart)
+		if isPartition(devname) {
+			// the kernel does not scan partition tables nested into partitions (e.g. a disk image installed to a partition)
+			return handleNestedGpt(devname, partitions)
+		}
+		resolveGptRefs(devname, partitions)
+	}
+
+	deviceRefsMutex.Lock()
+	matchesVerityData := cmdVerityData != nil && cmdVerityData.matchesBlkInfo(info)
+	matchesVerityHash := cmdVerityHash != nil && cmdVerityHash.matchesBlkInfo(info)
+	resumeRef := cmdResume
+	matchesResume := resumeRef != nil && resumeRef.matchesBlkInfo(info)
+	matchesUsr := cmdUsr != nil && !usrMatched && cmdUsr.matchesBlkInfo(info)
+	if matchesUsr {
+		usrMatched = true
+	}
+	matchesMounts := matchExtraMounts(info)
+	// the verity data device must not be mounted without the verification
+	matchesRoot := !rootMountStarted && !matchesVerityData && !matchesVerityHash && cmdRoot.matchesBlkInfo(info)
+	if matchesRoot && cmdRoot.isAmbiguous() {
+		addRootCandidate(info)
+		matchesRoot = false
+	} else if matchesRoot {
+		rootMountStarted = true
+	}
+	deviceRefsMutex.Unlock()
+
+	if matchesResume {
+		resumeOnce.Do(func() {
+			// a failed resume should not prevent the normal boot
+			if err := checkUnambiguous("resume", resumeRef); err != nil {
+				warning("%v", err)
+			} else if err := resume(devpath); err != nil {
+				warning("unable to resume from %s: %v", devpath, err)
+			}
+			close(resumeHandled)
+		})
+	}
+
+	if matchesUsr {
+		usrFound <- info
+	}
+	for _, m := range matchesMounts {
+		go m.stage(info)
+	}
+
+	if matchesVerityData || matchesVerityHash {
+		handleVerityBlockDevice(info, matchesVerityData)
+		return nil
+	}
+
+	if matchesRoot {
+		return mountRootDevice(info)
+	}
+
+	if info.format == "luks" || matchesLuksHeaderMapping(info) {
+		return handleLuksBlockDevice(info, devpath)
+	}
+
+	if info.format == "bcache" {
+		return handleBcacheBlockDevice(info)
+	}
+
+	if info.format == "integrity" {
+		return handleIntegrityBlockDevice(info)
+	}
+
+	if info.format == "lvm" {
+		return handleLvmBlockDevice(info)
+	}
+
+	if info.format == "imsm" {
+		return handleImsmBlockDevice(info)
+	}
+
+	return nil
+}
+
+// describeDiscoveredDevices returns a description of all discovered block devices sorted by the device name
+func describeDiscoveredDevices() []string {
+	discoveredDevicesMutex.Lock()
+	defer discoveredDevicesMutex.Unlock()
+
+	names := make([]string, 0, len(discoveredDevices))
+	for name := range discoveredDevices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		info := discoveredDevices[name]
+		lines = append(lines, fmt.Sprintf("%s: type=%s UUID=%s LABEL=%s", name, info.format, info.uuid.toString(), info.label))
+	}
+	return lines
+}
+
+// reportDiscoveredDevices prints the list of discovered block devices. It helps to find out why the root
+// reference did not match any device, e.g. because of a typo or a missing filesystem module.
+func reportDiscoveredDevices() {
+	if verbosityLevel < levelDebug && !verboseDeviceReport {
+		return
+	}
+
+	lines := describeDiscoveredDevices()
+	if len(lines) == 0 {
+		severe("no block devices have been discovered")
+		return
+	}
+	severe("root %s does not match any of the discovered block devices:", cmdRoot)
+	for _, l := range lines {
+		severe("  %s", l)
+	}
+}
+
+// deviceTimeout returns the time to wait for the root reference with index i to appear. booster.device_timeout
+// specifies the timeouts for the references in order, the last value is used for the rest of the references.
+// Without the param the mount timeout from the image config is used. Zero means waiting forever.
+func deviceTimeout(i int) time.Duration {
+	if len(deviceTimeouts) == 0 {
+		return time.Duration(config.MountTimeout) * time.Second
+	}
+	if i >= len(deviceTimeouts) {
+		i = len(deviceTimeouts) - 1
+	}
+	return deviceTimeouts[i]
+}
+
+// waitForRoot waits for the root filesystem to be mounted. Each of the root references is given its timeout
+// to appear and if it does not then the next reference from the list is tried. The timeout is paused while
+// an rd.break shell is open, the reference gets the whole timeout again once the shell exits. The rd.break=pre-mount
+// shell is started from here once the root mount asks for it with waitPreMountBreak.
+func waitForRoot() error {
+	start := time.Now()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		deviceRefsMutex.Lock()
+		i := activeRoot
+		deviceRefsMutex.Unlock()
+
+		timeout := deviceTimeout(i)
+		var expired <-chan time.Time
+		if timeout != 0 { // otherwise wait for mount forever
+			expired = time.After(timeout)
+		}
+		paused := false
+	wait:
+		for {
+			select {
+			case <-rootMounted:
+				return nil
+			case err := <-rootMountFailures:
+				return err
+			case done := <-preMountBreaks:
+				breakpoint(breakPreMount)
+				close(done)
+				// the reference gets the whole timeout again once the shell exits
+				if timeout != 0 {
+					expired = time.After(timeout)
+				}
+				paused = false
+			case <-heartbeat.C:
+				printHeartbeat(time.Since(start))
+			case <-expired:
+				if atomic.LoadInt32(&debugShells) != 0 {
+					paused = true
+					expired = time.After(debugShellPollInterval)
+					continue
+				}
+				if paused {
+					paused = false
+					expired = time.After(timeout)
+					continue
+				}
+				break wait
+			}
+		}
+		if !activateNextRoot(timeout) {
+			reportDiscoveredDevices()
+			return fmt.Errorf("Timeout waiting for root filesystem %s within %v, tried %s", cmdRootNames[i], timeout, strings.Join(cmdRootNames, ", "))
+		}
+	}
+}
+
+const (
+	heartbeatInterval = 2 * time.Second
+	// debugShellPollInterval is how often the expired root timeout checks whether the rd.break shell has exited
+	debugShellPollInterval = 100 * time.Millisecond
+	// with quiet boot the heartbeat is printed only if the devices take longer than this to appear
+	quietHeartbeatGrace = 10 * time.Second
+)
+
+// pendingDeviceRefs returns the references that are needed for the boot but do not match any device yet
+func pendingDeviceRefs() []string {
+	deviceRefsMutex.Lock()
+	defer deviceRefsMutex.Unlock()
+
+	var pending []string
+	if !rootMountStarted {
+		pending = append(pending, "root "+cmdRoot.String())
+	}
+	for _, m := range luksMappings {
+		if !m.found {
+			pending = append(pending, "luks "+m.ref.String())
+		}
+	}
+	if cmdUsr != nil && usrRequired && !usrMatched {
+		pending = append(pending, "/usr "+cmdUsr.String())
+	}
+	for _, m := range extraMounts {
+		if !m.matched {
+			pending = append(pending, m.Target+" "+m.ref.String())
+		}
+	}
+	return pending
+}
+
+// printHeartbeat shows what devices booster is still waiting for, so a slow disk does not look like a hung boot
+func printHeartbeat(elapsed time.Duration) {
+	if verbosityLevel < levelWarning && elapsed < quietHeartbeatGrace {
+		return
+	}
+	if atomic.LoadInt32(&passwordPrompts) != 0 {
+		return // the device is found already and the user is typing the passphrase
+	}
+	if atomic.LoadInt32(&debugShells) != 0 {
+		return // the heartbeat would mess up the rd.break shell
+	}
+	pending := pendingDeviceRefs()
+	if len(pending) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("waiting for %s (%v)", strings.Join(pending, ", "), elapsed.Round(time.Second))
+	if verbosityLevel < levelWarning {
+		// the heartbeat is shown even with quiet boot once the grace period is over
+		fmt.Println("booster: " + msg)
+		debug("%s", msg)
+		return
+	}
+	warning("%s", msg)
+}
+
+// activateNextRoot switches the active root reference to the next fallback after the current one did not appear
+// within the timeout. The fallback device might have been discovered already and in this case it gets mounted
+// right away. It returns false if there are no more fallbacks.
+func activateNextRoot(timeout time.Duration) bool {
+	deviceRefsMutex.Lock()
+	defer deviceRefsMutex.Unlock()
+
+	if rootMountStarted {
+		// the root device appeared right at the timeout, keep waiting for it
+		return true
+	}
+	if activeRoot == len(cmdRoots)-1 {
+		return false
+	}
+
+	warning("root %s did not appear within %v, trying %s", cmdRootNames[activeRoot], timeout, cmdRootNames[activeRoot+1])
+	activateRoot(activeRoot + 1)
+	return true
+}
+
+// activateRoot makes the i-th root reference active and mounts it if a matching device is discovered already.
+// deviceRefsMutex must be held.
+func activateRoot(i int) {
+	activeRoot = i
+	cmdRoot = cmdRoots[i]
+
+	if cmdRoot.isNetwork() {
+		go mountNetworkRootAsync(cmdRoot)
+		return
+	}
+	if cmdRoot.isZfs() {
+		go mountZfsRootAsync(cmdRoot)
+		return
+	}
+
+	rootCandidates = nil
+	discoveredDevicesMutex.Lock()
+	var match *blkInfo
+	for _, info := range discoveredDevices {
+		if !cmdRoot.matchesBlkInfo(info) {
+			continue
+		}
+		if cmdRoot.isAmbiguous() {
+			addRootCandidate(info)
+			continue
+		}
+		match = info
+		break
+	}
+	discoveredDevicesMutex.Unlock()
+
+	if match != nil {
+		rootMountStarted = true
+		go func() {
+			if err := mountRootDevice(match); err != nil {
+				severe("%v", err)
+			}
+		}()
+	}
+}
+
+// candidatesSettleTime is the time to wait for other devices matching an ambiguous reference
+var candidatesSettleTime = 2 * time.Second
+
+// addRootCandidate records a device that matches an ambiguous root reference. The first candidate starts
+// a timer and once it fires the root gets mounted if the device is the only match. deviceRefsMutex must be held.
+func addRootCandidate(info *blkInfo) {
+	rootCandidates = append(rootCandidates, info)
+	if len(rootCandidates) > 1 {
+		return
+	}
+
+	ref := cmdRoot
+	go func() {
+		time.Sleep(candidatesSettleTime)
+		// stacked devices that are still being activated might host another matching device
+		assembly.waitSettled()
+
+		deviceRefsMutex.Lock()
+		if cmdRoot != ref || rootMountStarted {
+			deviceRefsMutex.Unlock()
+			return
+		}
+		candidates := rootCandidates
+		if len(candidates) == 1 {
+			rootMountStarted = true
+		}
+		deviceRefsMutex.Unlock()
+
+		if len(candidates) > 1 {
+			// none of the candidates is going to be mounted, there is no point in waiting for the timeout
+			failRootWait(fmt.Errorf("root %s is ambiguous, it matches multiple devices: %s", ref, describeCandidates(candidates)))
+			return
+		}
+		if err := mountRootDevice(candidates[0]); err != nil {
+			severe("%v", err)
+		}
+	}()
+}
+
+// checkUnambiguous makes sure that an ambiguous reference other than root= matches exactly one device.
+// Other matching devices are given candidatesSettleTime to appear. name is used for error reporting.
+func checkUnambiguous(name string, ref *deviceRef) error {
+	if !ref.isAmbiguous() {
+		return nil
+	}
+	time.Sleep(candidatesSettleTime)
+
+	discoveredDevicesMutex.Lock()
+	var candidates []*blkInfo
+	for _, info := range discoveredDevices {
+		if ref.matchesBlkInfo(info) {
+			candidates = append(candidates, info)
+		}
+	}
+	discoveredDevicesMutex.Unlock()
+
+	if len(candidates) > 1 {
+		return fmt.Errorf("%s %s is ambiguous, it matches multiple devices: %s", name, ref, describeCandidates(candidates))
+	}
+	return nil
+}
+
+// describeCandidates lists the devices matching an ambiguous reference
+func describeCandidates(candidates []*blkInfo) string {
+	var paths []string
+	for _, c := range candidates {
+		paths = append(paths, c.path+" (UUID="+c.uuid.toString()+")")
+	}
+	sort.Strings(paths) // the devices are probed concurrently, make the report stable
+	return strings.Join(paths, ", ")
+}
+
+// probeBlockDevice reads block device information. If the content type cannot be detected then
+// the device is assumed to be a filesystem of the type specified with rootfstype boot param.
+func probeBlockDevice(devpath string) (*blkInfo, error) {
 	info, err := readBlkInfo(devpath)
 	if err == errUnknownBlockType {
+		devNo, err := deviceNo(devpath)
+		if err != nil {
+			return nil, err
+		}
 		// provide a fake blkid with fs type specified by user
 		info = &blkInfo{
+			path:   devpath,
+			devNo:  devNo,
 			format: cmdline["rootfstype"],
 			isFs:   true,
 		}
 		debug("unable to detect fs type for %s, using one specified by rootfstype boot param %s", devpath, cmdline["rootfstype"])
 	} else if err != nil {
-		return fmt.Errorf("%s: %v", devpath, err)
+		return nil, fmt.Errorf("%s: %v", devpath, err)
 	}
+	return info, nil
+}
 
-	if cmdresume, ok := cmdline["resume"]; ok {
-		if cmdresume == devpath || blkIdMatches(cmdresume, info) {
-			if err := resume(devpath); err != nil {
-				return err
+// mountRootDevice mounts the block device that matches the root reference
+func mountRootDevice(info *blkInfo) (err error) {
+	defer func() {
+		if err != nil {
+			rootMountFailed(err)
+		}
+	}()
+
+	if info, err = factoryReset(info); err != nil {
+		return err
+	}
+
+	if !info.isFs {
+		return fmt.Errorf("specified root %s has type %s and cannot be mounted as a filesystem", cmdRoot, info.format)
+	}
+	if info.format == "" {
+		return fmt.Errorf("unable to detect filesystem type for device %s and no 'rootfstype' boot parameter specified", info.path)
+	}
+	settleDeviceSymlink(info)
+	data, ok := info.data.(btrfsData)
+	multiDevice := ok && data.numDevices > 1
+	if !multiDevice && !resumePending() {
+		return mountRootFs(info)
+	}
+
+	// the other devices are discovered by the caller goroutine thus do not block it
+	go func() {
+		if multiDevice {
+			if err := waitForBtrfsMembers(info); err != nil {
+				severe("%v", err)
+				return
+			}
+		}
+		waitForResume(resumeTimeout)
+		if err := mountRootFs(info); err != nil {
+			severe("%v", err)
+		}
+	}()
+	return nil
+}
+
+// markRootMounted tells waitForRoot that the root filesystem is mounted, either by booster or by hand in rescue mode
+func markRootMounted() {
+	rootMountedMutex.Lock()
+	defer rootMountedMutex.Unlock()
+	select {
+	case <-rootMounted:
+	default:
+		close(rootMounted)
+	}
+}
+
+// parseResumeParams parses resume=, booster.resume_auto and resume_offset= boot params. Resume is optional,
+// the malformed params are reported and ignored so they do not break the boot.
+func parseResumeParams() {
+	var err error
+	cmdResume, resumeRequired = nil, false
+	if param := cmdline["resume"]; param != "" {
+		cmdResume, err = parseDeviceRef("resume", param, false)
+		if err != nil {
+			warning("%v", err)
+		}
+		resumeRequired = cmdResume != nil
+	} else if _, ok := cmdline["booster.resume_auto"]; ok {
+		cmdResume = autodiscoverySwapRef()
+		// a hibernation image can be at the autodiscovered swap as well, the root is not mounted before resuming
+		resumeRequired = true
+	}
+	if param, ok := cmdline["resume_offset"]; ok {
+		resumeOffset, err = parseResumeOffset(param)
+		if err != nil {
+			warning("%v", err)
+		} else if cmdResume == nil {
+			warning("resume_offset is specified without resume device, ignoring it")
+		}
+	}
+}
+
+// resumeTimeout is the time to wait for the resume device before mounting the root filesystem
+const resumeTimeout = 10 * time.Second
+
+// resumePending returns true if the resume device has not been processed yet
+func resumePending() bool {
+	if !resumeRequired {
+		return false
+	}
+	select {
+	case <-resumeHandled:
+		return false
+	default:
+		return true
+	}
+}
+
+// waitForResume waits until resuming from the resume device is attempted. Mounting the root filesystem before resuming
+// a hibernated system would corrupt the filesystem. If the resume device does not appear within the timeout then
+// the boot continues without resuming.
+func waitForResume(timeout time.Duration) {
+	if !resumePending() {
+		return
+	}
+	deviceRefsMutex.Lock()
+	ref := cmdResume
+	deviceRefsMutex.Unlock()
+
+	debug("waiting for resume device %s before mounting the root filesystem", ref)
+	select {
+	case <-resumeHandled:
+	case <-time.After(timeout):
+		warning("resume device %s did not appear within %v, continuing the boot without resuming", ref, timeout)
+	}
+}
+
+// settleDeviceSymlink waits for the device symlink (e.g. /dev/mapper/NAME) to be ready if booster.symlink_timeout is specified.
+// If the symlink does not settle within the timeout then the device is used anyway.
+func settleDeviceSymlink(info *blkInfo) {
+	if symlinkTimeout == 0 {
+		return
+	}
+	if fi, err := os.Lstat(info.path); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		return
+	}
+	if err := waitForDeviceSymlink(info, symlinkTimeout); err != nil {
+		warning("%v", err)
+	}
+}
+
+// waitForDeviceSymlink waits until the device path of info is a symlink that consistently resolves to the device node
+// with the probed device number
+func waitForDeviceSymlink(info *blkInfo, timeout time.Duration) error {
+	start := time.Now()
+	var prev string
+	for {
+		target, err := filepath.EvalSymlinks(info.path)
+		if err == nil {
+			var stat unix.Stat_t
+			if err = unix.Stat(target, &stat); err == nil && uint64(stat.Rdev) == info.devNo {
+				if target == prev {
+					debug("symlink %s -> %s is ready after %v", info.path, target, time.Since(start))
+					return nil
+				}
+			} else {
+				target = ""
 			}
 		}
+		prev = target
+
+		if time.Since(start) > timeout {
+			return fmt.Errorf("timeout waiting for symlink %s to point to device %d:%d", info.path, unix.Major(info.devNo), unix.Minor(info.devNo))
+		}
+		time.Sleep(symlinkPollInterval)
 	}
+}
 
-	matchesRoot := devpath == cmdroot || blkIdMatches(cmdroot, info)
+// isPartition checks whether the block device is a partition of some other device
+func isPartition(devName string) bool {
+	_, err := os.Stat("/sys/class/block/" + devName + "/partition")
+	return err == nil
+}
 
-	if matchesRoot {
-		if !info.isFs {
-			return fmt.Errorf("specified root %s has type %s and cannot be mounted as a filesystem", cmdroot, info.format)
+// gptRefsResolvable checks whether root/resume references can be resolved using the chain of partition tables
+func gptRefsResolvable(levels []tableLevel) bool {
+	deviceRefsMutex.Lock()
+	defer deviceRefsMutex.Unlock()
+
+	for _, r := range cmdRoots {
+		if r.resolveFromGptTableChain(levels) != nil {
+			return true
 		}
-		if info.format == "" {
-			return fmt.Errorf("unable to detect filesystem type for device %s and no 'rootfstype' boot parameter specified", devpath)
+	}
+	if cmdUsr != nil && cmdUsr.resolveFromGptTableChain(levels) != nil {
+		return true
+	}
+	for _, m := range extraMounts {
+		if m.ref != nil && m.ref.resolveFromGptTableChain(levels) != nil {
+			return true
 		}
-		return mountRootFs(devpath, info.format)
 	}
+	return cmdResume != nil && cmdResume.resolveFromGptTableChain(levels) != nil
+}
 
-	if info.format == "luks" {
-		return handleLuksBlockDevice(info, devpath)
+var (
+	nestedTables      = make(map[string][]tableLevel) // chains of the tables exposed by the loop devices attached by handleNestedGpt
+	nestedTablesMutex sync.Mutex
+)
+
+// parentTables returns the chain of the partition tables that contain the partition devName
+func parentTables(devName string) ([]tableLevel, error) {
+	disk, partitions, err := readParentGpt("/dev/" + devName)
+	if err != nil {
+		return nil, err
+	}
+
+	nestedTablesMutex.Lock()
+	defer nestedTablesMutex.Unlock()
+	if chain, ok := nestedTables[disk]; ok {
+		return chain, nil
+	}
+	return []tableLevel{{disk, partitions}}, nil
+}
+
+// handleNestedGpt handles a gpt table found inside the partition devName. If the table contains a referenced partition
+// then the nested table is exposed to the kernel with a partition-scanning loop device and the references are resolved
+// with the chain of the tables from the disk to the nested one. uevents for the loop device and its partitions are then
+// processed the same way as for any other disk.
+func handleNestedGpt(devName string, partitions []gptPart) error {
+	chain, err := parentTables(devName)
+	if err != nil {
+		// e.g. an MBR disk, the references are resolved with the nested table only
+		debug("%v", err)
+	}
+	// the loop device is not attached yet, the partitions are checked at the partition that stores the table
+	levels := append(append([]tableLevel{}, chain...), tableLevel{devName, partitions})
+	if !gptRefsResolvable(levels) {
+		debug("nested gpt table at %s does not contain referenced partitions", devName)
+		return nil
 	}
 
+	wg := loadModules("loop")
+	wg.Wait()
+
+	loop, err := attachLoopDevice("/dev/"+devName, true)
+	if err != nil {
+		return err
+	}
+	levels[len(levels)-1].devName = loop
+
+	nestedTablesMutex.Lock()
+	nestedTables[loop] = levels
+	nestedTablesMutex.Unlock()
+
+	resolveGptTableChainRefs(levels)
 	return nil
 }
 
-func blkIdMatches(blkId string, info *blkInfo) bool {
-	if strings.HasPrefix(blkId, "UUID=") {
-		uuid := strings.TrimPrefix(blkId, "UUID=")
-		u, err := parseUUID(stripQuotes(uuid))
-		if err != nil {
-			warning("unable to parse UUID parameter %s: %v", blkId, err)
-			return false
+// resolveGptRefs checks whether root/resume references point to a partition of the gpt device devName
+// and if they do then references are replaced with the partition device path.
+func resolveGptRefs(devName string, partitions []gptPart) {
+	resolveGptTableChainRefs([]tableLevel{{devName, partitions}})
+}
+
+// resolveGptTableChainRefs is resolveGptRefs for a chain of nested partition tables
+func resolveGptTableChainRefs(levels []tableLevel) {
+	deviceRefsMutex.Lock()
+	defer deviceRefsMutex.Unlock()
+
+	rootResolved := false
+	for i, r := range cmdRoots {
+		if ref, l := r.resolveGptTableLevel(levels); ref != nil {
+			debug("root reference %s resolved to %s", r, ref)
+			if r.format == refGptSlot {
+				countSlotAttempt(l.devName, l.partitions, r)
+			}
+			cmdRoots[i] = ref
+			rootResolved = true
+		}
+	}
+	cmdRoot = cmdRoots[activeRoot]
+	// an autodiscovered /usr partition has to be at the same disk as the autodiscovered root partition
+	if cmdUsr != nil && (usrRequired || rootResolved) {
+		if ref := cmdUsr.resolveFromGptTableChain(levels); ref != nil {
+			debug("/usr reference %s resolved to %s", cmdUsr, ref)
+			cmdUsr = ref
+		}
+	}
+	for _, m := range extraMounts {
+		if m.ref == nil {
+			continue // bind mount
+		}
+		if ref := m.ref.resolveFromGptTableChain(levels); ref != nil {
+			debug("%s reference %s resolved to %s", m.Target, m.ref, ref)
+			m.ref = ref
+		}
+	}
+	if cmdResume != nil {
+		if ref := cmdResume.resolveFromGptTableChain(levels); ref != nil {
+			debug("resume reference %s resolved to %s", cmdResume, ref)
+			cmdResume = ref
 		}
-		return bytes.Equal(u, info.uuid)
 	}
-	if strings.HasPrefix(blkId, "LABEL=") {
-		label := strings.TrimPrefix(blkId, "LABEL=")
-		return info.label == label
+	for _, m := range luksMappings {
+		if ref := m.ref.resolveFromGptTableChain(levels); ref != nil {
+			debug("luks reference %s resolved to %s", m.ref, ref)
+			m.ref = ref
+		}
+	}
+	if cmdLuksKeyfile != nil {
+		if ref := cmdLuksKeyfile.device.resolveFromGptTableChain(levels); ref != nil {
+			debug("keyfile device reference %s resolved to %s", cmdLuksKeyfile.device, ref)
+			cmdLuksKeyfile.device = ref
+		}
 	}
+	for _, f := range []*wireguardFile{cmdWireguardConfig, cmdWireguardKey} {
+		if f == nil {
+			continue
+		}
+		if ref := f.device.resolveFromGptTableChain(levels); ref != nil {
+			debug("wireguard device reference %s resolved to %s", f.device, ref)
+			f.device = ref
+		}
+	}
+	for _, r := range []**deviceRef{&cmdVerityData, &cmdVerityHash} {
+		if *r == nil {
+			continue
+		}
+		if ref := (*r).resolveFromGptTableChain(levels); ref != nil {
+			debug("verity reference %s resolved to %s", *r, ref)
+			*r = ref
+		}
+	}
+}
 
-	return false
+// resumeOffset is the offset of a swap file in pages (usually 4KiB), as reported by the swap file tools,
+// from the start of the resume device. It is set with resume_offset boot param.
+var resumeOffset uint64
+
+func parseResumeOffset(param string) (uint64, error) {
+	offset, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("resume_offset: invalid offset %s", param)
+	}
+	return offset, nil
 }
 
+// resume resumes the hibernated system from the swap partition or from the swap file at resumeOffset of the device.
+// The kernel reads the swap file blocks directly from the device thus the filesystem is not mounted.
 func resume(devpath string) error {
 	devNo, err := deviceNo(devpath)
 	if err != nil {
@@ -165,58 +1026,227 @@ func resume(devpath string) error {
 	major := unix.Major(devNo)
 	minor := unix.Minor(devNo)
 
+	if resumeOffset != 0 {
+		// the offset has to be set before the device, writing the device starts resuming
+		debug("resuming from swap file at offset %d", resumeOffset)
+		if err := os.WriteFile("/sys/power/resume_offset", []byte(strconv.FormatUint(resumeOffset, 10)), 0644); err != nil {
+			return err
+		}
+	}
 	debug("resuming device %s, devno=(%d,%d)", devpath, major, minor)
 	rd := fmt.Sprintf("%d:%d", major, minor)
 	return os.WriteFile("/sys/power/resume", []byte(rd), 0644)
 }
 
-func fsck(dev string) error {
-	if _, err := os.Stat("/usr/bin/fsck"); !os.IsNotExist(err) {
-		cmd := exec.Command("/usr/bin/fsck", "-y", dev)
-		if verbosityLevel >= levelDebug {
-			cmd.Stderr = os.Stderr
-			cmd.Stdout = os.Stdout
-		}
-		if err := cmd.Run(); err != nil {
-			if err, ok := err.(*exec.ExitError); ok {
-				code := err.ExitCode()
-				code &^= 0x1 // bit 1 means errors were corrected successfully which is good
+// mountRootFs loads the filesystem modules and mounts the root device. With rd.break=pre-mount the mount continues
+// in the background once the debug shell started by waitForRoot exits.
+func mountRootFs(info *blkInfo) error {
+	if err := checkVerifiedRoot(info.path); err != nil {
+		rootMountFailed(err)
+		return err
+	}
+	wg := loadModules(info.format)
+	wg.Wait()
 
-				if code != 0 {
-					return fmt.Errorf("fsck for %s failed with code 0x%x", dev, err.ExitCode())
-				}
+	if breakStages[breakPreMount] {
+		// the debug shell runs from waitForRoot, the caller goroutine keeps handling the uevents while it is open
+		go func() {
+			waitPreMountBreak()
+			if err := mountRootFilesystem(info); err != nil {
+				severe("%v", err)
 			}
+		}()
+		return nil
+	}
+	return mountRootFilesystem(info)
+}
 
-			return fmt.Errorf("fsck for %s: unknown error %v", dev, err)
+// mountRootFilesystem mounts the root device that has its filesystem modules loaded, see mountRootFs
+func mountRootFilesystem(info *blkInfo) (err error) {
+	defer func() {
+		if err != nil {
+			rootMountFailed(err)
 		}
-	}
+	}()
 
-	return nil
-}
+	dev, fstype := info.path, info.format
+	deviceRefsMutex.Lock()
+	ref := cmdRoot
+	deviceRefsMutex.Unlock()
 
-func mountRootFs(dev, fstype string) error {
-	wg := loadModules(fstype)
-	wg.Wait()
+	if liveMode {
+		if err := mountLiveRoot(info); err != nil {
+			return err
+		}
+		writeRootDeviceInfo(rootDeviceFile, info, ref)
+		setRootIdentity(info, ref)
+		mountedRootDevice = dev
+		markRootMounted()
+		return nil
+	}
 
-	if err := fsck(dev); err != nil {
+	if fstype != "zfs" && fstype != "nfs" { // zfs datasets are consistent by design and do not have fsck
+		if err := verifyRootDevice(ref, info); err != nil {
+			return err
+		}
+		if err := fsck(dev, fstype); err != nil {
+			return err
+		}
+	}
+	rootMountFlags, options, err := rootMountFlags(ref, fstype)
+	if err != nil {
 		return err
 	}
-
-	rootMountFlags, options := sunderMountFlags(cmdline["rootflags"])
-	if _, ro := cmdline["ro"]; ro {
+	if isDegradedBcache(dev) {
+		warning("%s is started without its cache device, mounting it read-only", dev)
 		rootMountFlags |= unix.MS_RDONLY
 	}
-	if _, rw := cmdline["rw"]; rw {
-		rootMountFlags &^= unix.MS_RDONLY
+	if fstype == "zfs" {
+		// zfsutil allows mounting datasets that do not have the legacy mountpoint
+		options = strings.TrimSuffix("zfsutil,"+options, ",")
+	}
+	if data, ok := info.data.(nfsData); ok {
+		options = nfsMountOptions(data, options)
+	}
+	var subvol string
+	if fstype == "btrfs" {
+		options, subvol, err = btrfsSubvolOptions(options)
+		if err != nil {
+			return err
+		}
 	}
 	if err := mount(dev, newRoot, fstype, rootMountFlags, options); err != nil {
+		if subvol != "" {
+			return fmt.Errorf("unable to mount btrfs subvolume %s of %s: %v", subvol, dev, err)
+		}
+		if rootflags := cmdline["rootflags"]; rootflags != "" {
+			return fmt.Errorf("%v, check the mount options rootflags=%s", err, rootflags)
+		}
 		return err
 	}
+	if fstype != "zfs" && fstype != "nfs" {
+		trimRoot(info)
+	}
 
-	rootMounted.Done()
+	writeRootDeviceInfo(rootDeviceFile, info, ref)
+	setRootIdentity(info, ref)
+	mountedRootDevice = dev
+	markRootMounted()
 	return nil
 }
 
+// rootDeviceFile describes the device the root filesystem is mounted from. /run is moved to the new root
+// at switch_root thus the file is available to the userspace.
+const rootDeviceFile = "/run/booster/root-device"
+
+// writeRootDeviceInfo saves information about the root device as KEY=value lines. It is best-effort,
+// the errors are only logged.
+func writeRootDeviceInfo(file string, info *blkInfo, ref *deviceRef) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "DEVICE=%s\n", info.path)
+	fmt.Fprintf(&b, "DEVNO=%d:%d\n", unix.Major(info.devNo), unix.Minor(info.devNo))
+	fmt.Fprintf(&b, "TYPE=%s\n", info.format)
+	if len(info.uuid) > 0 {
+		fmt.Fprintf(&b, "UUID=%s\n", info.uuid.toString())
+	}
+	if info.label != "" {
+		fmt.Fprintf(&b, "LABEL=%s\n", strings.ReplaceAll(info.label, "\n", " "))
+	}
+	fmt.Fprintf(&b, "REF=%s\n", ref)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		warning("unable to save root device information: %v", err)
+		return
+	}
+	if err := os.WriteFile(file, []byte(b.String()), 0644); err != nil {
+		warning("unable to save root device information: %v", err)
+	}
+}
+
+// rootMountFlags computes the root filesystem mount flags and options from the boot params and the root reference.
+// ro/rw boot params take precedence over rootflags, and the GPT read-only attribute takes precedence over all of them.
+// Without any of them the root is mounted read-only the same way the kernel does, the real init remounts it.
+func rootMountFlags(ref *deviceRef, fstype string) (uintptr, string, error) {
+	rootflags, err := normalizeRootflags(fstype, cmdline["rootflags"])
+	if err != nil {
+		return 0, "", err
+	}
+	flags, options := sunderMountFlags(rootflags)
+	if !hasRootflagsMode(rootflags) {
+		flags |= unix.MS_RDONLY
+	}
+	_, ro := cmdline["ro"]
+	_, rw := cmdline["rw"]
+	if ro && rw {
+		warning("both ro and rw boot params are specified, mounting the root filesystem read-write")
+	}
+	if ro {
+		flags |= unix.MS_RDONLY
+	}
+	if rw {
+		flags &^= unix.MS_RDONLY
+	}
+	if ref.readOnly {
+		debug("root partition has GPT read-only attribute set, mounting it read-only")
+		flags |= unix.MS_RDONLY
+	}
+	return flags, options, nil
+}
+
+// hasRootflagsMode reports if the rootflags specify ro or rw mode. normalizeRootflags keeps only the last of them.
+func hasRootflagsMode(rootflags string) bool {
+	for _, o := range strings.Split(rootflags, ",") {
+		if o == "ro" || o == "rw" {
+			return true
+		}
+	}
+	return false
+}
+
+// mountUsr mounts /usr filesystem after the root filesystem is mounted. An autodiscovered /usr partition is optional
+// and it is mounted only if it has been found at the same disk as the root partition.
+func mountUsr() error {
+	deviceRefsMutex.Lock()
+	ref, required := cmdUsr, usrRequired
+	timeout := deviceTimeout(activeRoot)
+	deviceRefsMutex.Unlock()
+
+	if ref == nil {
+		return nil
+	}
+	if !required && ref.format == refGptType {
+		debug("no /usr partition has been autodiscovered")
+		return nil
+	}
+
+	var info *blkInfo
+	if timeout != 0 {
+		select {
+		case info = <-usrFound:
+		case <-time.After(timeout):
+			return fmt.Errorf("Timeout waiting for /usr filesystem %s within %v", ref, timeout)
+		}
+	} else {
+		info = <-usrFound
+	}
+	if err := checkUnambiguous("/usr", ref); err != nil {
+		return err
+	}
+
+	if !info.isFs || info.format == "" {
+		return fmt.Errorf("/usr device %s has type '%s' and cannot be mounted as a filesystem", info.path, info.format)
+	}
+	settleDeviceSymlink(info)
+	wg := loadModules(info.format)
+	wg.Wait()
+
+	flags, options := sunderMountFlags(cmdline["mount.usrflags"])
+	if ref.readOnly {
+		flags |= unix.MS_RDONLY
+	}
+	return mount(info.path, newRoot+"/usr", info.format, flags, options)
+}
+
 // sunderMountFlags separates list of mount parameters (usually provided by a user) into `flags` and `options`
 // consumable by mount() functions.
 // for example 'noatime,user_xattr,nodev,nobarrier' becomes MS_NOATIME|MS_NODEV and 'user_xattr,nobarrier'
@@ -404,6 +1434,7 @@ func deleteRamfs() error {
 
 // https://github.com/mirror/busybox/blob/9aa751b08ab03d6396f86c3df77937a19687981b/util-linux/switch_root.c#L297
 func switchRoot() error {
+	writeLogFile()
 	if err := moveSlashRunMountpoint(); err != nil {
 		return err
 	}
@@ -471,32 +1502,86 @@ func cleanup() {
 	shutdownNetwork()
 }
 
+// blockDisk is a block device listed in /sys/block together with its partitions
+type blockDisk struct {
+	name       string
+	partitions []string
+}
+
+// maxProbeWorkers limits the number of block devices probed concurrently
+const maxProbeWorkers = 16
+
 func scanSysBlock() error {
 	devs, err := os.ReadDir("/sys/block")
 	if err != nil {
 		return err
 	}
+	disks := make([]blockDisk, 0, len(devs))
 	for _, d := range devs {
-		target := filepath.Join("/sys/block/", d.Name())
-		if err := addBlockDevice(d.Name()); err != nil {
-			// even if it fails to find UUID here (e.g. in case of unsupported partition table)
-			// we still want to check its partitions
-			return err
-		}
-
-		// Probe all partitions of this block device, too:
-		parts, err := os.ReadDir(target)
+		disk := blockDisk{name: d.Name()}
+		parts, err := os.ReadDir(filepath.Join("/sys/block/", d.Name()))
 		if err != nil {
 			return err
 		}
 		for _, p := range parts {
 			// partition name should start with the same prefix as the device itself
-			if !strings.HasPrefix(p.Name(), d.Name()) {
-				continue
+			if strings.HasPrefix(p.Name(), d.Name()) {
+				disk.partitions = append(disk.partitions, p.Name())
 			}
-			if err := addBlockDevice(p.Name()); err != nil {
-				return err
+		}
+		disks = append(disks, disk)
+	}
+
+	workers := runtime.NumCPU() * 2
+	if workers > maxProbeWorkers {
+		workers = maxProbeWorkers
+	}
+	return probeBlockDevices(disks, workers, addBlockDevice)
+}
+
+// probeBlockDevices calls add for all the disks and their partitions using a bounded pool of workers. Disks are probed
+// concurrently but partitions of a disk are added only after the disk itself, in their listing order. Resolving GPT references
+// of the partitions requires the parent disk partition table to be processed first. It returns the first encountered error.
+func probeBlockDevices(disks []blockDisk, workers int, add func(devname string) error) error {
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		firstErr error
+	)
+	if workers > len(disks) {
+		workers = len(disks)
+	}
+	tasks := make(chan blockDisk)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range tasks {
+				if err := probeDisk(d, add); err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMutex.Unlock()
+				}
 			}
+		}()
+	}
+	for _, d := range disks {
+		tasks <- d
+	}
+	close(tasks)
+	wg.Wait()
+	return firstErr
+}
+
+func probeDisk(disk blockDisk, add func(devname string) error) error {
+	if err := add(disk.name); err != nil {
+		return err
+	}
+	for _, p := range disk.partitions {
+		if err := add(p); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -572,6 +1657,14 @@ func boost() error {
 	if err := readAliases(); err != nil {
 		return err
 	}
+	// drivers request firmware at probe time, the first modules get loaded while parsing booster.cmdline_file
+	setFirmwarePath()
+	seedRandom()
+	rules, err := loadUdevRules(udevRulesDir)
+	if err != nil {
+		warning("udev rules: %v", err)
+	}
+	udevRules = rules
 
 	// Per systemd convention https://systemd.io/INITRD_INTERFACE/
 	if err := os.Mkdir("/run/initramfs", 0755); err != nil {
@@ -585,12 +1678,16 @@ func boost() error {
 	if err := configureVirtualConsole(); err != nil {
 		return err
 	}
-
-	rootMounted.Add(1)
+	startPlymouth()
+	breakpoint(breakDeviceRef)
 
 	go udevListener()
 
 	_ = loadModules(config.ModulesForceLoad...)
+	if len(cmdModules) != 0 {
+		debug("booster.modules: load order %s", strings.Join(moduleLoadOrder(cmdModules...), ", "))
+		_ = loadModules(cmdModules...)
+	}
 
 	if err := filepath.Walk("/sys/devices", scanSysModaliases); err != nil {
 		return err
@@ -599,16 +1696,39 @@ func boost() error {
 		return err
 	}
 
-	if config.MountTimeout != 0 {
-		timeout := waitTimeout(&rootMounted, time.Duration(config.MountTimeout)*time.Second)
-		if timeout {
-			return fmt.Errorf("Timeout waiting for root filesystem")
+	for _, r := range cmdRoots {
+		if r.isNetwork() && config.Network == nil {
+			return fmt.Errorf("root %s requires network but this image is built without network support", r)
 		}
-	} else {
-		// wait for mount forever
-		rootMounted.Wait()
+	}
+	if cmdRoot.isNetwork() {
+		go mountNetworkRootAsync(cmdRoot)
+	}
+	if cmdRoot.isZfs() {
+		go mountZfsRootAsync(cmdRoot)
 	}
 
+	if err := waitForRootRescue(); err != nil {
+		return err
+	}
+	measureRoot()
+
+	if err := mountOverlay(); err != nil {
+		return err
+	}
+	if err := mountUsr(); err != nil {
+		return err
+	}
+	if err := mountExtra(); err != nil {
+		return err
+	}
+	deliverCredentials()
+	if err := runHooks(); err != nil {
+		return err
+	}
+
+	breakpoint(breakPrePivot)
+	handoffPlymouth()
 	cleanup()
 	return switchRoot()
 }
@@ -620,8 +1740,83 @@ func readConfig() error {
 	if err != nil {
 		return err
 	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return err
+	}
 
-	return yaml.Unmarshal(data, &config)
+	// the overlay image is unpacked on top of the base image by the kernel
+	data, err = os.ReadFile(overlayInitConfigPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var overlay InitConfig
+	if err := yaml.Unmarshal(data, &overlay); err != nil {
+		return fmt.Errorf("%s: %v", overlayInitConfigPath, err)
+	}
+	debug("merging host-specific config %s", overlayInitConfigPath)
+	mergeInitConfig(&config, &overlay)
+	return nil
+}
+
+// mergeInitConfig applies the host-specific overlay config on top of the base one. The options set in the overlay
+// take precedence, the maps are merged key by key and the forcibly loaded modules of both configs are loaded.
+func mergeInitConfig(base, overlay *InitConfig) {
+	if overlay.Network != nil {
+		base.Network = overlay.Network
+	}
+	mergeMap := func(base *map[string][]string, overlay map[string][]string) {
+		if len(overlay) != 0 && *base == nil {
+			*base = make(map[string][]string)
+		}
+		for k, v := range overlay {
+			(*base)[k] = v
+		}
+	}
+	mergeMap(&base.ModuleDependencies, overlay.ModuleDependencies)
+	mergeMap(&base.ModulePostDependencies, overlay.ModulePostDependencies)
+	mergeMap(&base.ModuleSoftDependencies, overlay.ModuleSoftDependencies)
+overlayModules:
+	for _, m := range overlay.ModulesForceLoad {
+		for _, b := range base.ModulesForceLoad {
+			if b == m {
+				continue overlayModules
+			}
+		}
+		base.ModulesForceLoad = append(base.ModulesForceLoad, m)
+	}
+	if len(overlay.ModprobeOptions) != 0 && base.ModprobeOptions == nil {
+		base.ModprobeOptions = make(map[string]string)
+	}
+	for k, v := range overlay.ModprobeOptions {
+		base.ModprobeOptions[k] = v
+	}
+	if overlay.Kernel != "" && overlay.Kernel != base.Kernel {
+		warning("host-specific config is generated for kernel %s but the image is built for %s", overlay.Kernel, base.Kernel)
+	}
+	if overlay.MountTimeout != 0 {
+		base.MountTimeout = overlay.MountTimeout
+	}
+	if overlay.VirtualConsole != nil {
+		base.VirtualConsole = overlay.VirtualConsole
+	}
+	if len(overlay.Mounts) != 0 {
+		base.Mounts = overlay.Mounts
+	}
+	if overlay.MeasureRootPcr != nil {
+		base.MeasureRootPcr = overlay.MeasureRootPcr
+	}
+	if overlay.FactoryReset != nil {
+		base.FactoryReset = overlay.FactoryReset
+	}
+	if len(overlay.Credentials) != 0 {
+		base.Credentials = overlay.Credentials
+	}
+	if len(overlay.Hooks) != 0 {
+		base.Hooks = overlay.Hooks
+	}
 }
 
 func mount(source, target, fstype string, flags uintptr, options string) error {
@@ -650,6 +1845,7 @@ func readStartTime() {
 }
 
 func emergencyShell() {
+	quitPlymouth()
 	if _, err := os.Stat("/usr/bin/busybox"); !os.IsNotExist(err) {
 		if err := unix.Exec("/usr/bin/busybox", []string{"sh", "-I"}, nil); err != nil {
 			severe("Unable to start an emergency shell: %v\n", err)
@@ -657,6 +1853,17 @@ func emergencyShell() {
 	}
 }
 
+// abortBoot stops the boot because of an error that makes continuing unsafe, e.g. a root device that
+// failed the verification. It starts an emergency shell if it is available.
+func abortBoot(err error) {
+	severe("%v", err)
+	emergencyShell()
+
+	// if we are here then emergency shell did not launch
+	// in this case suggest user to reboot the computer
+	reboot()
+}
+
 func reboot() {
 	fmt.Println("Press ENTER to reboot")
 	_, _ = fmt.Scanln()
@@ -666,6 +1873,11 @@ func reboot() {
 func main() {
 	readStartTime()
 
+	if len(os.Args) > 1 && os.Args[1] == "validate-cmdline" && os.Getpid() != 1 {
+		// dry-run mode used by 'booster validate-cmdline'
+		os.Exit(validateCmdline(os.Args[2:], os.Stdout))
+	}
+
 	if err := checkIfInitrd(); err != nil {
 		panic(err)
 	}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
-	"path"
 	"strings"
 	"sync"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/xi2/xz"
 	"golang.org/x/sys/unix"
 )
 
@@ -22,10 +26,7 @@ var (
 )
 
 func loadModalias(alias string) error {
-	mods, err := matchAlias(alias)
-	if err != nil {
-		return fmt.Errorf("unable to match modalias %s: %v", alias, err)
-	}
+	mods := matchAlias(alias)
 	if len(mods) == 0 {
 		debug("no match found for alias %s", alias)
 		return nil
@@ -75,7 +76,7 @@ func loadModuleUnlocked(wg *sync.WaitGroup, modules ...string) {
 
 		// post deps
 		var postDepsWg sync.WaitGroup
-		if deps, ok := config.ModuleDependencies[mod]; ok {
+		if deps, ok := config.ModulePostDependencies[mod]; ok {
 			loadModuleUnlocked(&postDepsWg, deps...)
 		}
 	}
@@ -84,6 +85,13 @@ func loadModuleUnlocked(wg *sync.WaitGroup, modules ...string) {
 		if _, ok := loadedModules[module]; ok {
 			continue // the module is already loaded
 		}
+		if blocked := blockedBy(module); blocked == module {
+			debug("module %s is blocklisted with booster.blacklist, skip it", module)
+			continue
+		} else if blocked != "" {
+			severe("module %s cannot be loaded as it depends on module %s blocklisted with booster.blacklist", module, blocked)
+			continue
+		}
 
 		_, alreadyLoading := loadingModules[module]
 		wg.Add(1)
@@ -108,8 +116,67 @@ func loadModuleUnlocked(wg *sync.WaitGroup, modules ...string) {
 	}
 }
 
+// moduleCompressionExts are the extensions of the compressed modules, the generator compresses the modules in the image
+// with modules_compression config option
+var moduleCompressionExts = []string{".zst", ".xz", ".gz"}
+
+// moduleFile returns path of the module file in the image, the module might be compressed
+func moduleFile(module string) (string, error) {
+	file := imageModulesDir + module + ".ko"
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+	for _, ext := range moduleCompressionExts {
+		if _, err := os.Stat(file + ext); err == nil {
+			return file + ext, nil
+		}
+	}
+	return "", fmt.Errorf("module %s is not in the image", module)
+}
+
+// hasModule checks whether the image contains the module
+func hasModule(module string) bool {
+	_, err := moduleFile(module)
+	return err == nil
+}
+
+// decompressModule decompresses the module content. The compression is detected by the magic bytes.
+func decompressModule(content []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch {
+	case bytes.HasPrefix(content, []byte("\x7fELF")):
+		return content, nil
+	case bytes.HasPrefix(content, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(nil); err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		return d.DecodeAll(content, nil)
+	case bytes.HasPrefix(content, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		r, err = xz.NewReader(bytes.NewReader(content), 0)
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+		r, err = gzip.NewReader(bytes.NewReader(content))
+	default:
+		n := len(content)
+		if n > 6 {
+			n = 6
+		}
+		return nil, fmt.Errorf("unsupported compression format (magic bytes %x), expected zstd, xz or gzip", content[:n])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
 func finitModule(module string) error {
-	f, err := os.Open(imageModulesDir + "/" + module + ".ko")
+	file, err := moduleFile(module)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
@@ -130,10 +197,36 @@ func finitModule(module string) error {
 	} else {
 		debug("loading module %s params=\"%s\"", module, params)
 	}
-	if err := unix.FinitModule(int(f.Fd()), params, 0); err != nil {
-		return fmt.Errorf("finit(%v): %v", module, err)
+	if strings.HasSuffix(file, ".ko") {
+		err := unix.FinitModule(int(f.Fd()), params, 0)
+		if err == unix.EEXIST {
+			// e.g. loaded by the kernel with request_module()
+			debug("module %s is already loaded", module)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("finit(%v): %v", module, err)
+		}
+		return nil
 	}
 
+	// finit_module() accepts compressed modules since Linux 6.4 only, decompress it in memory instead
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	content, err = decompressModule(content)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	err = unix.InitModule(content, params)
+	if err == unix.EEXIST {
+		debug("module %s is already loaded", module)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("init_module(%v): %v", module, err)
+	}
 	return nil
 }
 
@@ -147,18 +240,127 @@ func loadModules(modules ...string) *sync.WaitGroup {
 	return &wg
 }
 
-// returns all module names that match given alias
-func matchAlias(alias string) ([]string, error) {
+var cmdModules []string // specified with booster.modules boot param
+
+// parseModulesParam parses booster.modules=$MODULE[,$MODULE...] boot param. A module is specified either with its name
+// or with an alias, e.g. booster.modules=fs-btrfs. The modules that are not in the image are reported and skipped.
+func parseModulesParam() {
+	cmdModules = nil
+	for _, param := range cmdlineParams("booster.modules") {
+		for _, name := range strings.Split(param, ",") {
+			if name == "" {
+				continue
+			}
+			mods, err := resolveModuleName(name)
+			if err != nil {
+				warning("booster.modules: %v", err)
+				continue
+			}
+			cmdModules = append(cmdModules, mods...)
+		}
+	}
+}
+
+var blocklistedModules = make(map[string]bool) // specified with booster.blacklist boot param, never loaded
+
+// parseBlocklistParam parses booster.blacklist=$MODULE[,$MODULE...] boot param
+func parseBlocklistParam() {
+	blocklistedModules = make(map[string]bool)
+	for _, param := range cmdlineParams("booster.blacklist") {
+		for _, name := range strings.Split(param, ",") {
+			if name != "" {
+				blocklistedModules[normalizeModuleName(name)] = true
+			}
+		}
+	}
+}
+
+// blockedBy returns the blocklisted module that prevents the module from being loaded. It is either the module itself
+// or one of its dependencies. The soft dependencies are optional, a blocklisted one is skipped when the module is loaded
+// and it does not block the module. An empty string is returned if the module can be loaded.
+func blockedBy(module string) string {
+	if len(blocklistedModules) == 0 {
+		return ""
+	}
+	visited := make(map[string]bool)
+	var visit func(mod string) string
+	visit = func(mod string) string {
+		if blocklistedModules[mod] {
+			return mod
+		}
+		if visited[mod] {
+			return ""
+		}
+		visited[mod] = true
+		for _, d := range config.ModuleDependencies[mod] {
+			if isSoftDependency(mod, d) {
+				continue
+			}
+			if blocked := visit(d); blocked != "" {
+				return blocked
+			}
+		}
+		return ""
+	}
+	return visit(module)
+}
+
+// isSoftDependency checks whether dep is a soft pre-dependency of the module
+func isSoftDependency(module, dep string) bool {
+	for _, d := range config.ModuleSoftDependencies[module] {
+		if d == dep {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveModuleName returns the module with the given name or the modules that match the alias
+func resolveModuleName(name string) ([]string, error) {
+	if mod := normalizeModuleName(name); hasModule(mod) {
+		return []string{mod}, nil
+	}
+	mods := matchAlias(name)
+	if len(mods) == 0 {
+		return nil, fmt.Errorf("module %s is not in the image, add it with 'modules: %s' in booster.yaml", name, name)
+	}
+	return mods, nil
+}
+
+// moduleLoadOrder returns the modules in the order they get loaded: the dependencies (including soft pre-dependencies)
+// go before the module and the soft post-dependencies after it. The modules are loaded concurrently unless
+// booster.disable_concurrent_module_loading is set, the order holds for every dependency chain.
+func moduleLoadOrder(modules ...string) []string {
+	var order []string
+	visited := make(map[string]bool)
+	var visit func(mod string)
+	visit = func(mod string) {
+		if visited[mod] {
+			return
+		}
+		visited[mod] = true
+		for _, d := range config.ModuleDependencies[mod] {
+			visit(d)
+		}
+		order = append(order, mod)
+		for _, d := range config.ModulePostDependencies[mod] {
+			visit(d)
+		}
+	}
+	for _, m := range modules {
+		visit(m)
+	}
+	return order
+}
+
+// returns all module names that match given alias, the patterns are matched the same way as modprobe does
+func matchAlias(alias string) []string {
 	var result []string
 	for _, a := range aliases {
-		match, err := path.Match(a.pattern, alias)
-		if err != nil {
-			return nil, err
-		}
-		if match {
+		if fnmatch(a.pattern, alias) {
 			debug("modalias %v matched module %v", alias, a.module)
 			result = append(result, a.module)
 		}
 	}
-	return result, nil
+	return result
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompressModule(t *testing.T) {
+	module := []byte("\x7fELF module content")
+
+	content, err := decompressModule(module)
+	if err != nil || !bytes.Equal(content, module) {
+		t.Fatalf("uncompressed module is expected to be returned as is, got %q (%v)", content, err)
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write(module); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, compressed := range map[string][]byte{"gzip": gz.Bytes(), "zstd": enc.EncodeAll(module, nil)} {
+		content, err := decompressModule(compressed)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(content, module) {
+			t.Fatalf("%s: expected %q, got %q", name, module, content)
+		}
+	}
+
+	// lz4 is supported by the generator only
+	if _, err := decompressModule([]byte{0x04, 0x22, 0x4d, 0x18, 0x64, 0x40}); err == nil || !strings.Contains(err.Error(), "unsupported compression format") {
+		t.Fatalf("expected unsupported compression error, got %v", err)
+	}
+}
+
+func TestModuleLoadOrder(t *testing.T) {
+	defer func(deps, postDeps map[string][]string) {
+		config.ModuleDependencies, config.ModulePostDependencies = deps, postDeps
+	}(config.ModuleDependencies, config.ModulePostDependencies)
+
+	config.ModuleDependencies = map[string][]string{
+		"btrfs":     {"libcrc32c", "xor", "raid6_pq"},
+		"libcrc32c": {"crc32c_generic"},
+		"raid6_pq":  {"xor"},
+	}
+	config.ModulePostDependencies = map[string][]string{
+		"crc32c_generic": {"crc32c_intel"},
+	}
+
+	order := moduleLoadOrder("btrfs", "xor")
+	expected := []string{"crc32c_generic", "crc32c_intel", "libcrc32c", "xor", "raid6_pq", "btrfs"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected load order %v, got %v", expected, order)
+	}
+}
+
+func TestResolveModuleName(t *testing.T) {
+	defer func(a []alias) { aliases = a }(aliases)
+	aliases = []alias{{"fs-btrfs", "btrfs"}, {"pci:v00008086d000015B8sv*sd*bc*sc*i*", "e1000e"}}
+
+	mods, err := resolveModuleName("fs-btrfs")
+	if err != nil || !reflect.DeepEqual(mods, []string{"btrfs"}) {
+		t.Fatalf("expected fs-btrfs to resolve to btrfs, got %v (%v)", mods, err)
+	}
+	if _, err := resolveModuleName("booster-missing-module"); err == nil || !strings.Contains(err.Error(), "modules: booster-missing-module") {
+		t.Fatalf("expected a hint to add the missing module, got %v", err)
+	}
+}
+
+func TestBlockedBy(t *testing.T) {
+	defer func(deps, softDeps map[string][]string) {
+		config.ModuleDependencies, config.ModuleSoftDependencies = deps, softDeps
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		moduleParams = make(map[string][]string)
+		blocklistedModules = make(map[string]bool)
+	}(config.ModuleDependencies, config.ModuleSoftDependencies)
+
+	cmdline = make(map[string]string)
+	cmdlineValues = make(map[string][]string)
+	moduleParams = make(map[string][]string)
+	config.ModuleDependencies = map[string][]string{
+		"btrfs":     {"libcrc32c", "xor", "raid6_pq"},
+		"libcrc32c": {"crc32c_generic"},
+		"raid6_pq":  {"xor"},
+		"ext4":      {"jbd2", "crc32c_generic"},
+		"xfs":       {"libcrc32c"},
+	}
+	// the soft dependencies are optional, unlike the hard ones
+	config.ModuleSoftDependencies = map[string][]string{
+		"ext4": {"crc32c_generic"},
+		"xfs":  {"libcrc32c"},
+	}
+	parseCmdlineParams("booster.blacklist=nouveau,crc32c-generic booster.blacklist=amdgpu")
+	parseBlocklistParam()
+
+	check := func(module, expected string) {
+		if blocked := blockedBy(module); blocked != expected {
+			t.Fatalf("module %s: expected to be blocked by '%s', got '%s'", module, expected, blocked)
+		}
+	}
+
+	check("nouveau", "nouveau")
+	check("amdgpu", "amdgpu")
+	check("btrfs", "crc32c_generic")
+	check("raid6_pq", "")
+	check("ext4", "")
+	check("xfs", "")
+	check("libcrc32c", "crc32c_generic")
+}
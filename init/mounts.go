@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// extraMountsDir is where the extra filesystems are mounted once their devices appear. They are moved under the new
+// root before switching to it thus the devices are not reopened and the filesystems are not mounted twice.
+const extraMountsDir = "/run/booster/mounts"
+
+// extraMount is a filesystem from the mounts config that is mounted under the new root before switching to it
+type extraMount struct {
+	InitMount
+	ref       *deviceRef // protected with deviceRefsMutex, gpt references get resolved to a device path
+	matched   bool       // a device matching ref has been found already or the wait is over, protected with deviceRefsMutex
+	bind      bool       // Device is a path inside the new root that is bind-mounted to Target
+	recursive bool       // bind the submounts as well (rbind)
+	staging   string     // the mount point inside the initramfs
+	staged    chan error // receives the result of mounting the device at staging
+}
+
+var extraMounts []*extraMount
+
+// parseExtraMounts parses the device references of the mounts config
+func parseExtraMounts() error {
+	extraMounts = nil
+	for i, m := range config.Mounts {
+		target := filepath.Clean("/" + m.Target)
+		if target == "/" {
+			return fmt.Errorf("mount %s: the root filesystem cannot be an extra mount", m.Device)
+		}
+		if target == "/usr" && usrRequired {
+			return fmt.Errorf("mount %s: /usr is specified with mount.usr boot param already", m.Device)
+		}
+		m.Target = target
+
+		em := &extraMount{staging: filepath.Join(extraMountsDir, strconv.Itoa(i)), staged: make(chan error, 1)}
+		em.bind, em.recursive, m.Options = parseBindOption(m.Options)
+		em.InitMount = m
+		if em.bind {
+			if !filepath.IsAbs(m.Device) {
+				return fmt.Errorf("mount %s: bind mount source %s is expected to be an absolute path inside the root filesystem", target, m.Device)
+			}
+			em.matched = true // nothing to wait for
+			extraMounts = append(extraMounts, em)
+			continue
+		}
+
+		ref, err := parseDeviceRef("mount "+target, m.Device, false)
+		if err != nil {
+			return err
+		}
+		if ref.isNetwork() || ref.isZfs() {
+			return fmt.Errorf("mount %s: only block devices are supported, got %s", target, m.Device)
+		}
+		em.ref = ref
+		extraMounts = append(extraMounts, em)
+	}
+	return nil
+}
+
+// parseBindOption removes bind and rbind from the mount options, they are not filesystem options
+func parseBindOption(options string) (bind, recursive bool, rest string) {
+	var other []string
+	for _, o := range strings.Split(options, ",") {
+		switch o {
+		case "bind":
+			bind = true
+		case "rbind":
+			bind, recursive = true, true
+		case "":
+		default:
+			other = append(other, o)
+		}
+	}
+	return bind, recursive, strings.Join(other, ",")
+}
+
+// matchExtraMounts returns the extra mounts that the device is found for. It must be called with deviceRefsMutex held.
+func matchExtraMounts(info *blkInfo) []*extraMount {
+	var matches []*extraMount
+	for _, m := range extraMounts {
+		if !m.matched && m.ref.matchesBlkInfo(info) {
+			m.matched = true
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// stage mounts the found device inside the initramfs, it is moved to its target once the root is mounted
+func (m *extraMount) stage(info *blkInfo) {
+	m.staged <- m.mountDevice(info)
+}
+
+func (m *extraMount) mountDevice(info *blkInfo) error {
+	fstype := m.Fstype
+	if fstype == "" {
+		if !info.isFs || info.format == "" {
+			return fmt.Errorf("%s device %s has type '%s' and cannot be mounted as a filesystem", m.Target, info.path, info.format)
+		}
+		fstype = info.format
+	}
+	settleDeviceSymlink(info)
+	wg := loadModules(fstype)
+	wg.Wait()
+
+	deviceRefsMutex.Lock()
+	readOnly := m.ref.readOnly
+	deviceRefsMutex.Unlock()
+
+	flags, options := sunderMountFlags(m.Options)
+	if readOnly {
+		flags |= unix.MS_RDONLY
+	}
+	return mount(info.path, m.staging, fstype, flags, options)
+}
+
+// mountExtra waits for the filesystems from the mounts config and moves them under the new root in order. The devices
+// are given the timeout of the mounted root reference, the same as the /usr device.
+func mountExtra() error {
+	deviceRefsMutex.Lock()
+	timeout := deviceTimeout(activeRoot)
+	deviceRefsMutex.Unlock()
+
+	// the devices are probed in parallel thus the timeout is counted from the same moment for all of them
+	deadline := time.Now().Add(timeout)
+	for _, m := range extraMounts {
+		var err error
+		if m.bind {
+			err = m.bindMount()
+		} else {
+			err = m.waitAndMove(timeout, deadline)
+		}
+		if err != nil {
+			if !m.NoFail {
+				return err
+			}
+			warning("%v, continuing the boot as the mount is marked with nofail", err)
+		}
+	}
+	return nil
+}
+
+func (m *extraMount) waitAndMove(timeout time.Duration, deadline time.Time) error {
+	var err error
+	if timeout != 0 {
+		select {
+		case err = <-m.staged:
+		case <-time.After(time.Until(deadline)):
+			deviceRefsMutex.Lock()
+			found := m.matched
+			m.matched = true // a device that appears later must not be mounted
+			ref := m.ref
+			deviceRefsMutex.Unlock()
+			if !found {
+				return fmt.Errorf("Timeout waiting for %s filesystem %s within %v", m.Target, ref, timeout)
+			}
+			err = <-m.staged // the device has been found just now
+		}
+	} else {
+		err = <-m.staged
+	}
+	if err != nil {
+		return err
+	}
+	return moveMount(m.staging, filepath.Join(newRoot, m.Target))
+}
+
+// moveMount moves the mount to the target directory, the directory is created if it does not exist at the new root yet.
+// The mount keeps its options.
+func moveMount(source, target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		if unmountErr := unix.Unmount(source, 0); unmountErr != nil {
+			warning("unmount(%s): %v", source, unmountErr)
+		}
+		return fmt.Errorf("unable to create mount point: %v", err)
+	}
+	inform("moving mount %s->%s", source, target)
+	if err := unix.Mount(source, target, "", unix.MS_MOVE, ""); err != nil {
+		return fmt.Errorf("move mount %s to %s: %v", source, target, err)
+	}
+	return nil
+}
+
+// bindMount binds a directory of the new root (e.g. a subdirectory of an extra mount) to the target
+func (m *extraMount) bindMount() error {
+	source := filepath.Join(newRoot, m.Device)
+	target := filepath.Join(newRoot, m.Target)
+	flags, _ := sunderMountFlags(m.Options)
+
+	bindFlags := uintptr(unix.MS_BIND)
+	if m.recursive {
+		bindFlags |= unix.MS_REC
+	}
+	if err := mount(source, target, "", bindFlags, ""); err != nil {
+		return err
+	}
+	if flags == 0 {
+		return nil
+	}
+	// the flags of a bind mount are applied with a remount only
+	if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|flags, ""); err != nil {
+		return fmt.Errorf("remount(%s): %v", target, err)
+	}
+	return nil
+}
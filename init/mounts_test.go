@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExtraMounts(t *testing.T) {
+	defer func() {
+		config.Mounts = nil
+		extraMounts = nil
+		usrRequired = false
+	}()
+
+	config.Mounts = []InitMount{
+		{Device: "LABEL=var", Target: "var/", Options: "noatime"},
+		{Device: "LABEL=data", Target: "/srv", NoFail: true},
+	}
+	if err := parseExtraMounts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(extraMounts) != 2 || extraMounts[0].Target != "/var" || extraMounts[1].ref.String() != "LABEL=data" || extraMounts[1].staging != "/run/booster/mounts/1" {
+		t.Fatalf("unexpected extra mounts %+v", extraMounts)
+	}
+
+	info := &blkInfo{path: "/dev/sda3", format: "ext4", label: "data"}
+	if matches := matchExtraMounts(info); len(matches) != 1 || matches[0].Target != "/srv" {
+		t.Fatalf("expected /srv to match the device, got %+v", matches)
+	}
+	if matches := matchExtraMounts(info); len(matches) != 0 {
+		t.Fatalf("a matched mount is expected to be skipped, got %+v", matches)
+	}
+
+	config.Mounts = []InitMount{{Device: "/srv/data/home", Target: "/home", Options: "rbind,nodev,ro"}}
+	if err := parseExtraMounts(); err != nil {
+		t.Fatal(err)
+	}
+	if m := extraMounts[0]; !m.bind || !m.recursive || m.Options != "nodev,ro" || m.ref != nil {
+		t.Fatalf("unexpected bind mount %+v", m)
+	}
+	if matches := matchExtraMounts(info); len(matches) != 0 {
+		t.Fatalf("a bind mount is not expected to match devices, got %+v", matches)
+	}
+	config.Mounts = []InitMount{{Device: "LABEL=data", Target: "/home", Options: "bind"}}
+	if err := parseExtraMounts(); err == nil {
+		t.Fatal("bind mount source is expected to be a path")
+	}
+
+	config.Mounts = []InitMount{{Device: "LABEL=root", Target: "/"}}
+	if err := parseExtraMounts(); err == nil {
+		t.Fatal("the root filesystem is expected to be rejected")
+	}
+	config.Mounts = []InitMount{{Device: "LABEL=usr", Target: "/usr"}}
+	usrRequired = true
+	if err := parseExtraMounts(); err == nil {
+		t.Fatal("/usr is expected to conflict with mount.usr")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// keyURLMacPlaceholder is replaced with the MAC address of the boot network interface
+	keyURLMacPlaceholder = "<MAC>"
+	// maxLuksKeySize is the maximum size of a keyfile fetched from the network, the same limit as cryptsetup uses
+	maxLuksKeySize      = 8 * 1024 * 1024
+	keyServerMaxBackoff = 8 * time.Second
+)
+
+// parseLuksKeyURL parses rd.luks.keyfile=https://$HOST/$PATH boot param. The URL might contain <MAC> placeholder.
+func parseLuksKeyURL(param string) (string, error) {
+	u, err := url.Parse(expandKeyURL(param, net.HardwareAddr{0, 0, 0, 0, 0, 0}))
+	if err != nil {
+		return "", fmt.Errorf("rd.luks.keyfile: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("rd.luks.keyfile: unsupported URL scheme %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("rd.luks.keyfile: key server is not specified in %s", param)
+	}
+	return param, nil
+}
+
+// expandKeyURL replaces <MAC> placeholder with the MAC address in lowercase dash-separated form, e.g. 52-54-00-12-34-56
+func expandKeyURL(rawurl string, mac net.HardwareAddr) string {
+	return strings.ReplaceAll(rawurl, keyURLMacPlaceholder, strings.ReplaceAll(mac.String(), ":", "-"))
+}
+
+// keyServerBackoff returns the delay before the next attempt to contact the key server
+func keyServerBackoff(attempt int) time.Duration {
+	if attempt >= 5 {
+		return keyServerMaxBackoff
+	}
+	return (500 * time.Millisecond) << attempt
+}
+
+// keyServerClient returns an HTTP client that verifies the key server with the CA bundle embedded at generation time
+func keyServerClient(insecure bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if insecure {
+		tlsConfig.InsecureSkipVerify = true
+	} else {
+		bundle, err := os.ReadFile(keyServerCAPath)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no CA bundle to verify the key server, add 'network.key_server_ca' to booster.yaml")
+		} else if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("%s: no valid certificates found", keyServerCAPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// fetchLuksKey downloads LUKS keyfile specified with rd.luks.keyfile=https://... boot param. Network errors are retried
+// with a backoff until the timeout expires, the timeout of 0 means retrying forever.
+// The caller needs to zero the returned key once it is used.
+func fetchLuksKey(rawurl string, timeout time.Duration) ([]byte, error) {
+	if config.Network == nil {
+		return nil, fmt.Errorf("network is disabled, add 'network' to booster.yaml to fetch keyfile %s", rawurl)
+	}
+	insecure := config.Network.KeyServerInsecure
+	if strings.HasPrefix(rawurl, "http://") && !insecure {
+		return nil, fmt.Errorf("keyfile %s is fetched over unencrypted HTTP, use HTTPS or set 'network.key_server_insecure' in booster.yaml", rawurl)
+	}
+	client, err := keyServerClient(insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		key, retry, err := fetchLuksKeyOnce(client, rawurl)
+		if err == nil {
+			return key, nil
+		}
+		if !retry {
+			return nil, err
+		}
+		delay := keyServerBackoff(attempt)
+		if timeout != 0 && time.Since(start)+delay > timeout {
+			return nil, fmt.Errorf("%v, giving up after %v", err, timeout)
+		}
+		debug("%v, retrying in %v", err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// fetchLuksKeyOnce makes a single attempt to download the keyfile. It also returns whether the error is temporary.
+func fetchLuksKeyOnce(client *http.Client, rawurl string) ([]byte, bool, error) {
+	if strings.Contains(rawurl, keyURLMacPlaceholder) {
+		ifc, err := bootInterface()
+		if err != nil {
+			return nil, true, err
+		}
+		rawurl = expandKeyURL(rawurl, ifc.HardwareAddr)
+	}
+
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		// a server that fails the verification is not going to pass it on the next attempt
+		return nil, !isCertificateError(err), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("keyfile %s: %s", rawurl, resp.Status)
+	}
+
+	key, err := io.ReadAll(io.LimitReader(resp.Body, maxLuksKeySize+1))
+	if err != nil {
+		MemZeroBytes(key)
+		return nil, true, fmt.Errorf("keyfile %s: %v", rawurl, err)
+	}
+	if len(key) > maxLuksKeySize {
+		MemZeroBytes(key)
+		return nil, false, fmt.Errorf("keyfile %s is larger than %d bytes", rawurl, maxLuksKeySize)
+	}
+	if len(key) == 0 {
+		return nil, false, fmt.Errorf("keyfile %s is empty", rawurl)
+	}
+	return key, false, nil
+}
+
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseLuksKeyURL(t *testing.T) {
+	for _, param := range []string{"https://keys.example/node-<MAC>.key", "http://10.0.2.2:8080/root.key"} {
+		if _, err := parseLuksKeyURL(param); err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+	}
+	for _, param := range []string{"ftp://keys.example/root.key", "https:///root.key"} {
+		if _, err := parseLuksKeyURL(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0xab, 0x56}
+	if u := expandKeyURL("https://keys.example/node-<MAC>.key", mac); u != "https://keys.example/node-52-54-00-12-ab-56.key" {
+		t.Fatalf("unexpected expanded URL %s", u)
+	}
+}
+
+func TestKeyServerBackoff(t *testing.T) {
+	expected := []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for i, e := range expected {
+		if d := keyServerBackoff(i); d != e {
+			t.Fatalf("attempt %d: expected backoff %v, got %v", i, e, d)
+		}
+	}
+}
+
+func TestFetchLuksKey(t *testing.T) {
+	defer func() { config.Network = nil }()
+
+	var requests int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/root.key":
+			if requests == 1 {
+				// the first attempt fails as if the server is not ready yet
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte("s3cr3t"))
+		case "/empty.key":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	config.Network = &InitNetworkConfig{}
+	if _, err := fetchLuksKey(srv.URL+"/root.key", time.Minute); err == nil {
+		t.Fatal("expected the server certificate verification to fail without the CA bundle")
+	}
+	untrusted := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}}}
+	if _, retry, err := fetchLuksKeyOnce(untrusted, srv.URL+"/root.key"); err == nil || retry {
+		t.Fatalf("expected untrusted server to fail without retries, got %v", err)
+	}
+
+	config.Network.KeyServerInsecure = true
+	key, err := fetchLuksKey(srv.URL+"/root.key", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "s3cr3t" || requests != 2 {
+		t.Fatalf("unexpected key %q fetched after %d requests", key, requests)
+	}
+
+	requests = 0
+	if _, err := fetchLuksKey(srv.URL+"/missing.key", time.Minute); err == nil || requests != 1 {
+		t.Fatalf("expected missing keyfile to fail without retries, got %v after %d requests", err, requests)
+	}
+	if _, err := fetchLuksKey(srv.URL+"/empty.key", time.Minute); err == nil {
+		t.Fatal("expected empty keyfile to fail")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// iscsiSessionsDir lists the iSCSI sessions, each one has the name of the logged in target
+var iscsiSessionsDir = "/sys/class/iscsi_session"
+
+// mountNetworkRoot attaches a network block device specified with root= boot param and mounts it as the root filesystem.
+// The network is configured asynchronously by the udev listener so the transport setup is retried
+// until the network becomes available.
+func mountNetworkRoot(ref *deviceRef) error {
+	if ref.format == refNfs {
+		return mountNfsRoot(ref)
+	}
+
+	var devpath string
+	var err error
+	for i := 0; i < 40; i++ {
+		if _, err = bootInterface(); err == nil {
+			devpath, err = attachNetworkDevice(ref)
+			if err == nil {
+				break
+			}
+		}
+		debug("%s: %v", ref, err)
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to attach network root device %s: %v", ref, err)
+	}
+	debug("network root device %s attached as %s", ref, devpath)
+
+	deviceRefsMutex.Lock()
+	active := !rootMountStarted && cmdRoot == ref
+	if active {
+		rootMountStarted = true
+	}
+	deviceRefsMutex.Unlock()
+	if !active {
+		return fmt.Errorf("network root device %s is attached but another root device has been selected", ref)
+	}
+
+	info, err := probeBlockDevice(devpath)
+	if err != nil {
+		return err
+	}
+	return mountRootDevice(info)
+}
+
+// mountNetworkRootAsync is a goroutine wrapper for mountNetworkRoot
+func mountNetworkRootAsync(ref *deviceRef) {
+	if err := mountNetworkRoot(ref); err != nil {
+		severe("%v", err)
+	}
+}
+
+// mountNfsRoot mounts the NFS export with the kernel NFS client. The server hostname is resolved once the network
+// is configured as the kernel client accepts the server IP address only.
+func mountNfsRoot(ref *deviceRef) error {
+	data := ref.data.(nfsData)
+	for _, m := range []string{"nfs", "nfsv3", "nfsv4"} {
+		if hasModule(m) {
+			loadModules(m).Wait()
+		}
+	}
+
+	var addrs []string
+	var err error
+	for i := 0; i < 40; i++ {
+		if _, err = bootInterface(); err == nil {
+			if addrs, err = net.LookupHost(data.host); err == nil {
+				break
+			}
+		}
+		debug("%s: %v", ref, err)
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to resolve NFS server of %s: %v", ref, err)
+	}
+
+	deviceRefsMutex.Lock()
+	active := !rootMountStarted && cmdRoot == ref
+	if active {
+		rootMountStarted = true
+	}
+	deviceRefsMutex.Unlock()
+	if !active {
+		return fmt.Errorf("NFS server of %s is resolved but another root device has been selected", ref)
+	}
+
+	resolved := nfsData{host: addrs[0], path: data.path, options: data.options}
+	return mountRootFs(&blkInfo{path: joinHost(addrs[0]) + ":" + data.path, format: "nfs", isFs: true, data: resolved})
+}
+
+// nfsMountOptions adds the options needed by the kernel NFS client. The lock daemon is not available at the initramfs.
+func nfsMountOptions(data nfsData, rootflags string) string {
+	options := []string{"addr=" + data.host, "nolock"}
+	for _, o := range []string{data.options, rootflags} {
+		if o != "" {
+			options = append(options, o)
+		}
+	}
+	return strings.Join(options, ",")
+}
+
+var dhcpRootPathOnce sync.Once
+
+// useDhcpRootPath mounts the root specified with DHCP option 17 (root-path) unless root= boot param is specified.
+// server is the DHCP server address, it is used if the root-path does not specify the server.
+func useDhcpRootPath(rootPath string, server net.IP) {
+	inform("DHCP: received root-path %s", rootPath)
+	if _, ok := cmdline["root"]; ok || verityRootHash != nil {
+		inform("DHCP: root= boot param is specified, ignoring root-path")
+		return
+	}
+
+	dhcpRootPathOnce.Do(func() {
+		ref, err := parseDhcpRootPath(rootPath, server)
+		if err != nil {
+			warning("DHCP: root-path %s: %v", rootPath, err)
+			return
+		}
+
+		deviceRefsMutex.Lock()
+		if rootMountStarted {
+			deviceRefsMutex.Unlock()
+			inform("DHCP: the root device is found already, ignoring root-path")
+			return
+		}
+		cmdRoots = []*deviceRef{ref}
+		cmdRootNames = []string{rootPath}
+		activeRoot = 0
+		cmdRoot = ref
+		deviceRefsMutex.Unlock()
+
+		inform("DHCP: using root %s", ref)
+		go mountNetworkRootAsync(ref)
+	})
+}
+
+// parseDhcpRootPath parses DHCP root-path in one of the formats: nfs://$HOST/$PATH, nfs:[$HOST:]$PATH[:$OPTIONS],
+// [$HOST:]$PATH, iscsi:[$HOST]:... (RFC 4173) or nbd:$HOST:... The DHCP server is used if the host is not specified.
+func parseDhcpRootPath(rootPath string, server net.IP) (*deviceRef, error) {
+	serverHost := ""
+	if server != nil && !server.IsUnspecified() {
+		serverHost = joinHost(server.String())
+	}
+	withServer := func(prefix, rest string) (string, error) {
+		if serverHost == "" {
+			return "", fmt.Errorf("server is not specified and the DHCP server address is unknown")
+		}
+		return prefix + serverHost + ":" + rest, nil
+	}
+
+	param := rootPath
+	var err error
+	switch {
+	case strings.HasPrefix(rootPath, "nfs:/") && !strings.HasPrefix(rootPath, "nfs://"):
+		param, err = withServer("nfs:", strings.TrimPrefix(rootPath, "nfs:"))
+	case strings.HasPrefix(rootPath, "iscsi::"):
+		param, err = withServer("iscsi:", strings.TrimPrefix(rootPath, "iscsi::"))
+	case strings.HasPrefix(rootPath, "nfs:"), strings.HasPrefix(rootPath, "iscsi:"), strings.HasPrefix(rootPath, "nbd:"):
+	case strings.HasPrefix(rootPath, "/"):
+		param, err = withServer("nfs:", rootPath)
+	case strings.Contains(rootPath, ":/") && !strings.Contains(rootPath, "://"):
+		param = "nfs:" + rootPath
+	default:
+		return nil, fmt.Errorf("unsupported root-path format")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceRef("root-path", param, false)
+}
+
+// attachNetworkDevice sets up the transport for the network device reference and returns path of the created block device.
+// The transports are handled by the userspace tools (nbd-client, iscsistart) that need to be added to the image.
+func attachNetworkDevice(ref *deviceRef) (string, error) {
+	switch ref.format {
+	case refNbd:
+		return attachNbd(ref.data.(nbdData))
+	case refIscsi:
+		return attachIscsi(ref.data.(iscsiData))
+	default:
+		return "", fmt.Errorf("%s is not a network device reference", ref)
+	}
+}
+
+func attachNbd(data nbdData) (string, error) {
+	loadModules("nbd").Wait()
+
+	dev, err := freeNbdDevice()
+	if err != nil {
+		return "", err
+	}
+
+	port := data.port
+	if port == 0 {
+		port = nbdDefaultPort
+	}
+	devpath := "/dev/" + dev
+	// -systemd-mark prevents the client from being killed by systemd at shutdown before the root is unmounted
+	cmd := exec.Command("nbd-client", data.host, strconv.Itoa(port), devpath, "-N", data.export, "-systemd-mark")
+	if verbosityLevel >= levelDebug {
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+	}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("nbd-client: %v", err)
+	}
+	return devpath, nil
+}
+
+// freeNbdDevice returns name of an nbd device that is not connected yet, e.g. "nbd0"
+func freeNbdDevice() (string, error) {
+	devs, err := filepath.Glob("/sys/block/nbd*")
+	if err != nil {
+		return "", err
+	}
+	for _, d := range devs {
+		// pid attribute is present only for connected devices
+		if _, err := os.Stat(d + "/pid"); os.IsNotExist(err) {
+			return filepath.Base(d), nil
+		}
+	}
+	return "", fmt.Errorf("no free nbd devices found")
+}
+
+func attachIscsi(data iscsiData) (string, error) {
+	initiator := cmdline["rd.iscsi.initiator"]
+	if initiator == "" {
+		return "", fmt.Errorf("iSCSI initiator name is not specified, use rd.iscsi.initiator boot param")
+	}
+
+	loadModules("iscsi_tcp", "sd_mod").Wait()
+
+	// iscsistart expects the portal address to be an IP
+	addrs, err := net.LookupHost(data.host)
+	if err != nil {
+		return "", err
+	}
+	port := data.port
+	if port == 0 {
+		port = iscsiDefaultPort
+	}
+
+	// a previous attempt might have logged in already and only timed out waiting for the LUN
+	if loggedIn, err := iscsiSessionExists(data.target); err != nil {
+		return "", err
+	} else if loggedIn {
+		debug("iSCSI session to %s exists already, skipping the login", data.target)
+	} else {
+		cmd := exec.Command("iscsistart", "-i", initiator, "-t", data.target, "-g", "1", "-a", addrs[0], "-p", strconv.Itoa(port))
+		if verbosityLevel >= levelDebug {
+			cmd.Stderr = os.Stderr
+			cmd.Stdout = os.Stdout
+		}
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("iscsistart: %v", err)
+		}
+	}
+
+	// the kernel scans the target asynchronously after the login
+	timeout := time.After(10 * time.Second)
+	for {
+		dev, err := iscsiLunDevice(data.target, data.lun)
+		if err != nil {
+			return "", err
+		}
+		if dev != "" {
+			return "/dev/" + dev, nil
+		}
+		select {
+		case <-timeout:
+			return "", fmt.Errorf("timeout waiting for LUN %d of iSCSI target %s", data.lun, data.target)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// iscsiSessionExists checks whether there is a logged in session to the iSCSI target
+func iscsiSessionExists(target string) (bool, error) {
+	sessions, err := filepath.Glob(iscsiSessionsDir + "/session*")
+	if err != nil {
+		return false, err
+	}
+	for _, s := range sessions {
+		name, err := os.ReadFile(s + "/targetname")
+		if err == nil && strings.TrimSpace(string(name)) == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// iscsiLunDevice finds the block device name of the given LUN exported by a logged in iSCSI target.
+// It returns an empty string if the device does not exist (yet).
+func iscsiLunDevice(target string, lun int) (string, error) {
+	sessions, err := filepath.Glob(iscsiSessionsDir + "/session*")
+	if err != nil {
+		return "", err
+	}
+	for _, s := range sessions {
+		name, err := os.ReadFile(s + "/targetname")
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(name)) != target {
+			continue
+		}
+		// e.g. /sys/class/iscsi_session/session1/device/target2:0:0/2:0:0:1/block/sdb
+		devs, err := filepath.Glob(fmt.Sprintf("%s/device/target*/*:*:*:%d/block/*", s, lun))
+		if err != nil {
+			return "", err
+		}
+		if len(devs) > 0 {
+			return filepath.Base(devs[0]), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseDhcpRootPath(t *testing.T) {
+	server := net.ParseIP("10.0.2.2")
+	check := func(rootPath, expected string) {
+		ref, err := parseDhcpRootPath(rootPath, server)
+		if err != nil {
+			t.Fatalf("%s: %v", rootPath, err)
+		}
+		if ref.String() != expected {
+			t.Fatalf("%s: expected root %s, got %s", rootPath, expected, ref)
+		}
+	}
+
+	check("/srv/root", "nfs=10.0.2.2:/srv/root")
+	check("nfs:/srv/root:vers=3", "nfs=10.0.2.2:/srv/root:vers=3")
+	check("nfs:storage:/srv/root", "nfs=storage:/srv/root")
+	check("storage:/srv/root", "nfs=storage:/srv/root")
+	check("nfs://[fd00::5]/exports/node1", "nfs=[fd00::5]:/exports/node1")
+	check("iscsi::6:3261:1:iqn.2021-04.com.example:disk1", "iscsi=10.0.2.2::3261:1:iqn.2021-04.com.example:disk1")
+	check("iscsi:storage::::iqn.2021-04.com.example:disk1", "iscsi=storage:::0:iqn.2021-04.com.example:disk1")
+	check("nbd:storage:rootfs", "nbd=storage:rootfs")
+
+	for _, rootPath := range []string{"rootfs", "http://boot.example/root.img"} {
+		if _, err := parseDhcpRootPath(rootPath, server); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", rootPath)
+		}
+	}
+	if _, err := parseDhcpRootPath("/srv/root", net.IPv4zero); err == nil {
+		t.Fatal("root-path without the server is expected to fail if the DHCP server address is unknown")
+	}
+}
+
+func TestNfsMountOptions(t *testing.T) {
+	if o := nfsMountOptions(nfsData{host: "fd00::1", path: "/srv/root"}, ""); o != "addr=fd00::1,nolock" {
+		t.Fatalf("unexpected NFS mount options %s", o)
+	}
+	if o := nfsMountOptions(nfsData{host: "10.0.2.2", path: "/srv/root", options: "vers=4.2"}, "noatime"); o != "addr=10.0.2.2,nolock,vers=4.2,noatime" {
+		t.Fatalf("unexpected NFS mount options %s", o)
+	}
+}
+
+func TestIscsiSessionExists(t *testing.T) {
+	iscsiSessionsDir = t.TempDir()
+	defer func() { iscsiSessionsDir = "/sys/class/iscsi_session" }()
+
+	exists := func(target string, expected bool) {
+		t.Helper()
+		ok, err := iscsiSessionExists(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Fatalf("%s: expected session exists=%v, got %v", target, expected, ok)
+		}
+	}
+	exists("iqn.2021-04.com.example:disk1", false)
+
+	session := iscsiSessionsDir + "/session1"
+	if err := os.Mkdir(session, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(session+"/targetname", []byte("iqn.2021-04.com.example:disk1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exists("iqn.2021-04.com.example:disk1", true)
+	exists("iqn.2021-04.com.example:disk2", false)
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
@@ -57,23 +58,42 @@ func runDhcp(ifname string) error {
 		}
 	}
 
-	dnsServers := dhcpv4.GetIPs(dhcpv4.OptionDomainNameServer, ack.Options)
-	if dnsServers != nil {
-		if err := writeResolvConf(dnsServers); err != nil {
+	servers := dhcpv4.GetIPs(dhcpv4.OptionDomainNameServer, ack.Options)
+	if servers != nil {
+		if err := addDNSServers(servers); err != nil {
 			return err
 		}
 	}
 
+	if rootPath := ack.RootPath(); rootPath != "" {
+		useDhcpRootPath(rootPath, ack.ServerIPAddr)
+	}
+
 	return nil
 }
 
+// shutdownNetwork deconfigures the interfaces before switching to the new userspace. The network is kept up if
+// the root filesystem is reached over it, the booted system would lose its root otherwise. It includes the WireGuard
+// tunnel, its routes and the routes pinning the tunnel endpoints to the physical interfaces.
 func shutdownNetwork() {
+	if rootOverNetwork() {
+		debug("the root filesystem is mounted over the network, keeping %s configured", strings.Join(initializedIfnames, ", "))
+		return
+	}
 	for _, ifname := range initializedIfnames {
 		link, err := netlink.LinkByName(ifname)
 		if err != nil {
 			continue
 		}
 
+		if ifname == wireguardIfname {
+			// the tunnel holds the private key, deleting the link removes its addresses and routes as well
+			if err := netlink.LinkDel(link); err != nil {
+				warning("unable to delete %s: %v", ifname, err)
+			}
+			continue
+		}
+
 		addrs, _ := netlink.AddrList(link, netlink.FAMILY_ALL)
 		for _, a := range addrs {
 			_ = netlink.AddrDel(link, &a)
@@ -90,6 +110,45 @@ func shutdownNetwork() {
 
 var initializedIfnames []string
 
+// rootOverNetwork reports whether the root filesystem is an NBD or iSCSI device or an NFS export
+func rootOverNetwork() bool {
+	deviceRefsMutex.Lock()
+	defer deviceRefsMutex.Unlock()
+
+	return cmdRoot != nil && cmdRoot.isNetwork()
+}
+
+// networkRootHwaddr returns the MAC address of the interface selected to reach the network root device, e.g.
+// with nbd=52:54:00:12:34:56@10.0.2.2:rootfs. Only this interface is configured then. It returns an empty string if
+// any interface can be used.
+func networkRootHwaddr() string {
+	deviceRefsMutex.Lock()
+	defer deviceRefsMutex.Unlock()
+
+	if cmdRoot == nil {
+		return ""
+	}
+	return cmdRoot.networkHwaddr()
+}
+
+var (
+	// bootIfname is the first network interface that got configured
+	bootIfname      string
+	bootIfnameMutex sync.Mutex
+)
+
+// bootInterface returns the first network interface that got configured at boot
+func bootInterface() (*net.Interface, error) {
+	bootIfnameMutex.Lock()
+	ifname := bootIfname
+	bootIfnameMutex.Unlock()
+
+	if ifname == "" {
+		return nil, fmt.Errorf("network is not configured yet")
+	}
+	return net.InterfaceByName(ifname)
+}
+
 func initializeNetworkInterface(ifname string) error {
 	link, err := netlink.LinkByName(ifname)
 	if err != nil {
@@ -103,6 +162,14 @@ func initializeNetworkInterface(ifname string) error {
 		return err
 	}
 
+	ifConfigs := ipConfigsFor(ifname)
+	prepareIpv6(ifname, ifConfigs)
+	if mtu := ipConfigsMtu(ifConfigs); mtu != 0 {
+		// jumbo frames need to be enabled before the network root is mounted
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("unable to set MTU %d: %v", mtu, err)
+		}
+	}
 	if err := netlink.LinkSetUp(link); err != nil {
 		return err
 	}
@@ -120,9 +187,27 @@ linkReadinessLoop:
 			return fmt.Errorf("Unable to setup network link %s: timeout", ifname)
 		}
 	}
+	if linkWait != 0 {
+		// DHCP has its own retries, try it even if the carrier is still down
+		if err := waitForCarrier(ifname, linkWait); err != nil {
+			warning("%v", err)
+		}
+	}
 
 	c := config.Network
-	if c.Dhcp {
+	if len(ifConfigs) != 0 {
+		// ip= boot params take precedence over booster.yaml
+		for _, ipc := range ifConfigs {
+			if err := configureIp(link, ipc); err != nil {
+				return err
+			}
+		}
+		if len(nameservers) != 0 {
+			if err := addDNSServers(nil); err != nil {
+				return err
+			}
+		}
+	} else if c.Dhcp {
 		if err := runDhcp(ifname); err != nil {
 			return err
 		}
@@ -159,12 +244,23 @@ linkReadinessLoop:
 				}
 				ips = append(ips, ip)
 			}
-			if err := writeResolvConf(ips); err != nil {
+			if err := addDNSServers(ips); err != nil {
 				return err
 			}
 		}
 	}
 
+	// the network root and the key server might be reachable through the tunnel only
+	if err := startWireguard(); err != nil {
+		return err
+	}
+
+	bootIfnameMutex.Lock()
+	if bootIfname == "" {
+		bootIfname = ifname
+	}
+	bootIfnameMutex.Unlock()
+
 	return nil
 }
 
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRootOverNetwork(t *testing.T) {
+	defer func() { cmdRoot = nil }()
+
+	for _, tc := range []struct {
+		root    string
+		network bool
+	}{
+		{"UUID=1705d91e-bf54-4a1a-878d-721d7233eba4", false},
+		{"/dev/sda2", false},
+		{"nbd=10.0.2.2:rootfs", true},
+		{"iscsi=10.0.2.2::::iqn.2021-04.com.example:disk1", true},
+		{"nfs=10.0.2.2:/srv/root", true},
+	} {
+		ref, err := parseDeviceRef("root", tc.root, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmdRoot = ref
+		if rootOverNetwork() != tc.network {
+			t.Fatalf("%s: expected root over network=%v", tc.root, tc.network)
+		}
+	}
+}
+
+func TestNetworkRootHwaddr(t *testing.T) {
+	defer func() { cmdRoot = nil }()
+
+	for _, tc := range []struct {
+		root   string
+		hwaddr string
+		str    string
+	}{
+		{"nbd=10.0.2.2:rootfs", "", "nbd=10.0.2.2:rootfs"},
+		{"nbd=52:54:00:AB:CD:EF@10.0.2.2:10810:rootfs", "52:54:00:ab:cd:ef", "nbd=52:54:00:ab:cd:ef@10.0.2.2:10810:rootfs"},
+		{"iscsi=52:54:00:12:34:56@[fd00::1]::::iqn.2021-04.com.example:disk1", "52:54:00:12:34:56", "iscsi=52:54:00:12:34:56@[fd00::1]:::0:iqn.2021-04.com.example:disk1"},
+		{"nfs=10.0.2.2:/srv/root", "", "nfs=10.0.2.2:/srv/root"},
+		{"/dev/sda2", "", "/dev/sda2"},
+	} {
+		ref, err := parseDeviceRef("root", tc.root, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.String() != tc.str {
+			t.Fatalf("%s: expected %s, got %s", tc.root, tc.str, ref)
+		}
+		cmdRoot = ref
+		if hwaddr := networkRootHwaddr(); hwaddr != tc.hwaddr {
+			t.Fatalf("%s: expected the interface %q to be selected, got %q", tc.root, tc.hwaddr, hwaddr)
+		}
+	}
+
+	cmdRoot = nil
+	if hwaddr := networkRootHwaddr(); hwaddr != "" {
+		t.Fatalf("no interface is expected to be selected without root, got %s", hwaddr)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// overlayDir is where the root filesystem and the overlay layers are mounted to. It is moved to the new root together with /run.
+const overlayDir = "/run/booster/overlay"
+
+var (
+	cmdOverlay    *deviceRef // devices stacked over the root filesystem, specified with booster.overlay boot param
+	overlayLayers int        // number of the layer devices, specified with booster.overlay_layers boot param
+
+	overlayPollInterval = 100 * time.Millisecond
+)
+
+// parseOverlayParams parses booster.overlay and booster.overlay_layers boot params. A reference that might match
+// several filesystems needs the number of layers, otherwise the set of the layers would depend on the timing.
+func parseOverlayParams() error {
+	cmdOverlay, overlayLayers = nil, 0
+	param, ok := cmdline["booster.overlay"]
+	if !ok {
+		return nil
+	}
+	ref, err := parseOverlayRef(param)
+	if err != nil {
+		return err
+	}
+	layers := 1
+	if param, ok := cmdline["booster.overlay_layers"]; ok {
+		layers, err = strconv.Atoi(param)
+		if err != nil || layers < 1 {
+			return fmt.Errorf("booster.overlay_layers: invalid number of layers %s", param)
+		}
+	} else if ref.format == refFsUuidPrefix || ref.format == refFsLabelGlob && hasGlobMeta(ref.data.(string)) {
+		return fmt.Errorf("booster.overlay: %s might match several filesystems, specify their number with booster.overlay_layers", ref)
+	}
+	cmdOverlay, overlayLayers = ref, layers
+	return nil
+}
+
+// parseOverlayRef parses booster.overlay boot param. Layers are matched against probed filesystems thus
+// only filesystem references, e.g. LABEL=layer-* or UUID=1234*, are supported.
+func parseOverlayRef(param string) (*deviceRef, error) {
+	ref, err := parseDeviceRef("booster.overlay", param, false)
+	if err != nil {
+		return nil, err
+	}
+	if ref.dependsOnGpt() || ref.isNetwork() || ref.isZfs() {
+		return nil, fmt.Errorf("booster.overlay: %s is not a filesystem reference", ref)
+	}
+	if ref.format == refFsLabel {
+		// layer labels might be a shell-style glob, check that the pattern is well-formed
+		pattern := ref.data.(string)
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("booster.overlay: invalid pattern %s: %v", pattern, err)
+		}
+		ref.format = refFsLabelGlob
+	}
+	return ref, nil
+}
+
+// resolveAll returns all discovered block devices that match the reference, in the order they have been discovered.
+// Unlike the root reference matching that expects a single device it is used only where many devices are
+// expected, e.g. for overlay layers.
+func resolveAll(ref *deviceRef) []*blkInfo {
+	discoveredDevicesMutex.Lock()
+	defer discoveredDevicesMutex.Unlock()
+
+	var result []*blkInfo
+	for _, name := range discoveredOrder {
+		info := discoveredDevices[name]
+		if info.isFs && ref.matchesBlkInfo(info) {
+			result = append(result, info)
+		}
+	}
+	return result
+}
+
+// overlayLayerDevices returns the discovered filesystems matching the overlay reference except the root device.
+// The layers are sorted by their labels, then by their UUIDs, so the stacking order does not depend on the order
+// the devices are discovered in.
+func overlayLayerDevices(ref *deviceRef, rootDevice string) []*blkInfo {
+	var layers []*blkInfo
+	for _, info := range resolveAll(ref) {
+		if info.path != rootDevice {
+			layers = append(layers, info)
+		}
+	}
+	sort.SliceStable(layers, func(i, j int) bool {
+		if layers[i].label != layers[j].label {
+			return layers[i].label < layers[j].label
+		}
+		return bytes.Compare(layers[i].uuid, layers[j].uuid) < 0
+	})
+	return layers
+}
+
+// waitForOverlayLayers waits until the expected number of the devices matching the overlay reference appear.
+// Timeout 0 means waiting forever.
+func waitForOverlayLayers(ref *deviceRef, count int, rootDevice string, timeout time.Duration) ([]*blkInfo, error) {
+	start := time.Now()
+	for {
+		layers := overlayLayerDevices(ref, rootDevice)
+		if len(layers) > count {
+			return nil, fmt.Errorf("overlay layers %s: expected %d devices, found %d: %s", ref, count, len(layers), describeLayers(layers))
+		}
+		if len(layers) == count {
+			return layers, nil
+		}
+		if timeout != 0 && time.Since(start) > timeout {
+			return nil, fmt.Errorf("Timeout waiting for overlay layers %s within %v: expected %d devices, found %d: %s", ref, timeout, count, len(layers), describeLayers(layers))
+		}
+		time.Sleep(overlayPollInterval)
+	}
+}
+
+func describeLayers(layers []*blkInfo) string {
+	if len(layers) == 0 {
+		return "none"
+	}
+	var paths []string
+	for _, info := range layers {
+		paths = append(paths, info.path)
+	}
+	return strings.Join(paths, ", ")
+}
+
+// mountOverlay stacks the devices matching booster.overlay over the mounted root filesystem. The layers are stacked in
+// the order of their labels, the layer with the lowest label is right above the root filesystem and the one with
+// the highest label is the uppermost. Writes go to a tmpfs and do not modify the layers.
+func mountOverlay() error {
+	if cmdOverlay == nil {
+		return nil
+	}
+
+	deviceRefsMutex.Lock()
+	timeout := deviceTimeout(activeRoot)
+	deviceRefsMutex.Unlock()
+
+	layers, err := waitForOverlayLayers(cmdOverlay, overlayLayers, mountedRootDevice, timeout)
+	if err != nil {
+		return err
+	}
+	if hasModule("overlay") {
+		loadModules("overlay").Wait()
+	}
+
+	rootDir := overlayDir + "/root"
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount(newRoot, rootDir, "", unix.MS_MOVE, ""); err != nil {
+		return fmt.Errorf("move root filesystem to %s: %v", rootDir, err)
+	}
+
+	// overlayfs lowerdir lists the uppermost layer first
+	lowerDirs := []string{rootDir}
+	for i, info := range layers {
+		loadModules(info.format).Wait()
+		dir := fmt.Sprintf("%s/layer%d", overlayDir, i)
+		if err := mount(info.path, dir, info.format, unix.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("overlay layer %s: %v", info.path, err)
+		}
+		debug("overlay layer %d: %s LABEL=%s", i, info.path, info.label)
+		lowerDirs = append([]string{dir}, lowerDirs...)
+	}
+
+	return mountTmpfsOverlay(lowerDirs, overlayDir+"/rw")
+}
+
+// mountTmpfsOverlay mounts an overlay of the read-only lower directories as the new root. The upper and work
+// directories are created at a tmpfs mounted to rwDir so the changes are discarded at reboot.
+func mountTmpfsOverlay(lowerDirs []string, rwDir string) error {
+	if err := mount("tmpfs", rwDir, "tmpfs", 0, "mode=0755"); err != nil {
+		return err
+	}
+	for _, d := range []string{"upper", "work"} {
+		if err := os.Mkdir(rwDir+"/"+d, 0755); err != nil {
+			return err
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s/upper,workdir=%s/work", strings.Join(lowerDirs, ":"), rwDir, rwDir)
+	return mount("overlay", newRoot, "overlay", 0, options)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveAll(t *testing.T) {
+	discoveredDevices = map[string]*blkInfo{
+		"sdb1": {path: "/dev/sdb1", format: "squashfs", isFs: true, label: "layer-base"},
+		"sda1": {path: "/dev/sda1", format: "ext4", isFs: true, label: "root"},
+		"sda2": {path: "/dev/sda2", format: "squashfs", isFs: true, label: "layer-apps"},
+		"sdc":  {path: "/dev/sdc", format: "gpt", label: "layer-disk"},
+	}
+	discoveredOrder = []string{"sdc", "sda1", "sda2", "sdb1"}
+	defer func() {
+		discoveredDevices = map[string]*blkInfo{}
+		discoveredOrder = nil
+	}()
+
+	check := func(param string, expected ...string) {
+		ref, err := parseOverlayRef(param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, info := range resolveAll(ref) {
+			paths = append(paths, info.path)
+		}
+		if strings.Join(paths, " ") != strings.Join(expected, " ") {
+			t.Fatalf("%s: expected %v, got %v", param, expected, paths)
+		}
+	}
+
+	check("LABEL=layer-*", "/dev/sda2", "/dev/sdb1") // discovery order is preserved, non-filesystems are skipped
+	check("LABEL=root", "/dev/sda1")
+	check("LABEL=home-*")
+
+	for _, param := range []string{"PARTLABEL=layer-*", "nbd=10.0.2.2:layers", "zfs:rpool/layers", "LABEL=layer-[ab"} {
+		if _, err := parseOverlayRef(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+func TestOverlayLayers(t *testing.T) {
+	discoveredDevices = map[string]*blkInfo{
+		"sdb1": {path: "/dev/sdb1", format: "squashfs", isFs: true, label: "layer-20-apps"},
+		"sda1": {path: "/dev/sda1", format: "squashfs", isFs: true, label: "layer-00-root"},
+		"sda2": {path: "/dev/sda2", format: "squashfs", isFs: true, label: "layer-10-base", uuid: []byte{2}},
+		"sdc1": {path: "/dev/sdc1", format: "squashfs", isFs: true, label: "layer-10-base", uuid: []byte{1}},
+	}
+	discoveredOrder = []string{"sdb1", "sda1", "sda2", "sdc1"}
+	defer func() {
+		discoveredDevices = map[string]*blkInfo{}
+		discoveredOrder = nil
+	}()
+
+	ref, err := parseOverlayRef("LABEL=layer-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, info := range overlayLayerDevices(ref, "/dev/sda1") {
+		paths = append(paths, info.path)
+	}
+	// sorted by the label and then by the UUID, the root device is not a layer
+	if strings.Join(paths, " ") != "/dev/sdc1 /dev/sda2 /dev/sdb1" {
+		t.Fatalf("unexpected layers order %v", paths)
+	}
+
+	overlayPollInterval = time.Millisecond
+	defer func() { overlayPollInterval = 100 * time.Millisecond }()
+	if layers, err := waitForOverlayLayers(ref, 3, "/dev/sda1", time.Second); err != nil || len(layers) != 3 {
+		t.Fatalf("expected 3 layers, got %v, %v", layers, err)
+	}
+	if _, err := waitForOverlayLayers(ref, 4, "/dev/sda1", 10*time.Millisecond); err == nil || !strings.Contains(err.Error(), "expected 4 devices, found 3") {
+		t.Fatalf("expected to time out waiting for the 4th layer, got %v", err)
+	}
+	if _, err := waitForOverlayLayers(ref, 2, "/dev/sda1", time.Second); err == nil || !strings.Contains(err.Error(), "expected 2 devices, found 3") {
+		t.Fatalf("expected to fail for an extra layer, got %v", err)
+	}
+}
+
+func TestParseOverlayParams(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdOverlay, overlayLayers = nil, 0
+	}()
+
+	check := func(params map[string]string, expectedLayers int) {
+		t.Helper()
+		cmdline = params
+		if err := parseOverlayParams(); err != nil {
+			t.Fatalf("%v: %v", params, err)
+		}
+		if overlayLayers != expectedLayers {
+			t.Fatalf("%v: expected %d layers, got %d", params, expectedLayers, overlayLayers)
+		}
+	}
+	invalid := func(params map[string]string) {
+		t.Helper()
+		cmdline = params
+		if err := parseOverlayParams(); err == nil {
+			t.Fatalf("%v: expected to fail but it did not", params)
+		}
+	}
+
+	check(map[string]string{}, 0)
+	check(map[string]string{"booster.overlay": "LABEL=apps"}, 1)
+	check(map[string]string{"booster.overlay": "LABEL=layer-*", "booster.overlay_layers": "3"}, 3)
+	check(map[string]string{"booster.overlay": "UUID=1234*", "booster.overlay_layers": "2"}, 2)
+	invalid(map[string]string{"booster.overlay": "LABEL=layer-*"})
+	invalid(map[string]string{"booster.overlay": "UUID=1234*"})
+	invalid(map[string]string{"booster.overlay": "LABEL=layer-*", "booster.overlay_layers": "0"})
+	invalid(map[string]string{"booster.overlay": "LABEL=layer-*", "booster.overlay_layers": "two"})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// plymouth boot protocol, see src/ply-boot-protocol.h in the plymouth sources
+const (
+	plymouthRequestPing       = "P"
+	plymouthRequestShowSplash = "$"
+	plymouthRequestPassword   = "*"
+	plymouthRequestMessage    = "M"
+	plymouthRequestNewRoot    = "R"
+	plymouthRequestQuit       = "Q"
+
+	plymouthResponseAck      = 0x06
+	plymouthResponseNak      = 0x15
+	plymouthResponseAnswer   = 0x02
+	plymouthResponseNoAnswer = 0x05
+)
+
+var (
+	// plymouthSocket is the abstract socket plymouthd listens at
+	plymouthSocket  = "@/org/freedesktop/plymouthd"
+	plymouthBinDirs = []string{"/usr/bin", "/usr/sbin"}
+
+	plymouthDisabled bool // disabled with plymouth.enable=0 or rd.plymouth=0 boot params
+	plymouthRunning  bool
+	plymouthMutex    sync.Mutex // protects plymouthRunning
+
+	passwordPrompts int32 // number of the active password prompts, the heartbeat does not interrupt them
+)
+
+// parsePlymouthParams parses the boot params that disable plymouth, the same ones as dracut and systemd use
+func parsePlymouthParams() {
+	for _, p := range []string{"plymouth.enable", "rd.plymouth"} {
+		if v, ok := cmdline[p]; ok && v == "0" {
+			plymouthDisabled = true
+		}
+	}
+}
+
+// startPlymouth starts plymouthd and shows the splash if plymouth is added to the image
+func startPlymouth() {
+	if plymouthDisabled {
+		debug("plymouth is disabled with a boot param")
+		return
+	}
+	var plymouthd string
+	for _, d := range plymouthBinDirs {
+		if _, err := os.Stat(filepath.Join(d, "plymouthd")); err == nil {
+			plymouthd = filepath.Join(d, "plymouthd")
+			break
+		}
+	}
+	if plymouthd == "" {
+		return
+	}
+
+	if err := os.MkdirAll("/run/plymouth", 0755); err != nil {
+		warning("plymouth: %v", err)
+		return
+	}
+	cmdlineContent, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		warning("plymouth: %v", err)
+		return
+	}
+	// there is no udev daemon in the image thus plymouth should not wait for it to announce the graphic devices
+	kernelCmdline := strings.TrimSpace(string(cmdlineContent)) + " plymouth.ignore-udev"
+	// plymouthd daemonizes itself once it is ready to accept requests
+	cmd := exec.Command(plymouthd, "--mode=boot", "--attach-to-session", "--pid-file=/run/plymouth/pid", "--kernel-command-line="+kernelCmdline)
+	if verbosityLevel >= levelDebug {
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+	}
+	if err := cmd.Run(); err != nil {
+		warning("plymouth: unable to start plymouthd: %v", err)
+		return
+	}
+	if _, err := plymouthRequest(plymouthRequestPing, nil); err != nil {
+		warning("plymouth: %v", err)
+		return
+	}
+
+	plymouthMutex.Lock()
+	plymouthRunning = true
+	plymouthMutex.Unlock()
+
+	if _, err := plymouthRequest(plymouthRequestShowSplash, nil); err != nil {
+		warning("plymouth: unable to show the splash: %v", err)
+		quitPlymouth()
+	}
+}
+
+func isPlymouthRunning() bool {
+	plymouthMutex.Lock()
+	defer plymouthMutex.Unlock()
+	return plymouthRunning
+}
+
+// plymouthRequestString encodes the request, an argument is prefixed with its length that includes the trailing zero
+func plymouthRequestString(command string, argument *string) ([]byte, error) {
+	if argument == nil {
+		return []byte(command + "\x00"), nil
+	}
+	if len(*argument)+1 > 0xff {
+		return nil, fmt.Errorf("request argument is too long")
+	}
+	req := append([]byte(command+"\x02"), byte(len(*argument)+1))
+	req = append(req, *argument...)
+	return append(req, 0), nil
+}
+
+// plymouthRequest sends the request to plymouthd and returns the answer if plymouthd replies with one
+func plymouthRequest(command string, argument *string) ([]byte, error) {
+	req, err := plymouthRequestString(command, argument)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("unix", plymouthSocket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var response [1]byte
+	if _, err := io.ReadFull(conn, response[:]); err != nil {
+		return nil, err
+	}
+	switch response[0] {
+	case plymouthResponseAck:
+		return nil, nil
+	case plymouthResponseNak:
+		return nil, fmt.Errorf("plymouth refused request '%s'", command)
+	case plymouthResponseNoAnswer:
+		return nil, fmt.Errorf("plymouth request '%s' is cancelled", command)
+	case plymouthResponseAnswer:
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, binary.LittleEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return nil, err
+		}
+		return answer, nil
+	default:
+		return nil, fmt.Errorf("unexpected plymouth response 0x%x", response[0])
+	}
+}
+
+// askPassword asks the password with plymouth if it is running, otherwise at the console. If plymouth fails then
+// it is stopped and the console prompt is used instead.
+func askPassword(prompt string) ([]byte, error) {
+	atomic.AddInt32(&passwordPrompts, 1)
+	defer atomic.AddInt32(&passwordPrompts, -1)
+
+	if isPlymouthRunning() {
+		password, err := plymouthRequest(plymouthRequestPassword, &prompt)
+		if err == nil {
+			return password, nil
+		}
+		warning("plymouth: unable to ask the password: %v", err)
+		quitPlymouth()
+	}
+	fmt.Print(prompt)
+	return readPassword()
+}
+
+// showMessage shows the message at the splash if plymouth is running, and at the console
+func showMessage(msg string) {
+	if isPlymouthRunning() {
+		if _, err := plymouthRequest(plymouthRequestMessage, &msg); err != nil {
+			debug("plymouth: unable to show message: %v", err)
+		}
+	}
+	fmt.Println(msg)
+}
+
+// quitPlymouth stops plymouthd and gives the console back, e.g. before starting a shell
+func quitPlymouth() {
+	plymouthMutex.Lock()
+	defer plymouthMutex.Unlock()
+	if !plymouthRunning {
+		return
+	}
+	plymouthRunning = false
+
+	retainSplash := "" // the splash is not retained, plymouthd restores the console
+	if _, err := plymouthRequest(plymouthRequestQuit, &retainSplash); err != nil {
+		warning("plymouth: unable to stop plymouthd: %v", err)
+	}
+}
+
+// handoffPlymouth passes plymouthd to the real root if it has plymouth that stops the splash once the system
+// is booted, otherwise plymouthd is stopped so it does not hold the console forever.
+func handoffPlymouth() {
+	if !isPlymouthRunning() {
+		return
+	}
+	for _, d := range plymouthBinDirs {
+		if _, err := os.Stat(filepath.Join(newRoot, d, "plymouth")); err == nil {
+			root := newRoot
+			_, err := plymouthRequest(plymouthRequestNewRoot, &root)
+			if err == nil {
+				return
+			}
+			warning("plymouth: unable to pass plymouthd to the new root: %v", err)
+			break
+		}
+	}
+	quitPlymouth()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestPlymouthRequest(t *testing.T) {
+	defer func(socket string) { plymouthSocket = socket }(plymouthSocket)
+	plymouthSocket = fmt.Sprintf("@/booster-test/plymouthd-%d", os.Getpid())
+
+	l, err := net.Listen("unix", plymouthSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// replies to the password request with the answer, to the message with NAK and to anything else with ACK
+	requests := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 512)
+			n, _ := conn.Read(buf)
+			req := string(buf[:n])
+			requests <- req
+			switch req[0] {
+			case '*':
+				_, _ = conn.Write([]byte("\x02\x06\x00\x00\x00secret"))
+			case 'M':
+				_, _ = conn.Write([]byte{0x15})
+			default:
+				_, _ = conn.Write([]byte{0x06})
+			}
+			conn.Close()
+		}
+	}()
+
+	if _, err := plymouthRequest(plymouthRequestPing, nil); err != nil {
+		t.Fatal(err)
+	}
+	if req := <-requests; req != "P\x00" {
+		t.Fatalf("unexpected ping request %q", req)
+	}
+
+	plymouthRunning = true
+	password, err := askPassword("Enter passphrase for root:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password) != "secret" {
+		t.Fatalf("expected password 'secret', got '%s'", password)
+	}
+	if req, expected := <-requests, "*\x02\x1bEnter passphrase for root:\x00"; req != expected {
+		t.Fatalf("expected password request %q, got %q", expected, req)
+	}
+
+	msg := "Unlocking..."
+	if _, err := plymouthRequest(plymouthRequestMessage, &msg); err == nil || err.Error() != "plymouth refused request 'M'" {
+		t.Fatalf("expected refused request, got %v", err)
+	}
+	<-requests
+
+	quitPlymouth()
+	if isPlymouthRunning() {
+		t.Fatal("plymouth is expected to be stopped")
+	}
+	if req := <-requests; req != "Q\x02\x01\x00" {
+		t.Fatalf("unexpected quit request %q", req)
+	}
+}
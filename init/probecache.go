@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// probeCacheKey is the state of a block device the probed information is valid for. A device is probed again
+// only after it is replaced (e.g. a new device got the same name), resized or the kernel reported a change for it.
+type probeCacheKey struct {
+	devNo uint64
+	size  uint64 // in 512-byte sectors, as reported by sysfs
+	seq   uint64 // SEQNUM of the last add or change uevent of the device, 0 if it was found at the sysfs scan
+}
+
+type probeCacheEntry struct {
+	key  probeCacheKey
+	info *blkInfo
+}
+
+var (
+	probeCache      = map[string]probeCacheEntry{} // keyed by device path
+	probeSeqnums    = map[string]uint64{}          // SEQNUM of the last uevent of the device path
+	probeCacheMutex sync.Mutex
+
+	// probeFunc reads the device information on a cache miss and probeKeyFunc reads the device state,
+	// tests replace them to simulate the devices
+	probeFunc    = probeBlockDevice
+	probeKeyFunc = readProbeCacheKey
+)
+
+// readProbeCacheKey returns the current state of the block device, it is much cheaper than probing the device
+func readProbeCacheKey(devpath string) (probeCacheKey, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(devpath, &st); err != nil {
+		return probeCacheKey{}, err
+	}
+	devNo := uint64(st.Rdev)
+	content, err := os.ReadFile(fmt.Sprintf("/sys/dev/block/%d:%d/size", unix.Major(devNo), unix.Minor(devNo)))
+	if err != nil {
+		return probeCacheKey{}, err
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return probeCacheKey{}, err
+	}
+
+	probeCacheMutex.Lock()
+	seq := probeSeqnums[devpath]
+	probeCacheMutex.Unlock()
+	return probeCacheKey{devNo: devNo, size: size, seq: seq}, nil
+}
+
+// cachedProbeBlockDevice returns the device information probed earlier if the device has not changed since then.
+// It is used by the code that looks up the devices repeatedly, e.g. while polling for a device to appear.
+func cachedProbeBlockDevice(devpath string) (*blkInfo, error) {
+	key, err := probeKeyFunc(devpath)
+	if err != nil {
+		return probeFunc(devpath) // not a regular block device node, e.g. in tests
+	}
+	probeCacheMutex.Lock()
+	entry, ok := probeCache[devpath]
+	probeCacheMutex.Unlock()
+	if ok && entry.key == key {
+		return cloneBlkInfo(entry.info), nil
+	}
+
+	info, err := probeFunc(devpath)
+	if err != nil {
+		return nil, err
+	}
+	probeCacheMutex.Lock()
+	probeCache[devpath] = probeCacheEntry{key: key, info: cloneBlkInfo(info)}
+	probeCacheMutex.Unlock()
+	return info, nil
+}
+
+// cloneBlkInfo returns a deep copy of the device information. The callers might modify the information they get,
+// including the slices of the format specific data, without changing the cached one.
+func cloneBlkInfo(info *blkInfo) *blkInfo {
+	c := *info
+	c.uuid = cloneUUID(info.uuid)
+	switch data := info.data.(type) {
+	case []gptPart:
+		partitions := make([]gptPart, len(data))
+		for i, p := range data {
+			p.typeGuid, p.uuid = cloneUUID(p.typeGuid), cloneUUID(p.uuid)
+			partitions[i] = p
+		}
+		c.data = partitions
+	case bcacheData:
+		data.setUuid = cloneUUID(data.setUuid)
+		c.data = data
+	case verityData:
+		data.salt = append([]byte(nil), data.salt...)
+		c.data = data
+	case imsmData:
+		data.disks = append([]imsmDisk(nil), data.disks...)
+		c.data = data
+	}
+	return &c
+}
+
+func cloneUUID(u UUID) UUID {
+	if u == nil {
+		return nil
+	}
+	return append(UUID{}, u...)
+}
+
+// invalidateProbeCache drops the cached information of the device once the kernel reports it is added, changed
+// or removed. The sequence number makes the device state differ from the cached one even if the device number
+// and its size stay the same, e.g. for a new partition table.
+func invalidateProbeCache(devpath string, seq uint64) {
+	probeCacheMutex.Lock()
+	defer probeCacheMutex.Unlock()
+
+	delete(probeCache, devpath)
+	probeSeqnums[devpath] = seq
+}
+
+// flushProbeCache drops all cached devices, e.g. the user might modify them at the rescue shell without uevents
+func flushProbeCache() {
+	probeCacheMutex.Lock()
+	defer probeCacheMutex.Unlock()
+
+	probeCache = map[string]probeCacheEntry{}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// fakeProbedDevices simulates block devices for the probe cache, it counts the probes of the devices
+type fakeProbedDevices struct {
+	sync.Mutex
+	sizes  map[string]uint64
+	probes int
+}
+
+func (f *fakeProbedDevices) install(t testing.TB) {
+	probeFunc = func(devpath string) (*blkInfo, error) {
+		f.Lock()
+		f.probes++
+		f.Unlock()
+		return &blkInfo{path: devpath, format: "ext4", isFs: true}, nil
+	}
+	probeKeyFunc = func(devpath string) (probeCacheKey, error) {
+		f.Lock()
+		size, ok := f.sizes[devpath]
+		f.Unlock()
+		if !ok {
+			return probeCacheKey{}, os.ErrNotExist
+		}
+		probeCacheMutex.Lock()
+		seq := probeSeqnums[devpath]
+		probeCacheMutex.Unlock()
+		return probeCacheKey{devNo: 1, size: size, seq: seq}, nil
+	}
+	t.Cleanup(func() {
+		probeFunc = probeBlockDevice
+		probeKeyFunc = readProbeCacheKey
+		flushProbeCache()
+		probeCacheMutex.Lock()
+		probeSeqnums = map[string]uint64{}
+		probeCacheMutex.Unlock()
+	})
+}
+
+func TestProbeCache(t *testing.T) {
+	devices := &fakeProbedDevices{sizes: map[string]uint64{"/dev/sda": 1000, "/dev/sdb": 2000}}
+	devices.install(t)
+
+	probe := func(devpath string, expectedProbes int) {
+		info, err := cachedProbeBlockDevice(devpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.path != devpath || info.format != "ext4" {
+			t.Fatalf("unexpected device info %+v", info)
+		}
+		if devices.probes != expectedProbes {
+			t.Fatalf("%s: expected %d probes, got %d", devpath, expectedProbes, devices.probes)
+		}
+	}
+	probe("/dev/sda", 1)
+	probe("/dev/sdb", 2)
+	probe("/dev/sda", 2)
+
+	// the callers get a copy of the cached information
+	info, _ := cachedProbeBlockDevice("/dev/sda")
+	info.format = "xfs"
+	probe("/dev/sda", 2)
+
+	invalidateProbeCache("/dev/sda", 42) // change uevent
+	probe("/dev/sda", 3)
+	probe("/dev/sda", 3)
+
+	devices.sizes["/dev/sdb"] = 4000 // resized
+	probe("/dev/sdb", 4)
+
+	flushProbeCache()
+	probe("/dev/sda", 5)
+	probe("/dev/sdb", 6)
+
+	// a device without the state is probed every time
+	probe("/dev/nbd0", 7)
+	probe("/dev/nbd0", 8)
+}
+
+func TestCloneBlkInfo(t *testing.T) {
+	orig := &blkInfo{path: "/dev/sda", format: "gpt", uuid: UUID{1, 2}, data: []gptPart{{num: 0, uuid: UUID{3}, typeGuid: UUID{4}, name: "root"}}}
+	c := cloneBlkInfo(orig)
+	c.uuid[0] = 0xff
+	partitions := c.data.([]gptPart)
+	partitions[0].name = "changed"
+	partitions[0].uuid[0] = 0xff
+	partitions[0].typeGuid[0] = 0xff
+
+	p := orig.data.([]gptPart)[0]
+	if orig.uuid[0] != 1 || p.name != "root" || p.uuid[0] != 3 || p.typeGuid[0] != 4 {
+		t.Fatalf("the original information is modified: %+v %+v", orig, p)
+	}
+
+	bcache := bcacheData{setUuid: UUID{5}}
+	imsm := imsmData{disks: []imsmDisk{{serial: "a"}}}
+	verity := verityData{salt: []byte{6}}
+	cloneBlkInfo(&blkInfo{format: "bcache", data: bcache}).data.(bcacheData).setUuid[0] = 0xff
+	cloneBlkInfo(&blkInfo{format: "imsm", data: imsm}).data.(imsmData).disks[0].serial = "b"
+	cloneBlkInfo(&blkInfo{format: "verity", data: verity}).data.(verityData).salt[0] = 0xff
+	if bcache.setUuid[0] != 5 || imsm.disks[0].serial != "a" || verity.salt[0] != 6 {
+		t.Fatal("the original format specific data is modified")
+	}
+	if cloneBlkInfo(&blkInfo{format: "ext4"}).uuid != nil {
+		t.Fatal("a missing UUID is expected to stay nil")
+	}
+}
+
+// BenchmarkProbeCache polls 48 static devices the way booster.cmdline_file looks for its device while a few of them
+// receive change uevents, the probes metric is the number of the probed superblocks
+func BenchmarkProbeCache(b *testing.B) {
+	devices := &fakeProbedDevices{sizes: map[string]uint64{}}
+	var paths []string
+	for i := 0; i < 24; i++ {
+		for _, p := range []string{"", "1"} {
+			path := fmt.Sprintf("/dev/sd%c%s", 'a'+i, p)
+			devices.sizes[path] = 1000
+			paths = append(paths, path)
+		}
+	}
+	devices.install(b)
+
+	const polls = 20
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			devices.probes = 0
+			for i := 0; i < b.N; i++ {
+				flushProbeCache()
+				for poll := 0; poll < polls; poll++ {
+					invalidateProbeCache(paths[poll%len(paths)], uint64(poll)) // a change uevent
+					for _, p := range paths {
+						var err error
+						if cached {
+							_, err = cachedProbeBlockDevice(p)
+						} else {
+							_, err = probeFunc(p)
+						}
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+			b.ReportMetric(float64(devices.probes)/float64(b.N), "probes/op")
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// randomSeedSize is the size of the seed embedded to the image and the amount of data read from the hardware RNG
+	randomSeedSize = 512
+	hwrngDevice    = "/dev/hwrng"
+	hwrngTimeout   = 10 * time.Second // time to wait for the virtio-rng device to appear
+	hwrngReadSize  = 64
+)
+
+// randPoolInfo is struct rand_pool_info from linux/random.h with a fixed size buffer
+type randPoolInfo struct {
+	entropyCount int32 // in bits
+	bufSize      int32
+	buf          [randomSeedSize]byte
+}
+
+func newRandPoolInfo(data []byte) *randPoolInfo {
+	var info randPoolInfo
+	n := copy(info.buf[:], data)
+	info.bufSize = int32(n)
+	info.entropyCount = int32(n * 8)
+	return &info
+}
+
+// addEntropy mixes the data into the kernel RNG and credits it with RNDADDENTROPY, unlike a plain write to
+// /dev/urandom that does not increase the entropy estimate
+func addEntropy(data []byte) error {
+	f, err := os.OpenFile("/dev/urandom", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info := newRandPoolInfo(data)
+	defer MemZeroBytes(info.buf[:])
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.RNDADDENTROPY, uintptr(unsafe.Pointer(info))); errno != 0 {
+		return os.NewSyscallError(fmt.Sprintf("ioctl (cmd=0x%x)", unix.RNDADDENTROPY), errno)
+	}
+	return nil
+}
+
+// mixEntropy mixes the data into the kernel RNG with a plain write to /dev/urandom, the entropy estimate is not changed
+func mixEntropy(data []byte) error {
+	f, err := os.OpenFile("/dev/urandom", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// seedRandom feeds the kernel RNG before the LUKS and network crypto needs it: from the seed embedded to the image at
+// generation time and from the virtio-rng device if its driver is in the image. The seed is deleted once it is used
+// so it is not passed to the userspace. The seed is not credited: the image is stored at an unencrypted /boot
+// and the same seed is used at every boot until the image is regenerated.
+func seedRandom() {
+	seed, err := os.ReadFile(randomSeedPath)
+	if err == nil {
+		if err := mixEntropy(seed); err != nil {
+			warning("unable to mix the random seed: %v", err)
+		} else {
+			debug("mixed %d bytes of the random seed into the kernel RNG", len(seed))
+		}
+		MemZeroBytes(seed)
+		if err := os.Remove(randomSeedPath); err != nil {
+			warning("%v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		warning("%v", err)
+	}
+
+	if hasModule("virtio_rng") {
+		// the device appears once the virtio transport driver is loaded, it does not need to delay the boot
+		go seedFromHwrng()
+	}
+}
+
+func seedFromHwrng() {
+	_ = loadModules("virtio_rng")
+	start := time.Now()
+	for {
+		if _, err := os.Stat(hwrngDevice); err == nil {
+			break
+		}
+		if time.Since(start) > hwrngTimeout {
+			debug("no hardware RNG appeared within %v", hwrngTimeout)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	f, err := os.Open(hwrngDevice)
+	if err != nil {
+		warning("%v", err)
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, hwrngReadSize)
+	defer MemZeroBytes(buf)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		warning("%s: %v", hwrngDevice, err)
+		return
+	}
+	if err := addEntropy(buf); err != nil {
+		warning("unable to credit the hardware RNG data: %v", err)
+		return
+	}
+	debug("credited %d bytes from %s", len(buf), hwrngDevice)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+)
+
+func TestRandPoolInfo(t *testing.T) {
+	info := newRandPoolInfo([]byte{1, 2, 3, 4})
+	if info.bufSize != 4 || info.entropyCount != 32 || !bytes.Equal(info.buf[:4], []byte{1, 2, 3, 4}) {
+		t.Fatalf("unexpected pool info: size %d, entropy %d", info.bufSize, info.entropyCount)
+	}
+	// the header is followed by the buffer as in struct rand_pool_info
+	if unsafe.Offsetof(info.buf) != 8 {
+		t.Fatalf("unexpected buffer offset %d", unsafe.Offsetof(info.buf))
+	}
+
+	info = newRandPoolInfo(make([]byte, 2*randomSeedSize))
+	if info.bufSize != randomSeedSize || info.entropyCount != randomSeedSize*8 {
+		t.Fatalf("a large seed is expected to be truncated, got size %d", info.bufSize)
+	}
+}
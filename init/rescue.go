@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// rescueRcFile is the shell startup file of the rescue shell
+const rescueRcFile = "/run/booster/rescue.rc"
+
+var (
+	rescueMode bool // enabled with booster.rescue=1 boot param
+
+	// rootMountFailures receives the errors that make waitForRoot fail without waiting for the timeout, e.g.
+	// an ambiguous root reference or a root mount error in rescue mode
+	rootMountFailures = make(chan error, 1)
+)
+
+// parseRescueParam parses booster.rescue=1 boot param
+func parseRescueParam() error {
+	param, ok := cmdline["booster.rescue"]
+	if !ok {
+		return nil
+	}
+	switch param {
+	case "1":
+		rescueMode = true
+	case "0":
+		rescueMode = false
+	default:
+		return fmt.Errorf("invalid booster.rescue kernel parameter %s, expected booster.rescue=1", param)
+	}
+	return nil
+}
+
+// rootMountFailed reports the root mount error to waitForRoot in rescue mode
+func rootMountFailed(err error) {
+	if rescueMode {
+		failRootWait(err)
+	}
+}
+
+// failRootWait makes waitForRoot return the error right away. Only the first pending error is kept.
+func failRootWait(err error) {
+	select {
+	case rootMountFailures <- err:
+	default:
+	}
+}
+
+// waitForRootRescue waits for the root filesystem and starts a rescue shell every time the root cannot be found or
+// mounted. Once the user exits the shell the root references are resolved again, unless the user has mounted
+// the root filesystem at /booster.root by hand.
+func waitForRootRescue() error {
+	for {
+		err := waitForRoot()
+		if err == nil || !rescueMode {
+			return err
+		}
+		severe("%v", err)
+		if !rescueShell() {
+			return err
+		}
+
+		if isMountPoint(newRoot) {
+			if verityPublicKey != nil {
+				// the filesystem mounted by hand is not verified
+				return fmt.Errorf("rescue: the image boots only the signed dm-verity root, refusing to boot the root filesystem mounted at %s", newRoot)
+			}
+			inform("rescue: the root filesystem is mounted at %s, continuing the boot", newRoot)
+			deviceRefsMutex.Lock()
+			rootMountStarted = true // the devices that appear later are not mounted over it
+			deviceRefsMutex.Unlock()
+			setMountedRootIdentity(newRoot)
+			markRootMounted()
+			return nil
+		}
+		inform("rescue: resolving the root device again")
+		if err := retryRoot(); err != nil {
+			return err
+		}
+	}
+}
+
+// rescueShell starts an interactive shell with the console inherited. It returns false if the shell is not available.
+func rescueShell() bool {
+	if _, err := os.Stat("/usr/bin/busybox"); os.IsNotExist(err) {
+		warning("rescue: busybox is not available in the image, add it to 'extra_files' in booster.yaml to get the rescue shell")
+		return false
+	}
+	quitPlymouth()
+
+	for _, l := range describeDiscoveredDevices() {
+		fmt.Println(l)
+	}
+	fmt.Printf("booster.rescue: inspect the devices (e.g. 'blkid', 'ls /dev/disk/by-uuid') and fix the problem. Either mount the root filesystem at %s by hand or leave it to booster.\n", newRoot)
+	fmt.Println("booster.rescue: type 'continue' or 'exit' to continue the boot")
+
+	if err := os.MkdirAll(filepath.Dir(rescueRcFile), 0755); err != nil {
+		warning("rescue: %v", err)
+	}
+	// 'continue' is a shell builtin, an alias takes precedence over it
+	if err := os.WriteFile(rescueRcFile, []byte("alias continue='exit 0'\n"), 0644); err != nil {
+		warning("rescue: %v", err)
+	}
+
+	cmd := exec.Command("/usr/bin/busybox", "sh", "-I")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "PS1=booster (rescue)# ", "ENV="+rescueRcFile)
+	if err := cmd.Run(); err != nil {
+		warning("rescue: shell: %v", err)
+	}
+	return true
+}
+
+// retryRoot makes the first root reference active again and matches it against the block devices. The devices
+// are probed again as the user might have changed them, the devices that appeared meanwhile are added as usual.
+func retryRoot() error {
+	select {
+	case <-rootMountFailures:
+	default:
+	}
+
+	flushProbeCache()
+	discoveredDevicesMutex.Lock()
+	for name, info := range discoveredDevices {
+		if updated, err := probeBlockDevice(info.path); err == nil {
+			discoveredDevices[name] = updated
+		}
+	}
+	discoveredDevicesMutex.Unlock()
+
+	deviceRefsMutex.Lock()
+	rootMountStarted = false
+	activateRoot(0)
+	deviceRefsMutex.Unlock()
+
+	return scanSysBlock()
+}
+
+// isMountPoint checks whether a filesystem is mounted at the directory
+func isMountPoint(dir string) bool {
+	var st, parent unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return false
+	}
+	if err := unix.Stat(filepath.Dir(dir), &parent); err != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
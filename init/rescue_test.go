@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRescueRootMountFailure(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		rescueMode = false
+		config.MountTimeout = 0
+	}()
+
+	cmdline = map[string]string{"booster.rescue": "1"}
+	if err := parseRescueParam(); err != nil {
+		t.Fatal(err)
+	}
+	if !rescueMode {
+		t.Fatal("rescue mode is expected to be enabled")
+	}
+	cmdline = map[string]string{"booster.rescue": "yes"}
+	if err := parseRescueParam(); err == nil {
+		t.Fatal("booster.rescue=yes is expected to fail")
+	}
+
+	// the root mount error is reported without waiting for the mount timeout that is disabled here
+	rootMounted = make(chan struct{})
+	defer func() { rootMounted = make(chan struct{}) }()
+	rootMountFailed(fmt.Errorf("mount(/dev/sda1): invalid argument"))
+	rootMountFailed(fmt.Errorf("the second error is dropped"))
+
+	done := make(chan error)
+	go func() { done <- waitForRoot() }()
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "mount(/dev/sda1): invalid argument" {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("root mount failure is not reported")
+	}
+	select {
+	case err := <-rootMountFailures:
+		t.Fatalf("unexpected pending error %v", err)
+	default:
+	}
+}
+
+func TestIsMountPoint(t *testing.T) {
+	if isMountPoint(t.TempDir()) {
+		t.Fatal("a temporary directory is not expected to be a mount point")
+	}
+	if !isMountPoint("/proc") {
+		t.Fatal("/proc is expected to be a mount point")
+	}
+}
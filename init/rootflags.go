@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// rootOptionRule describes a well-known root mount option
+type rootOptionRule struct {
+	fsType   string // the only filesystem that supports the option, empty means any filesystem
+	validate func(fstype, value string, hasValue bool) error
+}
+
+var rootOptionRules = map[string]rootOptionRule{
+	"ro":             {validate: validateNoValue},
+	"rw":             {validate: validateNoValue},
+	"noatime":        {validate: validateNoValue},
+	"subvol":         {fsType: "btrfs", validate: validateSubvol},
+	"compress":       {fsType: "btrfs", validate: validateCompress},
+	"compress-force": {fsType: "btrfs", validate: validateCompress},
+	"discard":        {validate: validateDiscard},
+}
+
+func validateNoValue(fstype, value string, hasValue bool) error {
+	if hasValue {
+		return fmt.Errorf("option does not accept a value")
+	}
+	return nil
+}
+
+func validateSubvol(fstype, value string, hasValue bool) error {
+	if value == "" {
+		return fmt.Errorf("subvolume path is not specified")
+	}
+	return nil
+}
+
+// validateCompress checks btrfs compression option, e.g. compress=zstd:3
+func validateCompress(fstype, value string, hasValue bool) error {
+	if !hasValue {
+		return nil // the default zlib compression
+	}
+	alg, level, hasLevel := value, "", false
+	if idx := strings.IndexByte(value, ':'); idx != -1 {
+		alg, level, hasLevel = value[:idx], value[idx+1:], true
+	}
+	maxLevels := map[string]int{"zlib": 9, "zstd": 15, "lzo": 0, "no": 0, "none": 0}
+	max, ok := maxLevels[alg]
+	if !ok {
+		return fmt.Errorf("unknown compression algorithm %s, expected one of zlib, lzo, zstd, no", alg)
+	}
+	if !hasLevel {
+		return nil
+	}
+	if max == 0 {
+		return fmt.Errorf("compression %s does not support levels", alg)
+	}
+	l, err := strconv.Atoi(level)
+	if err != nil || l < 1 || l > max {
+		return fmt.Errorf("invalid %s compression level %s, expected 1-%d", alg, level, max)
+	}
+	return nil
+}
+
+// validateDiscard checks discard option, btrfs also accepts discard=sync and discard=async
+func validateDiscard(fstype, value string, hasValue bool) error {
+	if !hasValue {
+		return nil
+	}
+	if fstype == "btrfs" && (value == "sync" || value == "async") {
+		return nil
+	}
+	return fmt.Errorf("unsupported value %s", value)
+}
+
+// normalizeRootflags validates the well-known options of rootflags boot param and passes the other options through.
+// Empty options are dropped. If an option is specified multiple times then the last one wins, the same way
+// if both ro and rw are specified then the last of them is used.
+func normalizeRootflags(fstype, rootflags string) (string, error) {
+	var outOptions []string
+	last := make(map[string]int) // index of the option in outOptions
+	for _, o := range strings.Split(rootflags, ",") {
+		if o == "" {
+			continue
+		}
+		key, value, hasValue := o, "", false
+		if idx := strings.IndexByte(o, '='); idx != -1 {
+			key, value, hasValue = o[:idx], o[idx+1:], true
+		}
+
+		rule, ok := rootOptionRules[key]
+		if !ok {
+			inform("rootflags: passing option %s to %s filesystem as is", o, fstype)
+			outOptions = append(outOptions, o)
+			continue
+		}
+		if rule.fsType != "" && rule.fsType != fstype {
+			return "", fmt.Errorf("rootflags: option %s is supported by %s only but the root filesystem is %s", o, rule.fsType, fstype)
+		}
+		if err := rule.validate(fstype, value, hasValue); err != nil {
+			return "", fmt.Errorf("rootflags: %s: %v", o, err)
+		}
+
+		if key == "ro" || key == "rw" {
+			key = "ro/rw" // these options are mutually exclusive
+		}
+		if i, ok := last[key]; ok {
+			warning("rootflags: both %s and %s are specified, using %s", outOptions[i], o, o)
+			outOptions[i] = o
+			continue
+		}
+		last[key] = len(outOptions)
+		outOptions = append(outOptions, o)
+	}
+	return strings.Join(outOptions, ","), nil
+}
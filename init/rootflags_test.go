@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeRootflags(t *testing.T) {
+	check := func(fstype, input, expected string) {
+		output, err := normalizeRootflags(fstype, input)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if output != expected {
+			t.Fatalf("%s: expected options %s, got %s", input, expected, output)
+		}
+	}
+
+	check("ext4", "", "")
+	check("ext4", "user_xattr,,noatime,", "user_xattr,noatime")
+	check("ext4", "ro,user_xattr,rw", "rw,user_xattr")
+	check("ext4", "discard", "discard")
+	check("btrfs", "subvol=@,compress=zstd:3,discard=async,space_cache=v2", "subvol=@,compress=zstd:3,discard=async,space_cache=v2")
+	check("btrfs", "compress=lzo,compress=zstd", "compress=zstd")
+	check("btrfs", "compress,compress-force=zlib:9", "compress,compress-force=zlib:9")
+
+	for _, c := range []struct{ fstype, input string }{
+		{"ext4", "subvol=@"},
+		{"btrfs", "subvol="},
+		{"btrfs", "compress=zstd:20"},
+		{"btrfs", "compress=lzo:1"},
+		{"btrfs", "compress=lz4"},
+		{"ext4", "discard=async"},
+		{"ext4", "ro=1"},
+	} {
+		if _, err := normalizeRootflags(c.fstype, c.input); err == nil {
+			t.Fatalf("%s %s: expected to fail but it did not", c.fstype, c.input)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A/B root slots use the GPT partition attributes of the ChromeOS boot counter convention
+const (
+	gptAttrSlotPriorityShift = 48      // bits 48-51, 0 means the slot is not bootable, 15 is the highest priority
+	gptAttrSlotTriesShift    = 52      // bits 52-55, boot attempts left for the slot that has not booted successfully yet
+	gptAttrSlotSuccessful    = 1 << 56 // set by the OS once the slot is verified to boot
+	gptAttrSlotMask          = 0xf
+)
+
+// slotFile is where the selected slot is reported to the OS, e.g. to mark it successful or to notice the rollback
+const slotFile = "/run/booster/slot"
+
+// gptSlot is the boot state of an A/B slot stored in the partition attributes
+type gptSlot struct {
+	priority   int
+	tries      int
+	successful bool
+}
+
+func parseGptSlot(attrs uint64) gptSlot {
+	return gptSlot{
+		priority:   int(attrs >> gptAttrSlotPriorityShift & gptAttrSlotMask),
+		tries:      int(attrs >> gptAttrSlotTriesShift & gptAttrSlotMask),
+		successful: attrs&gptAttrSlotSuccessful != 0,
+	}
+}
+
+// bootable returns false if the slot is disabled or all its boot attempts failed
+func (s gptSlot) bootable() bool {
+	return s.priority > 0 && (s.successful || s.tries > 0)
+}
+
+// parseSlotParams enables the A/B slot selection of the root partition with booster.ab boot param. The slots are
+// the partitions matching the root reference, either PARTLABEL= (e.g. a glob root_*) or PARTTYPE= (also autodiscovery).
+func parseSlotParams() error {
+	if v, ok := cmdline["booster.ab"]; !ok || v == "0" {
+		return nil
+	}
+	for i, r := range cmdRoots {
+		if r.format != refGptLabel && r.format != refGptType {
+			return fmt.Errorf("booster.ab: root %s is expected to be specified with PARTLABEL= or PARTTYPE=", r)
+		}
+		cmdRoots[i] = &deviceRef{format: refGptSlot, data: r}
+	}
+	cmdRoot = cmdRoots[0]
+	return nil
+}
+
+// selectGptSlot returns the slot to boot among the partitions of device devName that match the reference. The bootable
+// slot with the highest priority is selected, the lower partition number wins if the priorities are equal.
+// rollback is true if a slot with the same or higher priority is skipped as its boot attempts are exhausted.
+func selectGptSlot(devName string, t []gptPart, ref *deviceRef) (selected *gptPart, rollback bool) {
+	var selectedPriority, exhaustedPriority int
+	for i := range t {
+		p := &t[i]
+		if !ref.matchesGptPart(devName, p) {
+			continue
+		}
+		s := parseGptSlot(p.attributes)
+		if !s.bootable() {
+			if s.priority > exhaustedPriority {
+				exhaustedPriority = s.priority
+			}
+			continue
+		}
+		if s.priority > selectedPriority {
+			selected, selectedPriority = p, s.priority
+		}
+	}
+	if selected == nil {
+		return nil, false
+	}
+	return selected, exhaustedPriority >= selectedPriority
+}
+
+// countSlotAttempt decrements the boot attempts counter of the selected slot unless it has booted successfully already,
+// the counter reaches zero if the OS does not mark the slot successful and then the other slot is selected.
+// It must be called with deviceRefsMutex held.
+func countSlotAttempt(devName string, t []gptPart, ref *deviceRef) {
+	p, rollback := selectGptSlot(devName, t, ref.data.(*deviceRef))
+	if p == nil {
+		return
+	}
+	s := parseGptSlot(p.attributes)
+	if rollback {
+		warning("A/B: boot attempts of the preferred slot are exhausted, rolling back to partition #%d '%s' of %s", p.num+1, p.name, devName)
+	} else {
+		inform("A/B: booting slot partition #%d '%s' of %s", p.num+1, p.name, devName)
+	}
+
+	if !s.successful {
+		s.tries--
+		update := func(attrs uint64) uint64 {
+			return attrs&^(gptAttrSlotMask<<gptAttrSlotTriesShift) | uint64(s.tries)<<gptAttrSlotTriesShift
+		}
+		if err := updateGptAttributes("/dev/"+devName, p.num, update); err != nil {
+			// without the counter a broken slot would be booted forever
+			warning("A/B: unable to decrement boot attempts of partition #%d of %s: %v", p.num+1, devName, err)
+		} else {
+			debug("A/B: %d boot attempts left for partition #%d of %s", s.tries, p.num+1, devName)
+		}
+	}
+	writeSlotInfo(slotFile, p, s, rollback)
+}
+
+// writeSlotInfo saves the selected slot as KEY=value lines
+func writeSlotInfo(file string, p *gptPart, s gptSlot, rollback bool) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "PARTLABEL=%s\n", strings.ReplaceAll(p.name, "\n", " "))
+	fmt.Fprintf(&b, "PARTUUID=%s\n", p.uuid.toString())
+	fmt.Fprintf(&b, "PRIORITY=%d\n", s.priority)
+	fmt.Fprintf(&b, "TRIES=%d\n", s.tries)
+	fmt.Fprintf(&b, "SUCCESSFUL=%t\n", s.successful)
+	fmt.Fprintf(&b, "ROLLBACK=%t\n", rollback)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		warning("unable to save A/B slot information: %v", err)
+		return
+	}
+	if err := os.WriteFile(file, []byte(b.String()), 0644); err != nil {
+		warning("unable to save A/B slot information: %v", err)
+	}
+}
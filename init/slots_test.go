@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGptSlots(t *testing.T) {
+	slot := func(priority, tries int, successful bool) uint64 {
+		attrs := uint64(priority)<<gptAttrSlotPriorityShift | uint64(tries)<<gptAttrSlotTriesShift
+		if successful {
+			attrs |= gptAttrSlotSuccessful
+		}
+		return attrs
+	}
+	check := func(attrsA, attrsB uint64, expected string, expectedRollback bool) {
+		t.Helper()
+		partitions := []gptPart{
+			{num: 0, name: "esp", attributes: slot(15, 15, true)},
+			{num: 1, name: "root_a", attributes: attrsA},
+			{num: 2, name: "root_b", attributes: attrsB},
+		}
+		p, rollback := selectGptSlot("sda", partitions, &deviceRef{format: refGptLabel, data: "root_*"})
+		name := ""
+		if p != nil {
+			name = p.name
+		}
+		if name != expected || rollback != expectedRollback {
+			t.Fatalf("expected slot '%s' (rollback %v), got '%s' (rollback %v)", expected, expectedRollback, name, rollback)
+		}
+	}
+
+	check(slot(2, 0, true), slot(1, 0, true), "root_a", false)
+	check(slot(1, 0, true), slot(2, 3, false), "root_b", false) // an update is being tried
+	check(slot(1, 0, true), slot(2, 0, false), "root_a", true)  // the update failed to boot
+	check(slot(1, 3, false), slot(1, 0, true), "root_a", false) // the lower partition number wins
+	check(slot(0, 3, false), slot(1, 0, true), "root_b", false) // a disabled slot is not a rollback
+	check(slot(2, 0, false), slot(0, 0, true), "", false)
+
+	if s := parseGptSlot(slot(5, 7, true) | gptAttrReadOnly); s != (gptSlot{priority: 5, tries: 7, successful: true}) {
+		t.Fatalf("unexpected slot %+v", s)
+	}
+
+	ref := &deviceRef{format: refGptSlot, data: &deviceRef{format: refGptLabel, data: "root_*"}}
+	partitions := []gptPart{{num: 0, name: "root_a", attributes: slot(1, 0, true)}, {num: 3, name: "root_b", attributes: slot(2, 1, false)}}
+	if r := ref.resolveFromGptTable("nvme0n1", partitions); r == nil || r.data.(string) != "/dev/nvme0n1p4" {
+		t.Fatalf("unexpected slot resolution %v", r)
+	}
+
+	file := t.TempDir() + "/slot"
+	writeSlotInfo(file, &partitions[1], gptSlot{priority: 2, tries: 0}, false)
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "PARTLABEL=root_b\nPARTUUID=\nPRIORITY=2\nTRIES=0\nSUCCESSFUL=false\nROLLBACK=false\n"
+	if string(content) != expected {
+		t.Fatalf("unexpected slot information:\n%s", content)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tpm2TokenType is the LUKS2 token type created by systemd-cryptenroll --tpm2-device
+const tpm2TokenType = "systemd-tpm2"
+
+const (
+	tpm2Device        = "/dev/tpmrm0"
+	tpm2DeviceTimeout = 5 * time.Second // time to wait for the TPM driver to initialize
+	tpm2WorkDir       = "/run/booster/tpm2"
+	tpm2MaxPcr        = 23
+)
+
+// tpm2DefaultPcrs is the PCR set used if neither the token nor booster.tpm2_pcrs boot param specify it.
+// PCR 7 holds the Secure Boot state and does not change with firmware or kernel updates.
+var tpm2DefaultPcrs = []int{7}
+
+// tpm2Token is the payload of a systemd-tpm2 LUKS2 token
+type tpm2Token struct {
+	Blob        string `json:"tpm2-blob"` // base64 encoded TPM2B_PRIVATE followed by TPM2B_PUBLIC of the sealed object
+	Pcrs        []int  `json:"tpm2-pcrs"`
+	PcrBank     string `json:"tpm2-pcr-bank"`
+	PrimaryAlg  string `json:"tpm2-primary-alg"`
+	PolicyHash  string `json:"tpm2-policy-hash"` // hex encoded
+	PinRequired bool   `json:"tpm2-pin"`
+}
+
+// parseTpm2Pcrs parses a comma-separated list of PCR indexes, e.g. booster.tpm2_pcrs=0,2,7
+func parseTpm2Pcrs(param string) ([]int, error) {
+	var pcrs []int
+	for _, p := range strings.Split(param, ",") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > tpm2MaxPcr {
+			return nil, fmt.Errorf("invalid PCR index %s", p)
+		}
+		pcrs = append(pcrs, n)
+	}
+	return pcrs, nil
+}
+
+func formatPcrs(pcrs []int) string {
+	indexes := make([]string, len(pcrs))
+	for i, p := range pcrs {
+		indexes[i] = strconv.Itoa(p)
+	}
+	return strings.Join(indexes, ",")
+}
+
+// tpm2PcrSelection formats the PCR selection in the tpm2-tools format, e.g. sha256:0,2,7
+func tpm2PcrSelection(bank string, pcrs []int) string {
+	return bank + ":" + formatPcrs(pcrs)
+}
+
+// splitTpm2Blob splits the sealed object blob into its private and public parts. Each part is a TPM2B structure
+// prefixed with its big-endian 16-bit size.
+func splitTpm2Blob(blob []byte) ([]byte, []byte, error) {
+	if len(blob) < 2 {
+		return nil, nil, fmt.Errorf("TPM2 blob is too short")
+	}
+	privSize := 2 + int(binary.BigEndian.Uint16(blob))
+	if len(blob) < privSize+2 {
+		return nil, nil, fmt.Errorf("TPM2 blob is truncated")
+	}
+	pubSize := 2 + int(binary.BigEndian.Uint16(blob[privSize:]))
+	if len(blob) != privSize+pubSize {
+		return nil, nil, fmt.Errorf("TPM2 blob has unexpected size %d", len(blob))
+	}
+	return blob[:privSize], blob[privSize:], nil
+}
+
+// tpm2TokenPcrs returns the PCR set the token secret is sealed to. The policy is satisfied only with the PCR set
+// stored in the token, booster.tpm2_pcrs boot param is used for the tokens that do not store it.
+func tpm2TokenPcrs(token *tpm2Token) ([]int, error) {
+	param, ok := cmdline["booster.tpm2_pcrs"]
+	if len(token.Pcrs) != 0 {
+		if pcrs, err := parseTpm2Pcrs(param); ok && (err != nil || !samePcrSet(pcrs, token.Pcrs)) {
+			warning("tpm2: the token is sealed to PCRs %s, using them instead of booster.tpm2_pcrs=%s that cannot satisfy its policy", formatPcrs(token.Pcrs), param)
+		}
+		return token.Pcrs, nil
+	}
+	if !ok {
+		return tpm2DefaultPcrs, nil
+	}
+	pcrs, err := parseTpm2Pcrs(param)
+	if err != nil {
+		return nil, fmt.Errorf("booster.tpm2_pcrs: %v", err)
+	}
+	return pcrs, nil
+}
+
+// samePcrSet checks whether both lists contain the same PCR indexes, the order does not matter
+func samePcrSet(a, b []int) bool {
+	sortedPcrs := func(pcrs []int) string {
+		s := append([]int{}, pcrs...)
+		sort.Ints(s)
+		return formatPcrs(s)
+	}
+	return sortedPcrs(a) == sortedPcrs(b)
+}
+
+// tpm2TokenPassword unseals the secret of a systemd-tpm2 token by satisfying its PCR policy. The unsealing is done
+// with tpm2-tools. systemd uses the base64 encoded secret as the LUKS passphrase.
+func tpm2TokenPassword(payload []byte) ([]byte, error) {
+	var token tpm2Token
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return nil, err
+	}
+	if token.PinRequired {
+		return nil, fmt.Errorf("tpm2: tokens protected with a PIN are not supported")
+	}
+	if token.PcrBank == "" {
+		token.PcrBank = "sha256"
+	}
+	if token.PrimaryAlg == "" {
+		token.PrimaryAlg = "ecc"
+	}
+	pcrs, err := tpm2TokenPcrs(&token)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := base64.StdEncoding.DecodeString(token.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("tpm2: invalid blob: %v", err)
+	}
+	priv, pub, err := splitTpm2Blob(blob)
+	if err != nil {
+		return nil, fmt.Errorf("tpm2: %v", err)
+	}
+
+	for _, tool := range []string{"tpm2_createprimary", "tpm2_load", "tpm2_startauthsession", "tpm2_policypcr", "tpm2_unseal"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, fmt.Errorf("tpm2: %s tool is not available in the image, add tpm2-tools binaries to 'extra_files' in booster.yaml", tool)
+		}
+	}
+	if err := waitForTpm2Device(tpm2DeviceTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(tpm2WorkDir, 0700); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tpm2WorkDir)
+	if err := os.WriteFile(tpm2WorkDir+"/sealed.priv", priv, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(tpm2WorkDir+"/sealed.pub", pub, 0600); err != nil {
+		return nil, err
+	}
+
+	selection := tpm2PcrSelection(token.PcrBank, pcrs)
+	debug("tpm2: unsealing the token secret with PCR policy %s", selection)
+	steps := [][]string{
+		{"tpm2_createprimary", "-Q", "-C", "o", "-G", token.PrimaryAlg, "-c", tpm2WorkDir + "/primary.ctx"},
+		{"tpm2_load", "-Q", "-C", tpm2WorkDir + "/primary.ctx", "-u", tpm2WorkDir + "/sealed.pub", "-r", tpm2WorkDir + "/sealed.priv", "-c", tpm2WorkDir + "/sealed.ctx"},
+		{"tpm2_startauthsession", "-Q", "--policy-session", "-S", tpm2WorkDir + "/session.ctx"},
+		{"tpm2_policypcr", "-Q", "-S", tpm2WorkDir + "/session.ctx", "-l", selection},
+	}
+	for _, s := range steps {
+		if _, err := runTpm2Tool(s...); err != nil {
+			return nil, fmt.Errorf("tpm2: %v", err)
+		}
+	}
+	secret, err := runTpm2Tool("tpm2_unseal", "-c", tpm2WorkDir+"/sealed.ctx", "-p", "session:"+tpm2WorkDir+"/session.ctx")
+	_, _ = runTpm2Tool("tpm2_flushcontext", tpm2WorkDir+"/session.ctx")
+	if err != nil {
+		reportTpm2PolicyMismatch(&token, selection)
+		return nil, fmt.Errorf("tpm2: unable to unseal the secret, the PCR policy %s is not satisfied: %v", selection, err)
+	}
+	defer MemZeroBytes(secret)
+
+	password := make([]byte, base64.StdEncoding.EncodedLen(len(secret)))
+	base64.StdEncoding.Encode(password, secret)
+	return password, nil
+}
+
+// reportTpm2PolicyMismatch helps to find out why the PCR policy failed. The policy digest of the current PCR values
+// is compared with the digest stored in the token and the current values are printed.
+func reportTpm2PolicyMismatch(token *tpm2Token, selection string) {
+	if token.PolicyHash != "" {
+		_, err := runTpm2Tool("tpm2_startauthsession", "-Q", "-S", tpm2WorkDir+"/trial.ctx")
+		if err == nil {
+			_, err = runTpm2Tool("tpm2_policypcr", "-Q", "-S", tpm2WorkDir+"/trial.ctx", "-l", selection, "-L", tpm2WorkDir+"/policy.digest")
+			_, _ = runTpm2Tool("tpm2_flushcontext", tpm2WorkDir+"/trial.ctx")
+		}
+		if err == nil {
+			digest, _ := os.ReadFile(tpm2WorkDir + "/policy.digest")
+			expected, _ := hex.DecodeString(token.PolicyHash)
+			if bytes.Equal(digest, expected) {
+				warning("tpm2: the policy digest of %s matches the token, the sealed object does not belong to this TPM", selection)
+				return
+			}
+			warning("tpm2: values of PCRs %s changed since the secret was sealed (e.g. after a firmware update)", selection)
+		}
+	}
+	if out, err := runTpm2Tool("tpm2_pcrread", selection); err == nil {
+		for _, l := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			warning("tpm2: %s", l)
+		}
+	}
+}
+
+func runTpm2Tool(args ...string) ([]byte, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	if verbosityLevel >= levelDebug {
+		cmd.Stderr = os.Stderr
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", args[0], err)
+	}
+	return out, nil
+}
+
+func waitForTpm2Device(timeout time.Duration) error {
+	start := time.Now()
+	for {
+		if _, err := os.Stat(tpm2Device); err == nil {
+			return nil
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("tpm2: no TPM device found within %v", timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// rootIdentityPrefix starts the measured root identity, it tells the event apart from the other measurements to the PCR
+const rootIdentityPrefix = "booster:root:"
+
+var (
+	rootIdentity      string // identity of the mounted root filesystem that is measured to the TPM
+	rootIdentityMutex sync.Mutex
+)
+
+// formatRootIdentity returns the identity of the root filesystem: the root hash for a dm-verity root, otherwise
+// the filesystem UUID or the root reference if the filesystem does not have a UUID (e.g. NFS).
+func formatRootIdentity(info *blkInfo, ref *deviceRef, verityHash []byte) string {
+	if verityHash != nil && info.path == "/dev/mapper/"+verityRootName {
+		return "roothash=" + hex.EncodeToString(verityHash)
+	}
+	if len(info.uuid) > 0 {
+		return "UUID=" + info.uuid.toString()
+	}
+	return "REF=" + ref.String()
+}
+
+func setRootIdentity(info *blkInfo, ref *deviceRef) {
+	rootIdentityMutex.Lock()
+	defer rootIdentityMutex.Unlock()
+	rootIdentity = formatRootIdentity(info, ref, verityRootHash)
+}
+
+// setMountedRootIdentity sets the identity of the root filesystem mounted at dir by hand, e.g. in the rescue shell.
+// The filesystem is probed at the device backing the mount point. A filesystem without a block device (e.g. NFS)
+// is identified with the mount point, i.e. REF=/booster.root.
+func setMountedRootIdentity(dir string) {
+	ref := &deviceRef{format: refPath, data: dir}
+	info := &blkInfo{path: dir}
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err == nil {
+		sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(st.Dev), unix.Minor(st.Dev)))
+		if err == nil {
+			if probed, err := readBlkInfo("/dev/" + filepath.Base(sysPath)); err == nil {
+				info = probed
+			}
+		}
+	}
+	setRootIdentity(info, ref)
+}
+
+// tpm2Digest is a digest of a PCR bank
+type tpm2Digest struct {
+	alg    uint16
+	digest []byte
+}
+
+// tpm2HashAlgs are the hash algorithms of the PCR banks booster is able to extend
+var tpm2HashAlgs = map[uint16]func() hash.Hash{
+	tpm2AlgSha1:   sha1.New,
+	tpm2AlgSha256: sha256.New,
+	tpm2AlgSha384: sha512.New384,
+	tpm2AlgSha512: sha512.New,
+}
+
+// rootIdentityDigests are the digests the PCR banks are extended with, the hash of "booster:root:" followed by
+// the identity computed with the bank algorithm
+func rootIdentityDigests(identity string, banks []uint16) ([]tpm2Digest, error) {
+	var digests []tpm2Digest
+	for _, alg := range banks {
+		newHash, ok := tpm2HashAlgs[alg]
+		if !ok {
+			return nil, fmt.Errorf("PCR bank with hash algorithm 0x%04x is not supported", alg)
+		}
+		h := newHash()
+		h.Write([]byte(rootIdentityPrefix + identity))
+		digests = append(digests, tpm2Digest{alg: alg, digest: h.Sum(nil)})
+	}
+	return digests, nil
+}
+
+// measureRoot extends all active banks of the PCR specified in the config with the identity of the mounted root
+// filesystem so a remote verifier can tell what root has been booted. A missing TPM or a failed measurement does not
+// stop the boot.
+func measureRoot() {
+	if config.MeasureRootPcr == nil {
+		return
+	}
+	pcr := *config.MeasureRootPcr
+
+	rootIdentityMutex.Lock()
+	identity := rootIdentity
+	rootIdentityMutex.Unlock()
+	if identity == "" {
+		return
+	}
+
+	if err := waitForTpm2Device(tpm2DeviceTimeout); err != nil {
+		warning("%v, the root filesystem is not measured", err)
+		return
+	}
+	banks, err := tpm2ActiveBanks()
+	if err != nil {
+		warning("tpm2: unable to read the active PCR banks: %v, the root filesystem is not measured", err)
+		return
+	}
+	digests, err := rootIdentityDigests(identity, banks)
+	if err != nil {
+		warning("tpm2: %v, the root filesystem is not measured", err)
+		return
+	}
+	if err := tpm2PcrExtend(pcr, digests); err != nil {
+		warning("tpm2: unable to measure the root filesystem to PCR %d: %v", pcr, err)
+		return
+	}
+	inform("tpm2: measured root identity '%s' to PCR %d", identity, pcr)
+}
+
+// TPM 2.0 command encoding of TPM2_PCR_Extend and TPM2_GetCapability, see the TPM 2.0 specification part 3,
+// sections 22.2 and 30.2
+const (
+	tpm2StNoSessions    = 0x8001
+	tpm2StSessions      = 0x8002
+	tpm2CcPcrExtend     = 0x00000182
+	tpm2CcGetCapability = 0x0000017a
+	tpm2CapPcrs         = 0x00000005
+	tpm2RsPw            = 0x40000009 // password authorization session
+	tpm2AlgSha1         = 0x0004
+	tpm2AlgSha256       = 0x000b
+	tpm2AlgSha384       = 0x000c
+	tpm2AlgSha512       = 0x000d
+	tpm2ResponseHdrSz   = 10
+)
+
+// tpm2PcrExtendCommand builds the TPM2_PCR_Extend command that extends the banks of the PCR with the digests.
+// The PCRs are authorized with the empty password.
+func tpm2PcrExtendCommand(pcr int, digests []tpm2Digest) []byte {
+	var b bytes.Buffer
+	write := func(v interface{}) { _ = binary.Write(&b, binary.BigEndian, v) }
+	write(uint16(tpm2StSessions))
+	write(uint32(0)) // command size, set below
+	write(uint32(tpm2CcPcrExtend))
+	write(uint32(pcr)) // PCR handle
+	// authorization area: session handle, empty nonce, session attributes, empty password
+	write(uint32(4 + 2 + 1 + 2))
+	write(uint32(tpm2RsPw))
+	write(uint16(0))
+	write(uint8(0))
+	write(uint16(0))
+	// TPML_DIGEST_VALUES with a digest per bank
+	write(uint32(len(digests)))
+	for _, d := range digests {
+		write(d.alg)
+		write(d.digest)
+	}
+
+	cmd := b.Bytes()
+	binary.BigEndian.PutUint32(cmd[2:], uint32(len(cmd)))
+	return cmd
+}
+
+// tpm2GetPcrsCommand builds the TPM2_GetCapability command that reads the PCR banks allocation
+func tpm2GetPcrsCommand() []byte {
+	var b bytes.Buffer
+	write := func(v interface{}) { _ = binary.Write(&b, binary.BigEndian, v) }
+	write(uint16(tpm2StNoSessions))
+	write(uint32(0)) // command size, set below
+	write(uint32(tpm2CcGetCapability))
+	write(uint32(tpm2CapPcrs))
+	write(uint32(0)) // property
+	write(uint32(1)) // property count
+
+	cmd := b.Bytes()
+	binary.BigEndian.PutUint32(cmd[2:], uint32(len(cmd)))
+	return cmd
+}
+
+// parseTpm2ActiveBanks returns the hash algorithms of the banks that have any PCR allocated from the response
+// to TPM2_GetCapability(TPM_CAP_PCRS): moreData, capability and TPML_PCR_SELECTION
+func parseTpm2ActiveBanks(resp []byte) ([]uint16, error) {
+	data := resp[tpm2ResponseHdrSz:]
+	if len(data) < 9 || binary.BigEndian.Uint32(data[1:]) != tpm2CapPcrs {
+		return nil, fmt.Errorf("unexpected TPM capability data")
+	}
+	count := binary.BigEndian.Uint32(data[5:])
+	data = data[9:]
+	var banks []uint16
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 3 || len(data) < 3+int(data[2]) {
+			return nil, fmt.Errorf("TPM PCR selection is truncated")
+		}
+		alg, selection := binary.BigEndian.Uint16(data), data[3:3+int(data[2])]
+		if len(bytes.Trim(selection, "\x00")) != 0 {
+			banks = append(banks, alg)
+		}
+		data = data[3+len(selection):]
+	}
+	if len(banks) == 0 {
+		return nil, fmt.Errorf("no active PCR banks")
+	}
+	return banks, nil
+}
+
+func tpm2ActiveBanks() ([]uint16, error) {
+	resp, err := tpm2Command(tpm2GetPcrsCommand())
+	if err != nil {
+		return nil, err
+	}
+	return parseTpm2ActiveBanks(resp)
+}
+
+func tpm2PcrExtend(pcr int, digests []tpm2Digest) error {
+	if pcr < 0 || pcr > tpm2MaxPcr {
+		return fmt.Errorf("invalid PCR index %d", pcr)
+	}
+	_, err := tpm2Command(tpm2PcrExtendCommand(pcr, digests))
+	return err
+}
+
+// tpm2Command sends the command to the TPM and returns the response if the command succeeded
+func tpm2Command(cmd []byte) ([]byte, error) {
+	f, err := os.OpenFile(tpm2Device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(cmd); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 4096)
+	n, err := f.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	if n < tpm2ResponseHdrSz {
+		return nil, fmt.Errorf("TPM response is truncated")
+	}
+	if rc := binary.BigEndian.Uint32(resp[6:]); rc != 0 {
+		return nil, fmt.Errorf("TPM returned error code 0x%x", rc)
+	}
+	return resp[:n], nil
+}
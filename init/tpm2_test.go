@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestTpm2Token(t *testing.T) {
+	defer func() { cmdline = make(map[string]string) }()
+
+	pcrs, err := parseTpm2Pcrs("0,2,7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpm2PcrSelection("sha256", pcrs) != "sha256:0,2,7" {
+		t.Fatalf("unexpected PCR selection %s", tpm2PcrSelection("sha256", pcrs))
+	}
+	for _, param := range []string{"", "24", "-1", "0,,7", "seven"} {
+		if _, err := parseTpm2Pcrs(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+
+	check := func(token *tpm2Token, param string, expected string) {
+		cmdline = map[string]string{}
+		if param != "" {
+			cmdline["booster.tpm2_pcrs"] = param
+		}
+		pcrs, err := tpm2TokenPcrs(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if formatPcrs(pcrs) != expected {
+			t.Fatalf("token %v, booster.tpm2_pcrs=%s: expected PCRs %s, got %v", token.Pcrs, param, expected, pcrs)
+		}
+	}
+	check(&tpm2Token{}, "", "7")
+	check(&tpm2Token{Pcrs: []int{0, 7}}, "", "0,7")
+	// a policy sealed to other PCRs cannot be satisfied, the boot param is used only without the token PCRs
+	check(&tpm2Token{Pcrs: []int{0, 7}}, "0,2,7", "0,7")
+	check(&tpm2Token{Pcrs: []int{0, 7}}, "7,0", "0,7")
+	check(&tpm2Token{}, "0,2,7", "0,2,7")
+
+	blob := []byte{0x00, 0x03, 0xa, 0xb, 0xc, 0x00, 0x02, 0xd, 0xe}
+	priv, pub, err := splitTpm2Blob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(priv, blob[:5]) || !bytes.Equal(pub, blob[5:]) {
+		t.Fatalf("unexpected blob parts %x and %x", priv, pub)
+	}
+	for _, b := range [][]byte{{0x00}, {0x00, 0x03, 0xa}, append(blob, 0xf)} {
+		if _, _, err := splitTpm2Blob(b); err == nil {
+			t.Fatalf("%x: expected to fail but it did not", b)
+		}
+	}
+}
+
+func TestRootIdentity(t *testing.T) {
+	uuid := UUID{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4}
+	ref := &deviceRef{format: refPath, data: "192.168.1.1:/srv/root"}
+	check := func(info *blkInfo, verityHash []byte, expected string) {
+		if identity := formatRootIdentity(info, ref, verityHash); identity != expected {
+			t.Fatalf("expected root identity %s, got %s", expected, identity)
+		}
+	}
+	check(&blkInfo{path: "/dev/sda2", uuid: uuid}, nil, "UUID=1705d91e-bf54-4a1a-878d-721d7233eba4")
+	check(&blkInfo{path: "/dev/mapper/root", uuid: uuid}, []byte{0xab, 0xcd}, "roothash=abcd")
+	check(&blkInfo{path: "/dev/sda2", uuid: uuid}, []byte{0xab, 0xcd}, "UUID=1705d91e-bf54-4a1a-878d-721d7233eba4")
+	check(&blkInfo{path: "192.168.1.1:/srv/root"}, nil, "REF=192.168.1.1:/srv/root")
+
+	check(&blkInfo{path: "/dev/sdb1", uuid: UUID{0x12, 0x34, 0xab, 0xcd}}, nil, "UUID=1234abcd") // vfat
+
+	digests, err := rootIdentityDigests("roothash=abcd", []uint16{tpm2AlgSha1, tpm2AlgSha256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha1Digest := sha1.Sum([]byte("booster:root:roothash=abcd"))
+	sha256Digest := sha256.Sum256([]byte("booster:root:roothash=abcd"))
+	if len(digests) != 2 || !bytes.Equal(digests[0].digest, sha1Digest[:]) || !bytes.Equal(digests[1].digest, sha256Digest[:]) {
+		t.Fatalf("unexpected root identity digests %+v", digests)
+	}
+	if _, err := rootIdentityDigests("roothash=abcd", []uint16{0x0012}); err == nil {
+		t.Fatal("SM3 bank is not expected to be supported")
+	}
+
+	cmd := tpm2PcrExtendCommand(15, digests)
+	if len(cmd) != 87 || int(binary.BigEndian.Uint32(cmd[2:])) != len(cmd) {
+		t.Fatalf("unexpected command size %d", len(cmd))
+	}
+	if binary.BigEndian.Uint32(cmd[6:]) != tpm2CcPcrExtend || binary.BigEndian.Uint32(cmd[10:]) != 15 || binary.BigEndian.Uint32(cmd[18:]) != tpm2RsPw {
+		t.Fatalf("unexpected command header %x", cmd[:22])
+	}
+	if binary.BigEndian.Uint32(cmd[27:]) != 2 || binary.BigEndian.Uint16(cmd[31:]) != tpm2AlgSha1 || !bytes.Equal(cmd[33:53], sha1Digest[:]) ||
+		binary.BigEndian.Uint16(cmd[53:]) != tpm2AlgSha256 || !bytes.Equal(cmd[55:], sha256Digest[:]) {
+		t.Fatalf("unexpected digest values %x", cmd[27:])
+	}
+
+	// moreData, TPM_CAP_PCRS and the selections: SHA-1 and SHA-256 with PCRs 0-23 allocated, SHA-384 without PCRs
+	resp := append(make([]byte, tpm2ResponseHdrSz), 0, 0, 0, 0, 5, 0, 0, 0, 3,
+		0x00, 0x04, 3, 0xff, 0xff, 0xff,
+		0x00, 0x0b, 3, 0xff, 0xff, 0xff,
+		0x00, 0x0c, 3, 0x00, 0x00, 0x00)
+	banks, err := parseTpm2ActiveBanks(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(banks, []uint16{tpm2AlgSha1, tpm2AlgSha256}) {
+		t.Fatalf("unexpected active banks %v", banks)
+	}
+	if _, err := parseTpm2ActiveBanks(resp[:len(resp)-2]); err == nil {
+		t.Fatal("a truncated PCR selection is expected to fail")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FITRIM ioctl, see linux/fs.h
+const fitrim = 0xc0185879
+
+// fstrimRange is struct fstrim_range, the kernel sets len to the number of the discarded bytes
+type fstrimRange struct {
+	start  uint64
+	len    uint64
+	minLen uint64
+}
+
+var trimEnabled bool // set with booster.trim=1 boot param
+
+func parseTrimParam() error {
+	param, ok := cmdline["booster.trim"]
+	if !ok {
+		trimEnabled = false
+		return nil
+	}
+	switch param {
+	case "1", "":
+		trimEnabled = true
+	case "0":
+		trimEnabled = false
+	default:
+		return fmt.Errorf("invalid booster.trim kernel parameter %s, expected booster.trim=1", param)
+	}
+	return nil
+}
+
+// supportsDiscard reports if the block device accepts discard requests. A partition has no queue attributes,
+// they are read from its disk.
+func supportsDiscard(devNo uint64) bool {
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(devNo), unix.Minor(devNo)))
+	if err != nil {
+		return false
+	}
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		content, err := os.ReadFile(filepath.Join(d, "queue", "discard_max_bytes"))
+		if err != nil {
+			continue
+		}
+		max, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		return err == nil && max != 0
+	}
+	return false
+}
+
+// trimRoot discards the unused blocks of the mounted root filesystem, the same as fstrim(8) does. Only the free
+// space of the filesystem is trimmed, booster never discards the whole device.
+func trimRoot(info *blkInfo) {
+	if !trimEnabled {
+		return
+	}
+	if info.devNo == 0 || !supportsDiscard(info.devNo) {
+		inform("booster.trim: %s does not support discard, skipping it", info.path)
+		return
+	}
+
+	root, err := os.Open(newRoot)
+	if err != nil {
+		warning("booster.trim: %v", err)
+		return
+	}
+	defer root.Close()
+
+	r := fstrimRange{len: math.MaxUint64}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, root.Fd(), fitrim, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		if errno == unix.EOPNOTSUPP || errno == unix.ENOTTY {
+			inform("booster.trim: %s filesystem at %s does not support trimming, skipping it", info.format, info.path)
+		} else {
+			warning("booster.trim: unable to trim %s: %v", info.path, errno)
+		}
+		return
+	}
+	inform("booster.trim: %s: %d MiB trimmed", info.path, r.len/1024/1024)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestParseTrimParam(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		cmdlineValues = make(map[string][]string)
+		trimEnabled = false
+	}()
+
+	// FITRIM is _IOWR('X', 121, struct fstrim_range), the size is encoded into the ioctl number
+	if size := unsafe.Sizeof(fstrimRange{}); size != fitrim>>16&0x3fff {
+		t.Fatalf("fstrimRange size %d does not match the FITRIM ioctl", size)
+	}
+
+	for params, expected := range map[string]bool{"": false, "booster.trim": true, "booster.trim=1": true, "booster.trim=0": false} {
+		cmdline = make(map[string]string)
+		parseCmdlineParams(params)
+		if err := parseTrimParam(); err != nil {
+			t.Fatal(err)
+		}
+		if trimEnabled != expected {
+			t.Fatalf("%s: expected trim %v, got %v", params, expected, trimEnabled)
+		}
+	}
+	cmdline = map[string]string{"booster.trim": "yes"}
+	if err := parseTrimParam(); err == nil {
+		t.Fatal("booster.trim=yes: expected to fail but it did not")
+	}
+}
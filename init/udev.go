@@ -88,6 +88,8 @@ func udevListener() {
 			err = handleBlockDeviceUevent(ev)
 		} else if ev.Subsystem == "net" {
 			err = handleNetworkUevent(ev)
+		} else if ev.Subsystem == "firmware" {
+			err = handleFirmwareUevent(ev)
 		}
 
 		if err != nil {
@@ -105,12 +107,24 @@ func handleNetworkUevent(ev *uevent.Uevent) error {
 	if ifname == "lo" {
 		return nil
 	}
+	ifname = applyNetUdevRules(ifname)
 
 	if config.Network == nil {
 		debug("network is disabled, skipping interface %s", ifname)
 		return nil
 	}
 
+	if isBondName(ifname) {
+		return nil // the bond is configured once its members are added, see startBond()
+	}
+	if b := bondFor(ifname); b != nil {
+		startBond(b)
+		return nil
+	}
+	if startVlans(ifname) {
+		return nil // only the VLAN interfaces on top of it get configured
+	}
+
 	if len(config.Network.Interfaces) > 0 {
 		i, err := net.InterfaceByName(ifname)
 		if err != nil {
@@ -122,6 +136,21 @@ func handleNetworkUevent(ev *uevent.Uevent) error {
 			return nil
 		}
 	}
+	if hwaddr := networkRootHwaddr(); hwaddr != "" {
+		i, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return err
+		}
+
+		if i.HardwareAddr.String() != hwaddr {
+			debug("interface %s is not the interface %s selected for the network root, skipping it", ifname, hwaddr)
+			return nil
+		}
+	}
+	if len(ipConfigs) != 0 && len(ipConfigsFor(ifname)) == 0 {
+		debug("interface %s is not specified with ip= boot param, skipping it", ifname)
+		return nil
+	}
 
 	go func() {
 		// run network init in a separate goroutine to avoid it blocking with clevis+tang unlocking
@@ -135,6 +164,7 @@ func handleNetworkUevent(ev *uevent.Uevent) error {
 
 func handleBlockDeviceUevent(ev *uevent.Uevent) error {
 	devName := ev.Vars["DEVNAME"]
+	invalidateProbeCache("/dev/"+devName, ev.Seqnum)
 
 	if strings.HasPrefix(devName, "dm-") {
 		dmPath, err := handleMapperDeviceUevent(ev)
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// udev rules are evaluated by a small engine that supports the rules needed for the device naming: the matches of
+// the device and its parents, NAME= of the network interfaces, SYMLINK= of the block devices, ENV{} and GOTO/LABEL.
+// Rules with other match keys (e.g. PROGRAM or IMPORT) never match, other assignments (e.g. RUN or OWNER) are ignored.
+
+type udevOp uint8
+
+const (
+	udevOpMatch       udevOp = iota // ==
+	udevOpNomatch                   // !=
+	udevOpAssign                    // =
+	udevOpAssignFinal               // :=, later rules cannot change the value
+	udevOpAdd                       // +=
+	udevOpRemove                    // -=
+)
+
+var udevOps = []struct {
+	token string
+	op    udevOp
+}{{"==", udevOpMatch}, {"!=", udevOpNomatch}, {"+=", udevOpAdd}, {"-=", udevOpRemove}, {":=", udevOpAssignFinal}, {"=", udevOpAssign}}
+
+// udevRuleKey is a single key of a rule, e.g. ATTR{address}=="52:54:00:*"
+type udevRuleKey struct {
+	name  string
+	attr  string // the part in braces, e.g. address for ATTR{address}
+	op    udevOp
+	value string
+}
+
+func (k udevRuleKey) isMatch() bool {
+	return k.op == udevOpMatch || k.op == udevOpNomatch
+}
+
+// matches compares the value with the key pattern, the pattern might contain '|' separated alternatives
+func (k udevRuleKey) matches(value string) bool {
+	matched := false
+	for _, p := range strings.Split(k.value, "|") {
+		if fnmatch(p, value) {
+			matched = true
+			break
+		}
+	}
+	return matched == (k.op == udevOpMatch)
+}
+
+type udevRule struct {
+	file  string
+	line  int
+	keys  []udevRuleKey
+	label string // LABEL= of the rule, the target of GOTO=
+}
+
+var udevRules []*udevRule
+
+var (
+	udevLinks      = make(map[string]string) // symlinks created by the rules mapped to the paths of their devices
+	udevLinksMutex sync.Mutex
+)
+
+// loadUdevRules reads the rules files from the directory in the lexical order of their names as udev does
+func loadUdevRules(dir string) ([]*udevRule, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []*udevRule
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".rules") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, parseUdevRules(f.Name(), string(content))...)
+	}
+	debug("loaded %d udev rules", len(rules))
+	return rules, nil
+}
+
+// parseUdevRules parses the content of a rules file. A malformed rule is reported and skipped.
+func parseUdevRules(file, content string) []*udevRule {
+	var rules []*udevRule
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(lines[i])
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + strings.TrimSpace(lines[i])
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		keys, err := parseUdevRuleLine(line)
+		if err != nil {
+			warning("udev rules %s:%d: %v, skipping the rule", file, lineNo, err)
+			continue
+		}
+		rule := &udevRule{file: file, line: lineNo, keys: keys}
+		for _, k := range keys {
+			if k.name == "LABEL" {
+				rule.label = k.value
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// parseUdevRuleLine parses the comma separated keys of the rule, e.g. SUBSYSTEM=="net", NAME="lan0"
+func parseUdevRuleLine(line string) ([]udevRuleKey, error) {
+	var keys []udevRuleKey
+	for {
+		line = strings.TrimLeft(line, " \t,")
+		if line == "" {
+			break
+		}
+		i := 0
+		for i < len(line) && (line[i] >= 'A' && line[i] <= 'Z' || line[i] >= 'a' && line[i] <= 'z' || line[i] >= '0' && line[i] <= '9' || line[i] == '_') {
+			i++
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("invalid key at '%s'", line)
+		}
+		k := udevRuleKey{name: line[:i]}
+		line = line[i:]
+		if strings.HasPrefix(line, "{") {
+			end := strings.IndexByte(line, '}')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated attribute of key %s", k.name)
+			}
+			k.attr, line = line[1:end], line[end+1:]
+		}
+
+		line = strings.TrimLeft(line, " \t")
+		width := 0
+		for _, o := range udevOps {
+			if strings.HasPrefix(line, o.token) {
+				k.op, width = o.op, len(o.token)
+				break
+			}
+		}
+		if width == 0 {
+			return nil, fmt.Errorf("missing operator after key %s", k.name)
+		}
+		line = strings.TrimLeft(line[width:], " \t")
+
+		if !strings.HasPrefix(line, `"`) {
+			return nil, fmt.Errorf("value of key %s is not quoted", k.name)
+		}
+		var value strings.Builder
+		j := 1
+		for ; j < len(line) && line[j] != '"'; j++ {
+			if line[j] == '\\' && j+1 < len(line) && (line[j+1] == '"' || line[j+1] == '\\') {
+				j++
+			}
+			value.WriteByte(line[j])
+		}
+		if j == len(line) {
+			return nil, fmt.Errorf("unterminated value of key %s", k.name)
+		}
+		k.value, line = value.String(), line[j+1:]
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// udevDevice is a device the rules are evaluated for
+type udevDevice struct {
+	kernel        string            // kernel name, e.g. sda1 or eth0
+	syspath       string            // the device directory at sysfs
+	env           map[string]string // the uevent properties, ENV{} assignments change them
+	name          string            // NAME= assigned by the rules
+	nameFinal     bool
+	symlinks      []string // SYMLINK= assigned by the rules, relative to /dev
+	symlinksFinal bool
+}
+
+// newUdevDevice returns the device of the subsystem (block or net) with its properties read from sysfs
+func newUdevDevice(subsystem, kernel string) (*udevDevice, error) {
+	syspath, err := filepath.EvalSymlinks(filepath.Join("/sys/class", subsystem, kernel))
+	if err != nil {
+		return nil, err
+	}
+	return udevDeviceAt(subsystem, kernel, syspath), nil
+}
+
+func udevDeviceAt(subsystem, kernel, syspath string) *udevDevice {
+	env := make(map[string]string)
+	content, _ := os.ReadFile(filepath.Join(syspath, "uevent"))
+	for _, line := range strings.Split(string(content), "\n") {
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	env["ACTION"] = "add"
+	env["SUBSYSTEM"] = subsystem
+	env["DEVPATH"] = strings.TrimPrefix(syspath, "/sys")
+	return &udevDevice{kernel: kernel, syspath: syspath, env: env}
+}
+
+// readSysAttr reads the sysfs attribute, the trailing whitespace is removed the same way as udev does
+func readSysAttr(dir, attr string) string {
+	content, err := os.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(content), " \t\n")
+}
+
+func readSysLink(dir, link string) string {
+	target, err := os.Readlink(filepath.Join(dir, link))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+func (d *udevDevice) currentName() string {
+	if d.name != "" {
+		return d.name
+	}
+	return d.kernel
+}
+
+// property returns the value of the device that the match key compares, ok is false if the key is not supported
+func (d *udevDevice) property(k udevRuleKey) (string, bool) {
+	switch k.name {
+	case "ACTION", "SUBSYSTEM", "DEVPATH":
+		return d.env[k.name], true
+	case "KERNEL":
+		return d.kernel, true
+	case "NAME":
+		return d.currentName(), true
+	case "DRIVER":
+		return readSysLink(d.syspath, "driver"), true
+	case "ENV":
+		return d.env[k.attr], true
+	case "ATTR":
+		return readSysAttr(d.syspath, k.attr), true
+	default:
+		return "", false
+	}
+}
+
+// parentProperty returns the value of the device or of one of its parents at dir for KERNELS, SUBSYSTEMS, DRIVERS and ATTRS keys
+func parentProperty(dir string, k udevRuleKey) string {
+	switch k.name {
+	case "KERNELS":
+		return filepath.Base(dir)
+	case "SUBSYSTEMS":
+		return readSysLink(dir, "subsystem")
+	case "DRIVERS":
+		return readSysLink(dir, "driver")
+	default: // ATTRS
+		return readSysAttr(dir, k.attr)
+	}
+}
+
+func (r *udevRule) matches(d *udevDevice) bool {
+	var parentKeys []udevRuleKey
+	for _, k := range r.keys {
+		if !k.isMatch() {
+			continue
+		}
+		switch k.name {
+		case "KERNELS", "SUBSYSTEMS", "DRIVERS", "ATTRS":
+			parentKeys = append(parentKeys, k)
+			continue
+		}
+		value, ok := d.property(k)
+		if !ok {
+			debug("udev rules %s:%d: match key %s is not supported, the rule does not match", r.file, r.line, k.name)
+			return false
+		}
+		if !k.matches(value) {
+			return false
+		}
+	}
+	if len(parentKeys) == 0 {
+		return true
+	}
+
+	// all the parent keys have to match the same device, the device itself or one of its parents. The directories
+	// without uevent file are not devices, e.g. the class directory "net" between a network interface and its parent.
+	for dir := d.syspath; filepath.Base(dir) != "devices" && dir != "/"; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "uevent")); err != nil {
+			continue
+		}
+		matched := true
+		for _, k := range parentKeys {
+			if !k.matches(parentProperty(dir, k)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies the assignments of the matched rule to the device. It returns the label of GOTO= if the rule has one.
+func (r *udevRule) apply(d *udevDevice) string {
+	var gotoLabel string
+	for _, k := range r.keys {
+		if k.isMatch() {
+			continue
+		}
+		switch k.name {
+		case "NAME":
+			if !d.nameFinal {
+				d.name = d.substitute(k.value)
+				d.nameFinal = k.op == udevOpAssignFinal
+			}
+		case "SYMLINK":
+			if d.symlinksFinal {
+				continue
+			}
+			links := strings.Fields(d.substitute(k.value))
+			switch k.op {
+			case udevOpAdd:
+				d.symlinks = append(d.symlinks, links...)
+			case udevOpRemove:
+				var kept []string
+			next:
+				for _, l := range d.symlinks {
+					for _, r := range links {
+						if l == r {
+							continue next
+						}
+					}
+					kept = append(kept, l)
+				}
+				d.symlinks = kept
+			default:
+				d.symlinks = links
+				d.symlinksFinal = k.op == udevOpAssignFinal
+			}
+		case "ENV":
+			d.env[k.attr] = d.substitute(k.value)
+		case "GOTO":
+			gotoLabel = k.value
+		case "LABEL":
+		default:
+			debug("udev rules %s:%d: key %s is not supported, ignoring it", r.file, r.line, k.name)
+		}
+	}
+	return gotoLabel
+}
+
+// run evaluates the rules for the device
+func (d *udevDevice) run(rules []*udevRule) {
+	for i := 0; i < len(rules); i++ {
+		r := rules[i]
+		if !r.matches(d) {
+			continue
+		}
+		label := r.apply(d)
+		if label == "" {
+			continue
+		}
+		j := i + 1
+		for j < len(rules) && rules[j].label != label {
+			j++
+		}
+		if j == len(rules) {
+			debug("udev rules %s:%d: GOTO label %s is not found", r.file, r.line, label)
+		}
+		i = j - 1
+	}
+}
+
+// udevShortSubstitutions maps the %-form substitutions to their $-form names
+var udevShortSubstitutions = map[byte]string{'k': "kernel", 'n': "number", 'p': "devpath", 'E': "env", 's': "attr", 'D': "name"}
+
+var udevLongSubstitutions = []string{"kernel", "number", "devpath", "env", "attr", "name"}
+
+// substitute replaces the udev string substitutions in the assigned value, e.g. $kernel, %n or $env{ID_SERIAL}
+func (d *udevDevice) substitute(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '%' && c != '$' || i+1 == len(value) {
+			b.WriteByte(c)
+			continue
+		}
+		rest := value[i+1:]
+		if rest[0] == c {
+			b.WriteByte(c) // %% or $$
+			i++
+			continue
+		}
+		var name string
+		width := 0
+		if c == '%' {
+			if n, ok := udevShortSubstitutions[rest[0]]; ok {
+				name, width = n, 1
+			}
+		} else {
+			for _, n := range udevLongSubstitutions {
+				if strings.HasPrefix(rest, n) {
+					name, width = n, len(n)
+					break
+				}
+			}
+		}
+		if name == "" {
+			b.WriteByte(c)
+			continue
+		}
+		var arg string
+		if (name == "env" || name == "attr") && strings.HasPrefix(rest[width:], "{") {
+			if end := strings.IndexByte(rest[width:], '}'); end != -1 {
+				arg = rest[width+1 : width+end]
+				width += end + 1
+			}
+		}
+		b.WriteString(d.substitution(name, arg))
+		i += width
+	}
+	return b.String()
+}
+
+func (d *udevDevice) substitution(name, arg string) string {
+	switch name {
+	case "kernel":
+		return d.kernel
+	case "number":
+		i := len(d.kernel)
+		for i > 0 && d.kernel[i-1] >= '0' && d.kernel[i-1] <= '9' {
+			i--
+		}
+		return d.kernel[i:]
+	case "devpath":
+		return d.env["DEVPATH"]
+	case "env":
+		return d.env[arg]
+	case "attr":
+		return readSysAttr(d.syspath, arg)
+	default: // name
+		return d.currentName()
+	}
+}
+
+// applyBlockUdevRules creates the symlinks the rules assign to the block device devname (e.g. sda1 or mapper/root)
+func applyBlockUdevRules(devname string) {
+	if len(udevRules) == 0 {
+		return
+	}
+	devpath := "/dev/" + devname
+	kernel := devname
+	if strings.Contains(devname, "/") {
+		target, err := filepath.EvalSymlinks(devpath)
+		if err != nil {
+			debug("udev rules: %v", err)
+			return
+		}
+		kernel = filepath.Base(target)
+	}
+	d, err := newUdevDevice("block", kernel)
+	if err != nil {
+		debug("udev rules: %v", err)
+		return
+	}
+	d.run(udevRules)
+	if d.name != "" && d.name != kernel {
+		debug("udev rules: NAME=%s of block device %s is ignored, block devices are named by the kernel", d.name, kernel)
+	}
+
+	for _, l := range d.symlinks {
+		link := filepath.Join("/dev", l)
+		if !strings.HasPrefix(link, "/dev/") {
+			warning("udev rules: symlink %s of %s is outside of /dev", l, devname)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			warning("udev rules: %v", err)
+			continue
+		}
+		_ = os.Remove(link) // udev points the link to the most recently added device too
+		if err := os.Symlink("/dev/"+kernel, link); err != nil {
+			warning("udev rules: %v", err)
+			continue
+		}
+		debug("udev rules: created symlink %s for %s", link, devpath)
+		udevLinksMutex.Lock()
+		udevLinks[link] = devpath
+		udevLinksMutex.Unlock()
+	}
+}
+
+// udevLinkTarget returns the path of the device the symlink created by the udev rules points to
+func udevLinkTarget(link string) string {
+	udevLinksMutex.Lock()
+	defer udevLinksMutex.Unlock()
+	return udevLinks[filepath.Clean(link)]
+}
+
+// applyNetUdevRules renames the network interface if the rules assign NAME= to it. It returns the current interface name.
+func applyNetUdevRules(ifname string) string {
+	if len(udevRules) == 0 {
+		return ifname
+	}
+	d, err := newUdevDevice("net", ifname)
+	if err != nil {
+		debug("udev rules: %v", err)
+		return ifname
+	}
+	d.run(udevRules)
+	if d.name == "" || d.name == ifname {
+		return ifname
+	}
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		warning("udev rules: %v", err)
+		return ifname
+	}
+	if err := netlink.LinkSetName(link, d.name); err != nil {
+		warning("udev rules: unable to rename network interface %s to %s: %v", ifname, d.name, err)
+		return ifname
+	}
+	inform("udev rules: renamed network interface %s to %s", ifname, d.name)
+	return d.name
+}
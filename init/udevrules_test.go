@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUdevRules(t *testing.T) {
+	rules := parseUdevRules("10-test.rules", `# comment
+SUBSYSTEM=="net", ACTION=="add", ATTR{address}=="52:54:00:*", \
+  NAME="lan0"
+
+KERNEL!="sd*|nvme*", GOTO="end"
+ENV{ID_NAME}="test \"quoted\""
+KERNEL=="sda" NAME
+LABEL="end"
+`)
+	if len(rules) != 4 {
+		t.Fatalf("expected 4 rules, got %d", len(rules))
+	}
+	expected := []udevRuleKey{
+		{name: "SUBSYSTEM", op: udevOpMatch, value: "net"},
+		{name: "ACTION", op: udevOpMatch, value: "add"},
+		{name: "ATTR", attr: "address", op: udevOpMatch, value: "52:54:00:*"},
+		{name: "NAME", op: udevOpAssign, value: "lan0"},
+	}
+	if !reflect.DeepEqual(rules[0].keys, expected) || rules[0].line != 2 {
+		t.Fatalf("unexpected rule %+v", rules[0])
+	}
+	if rules[1].keys[0].op != udevOpNomatch || rules[1].keys[1].name != "GOTO" {
+		t.Fatalf("unexpected rule %+v", rules[1])
+	}
+	if rules[2].keys[0].value != `test "quoted"` {
+		t.Fatalf("unexpected escaped value %s", rules[2].keys[0].value)
+	}
+	if rules[3].label != "end" {
+		t.Fatalf("unexpected label %+v", rules[3])
+	}
+}
+
+func TestUdevRules(t *testing.T) {
+	sys := t.TempDir()
+	pci := sys + "/devices/pci0000:00/0000:00:03.0"
+	nic := pci + "/virtio0/net/eth0"
+	disk := pci + "/virtio1/block/vda"
+	for _, d := range []string{nic, disk + "/vda2", sys + "/bus/virtio", sys + "/bus/pci", sys + "/drivers/virtio_net"} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		pci + "/uevent":              "PCI_ID=1AF4:1000\n",
+		pci + "/vendor":              "0x1af4\n",
+		pci + "/virtio0/uevent":      "MODALIAS=virtio:d00000001v00001AF4\n",
+		nic + "/uevent":              "INTERFACE=eth0\nIFINDEX=2\n",
+		nic + "/address":             "52:54:00:12:34:56\n",
+		pci + "/virtio1/uevent":      "",
+		disk + "/uevent":             "DEVNAME=vda\nDEVTYPE=disk\n",
+		disk + "/vda2/uevent":        "DEVNAME=vda2\nDEVTYPE=partition\nPARTN=2\n",
+		disk + "/vda2/serial_suffix": "p2\n",
+	}
+	for f, content := range files {
+		if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../../../../bus/pci", pci+"/subsystem"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../../../../drivers/virtio_net", pci+"/virtio0/driver"); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := parseUdevRules("10-test.rules", `
+SUBSYSTEM=="net", ATTR{address}=="52:54:00:*", DRIVERS=="virtio_net", NAME="lan$number"
+SUBSYSTEM=="net", ATTR{address}=="aa:*", NAME="wrong"
+SUBSYSTEM=="net", NAME=="lan0", ENV{PROP}="named %k to $name"
+SUBSYSTEM=="block", KERNEL!="vd*", GOTO="end"
+SUBSYSTEM=="block", ENV{DEVTYPE}=="partition", SUBSYSTEMS=="pci", ATTRS{vendor}=="0x1af4", SYMLINK+="disk/by-id/virtio-root-part$env{PARTN} custom/%k"
+SUBSYSTEM=="block", PROGRAM=="/bin/true", SYMLINK+="unsupported"
+SUBSYSTEM=="block", SYMLINK-="custom/vda2", RUN+="/bin/false"
+LABEL="end"
+SUBSYSTEM=="block", SYMLINK+="all/$kernel"
+`)
+
+	d := udevDeviceAt("net", "eth0", nic)
+	d.run(rules)
+	if d.name != "lan0" {
+		t.Fatalf("expected the interface to be renamed to lan0, got '%s'", d.name)
+	}
+	if d.env["PROP"] != "named eth0 to lan0" {
+		t.Fatalf("unexpected substitution '%s'", d.env["PROP"])
+	}
+
+	d = udevDeviceAt("block", "vda2", disk+"/vda2")
+	d.run(rules)
+	if !reflect.DeepEqual(d.symlinks, []string{"disk/by-id/virtio-root-part2", "all/vda2"}) {
+		t.Fatalf("unexpected symlinks %q", d.symlinks)
+	}
+	if d.env["DEVPATH"] != strings.TrimPrefix(disk+"/vda2", "/sys") {
+		t.Fatalf("unexpected DEVPATH %s", d.env["DEVPATH"])
+	}
+
+	d = udevDeviceAt("block", "vda", disk)
+	d.run(rules)
+	if !reflect.DeepEqual(d.symlinks, []string{"all/vda"}) {
+		t.Fatalf("unexpected symlinks of the disk %q", d.symlinks)
+	}
+
+	d = udevDeviceAt("block", "sda", disk+"/vda2")
+	d.run(rules)
+	if !reflect.DeepEqual(d.symlinks, []string{"all/sda"}) {
+		t.Fatalf("the rules before the GOTO label are expected to be skipped, got symlinks %q", d.symlinks)
+	}
+
+	final := parseUdevRules("20-test.rules", `
+KERNEL=="eth*", NAME:="first"
+KERNEL=="eth*", NAME="second"
+`)
+	d = udevDeviceAt("net", "eth0", nic)
+	d.run(final)
+	if d.name != "first" {
+		t.Fatalf("the final NAME is expected to be kept, got '%s'", d.name)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -54,14 +55,25 @@ func deviceNo(path string) (uint64, error) {
 
 type UUID []byte
 
-const uuidLen = 36
+const (
+	uuidLen         = 36
+	uuidNoDashesLen = 32
+)
 
 var uuidRe = regexp.MustCompile(`[[:xdigit:]]{8}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{12}`)
 
-// parseUUID parses input string that provides UUID in format that matches uuidRe
+// parseUUID parses input string that provides UUID in format that matches uuidRe or as 32 hex digits without dashes
+// (e.g. as printed by some Windows tools)
 func parseUUID(uuid string) (UUID, error) {
+	if len(uuid) == uuidNoDashesLen {
+		u, err := hex.DecodeString(uuid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UUID format")
+		}
+		return u, nil
+	}
 	if len(uuid) != uuidLen {
-		return nil, fmt.Errorf("expected input length is %d, got length %d", uuidLen, len(uuid))
+		return nil, fmt.Errorf("expected input length is %d or %d, got length %d", uuidLen, uuidNoDashesLen, len(uuid))
 	}
 
 	if !uuidRe.MatchString(uuid) {
@@ -72,6 +84,45 @@ func parseUUID(uuid string) (UUID, error) {
 	return hex.DecodeString(noDashes)
 }
 
+// parseTimeout parses a timeout boot param specified either as a number of seconds or as a duration, e.g. 500ms
+func parseTimeout(param string) (time.Duration, error) {
+	if sec, err := strconv.ParseUint(param, 10, 32); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	d, err := time.ParseDuration(param)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %s", param)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative timeout %s", param)
+	}
+	return d, nil
+}
+
+// parseDeviceTimeouts parses a comma-separated list of timeouts, e.g. booster.device_timeout=5,1m
+func parseDeviceTimeouts(param string) ([]time.Duration, error) {
+	var timeouts []time.Duration
+	for _, p := range strings.Split(param, ",") {
+		d, err := parseTimeout(p)
+		if err != nil {
+			return nil, err
+		}
+		timeouts = append(timeouts, d)
+	}
+	return timeouts, nil
+}
+
+var fsSerialRe = regexp.MustCompile(`^[[:xdigit:]]{4}-[[:xdigit:]]{4}$|^[[:xdigit:]]{16}$|^\d{4}(-\d{2}){6}$`)
+
+// parseFsSerial parses a volume serial number that exFAT and NTFS use instead of UUID. It is the format printed by blkid,
+// e.g. 1234-ABCD for exFAT or 0123456789ABCDEF for NTFS. ISO 9660 volumes are identified by a date, e.g. 2024-01-01-12-00-00-00.
+func parseFsSerial(serial string) (UUID, error) {
+	if !fsSerialRe.MatchString(serial) {
+		return nil, fmt.Errorf("invalid volume serial number format")
+	}
+	return hex.DecodeString(strings.ReplaceAll(serial, "-", ""))
+}
+
 func (uuid UUID) toString() string {
 	if len(uuid) == 16 {
 		// UUID version 4
@@ -82,10 +133,13 @@ func (uuid UUID) toString() string {
 	}
 }
 
-// stripQuotes removes leading and trailing quote symbols if they wrap the given sentence
+// stripQuotes removes leading and trailing quote symbols (double or single) if they wrap the given sentence
 func stripQuotes(in string) string {
 	l := len(in)
-	if in[0] == '"' && in[l-1] == '"' {
+	if l < 2 {
+		return in
+	}
+	if (in[0] == '"' || in[0] == '\'') && in[l-1] == in[0] {
 		return in[1 : l-1]
 	}
 
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -52,6 +54,8 @@ func TestParseUUID(t *testing.T) {
 	check("123e4567-e89b-12d3-a456-426614174000", []byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00})
 	check("17878fe4-616e-4256-b198-2aa90b53603e", []byte{0x17, 0x87, 0x8f, 0xe4, 0x61, 0x6e, 0x42, 0x56, 0xb1, 0x98, 0x2a, 0xa9, 0x0b, 0x53, 0x60, 0x3e})
 	check("1705d91e-bf54-4a1a-878d-721d7233eba4", []byte{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4})
+	check("1705d91ebf544a1a878d721d7233eba4", []byte{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4})
+	check("1705D91EBF544A1A878D721D7233EBA4", []byte{0x17, 0x05, 0xd9, 0x1e, 0xbf, 0x54, 0x4a, 0x1a, 0x87, 0x8d, 0x72, 0x1d, 0x72, 0x33, 0xeb, 0xa4})
 
 	// invalid uuid
 	invalid := func(uuid string) {
@@ -66,10 +70,80 @@ func TestParseUUID(t *testing.T) {
 	invalid(`"1705d91e-bf54-4a1a-878d-721d7233eba4"`)
 	invalid("1705d91e-bf54-4a1a-878d-721d7233eb4")
 	invalid("1705d91e-bf54-4a1a-878d-721d7233eba42")
-	invalid("1705d91ebf544a1a878d721d7233eba4")
+	invalid("1705d91ebf544a1a878d721d7233eba")
+	invalid("1705d91ebf544a1a878d721d7233eba4a")
+	invalid("1705d91ebf544a1a878d721d7233ebx4")
+	invalid("1705d91e-bf544a1a878d721d7233eba4")
 	invalid("1705d91-ebf54-4a1a-878d-721d7233eba4")
 }
 
+func TestParseFsSerial(t *testing.T) {
+	check := func(serial string, expected []byte) {
+		u, err := parseFsSerial(serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(u, expected) {
+			t.Fatalf("serial %s does not match expected result", serial)
+		}
+	}
+
+	check("5D2A-1C3B", []byte{0x5d, 0x2a, 0x1c, 0x3b})
+	check("5d2a-1c3b", []byte{0x5d, 0x2a, 0x1c, 0x3b})
+	check("2C6E1D5A7F3B9E41", []byte{0x2c, 0x6e, 0x1d, 0x5a, 0x7f, 0x3b, 0x9e, 0x41})
+
+	invalid := func(serial string) {
+		if _, err := parseFsSerial(serial); err == nil {
+			t.Fatalf("serial %s expected to fail but it did not", serial)
+		}
+	}
+	invalid("5D2A1C3B")
+	invalid("5D2A-1C3")
+	invalid("5D2A-1C3X")
+	invalid("2C6E1D5A7F3B9E4")
+	invalid("2C6E-1D5A7F3B9E41")
+}
+
+func TestParseTimeout(t *testing.T) {
+	check := func(param string, expected time.Duration) {
+		d, err := parseTimeout(param)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if d != expected {
+			t.Fatalf("%s: expected %v, got %v", param, expected, d)
+		}
+	}
+
+	check("0", 0)
+	check("3", 3*time.Second)
+	check("500ms", 500*time.Millisecond)
+	check("1m30s", 90*time.Second)
+
+	for _, param := range []string{"", "-1s", "forever", "3 s"} {
+		if _, err := parseTimeout(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+func TestParseDeviceTimeouts(t *testing.T) {
+	timeouts, err := parseDeviceTimeouts("5,500ms,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Duration{5 * time.Second, 500 * time.Millisecond, 0}
+	if !reflect.DeepEqual(timeouts, expected) {
+		t.Fatalf("expected %v, got %v", expected, timeouts)
+	}
+
+	for _, param := range []string{"", "5,", "5,forever"} {
+		if _, err := parseDeviceTimeouts(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
 func TestFormatUUID(t *testing.T) {
 	// uuid v4
 	str := "1705d91e-bf54-4a1a-878d-721d7233eba4"
@@ -104,6 +178,10 @@ func TestStripQuotes(t *testing.T) {
 	check("Hello\"", "Hello\"")
 	check("\"Hello\"", "Hello")
 	check("\"\"He   llo\"", "\"He   llo")
+	check("'Hello'", "Hello")
+	check("'Hello\"", "'Hello\"")
+	check("\"", "\"")
+	check("", "")
 }
 
 func TestDeviceNo(t *testing.T) {
@@ -129,3 +207,43 @@ func TestDeviceNo(t *testing.T) {
 		}
 	}
 }
+
+func TestFnmatch(t *testing.T) {
+	t.Parallel()
+
+	check := func(pattern, name string, expected bool) {
+		if match := fnmatch(pattern, name); match != expected {
+			t.Fatalf("fnmatch(%q, %q): expected %v, got %v", pattern, name, expected, match)
+		}
+	}
+
+	check("", "", true)
+	check("", "a", false)
+	check("abc", "abc", true)
+	check("abc", "abd", false)
+	check("*", "", true)
+	check("*", "a/b/c", true)
+	check("a*", "a", true)
+	check("a*c", "abbbc", true)
+	check("a*c", "abbbcd", false)
+	check("a*b*c", "a/xb/yc", true)
+	check("*b", "abab", true)
+	check("a?c", "abc", true)
+	check("a?c", "ac", false)
+	check("a?c", "a/c", true)
+	check("[abc]", "b", true)
+	check("[abc]", "d", false)
+	check("[a-c]x", "bx", true)
+	check("[!a-c]", "d", true)
+	check("[!a-c]", "b", false)
+	check("[^0]", "1", true)
+	check("[]a]", "]", true)
+	check("[a-]", "-", true)
+	check("[\\]]", "]", true)
+	check("a[", "a[", true)
+	check("a[b", "ab", false)
+	check("a\\*", "a*", true)
+	check("a\\*", "ab", false)
+	check("a\\", "a\\", true)
+	check("dmi:*:pn*ThinkPad*:*", "dmi:bvnLENOVO:pnThinkPad/T460s:pvr:", true)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// validateCmdline is a dry-run mode of the init binary used by 'booster validate-cmdline'. It parses device references
+// of the given kernel command line and prints how they are interpreted. No devices are accessed.
+// It returns the process exit code.
+func validateCmdline(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("validate-cmdline", flag.ContinueOnError)
+	flags.SetOutput(out)
+	autodetect := flags.Bool("autodetect", true, "Autodiscover the root partition if root= is not specified")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cmdline = make(map[string]string)
+	moduleParams = make(map[string][]string)
+	cmdlineValues = make(map[string][]string)
+	parseCmdlineParams(strings.Join(flags.Args(), " "))
+
+	roots, err := parseDeviceRefs("root", cmdline["root"], *autodetect)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	for _, r := range roots {
+		describeDeviceRef(out, "root", r)
+	}
+	for _, name := range []string{"mount.usr", "resume", "systemd.verity_root_data", "systemd.verity_root_hash"} {
+		param, ok := cmdline[name]
+		if !ok {
+			continue
+		}
+		ref, err := parseDeviceRef(name, param, false)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		describeDeviceRef(out, name, ref)
+	}
+	if param, ok := cmdline["resume_offset"]; ok {
+		offset, err := parseResumeOffset(param)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		fmt.Fprintf(out, "resume_offset: %d\n", offset)
+		fmt.Fprintf(out, "  the hibernation image is read from the swap file at the offset of the resume device\n")
+	}
+	if param, ok := cmdline["booster.overlay"]; ok {
+		ref, err := parseOverlayRef(param)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		fmt.Fprintf(out, "booster.overlay: %s (format %s, data %s)\n", ref, ref.format, describeRefData(ref.data))
+		fmt.Fprintf(out, "  all matching filesystems are stacked over the root filesystem in the order they are discovered\n")
+	}
+	if param, ok := cmdline["booster.cmdline_file"]; ok {
+		f, err := parseCmdlineFile(param)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		describeDeviceRef(out, "booster.cmdline_file", f.device)
+		fmt.Fprintf(out, "  boot params are read from %s at boot time, the params above do not include them\n", f.path)
+	}
+	for _, name := range []string{"booster.wireguard", "booster.wireguard.key"} {
+		param, ok := cmdline[name]
+		if !ok {
+			continue
+		}
+		ref, path, err := parseDeviceFile(name, param)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		describeDeviceRef(out, name, ref)
+		fmt.Fprintf(out, "  %s is read once the network is configured, the WireGuard tunnel is set up before the network root is mounted\n", path)
+	}
+	return 0
+}
+
+func describeDeviceRef(out io.Writer, name string, ref *deviceRef) {
+	fmt.Fprintf(out, "%s: %s (format %s, data %s)\n", name, ref, ref.format, describeRefData(ref.data))
+	switch {
+	case ref.dependsOnGpt():
+		fmt.Fprintf(out, "  the reference is resolved at boot time using the GPT partition tables of the available disks\n")
+	case ref.isNetwork():
+		fmt.Fprintf(out, "  the device is attached at boot time once the network is configured\n")
+	case ref.isZfs():
+		fmt.Fprintf(out, "  the ZFS pool is imported at boot time and the dataset is mounted directly\n")
+	case ref.isAmbiguous():
+		fmt.Fprintf(out, "  the reference is used only if it matches exactly one device at boot time\n")
+	}
+}
+
+func describeRefData(data interface{}) string {
+	switch d := data.(type) {
+	case UUID:
+		return d.toString()
+	case gptTypeData:
+		types := make([]string, len(d.types))
+		for i, t := range d.types {
+			types[i] = t.toString()
+		}
+		return fmt.Sprintf("{types:[%s] autodetect:%v}", strings.Join(types, " "), d.autodetect)
+	case string:
+		return fmt.Sprintf("%q", d)
+	default:
+		return fmt.Sprintf("%+v", d)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateCmdline(t *testing.T) {
+	saved := cmdline
+	defer func() { cmdline = saved }()
+
+	check := func(args []string, code int, expected ...string) {
+		var out bytes.Buffer
+		if c := validateCmdline(args, &out); c != code {
+			t.Fatalf("%v: expected exit code %d, got %d: %s", args, code, c, out.String())
+		}
+		for _, e := range expected {
+			if !strings.Contains(out.String(), e) {
+				t.Fatalf("%v: expected output to contain '%s', got '%s'", args, e, out.String())
+			}
+		}
+	}
+
+	check([]string{"root=UUID=1705d91e-bf54-4a1a-878d-721d7233eba4 rw"}, 0, "format refFsUuid, data 1705d91e-bf54-4a1a-878d-721d7233eba4")
+	check([]string{"root=/dev/sda1", "resume=LABEL=swap"}, 0, `root: /dev/sda1 (format refPath, data "/dev/sda1")`, `resume: LABEL=swap (format refFsLabel, data "swap")`)
+	check([]string{"root=PARTLABEL=root"}, 0, "format refGptLabel", "resolved at boot time")
+	check([]string{"root=LABEL=root", "resume=LABEL=root", "resume_offset=34816"}, 0, `resume: LABEL=root (format refFsLabel, data "root")`, "resume_offset: 34816")
+	check([]string{"root=LABEL=root", "resume=LABEL=root", "resume_offset=-1"}, 1, "resume_offset: invalid offset -1")
+	check([]string{"root=nbd:server:rootfs"}, 0, "format refNbd", "once the network is configured")
+	check([]string{"-autodetect=false", "quiet"}, 1, "boot option is not specified")
+	check([]string{"root=UUID=foo"}, 1)
+	check([]string{"root=/dev/sda1", "mount.usr=HELLO=1"}, 1)
+	check([]string{"-unknown-flag"}, 2)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+)
+
+var rootVerifyEnabled bool // set with booster.verify_root boot param
+
+func parseVerifyRootParam() {
+	_, rootVerifyEnabled = cmdline["booster.verify_root"]
+}
+
+// verifyRootDevice re-reads the superblock of the resolved root device and checks that the filesystem still matches
+// the root reference. It catches e.g. an LVM or RAID assembly that produced a device with a different filesystem
+// than the one the root reference asked for.
+func verifyRootDevice(ref *deviceRef, info *blkInfo) error {
+	if !rootVerifyEnabled {
+		return nil
+	}
+	actual, err := readBlkInfo(info.path)
+	if err != nil {
+		return fmt.Errorf("verify root %s: unable to read the superblock of %s: %v", ref, info.path, err)
+	}
+	inform("verify root: expected filesystem %s, %s has %s filesystem UUID=%s LABEL=%s", ref, info.path, actual.format, actual.uuid.toString(), actual.label)
+	if err := verifyRootSuperblock(ref, actual); err != nil {
+		return fmt.Errorf("verify root %s: %s: %v", ref, info.path, err)
+	}
+	return nil
+}
+
+// verifyRootSuperblock checks that the filesystem read from the root device matches the filesystem UUID or label
+// of the root reference. References without a filesystem identity (e.g. device paths) cannot be verified.
+func verifyRootSuperblock(ref *deviceRef, actual *blkInfo) error {
+	switch ref.format {
+	case refFsUuid, refFsUuidPrefix, refFsLabel:
+	default:
+		return fmt.Errorf("the reference does not specify a filesystem UUID= or LABEL= to verify the device against")
+	}
+	if !ref.matchesBlkInfo(actual) {
+		return fmt.Errorf("expected filesystem %s, got UUID=%s LABEL=%s", ref, actual.uuid.toString(), actual.label)
+	}
+	return nil
+}
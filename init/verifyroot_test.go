@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVerifyRootSuperblock(t *testing.T) {
+	rootUuid, err := parseUUID("ac8299a8-91ce-4bf6-a524-55a62844b787")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUuid, err := parseUUID("1705d91e-bf54-4a1a-878d-721d7233eba4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuidRef := &deviceRef{format: refFsUuid, data: rootUuid}
+	prefixRef := &deviceRef{format: refFsUuidPrefix, data: "ac8299a8"}
+	labelRef := &deviceRef{format: refFsLabel, data: "root"}
+	pathRef := &deviceRef{format: refPath, data: "/dev/mapper/vg-root"}
+	info := &blkInfo{path: "/dev/mapper/vg-root", format: "ext4", isFs: true, uuid: rootUuid, label: "root"}
+
+	check := func(ref *deviceRef, actual *blkInfo, ok bool) {
+		err := verifyRootSuperblock(ref, actual)
+		if ok && err != nil {
+			t.Fatalf("%s: unexpected error %v", ref, err)
+		}
+		if !ok && err == nil {
+			t.Fatalf("%s: expected not to match %+v", ref, actual)
+		}
+	}
+	check(uuidRef, info, true)
+	check(prefixRef, info, true)
+	check(labelRef, info, true)
+	// the assembly produced a device with another filesystem
+	other := &blkInfo{path: "/dev/md0", format: "ext4", isFs: true, uuid: otherUuid, label: "home"}
+	check(uuidRef, other, false)
+	check(prefixRef, other, false)
+	check(labelRef, other, false)
+	// a path reference does not specify the filesystem to compare with
+	check(pathRef, info, false)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/anatol/devmapper.go"
+)
+
+// verityRootName is the name of the dm-verity device with the root filesystem, it appears as /dev/mapper/root
+const verityRootName = "root"
+
+// exitCodeVeritySignature is the exit code of init if the root hash signature check fails. The exit of the PID 1 makes
+// the kernel panic with this code. No emergency shell is started as the boot params are not trusted at this point.
+const exitCodeVeritySignature = 0x76
+
+var (
+	verityRootHash               []byte     // specified with roothash= boot param
+	cmdVerityData, cmdVerityHash *deviceRef // data and hash devices of the verity root, specified with systemd.verity_root_data and systemd.verity_root_hash boot params
+	verityDataInfo               *blkInfo
+	verityHashInfo               *blkInfo
+	verityActivated              bool // the dm-verity root device is created
+	verityMutex                  sync.Mutex
+)
+
+// verityPublicKey is embedded to the image at generation time, the root hash must be signed with its private key if set
+var verityPublicKey crypto.PublicKey
+
+// verityDigestSizes are the digest sizes of the supported dm-verity hash algorithms
+var verityDigestSizes = map[string]int{
+	"sha1":   20,
+	"sha256": sha256.Size,
+	"sha512": sha512.Size,
+}
+
+// parseVerityParams parses roothash= boot param together with the data and hash device references.
+// It is done in the systemd-veritysetup-generator compatible way.
+func parseVerityParams() error {
+	if err := readVerityPublicKey(); err != nil {
+		return err
+	}
+	param, ok := cmdline["roothash"]
+	if !ok {
+		if verityPublicKey != nil {
+			return fmt.Errorf("roothash: the image boots only a dm-verity root signed with the embedded key but roothash boot param is not specified")
+		}
+		return nil
+	}
+	hash, err := hex.DecodeString(param)
+	if err != nil || len(hash) == 0 {
+		return fmt.Errorf("roothash: invalid hash %s", param)
+	}
+	verityRootHash = hash
+
+	if cmdVerityData, err = parseDeviceRef("systemd.verity_root_data", cmdline["systemd.verity_root_data"], false); err != nil {
+		return err
+	}
+	if cmdVerityHash, err = parseDeviceRef("systemd.verity_root_hash", cmdline["systemd.verity_root_hash"], false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// handleVerityBlockDevice records the data or hash device of the verity root. Once both of them are discovered
+// the root hash is verified and the dm-verity device is created. The root must not be booted from the unverified
+// data device thus any failure aborts the boot.
+func handleVerityBlockDevice(info *blkInfo, isData bool) {
+	verityMutex.Lock()
+	if isData {
+		verityDataInfo = info
+	} else {
+		verityHashInfo = info
+	}
+	data, hash := verityDataInfo, verityHashInfo
+	verityMutex.Unlock()
+
+	if data == nil || hash == nil {
+		return
+	}
+	if verityPublicKey != nil {
+		if err := checkRootHashSignature(hash, verityRootHash); err != nil {
+			severe("dm-verity: %v, refusing to boot the root filesystem", err)
+			quitPlymouth()
+			os.Exit(exitCodeVeritySignature)
+		}
+		inform("dm-verity: root hash signature is valid")
+	}
+	if err := setupVerity(data, hash, verityRootHash); err != nil {
+		deviceRefsMutex.Lock()
+		rootMountStarted = true // prevent mounting any of the fallback root devices
+		deviceRefsMutex.Unlock()
+		abortBoot(fmt.Errorf("dm-verity: %v, refusing to boot unverified root filesystem", err))
+	}
+}
+
+func setupVerity(data, hash *blkInfo, rootHash []byte) error {
+	table, err := verityTable(data, hash, rootHash)
+	if err != nil {
+		return err
+	}
+
+	if hasModule("dm_verity") {
+		loadModules("dm_verity").Wait()
+	} else {
+		debug("dm_verity module is not in the image, assuming it is built into the kernel")
+	}
+	// the kernel cannot request the hash implementation module itself as there is no modprobe in the image
+	_ = loadModalias("crypto-" + table.Algorithm)
+
+	uuid := "CRYPT-VERITY-" + strings.ReplaceAll(hash.uuid.toString(), "-", "") + "-" + verityRootName
+	inform("activating dm-verity device %s with data %s and hash %s", verityRootName, data.path, hash.path)
+	if err := devmapper.CreateAndLoad(verityRootName, uuid, devmapper.ReadOnlyFlag, table); err != nil {
+		return fmt.Errorf("unable to activate %s, make sure the dm_verity kernel module is available: %v", verityRootName, err)
+	}
+	verityMutex.Lock()
+	verityActivated = true
+	verityMutex.Unlock()
+	return nil
+}
+
+// checkVerityRootParam makes sure the root= boot param does not point the boot away from the dm-verity device
+// if the image has the embedded public key. Otherwise a validly signed root hash could be combined with any
+// unverified root device.
+func checkVerityRootParam(param string) error {
+	if verityPublicKey == nil || param == "/dev/mapper/"+verityRootName {
+		return nil
+	}
+	return fmt.Errorf("root: the image boots only the dm-verity root /dev/mapper/%s signed with the embedded key, root=%s is not allowed", verityRootName, param)
+}
+
+// checkVerifiedRoot refuses to mount the root filesystem from any device other than the dm-verity one created
+// by booster if the image has the embedded public key
+func checkVerifiedRoot(path string) error {
+	if verityPublicKey == nil {
+		return nil
+	}
+	verityMutex.Lock()
+	activated := verityActivated
+	verityMutex.Unlock()
+	if !activated || path != "/dev/mapper/"+verityRootName {
+		return fmt.Errorf("dm-verity: %s is not the verified root device, refusing to boot it", path)
+	}
+	return nil
+}
+
+// verityTable builds the device mapper table for the verity root from the hash device superblock
+func verityTable(data, hash *blkInfo, rootHash []byte) (devmapper.VerityTable, error) {
+	if hash.format != "verity" {
+		return devmapper.VerityTable{}, fmt.Errorf("hash device %s does not have a verity superblock", hash.path)
+	}
+	sb := hash.data.(verityData)
+	size, ok := verityDigestSizes[sb.algorithm]
+	if !ok {
+		return devmapper.VerityTable{}, fmt.Errorf("unsupported hash algorithm %s", sb.algorithm)
+	}
+	if len(rootHash) != size {
+		return devmapper.VerityTable{}, fmt.Errorf("root hash is %d bytes long but %s digest is %d bytes", len(rootHash), sb.algorithm, size)
+	}
+	if sb.dataBlockSize == 0 || sb.hashBlockSize == 0 || sb.dataBlockSize%512 != 0 {
+		return devmapper.VerityTable{}, fmt.Errorf("invalid block size at the hash device %s", hash.path)
+	}
+
+	return devmapper.VerityTable{
+		Start:         0,
+		Length:        sb.dataBlocks * uint64(sb.dataBlockSize) / 512,
+		HashType:      uint64(sb.hashType),
+		DataDevice:    data.path,
+		HashDevice:    hash.path,
+		DataBlockSize: uint64(sb.dataBlockSize),
+		HashBlockSize: uint64(sb.hashBlockSize),
+		NumDataBlocks: sb.dataBlocks,
+		// the superblock occupies the first hash block
+		HashStartBlock: 1,
+		Algorithm:      sb.algorithm,
+		Digest:         rootHash,
+		Salt:           sb.salt,
+	}, nil
+}
+
+func readVerityPublicKey() error {
+	data, err := os.ReadFile(verityPublicKeyPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	key, err := parseVerityPublicKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", verityPublicKeyPath, err)
+	}
+	verityPublicKey = key
+	return nil
+}
+
+// checkRootHashSignature verifies the root hash against the signature stored at the hash device
+func checkRootHashSignature(hash *blkInfo, rootHash []byte) error {
+	if hash.format != "verity" {
+		return fmt.Errorf("hash device %s does not have a verity superblock", hash.path)
+	}
+	blockSize := int(hash.data.(verityData).hashBlockSize)
+	if blockSize < veritySignatureOffset+veritySignatureHeaderSize {
+		return fmt.Errorf("hash device %s does not have space for the root hash signature", hash.path)
+	}
+
+	f, err := os.Open(hash.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	record := make([]byte, blockSize-veritySignatureOffset)
+	if _, err := f.ReadAt(record, veritySignatureOffset); err != nil {
+		return fmt.Errorf("%s: %v", hash.path, err)
+	}
+	sig, err := decodeVeritySignature(record)
+	if err != nil {
+		return err
+	}
+	return verifyRootHashSignature(verityPublicKey, rootHash, sig)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestVerityTable(t *testing.T) {
+	data := &blkInfo{path: "/dev/sda2", format: "ext4", isFs: true}
+	hash := &blkInfo{path: "/dev/sda3", format: "verity", data: verityData{hashType: 1, algorithm: "sha256", dataBlockSize: 4096, hashBlockSize: 4096, dataBlocks: 25600, salt: []byte{1, 2, 3, 4}}}
+	rootHash := bytes.Repeat([]byte{0xab}, 32)
+
+	table, err := verityTable(data, hash, rootHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.DataDevice != "/dev/sda2" || table.HashDevice != "/dev/sda3" {
+		t.Fatalf("unexpected devices %s and %s", table.DataDevice, table.HashDevice)
+	}
+	if table.Length != 25600*8 || table.NumDataBlocks != 25600 || table.HashStartBlock != 1 {
+		t.Fatalf("unexpected table geometry %+v", table)
+	}
+	if table.Algorithm != "sha256" || !bytes.Equal(table.Digest, rootHash) || !bytes.Equal(table.Salt, []byte{1, 2, 3, 4}) {
+		t.Fatalf("unexpected table hash parameters %+v", table)
+	}
+
+	if _, err := verityTable(data, hash, rootHash[:20]); err == nil {
+		t.Fatal("expected root hash of a wrong size to fail")
+	}
+	if _, err := verityTable(data, data, rootHash); err == nil {
+		t.Fatal("expected hash device without superblock to fail")
+	}
+}
+
+func TestParseVerityParams(t *testing.T) {
+	defer func() {
+		cmdline = make(map[string]string)
+		verityRootHash, cmdVerityData, cmdVerityHash = nil, nil, nil
+	}()
+
+	cmdline = map[string]string{
+		"roothash":                 "abab",
+		"systemd.verity_root_data": "PARTUUID=1705d91e-bf54-4a1a-878d-721d7233eba4",
+		"systemd.verity_root_hash": "PARTLABEL=hash",
+	}
+	if err := parseVerityParams(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(verityRootHash, []byte{0xab, 0xab}) {
+		t.Fatalf("unexpected root hash %x", verityRootHash)
+	}
+	if cmdVerityData.format != refGptUuid || cmdVerityHash.format != refGptLabel {
+		t.Fatalf("unexpected verity references %s and %s", cmdVerityData, cmdVerityHash)
+	}
+
+	cmdline["roothash"] = "xyz"
+	if err := parseVerityParams(); err == nil {
+		t.Fatal("expected invalid root hash to fail")
+	}
+	cmdline["roothash"] = "abab"
+	delete(cmdline, "systemd.verity_root_hash")
+	if err := parseVerityParams(); err == nil {
+		t.Fatal("expected missing hash device to fail")
+	}
+}
+
+func TestVerityRootRestriction(t *testing.T) {
+	if err := checkVerityRootParam("/dev/sda2"); err != nil {
+		t.Fatalf("root= is expected to be accepted without the embedded key: %v", err)
+	}
+	if err := checkVerifiedRoot("/dev/sda2"); err != nil {
+		t.Fatalf("any root is expected to be accepted without the embedded key: %v", err)
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := verityPublicKey
+	verityPublicKey = pub
+	defer func() {
+		verityPublicKey = oldKey
+		verityActivated = false
+	}()
+
+	for _, root := range []string{"/dev/sda2", "UUID=1705d91e-bf54-4a1a-878d-721d7233eba4", "/dev/mapper/root,/dev/sda2"} {
+		if err := checkVerityRootParam(root); err == nil {
+			t.Fatalf("root=%s is expected to be rejected with the embedded key", root)
+		}
+	}
+	if err := checkVerityRootParam("/dev/mapper/root"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the device is named as the verity one but it is not created by booster
+	if err := checkVerifiedRoot("/dev/mapper/root"); err == nil {
+		t.Fatal("the root is expected to be rejected until the dm-verity device is created")
+	}
+	verityActivated = true
+	if err := checkVerifiedRoot("/dev/mapper/root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkVerifiedRoot("/dev/sda2"); err == nil {
+		t.Fatal("an unverified root is expected to be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// The root hash signature is stored at the first block of the verity hash device right after the superblock. The block
+// is reserved for the superblock (the hash tree starts at the second block) and veritysetup leaves the rest of it empty.
+const (
+	veritySignatureOffset = 512 // size of struct verity_sb
+	veritySignatureMagic  = "booster-roothash-sig\x00\x00\x00\x00"
+	// magic, uint16 little-endian signature length, signature
+	veritySignatureHeaderSize = len(veritySignatureMagic) + 2
+)
+
+var errVeritySignature = errors.New("root hash signature does not match")
+
+// parseVerityPublicKey parses a PEM encoded PKIX public key, Ed25519, ECDSA and RSA keys are supported
+func parseVerityPublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("PEM encoded public key is expected")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// verityRootHashMessage is the signed message, the root hash in the same hex form as at the roothash= boot param
+func verityRootHashMessage(rootHash []byte) []byte {
+	return []byte(hex.EncodeToString(rootHash))
+}
+
+// encodeVeritySignature serializes the signature record stored at veritySignatureOffset of the hash device
+func encodeVeritySignature(sig []byte) []byte {
+	record := make([]byte, veritySignatureHeaderSize, veritySignatureHeaderSize+len(sig))
+	copy(record, veritySignatureMagic)
+	binary.LittleEndian.PutUint16(record[len(veritySignatureMagic):], uint16(len(sig)))
+	return append(record, sig...)
+}
+
+// decodeVeritySignature returns the signature from the record
+func decodeVeritySignature(record []byte) ([]byte, error) {
+	if len(record) < veritySignatureHeaderSize || string(record[:len(veritySignatureMagic)]) != veritySignatureMagic {
+		return nil, fmt.Errorf("hash device does not contain a root hash signature")
+	}
+	size := int(binary.LittleEndian.Uint16(record[len(veritySignatureMagic):]))
+	if size == 0 || len(record) < veritySignatureHeaderSize+size {
+		return nil, fmt.Errorf("root hash signature is truncated")
+	}
+	return record[veritySignatureHeaderSize : veritySignatureHeaderSize+size], nil
+}
+
+// verifyRootHashSignature checks the signature of the root hash. The ECDSA and RSA (PKCS #1 v1.5) signatures are
+// made over the SHA-256 digest of the message, Ed25519 signs the message itself.
+func verifyRootHashSignature(key crypto.PublicKey, rootHash, sig []byte) error {
+	msg := verityRootHashMessage(rootHash)
+	digest := sha256.Sum256(msg)
+	var ok bool
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, msg, sig)
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, digest[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	if !ok {
+		return errVeritySignature
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"testing"
+)
+
+func TestCheckRootHashSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := verityPublicKey
+	verityPublicKey = pub
+	defer func() { verityPublicKey = oldKey }()
+
+	rootHash := []byte{0x6a, 0x1e, 0x7c, 0x3b}
+	device := t.TempDir() + "/hash"
+	block := make([]byte, 4096)
+	copy(block[veritySignatureOffset:], encodeVeritySignature(ed25519.Sign(priv, []byte("6a1e7c3b"))))
+	if err := os.WriteFile(device, block, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := &blkInfo{path: device, format: "verity", data: verityData{hashBlockSize: 4096}}
+
+	if err := checkRootHashSignature(hash, rootHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRootHashSignature(hash, []byte{0x6a, 0x1e, 0x7c, 0x3c}); err != errVeritySignature {
+		t.Fatalf("expected signature mismatch, got %v", err)
+	}
+	if err := os.WriteFile(device, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRootHashSignature(hash, rootHash); err == nil {
+		t.Fatal("a hash device without signature is expected to fail the check")
+	}
+}
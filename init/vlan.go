@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// vlanConfig is a VLAN interface specified with vlan= boot param
+type vlanConfig struct {
+	name   string // interface name as used by ip= boot param, e.g. eth0.100
+	parent string
+	id     int
+}
+
+var vlanConfigs []*vlanConfig // specified with vlan= boot params
+
+// parseVlanParam parses vlan=<vlanname>:<phys> boot param in the dracut format, e.g. vlan=eth0.100:eth0.
+// The VLAN id is taken from the interface name that is either <phys>.<id> or vlan<id>, leading zeros are allowed.
+func parseVlanParam(param string) (*vlanConfig, error) {
+	fields := strings.Split(param, ":")
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return nil, fmt.Errorf("expected format is vlan=<vlanname>:<phys>")
+	}
+	name, parent := fields[0], fields[1]
+	if len(name) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name %s is longer than %d characters", name, unix.IFNAMSIZ-1)
+	}
+	if name == parent {
+		return nil, fmt.Errorf("VLAN interface %s cannot be its own parent", name)
+	}
+
+	var id string
+	if idx := strings.LastIndexByte(name, '.'); idx != -1 {
+		id = name[idx+1:]
+	} else if strings.HasPrefix(name, "vlan") {
+		id = strings.TrimPrefix(name, "vlan")
+	} else {
+		return nil, fmt.Errorf("unable to get VLAN id from interface name %s, expected <phys>.<id> or vlan<id>", name)
+	}
+	if !isDigits(id) {
+		return nil, fmt.Errorf("invalid VLAN id %s", id)
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 1 || n > 4094 {
+		return nil, fmt.Errorf("VLAN id %s is out of range 1-4094", id)
+	}
+	return &vlanConfig{name: name, parent: parent, id: n}, nil
+}
+
+// vlansOf returns the VLAN interfaces to create on top of the parent interface
+func vlansOf(parent string) []*vlanConfig {
+	var result []*vlanConfig
+	for _, v := range vlanConfigs {
+		if v.parent == parent {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// newVlanLink returns the netlink request that creates the VLAN interface
+func newVlanLink(v *vlanConfig, parentIndex int) *netlink.Vlan {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = v.name
+	attrs.ParentIndex = parentIndex
+	return &netlink.Vlan{LinkAttrs: attrs, VlanId: v.id}
+}
+
+// createVlans brings the parent interface up and creates the VLAN interfaces on top of it. The VLAN interfaces
+// are configured once they appear, the same way as the physical ones.
+func createVlans(parent string, vlans []*vlanConfig) error {
+	if hasModule("8021q") {
+		loadModules("8021q").Wait()
+	}
+
+	link, err := netlink.LinkByName(parent)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+	initializedIfnames = append(initializedIfnames, parent)
+
+	for _, v := range vlans {
+		debug("creating VLAN interface %s with id %d on %s", v.name, v.id, parent)
+		if err := netlink.LinkAdd(newVlanLink(v, link.Attrs().Index)); err != nil {
+			return fmt.Errorf("unable to create VLAN interface %s: %v, the image might need the '8021q' module, add it with 'modules: 8021q' in booster.yaml", v.name, err)
+		}
+	}
+	return nil
+}
+
+// startVlans creates the VLAN interfaces of the parent in the background. It returns true if the parent itself
+// does not need to be configured, i.e. it is not specified with ip= boot param.
+func startVlans(parent string) bool {
+	vlans := vlansOf(parent)
+	if len(vlans) == 0 {
+		return false
+	}
+	go func() {
+		if err := createVlans(parent, vlans); err != nil {
+			warning("%v", err)
+		}
+	}()
+	return len(ipConfigsFor(parent)) == 0
+}
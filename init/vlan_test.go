@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseVlanParam(t *testing.T) {
+	check := func(param, name, parent string, id int) {
+		v, err := parseVlanParam(param)
+		if err != nil {
+			t.Fatalf("%s: %v", param, err)
+		}
+		if v.name != name || v.parent != parent || v.id != id {
+			t.Fatalf("%s: expected VLAN %s with id %d on %s, got %s with id %d on %s", param, name, id, parent, v.name, v.id, v.parent)
+		}
+	}
+
+	check("eth0.100:eth0", "eth0.100", "eth0", 100)
+	check("vlan0005:enp1s0", "vlan0005", "enp1s0", 5)
+	check("bond0.4094:bond0", "bond0.4094", "bond0", 4094)
+
+	for _, param := range []string{"eth0.100", "eth0.100:", "eth0:eth0", "eth0.0:eth0", "eth0.4095:eth0", "eth0.1a:eth0", "mgmt:eth0", "enp0s20f0u1u2.100:enp0s20f0u1u2"} {
+		if _, err := parseVlanParam(param); err == nil {
+			t.Fatalf("%s: expected to fail but it did not", param)
+		}
+	}
+}
+
+func TestNewVlanLink(t *testing.T) {
+	v, err := parseVlanParam("eth0.100:eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := newVlanLink(v, 7)
+	if link.Type() != "vlan" {
+		t.Fatalf("expected vlan link, got %s", link.Type())
+	}
+	if link.VlanId != 100 || link.Attrs().ParentIndex != 7 || link.Attrs().Name != "eth0.100" {
+		t.Fatalf("unexpected VLAN link request: name %s, id %d, parent index %d", link.Attrs().Name, link.VlanId, link.Attrs().ParentIndex)
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	wireguardIfname = "wg0"
+	// wireguardDefaultMtu is the MTU wg-quick uses for the usual 1500 bytes physical links
+	wireguardDefaultMtu = 1420
+	// wireguardFileTimeout is the time to wait for the device with the tunnel config or the private key
+	wireguardFileTimeout  = 10 * time.Second
+	wireguardFileMountDir = "/run/booster/wireguard"
+)
+
+// WireGuard generic netlink API, see include/uapi/linux/wireguard.h
+const (
+	wgGenlVersion  = 1
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfindex      = 1
+	wgDeviceAPrivateKey   = 3
+	wgDeviceAFlags        = 5
+	wgDeviceAListenPort   = 6
+	wgDeviceAPeers        = 8
+	wgDeviceFReplacePeers = 1
+
+	wgPeerAPublicKey                   = 1
+	wgPeerAPresharedKey                = 2
+	wgPeerAFlags                       = 3
+	wgPeerAEndpoint                    = 4
+	wgPeerAPersistentKeepaliveInterval = 5
+	wgPeerAAllowedips                  = 9
+	wgPeerFReplaceAllowedips           = 2
+
+	wgAllowedipAFamily   = 1
+	wgAllowedipAIpaddr   = 2
+	wgAllowedipACidrMask = 3
+)
+
+// wireguardConfig is a WireGuard tunnel configuration in the wg-quick(8) format
+type wireguardConfig struct {
+	privateKey []byte
+	listenPort int
+	addresses  []*net.IPNet
+	dns        []net.IP
+	mtu        int
+	peers      []*wireguardPeer
+}
+
+type wireguardPeer struct {
+	publicKey    []byte
+	presharedKey []byte
+	endpoint     string // host:port, the host is resolved once the physical network is configured
+	allowedIps   []*net.IPNet
+	keepalive    int // persistent keepalive interval in seconds
+}
+
+// wireguardFile is a file at a local filesystem, specified with booster.wireguard=$DEVICE:$PATH or
+// booster.wireguard.key=$DEVICE:$PATH boot params
+type wireguardFile struct {
+	device *deviceRef
+	path   string
+}
+
+func (f *wireguardFile) String() string {
+	return f.device.String() + ":" + f.path
+}
+
+var (
+	cmdWireguardConfig *wireguardFile // specified with booster.wireguard boot param
+	cmdWireguardKey    *wireguardFile // specified with booster.wireguard.key boot param
+	wireguardEnabled   bool           // either the image has an embedded tunnel config or it is specified at the cmdline
+
+	wireguardOnce sync.Once
+	wireguardErr  error
+)
+
+// parseWireguardParams parses booster.wireguard= and booster.wireguard.key= boot params
+func parseWireguardParams() error {
+	cmdWireguardConfig, cmdWireguardKey = nil, nil
+	if param, ok := cmdline["booster.wireguard"]; ok {
+		ref, path, err := parseDeviceFile("booster.wireguard", param)
+		if err != nil {
+			return err
+		}
+		cmdWireguardConfig = &wireguardFile{device: ref, path: path}
+	}
+	if param, ok := cmdline["booster.wireguard.key"]; ok {
+		ref, path, err := parseDeviceFile("booster.wireguard.key", param)
+		if err != nil {
+			return err
+		}
+		cmdWireguardKey = &wireguardFile{device: ref, path: path}
+	}
+
+	_, err := os.Stat(wireguardConfigPath)
+	wireguardEnabled = cmdWireguardConfig != nil || err == nil
+	if cmdWireguardKey != nil && !wireguardEnabled {
+		return fmt.Errorf("booster.wireguard.key: the tunnel config is not specified, add 'network.wireguard' to booster.yaml or use booster.wireguard boot param")
+	}
+	if wireguardEnabled && config.Network == nil {
+		warning("WireGuard tunnel is ignored as the image is built without network support, add 'network' to booster.yaml")
+	}
+	return nil
+}
+
+// parseWireguardConfig parses the tunnel config in the wg-quick(8) format. Errors do not include the line content
+// as the line might contain a key.
+func parseWireguardConfig(content []byte) (*wireguardConfig, error) {
+	c := &wireguardConfig{}
+	var peer *wireguardPeer
+	section := ""
+
+	for i, line := range strings.Split(string(content), "\n") {
+		if idx := strings.IndexByte(line, '#'); idx != -1 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line[1 : len(line)-1])
+			switch section {
+			case "interface":
+			case "peer":
+				peer = &wireguardPeer{}
+				c.peers = append(c.peers, peer)
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %s", i+1, line)
+			}
+			continue
+		}
+
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 {
+			return nil, fmt.Errorf("line %d: expected <key> = <value>", i+1)
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+
+		var err error
+		switch section {
+		case "interface":
+			err = c.parseInterfaceOption(strings.ToLower(key), value)
+		case "peer":
+			err = peer.parseOption(strings.ToLower(key), value)
+		default:
+			err = fmt.Errorf("option %s is outside of [Interface] and [Peer] sections", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+
+	if len(c.peers) == 0 {
+		return nil, fmt.Errorf("no [Peer] sections found")
+	}
+	for i, p := range c.peers {
+		if p.publicKey == nil {
+			return nil, fmt.Errorf("peer #%d: PublicKey is not specified", i+1)
+		}
+	}
+	return c, nil
+}
+
+func (c *wireguardConfig) parseInterfaceOption(key, value string) error {
+	var err error
+	switch key {
+	case "privatekey":
+		c.privateKey, err = parseWireguardKey(value)
+		if err != nil {
+			return fmt.Errorf("PrivateKey: %v", err)
+		}
+	case "listenport":
+		c.listenPort, err = strconv.Atoi(value)
+		if err != nil || c.listenPort < 1 || c.listenPort > 65535 {
+			return fmt.Errorf("invalid ListenPort %s", value)
+		}
+	case "address":
+		for _, a := range splitList(value) {
+			addr, err := parseWireguardAddress(a)
+			if err != nil {
+				return err
+			}
+			c.addresses = append(c.addresses, addr)
+		}
+	case "dns":
+		for _, s := range splitList(value) {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				// wg-quick allows search domains here, booster uses only the servers
+				debug("wireguard: DNS search domain %s is ignored", s)
+				continue
+			}
+			c.dns = append(c.dns, ip)
+		}
+	case "mtu":
+		c.mtu, err = parseMtu(value)
+		if err != nil {
+			return err
+		}
+	default:
+		// wg-quick specific options like PostUp or Table make no sense at the initramfs
+		debug("wireguard: option %s is not supported, ignoring it", key)
+	}
+	return nil
+}
+
+func (p *wireguardPeer) parseOption(key, value string) error {
+	var err error
+	switch key {
+	case "publickey":
+		p.publicKey, err = parseWireguardKey(value)
+		if err != nil {
+			return fmt.Errorf("PublicKey: %v", err)
+		}
+	case "presharedkey":
+		p.presharedKey, err = parseWireguardKey(value)
+		if err != nil {
+			return fmt.Errorf("PresharedKey: %v", err)
+		}
+	case "endpoint":
+		_, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return fmt.Errorf("invalid Endpoint %s: %v", value, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid Endpoint port %s", port)
+		}
+		p.endpoint = value
+	case "allowedips":
+		for _, a := range splitList(value) {
+			_, n, err := net.ParseCIDR(a)
+			if err != nil {
+				return fmt.Errorf("invalid AllowedIPs %s", a)
+			}
+			p.allowedIps = append(p.allowedIps, n)
+		}
+	case "persistentkeepalive":
+		if value == "off" {
+			p.keepalive = 0
+			break
+		}
+		p.keepalive, err = strconv.Atoi(value)
+		if err != nil || p.keepalive < 0 || p.keepalive > 65535 {
+			return fmt.Errorf("invalid PersistentKeepalive %s", value)
+		}
+	default:
+		debug("wireguard: peer option %s is not supported, ignoring it", key)
+	}
+	return nil
+}
+
+// parseWireguardKey decodes a base64 encoded key. The error does not include the key.
+func parseWireguardKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		MemZeroBytes(key)
+		return nil, fmt.Errorf("expected base64 encoded 32 bytes key")
+	}
+	return key, nil
+}
+
+// parseWireguardAddress parses the interface address, an address without prefix is a host address
+func parseWireguardAddress(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid Address %s", value)
+		}
+		return hostIPNet(ip), nil
+	}
+	ip, n, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Address %s", value)
+	}
+	n.IP = ip
+	return n, nil
+}
+
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// splitList splits a comma-separated list and drops the empty elements
+func splitList(value string) []string {
+	var result []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// wireguardRoutes returns the routes for the allowed IPs of the peers. A default route is split into two halves
+// so it takes precedence over the default route of the physical interface without replacing it.
+func wireguardRoutes(c *wireguardConfig) []*net.IPNet {
+	var routes []*net.IPNet
+	for _, p := range c.peers {
+		for _, n := range p.allowedIps {
+			ones, bits := n.Mask.Size()
+			if ones != 0 {
+				routes = append(routes, n)
+				continue
+			}
+			low := &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(1, bits)}
+			high := &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(1, bits)}
+			high.IP[0] = 0x80
+			routes = append(routes, low, high)
+		}
+	}
+	return routes
+}
+
+// wireguardSockaddr serializes the endpoint as struct sockaddr_in or sockaddr_in6
+func wireguardSockaddr(addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		copy(b, nl.Uint16Attr(unix.AF_INET))
+		binary.BigEndian.PutUint16(b[2:], uint16(addr.Port))
+		copy(b[4:], ip4)
+		return b
+	}
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	copy(b, nl.Uint16Attr(unix.AF_INET6))
+	binary.BigEndian.PutUint16(b[2:], uint16(addr.Port))
+	copy(b[8:], addr.IP.To16())
+	return b
+}
+
+// startWireguard brings the tunnel up once the first physical interface is configured. The rest of the interfaces
+// wait for it and get the same result.
+func startWireguard() error {
+	if !wireguardEnabled {
+		return nil
+	}
+	wireguardOnce.Do(func() {
+		if err := setupWireguard(); err != nil {
+			wireguardErr = fmt.Errorf("wireguard: %v", err)
+		}
+	})
+	return wireguardErr
+}
+
+// setupWireguard creates the tunnel interface, configures the peers and routes the allowed IPs through the tunnel
+func setupWireguard() error {
+	c, err := loadWireguardConfig()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		MemZeroBytes(c.privateKey)
+		for _, p := range c.peers {
+			MemZeroBytes(p.presharedKey)
+		}
+	}()
+
+	endpoints := make([]*net.UDPAddr, len(c.peers))
+	for i, p := range c.peers {
+		if p.endpoint == "" {
+			continue
+		}
+		if endpoints[i], err = resolveWireguardEndpoint(p.endpoint); err != nil {
+			return err
+		}
+	}
+
+	if hasModule("wireguard") {
+		loadModules("wireguard").Wait()
+	}
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = wireguardIfname
+	attrs.MTU = c.mtu
+	if attrs.MTU == 0 {
+		attrs.MTU = wireguardDefaultMtu
+	}
+	if err := netlink.LinkAdd(&netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"}); err != nil {
+		return fmt.Errorf("unable to create %s: %v, the image might need the 'wireguard' module, add it with 'modules: wireguard' in booster.yaml", wireguardIfname, err)
+	}
+	link, err := netlink.LinkByName(wireguardIfname)
+	if err != nil {
+		return err
+	}
+	initializedIfnames = append(initializedIfnames, wireguardIfname)
+
+	if err := configureWireguardDevice(link.Attrs().Index, c, endpoints); err != nil {
+		return fmt.Errorf("unable to configure %s: %v", wireguardIfname, err)
+	}
+	for _, a := range c.addresses {
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: a}); err != nil {
+			return fmt.Errorf("unable to add address %s: %v", a, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+
+	routes := wireguardRoutes(c)
+	// the packets to the endpoints have to keep going through the physical interface
+	for _, e := range endpoints {
+		if e != nil && routesContain(routes, e.IP) {
+			if err := pinEndpointRoute(e.IP); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range routes {
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: r}); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("unable to add route %s: %v", r, err)
+		}
+	}
+
+	if len(c.dns) != 0 {
+		if err := addDNSServers(c.dns); err != nil {
+			return err
+		}
+	}
+	inform("wireguard: %s is up with %d peer(s)", wireguardIfname, len(c.peers))
+	return nil
+}
+
+// loadWireguardConfig reads the tunnel config either from the device specified at the cmdline or the one embedded
+// into the image. The private key is replaced with the one specified with booster.wireguard.key boot param.
+func loadWireguardConfig() (*wireguardConfig, error) {
+	var content []byte
+	var err error
+	if cmdWireguardConfig != nil {
+		content, err = readWireguardFile(cmdWireguardConfig)
+	} else {
+		content, err = os.ReadFile(wireguardConfigPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseWireguardConfig(content)
+	MemZeroBytes(content)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmdWireguardKey != nil {
+		content, err := readWireguardFile(cmdWireguardKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseWireguardKey(strings.TrimSpace(string(content)))
+		MemZeroBytes(content)
+		if err != nil {
+			return nil, fmt.Errorf("private key %s: %v", cmdWireguardKey, err)
+		}
+		MemZeroBytes(c.privateKey)
+		c.privateKey = key
+	}
+	if c.privateKey == nil {
+		return nil, fmt.Errorf("the private key is not specified, set PrivateKey in the tunnel config or use booster.wireguard.key boot param")
+	}
+	return c, nil
+}
+
+// readWireguardFile mounts the device read-only and reads the file
+func readWireguardFile(f *wireguardFile) ([]byte, error) {
+	info, err := waitForFileDevice(&f.device, wireguardFileTimeout)
+	if err != nil {
+		return nil, err
+	}
+	content, err := readDeviceFile(info, wireguardFileMountDir, f.path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f, err)
+	}
+	return content, nil
+}
+
+// resolveWireguardEndpoint resolves the endpoint host. The DNS servers might have been configured just now
+// so the lookup is retried for a while.
+func resolveWireguardEndpoint(endpoint string) (*net.UDPAddr, error) {
+	var addr *net.UDPAddr
+	var err error
+	for i := 0; i < 10; i++ {
+		addr, err = net.ResolveUDPAddr("udp", endpoint)
+		if err == nil {
+			return addr, nil
+		}
+		debug("wireguard: %v", err)
+		time.Sleep(time.Second)
+	}
+	return nil, fmt.Errorf("unable to resolve endpoint %s: %v", endpoint, err)
+}
+
+func routesContain(routes []*net.IPNet, ip net.IP) bool {
+	for _, r := range routes {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinEndpointRoute adds a host route to the endpoint through the gateway that is currently used to reach it
+func pinEndpointRoute(ip net.IP) error {
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return fmt.Errorf("unable to find route to endpoint %s: %v", ip, err)
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("no route to endpoint %s", ip)
+	}
+	route := netlink.Route{Dst: hostIPNet(ip), Gw: routes[0].Gw, LinkIndex: routes[0].LinkIndex}
+	if err := netlink.RouteAdd(&route); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("unable to add route to endpoint %s: %v", ip, err)
+	}
+	return nil
+}
+
+// configureWireguardDevice sets the private key and the peers with WG_CMD_SET_DEVICE generic netlink request.
+// The existing peers are replaced.
+func configureWireguardDevice(ifindex int, c *wireguardConfig, endpoints []*net.UDPAddr) error {
+	family, err := netlink.GenlFamilyGet("wireguard")
+	if err != nil {
+		return fmt.Errorf("wireguard generic netlink family: %v", err)
+	}
+
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: wgCmdSetDevice, Version: wgGenlVersion})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfindex, nl.Uint32Attr(uint32(ifindex))))
+	req.AddData(nl.NewRtAttr(wgDeviceAPrivateKey, c.privateKey))
+	req.AddData(nl.NewRtAttr(wgDeviceAFlags, nl.Uint32Attr(wgDeviceFReplacePeers)))
+	if c.listenPort != 0 {
+		req.AddData(nl.NewRtAttr(wgDeviceAListenPort, nl.Uint16Attr(uint16(c.listenPort))))
+	}
+
+	peers := nl.NewRtAttr(wgDeviceAPeers|unix.NLA_F_NESTED, nil)
+	for i, p := range c.peers {
+		peer := peers.AddRtAttr(i|unix.NLA_F_NESTED, nil)
+		peer.AddRtAttr(wgPeerAPublicKey, p.publicKey)
+		peer.AddRtAttr(wgPeerAFlags, nl.Uint32Attr(wgPeerFReplaceAllowedips))
+		if p.presharedKey != nil {
+			peer.AddRtAttr(wgPeerAPresharedKey, p.presharedKey)
+		}
+		if endpoints[i] != nil {
+			peer.AddRtAttr(wgPeerAEndpoint, wireguardSockaddr(endpoints[i]))
+		}
+		if p.keepalive != 0 {
+			peer.AddRtAttr(wgPeerAPersistentKeepaliveInterval, nl.Uint16Attr(uint16(p.keepalive)))
+		}
+		allowedIps := peer.AddRtAttr(wgPeerAAllowedips|unix.NLA_F_NESTED, nil)
+		for j, n := range p.allowedIps {
+			ip := n.IP.To4()
+			family := uint16(unix.AF_INET)
+			if ip == nil {
+				ip = n.IP.To16()
+				family = unix.AF_INET6
+			}
+			ones, _ := n.Mask.Size()
+			allowedIp := allowedIps.AddRtAttr(j|unix.NLA_F_NESTED, nil)
+			allowedIp.AddRtAttr(wgAllowedipAFamily, nl.Uint16Attr(family))
+			allowedIp.AddRtAttr(wgAllowedipAIpaddr, ip)
+			allowedIp.AddRtAttr(wgAllowedipACidrMask, nl.Uint8Attr(uint8(ones)))
+		}
+	}
+	req.AddData(peers)
+
+	_, err = req.Execute(unix.NETLINK_GENERIC, 0)
+	return err
+}
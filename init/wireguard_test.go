@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseWireguardConfig(t *testing.T) {
+	privateKey := "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	publicKey := "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	content := `# booster tunnel
+[Interface]
+PrivateKey = ` + privateKey + `
+Address = 10.9.0.2/24, fd00:9::2
+DNS = 10.9.0.1, internal.example
+PostUp = iptables -A FORWARD -i wg0 -j ACCEPT
+
+[Peer]
+PublicKey = ` + publicKey + `
+Endpoint = vpn.example:51820
+AllowedIPs = 10.9.0.0/24, 192.168.50.0/24 # storage network
+PersistentKeepalive = 25
+`
+	c, err := parseWireguardConfig([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.privateKey) != 32 || len(c.peers) != 1 || len(c.peers[0].publicKey) != 32 {
+		t.Fatalf("keys are not parsed")
+	}
+	if len(c.addresses) != 2 || c.addresses[0].String() != "10.9.0.2/24" || c.addresses[1].String() != "fd00:9::2/128" {
+		t.Fatalf("unexpected addresses %v", c.addresses)
+	}
+	if len(c.dns) != 1 || !c.dns[0].Equal(net.ParseIP("10.9.0.1")) {
+		t.Fatalf("unexpected DNS servers %v", c.dns)
+	}
+	p := c.peers[0]
+	if p.endpoint != "vpn.example:51820" || p.keepalive != 25 {
+		t.Fatalf("unexpected peer endpoint %s, keepalive %d", p.endpoint, p.keepalive)
+	}
+	if len(p.allowedIps) != 2 || p.allowedIps[1].String() != "192.168.50.0/24" {
+		t.Fatalf("unexpected allowed IPs %v", p.allowedIps)
+	}
+
+	for _, invalid := range []string{
+		"[Interface]\nPrivateKey = " + privateKey + "\n",
+		"[Peer]\nEndpoint = vpn.example:51820\n",
+		"[Peer]\nPublicKey = " + publicKey + "\nEndpoint = vpn.example\n",
+		"[Peer]\nPublicKey = " + publicKey + "\nAllowedIPs = 10.9.0.0\n",
+		"[Interface]\nPrivateKey = " + privateKey[:20] + "\n[Peer]\nPublicKey = " + publicKey + "\n",
+		"PrivateKey = " + privateKey + "\n[Peer]\nPublicKey = " + publicKey + "\n",
+		"[Tunnel]\n",
+	} {
+		_, err := parseWireguardConfig([]byte(invalid))
+		if err == nil {
+			t.Fatalf("expected to fail but it did not: %q", invalid)
+		}
+		if strings.Contains(err.Error(), privateKey[:20]) {
+			t.Fatalf("error message contains the private key: %v", err)
+		}
+	}
+}
+
+func TestWireguardRoutes(t *testing.T) {
+	_, storage, _ := net.ParseCIDR("192.168.50.0/24")
+	_, all4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, all6, _ := net.ParseCIDR("::/0")
+	c := &wireguardConfig{peers: []*wireguardPeer{{allowedIps: []*net.IPNet{storage}}, {allowedIps: []*net.IPNet{all4, all6}}}}
+
+	var routes []string
+	for _, r := range wireguardRoutes(c) {
+		routes = append(routes, r.String())
+	}
+	expected := []string{"192.168.50.0/24", "0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("expected routes %v, got %v", expected, routes)
+	}
+	if !routesContain(wireguardRoutes(c), net.ParseIP("203.0.113.7")) || routesContain(wireguardRoutes(c)[:1], net.ParseIP("203.0.113.7")) {
+		t.Fatal("endpoint route check does not match the routes")
+	}
+}
+
+func TestWireguardSockaddr(t *testing.T) {
+	sa := wireguardSockaddr(&net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51820})
+	if len(sa) != unix.SizeofSockaddrInet4 || !bytes.Equal(sa[2:8], []byte{0xca, 0x6c, 203, 0, 113, 7}) {
+		t.Fatalf("unexpected IPv4 sockaddr %x", sa)
+	}
+	sa = wireguardSockaddr(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820})
+	if len(sa) != unix.SizeofSockaddrInet6 || !bytes.Equal(sa[2:4], []byte{0xca, 0x6c}) || !net.IP(sa[8:24]).Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("unexpected IPv6 sockaddr %x", sa)
+	}
+}
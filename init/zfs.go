@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// mountZfsRoot imports the ZFS pool specified with root=zfs:$DATASET boot param and mounts the dataset as the root filesystem.
+// The pool devices might not be discovered yet so the import is retried.
+func mountZfsRoot(ref *deviceRef) error {
+	if err := checkZfsSupport(); err != nil {
+		return err
+	}
+	loadModules("zfs").Wait()
+
+	data := ref.data.(zfsData)
+	var err error
+	for i := 0; i < 40; i++ {
+		err = importZfsPool(data.pool)
+		if err == nil {
+			break
+		}
+		debug("%s: %v", ref, err)
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to import ZFS pool for %s: %v", ref, err)
+	}
+
+	dataset := data.dataset
+	if dataset == "" {
+		out, err := exec.Command("zpool", "list", "-H", "-o", "bootfs").Output()
+		if err != nil {
+			return fmt.Errorf("zpool list: %v", err)
+		}
+		dataset = zpoolBootfs(string(out))
+		if dataset == "" {
+			return fmt.Errorf("%s: none of the imported ZFS pools has the bootfs property set", ref)
+		}
+		debug("%s resolved to dataset %s", ref, dataset)
+	}
+
+	deviceRefsMutex.Lock()
+	active := !rootMountStarted && cmdRoot == ref
+	if active {
+		rootMountStarted = true
+	}
+	deviceRefsMutex.Unlock()
+	if !active {
+		return fmt.Errorf("ZFS pool for %s is imported but another root device has been selected", ref)
+	}
+
+	return mountRootFs(&blkInfo{path: dataset, format: "zfs", isFs: true})
+}
+
+// mountZfsRootAsync is a goroutine wrapper for mountZfsRoot
+func mountZfsRootAsync(ref *deviceRef) {
+	if err := mountZfsRoot(ref); err != nil {
+		severe("%v", err)
+	}
+}
+
+// checkZfsSupport verifies that the image contains everything needed to mount a ZFS root
+func checkZfsSupport() error {
+	if _, err := os.Stat("/sys/module/zfs"); os.IsNotExist(err) {
+		if !hasModule("zfs") {
+			return fmt.Errorf("zfs kernel module is not available in the image, add 'zfs' to 'modules' in booster.yaml and regenerate the image")
+		}
+	}
+	if _, err := exec.LookPath("zpool"); err != nil {
+		return fmt.Errorf("zpool tool is not available in the image, add /usr/bin/zpool to 'extra_files' in booster.yaml and regenerate the image")
+	}
+	return nil
+}
+
+// importZfsPool imports the pool without mounting its datasets. An empty pool name imports all available pools.
+func importZfsPool(pool string) error {
+	args := []string{"import", "-N"}
+	if pool == "" {
+		args = append(args, "-a")
+	} else {
+		args = append(args, pool)
+	}
+	cmd := exec.Command("zpool", args...)
+	if verbosityLevel >= levelDebug {
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("zpool import: %v", err)
+	}
+	if pool == "" {
+		// 'import -a' succeeds even if there are no pools
+		out, err := exec.Command("zpool", "list", "-H", "-o", "name").Output()
+		if err != nil {
+			return fmt.Errorf("zpool list: %v", err)
+		}
+		if strings.TrimSpace(string(out)) == "" {
+			return fmt.Errorf("no ZFS pools found")
+		}
+	}
+	return nil
+}
+
+// zpoolBootfs returns the first bootfs property value from 'zpool list -H -o bootfs' output.
+// The pools that do not have the property are listed as '-'.
+func zpoolBootfs(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "-" {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestZpoolBootfs(t *testing.T) {
+	check := func(out, expected string) {
+		if bootfs := zpoolBootfs(out); bootfs != expected {
+			t.Fatalf("%q: expected bootfs '%s', got '%s'", out, expected, bootfs)
+		}
+	}
+
+	check("rpool/ROOT/default\n", "rpool/ROOT/default")
+	check("-\nrpool/ROOT/arch\n", "rpool/ROOT/arch")
+	check("-\n-\n", "")
+	check("", "")
+}